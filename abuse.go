@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// ABUSE REPORTS
+// ============================================================================
+//
+// Anyone who receives a short link can report it with POST /report. The answer is always
+// 202, whether or not the code exists, so the endpoint cannot be used to probe for links.
+// Reports are kept per link with one open report per reporting IP (stored as a keyed hash).
+// When a link collects ABUSE_REPORT_THRESHOLD reports (default 5) from distinct IPs within
+// 24 hours it is flagged: its redirect shows an interstitial until an admin reviews it.
+// Admins work through GET /admin/reports and either dismiss a link's reports, which also
+// clears the flag, or disable the link like POST /admin/urls/{code}/disable does. The
+// owner is notified of a disable through the link.disabled ops event. With a CAPTCHA
+// provider configured (captcha.go), reports must carry a captcha_token.
+
+// Abuse report reasons
+const (
+	AbuseReasonPhishing = "phishing"
+	AbuseReasonMalware  = "malware"
+	AbuseReasonSpam     = "spam"
+	AbuseReasonOther    = "other"
+)
+
+// Abuse report states
+const (
+	AbuseReportOpen      = "open"
+	AbuseReportDismissed = "dismissed"
+	AbuseReportDisabled  = "disabled"
+)
+
+// Event types for abuse handling, delivered like the quota events
+const (
+	EventLinkFlagged  = "abuse.link_flagged"
+	EventLinkDisabled = "link.disabled"
+)
+
+const (
+	defaultAbuseReportThreshold = 5
+	abuseReportWindow           = 24 * time.Hour
+	abuseReportRateLimit        = 5
+	abuseReportRateWindow       = time.Hour
+	maxAbuseReportDetails       = 1000
+	abuseReviewQueueLimit       = 1000
+)
+
+var abuseReasons = map[string]bool{
+	AbuseReasonPhishing: true,
+	AbuseReasonMalware:  true,
+	AbuseReasonSpam:     true,
+	AbuseReasonOther:    true,
+}
+
+// AbuseReport is one report of a link, stored in abuse_reports
+type AbuseReport struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URLID      primitive.ObjectID `bson:"url_id" json:"-"`
+	ShortURL   string             `bson:"short_url" json:"short_url"`
+	OwnerID    string             `bson:"owner_id" json:"owner_id"`
+	Reason     string             `bson:"reason" json:"reason"`
+	Details    string             `bson:"details,omitempty" json:"details,omitempty"`
+	IPHash     string             `bson:"ip_hash" json:"-"`
+	Status     string             `bson:"status" json:"status"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ResolvedAt *time.Time         `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+}
+
+// abuseReportRequest is the body of POST /report
+type abuseReportRequest struct {
+	ShortURL     string `json:"short_url"`
+	Reason       string `json:"reason"`
+	Details      string `json:"details"`
+	CaptchaToken string `json:"captcha_token"`
+}
+
+// reportedCode extracts the short code from a reported code or full short URL
+func reportedCode(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		if parsed, err := url.Parse(raw); err == nil {
+			raw = parsed.Path
+		}
+		raw = strings.Trim(raw, "/")
+		if i := strings.LastIndex(raw, "/"); i >= 0 {
+			raw = raw[i+1:]
+		}
+	}
+	return sanitizeInput(raw)
+}
+
+// writeReportAccepted answers every well-formed report the same way
+func writeReportAccepted(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Thanks, your report was received",
+	}); err != nil {
+		log.Printf("error encoding report response: %v", err)
+	}
+}
+
+// reportLink handles POST /report (public)
+func reportLink(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	policy := requestConfig(r).RateLimit("report")
+	if limit := checkRateLimit("report:"+rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+		writeRateLimited(w, limit)
+		return
+	}
+
+	var req abuseReportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	code := reportedCode(req.ShortURL)
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "short_url must be a short code or short URL", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.ToLower(strings.TrimSpace(req.Reason))
+	if !abuseReasons[req.Reason] {
+		http.Error(w, "reason must be one of phishing, malware, spam or other", http.StatusBadRequest)
+		return
+	}
+	details := []rune(sanitizeInput(req.Details))
+	if len(details) > maxAbuseReportDetails {
+		details = details[:maxAbuseReportDetails]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if ok, err := verifyCaptcha(ctx, req.CaptchaToken, clientIP); err != nil {
+		log.Printf("error verifying captcha: %v", err)
+		http.Error(w, "CAPTCHA verification is unavailable, please try again later", http.StatusServiceUnavailable)
+		return
+	} else if !ok {
+		http.Error(w, "CAPTCHA verification failed", http.StatusBadRequest)
+		return
+	}
+
+	// Unknown, expired and disabled codes get the same answer as live ones
+	urls := linkStore(r)
+	link, err := urls.FindRedirectTarget(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		writeReportAccepted(w)
+		return
+	} else if err != nil {
+		log.Printf("error loading reported link %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	report := &AbuseReport{
+		ID:        primitive.NewObjectID(),
+		URLID:     link.ID,
+		ShortURL:  link.ShortURL,
+		OwnerID:   link.UserID,
+		Reason:    req.Reason,
+		Details:   string(details),
+		IPHash:    hashIP(clientIP),
+		Status:    AbuseReportOpen,
+		CreatedAt: clock.Now().UTC(),
+	}
+	if err := urls.InsertAbuseReport(ctx, report); errors.Is(err, ErrDuplicate) {
+		// The same IP reporting again does not count twice
+		writeReportAccepted(w)
+		return
+	} else if err != nil {
+		log.Printf("error storing abuse report for %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	incMetric("abuse_reports_total", 1)
+	logSecurityEvent(r.Context(), "ABUSE_REPORTED", link.UserID, clientIP, r.UserAgent(),
+		"Link reported for "+req.Reason+": "+code, "WARN")
+
+	if !link.AbuseFlagged {
+		flagReportedLink(ctx, r, urls, link)
+	}
+	writeReportAccepted(w)
+}
+
+// flagReportedLink puts link behind the interstitial once enough distinct IPs reported it
+func flagReportedLink(ctx context.Context, r *http.Request, urls URLStore, link *URLData) {
+	reporters, err := urls.CountAbuseReporters(ctx, link.ID, clock.Now().Add(-abuseReportWindow))
+	if err != nil {
+		log.Printf("error counting abuse reports for %s: %v", link.ShortURL, err)
+		return
+	}
+	if reporters < int64(envInt("ABUSE_REPORT_THRESHOLD", defaultAbuseReportThreshold)) {
+		return
+	}
+	if _, err := urls.SetAbuseFlag(ctx, link.ShortURL, true); err != nil {
+		log.Printf("error flagging reported link %s: %v", link.ShortURL, err)
+		return
+	}
+	logSecurityEvent(r.Context(), "LINK_AUTO_FLAGGED", link.UserID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Link %s flagged for review after %d reports", link.ShortURL, reporters), "WARN")
+	emitOpsEvent(EventLinkFlagged, link.ShortURL, map[string]interface{}{
+		"short_url": link.ShortURL,
+		"user_id":   link.UserID,
+		"reports":   reporters,
+	})
+}
+
+// writeReportedInterstitial shows the destination of a flagged link on a page instead of
+// redirecting to it
+func writeReportedInterstitial(w http.ResponseWriter, r *http.Request, destination, note string) {
+	setNoStoreHeaders(w)
+	writeLocalizedNotePage(w, r, http.StatusOK, "link_reported", destination, note)
+}
+
+// ----------------------------------------------------------------------------
+// Admin review
+// ----------------------------------------------------------------------------
+
+// abuseQueueEntry summarizes the open reports of one link for the review queue
+type abuseQueueEntry struct {
+	ShortURL        string         `json:"short_url"`
+	OwnerID         string         `json:"owner_id"`
+	Reports         int            `json:"reports"`
+	Reasons         map[string]int `json:"reasons"`
+	Details         []string       `json:"details,omitempty"`
+	Flagged         bool           `json:"flagged"`
+	FirstReportedAt time.Time      `json:"first_reported_at"`
+	LastReportedAt  time.Time      `json:"last_reported_at"`
+}
+
+// adminListReports handles GET /admin/reports: open reports grouped by link, most
+// reported first
+func adminListReports(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reports, err := Links.ListAbuseReports(ctx, abuseReviewQueueLimit)
+	if err != nil {
+		log.Printf("error listing abuse reports: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	byCode := make(map[string]*abuseQueueEntry)
+	queue := []*abuseQueueEntry{}
+	for _, report := range reports {
+		entry, ok := byCode[report.ShortURL]
+		if !ok {
+			entry = &abuseQueueEntry{
+				ShortURL:        report.ShortURL,
+				OwnerID:         report.OwnerID,
+				Reasons:         make(map[string]int),
+				FirstReportedAt: report.CreatedAt,
+			}
+			byCode[report.ShortURL] = entry
+			queue = append(queue, entry)
+		}
+		entry.Reports++
+		entry.Reasons[report.Reason]++
+		entry.LastReportedAt = report.CreatedAt
+		if report.Details != "" && len(entry.Details) < 5 {
+			entry.Details = append(entry.Details, report.Details)
+		}
+	}
+	for _, entry := range queue {
+		if link, err := Links.FindLinkByCode(ctx, entry.ShortURL); err == nil {
+			entry.Flagged = link.AbuseFlagged
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].Reports > queue[j].Reports })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"links":   queue,
+		"count":   len(queue),
+	}); err != nil {
+		log.Printf("error encoding abuse report queue: %v", err)
+	}
+}
+
+// adminDismissReports handles POST /admin/reports/{code}/dismiss: closes the link's open
+// reports and lifts its flag
+func adminDismissReports(w http.ResponseWriter, r *http.Request) {
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closed, err := Links.ResolveAbuseReports(ctx, code, AbuseReportDismissed)
+	if err != nil {
+		log.Printf("error dismissing abuse reports for %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := Links.SetAbuseFlag(ctx, code, false); err != nil {
+		log.Printf("error clearing abuse flag of %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "ABUSE_REPORTS_DISMISSED", adminID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Dismissed %d reports of %s", closed, code), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"short_url": code,
+		"dismissed": closed,
+	}); err != nil {
+		log.Printf("error encoding dismiss response: %v", err)
+	}
+}
+
+// adminDisableReported handles POST /admin/reports/{code}/disable: disables the link and
+// closes its open reports
+func adminDisableReported(w http.ResponseWriter, r *http.Request) {
+	code, ok := disableLinkFromRequest(w, r, "reported abuse")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	closed, err := Links.ResolveAbuseReports(ctx, code, AbuseReportDisabled)
+	if err != nil {
+		log.Printf("error closing abuse reports for %s: %v", code, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"short_url": code,
+		"disabled":  true,
+		"resolved":  closed,
+	}); err != nil {
+		log.Printf("error encoding disable response: %v", err)
+	}
+}
+
+// adminDisableURL handles POST /admin/urls/{code}/disable with an optional {"reason": "..."}
+func adminDisableURL(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+	}
+	code, ok := disableLinkFromRequest(w, r, sanitizeInput(body.Reason))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"short_url": code,
+		"disabled":  true,
+	}); err != nil {
+		log.Printf("error encoding disable response: %v", err)
+	}
+}
+
+// disableLinkFromRequest switches off the link named by the {code} route variable and
+// notifies its owner, answering the error itself when it returns false
+func disableLinkFromRequest(w http.ResponseWriter, r *http.Request, reason string) (string, bool) {
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return "", false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := Links.FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && link.DeactivatedReason == DeactivatedDraft) {
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return "", false
+	} else if err != nil {
+		log.Printf("error loading link %s to disable: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return "", false
+	}
+	if _, err := Links.DeactivateLink(ctx, link.UserID, code, DeactivatedDisabled); err != nil {
+		log.Printf("error disabling link %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return "", false
+	}
+	forgetResolvedLink(code)
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	details := "Link " + code + " disabled by an admin"
+	if reason != "" {
+		details += ": " + reason
+	}
+	logSecurityEvent(r.Context(), "LINK_DISABLED_BY_ADMIN", adminID, getClientIP(r), r.UserAgent(), details, "WARN")
+
+	data := map[string]interface{}{
+		"short_url": code,
+		"user_id":   link.UserID,
+		"reason":    reason,
+	}
+	if id, err := primitive.ObjectIDFromHex(link.UserID); err == nil {
+		if owner, err := Users.GetUserByID(ctx, id); err == nil {
+			data["email"] = owner.Email
+		}
+	}
+	emitOpsEvent(EventLinkDisabled, code, data)
+	return code, true
+}
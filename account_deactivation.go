@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// SELF-SERVICE DEACTIVATION
+// ============================================================================
+//
+// POST /auth/deactivate with {"password": "..."} pauses the caller's account: it becomes
+// inactive like a suspended one, so its links answer 410 and drop out of public resolve,
+// its refresh token is revoked and its access tokens are refused. Nothing is written to
+// the links, so reactivation brings back exactly the links that would work anyway; links
+// that expired in the meantime stay expired. Logging in to a paused account answers 403
+// ACCOUNT_DEACTIVATED and mails a reactivation token (see mailer.go), which POST
+// /auth/reactivate with {"token": "..."} redeems. The token is signed with JWT_SECRET, is
+// valid for a day and is bound to the moment of deactivation, so it works once and not for
+// a later deactivation. Accounts suspended by an admin cannot be reactivated this way, and
+// an admin suspend or unsuspend cancels a self-deactivation.
+
+const (
+	reactivationTokenValidity = 24 * time.Hour
+	reactivationMailInterval  = 10 * time.Minute
+)
+
+// ErrAccountDeactivated is returned with the user for the right password of a paused account
+var ErrAccountDeactivated = errors.New("account deactivated by its owner")
+
+// reactivationSignature signs the reactivation token payload
+func reactivationSignature(payload string) string {
+	mac := hmac.New(sha256.New, JWTSecret)
+	mac.Write([]byte("account-reactivation\x00" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reactivationToken returns "<user id>.<deactivated at, unix ms>.<expiry, unix s>.<signature>"
+func reactivationToken(user *User, now time.Time) string {
+	payload := fmt.Sprintf("%s.%d.%d", user.ID.Hex(), user.DeactivatedAt.UnixMilli(),
+		now.Add(reactivationTokenValidity).Unix())
+	return payload + "." + reactivationSignature(payload)
+}
+
+// parseReactivationToken checks token and returns the user and deactivation it was issued for
+func parseReactivationToken(token string, now time.Time) (primitive.ObjectID, time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return primitive.NilObjectID, time.Time{}, false
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(reactivationSignature(payload))) {
+		return primitive.NilObjectID, time.Time{}, false
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return primitive.NilObjectID, time.Time{}, false
+	}
+	deactivatedAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return primitive.NilObjectID, time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return primitive.NilObjectID, time.Time{}, false
+	}
+	return id, time.UnixMilli(deactivatedAt).UTC(), true
+}
+
+// sendReactivationMail mails user a reactivation token, at most once per
+// reactivationMailInterval; false when one was sent recently
+func sendReactivationMail(r *http.Request, user *User) bool {
+	if limit := checkRateLimit("reactivation-mail:"+user.ID.Hex(), 1, reactivationMailInterval); limit.Limited {
+		return false
+	}
+	body := fmt.Sprintf("Your account %s is deactivated.\n\n"+
+		"To reactivate it, send this token to POST %s/auth/reactivate as {\"token\": \"...\"}:\n\n%s\n\n"+
+		"The token is valid for 24 hours. If you did not try to log in, you can ignore this mail.\n",
+		user.Username, requestBaseURL(r), reactivationToken(user, time.Now()))
+	go func(to string) {
+		if err := sendMail(to, "Reactivate your account", body); err != nil {
+			log.Printf("error sending reactivation mail to user %s: %v", user.ID.Hex(), err)
+		}
+	}(user.Email)
+	return true
+}
+
+// deactivateAccount handles POST /auth/deactivate
+func deactivateAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "password is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "user", "failed to load account")
+		return
+	}
+	if err := CheckPassword(req.Password, user.Password); err != nil {
+		logSecurityEvent(r.Context(), "DEACTIVATION_FAILED", userID, getClientIP(r), r.UserAgent(),
+			"Wrong password for account deactivation", "WARN")
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Millisecond precision so the time survives every backend and the token
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	found, err := Users.DeactivateUser(ctx, user.ID, at)
+	if err != nil {
+		log.Printf("error deactivating user %s: %v", userID, err)
+		writeStoreError(w, err, "user", "failed to deactivate account")
+		return
+	}
+	if !found {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	suspendedOwners.set(userID, true)
+	invalidateUserStats(userID)
+	clearSessionCookies(w)
+
+	logSecurityEvent(r.Context(), "ACCOUNT_DEACTIVATED", userID, getClientIP(r), r.UserAgent(),
+		"Account deactivated by its owner", "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"message":        "Account deactivated. Log in again to get a reactivation token by email.",
+		"deactivated_at": at,
+	}); err != nil {
+		log.Printf("error encoding deactivation response: %v", err)
+	}
+}
+
+// writeAccountDeactivated answers a login to a paused account and mails a reactivation token
+func writeAccountDeactivated(w http.ResponseWriter, r *http.Request, user *User) {
+	sent := sendReactivationMail(r, user)
+	details := "Login to deactivated account; reactivation mail sent"
+	if !sent {
+		details = "Login to deactivated account; reactivation mail sent recently"
+	}
+	logSecurityEvent(r.Context(), "REACTIVATION_REQUESTED", user.ID.Hex(), getClientIP(r), r.UserAgent(),
+		details, "INFO")
+	writeJSONError(w, http.StatusForbidden, ErrCodeAccountDeactivated,
+		"This account is deactivated. A reactivation token was sent to its email address.", nil)
+}
+
+// reactivateAccount handles POST /auth/reactivate
+func reactivateAccount(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	policy := requestConfig(r).RateLimit("reactivate")
+	if limit := checkRateLimit("reactivate:"+rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+		writeRateLimited(w, limit)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	id, deactivatedAt, ok := parseReactivationToken(strings.TrimSpace(req.Token), time.Now())
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, ErrCodeReactivationInvalid, "Invalid or expired reactivation token", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	restored, err := Users.ReactivateUser(ctx, id, deactivatedAt)
+	if err != nil {
+		log.Printf("error reactivating user %s: %v", id.Hex(), err)
+		writeStoreError(w, err, "user", "failed to reactivate account")
+		return
+	}
+	if !restored {
+		// Used already, superseded by a later deactivation, or the account was suspended
+		writeJSONError(w, http.StatusBadRequest, ErrCodeReactivationInvalid, "Invalid or expired reactivation token", nil)
+		return
+	}
+	suspendedOwners.set(id.Hex(), false)
+
+	logSecurityEvent(r.Context(), "ACCOUNT_REACTIVATED", id.Hex(), clientIP, r.UserAgent(),
+		"Account reactivated by its owner", "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Account reactivated. You can log in again.",
+		"user_id": id.Hex(),
+	}); err != nil {
+		log.Printf("error encoding reactivation response: %v", err)
+	}
+}
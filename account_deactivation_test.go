@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mailedReactivationToken is a reactivation token as sendMail logs it without SMTP_ADDR
+var mailedReactivationToken = regexp.MustCompile(`[0-9a-f]{24}\.\d+\.\d+\.[0-9a-f]{64}`)
+
+// login posts credentials to /auth/login and decodes the answer into out
+func (s *testServer) login(username, password string, out interface{}) *http.Response {
+	s.t.Helper()
+	return s.do("POST", "/auth/login", "", map[string]string{"username_or_email": username, "password": password}, out)
+}
+
+func TestDeactivateReactivateCycle(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "")
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	t.Cleanup(func() { suspendedOwners.set(userID, false) })
+	user, err := GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/live"})
+	lapsing := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/lapsing"})
+	for _, code := range []string{live, lapsing} {
+		if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("before the pause, /%s: status %d", code, resp.StatusCode)
+		}
+	}
+
+	// Pause
+	if resp := srv.do("POST", "/auth/deactivate", token, map[string]string{"password": "wrong"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", resp.StatusCode)
+	}
+	resp := srv.do("POST", "/auth/deactivate", token, map[string]string{"password": "correct-horse-1"}, nil)
+	if resp.StatusCode != http.StatusOK || len(resp.Cookies()) == 0 {
+		t.Fatalf("deactivate: status %d, %d cookies cleared", resp.StatusCode, len(resp.Cookies()))
+	}
+	for _, code := range []string{live, lapsing} {
+		if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusGone {
+			t.Fatalf("paused link /%s: status %d", code, resp.StatusCode)
+		}
+	}
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("access token of a paused account: status %d", resp.StatusCode)
+	}
+	// One link expires while the account is paused
+	expired := time.Now().Add(-time.Minute)
+	srv.editStored(lapsing, LinkEdit{ExpiresAt: &expired})
+
+	// Logging in mails a reactivation token, once in a while only
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if resp := srv.login(user.Username, "correct-horse-1", &refused); resp.StatusCode != http.StatusForbidden || refused.Error.Code != ErrCodeAccountDeactivated {
+		t.Fatalf("login to a paused account: status %d, code %q", resp.StatusCode, refused.Error.Code)
+	}
+	if !logs.waitFor("Reactivate your account") {
+		t.Fatal("no reactivation mail")
+	}
+	srv.login(user.Username, "correct-horse-1", nil)
+	if n := strings.Count(logs.String(), "Subject: Reactivate your account"); n != 1 {
+		t.Fatalf("%d reactivation mails for two logins", n)
+	}
+	if resp := srv.login(user.Username, "wrong", &refused); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password for a paused account: status %d", resp.StatusCode)
+	}
+	reactivation := mailedReactivationToken.FindString(logs.String())
+	if reactivation == "" {
+		t.Fatalf("no token in the mail:\n%s", logs)
+	}
+
+	// Resume
+	last := "0"
+	if strings.HasSuffix(reactivation, last) {
+		last = "1"
+	}
+	for _, bad := range []string{"", "nonsense", reactivation[:len(reactivation)-1] + last, strings.Replace(reactivation, ".", ".9", 1)} {
+		if resp := srv.do("POST", "/auth/reactivate", "", map[string]string{"token": bad}, &refused); resp.StatusCode != http.StatusBadRequest || refused.Error.Code != ErrCodeReactivationInvalid {
+			t.Errorf("token %q: status %d, code %q", bad, resp.StatusCode, refused.Error.Code)
+		}
+	}
+	if resp := srv.do("POST", "/auth/reactivate", "", map[string]string{"token": reactivation}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reactivate: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", "/"+live, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("link after reactivation: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", "/"+lapsing, "", nil, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("link that expired during the pause: status %d", resp.StatusCode)
+	}
+	if resp := srv.login(user.Username, "correct-horse-1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after reactivation: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("POST", "/auth/reactivate", "", map[string]string{"token": reactivation}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("token used twice: status %d", resp.StatusCode)
+	}
+
+	for _, event := range []string{"DEACTIVATION_FAILED", "ACCOUNT_DEACTIVATED", "REACTIVATION_REQUESTED", "ACCOUNT_REACTIVATED"} {
+		if !logs.waitFor(event) {
+			t.Errorf("%s not logged", event)
+		}
+	}
+}
+
+func TestReactivationTokenLimits(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, userID := srv.register()
+	t.Cleanup(func() { suspendedOwners.set(userID, false) })
+	user, err := GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.do("POST", "/auth/deactivate", token, map[string]string{"password": "correct-horse-1"}, nil)
+	if user, err = Users.FindDeactivatedUser(context.Background(), user.Username); err != nil || user.DeactivatedAt.IsZero() {
+		t.Fatalf("paused user %+v, %v", user, err)
+	}
+
+	// The token lasts a day
+	now := time.Now()
+	issued := reactivationToken(user, now)
+	if _, _, ok := parseReactivationToken(issued, now.Add(reactivationTokenValidity-time.Minute)); !ok {
+		t.Fatal("token refused within its day")
+	}
+	if _, _, ok := parseReactivationToken(issued, now.Add(reactivationTokenValidity+time.Second)); ok {
+		t.Fatal("token accepted after a day")
+	}
+
+	// An admin suspension takes precedence over the owner's pause
+	srv.do("POST", "/admin/users/"+userID+"/suspend", admin, map[string]interface{}{}, nil)
+	if resp := srv.do("POST", "/auth/reactivate", "", map[string]string{"token": issued}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reactivation of a suspended account: status %d", resp.StatusCode)
+	}
+	if _, err := GetUserByID(userID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("suspended account reactivated: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ============================================================================
+// ANALYTICS QUERY BENCHMARK (CLI: bench-analytics)
+// ============================================================================
+
+const (
+	benchAnalyticsLinks      = 10000
+	benchAnalyticsIterations = 20
+	benchAnalyticsPageSize   = 20
+)
+
+// runAnalyticsBenchmark seeds links for a throwaway user, then times the legacy analytics
+// queries (stats pipelines + count + page) against the single faceted aggregation and checks
+// that both return the same data. The seeded links are removed afterwards.
+func runAnalyticsBenchmark() error {
+	userID := "bench-analytics-" + InstanceID
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	log.Printf("🌱 Seeding %d links for %s...", benchAnalyticsLinks, userID)
+	if err := seedAnalyticsBenchmark(ctx, userID, benchAnalyticsLinks); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := DB.Collection.DeleteMany(context.Background(), bson.M{"user_id": userID}); err != nil {
+			log.Printf("Warning: failed to remove benchmark links: %v", err)
+		}
+	}()
+
+	legacy := func() (interface{}, error) {
+		return legacyAnalyticsPage(ctx, userID, LinkFilter{}, 0, benchAnalyticsPageSize)
+	}
+	faceted := func() (interface{}, error) {
+		return facetedAnalyticsPage(userID, LinkFilter{}, 0, benchAnalyticsPageSize)
+	}
+
+	legacyResult, legacyAvg, err := timeAnalyticsQuery(legacy)
+	if err != nil {
+		return fmt.Errorf("legacy analytics: %w", err)
+	}
+	facetResult, facetAvg, err := timeAnalyticsQuery(faceted)
+	if err != nil {
+		return fmt.Errorf("faceted analytics: %w", err)
+	}
+
+	log.Printf("⏱️  legacy (7 round trips): avg %v over %d runs", legacyAvg, benchAnalyticsIterations)
+	log.Printf("⏱️  faceted (1 round trip): avg %v over %d runs", facetAvg, benchAnalyticsIterations)
+
+	if !sameAnalyticsResult(legacyResult, facetResult) {
+		return fmt.Errorf("faceted analytics result differs from legacy result")
+	}
+	log.Println("✅ Faceted and legacy analytics results are identical")
+	return nil
+}
+
+// legacyAnalyticsPage answers the analytics listing the way it was before the faceted
+// aggregation: the statistics pipelines, a count and the page, one round trip each
+func legacyAnalyticsPage(ctx context.Context, userID string, filter LinkFilter, skip, limit int) (map[string]interface{}, error) {
+	stats, err := GetUserStatsOptimized(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	total, err := DB.Collection.CountDocuments(ctx, append(filter.mongoBaseMatch(userID), filter.mongoMatch()...))
+	if err != nil {
+		return nil, err
+	}
+	urls, err := GetUserURLsPaginated(userID, filter, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"statistics": stats, "urls": urls, "total": total}, nil
+}
+
+// facetedAnalyticsPage answers the analytics listing from the single faceted aggregation
+func facetedAnalyticsPage(userID string, filter LinkFilter, skip, limit int) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	urls, total, stats, err := GetUserAnalyticsPage(ctx, DB.Collection, userID, filter, skip, limit, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"statistics": stats, "urls": urls, "total": total}, nil
+}
+
+// timeAnalyticsQuery runs query benchAnalyticsIterations times and returns the last result
+// and the average latency
+func timeAnalyticsQuery(query func() (interface{}, error)) (interface{}, time.Duration, error) {
+	var result interface{}
+	var total time.Duration
+	for i := 0; i < benchAnalyticsIterations; i++ {
+		start := time.Now()
+		res, err := query()
+		if err != nil {
+			return nil, 0, err
+		}
+		total += time.Since(start)
+		result = res
+	}
+	return result, total / benchAnalyticsIterations, nil
+}
+
+// seedAnalyticsBenchmark inserts n links with varied tags, domains and recent clicks
+func seedAnalyticsBenchmark(ctx context.Context, userID string, n int) error {
+	rng := rand.New(rand.NewSource(42))
+	tags := []string{"education", "technology", "science", "health", "news", "sports", "travel", "food", "music", "art", "finance", "games"}
+	domains := []string{"http://localhost:8080", "http://rapidlink.com", "https://go.example.com"}
+	now := time.Now().UTC()
+
+	batch := make([]interface{}, 0, 1000)
+	for i := 0; i < n; i++ {
+		clicks := rng.Intn(50)
+		if i < 10 {
+			clicks = 1000 + i // distinct top links so both queries agree on the top 10
+		}
+		history := make([]ClickHistory, 0, 3)
+		for c := 0; c < clicks && c < 3; c++ {
+			history = append(history, ClickHistory{Timestamp: now.Add(-time.Duration(rng.Intn(20*24)) * time.Hour)})
+		}
+		batch = append(batch, URLData{
+			ShortURL: fmt.Sprintf("bench-%s-%d", InstanceID, i),
+			LongURL:  fmt.Sprintf("https://example.com/article/%d", i),
+			Domain:   domains[rng.Intn(len(domains))],
+			// Skewed so tag counts are distinct at the top-10 cut-off
+			Tags:         []string{tags[rng.Intn(rng.Intn(len(tags))+1)], tags[rng.Intn(len(tags))]},
+			UserID:       userID,
+			CreatedAt:    now.Add(-time.Duration(i) * time.Minute),
+			Clicks:       clicks,
+			IsActive:     true,
+			ClickHistory: history,
+		})
+		if len(batch) == cap(batch) || i == n-1 {
+			if _, err := DB.Collection.InsertMany(ctx, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return nil
+}
+
+// sameAnalyticsResult compares two results through their JSON encoding. Distributions are
+// sorted first because documents with equal counts have no defined order in either query.
+func sameAnalyticsResult(a, b interface{}) bool {
+	normalize := func(v interface{}) interface{} {
+		raw, _ := json.Marshal(v)
+		var out map[string]interface{}
+		json.Unmarshal(raw, &out)
+		if stats, ok := out["statistics"].(map[string]interface{}); ok {
+			for _, key := range []string{"tag_distribution", "domain_distribution", "top_links"} {
+				if list, ok := stats[key].([]interface{}); ok {
+					sort.Slice(list, func(i, j int) bool {
+						x, _ := json.Marshal(list[i])
+						y, _ := json.Marshal(list[j])
+						return string(x) < string(y)
+					})
+				}
+			}
+		}
+		return out
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// PUBLIC ANALYTICS SHARES
+// ============================================================================
+//
+// An owner shows a client the live numbers of one link, or of the links in one folder (the
+// closest thing to a campaign here), without giving them an account: POST /analytics/shares
+// returns a secret URL, GET /public/analytics/{token}, serving a read-only summary of the
+// last shareStatsDays days as JSON, or as a small page to browsers. The summary has clicks
+// per day, totals and the top referrer hosts; no destinations, IPs or visitor details.
+// Only the token's SHA-256 is stored, and an optional passcode is kept as a bcrypt hash and
+// sent in the X-Share-Passcode header, or POSTed by the page's form so that it stays out of
+// URLs, browser history and the access log, which also redacts the token.
+//
+// The share alone decides what is shown: the token names no resource, and every link is
+// checked against the share's owner and scope before it is counted. Summaries are cached for
+// shareStatsCacheTTL, but the share itself is looked up on every request, so expiry and
+// DELETE /analytics/shares/{id} take effect at once. Owners list their shares with
+// GET /analytics/shares. Public requests are rate limited per IP by the public_share policy.
+
+const (
+	shareScopeLink   = "link"
+	shareScopeFolder = "folder"
+
+	maxAnalyticsSharesPerUser = 50
+	defaultShareExpiry        = "30d"
+	maxShareExpiry            = 365 * 24 * time.Hour
+	minSharePasscodeLength    = 6
+	maxSharePasscodeLength    = 72 // bcrypt ignores the rest
+	shareStatsDays            = 30
+	shareStatsCacheTTL        = 5 * time.Minute
+	maxSharedFolderLinks      = 100
+	shareTopReferrers         = 10
+	publicShareRateLimit      = 60 // requests per minute per IP
+	publicShareRateWindow     = time.Minute
+)
+
+// AnalyticsShare is a public share of a link's or folder's analytics
+type AnalyticsShare struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	UserID    string             `bson:"user_id" json:"-"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	Scope     string             `bson:"scope" json:"scope"`
+	// ResourceID is the ID of the shared link or folder
+	ResourceID string `bson:"resource_id" json:"resource_id"`
+	// Label is the link's short code or the folder's name when the share was made
+	Label        string     `bson:"label" json:"label"`
+	PasscodeHash string     `bson:"passcode_hash,omitempty" json:"-"`
+	ExpiresAt    time.Time  `bson:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time  `bson:"created_at" json:"created_at"`
+	RevokedAt    *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// activeAt reports whether the share is neither revoked nor expired at now
+func (s *AnalyticsShare) activeAt(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// shareView is how owners see a share
+type shareView struct {
+	*AnalyticsShare
+	Passcode bool   `json:"passcode"`
+	Active   bool   `json:"active"`
+	URL      string `json:"url,omitempty"`
+}
+
+// analyticsShareRequest is the body of POST /analytics/shares; exactly one of ShortURL and
+// FolderID is set
+type analyticsShareRequest struct {
+	ShortURL  string `json:"short_url"`
+	FolderID  string `json:"folder_id"`
+	ExpiresIn string `json:"expires_in"` // e.g. 7d, 2w, 6m; default 30d, at most 1y
+	Passcode  string `json:"passcode"`
+}
+
+// newShareToken returns a random share token and the hash stored for it
+func newShareToken() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashShareToken(token), nil
+}
+
+// hashShareToken returns the stored form of token
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// shareAdmits reports whether share exposes link: a link of the share's owner that is the
+// shared link, or lies in the shared folder
+func shareAdmits(share *AnalyticsShare, link *URLData) bool {
+	if share == nil || link == nil || share.UserID == "" || link.UserID != share.UserID {
+		return false
+	}
+	switch share.Scope {
+	case shareScopeLink:
+		return link.ID.Hex() == share.ResourceID
+	case shareScopeFolder:
+		return share.ResourceID != "" && link.FolderID == share.ResourceID
+	}
+	return false
+}
+
+// sharedLinks returns the links share exposes and the title to show; ErrNotFound when the
+// link or folder is gone. Links are filtered by shareAdmits whatever the store returned.
+func sharedLinks(ctx context.Context, store URLStore, share *AnalyticsShare) ([]*URLData, string, error) {
+	var candidates []*URLData
+	title := share.Label
+	switch share.Scope {
+	case shareScopeLink:
+		link, err := store.FindLinkByCode(ctx, share.Label)
+		if err != nil {
+			return nil, "", err
+		}
+		// A code freed and taken again is a different link
+		if !shareAdmits(share, link) || link.DeactivatedReason == DeactivatedDraft {
+			return nil, "", ErrNotFound
+		}
+		candidates = []*URLData{link}
+	case shareScopeFolder:
+		id, err := primitive.ObjectIDFromHex(share.ResourceID)
+		if err != nil {
+			return nil, "", ErrNotFound
+		}
+		folder, err := store.FindFolder(ctx, share.UserID, id)
+		if err != nil {
+			return nil, "", err
+		}
+		title = folder.Name
+		docs, _, _, err := store.ListLinks(ctx, share.UserID, LinkFilter{FolderIDs: []string{share.ResourceID}}, 0, maxSharedFolderLinks, false, []string{"short_url"})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, doc := range docs {
+			code, _ := doc["short_url"].(string)
+			link, err := store.FindLinkByCode(ctx, code)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return nil, "", err
+			}
+			candidates = append(candidates, link)
+		}
+	default:
+		return nil, "", ErrNotFound
+	}
+
+	links := make([]*URLData, 0, len(candidates))
+	for _, link := range candidates {
+		if shareAdmits(share, link) {
+			links = append(links, link)
+		}
+	}
+	return links, title, nil
+}
+
+// ShareDashboard is the public summary of a share
+type ShareDashboard struct {
+	Scope         string            `json:"scope"`
+	Title         string            `json:"title"`
+	From          time.Time         `json:"from"`
+	To            time.Time         `json:"to"`
+	AsOf          time.Time         `json:"as_of"`
+	Clicks        int64             `json:"clicks"`
+	AllTimeClicks int64             `json:"all_time_clicks"`
+	Daily         []shareDay        `json:"daily"`
+	TopReferrers  []shareReferrer   `json:"top_referrers"`
+	Links         []sharedLinkStats `json:"links,omitempty"`
+	// Truncated is set when the clicks per day could not all be read
+	Truncated bool   `json:"truncated,omitempty"`
+	Notice    string `json:"notice,omitempty"`
+}
+
+type shareDay struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type shareReferrer struct {
+	Host   string `json:"host"`
+	Clicks int64  `json:"clicks"`
+}
+
+// sharedLinkStats is one link of a shared folder
+type sharedLinkStats struct {
+	ShortURL string `json:"short_url"`
+	Clicks   int64  `json:"clicks"`
+}
+
+// buildShareDashboard counts the human clicks of links in the shareStatsDays UTC days up to now
+func buildShareDashboard(ctx context.Context, store URLStore, share *AnalyticsShare, links []*URLData, title string, now time.Time) (*ShareDashboard, error) {
+	to := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -shareStatsDays)
+	dashboard := &ShareDashboard{
+		Scope: share.Scope,
+		Title: title,
+		From:  from,
+		To:    to,
+		AsOf:  now.UTC().Truncate(time.Second),
+	}
+	perDay := make(map[string]int64, shareStatsDays)
+	referrers := map[string]int64{}
+	rowBudget := maxClickExportRows
+	untracked := 0
+	for _, link := range links {
+		if link.AnalyticsDisabled {
+			untracked++
+			continue
+		}
+		dashboard.AllTimeClicks += int64(link.Clicks)
+		window, err := store.CountClickWindow(ctx, link, from, to)
+		if err != nil {
+			return nil, err
+		}
+		dashboard.Clicks += window.Clicks
+		for host, clicks := range window.Referrers {
+			referrers[host] += clicks
+		}
+		if share.Scope == shareScopeFolder {
+			dashboard.Links = append(dashboard.Links, sharedLinkStats{ShortURL: link.ShortURL, Clicks: window.Clicks})
+		}
+		if rowBudget == 0 {
+			dashboard.Truncated = true
+			continue
+		}
+		query := ClickExportQuery{UserID: share.UserID, Link: link, From: from, To: to, Limit: rowBudget}
+		rows := 0
+		err = store.ExportClicks(ctx, query, func(row ClickExportRow) error {
+			rows++
+			if !row.Bot {
+				perDay[row.Timestamp.UTC().Format("2006-01-02")]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if rowBudget -= rows; rowBudget <= 0 {
+			rowBudget = 0
+			dashboard.Truncated = true
+		}
+	}
+
+	dashboard.Daily = make([]shareDay, 0, shareStatsDays)
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		dashboard.Daily = append(dashboard.Daily, shareDay{Date: date, Clicks: perDay[date]})
+	}
+	dashboard.TopReferrers = make([]shareReferrer, 0, len(referrers))
+	for host, clicks := range referrers {
+		dashboard.TopReferrers = append(dashboard.TopReferrers, shareReferrer{Host: host, Clicks: clicks})
+	}
+	sort.Slice(dashboard.TopReferrers, func(i, j int) bool {
+		a, b := dashboard.TopReferrers[i], dashboard.TopReferrers[j]
+		return a.Clicks > b.Clicks || (a.Clicks == b.Clicks && a.Host < b.Host)
+	})
+	if len(dashboard.TopReferrers) > shareTopReferrers {
+		dashboard.TopReferrers = dashboard.TopReferrers[:shareTopReferrers]
+	}
+	sort.SliceStable(dashboard.Links, func(i, j int) bool { return dashboard.Links[i].Clicks > dashboard.Links[j].Clicks })
+	if untracked > 0 {
+		dashboard.Notice = fmt.Sprintf("%d link(s) have analytics disabled and are not counted.", untracked)
+	}
+	return dashboard, nil
+}
+
+type shareCacheEntry struct {
+	dashboard *ShareDashboard
+	expiresAt time.Time
+}
+
+var (
+	// shareCache holds recent summaries by share ID; the share is still checked per request
+	shareCache      = map[primitive.ObjectID]shareCacheEntry{}
+	shareCacheMutex sync.RWMutex
+)
+
+// cachedShareDashboard returns the summary of share, computing it at most every shareStatsCacheTTL
+func cachedShareDashboard(ctx context.Context, store URLStore, share *AnalyticsShare) (*ShareDashboard, error) {
+	now := clock.Now()
+	shareCacheMutex.RLock()
+	entry, ok := shareCache[share.ID]
+	shareCacheMutex.RUnlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.dashboard, nil
+	}
+
+	links, title, err := sharedLinks(ctx, store, share)
+	if err != nil {
+		return nil, err
+	}
+	dashboard, err := buildShareDashboard(ctx, store, share, links, title, now)
+	if err != nil {
+		return nil, err
+	}
+	shareCacheMutex.Lock()
+	for id, old := range shareCache {
+		if !now.Before(old.expiresAt) {
+			delete(shareCache, id)
+		}
+	}
+	shareCache[share.ID] = shareCacheEntry{dashboard: dashboard, expiresAt: now.Add(shareStatsCacheTTL)}
+	shareCacheMutex.Unlock()
+	return dashboard, nil
+}
+
+// forgetShareDashboard drops the cached summary of a revoked share
+func forgetShareDashboard(id primitive.ObjectID) {
+	shareCacheMutex.Lock()
+	delete(shareCache, id)
+	shareCacheMutex.Unlock()
+}
+
+// createAnalyticsShare handles POST /analytics/shares
+func createAnalyticsShare(w http.ResponseWriter, r *http.Request) {
+	var req analyticsShareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	req.ShortURL = sanitizeInput(strings.TrimSpace(req.ShortURL))
+	req.FolderID = strings.TrimSpace(req.FolderID)
+	if (req.ShortURL == "") == (req.FolderID == "") {
+		http.Error(w, "exactly one of short_url and folder_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn == "" {
+		req.ExpiresIn = defaultShareExpiry
+	}
+	expiry, err := parseLinkDuration(req.ExpiresIn)
+	if err != nil {
+		http.Error(w, "expires_in: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := clock.Now()
+	expiresAt := expiry.AddTo(now)
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxShareExpiry {
+		http.Error(w, "expires_in must be at most 1y", http.StatusBadRequest)
+		return
+	}
+	if req.Passcode != "" && (len(req.Passcode) < minSharePasscodeLength || len(req.Passcode) > maxSharePasscodeLength) {
+		http.Error(w, fmt.Sprintf("passcode must be %d to %d characters", minSharePasscodeLength, maxSharePasscodeLength), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := linkStore(r)
+
+	share := &AnalyticsShare{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: now.UTC(),
+	}
+	if req.ShortURL != "" {
+		link, err := store.FindLinkByCode(ctx, req.ShortURL)
+		if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+			http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error loading link %s for analytics share: %v", req.ShortURL, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		share.Scope, share.ResourceID, share.Label = shareScopeLink, link.ID.Hex(), link.ShortURL
+	} else {
+		id, err := primitive.ObjectIDFromHex(req.FolderID)
+		if err != nil {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		folder, err := store.FindFolder(ctx, userID, id)
+		if err != nil {
+			writeFolderError(w, err, "loading folder for analytics share")
+			return
+		}
+		share.Scope, share.ResourceID, share.Label = shareScopeFolder, folder.ID.Hex(), folder.Name
+	}
+
+	token, hash, err := newShareToken()
+	if err != nil {
+		log.Printf("error generating analytics share token: %v", err)
+		http.Error(w, "failed to create share", http.StatusInternalServerError)
+		return
+	}
+	share.TokenHash = hash
+	if req.Passcode != "" {
+		if share.PasscodeHash, err = HashPassword(req.Passcode); err != nil {
+			log.Printf("error hashing analytics share passcode: %v", err)
+			http.Error(w, "failed to create share", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := store.InsertAnalyticsShare(ctx, share, maxAnalyticsSharesPerUser, now); errors.Is(err, ErrLimitReached) {
+		http.Error(w, fmt.Sprintf("An account can have at most %d active analytics shares", maxAnalyticsSharesPerUser), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("error saving analytics share: %v", err)
+		writeStoreError(w, err, "analytics share", "Database error")
+		return
+	}
+
+	logSecurityEvent(r.Context(), "ANALYTICS_SHARE_CREATED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Analytics of %s %s shared until %s", share.Scope, share.Label, share.ExpiresAt.Format(time.RFC3339)), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		// The URL is only shown now; the server keeps its hash
+		"share": shareView{AnalyticsShare: share, Passcode: share.PasscodeHash != "", Active: true,
+			URL: requestBaseURL(r) + "/public/analytics/" + token},
+	}); err != nil {
+		log.Printf("error encoding analytics share response: %v", err)
+	}
+}
+
+// listAnalyticsShares handles GET /analytics/shares
+func listAnalyticsShares(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	shares, err := linkStore(r).ListAnalyticsShares(ctx, userID)
+	if err != nil {
+		log.Printf("error listing analytics shares of %s: %v", userID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	now := clock.Now()
+	views := make([]shareView, 0, len(shares))
+	for i := range shares {
+		share := &shares[i]
+		views = append(views, shareView{AnalyticsShare: share, Passcode: share.PasscodeHash != "", Active: share.activeAt(now)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "shares": views}); err != nil {
+		log.Printf("error encoding analytics shares response: %v", err)
+	}
+}
+
+// revokeAnalyticsShare handles DELETE /analytics/shares/{id}
+func revokeAnalyticsShare(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(string)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := linkStore(r).RevokeAnalyticsShare(ctx, userID, id, clock.Now()); errors.Is(err, ErrNotFound) {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("error revoking analytics share %s: %v", id.Hex(), err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	forgetShareDashboard(id)
+
+	logSecurityEvent(r.Context(), "ANALYTICS_SHARE_REVOKED", userID, getClientIP(r), r.UserAgent(),
+		"Analytics share "+id.Hex()+" revoked", "INFO")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publicAnalyticsShare handles GET /public/analytics/{token}, and POST from the passcode form
+func publicAnalyticsShare(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	policy := requestConfig(r).RateLimit("public_share")
+	if limit := checkRateLimit("public-share:"+rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+		logSecurityEvent(r.Context(), "PUBLIC_SHARE_RATE_LIMIT_EXCEEDED", "", clientIP, r.UserAgent(),
+			"Public analytics share rate limit exceeded", "WARN")
+		writeRateLimited(w, limit)
+		return
+	}
+	// Revocation must show on the next request, so nothing downstream may keep the answer
+	setNoStoreHeaders(w)
+	addSecurityHeaders(w)
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	page := wantsHTML(r) || r.URL.Query().Get("format") == "html"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	token := mux.Vars(r)["token"]
+	var share *AnalyticsShare
+	if len(token) <= 64 {
+		found, err := linkStore(r).FindAnalyticsShare(ctx, hashShareToken(token))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("error loading analytics share: %v", err)
+			http.Error(w, "Analytics are temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		share = found
+	}
+	if share == nil || !share.activeAt(clock.Now()) {
+		if page {
+			writeLocalizedPage(w, r, http.StatusNotFound, "share_unavailable", "")
+			return
+		}
+		http.Error(w, "This share link does not exist or has expired", http.StatusNotFound)
+		return
+	}
+
+	if share.PasscodeHash != "" {
+		passcode := r.Header.Get("X-Share-Passcode")
+		if passcode == "" && r.Method == http.MethodPost {
+			r.Body = http.MaxBytesReader(w, r.Body, 4096)
+			passcode = r.PostFormValue("passcode")
+		}
+		if passcode == "" || len(passcode) > maxSharePasscodeLength || CheckPassword(passcode, share.PasscodeHash) != nil {
+			if passcode != "" {
+				logSecurityEvent(r.Context(), "PUBLIC_SHARE_PASSCODE_FAILED", "", clientIP, r.UserAgent(),
+					"Wrong passcode for analytics share "+share.ID.Hex(), "WARN")
+			}
+			if page {
+				writeShareDashboardPage(w, http.StatusUnauthorized, &ShareDashboard{Title: "Passcode required"}, true, passcode != "")
+				return
+			}
+			http.Error(w, "A valid passcode is required in X-Share-Passcode", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	dashboard, err := cachedShareDashboard(ctx, linkStore(r), share)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "The shared link or folder no longer exists", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error building analytics share %s: %v", share.ID.Hex(), err)
+		http.Error(w, "Analytics are temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if page {
+		writeShareDashboardPage(w, http.StatusOK, dashboard, false, false)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dashboard); err != nil {
+		log.Printf("error encoding analytics share response: %v", err)
+	}
+}
+
+var shareDashboardTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><meta name="robots" content="noindex"><title>{{.Dashboard.Title}}</title><link rel="stylesheet" href="{{.Stylesheet}}"></head><body>
+<h1>{{.Dashboard.Title}}</h1>
+{{if .Locked}}<form method="post">{{if .Wrong}}<p>That passcode is not right.</p>
+{{end}}<label>Passcode <input type="password" name="passcode" autocomplete="off" required></label> <button type="submit">View</button></form>
+{{else}}<p>{{.Dashboard.Clicks}} clicks from {{.Dashboard.From.Format "2 Jan 2006"}} to today, {{.Dashboard.AllTimeClicks}} in total. As of {{.Dashboard.AsOf.Format "2 Jan 2006 15:04"}} UTC.</p>
+{{if .Dashboard.Notice}}<p>{{.Dashboard.Notice}}</p>
+{{end}}<h2>Clicks per day</h2>
+<table>{{range .Dashboard.Daily}}<tr><td>{{.Date}}</td><td>{{.Clicks}}</td></tr>{{end}}</table>
+<h2>Top referrers</h2>
+<table>{{range .Dashboard.TopReferrers}}<tr><td>{{.Host}}</td><td>{{.Clicks}}</td></tr>{{else}}<tr><td>No referrers yet</td></tr>{{end}}</table>
+{{if .Dashboard.Links}}<h2>Links</h2>
+<table>{{range .Dashboard.Links}}<tr><td>{{.ShortURL}}</td><td>{{.Clicks}}</td></tr>{{end}}</table>
+{{end}}{{end}}</body></html>
+`))
+
+// writeShareDashboardPage renders dashboard, or the passcode form when locked
+func writeShareDashboardPage(w http.ResponseWriter, status int, dashboard *ShareDashboard, locked, wrong bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	data := struct {
+		Stylesheet    string
+		Dashboard     *ShareDashboard
+		Locked, Wrong bool
+	}{staticURL("page.css"), dashboard, locked, wrong}
+	if err := shareDashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("error rendering analytics share page: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestShareAdmitsProperty(t *testing.T) {
+	users := []string{"", "user-a", "user-b"}
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	resources := []string{"", ids[0].Hex(), ids[1].Hex(), ids[2].Hex(), "folder-1", "folder-2"}
+	folders := []string{"", "folder-1", "folder-2", ids[0].Hex()}
+	scopes := []string{shareScopeLink, shareScopeFolder, "", "campaign"}
+
+	// Whatever the share and link, a link is only ever admitted by a share of its owner
+	// naming it or its folder, and a share of the owner naming it always admits it
+	property := func(shareUser, resource, scope, linkUser, linkID, folder uint8) bool {
+		share := &AnalyticsShare{
+			UserID:     users[int(shareUser)%len(users)],
+			ResourceID: resources[int(resource)%len(resources)],
+			Scope:      scopes[int(scope)%len(scopes)],
+		}
+		link := &URLData{
+			ID:       ids[int(linkID)%len(ids)],
+			UserID:   users[int(linkUser)%len(users)],
+			FolderID: folders[int(folder)%len(folders)],
+		}
+		named := share.Scope == shareScopeLink && link.ID.Hex() == share.ResourceID ||
+			share.Scope == shareScopeFolder && link.FolderID == share.ResourceID && share.ResourceID != ""
+		owned := share.UserID != "" && link.UserID == share.UserID
+		return shareAdmits(share, link) == (owned && named)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	if shareAdmits(nil, &URLData{}) || shareAdmits(&AnalyticsShare{}, nil) {
+		t.Fatal("nil share or link admitted")
+	}
+}
+
+func TestSharedLinksNeverEscalate(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		store := newMemoryStore()
+		owners := []string{primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()}
+		var folders []*Folder
+		for _, owner := range owners {
+			for _, name := range []string{"Spring", "Summer"} {
+				folder := newFolder(owner, name, nil, time.Now())
+				if err := store.InsertFolder(ctx, folder); err != nil {
+					t.Fatal(err)
+				}
+				folders = append(folders, folder)
+			}
+		}
+		// Links land in any folder, including folders of the other account
+		var links []*URLData
+		for i := 0; i < 12; i++ {
+			link := &URLData{ShortURL: "r" + string(rune('a'+round)) + string(rune('a'+i)), LongURL: "https://example.com/", UserID: owners[rng.Intn(2)], IsActive: true}
+			if n := rng.Intn(len(folders) + 1); n < len(folders) {
+				link.FolderID = folders[n].ID.Hex()
+			}
+			if err := store.InsertLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			links = append(links, link)
+		}
+
+		// Shares by either owner of every link and folder, honest or forged
+		var shares []*AnalyticsShare
+		folderOwners := map[string]string{}
+		for _, owner := range owners {
+			for _, link := range links {
+				shares = append(shares, &AnalyticsShare{UserID: owner, Scope: shareScopeLink, ResourceID: link.ID.Hex(), Label: link.ShortURL})
+				// The label names another link than the resource
+				other := links[rng.Intn(len(links))]
+				shares = append(shares, &AnalyticsShare{UserID: owner, Scope: shareScopeLink, ResourceID: link.ID.Hex(), Label: other.ShortURL})
+			}
+			for _, folder := range folders {
+				folderOwners[folder.ID.Hex()] = folder.UserID
+				shares = append(shares, &AnalyticsShare{UserID: owner, Scope: shareScopeFolder, ResourceID: folder.ID.Hex(), Label: folder.Name})
+			}
+		}
+		for _, share := range shares {
+			got, _, err := sharedLinks(ctx, store, share)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Fatal(err)
+			}
+			// A folder of the other account shows nothing, even links of the share's owner in it
+			want := 0
+			for _, link := range links {
+				if shareAdmits(share, link) && (share.Scope == shareScopeFolder && folderOwners[share.ResourceID] == share.UserID || link.ShortURL == share.Label) {
+					want++
+				}
+			}
+			for _, link := range got {
+				if !shareAdmits(share, link) {
+					t.Fatalf("%s share of %s (%s) by %s exposed %s of %s in %q", share.Scope, share.ResourceID, share.Label, share.UserID, link.ShortURL, link.UserID, link.FolderID)
+				}
+			}
+			if len(got) != want {
+				t.Fatalf("%s share of %s (%s) by %s: %d links, want %d", share.Scope, share.ResourceID, share.Label, share.UserID, len(got), want)
+			}
+		}
+	}
+}
+
+// shareAnswer is the share in the answer of POST /analytics/shares
+type shareAnswer struct {
+	Share struct {
+		ID       string `json:"id"`
+		URL      string `json:"url"`
+		Passcode bool   `json:"passcode"`
+	} `json:"share"`
+}
+
+// createShare shares the analytics described by body and returns the share's ID and path
+func (s *testServer) createShare(token string, body map[string]string) (id, path string) {
+	s.t.Helper()
+	var created shareAnswer
+	if resp := s.do("POST", "/analytics/shares", token, body, &created); resp.StatusCode != http.StatusCreated {
+		s.t.Fatalf("share %v: status %d: %s", body, resp.StatusCode, readBody(s.t, resp))
+	}
+	return created.Share.ID, created.Share.URL[strings.Index(created.Share.URL, "/public/"):]
+}
+
+func TestPublicAnalyticsShare(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	campaign := srv.createFolder(token, "Campaign", "")
+	shared := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/secret-landing"})
+	inFolder := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/a", "folder_id": campaign.ID})
+	outside := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/b"})
+	foreign := srv.shorten(other, map[string]interface{}{"long-url": "https://example.com/c"})
+	for code, n := range map[string]int{shared: 2, inFolder: 3, outside: 4, foreign: 5} {
+		for i := 0; i < n; i++ {
+			req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+			req.Header.Set("Referer", "https://news.example.org/post")
+			req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+			srv.send(req, nil)
+		}
+	}
+	drainClicks(t)
+
+	_, linkPath := srv.createShare(token, map[string]string{"short_url": shared})
+	var dashboard ShareDashboard
+	resp := srv.do("GET", linkPath, "", nil, &dashboard)
+	if resp.StatusCode != http.StatusOK || dashboard.Scope != shareScopeLink || dashboard.Title != shared || dashboard.Clicks != 2 || dashboard.AllTimeClicks != 2 {
+		t.Fatalf("link share: status %d, %+v", resp.StatusCode, dashboard)
+	}
+	if len(dashboard.Daily) != shareStatsDays || dashboard.Daily[shareStatsDays-1].Clicks != 2 {
+		t.Errorf("daily %+v", dashboard.Daily)
+	}
+	if len(dashboard.TopReferrers) != 1 || dashboard.TopReferrers[0] != (shareReferrer{Host: "news.example.org", Clicks: 2}) {
+		t.Errorf("referrers %+v", dashboard.TopReferrers)
+	}
+	if cache := resp.Header.Get("Cache-Control"); !strings.Contains(cache, "no-store") {
+		t.Errorf("Cache-Control %q", cache)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "secret-landing") || strings.Contains(body, "127.0.0.1") {
+		t.Errorf("destination or IP in the share: %s", body)
+	}
+
+	// A folder share counts the folder's links and nothing else
+	_, folderPath := srv.createShare(token, map[string]string{"folder_id": campaign.ID})
+	dashboard = ShareDashboard{}
+	srv.do("GET", folderPath, "", nil, &dashboard)
+	if dashboard.Title != "Campaign" || dashboard.Clicks != 3 || len(dashboard.Links) != 1 || dashboard.Links[0].ShortURL != inFolder {
+		t.Fatalf("folder share %+v", dashboard)
+	}
+
+	// Nobody shares what is not theirs
+	for _, tt := range []struct {
+		token string
+		body  map[string]string
+	}{{token, map[string]string{"short_url": foreign}}, {other, map[string]string{"folder_id": campaign.ID}}} {
+		if resp := srv.do("POST", "/analytics/shares", tt.token, tt.body, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("sharing %v of another account: status %d", tt.body, resp.StatusCode)
+		}
+	}
+	for _, path := range []string{linkPath + "x", "/public/analytics/" + strings.Repeat("a", 32), "/public/analytics/" + strings.Repeat("a", 65)} {
+		if resp := srv.do("GET", path, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, resp.StatusCode)
+		}
+	}
+
+	// Browsers get a page
+	req, _ := http.NewRequest("GET", srv.URL+linkPath, nil)
+	req.Header.Set("Accept", "text/html")
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusOK || !strings.Contains(readBody(t, resp), "<h1>"+shared+"</h1>") {
+		t.Errorf("page: status %d", resp.StatusCode)
+	}
+}
+
+func TestAnalyticsSharePasscode(t *testing.T) {
+	accessLog := captureAccessLog(t)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/"})
+	if resp := srv.do("POST", "/analytics/shares", token, map[string]string{"short_url": code, "passcode": "short"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("short passcode: status %d", resp.StatusCode)
+	}
+	_, path := srv.createShare(token, map[string]string{"short_url": code, "passcode": "open sesame"})
+
+	for _, passcode := range []string{"", "open sesame!", "OPEN SESAME"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if passcode != "" {
+			req.Header.Set("X-Share-Passcode", passcode)
+		}
+		if resp := srv.send(req, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("passcode %q: status %d", passcode, resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("X-Share-Passcode", "open sesame")
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("right passcode in the header: status %d", resp.StatusCode)
+	}
+	// The query would put the passcode in URLs and logs, so only the page's form posts it
+	if resp := srv.do("GET", path+"?passcode=open+sesame", "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("right passcode in the query: status %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("Accept", "text/html")
+	if page := readBody(t, srv.send(req, nil)); !strings.Contains(page, `<form method="post">`) {
+		t.Errorf("passcode form:\n%s", page)
+	}
+	for passcode, status := range map[string]int{"open sesame": http.StatusOK, "OPEN SESAME": http.StatusUnauthorized} {
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(url.Values{"passcode": {passcode}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html")
+		if resp := srv.send(req, nil); resp.StatusCode != status {
+			t.Errorf("form with passcode %q: status %d, want %d", passcode, resp.StatusCode, status)
+		}
+	}
+
+	// The token is a secret, so the access log only says a share was read
+	time.Sleep(10 * time.Millisecond)
+	secret := strings.TrimPrefix(path, "/public/analytics/")
+	if logged := accessLog(); strings.Contains(logged, secret) || strings.Contains(logged, "sesame") || !strings.Contains(logged, `"POST /public/analytics/[redacted] HTTP/1.1"`) {
+		t.Errorf("access log:\n%s", logged)
+	}
+}
+
+func TestAnalyticsShareRevocation(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/"})
+	id, path := srv.createShare(token, map[string]string{"short_url": code})
+	_, lasting := srv.createShare(token, map[string]string{"short_url": code, "expires_in": "7d"})
+
+	// The summary is cached now, which must not outlive the share
+	if resp := srv.do("GET", path, "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("before revocation: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("DELETE", "/analytics/shares/"+id, other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("revocation by another account: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("DELETE", "/analytics/shares/"+id, token, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", path, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("right after revocation: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", lasting, "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other share of the link: status %d", resp.StatusCode)
+	}
+
+	var listed struct {
+		Shares []struct {
+			ID        string     `json:"id"`
+			Active    bool       `json:"active"`
+			RevokedAt *time.Time `json:"revoked_at"`
+		} `json:"shares"`
+	}
+	srv.do("GET", "/analytics/shares", token, nil, &listed)
+	if len(listed.Shares) != 2 {
+		t.Fatalf("listed %+v", listed.Shares)
+	}
+	for _, share := range listed.Shares {
+		if revoked := share.ID == id; share.Active == revoked || (share.RevokedAt != nil) != revoked {
+			t.Errorf("listed share %+v", share)
+		}
+	}
+
+	// Expiry takes effect the same way
+	freezeClock(t, time.Now().AddDate(0, 0, 8))
+	if resp := srv.do("GET", lasting, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expired share: status %d", resp.StatusCode)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,9 +14,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -35,8 +34,22 @@ type User struct {
 	IsActive           bool               `bson:"is_active" json:"is_active"`
 	RefreshToken       string             `bson:"refresh_token,omitempty" json:"-"` // Store hashed refresh token
 	RefreshTokenExpiry time.Time          `bson:"refresh_token_expiry,omitempty" json:"-"`
+	Role               string             `bson:"role,omitempty" json:"role,omitempty"` // "admin" for operators; empty for regular users
+	TagRules           []TagRule          `bson:"tag_rules,omitempty" json:"tag_rules,omitempty"`
+	// Restricted accounts registered with a disposable email; see disposable_email.go
+	Restricted    bool `bson:"restricted,omitempty" json:"restricted,omitempty"`
+	EmailVerified bool `bson:"email_verified,omitempty" json:"email_verified,omitempty"`
+	// DeactivatedAt is set while the owner has paused the account; see account_deactivation.go
+	DeactivatedAt time.Time `bson:"deactivated_at,omitempty" json:"-"`
+	// AutoExpireUnclickedAfter is the account's unclicked-link expiry policy, e.g. "180d"
+	AutoExpireUnclickedAfter string `bson:"auto_expire_unclicked_after,omitempty" json:"auto_expire_unclicked_after,omitempty"`
+	// Timezone is the IANA time zone click patterns are reported in; UTC when empty
+	Timezone string `bson:"timezone,omitempty" json:"timezone,omitempty"`
 }
 
+// RoleAdmin marks operator accounts allowed to call /admin endpoints
+const RoleAdmin = "admin"
+
 // GenerateRefreshToken creates a new secure random refresh token
 func GenerateRefreshToken() (string, error) {
 	b := make([]byte, 32)
@@ -55,24 +68,13 @@ func HashRefreshToken(token string) string {
 
 // SetRefreshToken sets a new refresh token and expiry for a user in the DB
 func SetRefreshToken(userID string, refreshToken string, expiry time.Time) error {
-	if DB == nil {
-		return fmt.Errorf("database not connected")
-	}
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		return fmt.Errorf("invalid user ID")
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	hashed := HashRefreshToken(refreshToken)
-	update := bson.M{
-		"$set": bson.M{
-			"refresh_token":        hashed,
-			"refresh_token_expiry": expiry,
-		},
-	}
-	_, err = DB.Database.Collection("users").UpdateOne(ctx, bson.M{"_id": objectID}, update)
-	return err
+	return Users.SetRefreshToken(ctx, objectID, HashRefreshToken(refreshToken), expiry)
 }
 
 // ValidateRefreshToken checks if the refresh token is valid for the user
@@ -88,23 +90,13 @@ func ValidateRefreshToken(user *User, refreshToken string) bool {
 
 // ClearRefreshToken removes the refresh token from the user (on logout or rotation)
 func ClearRefreshToken(userID string) error {
-	if DB == nil {
-		return fmt.Errorf("database not connected")
-	}
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		return fmt.Errorf("invalid user ID")
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	update := bson.M{
-		"$unset": bson.M{
-			"refresh_token":        "",
-			"refresh_token_expiry": "",
-		},
-	}
-	_, err = DB.Database.Collection("users").UpdateOne(ctx, bson.M{"_id": objectID}, update)
-	return err
+	return Users.SetRefreshToken(ctx, objectID, "", time.Time{})
 }
 
 // Claims represents JWT claims
@@ -112,6 +104,9 @@ type Claims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	// Impersonator is the admin acting as the user, set on impersonation tokens only
+	Impersonator         string `json:"impersonator,omitempty"`
+	ImpersonatorUsername string `json:"impersonator_username,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -120,6 +115,8 @@ type AuthRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// CaptchaToken is required once the client's IP has too many failed logins
+	CaptchaToken string `json:"captcha_token,omitempty"`
 }
 
 // AuthResponse represents authentication response
@@ -127,6 +124,8 @@ type AuthResponse struct {
 	Token     string    `json:"token"`
 	ExpiresAt time.Time `json:"expires_at"`
 	User      User      `json:"user"`
+	// CSRFToken is set with COOKIE_AUTH=true; send it as X-CSRF-Token with cookie sessions
+	CSRFToken string `json:"csrf_token,omitempty"`
 }
 
 // InitJWT initializes the JWT secret
@@ -189,37 +188,97 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// tokenErrorCode classifies a ValidateToken error by the jwt library's error categories
+func tokenErrorCode(err error) (code, message string) {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrCodeTokenExpired, "Token has expired"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return ErrCodeTokenMalformed, "Token is malformed"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrCodeTokenSignature, "Token signature is invalid"
+	default:
+		return ErrCodeTokenInvalid, "Token is invalid"
+	}
+}
+
 func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
+		var tokenString string
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Check if it's a Bearer token
-		bearerToken := strings.Split(authHeader, " ")
-		if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format. Use: Bearer <token>", http.StatusUnauthorized)
-			return
+			// Cookie sessions: state-changing requests must also pass the CSRF check
+			cookieToken, ok := cookieAccessToken(r)
+			if !ok {
+				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+			if !validCSRF(r) {
+				logSecurityEvent(r.Context(), "CSRF_REJECTED", "", getClientIP(r), r.UserAgent(),
+					"Missing or invalid CSRF token: "+r.Method+" "+r.URL.Path, "WARN")
+				http.Error(w, "CSRF token missing or invalid", http.StatusForbidden)
+				return
+			}
+			tokenString = cookieToken
+		} else {
+			// Check if it's a Bearer token
+			bearerToken := strings.Split(authHeader, " ")
+			if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
+				http.Error(w, "Invalid authorization header format. Use: Bearer <token>", http.StatusUnauthorized)
+				return
+			}
+			tokenString = bearerToken[1]
 		}
 
-		tokenString := bearerToken[1]
 		claims, err := ValidateToken(tokenString)
 		if err != nil {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
+		// Impersonation tokens die with the admin role of whoever requested them
+		if claims.Impersonator != "" && !impersonatorStillAdmin(claims.Impersonator) {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		// Tokens of suspended and deactivated accounts stop working with the account
+		if suspendedOwners.Has(claims.UserID) {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
 
 		// Add user info to request context
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
 		ctx = context.WithValue(ctx, "username", claims.Username)
 		ctx = context.WithValue(ctx, "email", claims.Email)
+		requestInfoFrom(ctx).UserID = claims.UserID
+		if claims.Impersonator != "" {
+			ctx = context.WithValue(ctx, "impersonator", claims.Impersonator)
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+				recordImpersonatedAction(r.WithContext(ctx), claims)
+			}
+		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// AdminMiddleware authenticates the request and additionally requires the admin role.
+// The role is read from the database on every call so revocations apply immediately.
+// Impersonation tokens are refused, whoever the impersonated user is.
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return JWTMiddleware(refuseImpersonation(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value("user_id").(string)
+		user, err := GetUserByID(userID)
+		if err != nil || user.Role != RoleAdmin {
+			logSecurityEvent(r.Context(), "ADMIN_ACCESS_DENIED", userID, getClientIP(r), r.UserAgent(),
+				r.Method+" "+r.URL.Path, "WARN")
+			http.Error(w, "Admin privileges required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
 // HashPassword hashes a password using bcrypt
 func HashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -236,153 +295,88 @@ func CheckPassword(password, hash string) error {
 
 // CreateUser creates a new user in the database (legacy)
 func CreateUser(username, email, password string) (*User, error) {
-	return CreateUserWithTransaction(username, email, password)
+	return CreateUserWithTransaction(username, email, password, false)
 }
 
-// CreateUserWithTransaction creates a new user using MongoDB transactions for consistency
-func CreateUserWithTransaction(username, email, password string) (*User, error) {
-	if DB == nil {
-		return nil, fmt.Errorf("database not connected")
-	}
-
-	session, err := DB.Client.StartSession()
+// CreateUserWithTransaction creates a new user; the MongoDB store checks and inserts in one session
+func CreateUserWithTransaction(username, email, password string, restricted bool) (*User, error) {
+	hashedPassword, err := HashPassword(password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start session: %v", err)
+		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
-	defer session.EndSession(context.Background())
-
-	var user *User
-	err = mongo.WithSession(context.Background(), session, func(sc mongo.SessionContext) error {
-		// Hash the password
-		hashedPassword, err := HashPassword(password)
-		if err != nil {
-			return fmt.Errorf("failed to hash password: %v", err)
-		}
-
-		// Check if user already exists (within transaction)
-		var existingUser User
-		userCollection := DB.Database.Collection("users")
-		err = userCollection.FindOne(sc, bson.D{
-			{"$or", bson.A{
-				bson.D{{"username", username}},
-				bson.D{{"email", email}},
-			}},
-			{"is_active", true},
-		}).Decode(&existingUser)
-
-		if err == nil {
-			return fmt.Errorf("user with this username or email already exists")
-		} else if err != mongo.ErrNoDocuments {
-			return fmt.Errorf("error checking existing user: %v", err)
-		}
-
-		// Create new user
-		user = &User{
-			Username:  username,
-			Email:     email,
-			Password:  hashedPassword,
-			CreatedAt: time.Now().UTC(),
-			IsActive:  true,
-		}
-
-		// Insert the new user
-		result, err := userCollection.InsertOne(sc, user)
-		if err != nil {
-			return fmt.Errorf("failed to create user: %v", err)
-		}
 
-		user.ID = result.InsertedID.(primitive.ObjectID)
-		return nil
-	})
+	user := &User{
+		Username:   username,
+		Email:      email,
+		Password:   hashedPassword,
+		CreatedAt:  time.Now().UTC(),
+		IsActive:   true,
+		Restricted: restricted,
+	}
 
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := Users.CreateUser(ctx, user); err != nil {
+		return nil, fmt.Errorf("creating user: %w", err)
 	}
 
 	return user, nil
 }
 
+// ErrInvalidCredentials is returned for an unknown login as well as a wrong password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 // GetUserByCredentials retrieves a user by username/email and verifies password (optimized)
 func GetUserByCredentials(usernameOrEmail, password string) (*User, error) {
-	if DB == nil {
-		return nil, fmt.Errorf("database not connected")
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second) // Reduced timeout for faster response
 	defer cancel()
 
-	var user User
-	// Use optimized query that leverages compound indexes
-	err := DB.Database.Collection("users").FindOne(ctx, bson.D{
-		{Key: "$or", Value: bson.A{
-			bson.D{{Key: "username", Value: usernameOrEmail}, {Key: "is_active", Value: true}},
-			bson.D{{Key: "email", Value: usernameOrEmail}, {Key: "is_active", Value: true}},
-		}},
-	}).Decode(&user)
-
-	if err == mongo.ErrNoDocuments {
-		return nil, fmt.Errorf("user not found or inactive")
+	user, err := Users.FindUserByLogin(ctx, usernameOrEmail)
+	if errors.Is(err, ErrNotFound) {
+		// A paused account is only revealed to someone who knows its password
+		paused, findErr := Users.FindDeactivatedUser(ctx, usernameOrEmail)
+		if findErr == nil && CheckPassword(password, paused.Password) == nil {
+			return paused, ErrAccountDeactivated
+		}
+		return nil, fmt.Errorf("user not found or inactive: %w", ErrInvalidCredentials)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("finding user: %w", err)
 	}
 
 	// Check password
 	if err := CheckPassword(password, user.Password); err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+		return nil, ErrInvalidCredentials
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByID retrieves a user by ID
 func GetUserByID(userID string) (*User, error) {
-	if DB == nil {
-		return nil, fmt.Errorf("database not connected")
-	}
-
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid user ID")
+		return nil, &ValidationError{Field: "user_id", Reason: "invalid user ID"}
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user User
-	err = DB.Database.Collection("users").FindOne(ctx, bson.D{
-		{"_id", objectID},
-		{"is_active", true},
-	}).Decode(&user)
-
-	if err == mongo.ErrNoDocuments {
-		return nil, fmt.Errorf("user not found")
-	}
+	user, err := Users.GetUserByID(ctx, objectID)
 	if err != nil {
-		return nil, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("loading user %s: %w", userID, err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
-// GetUserProfile returns user profile with statistics
-func GetUserProfile(userID string) (map[string]interface{}, error) {
+// GetUserProfile returns the user's profile, with the dashboard statistics when withStats is set
+func GetUserProfile(userID string, withStats bool) (map[string]interface{}, error) {
 	user, err := GetUserByID(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get user statistics using optimized aggregation
-	stats, err := GetUserStatsOptimized(userID)
-	if err != nil {
-		log.Printf("Warning: Could not get user stats: %v", err)
-		stats = map[string]interface{}{
-			"total_urls":         0,
-			"total_clicks":       0,
-			"avg_clicks_per_url": 0,
-		}
-	}
-
 	profile := map[string]interface{}{
 		"user": map[string]interface{}{
 			"id":         user.ID.Hex(),
@@ -390,9 +384,30 @@ func GetUserProfile(userID string) (map[string]interface{}, error) {
 			"email":      user.Email,
 			"created_at": user.CreatedAt,
 			"is_active":  user.IsActive,
+			// Stable fallback color for the avatar, derived from the username
+			"avatar_color": accentColorFor(user.Username),
+			"tag_rules":    user.TagRules,
+			"timezone":     user.Timezone,
 		},
-		"statistics": stats,
+		"stats_included": withStats,
+	}
+	if !withStats {
+		return profile, nil
+	}
+
+	// Same statistics as the analytics dashboard, shared through the short-lived stats cache
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stats, err := cachedUserStats(ctx, userID)
+	if err != nil {
+		log.Printf("Warning: Could not get user stats: %v", err)
+		stats = map[string]interface{}{
+			"total_urls":         0,
+			"total_clicks":       0,
+			"avg_clicks_per_url": 0,
+		}
 	}
+	profile["statistics"] = stats
 
 	return profile, nil
 }
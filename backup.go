@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// BACKUP AND RESTORE
+// ============================================================================
+
+const (
+	backupBatchSize   = 500
+	backupListLimit   = 50
+	defaultBackupDest = "./backups"
+)
+
+// backupSpec describes one collection included in backups
+type backupSpec struct {
+	Name       string
+	Projection bson.D // fields excluded from the dump
+}
+
+// backupCollections lists the collections dumped by a backup. Credentials are never exported.
+// Rollup collections should be appended here as they are introduced.
+var backupCollections = []backupSpec{
+	{Name: "urls"},
+	{Name: "codes"},
+	{Name: "link_outcomes"},
+	{Name: "users", Projection: bson.D{
+		{Key: "password", Value: 0},
+		{Key: "refresh_token", Value: 0},
+		{Key: "refresh_token_expiry", Value: 0},
+	}},
+}
+
+// BackupCollectionManifest records the result of dumping one collection
+type BackupCollectionManifest struct {
+	Name     string `bson:"name" json:"name"`
+	Count    int64  `bson:"count" json:"count"`
+	Bytes    int64  `bson:"bytes" json:"bytes"`
+	SHA256   string `bson:"sha256" json:"sha256"`
+	Location string `bson:"location" json:"location"`
+}
+
+// BackupManifest is stored in the backups collection for every backup run
+type BackupManifest struct {
+	ID          primitive.ObjectID         `bson:"_id,omitempty" json:"id"`
+	Status      string                     `bson:"status" json:"status"` // running, completed, failed
+	Trigger     string                     `bson:"trigger" json:"trigger"`
+	RequestedBy string                     `bson:"requested_by,omitempty" json:"requested_by,omitempty"`
+	Destination string                     `bson:"destination" json:"destination"`
+	StartedAt   time.Time                  `bson:"started_at" json:"started_at"`
+	DurationMS  int64                      `bson:"duration_ms" json:"duration_ms"`
+	Collections []BackupCollectionManifest `bson:"collections" json:"collections"`
+	Error       string                     `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// backupDestination returns BACKUP_DESTINATION: a local directory or s3://bucket/prefix
+func backupDestination() string {
+	if dest := os.Getenv("BACKUP_DESTINATION"); dest != "" {
+		return dest
+	}
+	return defaultBackupDest
+}
+
+// splitS3Destination parses s3://bucket/prefix
+func splitS3Destination(dest string) (bucket, prefix string, ok bool) {
+	if !strings.HasPrefix(dest, "s3://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(dest, "s3://"), "/", 2)
+	bucket = parts[0]
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	return bucket, prefix, bucket != ""
+}
+
+// countingWriter counts bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StartBackup records a running manifest and performs the backup, returning the final manifest
+func StartBackup(trigger, requestedBy string) (*BackupManifest, error) {
+	if DB == nil || DB.Database == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	manifest := &BackupManifest{
+		ID:          primitive.NewObjectID(),
+		Status:      "running",
+		Trigger:     trigger,
+		RequestedBy: requestedBy,
+		Destination: backupDestination(),
+		StartedAt:   time.Now().UTC(),
+		Collections: []BackupCollectionManifest{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	_, err := DB.Database.Collection("backups").InsertOne(ctx, manifest)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record backup manifest: %v", err)
+	}
+
+	runErr := runBackup(manifest)
+	manifest.DurationMS = time.Since(manifest.StartedAt).Milliseconds()
+	manifest.Status = "completed"
+	if runErr != nil {
+		manifest.Status = "failed"
+		manifest.Error = runErr.Error()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := DB.Database.Collection("backups").ReplaceOne(ctx, bson.M{"_id": manifest.ID}, manifest); err != nil {
+		log.Printf("error updating backup manifest %s: %v", manifest.ID.Hex(), err)
+	}
+
+	return manifest, runErr
+}
+
+// runBackup streams every backup collection to the destination as gzipped NDJSON
+func runBackup(manifest *BackupManifest) error {
+	stamp := manifest.StartedAt.Format("20060102T150405Z")
+	bucket, prefix, isS3 := splitS3Destination(manifest.Destination)
+
+	var s3 *s3Client
+	if isS3 {
+		client, err := newS3ClientFromEnv(bucket)
+		if err != nil {
+			return err
+		}
+		s3 = client
+	}
+
+	for _, spec := range backupCollections {
+		fileName := spec.Name + ".ndjson.gz"
+
+		var file *os.File
+		var location string
+		var err error
+		if isS3 {
+			// S3 needs the payload size and hash up front, so stage the stream in a temp file
+			file, err = os.CreateTemp("", "rapidlink-backup-*.ndjson.gz")
+			location = "s3://" + bucket + "/" + strings.TrimPrefix(prefix+"/"+stamp+"/"+fileName, "/")
+		} else {
+			dir := filepath.Join(manifest.Destination, stamp)
+			if err = os.MkdirAll(dir, 0o750); err == nil {
+				location = filepath.Join(dir, fileName)
+				file, err = os.OpenFile(location, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create backup file for %s: %v", spec.Name, err)
+		}
+
+		entry, dumpErr := dumpCollection(spec, file)
+		entry.Location = location
+
+		if dumpErr == nil && isS3 {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				dumpErr = err
+			} else {
+				key := strings.TrimPrefix(location, "s3://"+bucket+"/")
+				dumpErr = s3.PutObject(key, file, entry.Bytes, entry.SHA256)
+			}
+		}
+
+		file.Close()
+		if isS3 {
+			os.Remove(file.Name())
+		}
+		if dumpErr != nil {
+			return fmt.Errorf("backup of %s failed: %v", spec.Name, dumpErr)
+		}
+
+		manifest.Collections = append(manifest.Collections, entry)
+		log.Printf("💾 Backed up %d %s documents to %s", entry.Count, spec.Name, location)
+	}
+
+	return nil
+}
+
+// dumpCollection writes one collection as gzipped canonical extended JSON lines, reading via a
+// batched cursor so the collection is never held in memory
+func dumpCollection(spec backupSpec, out io.Writer) (BackupCollectionManifest, error) {
+	entry := BackupCollectionManifest{Name: spec.Name}
+
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hasher)}
+	gz := gzip.NewWriter(counter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	findOptions := options.Find().SetBatchSize(backupBatchSize)
+	if spec.Projection != nil {
+		findOptions.SetProjection(spec.Projection)
+	}
+	cursor, err := DB.Database.Collection(spec.Name).Find(ctx, bson.D{}, findOptions)
+	if err != nil {
+		return entry, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return entry, err
+		}
+		if _, err := gz.Write(append(line, '\n')); err != nil {
+			return entry, err
+		}
+		entry.Count++
+	}
+	if err := cursor.Err(); err != nil {
+		return entry, err
+	}
+	if err := gz.Close(); err != nil {
+		return entry, err
+	}
+
+	entry.Bytes = counter.n
+	entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return entry, nil
+}
+
+// RunRestore re-imports a backup written by StartBackup. source is the backup's directory
+// (local path or s3://bucket/prefix/<timestamp>). Documents are upserted by _id with $set,
+// so fields excluded from the dump (such as password hashes) are preserved on existing users.
+func RunRestore(source string) error {
+	if DB == nil || DB.Database == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	bucket, prefix, isS3 := splitS3Destination(source)
+	var s3 *s3Client
+	if isS3 {
+		client, err := newS3ClientFromEnv(bucket)
+		if err != nil {
+			return err
+		}
+		s3 = client
+	}
+
+	for _, spec := range backupCollections {
+		fileName := spec.Name + ".ndjson.gz"
+
+		var reader io.ReadCloser
+		var err error
+		if isS3 {
+			reader, err = s3.GetObject(strings.TrimPrefix(prefix+"/"+fileName, "/"))
+		} else {
+			reader, err = os.Open(filepath.Join(source, fileName))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open backup of %s: %v", spec.Name, err)
+		}
+
+		count, err := restoreCollection(spec.Name, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("restore of %s failed after %d documents: %v", spec.Name, count, err)
+		}
+		log.Printf("♻️  Restored %d %s documents", count, spec.Name)
+	}
+	return nil
+}
+
+// restoreCollection upserts every NDJSON document from r in batches
+func restoreCollection(name string, r io.Reader) (int64, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	collection := DB.Database.Collection(name)
+	reader := bufio.NewReader(gz)
+	models := make([]mongo.WriteModel, 0, backupBatchSize)
+	var count int64
+
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var doc bson.D
+			if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+				return count, err
+			}
+			var id interface{}
+			fields := make(bson.D, 0, len(doc))
+			for _, field := range doc {
+				if field.Key == "_id" {
+					id = field.Value
+					continue
+				}
+				fields = append(fields, field)
+			}
+			if id == nil {
+				return count, fmt.Errorf("document without _id")
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{Key: "_id", Value: id}}).
+				SetUpdate(bson.D{{Key: "$set", Value: fields}}).
+				SetUpsert(true))
+			count++
+			if len(models) == backupBatchSize {
+				if err := flush(); err != nil {
+					return count, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return count, readErr
+		}
+	}
+	return count, flush()
+}
+
+// adminBackup handles POST /admin/backup. The backup runs in the background; poll GET /admin/backups.
+func adminBackup(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+
+	logSecurityEvent(r.Context(), "BACKUP_REQUESTED", userID, clientIP, r.UserAgent(),
+		"Backup to "+backupDestination(), "INFO")
+
+	go func() {
+		manifest, err := StartBackup("api", userID)
+		if err != nil {
+			log.Printf("❌ Backup failed: %v", err)
+			return
+		}
+		log.Printf("✅ Backup %s completed in %dms", manifest.ID.Hex(), manifest.DurationMS)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Backup started. Check GET /admin/backups for progress",
+		"destination": backupDestination(),
+	}); err != nil {
+		log.Printf("error encoding backup response: %v", err)
+	}
+}
+
+// adminListBackups handles GET /admin/backups
+func adminListBackups(w http.ResponseWriter, r *http.Request) {
+	if DB == nil || DB.Database == nil {
+		http.Error(w, "database connection error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := DB.Database.Collection("backups").Find(ctx, bson.D{},
+		options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}).SetLimit(backupListLimit))
+	if err != nil {
+		log.Printf("error listing backups: %v", err)
+		http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	backups := []BackupManifest{}
+	if err := cursor.All(ctx, &backups); err != nil {
+		log.Printf("error decoding backups: %v", err)
+		http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"backups": backups,
+		"count":   len(backups),
+	}); err != nil {
+		log.Printf("error encoding backups response: %v", err)
+	}
+}
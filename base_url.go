@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// PUBLIC BASE URL
+// ============================================================================
+//
+// BASE_URL is the external address of the deployment, used for full short URLs, QR codes
+// and signed links. It must be an absolute http(s) URL with nothing after the host. A
+// malformed value does not stop the server: the default is used instead and /health reports
+// the problem, so redirects keep working while the configuration is fixed.
+//
+// Behind a reverse proxy with a different scheme or host, PROXY_HEADERS_TRUSTED=true builds
+// those URLs from X-Forwarded-Proto and X-Forwarded-Host, but only for requests whose peer
+// is in TRUSTED_PROXIES (IPs or CIDRs; loopback and private ranges by default). Either way
+// /health compares the forwarded address with BASE_URL and warns when they disagree.
+
+var defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+var forwardedHostPattern = regexp.MustCompile(`(?i)^([a-z0-9.-]+|\[[0-9a-f:.]+\])(:[0-9]{1,5})?$`)
+
+var (
+	baseURLProblem      string // why BASE_URL was rejected; "" when it is valid
+	proxyHeadersTrusted bool
+	trustedProxies      []*net.IPNet
+	baseURLMismatchOnce sync.Once
+)
+
+// validateBaseURL checks that raw is an absolute http(s) URL naming only a scheme and host
+func validateBaseURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("not a URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("host is missing")
+	}
+	if parsed.User != nil || strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return fmt.Errorf("must not have credentials, a path, a query or a fragment")
+	}
+	return nil
+}
+
+// parseTrustedProxies reads a comma-separated list of IPs and CIDRs
+func parseTrustedProxies(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP or CIDR", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			entry = ip.String() + "/" + strconv.Itoa(bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP or CIDR", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// InitBaseURL validates BASE_URL, falling back to the default when it is unusable, and
+// loads PROXY_HEADERS_TRUSTED and TRUSTED_PROXIES
+func InitBaseURL() error {
+	raw := os.Getenv("BASE_URL")
+	if raw == "" {
+		log.Printf("⚠️  BASE_URL not set, using default: %s", DefaultBaseURL)
+		os.Setenv("BASE_URL", DefaultBaseURL)
+	} else if err := validateBaseURL(raw); err != nil {
+		baseURLProblem = err.Error()
+		log.Printf("❌ BASE_URL %q is invalid (%v); using %s until it is fixed", raw, err, DefaultBaseURL)
+		os.Setenv("BASE_URL", DefaultBaseURL)
+	} else {
+		log.Printf("✅ BASE_URL loaded: %s", raw)
+	}
+
+	if raw := os.Getenv("PROXY_HEADERS_TRUSTED"); raw != "" {
+		trusted, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("PROXY_HEADERS_TRUSTED must be true or false")
+		}
+		proxyHeadersTrusted = trusted
+	}
+	proxies := os.Getenv("TRUSTED_PROXIES")
+	if proxies == "" {
+		proxies = defaultTrustedProxies
+	}
+	nets, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	if proxyHeadersTrusted {
+		log.Printf("🔀 Absolute URLs follow X-Forwarded-Proto/Host from trusted proxies (%s)", proxies)
+	}
+	return nil
+}
+
+// fromTrustedProxy reports whether the peer of r is in TRUSTED_PROXIES
+func fromTrustedProxy(r *http.Request) bool {
+	ip := parseIPAddress(r.RemoteAddr)
+	return ip != nil && trustedProxyIP(ip)
+}
+
+// trustedProxyIP reports whether ip is in TRUSTED_PROXIES
+func trustedProxyIP(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstForwardedValue returns the first entry of a comma-separated forwarding header, the
+// one set by the proxy closest to the client
+func firstForwardedValue(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(first)
+}
+
+// forwardedBaseURL returns the external base URL a trusted proxy forwarded for r; false
+// when r did not come through one
+func forwardedBaseURL(r *http.Request) (string, bool) {
+	proto := strings.ToLower(firstForwardedValue(r.Header.Get("X-Forwarded-Proto")))
+	host := firstForwardedValue(r.Header.Get("X-Forwarded-Host"))
+	if (proto == "" && host == "") || !fromTrustedProxy(r) {
+		return "", false
+	}
+	configured, _ := url.Parse(baseURL())
+	if proto != "http" && proto != "https" {
+		proto = configured.Scheme
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if !forwardedHostPattern.MatchString(host) {
+		host = configured.Host
+	}
+	return proto + "://" + strings.ToLower(host), true
+}
+
+// requestBaseURL returns the base URL for absolute URLs in the response to r: BASE_URL, or
+// the forwarded address when PROXY_HEADERS_TRUSTED is set. r may be nil outside a request.
+// Every full short URL is built from this.
+func requestBaseURL(r *http.Request) string {
+	base := baseURL()
+	if r == nil || !proxyHeadersTrusted {
+		return base
+	}
+	forwarded, ok := forwardedBaseURL(r)
+	if !ok {
+		return base
+	}
+	if forwarded != base {
+		baseURLMismatchOnce.Do(func() {
+			log.Printf("⚠️  Requests arrive as %s but BASE_URL is %s; absolute URLs follow the proxy headers", forwarded, base)
+		})
+	}
+	return forwarded
+}
+
+// baseURLHealth is the base_url item of /health
+func baseURLHealth(r *http.Request) map[string]interface{} {
+	item := map[string]interface{}{
+		"status":                "ok",
+		"configured":            baseURL(),
+		"proxy_headers_trusted": proxyHeadersTrusted,
+	}
+	if baseURLProblem != "" {
+		item["status"] = "invalid"
+		item["warning"] = "BASE_URL is invalid (" + baseURLProblem + "); the default is used"
+		return item
+	}
+	forwarded, ok := forwardedBaseURL(r)
+	if !ok || forwarded == baseURL() {
+		return item
+	}
+	item["status"] = "mismatch"
+	item["forwarded"] = forwarded
+	if proxyHeadersTrusted {
+		item["warning"] = "requests arrive as " + forwarded + "; absolute URLs follow the proxy, but BASE_URL differs"
+	} else {
+		item["warning"] = "requests arrive as " + forwarded + " but absolute URLs use BASE_URL; fix BASE_URL or set PROXY_HEADERS_TRUSTED=true"
+	}
+	return item
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withProxyHeadersTrusted sets PROXY_HEADERS_TRUSTED for the duration of a test
+func withProxyHeadersTrusted(t *testing.T, trusted bool) {
+	t.Helper()
+	saved := proxyHeadersTrusted
+	proxyHeadersTrusted = trusted
+	t.Cleanup(func() { proxyHeadersTrusted = saved })
+}
+
+func TestValidateBaseURL(t *testing.T) {
+	for _, valid := range []string{"https://go.example.com", "http://localhost:8080", "https://go.example.com/", "http://[::1]:8080"} {
+		if err := validateBaseURL(valid); err != nil {
+			t.Errorf("%q rejected: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"go.example.com", "ftp://go.example.com", "https://", "https://go.example.com/app",
+		"https://user:pw@go.example.com", "https://go.example.com?x=1", "https://go.example.com#top", "://", ""} {
+		if err := validateBaseURL(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestForwardedBaseURL(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name  string
+		peer  string
+		proto string
+		host  string
+		want  string // "" when the headers are not used
+	}{
+		{"trusted proxy", "10.1.2.3:5000", "https", "links.example.org", "https://links.example.org"},
+		{"host with port", "10.1.2.3:5000", "http", "links.example.org:8443", "http://links.example.org:8443"},
+		{"upper case", "10.1.2.3:5000", "HTTPS", "Links.Example.ORG", "https://links.example.org"},
+		{"first of a chain", "10.1.2.3:5000", "https, http", "links.example.org, internal.local", "https://links.example.org"},
+		{"proto only uses the Host header", "10.1.2.3:5000", "https", "", "https://api.internal:8080"},
+		{"host only keeps the configured scheme", "10.1.2.3:5000", "", "links.example.org", "https://links.example.org"},
+		{"unknown proto", "10.1.2.3:5000", "gopher", "links.example.org", "https://links.example.org"},
+		{"hostile host", "10.1.2.3:5000", "https", "evil.example/path?x=<script>", "https://go.example.com"},
+		{"host with userinfo", "10.1.2.3:5000", "https", "user@evil.example", "https://go.example.com"},
+		{"untrusted peer", "203.0.113.9:5000", "https", "evil.example", ""},
+		{"no headers", "10.1.2.3:5000", "", "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Host = "api.internal:8080"
+		req.RemoteAddr = tt.peer
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if tt.host != "" {
+			req.Header.Set("X-Forwarded-Host", tt.host)
+		}
+		got, ok := forwardedBaseURL(req)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: headers used: %s", tt.name, got)
+			}
+			continue
+		}
+		if !ok || got != tt.want {
+			t.Errorf("%s: forwardedBaseURL = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestProxiedAbsoluteURLs(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	create := func(peer, longURL string) URLData {
+		req := httptest.NewRequest("PUT", "/url", jsonBody(t, map[string]interface{}{"long-url": longURL}))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "links.example.org")
+		rec := srv.serveFrom(peer, req)
+		var link URLData
+		if err := json.Unmarshal(rec.Body.Bytes(), &link); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("shorten from %s: status %d, %v", peer, rec.Code, err)
+		}
+		return link
+	}
+	health := func(peer string) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "links.example.org")
+		var body struct {
+			BaseURL map[string]interface{} `json:"base_url"`
+		}
+		json.Unmarshal(srv.serveFrom(peer, req).Body.Bytes(), &body)
+		return body.BaseURL
+	}
+
+	// Without PROXY_HEADERS_TRUSTED absolute URLs use BASE_URL and /health warns
+	withProxyHeadersTrusted(t, false)
+	if link := create("10.1.2.3:5000", "https://example.com/untrusted-mode"); link.FullShortURL != "https://go.example.com/"+link.ShortURL {
+		t.Fatalf("full_short_url %s", link.FullShortURL)
+	}
+	if item := health("10.1.2.3:5000"); item["status"] != "mismatch" || item["forwarded"] != "https://links.example.org" || item["warning"] == nil {
+		t.Fatalf("health base_url %v", item)
+	}
+
+	withProxyHeadersTrusted(t, true)
+	if link := create("10.1.2.3:5000", "https://example.com/proxied"); link.FullShortURL != "https://links.example.org/"+link.ShortURL {
+		t.Fatalf("proxied full_short_url %s", link.FullShortURL)
+	}
+	// Forwarded headers from anyone else are ignored
+	if link := create("203.0.113.9:5000", "https://example.com/direct"); link.FullShortURL != "https://go.example.com/"+link.ShortURL {
+		t.Fatalf("full_short_url from an untrusted peer %s", link.FullShortURL)
+	}
+	if item := health("203.0.113.9:5000"); item["status"] != "ok" {
+		t.Fatalf("health base_url from an untrusted peer %v", item)
+	}
+	if item := health("10.1.2.3:5000"); item["status"] != "mismatch" || item["proxy_headers_trusted"] != true {
+		t.Fatalf("health base_url %v", item)
+	}
+}
+
+func TestAbsoluteURLsUseRequestBaseURL(t *testing.T) {
+	// BASE_URL is read in base_url.go and shorturl.go only; everything else builds on
+	// requestBaseURL, or baseURL outside a request
+	for name, src := range goSources(t) {
+		if name != "base_url.go" && name != "shorturl.go" && strings.Contains(src, `os.Getenv("BASE_URL") +`) {
+			t.Errorf("%s builds a URL from BASE_URL directly", name)
+		}
+	}
+}
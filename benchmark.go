@@ -90,7 +90,8 @@ func mainBenchmark() {
 				resp, err := client.Do(httpReq)
 
 				mutex.Lock()
-				if err != nil || (resp != nil && resp.StatusCode != 200) {
+				// 201 for a new link, 200 when an existing one is reused
+				if err != nil || (resp != nil && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK) {
 					errorCount++
 				} else {
 					successCount++
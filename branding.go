@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// DOMAIN BRANDING
+// ============================================================================
+//
+// Pages served on a custom domain (404s, interstitials, error pages) can carry the domain
+// owner's logo, primary color, support email and footer instead of the plain defaults.
+// Branding is looked up by the request's Host and cached for brandingCacheTTL, so a change
+// reaches every instance within a minute. There is no self-service domain verification yet,
+// so only admins set branding, through /admin/domains/{host}/branding.
+//
+// Nothing reaches the page unchecked: colors must be #rrggbb, footers are plain text and the
+// logo is fetched once, checked to be a PNG, JPEG, GIF or WebP image and served from
+// /branding/logo on the branded domain itself. SVG is refused since it can carry script.
+
+const (
+	brandingCacheTTL      = time.Minute
+	brandingCacheCapacity = 1000
+	brandingLogoMaxBytes  = 256 * 1024
+	brandingFooterMaxLen  = 200
+)
+
+// DomainBranding is the look of the pages served on one custom domain
+type DomainBranding struct {
+	Host         string    `bson:"_id" json:"host"`
+	LogoURL      string    `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+	LogoData     []byte    `bson:"logo_data,omitempty" json:"-"`
+	LogoType     string    `bson:"logo_type,omitempty" json:"-"`
+	PrimaryColor string    `bson:"primary_color,omitempty" json:"primary_color,omitempty"`
+	SupportEmail string    `bson:"support_email,omitempty" json:"support_email,omitempty"`
+	FooterText   string    `bson:"footer_text,omitempty" json:"footer_text,omitempty"`
+	UpdatedAt    time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// logoVersion is a short hash of the logo, used to make its URL change with the image
+func (b *DomainBranding) logoVersion() string {
+	sum := sha256.Sum256(b.LogoData)
+	return hex.EncodeToString(sum[:6])
+}
+
+// logoPath is where the branded domain serves its logo, or "" without one
+func (b *DomainBranding) logoPath() string {
+	if len(b.LogoData) == 0 {
+		return ""
+	}
+	return "/branding/logo?v=" + b.logoVersion()
+}
+
+var (
+	brandingHostPattern  = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+	brandingColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+	brandingLogoTypes    = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+)
+
+// brandingCacheEntry is a cached lookup; branding is nil for hosts without branding
+type brandingCacheEntry struct {
+	branding *DomainBranding
+	expires  time.Time
+}
+
+var (
+	brandingCache      = make(map[string]brandingCacheEntry)
+	brandingCacheMutex = sync.RWMutex{}
+)
+
+// requestHostname returns the lower-cased Host of r without its port
+func requestHostname(r *http.Request) string {
+	return strings.ToLower(strings.TrimSuffix(splitHost(r.Host), "."))
+}
+
+// brandingForRequest returns the branding of the domain r was sent to, or nil for the
+// default look. Lookup failures fall back to the default rather than failing the page.
+func brandingForRequest(r *http.Request) *DomainBranding {
+	host := requestHostname(r)
+	if !brandingHostPattern.MatchString(host) {
+		return nil
+	}
+	now := clock.Now()
+	brandingCacheMutex.RLock()
+	entry, cached := brandingCache[host]
+	brandingCacheMutex.RUnlock()
+	if cached && now.Before(entry.expires) {
+		return entry.branding
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	branding, err := Links.GetDomainBranding(ctx, host)
+	if errors.Is(err, ErrNotFound) {
+		branding, err = nil, nil
+	}
+	if err != nil {
+		log.Printf("error loading branding for %s: %v", host, err)
+		return nil
+	}
+
+	brandingCacheMutex.Lock()
+	if len(brandingCache) >= brandingCacheCapacity {
+		brandingCache = make(map[string]brandingCacheEntry)
+	}
+	brandingCache[host] = brandingCacheEntry{branding: branding, expires: now.Add(brandingCacheTTL)}
+	brandingCacheMutex.Unlock()
+	return branding
+}
+
+// forgetBranding drops host from this instance's cache after an admin change
+func forgetBranding(host string) {
+	brandingCacheMutex.Lock()
+	delete(brandingCache, host)
+	brandingCacheMutex.Unlock()
+}
+
+// sanitizeFooterText strips control characters and trims the footer to brandingFooterMaxLen
+// characters; escaping is left to the page template
+func sanitizeFooterText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > brandingFooterMaxLen {
+		s = string([]rune(s)[:brandingFooterMaxLen])
+	}
+	return s
+}
+
+// fetchBrandingLogo downloads the logo at rawURL and returns it with its sniffed image type
+func fetchBrandingLogo(ctx context.Context, rawURL string) ([]byte, string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return nil, "", errors.New("logo_url must be an https URL")
+	}
+	body, _, truncated, err := safeFetch(ctx, rawURL, brandingLogoMaxBytes)
+	if err != nil {
+		return nil, "", errors.New("could not fetch logo_url: " + err.Error())
+	}
+	if truncated {
+		return nil, "", errors.New("logo must be at most " + strconv.Itoa(brandingLogoMaxBytes/1024) + " KB")
+	}
+	// The type is sniffed from the bytes; the origin's Content-Type is not trusted
+	contentType := http.DetectContentType(body)
+	if !brandingLogoTypes[contentType] {
+		return nil, "", errors.New("logo must be a PNG, JPEG, GIF or WebP image")
+	}
+	return body, contentType, nil
+}
+
+// brandingLogo handles GET /branding/logo on a branded domain
+func brandingLogo(w http.ResponseWriter, r *http.Request) {
+	branding := brandingForRequest(r)
+	if branding == nil || len(branding.LogoData) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	version := branding.logoVersion()
+	etag := `"` + version + `"`
+	addSecurityHeaders(w)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("ETag", etag)
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", staticImmutableCache)
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if etagListMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", branding.LogoType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(branding.LogoData)))
+	w.Write(branding.LogoData)
+}
+
+// brandingResponse is the admin view of a domain's branding
+func brandingResponse(b *DomainBranding) map[string]interface{} {
+	return map[string]interface{}{
+		"host":          b.Host,
+		"logo_url":      b.LogoURL,
+		"logo_path":     b.logoPath(),
+		"primary_color": b.PrimaryColor,
+		"support_email": b.SupportEmail,
+		"footer_text":   b.FooterText,
+		"updated_at":    b.UpdatedAt,
+	}
+}
+
+// brandingHostFromRequest validates the {host} route variable
+func brandingHostFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	host := strings.ToLower(mux.Vars(r)["host"])
+	if !brandingHostPattern.MatchString(host) || len(host) > 253 {
+		http.Error(w, "host must be a domain name such as links.example.com", http.StatusBadRequest)
+		return "", false
+	}
+	return host, true
+}
+
+// writeBrandingJSON writes an admin branding response
+func writeBrandingJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("error encoding branding response: %v", err)
+	}
+}
+
+// adminGetBranding handles GET /admin/domains/{host}/branding
+func adminGetBranding(w http.ResponseWriter, r *http.Request) {
+	host, ok := brandingHostFromRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	branding, err := Links.GetDomainBranding(ctx, host)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "No branding for this domain", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("error loading branding for %s: %v", host, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	writeBrandingJSON(w, http.StatusOK, brandingResponse(branding))
+}
+
+// adminPutBranding handles PUT /admin/domains/{host}/branding, replacing all settings;
+// omitted fields are cleared
+func adminPutBranding(w http.ResponseWriter, r *http.Request) {
+	host, ok := brandingHostFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		LogoURL      string `json:"logo_url"`
+		PrimaryColor string `json:"primary_color"`
+		SupportEmail string `json:"support_email"`
+		FooterText   string `json:"footer_text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	branding := &DomainBranding{
+		Host:         host,
+		LogoURL:      strings.TrimSpace(body.LogoURL),
+		PrimaryColor: strings.ToLower(strings.TrimSpace(body.PrimaryColor)),
+		SupportEmail: strings.TrimSpace(body.SupportEmail),
+		FooterText:   sanitizeFooterText(body.FooterText),
+		UpdatedAt:    clock.Now(),
+	}
+	if branding.PrimaryColor != "" && !brandingColorPattern.MatchString(branding.PrimaryColor) {
+		http.Error(w, "primary_color must be a hex color such as #2563eb", http.StatusBadRequest)
+		return
+	}
+	if branding.SupportEmail != "" && !validateEmail(branding.SupportEmail) {
+		http.Error(w, "support_email is not a valid email address", http.StatusBadRequest)
+		return
+	}
+	if branding.LogoURL != "" {
+		fetchCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		data, contentType, err := fetchBrandingLogo(fetchCtx, branding.LogoURL)
+		cancel()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		branding.LogoData, branding.LogoType = data, contentType
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Links.SaveDomainBranding(ctx, branding); err != nil {
+		log.Printf("error saving branding for %s: %v", host, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	forgetBranding(host)
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "DOMAIN_BRANDING_UPDATED", adminID, getClientIP(r), r.UserAgent(), "Branding of "+host+" updated", "INFO")
+	writeBrandingJSON(w, http.StatusOK, brandingResponse(branding))
+}
+
+// adminDeleteBranding handles DELETE /admin/domains/{host}/branding
+func adminDeleteBranding(w http.ResponseWriter, r *http.Request) {
+	host, ok := brandingHostFromRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deleted, err := Links.DeleteDomainBranding(ctx, host)
+	if err != nil {
+		log.Printf("error deleting branding for %s: %v", host, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "No branding for this domain", http.StatusNotFound)
+		return
+	}
+	forgetBranding(host)
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "DOMAIN_BRANDING_DELETED", adminID, getClientIP(r), r.UserAgent(), "Branding of "+host+" removed", "INFO")
+	writeBrandingJSON(w, http.StatusOK, map[string]interface{}{"success": true, "host": host})
+}
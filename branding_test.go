@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateSnapshots = flag.Bool("update", false, "rewrite the testdata snapshots")
+
+// matchSnapshot compares got with testdata/name, or rewrites the file with -update
+func matchSnapshot(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateSnapshots {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the snapshot (run with -update to accept):\n%s", name, got)
+	}
+}
+
+// testLogo is a 2x2 PNG
+func testLogo(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// brandedPage fetches path on host as a browser, with the fingerprint of the stylesheet
+// left out so the snapshots survive CSS changes
+func brandedPage(srv *testServer, host, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Host = host
+	req.Header.Set("Accept", "text/html")
+	rec := srv.serveFrom("192.0.2.80:5000", req)
+	body := strings.Replace(rec.Body.String(), staticURL("page.css"), "/static/page.css", 1)
+	rec.Body = bytes.NewBufferString(body)
+	return rec
+}
+
+func TestBrandedInterstitialSnapshots(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	restrictedOwners.set(userID, true)
+	t.Cleanup(func() { restrictedOwners.set(userID, false) })
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/offer?id=1"})
+
+	const host = "go.brand.example"
+	logo := testLogo(t)
+	err := srv.links.SaveDomainBranding(context.Background(), &DomainBranding{
+		Host: host, LogoData: logo, LogoType: "image/png", PrimaryColor: "#c2410c",
+		SupportEmail: "help@brand.example", FooterText: "© Brand <Co> & Partners",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forgetBranding(host) })
+
+	branded := brandedPage(srv, host, "/"+code)
+	plain := brandedPage(srv, "go.example.com", "/"+code)
+	if branded.Code != http.StatusOK || plain.Code != http.StatusOK {
+		t.Fatalf("interstitial: status %d branded, %d default", branded.Code, plain.Code)
+	}
+	matchSnapshot(t, "interstitial_branded.html", branded.Body.String())
+	matchSnapshot(t, "interstitial_default.html", plain.Body.String())
+
+	// The host's port and case do not matter
+	if again := brandedPage(srv, "Go.Brand.Example:443", "/"+code); again.Body.String() != branded.Body.String() {
+		t.Fatal("branding depends on the Host's case or port")
+	}
+	// Other system pages carry it too
+	if page := brandedPage(srv, host, "/no-such-code").Body.String(); !strings.Contains(page, "--brand: #c2410c") || !strings.Contains(page, "help@brand.example") {
+		t.Fatalf("branded 404 page:\n%s", page)
+	}
+
+	// The logo is served by the branded domain under its versioned URL
+	sum := (&DomainBranding{LogoData: logo}).logoPath()
+	req := httptest.NewRequest("GET", sum, nil)
+	req.Host = host
+	rec := srv.serveFrom("192.0.2.80:5000", req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rec.Body.Bytes(), logo) {
+		t.Fatalf("logo: status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("Cache-Control") != staticImmutableCache {
+		t.Fatalf("versioned logo Cache-Control %q", rec.Header().Get("Cache-Control"))
+	}
+	req = httptest.NewRequest("GET", sum, nil)
+	req.Host = host
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	if rec := srv.serveFrom("192.0.2.80:5000", req); rec.Code != http.StatusNotModified {
+		t.Fatalf("logo revalidation: status %d", rec.Code)
+	}
+	if rec := srv.serveFrom("192.0.2.80:5000", httptest.NewRequest("GET", sum, nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("logo on an unbranded host: status %d", rec.Code)
+	}
+}
+
+func TestBrandingAdminValidation(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	user, _ := srv.register()
+	const path = "/admin/domains/links.brand.example/branding"
+	t.Cleanup(func() { forgetBranding("links.brand.example") })
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"named color", map[string]interface{}{"primary_color": "red"}},
+		{"short hex", map[string]interface{}{"primary_color": "#fff"}},
+		{"css injection", map[string]interface{}{"primary_color": "#ffffff; background: url(x)"}},
+		{"bad email", map[string]interface{}{"support_email": "help at brand"}},
+		{"logo over http", map[string]interface{}{"logo_url": "http://brand.example/logo.png"}},
+		{"logo on a private address", map[string]interface{}{"logo_url": "https://127.0.0.1/logo.png"}},
+	}
+	for _, tt := range tests {
+		if resp := srv.do("PUT", path, admin, tt.body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.name, resp.StatusCode)
+		}
+	}
+	if resp := srv.do("PUT", "/admin/domains/not_a_host/branding", admin, map[string]interface{}{}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid host: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("PUT", path, user, map[string]interface{}{"primary_color": "#c2410c"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin: status %d", resp.StatusCode)
+	}
+
+	// Upper-case colors are normalized and the footer loses its control characters
+	var saved DomainBranding
+	resp := srv.do("PUT", path, admin, map[string]interface{}{
+		"primary_color": "#C2410C", "footer_text": "Brand\x00 Co\r\n<b>bold</b>" + strings.Repeat("x", 300),
+	}, &saved)
+	if resp.StatusCode != http.StatusOK || saved.PrimaryColor != "#c2410c" {
+		t.Fatalf("status %d, %+v", resp.StatusCode, saved)
+	}
+	if strings.ContainsAny(saved.FooterText, "\x00\r\n") || len([]rune(saved.FooterText)) > brandingFooterMaxLen {
+		t.Fatalf("footer %q", saved.FooterText)
+	}
+	page := brandedPage(srv, "links.brand.example", "/no-such-code").Body.String()
+	if strings.Contains(page, "<b>bold</b>") || !strings.Contains(page, "&lt;b&gt;bold&lt;/b&gt;") {
+		t.Fatalf("footer not escaped:\n%s", page)
+	}
+
+	// Removing the branding restores the default look at once on this instance
+	if resp := srv.do("DELETE", path, admin, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if page := brandedPage(srv, "links.brand.example", "/no-such-code").Body.String(); strings.Contains(page, "--brand") {
+		t.Fatal("branding still applied after delete")
+	}
+	if resp := srv.do("DELETE", path, admin, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second delete: status %d", resp.StatusCode)
+	}
+}
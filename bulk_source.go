@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// BULK UPLOAD FROM A REMOTE CSV
+// ============================================================================
+//
+// POST /bulk with a JSON body {"source_url": "..."} makes the server fetch the CSV itself and
+// run it through the same pipeline as an uploaded file. A Google Sheets link is turned into
+// its CSV export, so a sheet shared "with anyone who has the link" works as is. Fetches go
+// through safeFetch (no private addresses) and are capped at 10MB like uploads.
+//
+// Each import is kept as a bulk job remembering the canonical long URLs it created. POST
+// /bulk/resync/{job_id} fetches the source again and creates only the rows not seen before,
+// so a sheet can keep growing. Rows that failed are not remembered and are retried.
+
+const (
+	bulkSourceMaxBytes     = 10 << 20
+	bulkSourceRateLimit    = 10
+	bulkSourceRateWindow   = time.Hour
+	bulkSourceFetchTimeout = 30 * time.Second
+)
+
+// BulkSource is a source_url import that can be resynced
+type BulkSource struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	UserID       string             `bson:"user_id"`
+	SourceURL    string             `bson:"source_url"`
+	SeenURLs     []string           `bson:"seen_urls"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	LastSyncedAt time.Time          `bson:"last_synced_at"`
+}
+
+// bulkSourceError is a failed source fetch; code tells network, size, type and parse
+// problems apart
+type bulkSourceError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *bulkSourceError) Error() string { return e.message }
+
+// bulkSourceTypes are the Content-Types accepted as CSV; servers label CSV loosely
+var bulkSourceTypes = map[string]bool{
+	"":                            true,
+	"text/csv":                    true,
+	"text/plain":                  true,
+	"text/comma-separated-values": true,
+	"application/csv":             true,
+	"application/octet-stream":    true,
+}
+
+var (
+	sheetsURLPattern = regexp.MustCompile(`^/spreadsheets/d/([A-Za-z0-9_-]+)`)
+	sheetsGIDPattern = regexp.MustCompile(`gid=([0-9]+)`)
+)
+
+// bulkSourceFetchURL validates a source_url and rewrites Google Sheets edit/view links to
+// their CSV export
+func bulkSourceFetchURL(raw string) (string, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Hostname() == "" {
+		return "", errors.New("source_url must be an http(s) URL")
+	}
+	if parsed.User != nil {
+		return "", errors.New("source_url must not contain credentials")
+	}
+	if strings.EqualFold(parsed.Hostname(), "docs.google.com") {
+		match := sheetsURLPattern.FindStringSubmatch(parsed.Path)
+		if match != nil && !strings.Contains(parsed.Path, "/export") && !strings.Contains(parsed.Path, "/pub") {
+			export := "https://docs.google.com/spreadsheets/d/" + match[1] + "/export?format=csv"
+			// The tab is in the fragment (#gid=N) of edit links, or the query
+			if gid := sheetsGIDPattern.FindStringSubmatch(parsed.Fragment + "&" + parsed.RawQuery); gid != nil {
+				export += "&gid=" + gid[1]
+			}
+			return export, nil
+		}
+	}
+	return parsed.String(), nil
+}
+
+// fetchBulkSource downloads and parses the CSV at fetchURL
+func fetchBulkSource(ctx context.Context, fetchURL string) ([]BulkURLRequest, error) {
+	body, contentType, truncated, err := safeFetch(ctx, fetchURL, bulkSourceMaxBytes)
+	if err != nil {
+		return nil, &bulkSourceError{http.StatusBadGateway, ErrCodeSourceFetchFailed,
+			"Could not fetch source_url: " + err.Error()}
+	}
+	if truncated {
+		return nil, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceTooLarge,
+			fmt.Sprintf("source_url is larger than %dMB", bulkSourceMaxBytes>>20)}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/html" {
+		// Sheets that are not shared publicly answer with a sign-in page
+		return nil, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceNotCSV,
+			"source_url returned a web page, not CSV; make sure it is shared with anyone who has the link"}
+	}
+	if !bulkSourceTypes[mediaType] {
+		return nil, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceNotCSV,
+			"source_url returned " + mediaType + ", not CSV"}
+	}
+	urls, err := parseCSV(bytes.NewReader(body))
+	if err != nil {
+		return nil, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceParseFailed,
+			"Could not parse the CSV from source_url: " + err.Error()}
+	}
+	if len(urls) > maxURLsPerBatch {
+		return nil, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceTooLarge,
+			fmt.Sprintf("source_url has too many URLs. Maximum allowed: %d (found: %d)", maxURLsPerBatch, len(urls))}
+	}
+	return urls, nil
+}
+
+// canonicalLongURL is the form rows are compared in across resyncs: scheme and host
+// lower-cased, default ports and fragments dropped
+func canonicalLongURL(raw string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return strings.TrimSpace(raw)
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	host := strings.ToLower(parsed.Hostname())
+	if port := parsed.Port(); port != "" && !(parsed.Scheme == "http" && port == "80") && !(parsed.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	parsed.Host = host
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	return parsed.String()
+}
+
+// createdCanonicalURLs returns the canonical long URLs of the rows that got a link
+func createdCanonicalURLs(urls []BulkURLRequest, results *BulkResponse) []string {
+	created := []string{}
+	for i, result := range results.Results {
+		if result.Success {
+			created = append(created, canonicalLongURL(urls[i].LongURL))
+		}
+	}
+	return created
+}
+
+// writeBulkSourceError answers a failed fetch with its error code
+func writeBulkSourceError(w http.ResponseWriter, r *http.Request, userID string, err error) {
+	var sourceErr *bulkSourceError
+	if !errors.As(err, &sourceErr) {
+		sourceErr = &bulkSourceError{http.StatusInternalServerError, ErrCodeSourceFetchFailed, err.Error()}
+	}
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_ERROR", userID, getClientIP(r), r.UserAgent(),
+		"Source fetch failed: "+sourceErr.message, "WARN")
+	writeJSONError(w, sourceErr.status, sourceErr.code, sourceErr.message, nil)
+}
+
+// checkBulkSourceRate limits source fetches per user; they cost an outbound request each
+func checkBulkSourceRate(w http.ResponseWriter, r *http.Request, userID string) bool {
+	policy := requestConfig(r).RateLimit("bulk_source")
+	if limit := checkRateLimit("bulk-source:"+userID, policy.Limit, policy.Window); limit.Limited {
+		writeRateLimited(w, limit)
+		return false
+	}
+	return true
+}
+
+// writeBulkResults writes a bulk response
+func writeBulkResults(w http.ResponseWriter, results *BulkResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("error encoding bulk response: %v", err)
+	}
+}
+
+// bulkFromSource handles POST /bulk with a JSON {"source_url": ...} body
+func bulkFromSource(w http.ResponseWriter, r *http.Request, userID string) {
+	var body struct {
+		SourceURL string `json:"source_url"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidSourceURL, "Invalid JSON payload", nil)
+		return
+	}
+	sourceURL := strings.TrimSpace(body.SourceURL)
+	fetchURL, err := bulkSourceFetchURL(sourceURL)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidSourceURL, err.Error(), nil)
+		return
+	}
+	if !checkBulkSourceRate(w, r, userID) {
+		return
+	}
+
+	startTime := time.Now()
+	fetchCtx, cancel := context.WithTimeout(r.Context(), bulkSourceFetchTimeout)
+	urls, err := fetchBulkSource(fetchCtx, fetchURL)
+	cancel()
+	if err != nil {
+		writeBulkSourceError(w, r, userID, err)
+		return
+	}
+	if len(urls) == 0 {
+		writeBulkSourceError(w, r, userID, &bulkSourceError{http.StatusUnprocessableEntity, ErrCodeSourceParseFailed,
+			"No valid URLs found in source_url"})
+		return
+	}
+
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_START", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Processing %d rows from %s", len(urls), redactURL(sourceURL)), "INFO")
+	results := processBulkRows(r, urls, userID, getClientIP(r), r.UserAgent(), startTime, bulkImportOptions{})
+
+	now := clock.Now()
+	job := BulkSource{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		SourceURL:    sourceURL,
+		SeenURLs:     createdCanonicalURLs(urls, results),
+		CreatedAt:    now,
+		LastSyncedAt: now,
+	}
+	ctx, cancelStore := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelStore()
+	if _, err := DB.Database.Collection("bulk_sources").InsertOne(ctx, job); err != nil {
+		// The links exist either way; only resync is lost
+		log.Printf("error saving bulk source for user %s: %v", userID, err)
+	} else {
+		results.JobID = job.ID.Hex()
+	}
+
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_COMPLETE", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Processed %d URLs, %d successful, %d failed",
+			results.TotalProcessed, results.Successful, results.Failed), "INFO")
+	writeBulkResults(w, results)
+}
+
+// bulkResync handles POST /bulk/resync/{job_id}: the job's source is fetched again and only
+// rows whose canonical long URL has not been created by the job are processed
+func bulkResync(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["job_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Bulk job not found", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	jobs := DB.Database.Collection("bulk_sources")
+	var job BulkSource
+	err = jobs.FindOne(ctx, bson.D{{Key: "_id", Value: jobID}, {Key: "user_id", Value: userID}}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSONError(w, http.StatusNotFound, ErrCodeNotFound, "Bulk job not found", nil)
+		return
+	} else if err != nil {
+		log.Printf("error loading bulk job %s: %v", jobID.Hex(), err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !checkBulkSourceRate(w, r, userID) {
+		return
+	}
+
+	startTime := time.Now()
+	fetchURL, err := bulkSourceFetchURL(job.SourceURL)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidSourceURL, err.Error(), nil)
+		return
+	}
+	fetchCtx, cancelFetch := context.WithTimeout(r.Context(), bulkSourceFetchTimeout)
+	urls, err := fetchBulkSource(fetchCtx, fetchURL)
+	cancelFetch()
+	if err != nil {
+		writeBulkSourceError(w, r, userID, err)
+		return
+	}
+
+	seen := make(map[string]bool, len(job.SeenURLs))
+	for _, u := range job.SeenURLs {
+		seen[u] = true
+	}
+	var fresh []BulkURLRequest
+	skipped := 0
+	for _, row := range urls {
+		canonical := canonicalLongURL(row.LongURL)
+		if seen[canonical] {
+			skipped++
+			continue
+		}
+		// A URL listed twice in the sheet is created once
+		seen[canonical] = true
+		fresh = append(fresh, row)
+	}
+
+	results := &BulkResponse{Results: []BulkURLResult{}, ProcessingTime: time.Since(startTime).String()}
+	if len(fresh) > 0 {
+		results = processBulkRows(r, fresh, userID, getClientIP(r), r.UserAgent(), startTime, bulkImportOptions{})
+	}
+	results.JobID = job.ID.Hex()
+	results.Skipped = skipped
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "last_synced_at", Value: clock.Now()}}}}
+	if created := createdCanonicalURLs(fresh, results); len(created) > 0 {
+		update = append(update, bson.E{Key: "$addToSet", Value: bson.D{{Key: "seen_urls", Value: bson.D{{Key: "$each", Value: created}}}}})
+	}
+	updateCtx, cancelUpdate := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelUpdate()
+	if _, err := jobs.UpdateOne(updateCtx, bson.D{{Key: "_id", Value: job.ID}}, update); err != nil {
+		log.Printf("error updating bulk job %s: %v", job.ID.Hex(), err)
+	}
+
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_COMPLETE", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Resynced job %s: %d new URLs, %d successful, %d failed, %d skipped",
+			job.ID.Hex(), results.TotalProcessed, results.Successful, results.Failed, skipped), "INFO")
+	writeBulkResults(w, results)
+}
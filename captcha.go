@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CAPTCHA
+// ============================================================================
+//
+// A CaptchaVerifier checks the token a CAPTCHA widget gives the browser. CAPTCHA_PROVIDER
+// picks hCaptcha or Turnstile, or any siteverify-style endpoint through CAPTCHA_VERIFY_URL,
+// with CAPTCHA_SECRET. Without one the no-op verifier is used and no token is ever asked
+// for. Verification calls time out after captchaVerifyTimeout. When the provider fails,
+// CAPTCHA_FAIL_OPEN=true lets the request through instead of answering 503.
+//
+// Abuse reports always need a token when a provider is configured. Login and registration
+// only ask for one once the client's IP has LOGIN_CAPTCHA_THRESHOLD failed logins (default
+// 5) in the limiter's LOGIN_CAPTCHA_WINDOW (default 15m). The 428 CAPTCHA_REQUIRED answer
+// carries Retry-After: the time until the window ends and the gate lifts by itself.
+
+const captchaVerifyTimeout = 3 * time.Second
+
+// Well-known siteverify endpoints by CAPTCHA_PROVIDER
+var captchaProviders = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// CaptchaVerifier checks CAPTCHA widget tokens
+type CaptchaVerifier interface {
+	// Enabled reports whether tokens are checked at all
+	Enabled() bool
+	// Verify reports whether token is a valid solution sent from clientIP
+	Verify(ctx context.Context, token, clientIP string) (bool, error)
+}
+
+// noopCaptchaVerifier is used when no provider is configured
+type noopCaptchaVerifier struct{}
+
+func (noopCaptchaVerifier) Enabled() bool { return false }
+
+func (noopCaptchaVerifier) Verify(context.Context, string, string) (bool, error) { return true, nil }
+
+// siteverifyCaptcha posts tokens to a siteverify endpoint (hCaptcha, Turnstile, reCAPTCHA)
+type siteverifyCaptcha struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+func (c *siteverifyCaptcha) Enabled() bool { return true }
+
+func (c *siteverifyCaptcha) Verify(ctx context.Context, token, clientIP string) (bool, error) {
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {clientIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verifier returned %d", resp.StatusCode)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+var (
+	captcha               CaptchaVerifier = noopCaptchaVerifier{}
+	captchaFailOpen       bool
+	loginCaptchaThreshold = 5
+	loginCaptchaWindow    = 15 * time.Minute
+)
+
+// SetCaptchaVerifier installs a custom verifier; call before the server starts
+func SetCaptchaVerifier(verifier CaptchaVerifier) {
+	if verifier == nil {
+		verifier = noopCaptchaVerifier{}
+	}
+	captcha = verifier
+}
+
+// InitCaptcha configures the verifier and the login gate from the environment
+func InitCaptcha() {
+	captchaFailOpen = strings.EqualFold(os.Getenv("CAPTCHA_FAIL_OPEN"), "true")
+	loginCaptchaThreshold = envInt("LOGIN_CAPTCHA_THRESHOLD", loginCaptchaThreshold)
+	if raw := os.Getenv("LOGIN_CAPTCHA_WINDOW"); raw != "" {
+		if window, err := time.ParseDuration(raw); err == nil && window > 0 {
+			loginCaptchaWindow = window
+		} else {
+			log.Printf("⚠️  Invalid LOGIN_CAPTCHA_WINDOW %q, using %s", raw, loginCaptchaWindow)
+		}
+	}
+
+	verifyURL := os.Getenv("CAPTCHA_VERIFY_URL")
+	if provider := strings.ToLower(os.Getenv("CAPTCHA_PROVIDER")); provider != "" && verifyURL == "" {
+		if verifyURL = captchaProviders[provider]; verifyURL == "" {
+			log.Printf("⚠️  Unknown CAPTCHA_PROVIDER %q (use hcaptcha or turnstile), CAPTCHA disabled", provider)
+			return
+		}
+	}
+	if verifyURL == "" {
+		return
+	}
+	if os.Getenv("CAPTCHA_SECRET") == "" {
+		log.Printf("⚠️  CAPTCHA_SECRET is not set, CAPTCHA disabled")
+		return
+	}
+	SetCaptchaVerifier(&siteverifyCaptcha{
+		verifyURL: verifyURL,
+		secret:    os.Getenv("CAPTCHA_SECRET"),
+		client:    newOutboundClient(outboundOptions{timeout: captchaVerifyTimeout}),
+	})
+	log.Printf("🧩 CAPTCHA enabled (login gate after %d failures per %s, fail-open: %t)",
+		loginCaptchaThreshold, loginCaptchaWindow, captchaFailOpen)
+}
+
+// verifyCaptcha checks token with the configured verifier; always true when none is. A
+// verifier error is returned unless CAPTCHA_FAIL_OPEN lets the request through.
+func verifyCaptcha(ctx context.Context, token, clientIP string) (bool, error) {
+	if !captcha.Enabled() {
+		return true, nil
+	}
+	if token == "" {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, captchaVerifyTimeout)
+	defer cancel()
+	ok, err := captcha.Verify(ctx, token, clientIP)
+	if err != nil && captchaFailOpen {
+		log.Printf("CAPTCHA verification failed, letting the request through (fail-open): %v", err)
+		incMetric("captcha_fail_open", 1)
+		return true, nil
+	}
+	return ok, err
+}
+
+// noteLoginFailure counts a failed login against clientIP's login CAPTCHA window
+func noteLoginFailure(clientIP string) {
+	if captcha.Enabled() {
+		checkRateLimit("login-failures:"+rateLimitSubject(clientIP), math.MaxInt32, loginCaptchaWindow)
+	}
+}
+
+// requireLoginCaptcha checks the captcha_token of a login or registration from an IP that
+// is over the failure threshold, and answers the request itself when it may not proceed
+func requireLoginCaptcha(w http.ResponseWriter, r *http.Request, clientIP, token string) bool {
+	if !captcha.Enabled() {
+		return true
+	}
+	failures, resetAt := peekRateLimit("login-failures:"+rateLimitSubject(clientIP), loginCaptchaWindow)
+	if failures < loginCaptchaThreshold {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(time.Until(resetAt).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	details := map[string]interface{}{
+		"captcha_required":    true,
+		"retry_after_seconds": retryAfter,
+	}
+	if siteKey := os.Getenv("CAPTCHA_SITE_KEY"); siteKey != "" {
+		details["site_key"] = siteKey
+	}
+	if token == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		logSecurityEvent(r.Context(), "CAPTCHA_REQUIRED", "", clientIP, r.UserAgent(),
+			fmt.Sprintf("%d failed logins, CAPTCHA required on %s", failures, r.URL.Path), "WARN")
+		writeJSONError(w, http.StatusPreconditionRequired, ErrCodeCaptchaRequired,
+			"Too many failed logins from your network. Solve the CAPTCHA and send its captcha_token.", details)
+		return false
+	}
+	ok, err := verifyCaptcha(r.Context(), token, clientIP)
+	if err != nil {
+		log.Printf("error verifying captcha: %v", err)
+		writeJSONError(w, http.StatusServiceUnavailable, ErrCodeCaptchaUnavailable,
+			"CAPTCHA verification is unavailable, please try again later", nil)
+		return false
+	}
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		logSecurityEvent(r.Context(), "CAPTCHA_FAILED", "", clientIP, r.UserAgent(),
+			"CAPTCHA verification failed on "+r.URL.Path, "WARN")
+		writeJSONError(w, http.StatusBadRequest, ErrCodeCaptchaInvalid, "CAPTCHA verification failed", details)
+		return false
+	}
+	return true
+}
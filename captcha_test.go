@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubCaptcha accepts the token "solved", or fails every call with err
+type stubCaptcha struct {
+	err error
+
+	mu       sync.Mutex
+	clients  []string      // client IPs of the Verify calls
+	deadline time.Duration // time left on the last call's context
+}
+
+func (s *stubCaptcha) Enabled() bool { return true }
+
+func (s *stubCaptcha) Verify(ctx context.Context, token, clientIP string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = append(s.clients, clientIP)
+	if deadline, ok := ctx.Deadline(); ok {
+		s.deadline = time.Until(deadline)
+	}
+	if s.err != nil {
+		return false, s.err
+	}
+	return token == "solved", nil
+}
+
+// withCaptcha installs verifier, with the login gate after three failures, for one test
+func withCaptcha(t *testing.T, verifier CaptchaVerifier) {
+	t.Helper()
+	saved, savedThreshold, savedFailOpen := captcha, loginCaptchaThreshold, captchaFailOpen
+	SetCaptchaVerifier(verifier)
+	loginCaptchaThreshold = 3
+	t.Cleanup(func() {
+		SetCaptchaVerifier(saved)
+		loginCaptchaThreshold, captchaFailOpen = savedThreshold, savedFailOpen
+	})
+}
+
+// captchaAnswer is the JSON body of a refused login or registration
+type captchaAnswer struct {
+	Error struct {
+		Code              string `json:"code"`
+		CaptchaRequired   bool   `json:"captcha_required"`
+		RetryAfterSeconds int    `json:"retry_after_seconds"`
+	} `json:"error"`
+}
+
+// failLogins makes n logins with a wrong password
+func (s *testServer) failLogins(n int) {
+	s.t.Helper()
+	for i := 0; i < n; i++ {
+		resp := s.do("POST", "/auth/login", "", map[string]string{"username_or_email": "nobody", "password": "wrong-password-1"}, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			s.t.Fatalf("failed login %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+}
+
+func TestLoginCaptchaGate(t *testing.T) {
+	stub := &stubCaptcha{}
+	withCaptcha(t, stub)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	if token == "" {
+		t.Fatal("registration below the threshold needs no CAPTCHA")
+	}
+	srv.failLogins(3)
+
+	// Over the threshold, login and registration ask for a token
+	login := map[string]string{"username_or_email": "tester", "password": "correct-horse-1"}
+	var answer captchaAnswer
+	resp := srv.do("POST", "/auth/login", "", login, &answer)
+	if resp.StatusCode != http.StatusPreconditionRequired || answer.Error.Code != ErrCodeCaptchaRequired || !answer.Error.CaptchaRequired {
+		t.Fatalf("login without a token: status %d, %+v", resp.StatusCode, answer)
+	}
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > int(loginCaptchaWindow.Seconds()) || retryAfter != answer.Error.RetryAfterSeconds {
+		t.Fatalf("Retry-After %q, retry_after_seconds %d", resp.Header.Get("Retry-After"), answer.Error.RetryAfterSeconds)
+	}
+	register := map[string]string{"username": "gated", "email": "gated@example.com", "password": "correct-horse-1"}
+	if resp := srv.do("POST", "/auth/register", "", register, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("registration without a token: status %d", resp.StatusCode)
+	}
+	if len(stub.clients) != 0 {
+		t.Fatalf("verifier called without a token: %v", stub.clients)
+	}
+
+	// A wrong solution is refused with its own code, a right one lets the request through
+	register["captcha_token"] = "guessed"
+	answer = captchaAnswer{}
+	if resp := srv.do("POST", "/auth/register", "", register, &answer); resp.StatusCode != http.StatusBadRequest || answer.Error.Code != ErrCodeCaptchaInvalid {
+		t.Fatalf("wrong token: status %d, %+v", resp.StatusCode, answer)
+	}
+	register["captcha_token"] = "solved"
+	if resp := srv.do("POST", "/auth/register", "", register, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("solved token: status %d", resp.StatusCode)
+	}
+	if len(stub.clients) != 2 || stub.clients[1] != "127.0.0.1" {
+		t.Fatalf("verifier calls from %v", stub.clients)
+	}
+	if stub.deadline <= 0 || stub.deadline > captchaVerifyTimeout {
+		t.Fatalf("verification deadline %v, want within %v", stub.deadline, captchaVerifyTimeout)
+	}
+
+	// Other networks are not affected
+	req := httptest.NewRequest("POST", "/auth/login", jsonBody(t, login))
+	req.Header.Set("Content-Type", "application/json")
+	if rec := srv.serveFrom("192.0.2.15:4000", req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login from another network: status %d", rec.Code)
+	}
+}
+
+func TestLoginCaptchaDisabled(t *testing.T) {
+	srv := newTestServer(t)
+	if captcha.Enabled() {
+		t.Skip("a CAPTCHA provider is configured")
+	}
+	srv.failLogins(loginCaptchaThreshold + 2)
+	if token, _ := srv.register(); token == "" {
+		t.Fatal("no token after registration")
+	}
+}
+
+func TestLoginCaptchaVerifierDown(t *testing.T) {
+	stub := &stubCaptcha{err: context.DeadlineExceeded}
+	withCaptcha(t, stub)
+	srv := newTestServer(t)
+	srv.failLogins(3)
+	register := map[string]string{"username": "waiting", "email": "waiting@example.com", "password": "correct-horse-1", "captcha_token": "solved"}
+
+	// Fail closed by default
+	var answer captchaAnswer
+	if resp := srv.do("POST", "/auth/register", "", register, &answer); resp.StatusCode != http.StatusServiceUnavailable || answer.Error.Code != ErrCodeCaptchaUnavailable {
+		t.Fatalf("verifier timeout: status %d, %+v", resp.StatusCode, answer)
+	}
+
+	// Fail open lets the request through and counts it
+	captchaFailOpen = true
+	before := metricValue("captcha_fail_open")
+	if resp := srv.do("POST", "/auth/register", "", register, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("fail-open: status %d", resp.StatusCode)
+	}
+	if metricValue("captcha_fail_open") != before+1 {
+		t.Fatal("captcha_fail_open not counted")
+	}
+	// A wrong answer is still wrong when the verifier works
+	stub.mu.Lock()
+	stub.err = nil
+	stub.mu.Unlock()
+	if resp := srv.do("POST", "/auth/login", "", map[string]string{"username_or_email": "waiting", "password": "correct-horse-1", "captcha_token": "guessed"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong token with fail-open: status %d", resp.StatusCode)
+	}
+}
+
+func TestSiteverifyCaptcha(t *testing.T) {
+	var status int
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("secret") != "shh" || r.PostForm.Get("remoteip") != "192.0.2.1" {
+			t.Errorf("siteverify form %v", r.PostForm)
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"success": ` + strconv.FormatBool(r.PostForm.Get("response") == "solved") + `}`))
+	}))
+	defer verifier.Close()
+	c := &siteverifyCaptcha{verifyURL: verifier.URL, secret: "shh", client: verifier.Client()}
+
+	status = http.StatusOK
+	for token, want := range map[string]bool{"solved": true, "guessed": false} {
+		if ok, err := c.Verify(context.Background(), token, "192.0.2.1"); err != nil || ok != want {
+			t.Errorf("Verify(%q) = %v, %v", token, ok, err)
+		}
+	}
+	status = http.StatusInternalServerError
+	if _, err := c.Verify(context.Background(), "solved", "192.0.2.1"); err == nil {
+		t.Error("no error from a failing provider")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Verify(ctx, "solved", "192.0.2.1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled verification: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// SOCIAL CARDS
+// ============================================================================
+//
+// GET /url/{code}/card renders a 1200×630 PNG to attach when sharing a link: its title,
+// destination host, short URL and QR code, in a light or dark palette (?style=). Text uses
+// the built-in bitmap font in card_font.go, so only printable ASCII is drawn and anything
+// else shows as "?". The title wraps to three lines and the other lines are cut to fit.
+// The canvas never grows, so a render costs one 750KB paletted image and a few
+// milliseconds, and the route shares the heavy load-shedding budget. Cards are cached by
+// the link's updated_at and served with an ETag, so clients revalidate without a render.
+
+const (
+	cardWidth         = 1200
+	cardHeight        = 630
+	cardPadding       = 64
+	cardAccentBar     = 16
+	cardQRPanel       = 360
+	cardTitleScale    = 6
+	cardTitleLines    = 3
+	cardDetailScale   = 4
+	cardCacheCapacity = 200
+	cardMaxAge        = 24 * time.Hour
+)
+
+// Palette indexes of a card image
+const (
+	cardBackground = iota
+	cardText
+	cardMuted
+	cardAccent
+	cardPanel
+	cardInk
+)
+
+// cardStyle is the palette of one ?style= value
+type cardStyle struct {
+	background, text, muted color.RGBA
+}
+
+var cardStyles = map[string]cardStyle{
+	"light": {
+		background: color.RGBA{0xf8, 0xfa, 0xfc, 0xff},
+		text:       color.RGBA{0x0f, 0x17, 0x2a, 0xff},
+		muted:      color.RGBA{0x64, 0x74, 0x8b, 0xff},
+	},
+	"dark": {
+		background: color.RGBA{0x0f, 0x17, 0x2a, 0xff},
+		text:       color.RGBA{0xf8, 0xfa, 0xfc, 0xff},
+		muted:      color.RGBA{0x94, 0xa3, 0xb8, 0xff},
+	},
+}
+
+// cardDefaultAccent is used when the favicon fetcher has not picked an accent color
+var cardDefaultAccent = color.RGBA{0x25, 0x63, 0xeb, 0xff}
+
+var (
+	cardCache      = make(map[string][]byte)
+	cardCacheMutex = sync.RWMutex{}
+)
+
+// cardAccentColor parses a "#rrggbb" accent color
+func cardAccentColor(hexColor string) color.RGBA {
+	raw, err := hex.DecodeString(strings.TrimPrefix(hexColor, "#"))
+	if err != nil || len(raw) != 3 {
+		return cardDefaultAccent
+	}
+	return color.RGBA{raw[0], raw[1], raw[2], 0xff}
+}
+
+// cardFill paints rect with palette index c
+func cardFill(img *image.Paletted, rect image.Rectangle, c uint8) {
+	rect = rect.Intersect(img.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			row[x] = c
+		}
+	}
+}
+
+// drawCardText draws s with its top-left corner at (x, y), each font pixel scale pixels square
+func drawCardText(img *image.Paletted, x, y, scale int, c uint8, s string) {
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			r = '?'
+		}
+		for col, bits := range cardFont[r-0x20] {
+			for row := 0; row < 8; row++ {
+				if bits&(1<<row) != 0 {
+					px, py := x+col*scale, y+row*scale
+					cardFill(img, image.Rect(px, py, px+scale, py+scale), c)
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// cardTruncate cuts s to at most max characters, ending in "..." when shortened
+func cardTruncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	return strings.TrimRight(string(runes[:max-3]), " ") + "..."
+}
+
+// cardWrap splits s into at most lines lines of at most width characters, breaking between
+// words where it can and marking a cut with "..."
+func cardWrap(s string, width, lines int) []string {
+	var out []string
+	current := ""
+	words := strings.Fields(s)
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		switch {
+		case current == "" && len([]rune(word)) > width:
+			runes := []rune(word)
+			out = append(out, string(runes[:width]))
+			words[i] = string(runes[width:])
+			i--
+		case current == "":
+			current = word
+		case len([]rune(current))+1+len([]rune(word)) <= width:
+			current += " " + word
+		default:
+			out = append(out, current)
+			current = ""
+			i--
+		}
+		if len(out) == lines {
+			rest := strings.Join(words[i+1:], " ")
+			if current != "" || rest != "" {
+				out[lines-1] = cardTruncate(out[lines-1]+" "+rest, width)
+			}
+			return out
+		}
+	}
+	if current != "" {
+		out = append(out, current)
+	}
+	return out
+}
+
+// renderCard draws the social card of link, whose short URL is shortURL, and encodes it as PNG
+func renderCard(link *URLData, shortURL string, style cardStyle) ([]byte, error) {
+	palette := color.Palette{
+		cardBackground: style.background,
+		cardText:       style.text,
+		cardMuted:      style.muted,
+		cardAccent:     cardAccentColor(link.AccentColor),
+		cardPanel:      color.White,
+		cardInk:        color.RGBA{0x0f, 0x17, 0x2a, 0xff},
+	}
+	img := image.NewPaletted(image.Rect(0, 0, cardWidth, cardHeight), palette)
+	cardFill(img, image.Rect(0, 0, cardAccentBar, cardHeight), cardAccent)
+
+	// Text column, left of the QR panel
+	left := cardAccentBar + cardPadding
+	textWidth := cardWidth - cardPadding - cardQRPanel - cardPadding - left
+	host := destinationHost(link.LongURL)
+	title := link.Title
+	if title == "" && link.OG != nil {
+		title = link.OG.Title
+	}
+	if title == "" {
+		title = host
+	}
+	y := 96
+	for _, line := range cardWrap(title, textWidth/(6*cardTitleScale), cardTitleLines) {
+		drawCardText(img, left, y, cardTitleScale, cardText, line)
+		y += 10 * cardTitleScale
+	}
+	detailChars := textWidth / (6 * cardDetailScale)
+	drawCardText(img, left, 430, cardDetailScale, cardMuted, cardTruncate(host, detailChars))
+	display := strings.TrimPrefix(strings.TrimPrefix(shortURL, "https://"), "http://")
+	drawCardText(img, left, 500, cardDetailScale, cardAccent, cardTruncate(display, detailChars))
+
+	// QR code on a white panel, which keeps it scannable on the dark palette
+	panel := image.Rect(cardWidth-cardPadding-cardQRPanel, (cardHeight-cardQRPanel)/2, cardWidth-cardPadding, (cardHeight+cardQRPanel)/2)
+	cardFill(img, panel, cardPanel)
+	if qr, err := encodeQR([]byte(shortURL)); err != nil {
+		log.Printf("error encoding QR code for card of %s: %v", link.ShortURL, err)
+	} else {
+		const quiet = 4
+		scale := cardQRPanel / (qr.size + 2*quiet)
+		offsetX := panel.Min.X + (cardQRPanel-qr.size*scale)/2
+		offsetY := panel.Min.Y + (cardQRPanel-qr.size*scale)/2
+		for my := 0; my < qr.size; my++ {
+			for mx := 0; mx < qr.size; mx++ {
+				if qr.modules[my][mx] {
+					px, py := offsetX+mx*scale, offsetY+my*scale
+					cardFill(img, image.Rect(px, py, px+scale, py+scale), cardInk)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// linkCard handles GET /url/{code}/card (owner only); ?style= is light (default) or dark
+func linkCard(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+	styleName := r.URL.Query().Get("style")
+	if styleName == "" {
+		styleName = "light"
+	}
+	style, ok := cardStyles[styleName]
+	if !ok {
+		http.Error(w, "style must be light or dark", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := linkStore(r).FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error loading link for card %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	shortURL := fullShortURL(r, link.Domain, link.ShortURL)
+	version := link.CreatedAt
+	if link.UpdatedAt != nil {
+		version = *link.UpdatedAt
+	}
+	// The accent color is filled in later by the favicon fetcher without touching updated_at
+	key := strings.Join([]string{shortURL, styleName, strconv.FormatInt(version.UnixNano(), 10), link.AccentColor}, " ")
+	sum := sha256.Sum256([]byte(key))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(cardMaxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+	addSecurityHeaders(w)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cardCacheMutex.RLock()
+	entry, cached := cardCache[key]
+	cardCacheMutex.RUnlock()
+	if !cached {
+		image, err := renderCard(link, shortURL, style)
+		if err != nil {
+			log.Printf("error rendering card for %s: %v", code, err)
+			w.Header().Del("ETag")
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "failed to render card", http.StatusInternalServerError)
+			return
+		}
+		incMetric("cards_rendered", 1)
+		entry = image
+
+		cardCacheMutex.Lock()
+		if len(cardCache) >= cardCacheCapacity {
+			// Same policy as the QR cache: a render is cheap next to tracking recency
+			cardCache = make(map[string][]byte)
+		}
+		cardCache[key] = entry
+		cardCacheMutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry)))
+	if _, err := w.Write(entry); err != nil {
+		log.Printf("error writing card for %s: %v", code, err)
+	}
+}
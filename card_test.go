@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cardByteBudget bounds the PNG size of a card; renders are about 4KB
+const cardByteBudget = 32 << 10
+
+func decodeCard(t *testing.T, raw []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds(); got != image.Rect(0, 0, cardWidth, cardHeight) {
+		t.Fatalf("card bounds %v, want 1200x630", got)
+	}
+	return img
+}
+
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
+
+func TestCardWrap(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		lines int
+		want  []string
+	}{
+		{"", 10, 3, nil},
+		{"short title", 20, 3, []string{"short title"}},
+		{"one two three four", 9, 3, []string{"one two", "three", "four"}},
+		{"one two three four five six", 9, 2, []string{"one two", "three..."}},
+		{"abcdefghijklmnopqrstuvwxyz", 5, 3, []string{"abcde", "fghij", "kl..."}},
+	}
+	for _, tt := range tests {
+		if got := cardWrap(tt.s, tt.width, tt.lines); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cardWrap(%q, %d, %d) = %q, want %q", tt.s, tt.width, tt.lines, got, tt.want)
+		}
+	}
+	if got := cardTruncate("ünïcödé title", 8); got != "ünïcö..." {
+		t.Errorf("cardTruncate = %q", got)
+	}
+}
+
+func TestRenderCardBudget(t *testing.T) {
+	links := []*URLData{
+		{ShortURL: "abc123", LongURL: "https://example.com/"},
+		{ShortURL: "titled", LongURL: "https://www.example.org/a/b", Title: "Spring launch: everything you need to know", AccentColor: "#e11d48"},
+		{ShortURL: "long", LongURL: "https://" + strings.Repeat("sub.", 40) + "example.net/", Title: strings.Repeat("Ünicode and a very long title ", 40)},
+	}
+	for _, link := range links {
+		for name, style := range cardStyles {
+			start := time.Now()
+			raw, err := renderCard(link, "https://rapid.link/"+link.ShortURL, style)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("%s %s: render took %v", link.ShortURL, name, elapsed)
+			}
+			if len(raw) > cardByteBudget {
+				t.Errorf("%s %s: %d bytes, budget %d", link.ShortURL, name, len(raw), cardByteBudget)
+			}
+			img := decodeCard(t, raw)
+
+			// Accent bar, background and the white QR panel
+			accent := cardAccentColor(link.AccentColor)
+			if got := img.At(cardAccentBar/2, cardHeight/2); !sameColor(got, accent) {
+				t.Errorf("%s %s: accent bar %v, want %v", link.ShortURL, name, got, accent)
+			}
+			if got := img.At(cardAccentBar+8, 8); !sameColor(got, style.background) {
+				t.Errorf("%s %s: background %v, want %v", link.ShortURL, name, got, style.background)
+			}
+			if got := img.At(cardWidth-cardPadding-cardQRPanel+2, (cardHeight-cardQRPanel)/2+2); !sameColor(got, color.White) {
+				t.Errorf("%s %s: QR panel %v, want white", link.ShortURL, name, got)
+			}
+		}
+	}
+}
+
+func TestRenderCardAllocations(t *testing.T) {
+	link := &URLData{ShortURL: "abc123", LongURL: "https://example.com/", Title: "Allocation budget"}
+	allocs := testing.AllocsPerRun(5, func() {
+		if _, err := renderCard(link, "https://rapid.link/abc123", cardStyles["dark"]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// One paletted canvas plus the encoder's buffers, never per-pixel allocations
+	if allocs > 250 {
+		t.Fatalf("%v allocations per render", allocs)
+	}
+}
+
+func TestCardEndpoint(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/card", "title": "Card endpoint"})
+	// The favicon fetcher fills in the accent color, which is part of the card
+	deadline := time.Now().Add(2*safeFetchTimeout + time.Second)
+	for {
+		link, err := srv.links.FindLinkByCode(context.Background(), code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.AccentColor != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("accent color never set")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := srv.do("GET", "/url/"+code+"/card", token, nil, nil)
+	light := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Cache-Control") != "private, max-age=86400" || resp.Header.Get("ETag") == "" {
+		t.Fatalf("Cache-Control %q, ETag %q", resp.Header.Get("Cache-Control"), resp.Header.Get("ETag"))
+	}
+	if !sameColor(decodeCard(t, []byte(light)).At(cardAccentBar+8, 8), cardStyles["light"].background) {
+		t.Fatal("default style is not light")
+	}
+	etag := resp.Header.Get("ETag")
+
+	// The dark card is a different image with its own ETag
+	resp = srv.do("GET", "/url/"+code+"/card?style=dark", token, nil, nil)
+	dark := readBody(t, resp)
+	if !sameColor(decodeCard(t, []byte(dark)).At(cardAccentBar+8, 8), cardStyles["dark"].background) || resp.Header.Get("ETag") == etag {
+		t.Fatalf("dark card: ETag %q", resp.Header.Get("ETag"))
+	}
+
+	// Served from the cache, and revalidated without a body
+	rendered := metricValue("cards_rendered")
+	resp = srv.do("GET", "/url/"+code+"/card", token, nil, nil)
+	if readBody(t, resp) != light || metricValue("cards_rendered") != rendered {
+		t.Fatal("second request rendered the card again")
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/url/"+code+"/card", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", etag)
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-None-Match: status %d", resp.StatusCode)
+	}
+
+	// An edit changes updated_at, and so the card
+	if resp := srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.org/edited"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("edit: status %d", resp.StatusCode)
+	}
+	resp = srv.do("GET", "/url/"+code+"/card", token, nil, nil)
+	if readBody(t, resp) == light || resp.Header.Get("ETag") == etag {
+		t.Fatal("card unchanged after an edit")
+	}
+
+	for _, tt := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/url/" + code + "/card?style=sepia", token, http.StatusBadRequest},
+		{"/url/" + code + "/card", other, http.StatusNotFound},
+		{"/url/missing/card", token, http.StatusNotFound},
+		{"/url/" + code + "/card", "", http.StatusUnauthorized},
+	} {
+		if resp := srv.do("GET", tt.path, tt.token, nil, nil); resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata" // budget timezones must load in containers without a zoneinfo database
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// DAILY CLICK BUDGET
+// ============================================================================
+//
+// A link with daily_click_limit set stops redirecting for the rest of the day once that
+// many clicks were counted on it, e.g. to cap the spend of a paid campaign. Days run from
+// midnight to midnight in the link's daily_click_timezone (an IANA name, UTC by default).
+// The click worker counts each recorded click in a per-link per-day rollup (daily_clicks);
+// the click that reaches the limit sets paused_until to the next local midnight. Until then
+// redirect() sends visitors to budget_fallback_url, or answers 410 without one, and counts
+// nothing. Because clicks are counted in the background, a burst may overshoot the limit by
+// the clicks still queued when it is reached.
+//
+// The pause lifts by itself at paused_until; a worker then clears the field and sends the
+// link.budget_resumed ops event, as link.budget_paused is sent on pause. Both carry the
+// owner's email so the ops webhook can notify them. Budgeted links are never edge-cached,
+// since a cached redirect would neither be counted nor paused.
+
+// Ops events of the daily click budget
+const (
+	EventLinkBudgetPaused  = "link.budget_paused"
+	EventLinkBudgetResumed = "link.budget_resumed"
+)
+
+const (
+	maxDailyClickLimit   = 1000000000
+	budgetResumeInterval = time.Minute
+	budgetResumeBatch    = 500
+)
+
+// validateDailyClickLimit checks the budget options of a shorten request and returns the
+// timezone normalized, empty for UTC
+func validateDailyClickLimit(limit int, timezone, fallbackURL string) (string, error) {
+	if limit < 0 || limit > maxDailyClickLimit {
+		return "", fmt.Errorf("daily_click_limit must be between 0 and %d", maxDailyClickLimit)
+	}
+	if limit == 0 && (timezone != "" || fallbackURL != "") {
+		return "", fmt.Errorf("daily_click_timezone and budget_fallback_url require daily_click_limit")
+	}
+	if timezone == "UTC" {
+		timezone = ""
+	}
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return "", fmt.Errorf("daily_click_timezone must be an IANA time zone such as Europe/Berlin")
+		}
+	}
+	if fallbackURL != "" && !validateURL(fallbackURL) {
+		return "", fmt.Errorf("Invalid budget_fallback_url. Must be a valid HTTP or HTTPS URL")
+	}
+	return timezone, nil
+}
+
+// budgetLocation returns the timezone the link's budget days are counted in
+func budgetLocation(link *URLData) *time.Location {
+	if link.DailyClickTimezone != "" {
+		if loc, err := time.LoadLocation(link.DailyClickTimezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// budgetDay returns the local date of t in loc, the key of its daily_clicks counter
+func budgetDay(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02")
+}
+
+// nextLocalMidnight returns the first instant of the day after t's day in loc. Where a DST
+// change skips midnight, time.Date resolves it to the last hour of the day before, so the
+// day then starts at the transition instead.
+func nextLocalMidnight(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+	if budgetDay(next, loc) == budgetDay(local, loc) {
+		_, next = next.ZoneBounds()
+	}
+	return next
+}
+
+// linkPaused reports whether the link's daily budget is used up at now
+func linkPaused(link *URLData, now time.Time) bool {
+	return link.PausedUntil != nil && now.Before(*link.PausedUntil)
+}
+
+// countBudgetClick counts a recorded click against the link's daily budget and pauses the
+// link when it reaches the limit; a no-op for links without one
+func countBudgetClick(ctx context.Context, store URLStore, link *URLData, click ClickHistory) error {
+	if link.DailyClickLimit <= 0 {
+		return nil
+	}
+	loc := budgetLocation(link)
+	until := nextLocalMidnight(click.Timestamp, loc).UTC()
+	// The counter is kept a day past its own so late clicks of that day still find it
+	count, err := store.CountDailyClick(ctx, link, budgetDay(click.Timestamp, loc), until.Add(24*time.Hour))
+	if err != nil {
+		return err
+	}
+	if count < link.DailyClickLimit || !until.After(clock.Now()) {
+		return nil
+	}
+	paused, err := store.PauseLink(ctx, link, until)
+	if err != nil || !paused {
+		return err
+	}
+	incMetric("links_budget_paused_total", 1)
+	log.Printf("Short URL %s reached its daily limit of %d clicks, paused until %s",
+		link.ShortURL, link.DailyClickLimit, until.In(loc).Format(time.RFC3339))
+	data := budgetEventData(ctx, link)
+	data["clicks"] = count
+	data["paused_until"] = until
+	// Keyed on the pause's end, so a pause right after a resume is not deduplicated away
+	emitOpsEvent(EventLinkBudgetPaused, link.ShortURL+"@"+until.Format(time.RFC3339), data)
+	return nil
+}
+
+// budgetEventData returns the common data of the budget events, with the owner's email
+func budgetEventData(ctx context.Context, link *URLData) map[string]interface{} {
+	timezone := link.DailyClickTimezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	data := map[string]interface{}{
+		"short_url":         link.ShortURL,
+		"user_id":           link.UserID,
+		"daily_click_limit": link.DailyClickLimit,
+		"timezone":          timezone,
+	}
+	if id, err := primitive.ObjectIDFromHex(link.UserID); err == nil {
+		if owner, err := Users.GetUserByID(ctx, id); err == nil {
+			data["email"] = owner.Email
+		}
+	}
+	return data
+}
+
+// writePausedLink answers a redirect of a link whose daily budget is used up
+func writePausedLink(w http.ResponseWriter, r *http.Request, link *URLData) {
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	if link.BudgetFallbackURL != "" && validateURL(link.BudgetFallbackURL) && !isSelfRedirect(r, link.BudgetFallbackURL) {
+		http.Redirect(w, r, link.BudgetFallbackURL, http.StatusFound)
+		return
+	}
+	if wantsHTML(r) {
+		writeLocalizedPage(w, r, http.StatusGone, "link_paused", "")
+		return
+	}
+	http.Error(w, "This link has reached its click limit for today", http.StatusGone)
+}
+
+// resumeBudgetPauses clears the pause of links whose paused_until has passed and sends
+// link.budget_resumed for each
+func resumeBudgetPauses() (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	links, err := Links.ResumePausedLinks(ctx, clock.Now(), budgetResumeBatch)
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		log.Printf("Short URL %s resumed after its daily click limit", link.ShortURL)
+		data := budgetEventData(ctx, link)
+		data["paused_until"] = *link.PausedUntil
+		emitOpsEvent(EventLinkBudgetResumed, link.ShortURL+"@"+link.PausedUntil.Format(time.RFC3339), data)
+	}
+	incMetric("links_budget_resumed_total", int64(len(links)))
+	return map[string]int64{"resumed": int64(len(links))}, nil
+}
+
+// StartBudgetResumeWorker runs resumeBudgetPauses every budgetResumeInterval. Redirects
+// already ignore a past paused_until, so the worker only notifies. On MongoDB a worker lease
+// ensures only one instance does so.
+func StartBudgetResumeWorker() {
+	go func() {
+		ticker := time.NewTicker(budgetResumeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if usesMongo() {
+				runExclusive("budget_resume", budgetResumeInterval, resumeBudgetPauses)
+			} else if _, err := resumeBudgetPauses(); err != nil {
+				log.Printf("⚠️  Budget resume failed: %v", err)
+			}
+		}
+	}()
+}
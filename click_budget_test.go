@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestNextLocalMidnight(t *testing.T) {
+	tests := []struct {
+		zone  string
+		at    string
+		day   string
+		until string
+	}{
+		{"UTC", "2024-06-15T23:59:59Z", "2024-06-15", "2024-06-16T00:00:00Z"},
+		// Just before and after local midnight on the day clocks spring forward
+		{"America/New_York", "2024-03-10T04:59:00Z", "2024-03-09", "2024-03-10T05:00:00Z"},
+		{"America/New_York", "2024-03-10T05:00:00Z", "2024-03-10", "2024-03-11T04:00:00Z"},
+		// The 25-hour day clocks fall back
+		{"Europe/Berlin", "2024-10-27T00:30:00Z", "2024-10-27", "2024-10-27T23:00:00Z"},
+		// Midnight skipped by DST: the next day starts at the transition, 01:00 local
+		{"America/Sao_Paulo", "2018-11-03T12:00:00Z", "2018-11-03", "2018-11-04T03:00:00Z"},
+		{"America/Sao_Paulo", "2018-11-04T03:00:00Z", "2018-11-04", "2018-11-05T02:00:00Z"},
+		{"America/Havana", "2024-03-09T12:00:00Z", "2024-03-09", "2024-03-10T05:00:00Z"},
+		// Half-hour offsets and half-hour DST shifts
+		{"Asia/Kolkata", "2024-01-01T18:29:00Z", "2024-01-01", "2024-01-01T18:30:00Z"},
+		{"Australia/Lord_Howe", "2024-04-06T12:00:00Z", "2024-04-06", "2024-04-06T13:00:00Z"},
+		// Samoa skipped 30 December 2011 entirely
+		{"Pacific/Apia", "2011-12-29T12:00:00Z", "2011-12-29", "2011-12-30T10:00:00Z"},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := mustParseTime(t, tt.at)
+		if got := budgetDay(at, loc); got != tt.day {
+			t.Errorf("budgetDay(%s in %s) = %s, want %s", tt.at, tt.zone, got, tt.day)
+		}
+		if got := nextLocalMidnight(at, loc); !got.Equal(mustParseTime(t, tt.until)) {
+			t.Errorf("nextLocalMidnight(%s in %s) = %s, want %s", tt.at, tt.zone, got.UTC().Format(time.RFC3339), tt.until)
+		}
+	}
+}
+
+func TestValidateDailyClickLimit(t *testing.T) {
+	tests := []struct {
+		limit    int
+		timezone string
+		fallback string
+		want     string
+		invalid  bool
+	}{
+		{0, "", "", "", false},
+		{100, "", "", "", false},
+		{100, "UTC", "", "", false},
+		{100, "Europe/Berlin", "https://example.com/sold-out", "Europe/Berlin", false},
+		{-1, "", "", "", true},
+		{maxDailyClickLimit + 1, "", "", "", true},
+		{0, "Europe/Berlin", "", "", true},
+		{0, "", "https://example.com/sold-out", "", true},
+		{100, "Mars/Olympus_Mons", "", "", true},
+		{100, "Local", "", "", true},
+		{100, "", "javascript:alert(1)", "", true},
+	}
+	for _, tt := range tests {
+		got, err := validateDailyClickLimit(tt.limit, tt.timezone, tt.fallback)
+		if (err != nil) != tt.invalid || got != tt.want {
+			t.Errorf("validateDailyClickLimit(%d, %q, %q) = %q, %v", tt.limit, tt.timezone, tt.fallback, got, err)
+		}
+	}
+}
+
+func TestDailyClickBudget(t *testing.T) {
+	rcv := newOpsReceiver(t)
+	freezeClock(t, mustParseTime(t, "2024-03-09T12:00:00Z"))
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	code := srv.shorten(token, map[string]interface{}{
+		"long-url": "https://example.com/campaign", "daily_click_limit": 2,
+		"daily_click_timezone": "America/New_York", "budget_fallback_url": "https://example.com/sold-out",
+	})
+	ctx := context.Background()
+	count := func(at string) {
+		t.Helper()
+		link, err := srv.links.FindLinkByCode(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetClock(FixedClock(mustParseTime(t, at)))
+		if err := countBudgetClick(ctx, srv.links, link, ClickHistory{Timestamp: clock.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pausedUntil := func() *time.Time {
+		t.Helper()
+		link, err := srv.links.FindLinkByCode(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link.PausedUntil
+	}
+
+	// 23:30 on the 9th and 00:30 on the 10th New York time are different budget days,
+	// although both are the 10th in UTC
+	count("2024-03-10T04:30:00Z")
+	count("2024-03-10T05:30:00Z")
+	if pausedUntil() != nil {
+		t.Fatal("paused by clicks on two local days")
+	}
+	rcv.expectNothingBut()
+
+	// The second click of the 10th pauses the link until midnight EDT, 23 hours after midnight EST
+	count("2024-03-11T03:30:00Z")
+	until := mustParseTime(t, "2024-03-11T04:00:00Z")
+	if got := pausedUntil(); got == nil || !got.Equal(until) {
+		t.Fatalf("paused until %v, want %s", got, until)
+	}
+	event := rcv.next()
+	if event.Type != EventLinkBudgetPaused || event.Data["short_url"] != code || event.Data["user_id"] != userID ||
+		event.Data["clicks"] != 2.0 || event.Data["timezone"] != "America/New_York" || event.Data["email"] == nil {
+		t.Fatalf("pause event %+v", event)
+	}
+
+	// Visitors go to the fallback meanwhile
+	resp := srv.do("GET", "/"+code, "", nil, nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://example.com/sold-out" {
+		t.Fatalf("paused link: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp.Header.Get("Cache-Control") == "" || resp.Header.Get("Cache-Control") == "public" {
+		t.Fatalf("paused answer Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+	if result, err := resumeBudgetPauses(); err != nil || result["resumed"] != 0 {
+		t.Fatalf("resume before midnight: %v, %v", result, err)
+	}
+
+	// At local midnight the link redirects again and the resume event is sent
+	SetClock(FixedClock(until))
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("link after midnight: status %d", resp.StatusCode)
+	}
+	drainClicks(t)
+	if result, err := resumeBudgetPauses(); err != nil || result["resumed"] != 1 {
+		t.Fatalf("resume after midnight: %v, %v", result, err)
+	}
+	if pausedUntil() != nil {
+		t.Fatal("paused_until not cleared")
+	}
+	if event := rcv.next(); event.Type != EventLinkBudgetResumed || event.Data["short_url"] != code {
+		t.Fatalf("resume event %+v", event)
+	}
+
+	// The new day starts with a fresh counter
+	count("2024-03-11T04:30:00Z")
+	if pausedUntil() != nil {
+		t.Fatal("first click of a new day paused the link")
+	}
+}
+
+func TestDailyClickBudgetWithoutFallback(t *testing.T) {
+	freezeClock(t, mustParseTime(t, "2024-10-26T12:00:00Z"))
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/limited", "daily_click_limit": 1, "daily_click_timezone": "Europe/Berlin"})
+	link, err := srv.links.FindLinkByCode(context.Background(), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:30 CEST on the night clocks fall back; the day has 25 hours
+	SetClock(FixedClock(mustParseTime(t, "2024-10-27T00:30:00Z")))
+	if err := countBudgetClick(context.Background(), srv.links, link, ClickHistory{Timestamp: clock.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "de")
+	SetClock(FixedClock(mustParseTime(t, "2024-10-27T22:59:00Z")))
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusGone || resp.Header.Get("Content-Language") != "de" {
+		t.Fatalf("paused link: status %d, Content-Language %q", resp.StatusCode, resp.Header.Get("Content-Language"))
+	}
+	SetClock(FixedClock(mustParseTime(t, "2024-10-27T23:00:00Z")))
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("link after midnight CET: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// DAILY CLICK EXPORT
+// ============================================================================
+//
+// GET /analytics/clicks/export?date=2024-06-01 streams one UTC day of the caller's clicks,
+// oldest first, as NDJSON (default) or CSV (format=csv); GET /url/{code}/clicks/export does
+// the same for one link. Rows are written as they are read, so memory stays flat however
+// large the day. A response holds at most maxClickExportRows rows (or ?limit=); when the day
+// has more, X-Next-Cursor carries the position to pass back as ?cursor= for the rest.
+// ip_hash is only exported when the privacy mode keeps one. Compression comes from
+// compressionMiddleware like every other text response.
+
+const (
+	maxClickExportRows      = 100000
+	clickExportWriteTimeout = 5 * time.Minute
+	clickExportFlushEvery   = 1000
+)
+
+// ClickExportRow is one click in a date export
+type ClickExportRow struct {
+	EventID   string    `json:"event_id"`
+	Timestamp time.Time `json:"timestamp"`
+	ShortURL  string    `json:"short_url"`
+	Device    string    `json:"device"`
+	Bot       bool      `json:"bot"`
+	Branch    string    `json:"branch,omitempty"`
+	Signed    bool      `json:"signed,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+}
+
+var clickExportCSVHeader = []string{"event_id", "timestamp", "short_url", "device", "bot", "branch", "signed", "ip_hash"}
+
+// ClickExportQuery selects the clicks of an export, oldest first
+type ClickExportQuery struct {
+	UserID string
+	Link   *URLData // nil for all of the user's links
+	From   time.Time
+	To     time.Time    // exclusive
+	After  *clickCursor // nil for the start of the range
+	Skip   int
+	Limit  int
+}
+
+// admits reports whether a click at (at, id) belongs to the range selected by q
+func (q ClickExportQuery) admits(at time.Time, id string) bool {
+	if at.Before(q.From) || !at.Before(q.To) {
+		return false
+	}
+	if q.After != nil && (at.Before(q.After.Timestamp) || (at.Equal(q.After.Timestamp) && id <= q.After.ID)) {
+		return false
+	}
+	return true
+}
+
+// clickIPHash returns the keyed hash kept for a click's IP, or "" when IP_PRIVACY_MODE=none
+// or the IP is unknown
+func clickIPHash(ip string) string {
+	if ip == "" || ipPrivacyMode() == "none" {
+		return ""
+	}
+	return hashIP(ip)
+}
+
+// clickExportWriter encodes rows in the requested format
+type clickExportWriter interface {
+	Write(row ClickExportRow) error
+	Flush() error
+}
+
+type ndjsonClickWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (n *ndjsonClickWriter) Write(row ClickExportRow) error { return n.enc.Encode(row) }
+func (n *ndjsonClickWriter) Flush() error                   { return n.buf.Flush() }
+
+type csvClickWriter struct {
+	csv    *csv.Writer
+	record []string
+}
+
+func (c *csvClickWriter) Write(row ClickExportRow) error {
+	c.record = append(c.record[:0], row.EventID, row.Timestamp.Format(time.RFC3339Nano), row.ShortURL,
+		row.Device, strconv.FormatBool(row.Bot), row.Branch, strconv.FormatBool(row.Signed), row.IPHash)
+	return c.csv.Write(c.record)
+}
+
+func (c *csvClickWriter) Flush() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+// newClickExportWriter returns the encoder for format ("ndjson" or "csv") writing to w
+func newClickExportWriter(format string, w io.Writer) (clickExportWriter, error) {
+	switch format {
+	case "", "ndjson":
+		buf := bufio.NewWriterSize(w, 32<<10)
+		return &ndjsonClickWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case "csv":
+		c := &csvClickWriter{csv: csv.NewWriter(w)}
+		return c, c.csv.Write(clickExportCSVHeader)
+	default:
+		return nil, fmt.Errorf("format must be ndjson or csv")
+	}
+}
+
+// exportClicks handles GET /analytics/clicks/export and GET /url/{code}/clicks/export
+func exportClicks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	params := r.URL.Query()
+	day, err := time.Parse("2006-01-02", params.Get("date"))
+	if err != nil {
+		http.Error(w, "date must be a YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+	format := params.Get("format")
+	if format != "" && format != "ndjson" && format != "csv" {
+		http.Error(w, "format must be ndjson or csv", http.StatusBadRequest)
+		return
+	}
+	query := ClickExportQuery{UserID: userID, From: day, To: day.AddDate(0, 0, 1), Limit: maxClickExportRows}
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if n < maxClickExportRows {
+			query.Limit = n
+		}
+	}
+	if raw := params.Get("cursor"); raw != "" {
+		cursor, err := decodeClickCursor(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.After = cursor
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickExportWriteTimeout)
+	defer cancel()
+
+	store := linkStore(r)
+	if code, perLink := mux.Vars(r)["code"]; perLink {
+		code = sanitizeInput(code)
+		if code == "" || !validateCustomURL(code) {
+			http.Error(w, "Invalid short code", http.StatusBadRequest)
+			return
+		}
+		link, err := store.FindLinkByCode(ctx, code)
+		if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+			http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error loading link %s for click export: %v", code, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if link.AnalyticsDisabled {
+			// Nothing to stream; the notice goes in a header since the body would be CSV
+			w.Header().Set("X-Analytics", analyticsOff)
+			addSecurityHeaders(w)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		query.Link = link
+	}
+
+	// Headers go out before the first row, so whether the day continues past this response
+	// is settled first by reading the last row of the page and the one after it
+	probe := query
+	probe.Skip, probe.Limit = query.Limit-1, 2
+	var boundary []ClickExportRow
+	if err := store.ExportClicks(ctx, probe, func(row ClickExportRow) error {
+		boundary = append(boundary, row)
+		return nil
+	}); err != nil {
+		log.Printf("error probing click export for user %s: %v", userID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := "clicks-" + day.Format("2006-01-02")
+	if query.Link != nil {
+		filename += "-" + query.Link.ShortURL
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		filename += ".csv"
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Export-Row-Limit", strconv.Itoa(query.Limit))
+	w.Header().Set("X-Served-From", analyticsServedFrom())
+	if len(boundary) == 2 {
+		w.Header().Set("X-Next-Cursor", encodeClickCursor(ClickRecord{ID: boundary[0].EventID, Timestamp: boundary[0].Timestamp}))
+	}
+	addSecurityHeaders(w)
+
+	// A large day outlives the server's WriteTimeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(clickExportWriteTimeout)); err != nil {
+		log.Printf("Warning: could not extend the write deadline of a click export: %v", err)
+	}
+
+	out, err := newClickExportWriter(format, w)
+	if err != nil {
+		log.Printf("error starting click export: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	rows := 0
+	err = store.ExportClicks(ctx, query, func(row ClickExportRow) error {
+		if err := out.Write(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%clickExportFlushEvery == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			http.NewResponseController(w).Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		// The status is already sent; aborting the connection keeps a truncated export
+		// from looking complete
+		log.Printf("error exporting clicks for user %s after %d rows: %v", userID, rows, err)
+		panic(http.ErrAbortHandler)
+	}
+	incMetric("click_export_rows_total", int64(rows))
+}
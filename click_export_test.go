@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportedRows decodes an NDJSON export
+func exportedRows(t *testing.T, body string) []ClickExportRow {
+	t.Helper()
+	var rows []ClickExportRow
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var row ClickExportRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("line %d: %v", len(rows)+1, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestClickExport(t *testing.T) {
+	t.Setenv("IP_PRIVACY_MODE", "hash")
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/exported"})
+	second := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/exported-too"})
+	foreign := srv.shorten(other, map[string]interface{}{"long-url": "https://example.com/not-mine"})
+
+	day := time.Date(2031, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		srv.addClicks(code, ClickHistory{Timestamp: day.Add(time.Duration(i) * time.Hour / 2), IP: "198.51.100.7", UserAgent: "Mozilla/5.0"})
+	}
+	srv.addClicks(second, ClickHistory{Timestamp: day.Add(time.Minute)})
+	srv.addClicks(foreign, ClickHistory{Timestamp: day.Add(time.Minute)})
+	// Either side of the day
+	srv.addClicks(code, ClickHistory{Timestamp: day.Add(-time.Nanosecond)}, ClickHistory{Timestamp: day.AddDate(0, 0, 1)})
+
+	resp := srv.do("GET", "/analytics/clicks/export?date=2031-03-01", token, nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" || resp.Header.Get("X-Next-Cursor") != "" {
+		t.Fatalf("status %d, Content-Type %q, X-Next-Cursor %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("X-Next-Cursor"))
+	}
+	rows := exportedRows(t, readBody(t, resp))
+	if len(rows) != 31 {
+		t.Fatalf("exported %d rows, want 31", len(rows))
+	}
+	for i, row := range rows {
+		if row.ShortURL == foreign || row.Timestamp.Before(day) || !row.Timestamp.Before(day.AddDate(0, 0, 1)) {
+			t.Fatalf("row %d should not be exported: %+v", i, row)
+		}
+		if i > 0 && row.Timestamp.Before(rows[i-1].Timestamp) {
+			t.Fatalf("row %d is older than the one before", i)
+		}
+	}
+	if rows[0].IPHash != hashIP("198.51.100.7") {
+		t.Fatalf("ip_hash %q", rows[0].IPHash)
+	}
+
+	// One link, as CSV
+	resp = srv.do("GET", "/url/"+second+"/clicks/export?date=2031-03-01&format=csv", token, nil, nil)
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil || len(records) != 2 || strings.Join(records[0], ",") != strings.Join(clickExportCSVHeader, ",") || records[1][2] != second {
+		t.Fatalf("CSV export %q, %v", records, err)
+	}
+	if resp := srv.do("GET", "/url/"+foreign+"/clicks/export?date=2031-03-01", token, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("another user's link: status %d", resp.StatusCode)
+	}
+
+	// Without a kept IP there is no hash to export
+	t.Setenv("IP_PRIVACY_MODE", "none")
+	resp = srv.do("GET", "/analytics/clicks/export?date=2031-03-01", token, nil, nil)
+	if body := readBody(t, resp); strings.Contains(body, "ip_hash") {
+		t.Fatal("ip_hash exported with IP_PRIVACY_MODE=none")
+	}
+
+	for _, bad := range []string{"", "date=03/01/2031", "date=2031-03-01&format=xml", "date=2031-03-01&limit=0", "date=2031-03-01&cursor=zz"} {
+		if resp := srv.do("GET", "/analytics/clicks/export?"+bad, token, nil, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", bad, resp.StatusCode)
+		}
+	}
+}
+
+func TestClickExportContinuation(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/continued"})
+	day := time.Date(2031, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		// Pairs of clicks share a timestamp, so pages end between them
+		srv.addClicks(code, ClickHistory{Timestamp: day.Add(time.Duration(i/2) * time.Second)})
+	}
+
+	var all []ClickExportRow
+	query := "/analytics/clicks/export?date=2031-03-01&limit=7"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("the export does not end")
+		}
+		resp := srv.do("GET", query, token, nil, nil)
+		rows := exportedRows(t, readBody(t, resp))
+		if resp.Header.Get("X-Export-Row-Limit") != "7" || len(rows) > 7 {
+			t.Fatalf("page %d: %d rows, limit header %q", pages, len(rows), resp.Header.Get("X-Export-Row-Limit"))
+		}
+		all = append(all, rows...)
+		cursor := resp.Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		query = "/analytics/clicks/export?date=2031-03-01&limit=7&cursor=" + cursor
+	}
+	seen := map[string]bool{}
+	for _, row := range all {
+		if seen[row.EventID] {
+			t.Fatalf("row %s exported twice", row.EventID)
+		}
+		seen[row.EventID] = true
+	}
+	if len(all) != 25 {
+		t.Fatalf("exported %d rows over all pages, want 25", len(all))
+	}
+}
+
+func TestClickExportGzip(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/compressed"})
+	for i := 0; i < 500; i++ {
+		srv.addClicks(code, ClickHistory{Timestamp: time.Date(2031, 3, 1, 12, 0, i, 0, time.UTC)})
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/analytics/clicks/export?date=2031-03-01", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := srv.send(req, nil)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := exportedRows(t, string(raw)); len(rows) != 500 {
+		t.Fatalf("decompressed %d rows, want 500", len(rows))
+	}
+}
+
+// streamingClickStore generates a day of clicks as they are read instead of storing them,
+// so an export's memory use is the handler's alone
+type streamingClickStore struct {
+	URLStore
+	day      time.Time
+	rows     int
+	heapAt   map[int]uint64 // live heap after a GC, sampled at row numbers
+	produced int
+}
+
+func (s *streamingClickStore) ExportClicks(_ context.Context, query ClickExportQuery, fn func(ClickExportRow) error) error {
+	skipped, sent := 0, 0
+	for i := 0; i < s.rows && sent < query.Limit; i++ {
+		row := ClickExportRow{
+			EventID:   fmt.Sprintf("%024x", i),
+			Timestamp: s.day.Add(time.Duration(i) * time.Millisecond),
+			ShortURL:  "streamed",
+			Device:    DeviceOther,
+		}
+		if !query.admits(row.Timestamp, row.EventID) {
+			continue
+		}
+		if skipped < query.Skip {
+			skipped++
+			continue
+		}
+		if _, sample := s.heapAt[i]; sample && query.Skip == 0 {
+			var stats runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			s.heapAt[i] = stats.HeapAlloc
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		sent++
+		s.produced++
+	}
+	return nil
+}
+
+// lineCountingWriter is a ResponseWriter that keeps only the number of lines written
+type lineCountingWriter struct {
+	header http.Header
+	status int
+	lines  int
+}
+
+func (c *lineCountingWriter) Header() http.Header { return c.header }
+func (c *lineCountingWriter) WriteHeader(status int) {
+	c.status = status
+}
+func (c *lineCountingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.lines += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+func TestClickExportMemoryStaysFlat(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	const n = 50000
+	store := &streamingClickStore{
+		URLStore: srv.links,
+		day:      time.Date(2031, 3, 1, 0, 0, 0, 0, time.UTC),
+		rows:     n,
+		heapAt:   map[int]uint64{5000: 0, n - 1: 0},
+	}
+	Links = store
+
+	for _, format := range []string{"ndjson", "csv"} {
+		store.produced = 0
+		req := httptest.NewRequest("GET", "/analytics/clicks/export?date=2031-03-01&format="+format, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "127.0.0.1:4000"
+		out := &lineCountingWriter{header: http.Header{}}
+		srv.Config.Handler.ServeHTTP(out, req)
+
+		wantLines := n
+		if format == "csv" {
+			wantLines++ // header
+		}
+		if out.status != http.StatusOK || out.lines != wantLines || store.produced != n {
+			t.Fatalf("%s: status %d, %d lines, %d rows read; want %d lines", format, out.status, out.lines, store.produced, wantLines)
+		}
+		// Rows are written as they are read: the live heap at the end of the day is what it
+		// was near the start, not 45000 rows larger
+		early, late := store.heapAt[5000], store.heapAt[n-1]
+		if late > early+(1<<20) {
+			t.Fatalf("%s: live heap grew from %d to %d bytes over 45000 rows", format, early, late)
+		}
+	}
+}
+
+func TestClickExportWritersAllocations(t *testing.T) {
+	row := ClickExportRow{EventID: "0123456789abcdef01234567", Timestamp: clockTestBase, ShortURL: "abc", Device: DeviceIOS, IPHash: "sha256:00"}
+	for _, format := range []string{"ndjson", "csv"} {
+		out, err := newClickExportWriter(format, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allocs := testing.AllocsPerRun(1000, func() {
+			if err := out.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		})
+		// A constant per row, whatever has been written before
+		if allocs > 4 {
+			t.Errorf("%s writer: %.1f allocations per row", format, allocs)
+		}
+	}
+}
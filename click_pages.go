@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// CLICK HISTORY PAGES
+// ============================================================================
+//
+// GET /url/{code}/clicks pages through a link's clicks newest first with keyset pagination:
+// next_cursor encodes the (timestamp, id) of the last click returned and the next page starts
+// strictly after it, so clicks recorded while paging never shift, duplicate or skip entries
+// the way skip/limit would. On MongoDB clicks are read from the clicks collection (indexed on
+// short_url, timestamp desc, _id desc); SQL uses its clicks table. With include_shares=true
+// the link's share events in the from/to range are returned alongside (see share_events.go).
+
+const (
+	clickPageDefaultLimit = 50
+	clickPageMaxLimit     = 200
+)
+
+// ClickRecord is one click as listed by GET /url/{code}/clicks
+type ClickRecord struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Device    string    `json:"device"`
+	Bot       bool      `json:"bot"`
+	Branch    string    `json:"branch,omitempty"`
+	Signed    bool      `json:"signed,omitempty"`
+}
+
+// clickCursor is the position of the last click of a page
+type clickCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// ClickQuery selects a page of a link's clicks, newest first
+type ClickQuery struct {
+	Limit  int
+	After  *clickCursor // nil for the first page
+	From   time.Time    // inclusive; zero when unset
+	To     time.Time    // exclusive; zero when unset
+	Device string       // ios, android or fallback; "" for any
+	Bot    *bool        // nil for any
+}
+
+// encodeClickCursor renders the cursor of rec as an opaque token
+func encodeClickCursor(rec ClickRecord) string {
+	raw := strconv.FormatInt(rec.Timestamp.UnixNano(), 10) + ":" + rec.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeClickCursor parses a next_cursor token
+func decodeClickCursor(token string) (*clickCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || len(id) != 24 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &clickCursor{Timestamp: time.Unix(0, n).UTC(), ID: id}, nil
+}
+
+// before reports whether rec sorts after the cursor, newest first
+func (c *clickCursor) before(rec ClickRecord) bool {
+	return rec.Timestamp.Before(c.Timestamp) || (rec.Timestamp.Equal(c.Timestamp) && rec.ID < c.ID)
+}
+
+// admits reports whether rec belongs in the page selected by q. Stores that cannot push a
+// filter into their query apply it with admits while reading in page order.
+func (q ClickQuery) admits(rec ClickRecord) bool {
+	if !q.From.IsZero() && rec.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !rec.Timestamp.Before(q.To) {
+		return false
+	}
+	if q.After != nil && !q.After.before(rec) {
+		return false
+	}
+	if q.Device != "" && rec.Device != q.Device {
+		return false
+	}
+	if q.Bot != nil && rec.Bot != *q.Bot {
+		return false
+	}
+	return true
+}
+
+// clickRecordFor classifies a stored click's user agent for listing
+func clickRecordFor(id string, click ClickHistory) ClickRecord {
+	return ClickRecord{
+		ID:        id,
+		Timestamp: click.Timestamp.UTC(),
+		Device:    detectDeviceClass(click.UserAgent),
+		Bot:       isBotUserAgent(click.UserAgent),
+		Branch:    click.Branch,
+		Signed:    click.Signed,
+	}
+}
+
+// parseClickTime accepts RFC 3339 timestamps and plain dates (midnight UTC)
+func parseClickTime(raw string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, raw); err == nil {
+		return parsed.UTC(), nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
+
+// parseClickQuery reads the page size, cursor and filters of a click listing request. It
+// also returns the filters as applied, for the response.
+func parseClickQuery(r *http.Request) (ClickQuery, map[string]interface{}, error) {
+	params := r.URL.Query()
+	query := ClickQuery{Limit: clickPageDefaultLimit}
+	filters := map[string]interface{}{}
+
+	if raw := params.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return query, nil, fmt.Errorf("limit must be a positive number")
+		}
+		if n > clickPageMaxLimit {
+			n = clickPageMaxLimit
+		}
+		query.Limit = n
+	}
+	if raw := params.Get("cursor"); raw != "" {
+		cursor, err := decodeClickCursor(raw)
+		if err != nil {
+			return query, nil, err
+		}
+		query.After = cursor
+	}
+	if raw := params.Get("from"); raw != "" {
+		from, err := parseClickTime(raw)
+		if err != nil {
+			return query, nil, fmt.Errorf("from must be an RFC 3339 timestamp or YYYY-MM-DD date")
+		}
+		query.From = from
+		filters["from"] = from
+	}
+	if raw := params.Get("to"); raw != "" {
+		to, err := parseClickTime(raw)
+		if err != nil {
+			return query, nil, fmt.Errorf("to must be an RFC 3339 timestamp or YYYY-MM-DD date")
+		}
+		query.To = to
+		filters["to"] = to
+	}
+	if raw := params.Get("device"); raw != "" {
+		if raw != DeviceIOS && raw != DeviceAndroid && raw != DeviceOther {
+			return query, nil, fmt.Errorf("device must be one of ios, android, fallback")
+		}
+		query.Device = raw
+		filters["device"] = raw
+	}
+	if raw := params.Get("bot"); raw != "" {
+		bot, err := strconv.ParseBool(raw)
+		if err != nil {
+			return query, nil, fmt.Errorf("bot must be true or false")
+		}
+		query.Bot = &bot
+		filters["bot"] = bot
+	}
+	if params.Get("country") != "" {
+		return query, nil, fmt.Errorf("country filtering is not available: click locations are not recorded")
+	}
+	return query, filters, nil
+}
+
+// listLinkClicks handles GET /url/{code}/clicks (owner only)
+func listLinkClicks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+	query, filters, err := parseClickQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	includeShares := false
+	if raw := r.URL.Query().Get("include_shares"); raw != "" {
+		if includeShares, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "include_shares must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	withPatterns, err := includePatterns(r)
+	if err != nil {
+		http.Error(w, "include_patterns must be true or false", http.StatusBadRequest)
+		return
+	}
+	includeOutcomes := false
+	if raw := r.URL.Query().Get("include_outcomes"); raw != "" {
+		if includeOutcomes, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "include_outcomes must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	link, err := store.FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error loading link %s for click listing: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if link.AnalyticsDisabled {
+		writeAnalyticsOff(w, link)
+		return
+	}
+
+	// One extra click tells whether another page follows
+	limit := query.Limit
+	query.Limit++
+	records, err := store.ListClicks(ctx, link, query)
+	if err != nil {
+		log.Printf("error listing clicks of %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	nextCursor := ""
+	if len(records) > limit {
+		records = records[:limit]
+		nextCursor = encodeClickCursor(records[limit-1])
+	}
+
+	response := map[string]interface{}{
+		"success":     true,
+		"short_url":   link.ShortURL,
+		"clicks":      records,
+		"limit":       limit,
+		"filters":     filters,
+		"next_cursor": nextCursor,
+		"served_from": analyticsServedFrom(),
+		// The hourly baseline the spike alerts compare against, as this instance sees it
+		"click_baseline": spikes.Baseline(link.ID.Hex(), clock.Now()),
+	}
+	if includeShares {
+		// Chart markers cover the requested range, not just this page of clicks
+		shares, err := store.ListShareEvents(ctx, link, query.From, query.To)
+		if err != nil {
+			log.Printf("error listing share events of %s: %v", code, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		response["shares"] = shares
+	}
+	if withPatterns {
+		// Patterns cover every click of the link, not this page or the filters
+		patterns, err := engagementPatterns(ctx, store, userID, link)
+		if err != nil {
+			log.Printf("error computing engagement patterns of %s: %v", code, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		response["engagement_patterns"] = patterns
+	}
+	if includeOutcomes {
+		outcomes, err := linkOutcomes(ctx, store, link, query.From, query.To)
+		if err != nil {
+			log.Printf("error reading redirect outcomes of %s: %v", code, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		response["outcomes"] = outcomes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding click listing response: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clickPage is the body of GET /url/{code}/clicks
+type clickPage struct {
+	Clicks     []ClickRecord          `json:"clicks"`
+	Limit      int                    `json:"limit"`
+	Filters    map[string]interface{} `json:"filters"`
+	NextCursor string                 `json:"next_cursor"`
+}
+
+// seedClicks stores n clicks on the link, ten to a second so pages split between clicks
+// with the same timestamp, every third one from a bot
+func seedClicks(s *testServer, code string, n int, newest time.Time) {
+	s.t.Helper()
+	for i := 0; i < n; i++ {
+		ua := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"
+		if i%3 == 0 {
+			ua = "Googlebot/2.1 (+http://www.google.com/bot.html)"
+		}
+		s.addClicks(code, ClickHistory{Timestamp: newest.Add(-time.Duration(i/10) * time.Second), UserAgent: ua})
+	}
+}
+
+// pageThrough follows next_cursor from the first page of query and returns every click
+func pageThrough(s *testServer, token, code string, query url.Values) []ClickRecord {
+	s.t.Helper()
+	var all []ClickRecord
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			s.t.Fatal("paging does not end")
+		}
+		var page clickPage
+		if resp := s.do("GET", "/url/"+code+"/clicks?"+query.Encode(), token, nil, &page); resp.StatusCode != http.StatusOK {
+			s.t.Fatalf("page %d: status %d", pages, resp.StatusCode)
+		}
+		all = append(all, page.Clicks...)
+		if page.NextCursor == "" {
+			return all
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+// checkClickOrder fails unless clicks are unique and strictly newest first
+func checkClickOrder(t *testing.T, clicks []ClickRecord) {
+	t.Helper()
+	seen := make(map[string]bool, len(clicks))
+	for i, click := range clicks {
+		if seen[click.ID] {
+			t.Fatalf("click %s listed twice", click.ID)
+		}
+		seen[click.ID] = true
+		if i > 0 {
+			prev := clicks[i-1]
+			if click.Timestamp.After(prev.Timestamp) || (click.Timestamp.Equal(prev.Timestamp) && click.ID >= prev.ID) {
+				t.Fatalf("click %d (%s %s) out of order after %s %s", i, click.Timestamp, click.ID, prev.Timestamp, prev.ID)
+			}
+		}
+	}
+}
+
+func TestClickPagesCoverEveryClick(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/popular"})
+	const n = 10000
+	seedClicks(srv, code, n, clockTestBase)
+
+	all := pageThrough(srv, token, code, url.Values{"limit": {"200"}})
+	if len(all) != n {
+		t.Fatalf("paged through %d clicks, want %d", len(all), n)
+	}
+	checkClickOrder(t, all)
+
+	bots := 0
+	for _, click := range all {
+		if click.Bot {
+			bots++
+		}
+	}
+	filtered := pageThrough(srv, token, code, url.Values{"limit": {"200"}, "bot": {"true"}})
+	if len(filtered) != bots || bots != (n+2)/3 {
+		t.Fatalf("bot=true paged through %d clicks, %d of %d are bots", len(filtered), bots, n)
+	}
+	checkClickOrder(t, filtered)
+}
+
+func TestClickPagesSplitTimestampGroups(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/grouped"})
+	seedClicks(srv, code, 1000, clockTestBase)
+
+	// 37 does not divide the groups of ten clicks sharing a second
+	all := pageThrough(srv, token, code, url.Values{"limit": {"37"}})
+	if len(all) != 1000 {
+		t.Fatalf("paged through %d clicks 37 at a time, want 1000", len(all))
+	}
+	checkClickOrder(t, all)
+}
+
+func TestClickPagesStableWhileClicksArrive(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/busy"})
+	seedClicks(srv, code, 500, clockTestBase)
+
+	var first clickPage
+	srv.do("GET", "/url/"+code+"/clicks?limit=200", token, nil, &first)
+	// New clicks land in front of the pages already read
+	seedClicks(srv, code, 300, clockTestBase.Add(time.Hour))
+
+	rest := pageThrough(srv, token, code, url.Values{"limit": {"200"}, "cursor": {first.NextCursor}})
+	all := append(first.Clicks, rest...)
+	if len(all) != 500 {
+		t.Fatalf("paged through %d of the 500 clicks present at the start", len(all))
+	}
+	checkClickOrder(t, all)
+}
+
+func TestClickPageQuery(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/filtered"})
+	seedClicks(srv, code, 300, clockTestBase)
+
+	var page clickPage
+	srv.do("GET", "/url/"+code+"/clicks?limit=5000", token, nil, &page)
+	if page.Limit != clickPageMaxLimit || len(page.Clicks) != clickPageMaxLimit {
+		t.Fatalf("limit 5000 gave limit %d and %d clicks", page.Limit, len(page.Clicks))
+	}
+
+	from := clockTestBase.Add(-10 * time.Second)
+	query := url.Values{"limit": {"200"}, "from": {from.Format(time.RFC3339)}, "to": {clockTestBase.Format(time.RFC3339)}, "device": {DeviceIOS}, "bot": {"false"}}
+	page = clickPage{}
+	srv.do("GET", "/url/"+code+"/clicks?"+query.Encode(), token, nil, &page)
+	// Seconds -10 to -1 hold clicks 10 to 109, 33 of them from bots
+	if len(page.Clicks) != 67 {
+		t.Fatalf("filtered page has %d clicks, want 67", len(page.Clicks))
+	}
+	for _, click := range page.Clicks {
+		if click.Bot || click.Device != DeviceIOS || click.Timestamp.Before(from) || !click.Timestamp.Before(clockTestBase) {
+			t.Fatalf("click outside the filters: %+v", click)
+		}
+	}
+	if page.Filters["device"] != DeviceIOS || page.Filters["bot"] != false || page.Filters["from"] == nil || page.Filters["to"] == nil {
+		t.Fatalf("applied filters %v", page.Filters)
+	}
+
+	for _, bad := range []string{"limit=0", "limit=x", "cursor=not-a-cursor", "from=yesterday", "device=desktop", "bot=maybe", "country=DE"} {
+		if resp := srv.do("GET", "/url/"+code+"/clicks?"+bad, token, nil, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, resp.StatusCode)
+		}
+	}
+	other, _ := srv.register()
+	if resp := srv.do("GET", "/url/"+code+"/clicks", other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another user's clicks: status %d", resp.StatusCode)
+	}
+}
+
+func TestClickCursorRoundTrip(t *testing.T) {
+	rec := ClickRecord{ID: "0123456789abcdef01234567", Timestamp: clockTestBase.Add(123 * time.Nanosecond)}
+	cursor, err := decodeClickCursor(encodeClickCursor(rec))
+	if err != nil || !cursor.Timestamp.Equal(rec.Timestamp) || cursor.ID != rec.ID {
+		t.Fatalf("round trip gave %+v, %v", cursor, err)
+	}
+	for _, token := range []string{"", "!!", "MTIz", strconv.Quote("x")} {
+		if _, err := decodeClickCursor(token); err == nil {
+			t.Errorf("cursor %q accepted", token)
+		}
+	}
+}
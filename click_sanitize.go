@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// CLICK SANITIZATION
+// ============================================================================
+//
+// Click events come from request headers any client can set, so the click worker cleans them
+// before they are stored or sent to the click sink. Non-printable characters and invalid
+// UTF-8 are stripped, and the User-Agent and referrer are cut to a few hundred bytes with a
+// trailing "…". The address is the one getClientIP took from the forwarding headers, the
+// right-most X-Forwarded-For hop that is not a trusted proxy, only when the connection came
+// from a TRUSTED_PROXIES peer; otherwise the peer address itself is kept. An address that does not parse is dropped, and valid ones are stored in canonical
+// form. Each click that needed any of this counts in the sanitized_clicks_total metric.
+
+const (
+	maxClickUserAgentBytes = 256
+	maxClickReferrerBytes  = 512
+	clickTruncationMarker  = "…"
+)
+
+// sanitizeClickText strips non-printable characters from s and truncates it to max bytes,
+// marker included; changed reports whether s was altered
+func sanitizeClickText(s string, max int) (clean string, changed bool) {
+	clean = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if len(clean) > max {
+		cut := max - len(clickTruncationMarker)
+		for cut > 0 && !utf8.RuneStart(clean[cut]) {
+			cut--
+		}
+		clean = clean[:cut] + clickTruncationMarker
+	}
+	return clean, clean != s
+}
+
+// normalizeClickIP returns the address to store for a click: recorded, the address getClientIP
+// derived from the forwarding headers, when peer (the connection's RemoteAddr) is a trusted
+// proxy, and the peer's own address otherwise. An empty peer trusts recorded. Unparseable addresses become "".
+func normalizeClickIP(recorded, peer string) (ip string, changed bool) {
+	ip = recorded
+	if peer != "" {
+		if peerIP := parseIPAddress(peer); peerIP == nil || !trustedProxyIP(peerIP) {
+			ip = splitHost(peer)
+		}
+	}
+	ip = canonicalIP(ip)
+	if ip == "" {
+		return "", recorded != ""
+	}
+	return ip, ip != recorded
+}
+
+// sanitize cleans the visitor-supplied fields of a click before it is written
+func (job *clickJob) sanitize() {
+	var uaChanged, ipChanged, refChanged bool
+	job.click.UserAgent, uaChanged = sanitizeClickText(job.click.UserAgent, maxClickUserAgentBytes)
+	job.click.IP, ipChanged = normalizeClickIP(job.click.IP, job.peer)
+	job.referrer, refChanged = sanitizeClickText(job.referrer, maxClickReferrerBytes)
+	if uaChanged || ipChanged || refChanged {
+		incMetric("sanitized_clicks_total", 1)
+	}
+}
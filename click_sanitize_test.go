@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestSanitizeClickText(t *testing.T) {
+	tests := []struct {
+		in, want string
+		max      int
+	}{
+		{"Mozilla/5.0 (X11; Linux x86_64)", "Mozilla/5.0 (X11; Linux x86_64)", 256},
+		{"Mozilla/5.0\x00\r\n\tEvil", "Mozilla/5.0Evil", 256},
+		{"bad\xff\xfeutf8", "badutf8", 256},
+		{"zero​width‮right-to-left", "zerowidthright-to-left", 256},
+		{"abcdefghijk", "abcdefg…", 10},
+		{"abcdefgh", "abcdefgh", 8},
+		// Never cut inside a character
+		{"aaaaaaé€", "aaaaaa…", 10},
+		{"", "", 256},
+	}
+	for _, tt := range tests {
+		got, changed := sanitizeClickText(tt.in, tt.max)
+		if got != tt.want || changed != (tt.in != tt.want) {
+			t.Errorf("sanitizeClickText(%q, %d) = %q, %v; want %q", tt.in, tt.max, got, changed, tt.want)
+		}
+		if len(got) > tt.max || !utf8.ValidString(got) {
+			t.Errorf("sanitizeClickText(%q, %d) = %q: %d bytes", tt.in, tt.max, got, len(got))
+		}
+	}
+}
+
+func TestHostileClickHeaders(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/hostile"})
+
+	click := func(remoteAddr string, headers map[string]string) ClickHistory {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/"+code, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		srv.serveFrom(remoteAddr, req)
+		drainClicks(t)
+		history := srv.clickEvents(code)
+		return history[len(history)-1]
+	}
+
+	before := metricValue("sanitized_clicks_total")
+	huge := "Mozilla/5.0 \x00\x1b[31m" + strings.Repeat("junk€", 2000)
+	stored := click("203.0.113.5:4000", map[string]string{"User-Agent": huge, "X-Forwarded-For": "1.2.3.4", "X-Real-IP": "5.6.7.8"})
+	if stored.IP != "203.0.113.5" {
+		t.Errorf("spoofed X-Forwarded-For from an untrusted peer stored as %q", stored.IP)
+	}
+	if len(stored.UserAgent) > maxClickUserAgentBytes || !strings.HasPrefix(stored.UserAgent, "Mozilla/5.0 [31mjunk€") ||
+		!strings.HasSuffix(stored.UserAgent, clickTruncationMarker) || !utf8.ValidString(stored.UserAgent) {
+		t.Errorf("stored user agent %q (%d bytes)", stored.UserAgent, len(stored.UserAgent))
+	}
+	for _, r := range stored.UserAgent {
+		if !unicode.IsPrint(r) {
+			t.Errorf("stored user agent keeps %U", r)
+		}
+	}
+	if metricValue("sanitized_clicks_total") != before+1 {
+		t.Errorf("sanitized_clicks_total %d, want %d", metricValue("sanitized_clicks_total"), before+1)
+	}
+
+	// A trusted proxy's X-Forwarded-For is believed, in canonical form
+	if stored := click("10.0.0.1:4000", map[string]string{"User-Agent": "curl/8.0", "X-Forwarded-For": "::ffff:198.51.100.9"}); stored.IP != "198.51.100.9" || stored.UserAgent != "curl/8.0" {
+		t.Errorf("click through a trusted proxy stored %+v", stored)
+	}
+	// Clean clicks are stored as they came and not counted
+	counted := metricValue("sanitized_clicks_total")
+	if stored := click("198.51.100.20:4000", map[string]string{"User-Agent": "Mozilla/5.0 (Macintosh)"}); stored.IP != "198.51.100.20" || stored.UserAgent != "Mozilla/5.0 (Macintosh)" {
+		t.Errorf("clean click stored %+v", stored)
+	}
+	if metricValue("sanitized_clicks_total") != counted {
+		t.Error("a clean click was counted as sanitized")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// CLICK SPIKE DETECTION
+// ============================================================================
+//
+// The click worker keeps, next to the daily_clicks rollup, an exponentially weighted moving
+// average and variance of each link's clicks per UTC hour. Hours without clicks count as 0.
+// When the running hour exceeds mean + CLICK_SPIKE_K standard deviations (default 4) and has
+// at least CLICK_SPIKE_MIN_CLICKS clicks (default 50, so tiny links stay quiet), the
+// link.click_spike ops event is sent to WEBHOOK_OPS_URL with the owner's user_id and email,
+// at most once per spikeAlertEvery per link. A link needs spikeWarmupHours of history before
+// it can spike. Bot clicks count, as a bot attack is one of the spikes to report.
+//
+// Baselines live in the memory of the instance recording the clicks and start over on a
+// restart. Behind a load balancer each instance sees its share of a link's clicks, which
+// scales mean and spike alike. The click listing shows the baseline as click_baseline.
+
+// EventLinkClickSpike is the ops event of a link getting far more clicks than usual
+const EventLinkClickSpike = "link.click_spike"
+
+const (
+	// spikeAlpha is the weight of the latest hour in the moving average and variance
+	spikeAlpha            = 0.1
+	spikeWarmupHours      = 24
+	spikeAlertEvery       = 6 * time.Hour
+	spikeIdleHours        = 7 * 24
+	defaultSpikeK         = 4.0
+	defaultSpikeMinClicks = 50
+)
+
+// clickBaseline is the hourly click statistics of one link
+type clickBaseline struct {
+	hour     time.Time // start of the hour being counted
+	count    int64     // clicks in that hour so far
+	mean     float64
+	variance float64
+	hours    int // completed hours folded into mean and variance
+	alerted  time.Time
+}
+
+// fold adds a completed hour with clicks to the moving average and variance
+func (b *clickBaseline) fold(clicks float64) {
+	if b.hours == 0 {
+		b.mean, b.variance = clicks, 0
+	} else {
+		diff := clicks - b.mean
+		incr := spikeAlpha * diff
+		b.mean += incr
+		b.variance = (1 - spikeAlpha) * (b.variance + diff*incr)
+	}
+	b.hours++
+}
+
+// roll moves the baseline to hour, folding in the hour counted so far and the empty hours
+// between; after spikeIdleHours without clicks the average has decayed to 0 anyway
+func (b *clickBaseline) roll(hour time.Time) {
+	if !hour.After(b.hour) {
+		return
+	}
+	gap := int(hour.Sub(b.hour) / time.Hour)
+	b.fold(float64(b.count))
+	if gap > spikeIdleHours {
+		b.mean, b.variance = 0, 0
+		b.hours += gap - 1
+	} else {
+		for i := 1; i < gap; i++ {
+			b.fold(0)
+		}
+	}
+	b.hour, b.count = hour, 0
+}
+
+// threshold returns how many clicks in an hour make a spike
+func (b *clickBaseline) threshold(k float64, minClicks int64) float64 {
+	return math.Max(b.mean+k*math.Sqrt(b.variance), float64(minClicks))
+}
+
+// ClickBaseline is a link's hourly click baseline as shown in its click listing
+type ClickBaseline struct {
+	HourlyMean        float64    `json:"hourly_mean"`
+	HourlyStddev      float64    `json:"hourly_stddev"`
+	SpikeThreshold    float64    `json:"spike_threshold"`
+	CurrentHourClicks int64      `json:"current_hour_clicks"`
+	HoursObserved     int        `json:"hours_observed"`
+	WarmingUp         bool       `json:"warming_up"`
+	LastSpikeAt       *time.Time `json:"last_spike_at"`
+}
+
+// spikeDetector holds the baselines of the links this instance recorded clicks of
+type spikeDetector struct {
+	mu        sync.Mutex
+	k         float64
+	minClicks int64
+	links     map[string]*clickBaseline
+	pruned    time.Time
+}
+
+func newSpikeDetector(k float64, minClicks int64) *spikeDetector {
+	return &spikeDetector{k: k, minClicks: minClicks, links: make(map[string]*clickBaseline)}
+}
+
+var spikes = newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+
+// InitClickSpikes reads the spike threshold from the environment
+func InitClickSpikes() error {
+	k := defaultSpikeK
+	if raw := os.Getenv("CLICK_SPIKE_K"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed <= 0 || math.IsInf(parsed, 0) {
+			return fmt.Errorf("CLICK_SPIKE_K must be a positive number")
+		}
+		k = parsed
+	}
+	spikes = newSpikeDetector(k, int64(envInt("CLICK_SPIKE_MIN_CLICKS", defaultSpikeMinClicks)))
+	return nil
+}
+
+// Observe counts a click at t on the link with id and reports whether it makes the link's
+// hour a spike to alert on, with the baseline it was measured against
+func (d *spikeDetector) Observe(id string, t time.Time) (ClickBaseline, bool) {
+	hour := t.UTC().Truncate(time.Hour)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(hour)
+
+	b, ok := d.links[id]
+	if !ok {
+		b = &clickBaseline{hour: hour}
+		d.links[id] = b
+	}
+	b.roll(hour)
+	// A click queued across the hour boundary counts in the running hour
+	b.count++
+
+	spike := b.hours >= spikeWarmupHours &&
+		float64(b.count) > b.threshold(d.k, d.minClicks) &&
+		(b.alerted.IsZero() || t.Sub(b.alerted) >= spikeAlertEvery)
+	if spike {
+		b.alerted = t
+	}
+	return d.snapshot(b), spike
+}
+
+// Baseline returns the baseline of the link with id at now; nil when this instance has not
+// recorded clicks of it
+func (d *spikeDetector) Baseline(id string, now time.Time) *ClickBaseline {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.links[id]
+	if !ok {
+		return nil
+	}
+	b.roll(now.UTC().Truncate(time.Hour))
+	snapshot := d.snapshot(b)
+	return &snapshot
+}
+
+func (d *spikeDetector) snapshot(b *clickBaseline) ClickBaseline {
+	snapshot := ClickBaseline{
+		HourlyMean:        math.Round(b.mean*100) / 100,
+		HourlyStddev:      math.Round(math.Sqrt(b.variance)*100) / 100,
+		SpikeThreshold:    math.Round(b.threshold(d.k, d.minClicks)*100) / 100,
+		CurrentHourClicks: b.count,
+		HoursObserved:     b.hours,
+		WarmingUp:         b.hours < spikeWarmupHours,
+	}
+	if !b.alerted.IsZero() {
+		alerted := b.alerted
+		snapshot.LastSpikeAt = &alerted
+	}
+	return snapshot
+}
+
+// prune forgets, once an hour, the baselines of links without clicks for spikeIdleHours
+func (d *spikeDetector) prune(hour time.Time) {
+	if hour.Sub(d.pruned) < time.Hour {
+		return
+	}
+	d.pruned = hour
+	for id, b := range d.links {
+		if hour.Sub(b.hour) > spikeIdleHours*time.Hour {
+			delete(d.links, id)
+		}
+	}
+}
+
+// checkClickSpike feeds a recorded click to the detector and sends link.click_spike when it
+// makes the link's hour a spike
+func checkClickSpike(ctx context.Context, link *URLData, click ClickHistory) {
+	baseline, spike := spikes.Observe(link.ID.Hex(), click.Timestamp)
+	if !spike {
+		return
+	}
+	hour := click.Timestamp.UTC().Truncate(time.Hour)
+	incMetric("click_spikes_total", 1)
+	log.Printf("📈 Short URL %s got %d clicks this hour, above its spike threshold of %.0f (hourly mean %.1f)",
+		link.ShortURL, baseline.CurrentHourClicks, baseline.SpikeThreshold, baseline.HourlyMean)
+	data := map[string]interface{}{
+		"short_url":     link.ShortURL,
+		"user_id":       link.UserID,
+		"hour":          hour,
+		"clicks":        baseline.CurrentHourClicks,
+		"hourly_mean":   baseline.HourlyMean,
+		"hourly_stddev": baseline.HourlyStddev,
+		"threshold":     baseline.SpikeThreshold,
+	}
+	if id, err := primitive.ObjectIDFromHex(link.UserID); err == nil {
+		if owner, err := Users.GetUserByID(ctx, id); err == nil {
+			data["email"] = owner.Email
+		}
+	}
+	emitOpsEvent(EventLinkClickSpike, link.ShortURL+"@"+hour.Format(time.RFC3339), data)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var spikeSeriesStart = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// feedSeries sends series[h] clicks in hour h to d, spread over the hour, and returns the
+// hour and in-hour click number (1-based) of every alert
+func feedSeries(d *spikeDetector, series []int) [][2]int {
+	var alerts [][2]int
+	for h, clicks := range series {
+		for i := 0; i < clicks; i++ {
+			at := spikeSeriesStart.Add(time.Duration(h)*time.Hour + time.Duration(i)*time.Hour/time.Duration(clicks))
+			if _, spike := d.Observe("link", at); spike {
+				alerts = append(alerts, [2]int{h, i + 1})
+			}
+		}
+	}
+	return alerts
+}
+
+// steadySeries returns hours of clicks alternating around perHour
+func steadySeries(hours, perHour int) []int {
+	series := make([]int, hours)
+	for h := range series {
+		series[h] = perHour + []int{-10, 5, 10, -5}[h%4]
+	}
+	return series
+}
+
+func TestClickSpikeSteadyTrafficNeverAlerts(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	if alerts := feedSeries(d, steadySeries(24*14, 100)); len(alerts) != 0 {
+		t.Fatalf("steady traffic alerted at %v", alerts)
+	}
+}
+
+func TestClickSpikeGradualRampNeverAlerts(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	series := steadySeries(48, 100)
+	// Growing by 2% an hour for three days more than quadruples the traffic
+	for h, clicks := 0, 100.0; h < 72; h++ {
+		clicks *= 1.02
+		series = append(series, int(clicks)+[]int{-10, 5, 10, -5}[h%4])
+	}
+	if alerts := feedSeries(d, series); len(alerts) != 0 {
+		t.Fatalf("gradual ramp alerted at %v", alerts)
+	}
+}
+
+func TestClickSpikeAlertsOnceWhenThresholdIsCrossed(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	series := append(steadySeries(48, 100), 1000)
+	alerts := feedSeries(d, series)
+	if len(alerts) != 1 || alerts[0][0] != 48 {
+		t.Fatalf("alerts = %v, want one in hour 48", alerts)
+	}
+
+	// The alert fires on the first click above the threshold of the baseline after hour 47
+	d2 := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	feedSeries(d2, steadySeries(48, 100))
+	baseline := d2.Baseline("link", spikeSeriesStart.Add(48*time.Hour))
+	if want := int(baseline.SpikeThreshold) + 1; alerts[0][1] != want {
+		t.Fatalf("alert on click %d, want click %d (threshold %.2f)", alerts[0][1], want, baseline.SpikeThreshold)
+	}
+}
+
+func TestClickSpikeAlertsAtMostEverySixHours(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	series := append(steadySeries(48, 100), 1000, 1000, 1000, 1000, 1000, 1000, 1000)
+	alerts := feedSeries(d, series)
+	// Hour 48 alerts; the baseline absorbs part of the spike, but hours 49-53 are within
+	// six hours of that alert, and by hour 54 the spike has become the new normal
+	if len(alerts) != 1 || alerts[0][0] != 48 {
+		t.Fatalf("alerts = %v, want one in hour 48", alerts)
+	}
+
+	d = newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	series = append(steadySeries(48, 100), 1000)
+	series = append(series, steadySeries(6, 100)...)
+	series = append(series, 1000)
+	alerts = feedSeries(d, series)
+	if len(alerts) != 2 || alerts[0][0] != 48 || alerts[1][0] != 55 {
+		t.Fatalf("alerts = %v, want one in hour 48 and one in hour 55", alerts)
+	}
+}
+
+func TestClickSpikeNeedsWarmupAndMinimumClicks(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	// Ten times the traffic, but only a few hours into the link's life
+	if alerts := feedSeries(d, []int{10, 10, 10, 100}); len(alerts) != 0 {
+		t.Fatalf("alerted during warm-up at %v", alerts)
+	}
+
+	// A tiny link going from 1 to 40 clicks stays below the floor
+	d = newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	series := make([]int, 48)
+	for h := range series {
+		series[h] = 1
+	}
+	if alerts := feedSeries(d, append(series, 40)); len(alerts) != 0 {
+		t.Fatalf("tiny link alerted at %v", alerts)
+	}
+	// 60 clicks pass it
+	d = newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	alerts := feedSeries(d, append(series, 60))
+	if len(alerts) != 1 || alerts[0] != [2]int{48, defaultSpikeMinClicks + 1} {
+		t.Fatalf("alerts = %v, want one on click %d of hour 48", alerts, defaultSpikeMinClicks+1)
+	}
+}
+
+func TestClickSpikeEmptyHoursCountAsZero(t *testing.T) {
+	d := newSpikeDetector(defaultSpikeK, defaultSpikeMinClicks)
+	feedSeries(d, steadySeries(48, 100))
+	baseline := d.Baseline("link", spikeSeriesStart.Add(60*time.Hour))
+	if baseline.HoursObserved != 60 || baseline.HourlyMean >= 50 {
+		t.Fatalf("after 12 empty hours: %+v", baseline)
+	}
+	if d.Baseline("other", spikeSeriesStart) != nil {
+		t.Fatal("baseline of a link without clicks should be nil")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// ASYNC CLICK RECORDING
+// ============================================================================
+
+const clickQueueSize = 10000
+
+// clickJob is one click to record. Demo clicks only increment the demo_urls counter - no
+// history and nothing about the visitor is stored for them. Blocked clicks likewise only
+// increment the link's blocked_clicks counter. A job with outcome set only counts how a
+// redirect of the link ended, see link_outcomes.go. A job with done set only marks a point in
+// the queue: it is closed once every click queued before it has been written.
+type clickJob struct {
+	demo     bool
+	blocked  bool
+	outcome  string
+	demoID   primitive.ObjectID
+	store    URLStore
+	link     *URLData
+	click    ClickHistory
+	referrer string
+	// peer is the RemoteAddr of the click's connection, checked against TRUSTED_PROXIES
+	peer string
+	done chan struct{}
+}
+
+// clickRecorder writes clicks in the background so redirects never wait on the database
+type clickRecorder struct {
+	queue chan clickJob
+	once  sync.Once
+}
+
+var clicks = &clickRecorder{queue: make(chan clickJob, clickQueueSize)}
+
+// Record queues a click on a registered link; clicks are dropped when the queue is full.
+// Only the referrer's host is stored; the referrer itself is passed on to the click event
+// sink. The worker sanitizes the click first, see click_sanitize.go.
+func (c *clickRecorder) Record(store URLStore, link *URLData, click ClickHistory, referrer, peer string) {
+	c.enqueue(clickJob{store: store, link: link, click: click, referrer: referrer, peer: peer})
+}
+
+// RecordDemo queues a click on a demo link
+func (c *clickRecorder) RecordDemo(id primitive.ObjectID) {
+	c.enqueue(clickJob{demo: true, demoID: id})
+}
+
+// RecordBlocked queues a click refused by the link's referrer restriction
+func (c *clickRecorder) RecordBlocked(store URLStore, link *URLData) {
+	c.enqueue(clickJob{blocked: true, store: store, link: link})
+}
+
+// RecordOutcome queues the outcome of a redirect of a registered link
+func (c *clickRecorder) RecordOutcome(store URLStore, link *URLData, outcome string) {
+	c.enqueue(clickJob{outcome: outcome, store: store, link: link})
+}
+
+func (c *clickRecorder) enqueue(job clickJob) {
+	c.once.Do(func() { go c.run() })
+	select {
+	case c.queue <- job:
+	default:
+		incMetric("clicks_dropped_total", 1)
+		log.Printf("Warning: click queue full, dropping click")
+	}
+}
+
+// Drain waits until every click queued so far has been written
+func (c *clickRecorder) Drain(ctx context.Context) {
+	c.once.Do(func() { go c.run() })
+	done := make(chan struct{})
+	select {
+	case c.queue <- clickJob{done: done}:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Warning: click queue drain interrupted: %v", ctx.Err())
+	}
+}
+
+func (c *clickRecorder) run() {
+	ticker := time.NewTicker(outcomeFlushInterval)
+	defer ticker.Stop()
+	outcomes := make(map[outcomeKey]*pendingOutcome)
+	for {
+		select {
+		case job := <-c.queue:
+			if job.done != nil {
+				flushOutcomes(outcomes)
+				outcomes = make(map[outcomeKey]*pendingOutcome)
+				close(job.done)
+				continue
+			}
+			if job.outcome != "" {
+				countOutcome(outcomes, job, clock.Now())
+				continue
+			}
+			if err := c.write(job); err != nil {
+				incMetric("clicks_failed_total", 1)
+				log.Printf("error updating analytics: %v", err)
+			}
+		case <-ticker.C:
+			if len(outcomes) > 0 {
+				flushOutcomes(outcomes)
+				outcomes = make(map[outcomeKey]*pendingOutcome)
+			}
+		}
+	}
+}
+
+func (c *clickRecorder) write(job clickJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if job.demo {
+		if !usesMongo() {
+			return nil
+		}
+		_, err := DB.Database.Collection("demo_urls").UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: job.demoID}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "clicks", Value: 1}}}})
+		return err
+	}
+	if job.blocked {
+		return job.store.RecordBlockedClick(ctx, job.link)
+	}
+	job.sanitize()
+	job.click.ReferrerHost = referrerHost(job.referrer)
+	if err := job.store.RecordClick(ctx, job.link, job.click); err != nil {
+		return err
+	}
+	if err := countBudgetClick(ctx, job.store, job.link, job.click); err != nil {
+		log.Printf("error counting daily click budget of %s: %v", job.link.ShortURL, err)
+	}
+	checkClickSpike(ctx, job.link, job.click)
+	if clickSinkEnabled() {
+		clickEvents.Publish(newClickEvent(job.link, job.click, job.referrer))
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// CLICK EVENT SINK (EXTERNAL ANALYTICS PIPELINE)
+// ============================================================================
+//
+// With CLICK_SINK_URL set, every click the click worker has persisted is also sent to an
+// external pipeline as a ClickEvent, POSTed in JSON batches ({"events": [...]}) and signed
+// like webhooks when CLICK_SINK_SECRET is set. Delivery is at least once: a batch the sink
+// does not accept is spilled to the clicks_outbox collection (a bounded in-memory queue on
+// the other backends) and redelivered by the outbox drain once the sink answers again, so
+// receivers should de-duplicate on event_id. On shutdown buffered events are delivered or
+// spilled before the process exits.
+
+// ClickEventSchemaVersion is bumped whenever a ClickEvent field changes meaning or is removed
+const ClickEventSchemaVersion = 1
+
+const (
+	clickSinkBufferSize     = 10000
+	clickSinkDefaultBatch   = 100
+	clickSinkMaxBatch       = 1000
+	clickSinkFlushEvery     = 2 * time.Second
+	clickSinkTimeout        = 10 * time.Second
+	clickSinkRetryAfter     = 15 * time.Second
+	clickSinkDrainEvery     = 15 * time.Second
+	clickSinkMemoryCapacity = 100000
+)
+
+// ClickEvent is one click as delivered to the external pipeline
+type ClickEvent struct {
+	SchemaVersion int       `bson:"schema_version" json:"schema_version"`
+	EventID       string    `bson:"event_id" json:"event_id"`
+	LinkID        string    `bson:"link_id" json:"link_id"`
+	ShortURL      string    `bson:"short_url" json:"short_url"`
+	Domain        string    `bson:"domain,omitempty" json:"domain,omitempty"`
+	Timestamp     time.Time `bson:"timestamp" json:"timestamp"`
+	IPHash        string    `bson:"ip_hash,omitempty" json:"ip_hash,omitempty"`
+	Device        string    `bson:"device" json:"device"`
+	Bot           bool      `bson:"bot" json:"bot"`
+	Referrer      string    `bson:"referrer,omitempty" json:"referrer,omitempty"`
+	Branch        string    `bson:"branch,omitempty" json:"branch,omitempty"`
+	Signed        bool      `bson:"signed,omitempty" json:"signed,omitempty"`
+}
+
+// clickOutboxEntry is a clicks_outbox document
+type clickOutboxEntry struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Event    ClickEvent         `bson:"event"`
+	QueuedAt time.Time          `bson:"queued_at"`
+}
+
+// botUserAgentMarkers identify crawlers, link unfurlers and HTTP libraries
+var botUserAgentMarkers = []string{
+	"bot", "crawler", "spider", "slurp", "facebookexternalhit", "embedly", "preview",
+	"curl/", "wget/", "python-requests", "go-http-client", "headless",
+}
+
+// isBotUserAgent reports whether a User-Agent is a known automated client
+func isBotUserAgent(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+	ua := strings.ToLower(userAgent)
+	for _, marker := range botUserAgentMarkers {
+		if strings.Contains(ua, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// newClickEvent builds the event for a recorded click. The visitor's address is only ever
+// sent hashed, and not at all when IP_PRIVACY_MODE=none.
+func newClickEvent(link *URLData, click ClickHistory, referrer string) ClickEvent {
+	event := ClickEvent{
+		SchemaVersion: ClickEventSchemaVersion,
+		EventID:       primitive.NewObjectID().Hex(),
+		LinkID:        link.ID.Hex(),
+		ShortURL:      link.ShortURL,
+		Domain:        link.Domain,
+		Timestamp:     click.Timestamp,
+		Device:        detectDeviceClass(click.UserAgent),
+		Bot:           isBotUserAgent(click.UserAgent),
+		Referrer:      redactURL(referrer),
+		Branch:        click.Branch,
+		Signed:        click.Signed,
+	}
+	event.IPHash = clickIPHash(click.IP)
+	return event
+}
+
+// clickSink batches click events to CLICK_SINK_URL
+type clickSink struct {
+	endpoint  string
+	secret    string
+	batchSize int
+	client    *http.Client
+	events    chan ClickEvent
+	flush     chan chan struct{}
+
+	mu        sync.Mutex
+	downUntil time.Time
+	memory    []ClickEvent // spilled events when the outbox collection is unavailable
+}
+
+var clickEvents *clickSink
+
+// InitClickSink configures the click event sink from the environment; it is off unless
+// CLICK_SINK_URL is set
+func InitClickSink() error {
+	if os.Getenv("CLICK_SINK_KAFKA_BROKERS") != "" {
+		return fmt.Errorf("CLICK_SINK_KAFKA_BROKERS is set, but this build has no Kafka producer; use CLICK_SINK_URL with an HTTPS ingestion endpoint")
+	}
+	endpoint := os.Getenv("CLICK_SINK_URL")
+	if endpoint == "" {
+		return nil
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("CLICK_SINK_URL is not a valid URL")
+	}
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && parsed.Hostname() == "localhost") {
+		return fmt.Errorf("CLICK_SINK_URL must use https (plain http is only accepted for localhost)")
+	}
+	batchSize := clickSinkDefaultBatch
+	if raw := os.Getenv("CLICK_SINK_BATCH_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > clickSinkMaxBatch {
+			return fmt.Errorf("CLICK_SINK_BATCH_SIZE must be between 1 and %d", clickSinkMaxBatch)
+		}
+		batchSize = n
+	}
+
+	clickEvents = &clickSink{
+		endpoint:  endpoint,
+		secret:    os.Getenv("CLICK_SINK_SECRET"),
+		batchSize: batchSize,
+		client:    newOutboundClient(outboundOptions{timeout: clickSinkTimeout}),
+		events:    make(chan ClickEvent, clickSinkBufferSize),
+		flush:     make(chan chan struct{}),
+	}
+	go clickEvents.run()
+	go clickEvents.drainLoop()
+	log.Printf("📤 Click events are sent to %s", redactURL(endpoint))
+	return nil
+}
+
+// clickSinkEnabled reports whether clicks are forwarded to an external pipeline
+func clickSinkEnabled() bool {
+	return clickEvents != nil
+}
+
+// Publish queues an event without blocking the click worker; when the buffer is full the
+// event goes straight to the outbox
+func (s *clickSink) Publish(event ClickEvent) {
+	select {
+	case s.events <- event:
+	default:
+		s.spill([]ClickEvent{event})
+	}
+}
+
+func (s *clickSink) run() {
+	ticker := time.NewTicker(clickSinkFlushEvery)
+	defer ticker.Stop()
+	batch := make([]ClickEvent, 0, s.batchSize)
+	send := func() {
+		if len(batch) > 0 {
+			s.sendOrSpill(batch)
+			batch = make([]ClickEvent, 0, s.batchSize)
+		}
+	}
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) >= s.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-s.flush:
+			for pending := true; pending; {
+				select {
+				case event := <-s.events:
+					batch = append(batch, event)
+					if len(batch) >= s.batchSize {
+						send()
+					}
+				default:
+					pending = false
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// sendOrSpill delivers a batch, spilling it to the outbox when the sink is down or refuses it
+func (s *clickSink) sendOrSpill(batch []ClickEvent) {
+	if s.isDown() {
+		s.spill(batch)
+		return
+	}
+	if err := s.deliver(batch); err != nil {
+		log.Printf("⚠️  Click sink delivery failed, spilling %d events: %v", len(batch), err)
+		s.spill(batch)
+		return
+	}
+	if s.outboxSize() == 0 {
+		setGauge("click_sink_lag_seconds", int64(time.Since(batch[0].Timestamp).Seconds()))
+	}
+}
+
+// deliver POSTs one batch; any non-2xx answer counts as a failure and backs the sink off
+func (s *clickSink) deliver(batch []ClickEvent) error {
+	body, err := json.Marshal(map[string]interface{}{"events": batch})
+	if err != nil {
+		return err
+	}
+	err = s.post(body)
+	if err != nil {
+		incMetric("click_sink_failures_total", 1)
+		s.mu.Lock()
+		s.downUntil = time.Now().Add(clickSinkRetryAfter)
+		s.mu.Unlock()
+		return err
+	}
+	incMetric("click_sink_delivered_total", int64(len(batch)))
+	return nil
+}
+
+func (s *clickSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RapidLink-Schema-Version", strconv.Itoa(ClickEventSchemaVersion))
+	if s.secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(body)
+		req.Header.Set("X-RapidLink-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *clickSink) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.downUntil)
+}
+
+// spill keeps undelivered events for the outbox drain
+func (s *clickSink) spill(batch []ClickEvent) {
+	incMetric("click_sink_spilled_total", int64(len(batch)))
+	if usesMongo() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		now := time.Now().UTC()
+		docs := make([]interface{}, len(batch))
+		for i, event := range batch {
+			docs[i] = clickOutboxEntry{Event: event, QueuedAt: now}
+		}
+		_, err := DB.Database.Collection("clicks_outbox").InsertMany(ctx, docs)
+		if err == nil {
+			incMetric("click_sink_outbox_size", int64(len(batch)))
+			return
+		}
+		log.Printf("⚠️  Could not write %d click events to clicks_outbox, keeping them in memory: %v", len(batch), err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory = append(s.memory, batch...)
+	if overflow := len(s.memory) - clickSinkMemoryCapacity; overflow > 0 {
+		incMetric("click_sink_dropped_total", int64(overflow))
+		log.Printf("Warning: click sink retry queue full, dropping %d oldest events", overflow)
+		s.memory = append([]ClickEvent(nil), s.memory[overflow:]...)
+	}
+	setGauge("click_sink_memory_queue", int64(len(s.memory)))
+}
+
+// outboxSize returns the number of spilled events still waiting for redelivery
+func (s *clickSink) outboxSize() int64 {
+	return metricValue("click_sink_outbox_size") + metricValue("click_sink_memory_queue")
+}
+
+// drainLoop periodically redelivers spilled events once the sink is back
+func (s *clickSink) drainLoop() {
+	ticker := time.NewTicker(clickSinkDrainEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.isDown() {
+			continue
+		}
+		s.drainMemory()
+		if usesMongo() {
+			runExclusive("click_outbox", clickSinkDrainEvery, s.drainOutbox)
+		}
+		if s.outboxSize() == 0 {
+			setGauge("click_sink_lag_seconds", 0)
+		}
+	}
+}
+
+// drainMemory redelivers the in-memory retry queue oldest first
+func (s *clickSink) drainMemory() {
+	for {
+		s.mu.Lock()
+		n := len(s.memory)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		batch := append([]ClickEvent(nil), s.memory[:n]...)
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			setGauge("click_sink_memory_queue", 0)
+			return
+		}
+		setGauge("click_sink_lag_seconds", int64(time.Since(batch[0].Timestamp).Seconds()))
+		if err := s.deliver(batch); err != nil {
+			log.Printf("⚠️  Click sink still failing, %d events queued in memory: %v", s.memoryLen(), err)
+			return
+		}
+		s.mu.Lock()
+		s.memory = s.memory[n:]
+		setGauge("click_sink_memory_queue", int64(len(s.memory)))
+		s.mu.Unlock()
+	}
+}
+
+func (s *clickSink) memoryLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.memory)
+}
+
+// drainOutbox redelivers clicks_outbox oldest first, deleting each batch only after the sink
+// accepted it; a crash in between redelivers the batch, never loses it
+func (s *clickSink) drainOutbox() (map[string]int64, error) {
+	outbox := DB.Database.Collection("clicks_outbox")
+	delivered := int64(0)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cursor, err := outbox.Find(ctx, bson.D{},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(s.batchSize)))
+		if err != nil {
+			cancel()
+			return map[string]int64{"delivered": delivered}, err
+		}
+		var entries []clickOutboxEntry
+		err = cursor.All(ctx, &entries)
+		if err != nil {
+			cancel()
+			return map[string]int64{"delivered": delivered}, err
+		}
+		if len(entries) == 0 {
+			setGauge("click_sink_outbox_size", 0)
+			cancel()
+			return map[string]int64{"delivered": delivered}, nil
+		}
+
+		batch := make([]ClickEvent, len(entries))
+		ids := make([]primitive.ObjectID, len(entries))
+		for i, entry := range entries {
+			batch[i] = entry.Event
+			ids[i] = entry.ID
+		}
+		setGauge("click_sink_lag_seconds", int64(time.Since(batch[0].Timestamp).Seconds()))
+		if remaining, err := outbox.EstimatedDocumentCount(ctx); err == nil {
+			setGauge("click_sink_outbox_size", remaining)
+		}
+		if err := s.deliver(batch); err != nil {
+			cancel()
+			return map[string]int64{"delivered": delivered}, err
+		}
+		_, err = outbox.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		cancel()
+		if err != nil {
+			return map[string]int64{"delivered": delivered}, err
+		}
+		delivered += int64(len(batch))
+	}
+}
+
+// Drain delivers (or spills) every buffered event; called on shutdown after the click
+// worker has stopped taking new clicks
+func (s *clickSink) Drain(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case s.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Warning: click sink drain interrupted: %v", ctx.Err())
+	}
+	if n := s.memoryLen(); n > 0 {
+		log.Printf("Warning: %d undelivered click events were only queued in memory and are lost", n)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ============================================================================
+// TIME SOURCE AND EXPIRY FILTERS
+// ============================================================================
+//
+// Expiry decisions made inside queries (redirect, cleanup, demo lookups) compare against
+// MongoDB's $$NOW, so they agree with each other and with the TTL index on demo_urls no
+// matter how far the app server's clock drifts. Go-side logic that needs "now" (default
+// expiries, status reporting) reads it from the injectable clock instead of time.Now().
+
+// Clock supplies the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the local system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+// FixedClock always returns the same instant, for deterministic checks around expiry boundaries
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time { return time.Time(c) }
+
+// swappableClock is the process time source. Background workers read it while tests swap
+// it, so the current Clock is held atomically.
+type swappableClock struct {
+	current atomic.Pointer[Clock]
+}
+
+func (s *swappableClock) Now() time.Time {
+	if c := s.current.Load(); c != nil {
+		return (*c).Now()
+	}
+	return systemClock{}.Now()
+}
+
+var clock = &swappableClock{}
+
+// SetClock replaces the process time source; nil restores the system clock
+func SetClock(c Clock) {
+	if c == nil {
+		clock.current.Store(nil)
+		return
+	}
+	clock.current.Store(&c)
+}
+
+// isExpiredAt reports whether an expiry has passed at now. A link expires at exactly
+// expires_at, matching the $lte used by the cleanup worker.
+func isExpiredAt(expiresAt *time.Time, now time.Time) bool {
+	return expiresAt != nil && !expiresAt.After(now)
+}
+
+// notExpiredFilter matches documents without an expiry or whose expiry is after the
+// database's current time
+func notExpiredFilter() bson.E {
+	return bson.E{Key: "$expr", Value: bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$expires_at", nil}}}, nil}}},
+		bson.D{{Key: "$gt", Value: bson.A{"$expires_at", "$$NOW"}}},
+	}}}}
+}
+
+// expiredFilter matches documents whose expiry is at or before the database's current time
+func expiredFilter() bson.D {
+	return bson.D{
+		// Lets the sparse expires_at index narrow candidates before $expr is evaluated
+		{Key: "expires_at", Value: bson.D{{Key: "$type", Value: "date"}}},
+		{Key: "$expr", Value: bson.D{{Key: "$lte", Value: bson.A{"$expires_at", "$$NOW"}}}},
+	}
+}
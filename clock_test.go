@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var clockTestBase = time.Date(2031, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// freezeClock sets the clock to at until the end of the test
+func freezeClock(t *testing.T, at time.Time) {
+	SetClock(FixedClock(at))
+	t.Cleanup(func() { SetClock(nil) })
+}
+
+func TestIsExpiredAtBoundary(t *testing.T) {
+	expiry := clockTestBase
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{expiry.Add(-time.Nanosecond), false},
+		{expiry, true},
+		{expiry.Add(time.Nanosecond), true},
+	}
+	for _, tt := range tests {
+		if got := isExpiredAt(&expiry, tt.now); got != tt.want {
+			t.Errorf("isExpiredAt(%v, %v) = %v, want %v", expiry, tt.now, got, tt.want)
+		}
+	}
+	if isExpiredAt(nil, expiry) {
+		t.Error("a link without expiry expired")
+	}
+}
+
+func TestStatusCategoryAtExpiryBoundary(t *testing.T) {
+	expiry := clockTestBase
+	link := &URLData{IsActive: true, ExpiresAt: &expiry}
+	if got := statusCategory(link, expiry.Add(-time.Nanosecond)); got != statusActive {
+		t.Errorf("just before expiry: %s", got)
+	}
+	if got := statusCategory(link, expiry); got != statusExpired {
+		t.Errorf("at expiry: %s", got)
+	}
+}
+
+func TestRedirectAtExactExpiry(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	expiry := clockTestBase.Add(time.Hour)
+	code := srv.shorten(token, map[string]interface{}{
+		"long-url": "https://example.com/boundary",
+		"expires":  expiry.Format(time.RFC3339),
+	})
+
+	SetClock(FixedClock(expiry.Add(-time.Nanosecond)))
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("1ns before expiry: status %d, want 301", resp.StatusCode)
+	}
+	SetClock(FixedClock(expiry))
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("at expiry: status %d, want 410", resp.StatusCode)
+	}
+}
+
+func TestExpiryJanitorAtExactExpiry(t *testing.T) {
+	store := newMemoryStore()
+	expiry := clockTestBase
+	ctx := context.Background()
+	if err := store.InsertLink(ctx, &URLData{ShortURL: "boundary", LongURL: "https://example.com/", UserID: "u", IsActive: true, ExpiresAt: &expiry}); err != nil {
+		t.Fatal(err)
+	}
+
+	freezeClock(t, expiry.Add(-time.Nanosecond))
+	if n, _ := store.DeactivateExpired(ctx); n != 0 {
+		t.Fatalf("deactivated %d links before their expiry", n)
+	}
+	SetClock(FixedClock(expiry))
+	if n, _ := store.DeactivateExpired(ctx); n != 1 {
+		t.Fatalf("deactivated %d links at their expiry, want 1", n)
+	}
+	link, _ := store.FindLinkByCode(ctx, "boundary")
+	if link.IsActive || link.DeactivatedReason != DeactivatedExpired {
+		t.Fatalf("link after cleanup: active %v, reason %q", link.IsActive, link.DeactivatedReason)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// CODE-PRESERVING IMPORT
+// ============================================================================
+//
+// POST /bulk with mode=preserve_codes (form field or query parameter) imports links from
+// another shortener with their existing codes: the Custom Alias column is the code to keep,
+// and no other code is ever generated. Instead of a per-row error, a code that cannot be kept
+// lands in the conflicts report with the reason (missing, invalid, reserved, taken, or
+// duplicate_in_file) and, for taken codes, what holds it and whether that is the importer's
+// own link. A row whose code already points at the importer's link to the same destination
+// counts as existing, so an import can be run again. With on_conflict=prefix or suffix and
+// rename_with=<text>, a conflicting code is retried once as text+code or code+text.
+//
+// dry_run=true runs every row through the same processSingleURL path as a real import and
+// stops just before the code is reserved, so the report is exactly what a real run would
+// produce, barring codes taken in between. Codes are claimed within the file in row order,
+// in both runs, so duplicates are reported the same way. Only uploaded files support this
+// mode; source_url imports always generate codes as before.
+
+// Conflict reasons of the import report
+const (
+	ConflictMissing   = "missing"
+	ConflictInvalid   = "invalid"
+	ConflictReserved  = "reserved"
+	ConflictTaken     = "taken"
+	ConflictDuplicate = "duplicate_in_file"
+)
+
+// bulkImportOptions are the code-preserving settings of a bulk upload
+type bulkImportOptions struct {
+	PreserveCodes bool
+	DryRun        bool
+	// OnConflict is "prefix" or "suffix" to retry conflicting codes with Affix, "" to report them
+	OnConflict string
+	Affix      string
+	// claimed holds the codes rows of this file have taken
+	claimed *importCodeSet
+}
+
+// importCodeSet records the codes taken within one file
+type importCodeSet struct {
+	mu    sync.Mutex
+	codes map[string]bool
+}
+
+// claim takes code for the calling row; false when another row has it
+func (s *importCodeSet) claim(code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codes[code] {
+		return false
+	}
+	s.codes[code] = true
+	return true
+}
+
+// CodeHolderInfo describes what holds a conflicting code. Other users' links are only
+// identified as such.
+type CodeHolderInfo struct {
+	Type       string `json:"type"`
+	OwnedByYou bool   `json:"owned_by_you"`
+	LinkID     string `json:"link_id,omitempty"`
+	LongURL    string `json:"long_url,omitempty"`
+}
+
+// CodeConflict is why a row's code could not be kept
+type CodeConflict struct {
+	Code   string          `json:"code"`
+	Reason string          `json:"reason"`
+	HeldBy *CodeHolderInfo `json:"held_by,omitempty"`
+	// RenamedTo is the code used instead, when the rename strategy found a free one
+	RenamedTo string `json:"renamed_to,omitempty"`
+	// RenameConflict is why the renamed code could not be used either
+	RenameConflict *CodeConflict `json:"rename_conflict,omitempty"`
+}
+
+// BulkConflict is one entry of the conflicts report
+type BulkConflict struct {
+	Row     int    `json:"row"`
+	LongURL string `json:"long_url"`
+	CodeConflict
+}
+
+// parseBulkImportOptions reads mode, dry_run, on_conflict and rename_with
+func parseBulkImportOptions(r *http.Request) (bulkImportOptions, error) {
+	opts := bulkImportOptions{claimed: &importCodeSet{codes: make(map[string]bool)}}
+	switch mode := r.FormValue("mode"); mode {
+	case "":
+	case "preserve_codes":
+		opts.PreserveCodes = true
+	default:
+		return opts, fmt.Errorf("unknown mode %q (use preserve_codes)", mode)
+	}
+	opts.DryRun = r.FormValue("dry_run") == "true"
+	opts.OnConflict = r.FormValue("on_conflict")
+	opts.Affix = strings.TrimSpace(r.FormValue("rename_with"))
+
+	if !opts.PreserveCodes && (opts.DryRun || opts.OnConflict != "") {
+		return opts, fmt.Errorf("dry_run and on_conflict require mode=preserve_codes")
+	}
+	switch opts.OnConflict {
+	case "", "report":
+		opts.OnConflict = ""
+	case "prefix", "suffix":
+		if opts.Affix == "" {
+			return opts, fmt.Errorf("on_conflict=%s requires rename_with", opts.OnConflict)
+		}
+	default:
+		return opts, fmt.Errorf("on_conflict must be report, prefix or suffix")
+	}
+	return opts, nil
+}
+
+// claimFileCodes claims the codes of urls in row order; the result marks the rows whose
+// code an earlier row already has
+func (opts bulkImportOptions) claimFileCodes(urls []BulkURLRequest) []bool {
+	duplicates := make([]bool, len(urls))
+	for i, req := range urls {
+		if req.CustomAlias != "" && !opts.claimed.claim(req.CustomAlias) {
+			duplicates[i] = true
+		}
+	}
+	return duplicates
+}
+
+// renamed applies the rename strategy to code
+func (opts bulkImportOptions) renamed(code string) string {
+	if opts.OnConflict == "prefix" {
+		return opts.Affix + code
+	}
+	return code + opts.Affix
+}
+
+// checkImportCode reports why userID cannot use code for a link to longURL, or nil when the
+// code is free. existing is set instead when code already is userID's link to longURL.
+func checkImportCode(ctx context.Context, code, userID, longURL string) (conflict *CodeConflict, existing *URLData, err error) {
+	switch {
+	case code == "":
+		return &CodeConflict{Reason: ConflictMissing}, nil, nil
+	case !validateCustomURL(code):
+		return &CodeConflict{Code: code, Reason: ConflictInvalid}, nil, nil
+	case isReservedCode(code):
+		return &CodeConflict{Code: code, Reason: ConflictReserved}, nil, nil
+	}
+
+	holder, err := Links.CodeHolder(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conflict = &CodeConflict{Code: code, Reason: ConflictTaken, HeldBy: &CodeHolderInfo{
+		Type:       holder.OwnerType,
+		OwnedByYou: holder.UserID != "" && holder.UserID == userID,
+	}}
+	if holder.OwnerType == CodeOwnerReserved {
+		conflict.Reason = ConflictReserved
+	}
+	if conflict.HeldBy.OwnedByYou && (holder.OwnerType == CodeOwnerLink || holder.OwnerType == CodeOwnerDraft) {
+		conflict.HeldBy.LinkID = holder.Ref
+		link, err := Links.FindLinkByCode(ctx, code)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, nil, err
+		}
+		if link != nil {
+			conflict.HeldBy.LongURL = link.LongURL
+			if link.IsActive && link.LongURL == longURL {
+				return nil, link, nil
+			}
+		}
+	}
+	return conflict, nil, nil
+}
+
+// resolveImportCode picks the code of an import row: its own code, or the renamed one when
+// the strategy allows. conflict is set, with an empty code, when neither can be used.
+func resolveImportCode(ctx context.Context, req BulkURLRequest, userID string, duplicate bool, opts bulkImportOptions) (code string, conflict *CodeConflict, existing *URLData, err error) {
+	if duplicate {
+		conflict = &CodeConflict{Code: req.CustomAlias, Reason: ConflictDuplicate}
+	} else {
+		conflict, existing, err = checkImportCode(ctx, req.CustomAlias, userID, req.LongURL)
+		if err != nil || existing != nil {
+			return "", nil, existing, err
+		}
+		if conflict == nil {
+			return req.CustomAlias, nil, nil, nil
+		}
+	}
+	if opts.OnConflict == "" || conflict.Reason == ConflictMissing {
+		return "", conflict, nil, nil
+	}
+
+	candidate := opts.renamed(req.CustomAlias)
+	renameConflict, _, err := checkImportCode(ctx, candidate, userID, "")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if renameConflict == nil && !opts.claimed.claim(candidate) {
+		renameConflict = &CodeConflict{Code: candidate, Reason: ConflictDuplicate}
+	}
+	if renameConflict != nil {
+		conflict.RenameConflict = renameConflict
+		return "", conflict, nil, nil
+	}
+	conflict.RenamedTo = candidate
+	return candidate, conflict, nil, nil
+}
+
+// bulkConflicts collects the conflicts report of a code-preserving import
+func bulkConflicts(urls []BulkURLRequest, results []BulkURLResult) []BulkConflict {
+	conflicts := []BulkConflict{}
+	for i, result := range results {
+		if result.Conflict != nil {
+			conflicts = append(conflicts, BulkConflict{Row: urls[i].Row, LongURL: urls[i].LongURL, CodeConflict: *result.Conflict})
+		}
+	}
+	return conflicts
+}
+
+// conflictReasonText phrases the conflict reasons for row errors
+var conflictReasonText = map[string]string{
+	ConflictInvalid:   "not a valid code",
+	ConflictReserved:  "reserved",
+	ConflictTaken:     "already taken",
+	ConflictDuplicate: "used by an earlier row",
+}
+
+// describeConflict is the row error of a conflict that left the row without a code
+func describeConflict(conflict *CodeConflict) string {
+	if conflict.Reason == ConflictMissing {
+		return "Custom Alias is required with mode=preserve_codes"
+	}
+	message := fmt.Sprintf("Short code '%s' is %s", conflict.Code, conflictReasonText[conflict.Reason])
+	if rename := conflict.RenameConflict; rename != nil {
+		message += fmt.Sprintf(", and so is '%s' (%s)", rename.Code, conflictReasonText[rename.Reason])
+	}
+	return message
+}
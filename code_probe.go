@@ -0,0 +1,253 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// SHORT CODE ENUMERATION GUARD
+// ============================================================================
+//
+// Preview, resolve and demo stats answer "does this code exist", which lets a client walk
+// the keyspace. Destinations are only ever returned to the owner or with a signature, so a
+// scan learns which codes exist, not where they lead; this guard makes even that slow.
+// Each endpoint has its own strict per-identifier rate limit, with a WARN security event
+// once a client has used 80% of it in a window. The distinct codes each IP and each user
+// asks about are counted in a small HyperLogLog sketch per hour: past half of
+// CODE_PROBE_DISTINCT_LIMIT (default 300) one CODE_ENUMERATION_SUSPECTED event is logged
+// for the hour, and at the limit the identifier is blocked from every guarded endpoint for
+// CODE_PROBE_BLOCK_MINUTES (default 60). Misses are answered after a random delay of up to
+// CODE_PROBE_MISS_DELAY_MS (default 150) so response times do not tell codes apart. State is
+// per instance, like the other rate limiters.
+
+// codeProbeEndpoint is a guarded endpoint and its requests per minute per identifier; 0
+// leaves rate limiting to the handler
+type codeProbeEndpoint struct {
+	name  string
+	limit int
+}
+
+var (
+	probePreview       = codeProbeEndpoint{"preview", 30}
+	probeResolveOwner  = codeProbeEndpoint{"resolve", 60}
+	probeResolvePublic = codeProbeEndpoint{"resolve_public", 0} // publicResolveRateLimit applies
+	probeDemoStats     = codeProbeEndpoint{"demo_stats", 30}
+)
+
+const (
+	codeProbeWindow          = time.Hour
+	codeProbeRateWindow      = time.Minute
+	codeProbeMaxTracked      = 50000
+	defaultCodeProbeDistinct = 300
+	defaultCodeProbeBlockMin = 60
+	defaultCodeProbeDelayMS  = 150
+)
+
+// codeSketchRegisters is the HyperLogLog register count: 256 bytes per identifier for a
+// standard error of about 6.5%
+const codeSketchRegisters = 256
+
+// codeSketch estimates how many distinct codes were added to it
+type codeSketch [codeSketchRegisters]uint8
+
+// Add records code in the sketch
+func (s *codeSketch) Add(code string) {
+	h := fnv.New64a()
+	h.Write([]byte(code))
+	x := h.Sum64()
+	// splitmix64 finalizer: FNV's high bits are too regular for short codes
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	register := x >> 56
+	rank := uint8(bits.LeadingZeros64(x<<8|1<<7)) + 1
+	if rank > s[register] {
+		s[register] = rank
+	}
+}
+
+// Estimate returns the approximate number of distinct codes added
+func (s *codeSketch) Estimate() int {
+	const m = float64(codeSketchRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros)) // linear counting for small sets
+	}
+	return int(estimate + 0.5)
+}
+
+// codeProbeState is one identifier's sketch for the current hour
+type codeProbeState struct {
+	windowStart time.Time
+	sketch      codeSketch
+	warned      bool
+}
+
+// codeProbeGuard tracks probing identifiers and the ones currently blocked
+type codeProbeGuard struct {
+	mu        sync.Mutex
+	states    map[string]*codeProbeState
+	blocked   map[string]time.Time
+	lastPrune time.Time
+}
+
+var codeProbes = &codeProbeGuard{
+	states:  make(map[string]*codeProbeState),
+	blocked: make(map[string]time.Time),
+}
+
+// blockedUntil returns when identifier's block ends; zero when it is not blocked
+func (g *codeProbeGuard) blockedUntil(identifier string, now time.Time) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.blocked[identifier]
+	if ok && !now.Before(until) {
+		delete(g.blocked, identifier)
+		return time.Time{}
+	}
+	return until
+}
+
+// observe adds code to identifier's sketch and returns the distinct codes it queried this
+// hour and whether this is the first time the count passed warnAt in the hour
+func (g *codeProbeGuard) observe(identifier, code string, warnAt int, now time.Time) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, ok := g.states[identifier]
+	if !ok || now.Sub(state.windowStart) > codeProbeWindow {
+		if len(g.states) >= codeProbeMaxTracked || now.Sub(g.lastPrune) > codeProbeRateWindow {
+			g.prune(now)
+		}
+		state = &codeProbeState{windowStart: now}
+		g.states[identifier] = state
+	}
+	state.sketch.Add(code)
+	distinct := state.sketch.Estimate()
+	firstWarning := distinct >= warnAt && !state.warned
+	if firstWarning {
+		state.warned = true
+	}
+	return distinct, firstWarning
+}
+
+// block refuses identifier on every guarded endpoint until until and forgets its sketch
+func (g *codeProbeGuard) block(identifier string, until time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.blocked[identifier] = until
+	delete(g.states, identifier)
+}
+
+// prune drops finished windows and blocks and refreshes the gauges; g.mu must be held
+func (g *codeProbeGuard) prune(now time.Time) {
+	g.lastPrune = now
+	maxDistinct := 0
+	for identifier, state := range g.states {
+		if now.Sub(state.windowStart) > codeProbeWindow {
+			delete(g.states, identifier)
+		} else if distinct := state.sketch.Estimate(); distinct > maxDistinct {
+			maxDistinct = distinct
+		}
+	}
+	for identifier, until := range g.blocked {
+		if !now.Before(until) {
+			delete(g.blocked, identifier)
+		}
+	}
+	setGauge("code_probe_tracked_identifiers", int64(len(g.states)))
+	setGauge("code_probe_max_distinct_codes", int64(maxDistinct))
+	setGauge("code_probe_blocked_identifiers", int64(len(g.blocked)))
+}
+
+// guardCodeProbe admits a lookup of code on endpoint. It answers 429 and returns false when
+// the client is blocked or over the endpoint's limit; userID is empty for anonymous callers.
+func guardCodeProbe(w http.ResponseWriter, r *http.Request, endpoint codeProbeEndpoint, userID, code string) bool {
+	clientIP := getClientIP(r)
+	identifiers := []string{"ip:" + rateLimitSubject(clientIP)}
+	if userID != "" {
+		identifiers = append(identifiers, "user:"+userID)
+	}
+	now := time.Now()
+
+	for _, identifier := range identifiers {
+		if until := codeProbes.blockedUntil(identifier, now); !until.IsZero() {
+			incMetric("code_probe_blocked_requests_total", 1)
+			writeRateLimited(w, RateLimitResult{Limited: true, ResetAt: until})
+			return false
+		}
+	}
+
+	if endpoint.limit > 0 {
+		identifier := identifiers[len(identifiers)-1]
+		limit := checkRateLimit("code-probe:"+endpoint.name+":"+identifier, endpoint.limit, codeProbeRateWindow)
+		if limit.Limited {
+			incMetric("code_probe_rate_limited_total", 1)
+			logSecurityEvent(r.Context(), "CODE_PROBE_RATE_LIMIT_EXCEEDED", userID, clientIP, r.UserAgent(),
+				endpoint.name+" rate limit exceeded", "WARN")
+			writeRateLimited(w, limit)
+			return false
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+		// Soft warning once 80% of the window is used
+		if limit.Remaining == endpoint.limit/5 {
+			logSecurityEvent(r.Context(), "CODE_PROBE_RATE_WARNING", userID, clientIP, r.UserAgent(),
+				endpoint.name+" used 80% of its rate limit", "WARN")
+		}
+	}
+
+	distinctLimit := envInt("CODE_PROBE_DISTINCT_LIMIT", defaultCodeProbeDistinct)
+	if distinctLimit <= 0 {
+		return true
+	}
+	// Every identifier sees the code, so a user's block does not wait for their IP's or
+	// the other way round
+	var blockedUntil time.Time
+	for _, identifier := range identifiers {
+		distinct, warn := codeProbes.observe(identifier, code, distinctLimit/2, now)
+		if warn {
+			incMetric("code_probe_warnings_total", 1)
+			logSecurityEvent(r.Context(), "CODE_ENUMERATION_SUSPECTED", userID, clientIP, r.UserAgent(),
+				identifier+" queried about "+strconv.Itoa(distinct)+" distinct codes this hour", "WARN")
+		}
+		if distinct >= distinctLimit {
+			blockedUntil = now.Add(time.Duration(envInt("CODE_PROBE_BLOCK_MINUTES", defaultCodeProbeBlockMin)) * time.Minute)
+			codeProbes.block(identifier, blockedUntil)
+			incMetric("code_probe_blocks_total", 1)
+			logSecurityEvent(r.Context(), "CODE_ENUMERATION_BLOCKED", userID, clientIP, r.UserAgent(),
+				identifier+" blocked until "+blockedUntil.UTC().Format(time.RFC3339)+" after about "+
+					strconv.Itoa(distinct)+" distinct codes in an hour", "CRITICAL")
+		}
+	}
+	if !blockedUntil.IsZero() {
+		writeRateLimited(w, RateLimitResult{Limited: true, ResetAt: blockedUntil})
+		return false
+	}
+	return true
+}
+
+// delayCodeMiss sleeps for a random part of CODE_PROBE_MISS_DELAY_MS before a miss is
+// answered
+func delayCodeMiss() {
+	maxDelay := envInt("CODE_PROBE_MISS_DELAY_MS", defaultCodeProbeDelayMS)
+	if maxDelay <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(maxDelay/2+rand.Intn(maxDelay/2+1)) * time.Millisecond)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withCodeProbeGuard starts the test with no probing history
+func withCodeProbeGuard(t *testing.T) {
+	t.Helper()
+	saved := codeProbes
+	codeProbes = &codeProbeGuard{states: make(map[string]*codeProbeState), blocked: make(map[string]time.Time)}
+	t.Cleanup(func() { codeProbes = saved })
+}
+
+func TestCodeSketchEstimate(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 300, 1000, 10000} {
+		var sketch codeSketch
+		for i := 0; i < n; i++ {
+			code := fmt.Sprintf("c%05d", i)
+			sketch.Add(code)
+			sketch.Add(code) // repeats are not counted again
+		}
+		// Four standard errors of a 256-register sketch
+		if got := sketch.Estimate(); math.Abs(float64(got-n)) > 0.26*float64(n)+1 {
+			t.Errorf("%d distinct codes estimated as %d", n, got)
+		}
+	}
+	var empty codeSketch
+	if got := empty.Estimate(); got != 0 {
+		t.Errorf("empty sketch estimated as %d", got)
+	}
+}
+
+func TestCodeEnumerationBlocked(t *testing.T) {
+	withCodeProbeGuard(t)
+	t.Setenv("CODE_PROBE_DISTINCT_LIMIT", "20")
+	t.Setenv("CODE_PROBE_MISS_DELAY_MS", "0")
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	token, userID := srv.register()
+
+	// Walking through codes is refused once about 20 distinct ones were asked for
+	status, asked := http.StatusOK, 0
+	for asked < 40 && status == http.StatusOK {
+		asked++
+		resp := srv.do("POST", "/url/preview", token, map[string]interface{}{
+			"long-url": "https://example.com/walk", "custom": fmt.Sprintf("walk-%03d", asked),
+		}, nil)
+		status = resp.StatusCode
+		if status == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Fatal("block without Retry-After")
+		}
+	}
+	if status != http.StatusTooManyRequests || asked < 16 || asked > 26 {
+		t.Fatalf("status %d after %d distinct codes", status, asked)
+	}
+	if !logs.waitFor("CODE_ENUMERATION_SUSPECTED") || !logs.waitFor("CODE_ENUMERATION_BLOCKED") {
+		t.Fatalf("enumeration not logged:\n%s", logs)
+	}
+	for _, identifier := range []string{"ip:127.0.0.1", "user:" + userID} {
+		if codeProbes.blockedUntil(identifier, time.Now()).IsZero() {
+			t.Fatalf("%s not blocked", identifier)
+		}
+	}
+	// Repeating a code already asked about is refused too, for the rest of the block
+	if resp := srv.do("POST", "/url/preview", token, map[string]interface{}{"long-url": "https://example.com/walk", "custom": "walk-001"}, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("blocked client: status %d", resp.StatusCode)
+	}
+
+	// The block covers every guarded endpoint, for the user and the IP alike
+	for _, caller := range []struct{ remoteAddr, userID string }{{"198.51.100.1:1000", userID}, {"127.0.0.1:1000", ""}} {
+		req := httptest.NewRequest("GET", "/rapidlink-demo/abc/stats", nil)
+		req.RemoteAddr = caller.remoteAddr
+		rec := httptest.NewRecorder()
+		if guardCodeProbe(rec, req, probeDemoStats, caller.userID, "walk-001") || rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("demo stats for %+v: admitted, status %d", caller, rec.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/rapidlink-demo/abc/stats", nil)
+	req.RemoteAddr = "198.51.100.1:1000"
+	if !guardCodeProbe(httptest.NewRecorder(), req, probeDemoStats, "", "walk-001") {
+		t.Fatal("an unrelated client was blocked")
+	}
+	// The block ends by itself
+	if until := codeProbes.blockedUntil("user:"+userID, time.Now().Add(61*time.Minute)); !until.IsZero() {
+		t.Fatalf("still blocked until %s after an hour", until)
+	}
+}
+
+func TestCodeProbeRateLimit(t *testing.T) {
+	withCodeProbeGuard(t)
+	t.Setenv("CODE_PROBE_MISS_DELAY_MS", "0")
+	logs := captureLog(t)
+	newTestServer(t)
+
+	probe := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/rapidlink-demo/same/stats", nil)
+		req.RemoteAddr = "203.0.113.9:4000"
+		rec := httptest.NewRecorder()
+		guardCodeProbe(rec, req, probeDemoStats, "", "same")
+		return rec
+	}
+	for i := 1; i <= probeDemoStats.limit; i++ {
+		if rec := probe(); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "30" {
+			t.Fatalf("request %d: status %d, X-RateLimit-Limit %q", i, rec.Code, rec.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+	if !logs.waitFor("CODE_PROBE_RATE_WARNING") {
+		t.Fatal("no warning at 80% of the limit")
+	}
+	if rec := probe(); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: status %d", rec.Code)
+	}
+}
+
+func TestDelayCodeMiss(t *testing.T) {
+	t.Setenv("CODE_PROBE_MISS_DELAY_MS", "40")
+	start := time.Now()
+	delayCodeMiss()
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("miss answered after %v, want at least half of 40ms", elapsed)
+	}
+	t.Setenv("CODE_PROBE_MISS_DELAY_MS", "0")
+	start = time.Now()
+	delayCodeMiss()
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("disabled delay took %v", elapsed)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// SHORT CODE RESERVATIONS
+// ============================================================================
+//
+// On MongoDB every short code in use is recorded in the codes collection, keyed by the code
+// itself, with the kind of owner holding it (a link, a draft, a demo link or a reserved
+// word) and a reference to the owning document. Creation paths reserve the code before
+// inserting the owner and release it when the owner is purged, so the _id index is the one
+// place that answers "is this code taken" across urls and demo_urls. Demo reservations carry
+// the demo link's expires_at and expire with it through a TTL index. Redirects never read
+// this collection; they still look codes up in urls and demo_urls.
+//
+// The SQL and in-memory stores keep all codes in one links table, whose primary key already
+// does this job, so they derive the holder from the link instead.
+
+// Owner types of a code reservation
+const (
+	CodeOwnerLink     = "link"
+	CodeOwnerDraft    = "draft"
+	CodeOwnerDemo     = "demo"
+	CodeOwnerReserved = "reserved"
+)
+
+// CodeReservation records who holds a short code
+type CodeReservation struct {
+	Code      string     `bson:"_id" json:"code"`
+	OwnerType string     `bson:"owner_type" json:"owner_type"`
+	Ref       string     `bson:"ref,omitempty" json:"ref,omitempty"`
+	UserID    string     `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// linkCodeReservation returns the reservation held by link, which must have its ID set
+func linkCodeReservation(link *URLData) *CodeReservation {
+	ownerType := CodeOwnerLink
+	if link.DeactivatedReason == DeactivatedDraft {
+		ownerType = CodeOwnerDraft
+	}
+	return &CodeReservation{
+		Code:      link.ShortURL,
+		OwnerType: ownerType,
+		Ref:       link.ID.Hex(),
+		UserID:    link.UserID,
+		CreatedAt: link.CreatedAt,
+	}
+}
+
+// codeOwnerCollections maps owner types to the collection holding their documents
+var codeOwnerCollections = map[string]string{
+	CodeOwnerLink:  "urls",
+	CodeOwnerDraft: "urls",
+	CodeOwnerDemo:  "demo_urls",
+}
+
+// reserveCode records reservation in db's codes collection; ErrDuplicate when the code is
+// held. A reservation whose owner document no longer exists, left behind by a crash between
+// reserving and inserting, is taken over.
+func reserveCode(ctx context.Context, db *mongo.Database, reservation *CodeReservation) error {
+	codes := db.Collection("codes")
+	_, err := codes.InsertOne(ctx, reservation)
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	var holder CodeReservation
+	if err := codes.FindOne(ctx, bson.D{{Key: "_id", Value: reservation.Code}}).Decode(&holder); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrDuplicate // released meanwhile; the caller picks another code anyway
+		}
+		return err
+	}
+	ownerColl, ok := codeOwnerCollections[holder.OwnerType]
+	ref, refErr := primitive.ObjectIDFromHex(holder.Ref)
+	if !ok || refErr != nil {
+		return ErrDuplicate
+	}
+	n, err := db.Collection(ownerColl).CountDocuments(ctx, bson.D{{Key: "_id", Value: ref}}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicate
+	}
+	res, err := codes.ReplaceOne(ctx, bson.D{
+		{Key: "_id", Value: holder.Code},
+		{Key: "ref", Value: holder.Ref},
+	}, reservation)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrDuplicate
+	}
+	log.Printf("Took over orphaned %s reservation of code %s", holder.OwnerType, holder.Code)
+	return nil
+}
+
+// releaseCode deletes the reservation of code, provided it is still held by ref
+func releaseCode(ctx context.Context, db *mongo.Database, code, ref string) error {
+	_, err := db.Collection("codes").DeleteOne(ctx, bson.D{
+		{Key: "_id", Value: code},
+		{Key: "ref", Value: ref},
+	})
+	return err
+}
+
+// findCodeReservation returns the reservation of code in db; ErrNotFound when it is free
+func findCodeReservation(ctx context.Context, db *mongo.Database, code string) (*CodeReservation, error) {
+	var reservation CodeReservation
+	err := db.Collection("codes").FindOne(ctx, bson.D{{Key: "_id", Value: code}}).Decode(&reservation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// linkCodeHolder derives the holder of code for stores whose links table is the only owner
+func linkCodeHolder(ctx context.Context, urls URLStore, code string) (*CodeReservation, error) {
+	if isReservedCode(code) {
+		return &CodeReservation{Code: code, OwnerType: CodeOwnerReserved}, nil
+	}
+	link, err := urls.FindLinkByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return linkCodeReservation(link), nil
+}
+
+// EnsureReservedCodes reserves every entry of ReservedShortCodes, so the codes collection
+// also refuses words added to the list since the last start. Words already held by a link
+// stay with it.
+func EnsureReservedCodes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := clock.Now()
+	models := make([]mongo.WriteModel, 0, len(ReservedShortCodes))
+	for _, word := range ReservedShortCodes {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: word}}).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: bson.D{
+				{Key: "owner_type", Value: CodeOwnerReserved},
+				{Key: "created_at", Value: now},
+			}}}).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	if _, err := DB.Database.Collection("codes").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return fmt.Errorf("failed to reserve reserved short codes: %v", err)
+	}
+	return nil
+}
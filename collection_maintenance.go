@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// COLLECTION MAINTENANCE
+// ============================================================================
+//
+// Auxiliary collections grow with traffic, so each one has a retention policy and the cleanup
+// worker prunes them after expiring links. Collections whose documents all age the same way
+// are pruned by a MongoDB TTL index; maintenance only keeps the index's expiry in line with
+// the policy. The others are pruned in batches of maintenanceBatchSize, pausing between
+// batches so a large backlog doesn't starve the primary. A policy can also cap a collection
+// at max_documents, dropping the oldest first, and a filter limits pruning to documents that
+// are done with (closed abuse reports). Ages run from the document's _id, which is indexed,
+// unless the policy names a time field.
+//
+// Policies are overridden in CONFIG_FILE, e.g.
+//
+//	"retention": {"security_events": {"max_age": "1y"}, "clicks_outbox": {"max_documents": 200000}}
+//
+// where "keep" as max_age turns age pruning off. POST /admin/maintenance/{collection} runs one
+// collection's maintenance on demand. Each run counts maintenance_<collection>_deleted_total
+// and sets maintenance_<collection>_duration_ms.
+
+const (
+	maintenanceBatchSize  = 500
+	maintenanceBatchPause = 100 * time.Millisecond
+	// maintenanceKeep turns age pruning off in a retention override
+	maintenanceKeep = "keep"
+)
+
+// retentionPolicy is how long one collection keeps its documents
+type retentionPolicy struct {
+	Collection string
+	// TTLIndex names the TTL index pruning the collection; MaxAge sets its expiry
+	TTLIndex string
+	// MaxAge is nil when documents are kept regardless of age
+	MaxAge *LinkDuration
+	// MaxDocuments caps the collection, oldest first; 0 is no cap
+	MaxDocuments int64
+	// AgeField is the time field documents age by; "" uses the _id timestamp
+	AgeField string
+	// Filter restricts pruning to the documents it matches
+	Filter bson.D
+}
+
+// defaultRetentionPolicies apply unless CONFIG_FILE overrides them. Security events and bulk
+// sources are kept until an operator chooses a retention.
+var defaultRetentionPolicies = []retentionPolicy{
+	// Events the click sink could not take for a month are dropped, as is the oldest backlog
+	// beyond a million events
+	{Collection: "clicks_outbox", MaxAge: &LinkDuration{Days: 30}, MaxDocuments: 1_000_000},
+	{Collection: "api_usage", TTLIndex: "day_ttl_idx", MaxAge: &LinkDuration{Days: usageRetentionDays}},
+	{Collection: "link_outcomes", TTLIndex: "day_ttl_idx", MaxAge: &LinkDuration{Days: outcomeRetentionDays}},
+	{Collection: "abuse_reports", MaxAge: &LinkDuration{Years: 1}, AgeField: "resolved_at",
+		Filter: bson.D{{Key: "status", Value: bson.D{{Key: "$ne", Value: AbuseReportOpen}}}}},
+	{Collection: "security_events"},
+	{Collection: "bulk_sources", AgeField: "last_synced_at"},
+}
+
+// retentionOverride is one collection's entry under "retention" in CONFIG_FILE
+type retentionOverride struct {
+	MaxAge       string `json:"max_age"`
+	MaxDocuments *int64 `json:"max_documents"`
+}
+
+// parseRetentionPolicies applies the overrides to the default policies
+func parseRetentionPolicies(overrides map[string]retentionOverride) ([]retentionPolicy, error) {
+	policies := append([]retentionPolicy(nil), defaultRetentionPolicies...)
+	byName := make(map[string]*retentionPolicy, len(policies))
+	for i := range policies {
+		byName[policies[i].Collection] = &policies[i]
+	}
+	for name, override := range overrides {
+		policy, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("retention: unknown collection %q", name)
+		}
+		switch override.MaxAge {
+		case "":
+		case maintenanceKeep:
+			if policy.TTLIndex != "" {
+				return nil, fmt.Errorf("retention.%s: a TTL collection needs a max_age", name)
+			}
+			policy.MaxAge = nil
+		default:
+			age, err := parseLinkDuration(override.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("retention.%s.max_age: %v", name, err)
+			}
+			policy.MaxAge = &age
+		}
+		if override.MaxDocuments != nil {
+			if *override.MaxDocuments < 0 || (policy.TTLIndex != "" && *override.MaxDocuments > 0) {
+				return nil, fmt.Errorf("retention.%s.max_documents must be 0 or more, and 0 for a TTL collection", name)
+			}
+			policy.MaxDocuments = *override.MaxDocuments
+		}
+	}
+	return policies, nil
+}
+
+// retentionPolicies returns the policies of cfg
+func retentionPolicies(cfg *runtimeConfig) []retentionPolicy {
+	if cfg.retention == nil {
+		return defaultRetentionPolicies
+	}
+	return cfg.retention
+}
+
+// findRetentionPolicy returns the policy of collection in cfg
+func findRetentionPolicy(cfg *runtimeConfig, collection string) (retentionPolicy, bool) {
+	for _, policy := range retentionPolicies(cfg) {
+		if policy.Collection == collection {
+			return policy, true
+		}
+	}
+	return retentionPolicy{}, false
+}
+
+// runMaintenance applies every policy of cfg, going on after a failing collection
+func runMaintenance(ctx context.Context, db *mongo.Database, cfg *runtimeConfig) (map[string]int64, error) {
+	counts := map[string]int64{}
+	var firstErr error
+	for _, policy := range retentionPolicies(cfg) {
+		deleted, err := maintainCollection(ctx, db, policy, clock.Now())
+		counts[policy.Collection+"_deleted"] = deleted
+		if err != nil {
+			log.Printf("Error maintaining %s: %v", policy.Collection, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", policy.Collection, err)
+			}
+		}
+	}
+	return counts, firstErr
+}
+
+// maintainCollection applies policy at now and returns how many documents it deleted; with
+// a TTL index that is 0, the index deleting on its own schedule
+func maintainCollection(ctx context.Context, db *mongo.Database, policy retentionPolicy, now time.Time) (int64, error) {
+	startedAt := time.Now()
+	defer func() {
+		setGauge("maintenance_"+policy.Collection+"_duration_ms", time.Since(startedAt).Milliseconds())
+	}()
+	coll := db.Collection(policy.Collection)
+	if policy.Filter == nil {
+		policy.Filter = bson.D{}
+	}
+
+	if policy.TTLIndex != "" {
+		seconds := int64(policy.MaxAge.AddTo(now).Sub(now).Seconds())
+		// collMod with the current expiry changes nothing
+		return 0, db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: policy.Collection},
+			{Key: "index", Value: bson.D{{Key: "name", Value: policy.TTLIndex}, {Key: "expireAfterSeconds", Value: seconds}}},
+		}).Err()
+	}
+
+	var deleted int64
+	if policy.MaxAge != nil {
+		cutoff := now.AddDate(-policy.MaxAge.Years, -policy.MaxAge.Months, -policy.MaxAge.Days)
+		filter := append(bson.D{}, policy.Filter...)
+		if policy.AgeField == "" {
+			filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$lt", Value: primitive.NewObjectIDFromTimestamp(cutoff)}}})
+		} else {
+			filter = append(filter, bson.E{Key: policy.AgeField, Value: bson.D{{Key: "$lt", Value: cutoff}}})
+		}
+		n, err := deleteInBatches(ctx, coll, filter, -1)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	if policy.MaxDocuments > 0 {
+		total, err := coll.CountDocuments(ctx, policy.Filter)
+		if err != nil {
+			return deleted, err
+		}
+		if excess := total - policy.MaxDocuments; excess > 0 {
+			n, err := deleteInBatches(ctx, coll, policy.Filter, excess)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if deleted > 0 {
+		incMetric("maintenance_"+policy.Collection+"_deleted_total", deleted)
+		log.Printf("🧹 Maintenance deleted %d documents from %s", deleted, policy.Collection)
+	}
+	return deleted, nil
+}
+
+// deleteInBatches deletes the documents matching filter oldest first, at most limit of them
+// (all for a negative limit)
+func deleteInBatches(ctx context.Context, coll *mongo.Collection, filter bson.D, limit int64) (int64, error) {
+	var deleted int64
+	for limit < 0 || deleted < limit {
+		batch := int64(maintenanceBatchSize)
+		if limit >= 0 && limit-deleted < batch {
+			batch = limit - deleted
+		}
+		cursor, err := coll.Find(ctx, filter, options.Find().
+			SetProjection(bson.D{{Key: "_id", Value: 1}}).
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(batch))
+		if err != nil {
+			return deleted, err
+		}
+		var docs []struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &docs); err != nil {
+			return deleted, err
+		}
+		if len(docs) == 0 {
+			return deleted, nil
+		}
+		ids := make(bson.A, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc.ID
+		}
+		res, err := coll.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += res.DeletedCount
+		if int64(len(docs)) < batch {
+			return deleted, nil
+		}
+		select {
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		case <-time.After(maintenanceBatchPause):
+		}
+	}
+	return deleted, nil
+}
+
+// adminRunMaintenance handles POST /admin/maintenance/{collection}
+func adminRunMaintenance(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+	policy, ok := findRetentionPolicy(requestConfig(r), collection)
+	if !ok {
+		names := make([]string, 0, len(defaultRetentionPolicies))
+		for _, p := range defaultRetentionPolicies {
+			names = append(names, p.Collection)
+		}
+		sort.Strings(names)
+		http.Error(w, "No retention policy for "+collection+"; known: "+strings.Join(names, ", "), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), workerLeaseTTL)
+	defer cancel()
+	lockName := "maintenance:" + collection
+	acquired, err := acquireLease(ctx, lockName, InstanceID, workerLeaseTTL)
+	if err != nil {
+		log.Printf("error acquiring %s lease: %v", lockName, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !acquired {
+		http.Error(w, "Maintenance of "+collection+" is already running", http.StatusConflict)
+		return
+	}
+	deleted, runErr := maintainCollection(ctx, DB.Database, policy, clock.Now())
+	if err := releaseLease(context.Background(), lockName, InstanceID); err != nil {
+		log.Printf("Warning: failed to release %s lease: %v", lockName, err)
+	}
+	userID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "MAINTENANCE_RUN", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Maintenance of %s deleted %d documents", collection, deleted), "INFO")
+	if runErr != nil {
+		log.Printf("error running maintenance of %s: %v", collection, runErr)
+		http.Error(w, "maintenance failed after deleting "+fmt.Sprint(deleted)+" documents", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":       true,
+		"collection":    collection,
+		"deleted":       deleted,
+		"ttl_index":     policy.TTLIndex,
+		"max_documents": policy.MaxDocuments,
+		"max_age":       maintenanceKeep,
+	}
+	if policy.MaxAge != nil {
+		response["max_age"] = formatLinkDuration(*policy.MaxAge)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding maintenance response: %v", err)
+	}
+}
+
+// formatLinkDuration writes d the way parseLinkDuration reads it
+func formatLinkDuration(d LinkDuration) string {
+	switch {
+	case d.Years > 0 && d.Months == 0 && d.Days == 0:
+		return fmt.Sprintf("%dy", d.Years)
+	case d.Months > 0 && d.Years == 0 && d.Days == 0:
+		return fmt.Sprintf("%dm", d.Months)
+	}
+	return fmt.Sprintf("%dd", d.Days)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	count := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name      string
+		overrides map[string]retentionOverride
+		valid     bool
+		check     func(map[string]retentionPolicy) bool
+	}{
+		{"defaults", nil, true, func(p map[string]retentionPolicy) bool {
+			return p["security_events"].MaxAge == nil && p["clicks_outbox"].MaxDocuments == 1_000_000 && p["abuse_reports"].MaxAge.Years == 1
+		}},
+		{"age and cap", map[string]retentionOverride{"security_events": {MaxAge: "1y"}, "clicks_outbox": {MaxDocuments: count(200000)}}, true, func(p map[string]retentionPolicy) bool {
+			return p["security_events"].MaxAge.Years == 1 && p["clicks_outbox"].MaxDocuments == 200000 && p["clicks_outbox"].MaxAge.Days == 30
+		}},
+		{"keep", map[string]retentionOverride{"abuse_reports": {MaxAge: "keep"}}, true, func(p map[string]retentionPolicy) bool {
+			return p["abuse_reports"].MaxAge == nil && p["abuse_reports"].Filter != nil
+		}},
+		{"TTL expiry", map[string]retentionOverride{"api_usage": {MaxAge: "30d"}}, true, func(p map[string]retentionPolicy) bool {
+			return p["api_usage"].MaxAge.Days == 30 && p["api_usage"].TTLIndex == "day_ttl_idx"
+		}},
+		{"unknown collection", map[string]retentionOverride{"urls": {MaxAge: "1y"}}, false, nil},
+		{"bad age", map[string]retentionOverride{"security_events": {MaxAge: "forever"}}, false, nil},
+		{"negative cap", map[string]retentionOverride{"clicks_outbox": {MaxDocuments: count(-1)}}, false, nil},
+		{"TTL kept forever", map[string]retentionOverride{"api_usage": {MaxAge: "keep"}}, false, nil},
+		{"TTL capped", map[string]retentionOverride{"link_outcomes": {MaxDocuments: count(10)}}, false, nil},
+	}
+	for _, tt := range tests {
+		policies, err := parseRetentionPolicies(tt.overrides)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		byName := map[string]retentionPolicy{}
+		for _, policy := range policies {
+			byName[policy.Collection] = policy
+		}
+		if len(byName) != len(defaultRetentionPolicies) || !tt.check(byName) {
+			t.Errorf("%s: policies %+v", tt.name, policies)
+		}
+	}
+	// Overrides never change the defaults they start from
+	if defaultRetentionPolicies[0].MaxDocuments != 1_000_000 {
+		t.Errorf("default clicks_outbox policy changed: %+v", defaultRetentionPolicies[0])
+	}
+}
+
+func TestFormatLinkDuration(t *testing.T) {
+	for _, in := range []string{"30d", "6m", "1y", "14d"} {
+		d, err := parseLinkDuration(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatLinkDuration(d); got != in {
+			t.Errorf("formatLinkDuration(%s) = %s", in, got)
+		}
+	}
+}
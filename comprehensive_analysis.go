@@ -367,7 +367,7 @@ func testMixedOperations(baseURL, token string) {
 				if len(shortCodes) > 0 {
 					code := shortCodes[index%len(shortCodes)]
 					client := &http.Client{Timeout: 5 * time.Second}
-					client.Get(baseURL + "/" + code)
+					client.Get(baseURL + shortCodePath(code))
 				}
 			case "analytics":
 				req, _ := http.NewRequest("GET", baseURL+"/analytics", nil)
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// SELECTIVE RESPONSE COMPRESSION
+// ============================================================================
+//
+// Replaces the blanket handlers.CompressHandler. Redirects (empty 301/302 bodies) are never
+// wrapped, bodies under compressMinSize are sent as is because the gzip framing outweighs
+// the savings, and event streams are never compressed since buffering proxies break them.
+// Brotli is preferred over gzip when the client accepts both.
+
+// compressMinSize is the smallest body worth compressing
+const compressMinSize = 1024
+
+// responseEncoder is a Content-Encoding the middleware can produce, in preference order
+type responseEncoder struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+	release   func(wc io.WriteCloser)
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return gz
+}}
+
+// brotliLevel trades ratio for speed the way dynamic responses need; 11 is for static assets
+const brotliLevel = 5
+
+var brotliWriters = sync.Pool{New: func() interface{} {
+	return brotli.NewWriterLevel(io.Discard, brotliLevel)
+}}
+
+var responseEncoders = []responseEncoder{
+	{
+		name: "br",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			br := brotliWriters.Get().(*brotli.Writer)
+			br.Reset(w)
+			return br
+		},
+		release: func(wc io.WriteCloser) { brotliWriters.Put(wc) },
+	},
+	{
+		name: "gzip",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(w)
+			return gz
+		},
+		release: func(wc io.WriteCloser) { gzipWriters.Put(wc) },
+	},
+}
+
+// compressibleTypes are the media types worth compressing; everything else (images,
+// archives, event streams) is sent as is
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-ndjson":   true,
+	"image/svg+xml":          true,
+}
+
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// negotiateEncoder picks the first responseEncoder the Accept-Encoding header allows (q > 0)
+func negotiateEncoder(acceptEncoding string) *responseEncoder {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for i := range responseEncoders {
+		if ok, listed := accepted[responseEncoders[i].name]; ok || (!listed && accepted["*"]) {
+			return &responseEncoders[i]
+		}
+	}
+	return nil
+}
+
+// compressionMiddleware compresses eligible responses; it runs as router middleware so the
+// redirect catch-all can be skipped by route name
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == redirectRouteName {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The representation depends on Accept-Encoding whether or not this one is compressed
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoder := negotiateEncoder(r.Header.Get("Accept-Encoding"))
+		if encoder == nil || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoder: encoder}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers up to compressMinSize bytes before deciding whether to compress
+type compressWriter struct {
+	http.ResponseWriter
+	encoder *responseEncoder
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// Informational, bodiless and already-encoded responses are passed through untouched
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		cw.Header().Get("Content-Encoding") != "" ||
+		strings.HasPrefix(cw.Header().Get("Content-Type"), "text/event-stream") {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMinSize {
+		cw.decide(true)
+	}
+	return len(p), nil
+}
+
+// decide sends the headers and buffered body, compressing when allowed and worthwhile
+func (cw *compressWriter) decide(allowed bool) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if allowed && len(cw.buf) >= compressMinSize && isCompressibleType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoder.name)
+		header.Del("Content-Length")
+		cw.enc = cw.encoder.newWriter(cw.ResponseWriter)
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Write(cw.buf)
+	} else {
+		cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+}
+
+// Flush sends what is buffered; an undecided response too small to compress goes out as is
+func (cw *compressWriter) Flush() {
+	cw.decide(true)
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response; handlers that never wrote still get their status sent
+func (cw *compressWriter) Close() {
+	if cw.status == 0 && !cw.decided {
+		// Nothing written: let net/http send its implicit 200
+		return
+	}
+	cw.decide(true)
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.encoder.release(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend a write deadline
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response does not support hijacking")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// COMPRESSION BENCHMARK (CLI: bench-compression)
+// ============================================================================
+
+const benchCompressionIterations = 100000
+
+// runCompressionBenchmark times the redirect path behind the old blanket CompressHandler and
+// behind compressionMiddleware, then checks that event streams and small JSON bodies are
+// sent uncompressed while large JSON still is. Runs in process; no database is needed.
+func runCompressionBenchmark() error {
+	redirectHandler := func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/destination", http.StatusMovedPermanently)
+	}
+	blanket := mux.NewRouter()
+	blanket.PathPrefix("/").HandlerFunc(redirectHandler).Methods("GET").Name(redirectRouteName)
+	selective := mux.NewRouter()
+	selective.Use(compressionMiddleware)
+	selective.PathPrefix("/").HandlerFunc(redirectHandler).Methods("GET").Name(redirectRouteName)
+
+	before := timeCompressionHandler(handlers.CompressHandler(blanket), "/aQ8YHAC1ZU")
+	after := timeCompressionHandler(selective, "/aQ8YHAC1ZU")
+	log.Printf("⏱️  redirect behind CompressHandler: avg %v over %d requests", before, benchCompressionIterations)
+	log.Printf("⏱️  redirect behind compressionMiddleware: avg %v over %d requests", after, benchCompressionIterations)
+
+	checks := mux.NewRouter()
+	checks.Use(compressionMiddleware)
+	checks.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "data: %s\n\n", strings.Repeat("x", 64))
+			w.(http.Flusher).Flush()
+		}
+	})
+	checks.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true}`))
+	})
+	checks.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":"` + strings.Repeat("x", 4*compressMinSize) + `"}`))
+	})
+
+	for path, want := range map[string]string{"/events": "", "/small": "", "/large": "br"} {
+		rec := serveCompressionRequest(checks, path)
+		if got := rec.Header().Get("Content-Encoding"); got != want {
+			return fmt.Errorf("%s: Content-Encoding %q, want %q", path, got, want)
+		}
+		if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+			return fmt.Errorf("%s: missing Vary: Accept-Encoding", path)
+		}
+	}
+	log.Println("✅ Event streams and small JSON are sent uncompressed, large JSON is brotli-compressed")
+	return nil
+}
+
+func serveCompressionRequest(h http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// timeCompressionHandler returns the average latency of benchCompressionIterations requests
+func timeCompressionHandler(h http.Handler, path string) time.Duration {
+	start := time.Now()
+	for i := 0; i < benchCompressionIterations; i++ {
+		serveCompressionRequest(h, path)
+	}
+	return time.Since(start) / benchCompressionIterations
+}
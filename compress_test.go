@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// compressionTestRouter serves a redirect catch-all, an event stream and JSON bodies of
+// either side of compressMinSize behind compressionMiddleware
+func compressionTestRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(compressionMiddleware)
+	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "data: %s\n\n", strings.Repeat("x", 64))
+			w.(http.Flusher).Flush()
+		}
+	})
+	r.HandleFunc("/events-late-type", func(w http.ResponseWriter, r *http.Request) {
+		// Content type set with parameters; still an event stream
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "data: "+strings.Repeat("x", 4*compressMinSize)+"\n\n")
+	})
+	r.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true}`))
+	})
+	r.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":"` + strings.Repeat("x", 4*compressMinSize) + `"}`))
+	})
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/destination", http.StatusMovedPermanently)
+	}).Methods("GET").Name(redirectRouteName)
+	return r
+}
+
+func serveWithEncoding(h http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressionNeverCompressesEventStreams(t *testing.T) {
+	router := compressionTestRouter()
+	for _, path := range []string{"/events", "/events-late-type"} {
+		for _, accept := range []string{"gzip", "br", "gzip, deflate, br", "*"} {
+			rec := serveWithEncoding(router, path, accept)
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("%s with Accept-Encoding %q: Content-Encoding %q", path, accept, got)
+			}
+			if !strings.HasPrefix(rec.Body.String(), "data: ") {
+				t.Errorf("%s with Accept-Encoding %q: body is not a plain event stream", path, accept)
+			}
+		}
+	}
+}
+
+func TestCompressionSelection(t *testing.T) {
+	router := compressionTestRouter()
+	tests := []struct {
+		path, accept, want string
+	}{
+		{"/large", "gzip, deflate, br", "br"},
+		{"/large", "br;q=0, gzip", "gzip"},
+		{"/large", "gzip", "gzip"},
+		{"/large", "*", "br"},
+		{"/large", "identity", ""},
+		{"/large", "", ""},
+		{"/small", "gzip, br", ""},
+		{"/aQ8YHAC1ZU", "gzip, br", ""},
+	}
+	for _, tt := range tests {
+		rec := serveWithEncoding(router, tt.path, tt.accept)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%s with Accept-Encoding %q: Content-Encoding %q, want %q", tt.path, tt.accept, got, tt.want)
+		}
+		if tt.path == "/aQ8YHAC1ZU" {
+			if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Vary") != "" {
+				t.Errorf("redirect: status %d, Vary %q; want an untouched 301", rec.Code, rec.Header().Get("Vary"))
+			}
+		} else if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%s: missing Vary: Accept-Encoding", tt.path)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	router := compressionTestRouter()
+	want := serveWithEncoding(router, "/large", "").Body.Bytes()
+	for _, encoding := range []string{"br", "gzip"} {
+		rec := serveWithEncoding(router, "/large", encoding)
+		var body io.Reader = rec.Body
+		if encoding == "br" {
+			body = brotli.NewReader(rec.Body)
+		} else {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded body differs from the uncompressed one", encoding)
+		}
+	}
+}
+
+// benchmarkRedirect serves the redirect catch-all through h
+func benchmarkRedirect(b *testing.B, h http.Handler) {
+	req := httptest.NewRequest(http.MethodGet, "/aQ8YHAC1ZU", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func redirectOnlyRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/destination", http.StatusMovedPermanently)
+	}).Methods("GET").Name(redirectRouteName)
+	return r
+}
+
+func BenchmarkRedirectBlanketCompression(b *testing.B) {
+	benchmarkRedirect(b, handlers.CompressHandler(redirectOnlyRouter()))
+}
+
+func BenchmarkRedirectSelectiveCompression(b *testing.B) {
+	r := redirectOnlyRouter()
+	r.Use(compressionMiddleware)
+	benchmarkRedirect(b, r)
+}
@@ -11,6 +11,13 @@ const (
 	DefaultTokenTTL   = 24 * 60 * 60     // 24 hours in seconds
 	RefreshTokenTTL   = 7 * 24 * 60 * 60 // 7 days in seconds
 	MaxBulkUploadSize = 10 * 1024 * 1024 // 10MB
+
+	// Tags
+	MaxTagsPerLink = 20
+	MaxTagLength   = 40 // characters
+
+	// Referrer restrictions
+	MaxAllowedReferrers = 20
 )
 
 var (
@@ -20,6 +27,26 @@ var (
 		"http://rapidlink.com",
 	}
 
+	// Reserved short codes that collide with routes or well-known files
+	ReservedShortCodes = []string{
+		"url",
+		"analytics",
+		"auth",
+		"bulk",
+		"api",
+		"rapidlink-demo",
+		"admin",
+		"health",
+		"metrics",
+		"favicon.ico",
+		"robots.txt",
+		"report",
+		"static",
+		"branding",
+		"folders",
+		"public",
+	}
+
 	// Default tags for new links
 	DefaultTags = []string{
 		"Education",
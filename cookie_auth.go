@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// COOKIE SESSIONS
+// ============================================================================
+//
+// With COOKIE_AUTH=true, login, registration and refresh also set the access token as an
+// HttpOnly access_token cookie, and JWTMiddleware uses that cookie when a request has no
+// Authorization header. Browsers send cookies on their own, so a cookie-authenticated
+// request that changes state (anything but GET, HEAD and OPTIONS) must also echo the
+// csrf_token cookie in an X-CSRF-Token header (double-submit). The CSRF token is readable by
+// the page and returned as csrf_token by login. Requests with an Authorization header are
+// untouched, and with the mode off no access or CSRF cookie is ever set or read.
+// POST /auth/logout revokes the refresh token and clears all session cookies in either mode.
+
+const (
+	accessTokenCookie = "access_token"
+	csrfTokenCookie   = "csrf_token"
+	csrfTokenHeader   = "X-CSRF-Token"
+)
+
+var cookieAuthEnabled bool
+
+// InitCookieAuth reads COOKIE_AUTH
+func InitCookieAuth() error {
+	raw := os.Getenv("COOKIE_AUTH")
+	if raw == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return fmt.Errorf("COOKIE_AUTH must be true or false")
+	}
+	cookieAuthEnabled = enabled
+	if enabled {
+		log.Println("🍪 Cookie sessions enabled (access_token cookie with double-submit CSRF token)")
+	}
+	return nil
+}
+
+// newCSRFToken returns a random token for the csrf_token cookie
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setSessionCookies sets the access token cookie, and a CSRF token unless the request already
+// carries one, when cookie sessions are enabled. It returns the CSRF token in effect, or ""
+// when the mode is off.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, token string, expiresAt time.Time) (string, error) {
+	if !cookieAuthEnabled {
+		return "", nil
+	}
+	csrf := ""
+	if cookie, err := r.Cookie(csrfTokenCookie); err == nil && len(cookie.Value) == 64 {
+		csrf = cookie.Value
+	} else {
+		var err error
+		if csrf, err = newCSRFToken(); err != nil {
+			return "", err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessTokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Readable by the page, which copies it into the X-CSRF-Token header
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfTokenCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  time.Now().Add(7 * 24 * time.Hour),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrf, nil
+}
+
+// clearSessionCookies expires the refresh, access and CSRF cookies
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"refresh_token", accessTokenCookie, csrfTokenCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+			HttpOnly: name != csrfTokenCookie,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// cookieAccessToken returns the access token cookie of r when cookie sessions are enabled
+func cookieAccessToken(r *http.Request) (string, bool) {
+	if !cookieAuthEnabled {
+		return "", false
+	}
+	cookie, err := r.Cookie(accessTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// validCSRF reports whether a cookie-authenticated request may proceed: safe methods always
+// may, others only with an X-CSRF-Token header matching the csrf_token cookie
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := r.Cookie(csrfTokenCookie)
+	header := r.Header.Get(csrfTokenHeader)
+	if err != nil || cookie.Value == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// logout handles POST /auth/logout: revokes the refresh token of the refresh cookie, if any,
+// and clears the session cookies
+func logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("refresh_token"); err == nil && cookie.Value != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if user, err := Users.FindUserByRefreshToken(ctx, HashRefreshToken(cookie.Value)); err == nil {
+			if err := ClearRefreshToken(user.ID.Hex()); err != nil {
+				log.Printf("error clearing refresh token on logout: %v", err)
+			}
+			logSecurityEvent(r.Context(), "USER_LOGOUT", user.ID.Hex(), getClientIP(r), r.UserAgent(),
+				"User logged out", "INFO")
+		}
+	}
+	clearSessionCookies(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Logged out",
+	}); err != nil {
+		log.Printf("error encoding logout response: %v", err)
+	}
+}
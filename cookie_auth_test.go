@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// withCookieAuth sets COOKIE_AUTH for the duration of a test
+func withCookieAuth(t *testing.T, enabled bool) {
+	t.Helper()
+	saved := cookieAuthEnabled
+	cookieAuthEnabled = enabled
+	t.Cleanup(func() { cookieAuthEnabled = saved })
+}
+
+// responseCookie returns the cookie name set by resp, or nil
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// cookieSession logs in a new account and returns its session cookies and CSRF token
+func cookieSession(t *testing.T, srv *testServer, username string) (access, csrf *http.Cookie, csrfToken string) {
+	t.Helper()
+	var auth struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	srv.do("POST", "/auth/register", "", map[string]string{
+		"username": username, "email": username + "@example.com", "password": "correct-horse-1",
+	}, nil)
+	resp := srv.do("POST", "/auth/login", "", map[string]string{"username_or_email": username, "password": "correct-horse-1"}, &auth)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	return responseCookie(resp, accessTokenCookie), responseCookie(resp, csrfTokenCookie), auth.CSRFToken
+}
+
+func TestCookieSessions(t *testing.T) {
+	withCookieAuth(t, true)
+	srv := newTestServer(t)
+	access, csrf, token := cookieSession(t, srv, "cookie-user")
+	if access == nil || !access.HttpOnly || !access.Secure || access.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("access cookie %+v", access)
+	}
+	if csrf == nil || csrf.HttpOnly || csrf.Value != token || len(token) != 64 {
+		t.Fatalf("csrf cookie %+v, csrf_token %q", csrf, token)
+	}
+
+	// send makes a cookie-authenticated request; the cookies are added by hand since the
+	// test server is plain HTTP and they are Secure
+	send := func(method, path string, cookies []*http.Cookie, csrfHeader string) *http.Response {
+		var body map[string]interface{}
+		if method != "GET" {
+			body = map[string]interface{}{"long-url": "https://example.com/cookie-" + csrfHeader}
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, jsonBody(t, body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		if csrfHeader != "" {
+			req.Header.Set(csrfTokenHeader, csrfHeader)
+		}
+		return srv.send(req, nil)
+	}
+	both := []*http.Cookie{access, csrf}
+
+	if resp := send("GET", "/auth/profile", []*http.Cookie{access}, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET with the access cookie: status %d", resp.StatusCode)
+	}
+	if resp := send("PUT", "/url", both, token); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT with cookie and CSRF header: status %d", resp.StatusCode)
+	}
+
+	forged := "0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+		header  string
+	}{
+		{"no CSRF header", both, ""},
+		{"wrong CSRF header", both, forged},
+		{"CSRF header of another session", both, token[:63] + "x"},
+		{"header without the CSRF cookie", []*http.Cookie{access}, token},
+		{"empty CSRF cookie and header", []*http.Cookie{access, {Name: csrfTokenCookie, Value: ""}}, ""},
+	}
+	for _, tt := range tests {
+		if resp := send("PUT", "/url", tt.cookies, tt.header); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", tt.name, resp.StatusCode)
+		}
+		if resp := send("DELETE", "/url", tt.cookies, tt.header); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s, DELETE: status %d, want 403", tt.name, resp.StatusCode)
+		}
+	}
+	if resp := send("GET", "/auth/profile", []*http.Cookie{{Name: accessTokenCookie, Value: "not-a-jwt"}}, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("invalid access cookie: status %d", resp.StatusCode)
+	}
+
+	// A bearer token needs no CSRF token, even next to session cookies
+	bearer, _ := srv.register()
+	req, _ := http.NewRequest("PUT", srv.URL+"/url", jsonBody(t, map[string]interface{}{"long-url": "https://example.com/bearer"}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.AddCookie(&http.Cookie{Name: accessTokenCookie, Value: access.Value})
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("bearer request with cookies: status %d", resp.StatusCode)
+	}
+
+	// Logout clears every session cookie
+	logout := send("POST", "/auth/logout", both, token)
+	for _, name := range []string{"refresh_token", accessTokenCookie, csrfTokenCookie} {
+		if cookie := responseCookie(logout, name); cookie == nil || cookie.MaxAge >= 0 || cookie.Value != "" {
+			t.Errorf("logout left cookie %s: %+v", name, cookie)
+		}
+	}
+}
+
+func TestCookieSessionsOff(t *testing.T) {
+	withCookieAuth(t, false)
+	srv := newTestServer(t)
+	access, csrf, token := cookieSession(t, srv, "header-user")
+	if access != nil || csrf != nil || token != "" {
+		t.Fatalf("cookie mode off set access %v, csrf %v, csrf_token %q", access, csrf, token)
+	}
+
+	// An access token in a cookie is ignored
+	bearer, _ := srv.register()
+	req, _ := http.NewRequest("GET", srv.URL+"/auth/profile", nil)
+	req.AddCookie(&http.Cookie{Name: accessTokenCookie, Value: bearer})
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("cookie with the mode off: status %d", resp.StatusCode)
+	}
+	// Header auth needs no CSRF token
+	if resp := srv.do("PUT", "/url", bearer, map[string]interface{}{"long-url": "https://example.com/header-only"}, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("bearer PUT: status %d", resp.StatusCode)
+	}
+}
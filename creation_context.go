@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// LINK CREATION CONTEXT
+// ============================================================================
+//
+// Links record the IP address and user agent of the client that created them, for abuse
+// investigations. IP_PRIVACY_MODE decides how the address is kept:
+//   - hash (default): "sha256:" + HMAC of the address; matches other links from the same
+//     address but cannot be reversed (nor compared across ENCRYPTION_KEY changes)
+//   - encrypt: "enc:" + AES-GCM ciphertext, shown decrypted to the owner and admins
+//   - none: the address is not stored
+//
+// The fields are never part of the URLData JSON; only resolveOwner and the admin link
+// inspection add them to a response.
+
+const maxCreatedUserAgentLength = 512
+
+// ipPrivacyMode returns the configured IP_PRIVACY_MODE
+func ipPrivacyMode() string {
+	switch mode := os.Getenv("IP_PRIVACY_MODE"); mode {
+	case "encrypt", "none":
+		return mode
+	default:
+		return "hash"
+	}
+}
+
+// protectCreatedIP returns ip in the form stored under the privacy mode, or nil
+func protectCreatedIP(ip string) *string {
+	if ip == "" {
+		return nil
+	}
+	var stored string
+	switch ipPrivacyMode() {
+	case "none":
+		return nil
+	case "encrypt":
+		encrypted, err := EncryptSensitiveData(ip)
+		if err != nil {
+			log.Printf("Warning: could not encrypt creation IP: %v", err)
+			return nil
+		}
+		stored = "enc:" + encrypted
+	default:
+		stored = hashIP(ip)
+	}
+	return &stored
+}
+
+// hashIP returns "sha256:" + the HMAC of ip under ENCRYPTION_KEY
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, encryptionKey)
+	mac.Write([]byte(ip))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// createdUserAgent returns the user agent as stored, or nil
+func createdUserAgent(ua string) *string {
+	if ua == "" {
+		return nil
+	}
+	if len(ua) > maxCreatedUserAgentLength {
+		ua = ua[:maxCreatedUserAgentLength]
+	}
+	return &ua
+}
+
+// revealCreatedIP turns a stored address back into something readable: encrypted
+// addresses are decrypted, hashes are returned as is
+func revealCreatedIP(stored *string) *string {
+	if stored == nil {
+		return nil
+	}
+	encrypted, ok := strings.CutPrefix(*stored, "enc:")
+	if !ok {
+		return stored
+	}
+	ip, err := DecryptSensitiveData(encrypted)
+	if err != nil {
+		// Encrypted under another ENCRYPTION_KEY
+		undecryptable := "enc:undecryptable"
+		return &undecryptable
+	}
+	return &ip
+}
+
+// adminInspectURL handles GET /admin/urls/{code}: the link in any state, with its owner
+// and creation context
+func adminInspectURL(w http.ResponseWriter, r *http.Request) {
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := Links.FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error inspecting short URL %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	link.FullShortURL = fullShortURL(r, link.Domain, link.ShortURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":            true,
+		"url":                link,
+		"created_ip":         revealCreatedIP(link.CreatedIP),
+		"created_user_agent": link.CreatedUserAgent,
+		"ip_privacy_mode":    ipPrivacyMode(),
+	}); err != nil {
+		log.Printf("error encoding URL inspection response: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProtectCreatedIP(t *testing.T) {
+	t.Setenv("IP_PRIVACY_MODE", "hash")
+	hashed := protectCreatedIP("198.51.100.7")
+	if hashed == nil || !strings.HasPrefix(*hashed, "sha256:") || strings.Contains(*hashed, "198.51.100.7") {
+		t.Fatalf("hash mode stored %v", hashed)
+	}
+	if again := protectCreatedIP("198.51.100.7"); *again != *hashed {
+		t.Fatal("the same address hashes differently")
+	}
+	if other := protectCreatedIP("198.51.100.8"); *other == *hashed {
+		t.Fatal("different addresses hash the same")
+	}
+	if revealed := revealCreatedIP(hashed); *revealed != *hashed {
+		t.Fatalf("revealing a hash gave %s", *revealed)
+	}
+
+	t.Setenv("IP_PRIVACY_MODE", "encrypt")
+	encrypted := protectCreatedIP("198.51.100.7")
+	if encrypted == nil || !strings.HasPrefix(*encrypted, "enc:") || strings.Contains(*encrypted, "198.51.100.7") {
+		t.Fatalf("encrypt mode stored %v", encrypted)
+	}
+	if revealed := revealCreatedIP(encrypted); revealed == nil || *revealed != "198.51.100.7" {
+		t.Fatalf("revealing %s gave %v", *encrypted, revealed)
+	}
+	foreign := "enc:c29tZXRoaW5nIGVsc2U="
+	if revealed := revealCreatedIP(&foreign); *revealed != "enc:undecryptable" {
+		t.Fatalf("revealing a foreign ciphertext gave %s", *revealed)
+	}
+
+	t.Setenv("IP_PRIVACY_MODE", "none")
+	if stored := protectCreatedIP("198.51.100.7"); stored != nil {
+		t.Fatalf("none mode stored %s", *stored)
+	}
+	if protectCreatedIP("") != nil || revealCreatedIP(nil) != nil {
+		t.Fatal("no address became one")
+	}
+}
+
+func TestCreatedUserAgentTruncated(t *testing.T) {
+	if createdUserAgent("") != nil {
+		t.Fatal("empty user agent stored")
+	}
+	if ua := createdUserAgent(strings.Repeat("x", 2*maxCreatedUserAgentLength)); len(*ua) != maxCreatedUserAgentLength {
+		t.Fatalf("stored %d bytes of user agent", len(*ua))
+	}
+}
+
+func TestCreationContextExposure(t *testing.T) {
+	tests := []struct {
+		mode   string
+		stored func(*string) bool
+		shown  func(interface{}) bool
+	}{
+		{"hash",
+			func(s *string) bool { return s != nil && strings.HasPrefix(*s, "sha256:") },
+			func(v interface{}) bool { s, _ := v.(string); return strings.HasPrefix(s, "sha256:") }},
+		{"encrypt",
+			func(s *string) bool { return s != nil && strings.HasPrefix(*s, "enc:") },
+			func(v interface{}) bool { return v == "127.0.0.1" }},
+		{"none",
+			func(s *string) bool { return s == nil },
+			func(v interface{}) bool { return v == nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv("IP_PRIVACY_MODE", tt.mode)
+			srv := newTestServer(t)
+			token, _ := srv.register()
+			admin, _ := srv.registerAdmin()
+
+			req, _ := http.NewRequest("PUT", srv.URL+"/url", jsonBody(t, map[string]interface{}{"long-url": "https://example.com/investigated"}))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("User-Agent", "creator-agent/1.0")
+			var created URLData
+			resp := srv.send(req, &created)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("shorten: status %d", resp.StatusCode)
+			}
+			if stored := srv.stored(created.ShortURL); !tt.stored(stored.CreatedIP) || stored.CreatedUserAgent == nil || *stored.CreatedUserAgent != "creator-agent/1.0" {
+				t.Fatalf("stored created_ip %v, created_user_agent %v", stored.CreatedIP, stored.CreatedUserAgent)
+			}
+
+			// Only the admin inspection shows the creation context
+			var inspected map[string]interface{}
+			if resp := srv.do("GET", "/admin/urls/"+created.ShortURL, admin, nil, &inspected); resp.StatusCode != http.StatusOK {
+				t.Fatalf("inspect: status %d", resp.StatusCode)
+			}
+			if !tt.shown(inspected["created_ip"]) || inspected["created_user_agent"] != "creator-agent/1.0" || inspected["ip_privacy_mode"] != tt.mode {
+				t.Fatalf("inspection shows created_ip %v, created_user_agent %v, mode %v", inspected["created_ip"], inspected["created_user_agent"], inspected["ip_privacy_mode"])
+			}
+			for _, leak := range []*http.Response{
+				resp,
+				srv.do("GET", "/url/"+created.ShortURL, token, nil, nil),
+				srv.do("GET", "/analytics", token, nil, nil),
+				srv.do("POST", "/url/preview", token, map[string]interface{}{"long-url": "https://example.com/investigated"}, nil),
+			} {
+				if body := readBody(t, leak); strings.Contains(body, "created_ip") || strings.Contains(body, "creator-agent") {
+					t.Errorf("%s %s exposes the creation context: %s", leak.Request.Method, leak.Request.URL.Path, body)
+				}
+			}
+			if resp := srv.do("GET", "/admin/urls/"+created.ShortURL, token, nil, nil); resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("inspection by the owner: status %d", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -1,639 +1,879 @@
-package main
-
-import (
-	"context"
-	"fmt"
-	"log"
-	"os"
-	"sync"
-	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-)
-
-type DatabaseConfig struct {
-	Client     *mongo.Client
-	Database   *mongo.Database
-	Collection *mongo.Collection
-}
-
-// DatabaseCollections provides logical separation of collections
-type DatabaseCollections struct {
-	Users *mongo.Collection
-	URLs  *mongo.Collection
-}
-
-var DB *DatabaseConfig
-
-// GetCollections returns organized collection references
-func GetCollections() *DatabaseCollections {
-	return &DatabaseCollections{
-		Users: DB.Database.Collection("users"),
-		URLs:  DB.Database.Collection("urls"),
-	}
-}
-
-// InitializeDatabase initializes MongoDB connection with default configuration
-func InitializeDatabase() error {
-	// Get connection string from environment or use default
-	connectionString := os.Getenv("MONGODB_URI")
-	if connectionString == "" {
-		connectionString = "mongodb://localhost:27017"
-	}
-
-	// Get database name from environment or use default
-	databaseName := os.Getenv("MONGODB_DATABASE")
-	if databaseName == "" {
-		databaseName = "url_shortener"
-	}
-
-	log.Println("Attempting to connect to MongoDB...")
-	log.Printf("Connection String: %s", connectionString)
-	log.Printf("Database Name: %s", databaseName)
-
-	if err := InitMongoDB(connectionString, databaseName); err != nil {
-		log.Printf("⚠️  MongoDB connection failed: %v", err)
-		log.Println("💡 To fix this:")
-		log.Println("   1. Install MongoDB: https://www.mongodb.com/try/download/community")
-		log.Println("   2. Start MongoDB service:")
-		log.Println("      Windows: net start MongoDB")
-		log.Println("      Linux/Mac: sudo systemctl start mongod")
-		log.Println("   3. Or use Docker: docker run -d -p 27017:27017 --name mongodb mongo:latest")
-		log.Println("   4. Set environment variables:")
-		log.Println("      export MONGODB_URI=\"mongodb://localhost:27017\"")
-		log.Println("      export MONGODB_DATABASE=\"url_shortener\"")
-		log.Println("🔄 Starting in demo mode without database...")
-		return nil // Allow startup without database for testing
-	}
-
-	log.Println("✅ MongoDB connected successfully!")
-	return nil
-}
-
-// InitMongoDB initializes the MongoDB connection and creates indexes
-func InitMongoDB(connectionString, databaseName string) error {
-	// Optimize connection pool settings
-	clientOptions := options.Client().ApplyURI(connectionString).
-		SetMaxPoolSize(100).                       // Max 100 connections in pool
-		SetMinPoolSize(10).                        // Min 10 connections always available
-		SetMaxConnIdleTime(30 * time.Second).      // Close idle connections after 30s
-		SetRetryWrites(true).                      // Auto-retry write operations
-		SetRetryReads(true).                       // Auto-retry read operations
-		SetConnectTimeout(10 * time.Second).       // 10s connection timeout
-		SetServerSelectionTimeout(5 * time.Second) // 5s server selection timeout
-
-	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		return fmt.Errorf("failed to connect to MongoDB: %v", err)
-	}
-
-	// Check the connection
-	err = client.Ping(context.TODO(), nil)
-	if err != nil {
-		return fmt.Errorf("failed to ping MongoDB: %v", err)
-	}
-
-	database := client.Database(databaseName)
-	collection := database.Collection("urls")
-
-	DB = &DatabaseConfig{
-		Client:     client,
-		Database:   database,
-		Collection: collection,
-	}
-
-	log.Println("Connected to MongoDB!")
-
-	// Create indexes
-	if err := createIndexes(); err != nil {
-		return fmt.Errorf("failed to create indexes: %v", err)
-	}
-
-	log.Println("MongoDB indexes created successfully!")
-	return nil
-}
-
-// createIndexes creates all necessary indexes for the URLs collection
-func createIndexes() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// 1. Unique index on short_url
-	shortURLIndex := mongo.IndexModel{
-		Keys:    bson.D{{Key: "short_url", Value: 1}},
-		Options: options.Index().SetUnique(true),
-	}
-
-	// 2. Partial unique index on long_url (only for active URLs)
-	longURLIndex := mongo.IndexModel{
-		Keys: bson.D{{Key: "long_url", Value: 1}},
-		Options: options.Index().
-			SetUnique(true).
-			SetPartialFilterExpression(bson.D{{Key: "is_active", Value: true}}),
-	}
-
-	// 3. Index on expires_at for cleanup operations
-	expiryIndex := mongo.IndexModel{
-		Keys:    bson.D{{Key: "expires_at", Value: 1}},
-		Options: options.Index().SetSparse(true),
-	}
-
-	// 4. Index on created_at for analytics
-	createdAtIndex := mongo.IndexModel{
-		Keys: bson.D{{Key: "created_at", Value: -1}},
-	}
-
-	// 5. Compound index on is_active and created_at
-	compoundIndex := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "is_active", Value: 1},
-			{Key: "created_at", Value: -1},
-		},
-	}
-
-	// 6. Index on user_id for user-specific queries
-	userIndex := mongo.IndexModel{
-		Keys: bson.D{{Key: "user_id", Value: 1}},
-	}
-
-	// 7. Compound index on user_id and created_at
-	userCompoundIndex := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "user_id", Value: 1},
-			{Key: "created_at", Value: -1},
-		},
-	}
-
-	// Enhanced indexes for users collection
-	userUsernameIndex := mongo.IndexModel{
-		Keys:    bson.D{{Key: "username", Value: 1}},
-		Options: options.Index().SetUnique(true).SetName("username_unique_idx"),
-	}
-
-	userEmailIndex := mongo.IndexModel{
-		Keys:    bson.D{{Key: "email", Value: 1}},
-		Options: options.Index().SetUnique(true).SetName("email_unique_idx"),
-	}
-
-	// Compound index for login queries (username/email + active status)
-	userLoginIndex := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "username", Value: 1},
-			{Key: "is_active", Value: 1},
-		},
-		Options: options.Index().SetName("username_active_idx"),
-	}
-
-	// Compound index for email login queries
-	userEmailLoginIndex := mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "email", Value: 1},
-			{Key: "is_active", Value: 1},
-		},
-		Options: options.Index().SetName("email_active_idx"),
-	}
-
-	// Index on created_at for user analytics
-	userCreatedAtIndex := mongo.IndexModel{
-		Keys:    bson.D{{Key: "created_at", Value: -1}},
-		Options: options.Index().SetName("user_created_at_idx"),
-	}
-
-	// Create all indexes for urls collection
-	urlIndexes := []mongo.IndexModel{
-		shortURLIndex,
-		longURLIndex,
-		expiryIndex,
-		createdAtIndex,
-		compoundIndex,
-		userIndex,
-		userCompoundIndex,
-	}
-
-	_, err := DB.Collection.Indexes().CreateMany(ctx, urlIndexes)
-	if err != nil {
-		return err
-	}
-
-	// Create all enhanced indexes for users collection
-	userIndexes := []mongo.IndexModel{
-		userUsernameIndex,
-		userEmailIndex,
-		userLoginIndex,
-		userEmailLoginIndex,
-		userCreatedAtIndex,
-	}
-
-	_, err = DB.Database.Collection("users").Indexes().CreateMany(ctx, userIndexes)
-	return err
-}
-
-// CleanupExpiredURLs marks expired URLs as inactive
-func CleanupExpiredURLs() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	filter := bson.D{
-		{Key: "expires_at", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
-		{Key: "is_active", Value: true},
-	}
-
-	update := bson.D{
-		{Key: "$set", Value: bson.D{{Key: "is_active", Value: false}}},
-	}
-
-	result, err := DB.Collection.UpdateMany(ctx, filter, update)
-	if err != nil {
-		return err
-	}
-
-	if result.ModifiedCount > 0 {
-		log.Printf("Marked %d expired URLs as inactive", result.ModifiedCount)
-	}
-
-	return nil
-}
-
-// GetDatabaseStats returns collection statistics
-func GetDatabaseStats() (bson.M, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var result bson.M
-	err := DB.Database.RunCommand(ctx, bson.D{
-		{Key: "collStats", Value: "urls"},
-	}).Decode(&result)
-
-	return result, err
-}
-
-// CloseMongoDB closes the MongoDB connection
-func CloseMongoDB() error {
-	if DB != nil && DB.Client != nil {
-		log.Println("🔌 Closing MongoDB connection...")
-		return DB.Client.Disconnect(context.TODO())
-	}
-	return nil
-}
-
-// GetUserURLsPaginated retrieves paginated URLs for a user using skip/limit
-func GetUserURLsPaginated(userID string, skip int, limit int) ([]map[string]interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if limit <= 0 || limit > 100 {
-		limit = 50 // Default limit
-	}
-	if skip < 0 {
-		skip = 0
-	}
-
-	pipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}}}},
-		bson.D{{Key: "$skip", Value: skip}},
-		bson.D{{Key: "$limit", Value: limit}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "short_url", Value: 1},
-			{Key: "long_url", Value: 1},
-			{Key: "domain", Value: 1},
-			{Key: "tags", Value: 1},
-			{Key: "clicks", Value: 1},
-			{Key: "created_at", Value: 1},
-			{Key: "expires_at", Value: 1},
-			{Key: "is_active", Value: 1},
-			{Key: "_id", Value: 0},
-		}}},
-	}
-
-	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(ctx)
-
-	var urls []map[string]interface{}
-	if err = cursor.All(ctx, &urls); err != nil {
-		return nil, err
-	}
-	return urls, nil
-}
-
-// GetUserURLsOptimized retrieves URLs for a user using optimized aggregation
-func GetUserURLsOptimized(userID string, limit int) ([]map[string]interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if limit <= 0 || limit > 100 {
-		limit = 50 // Default limit
-	}
-
-	// Optimized aggregation pipeline
-	pipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}}}},
-		bson.D{{Key: "$limit", Value: limit}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "short_url", Value: 1},
-			{Key: "long_url", Value: 1},
-			{Key: "domain", Value: 1},
-			{Key: "tags", Value: 1},
-			{Key: "clicks", Value: 1},
-			{Key: "created_at", Value: 1},
-			{Key: "expires_at", Value: 1},
-			{Key: "is_active", Value: 1},
-			{Key: "_id", Value: 0},
-		}}},
-	}
-
-	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		return nil, fmt.Errorf("aggregation failed: %v", err)
-	}
-	defer cursor.Close(ctx)
-
-	var urls []map[string]interface{}
-	if err = cursor.All(ctx, &urls); err != nil {
-		return nil, fmt.Errorf("cursor processing failed: %v", err)
-	}
-
-	// Prepare URLs with full BASE_URL for frontend
-	// baseURL := os.Getenv("BASE_URL")
-	// if baseURL == "" {
-	// 	baseURL = "http://localhost:8080" // Default base URL
-	// }
-
-	// for i := range urls {
-	// 	if shortURL, ok := urls[i]["short_url"].(string); ok {
-	// 		urls[i]["short_url"] = baseURL + "/" + shortURL
-	// 	}
-	// }
-	return urls, nil
-}
-
-// GetUserStatsOptimized gets user statistics using aggregation
-func GetUserStatsOptimized(userID string) (map[string]interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	stats := map[string]interface{}{
-		"total_urls":          0,
-		"total_clicks":        0,
-		"avg_clicks_per_url":  0,
-		"clicks_over_time":    []map[string]interface{}{},
-		"tag_distribution":    []map[string]interface{}{},
-		"domain_distribution": []map[string]interface{}{},
-		"top_links":           []map[string]interface{}{},
-	}
-
-	type result struct {
-		key   string
-		value interface{}
-		err   error
-	}
-
-	var wg sync.WaitGroup
-	ch := make(chan result, 5)
-
-	wg.Add(5)
-	go func() {
-		defer wg.Done()
-		val, err := getBasicStats(ctx, userID)
-		ch <- result{"basic", val, err}
-	}()
-	go func() {
-		defer wg.Done()
-		val, err := getClicksOverTime(ctx, userID)
-		ch <- result{"clicks_over_time", val, err}
-	}()
-	go func() {
-		defer wg.Done()
-		val, err := getTagDistribution(ctx, userID)
-		ch <- result{"tag_distribution", val, err}
-	}()
-	go func() {
-		defer wg.Done()
-		val, err := getDomainDistribution(ctx, userID)
-		ch <- result{"domain_distribution", val, err}
-	}()
-	go func() {
-		defer wg.Done()
-		val, err := getTopLinks(ctx, userID)
-		ch <- result{"top_links", val, err}
-	}()
-
-	wg.Wait()
-	close(ch)
-
-	for res := range ch {
-		if res.err != nil {
-			if res.key == "basic" {
-				return nil, res.err
-			}
-			log.Printf("Warning: analytics aggregation for %s failed: %v", res.key, res.err)
-			continue
-		}
-		switch res.key {
-		case "basic":
-			if res.value != nil {
-				for k, v := range res.value.(map[string]interface{}) {
-					stats[k] = v
-				}
-			}
-		default:
-			stats[res.key] = res.value
-		}
-	}
-
-	return stats, nil
-}
-
-// Helper functions for GetUserStatsOptimized
-
-func getBasicStats(ctx context.Context, userID string) (map[string]interface{}, error) {
-	pipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: nil},
-			{Key: "total_urls", Value: bson.D{{Key: "$sum", Value: 1}}},
-			{Key: "total_clicks", Value: bson.D{{Key: "$sum", Value: "$clicks"}}},
-			{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$avg", Value: "$clicks"}}},
-		}}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "_id", Value: 0},
-			{Key: "total_urls", Value: 1},
-			{Key: "total_clicks", Value: 1},
-			{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$round", Value: bson.A{"$avg_clicks_per_url", 2}}}},
-		}}},
-	}
-	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(ctx)
-	var results []map[string]interface{}
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, err
-	}
-	if len(results) > 0 {
-		return results[0], nil
-	}
-	return nil, nil
-}
-
-func getClicksOverTime(ctx context.Context, userID string) ([]map[string]interface{}, error) {
-	clicksOverTime := []map[string]interface{}{}
-	clicksPipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "user_id", Value: userID},
-			{Key: "is_active", Value: true},
-			{Key: "created_at", Value: bson.D{{Key: "$gte", Value: time.Now().AddDate(0, 0, -30)}}},
-		}}},
-		bson.D{{Key: "$unwind", Value: "$click_history"}},
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "click_history.timestamp", Value: bson.D{{Key: "$gte", Value: time.Now().AddDate(0, 0, -30)}}},
-		}}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: bson.D{
-				{Key: "$dateToString", Value: bson.D{
-					{Key: "format", Value: "%Y-%m-%d"},
-					{Key: "date", Value: "$click_history.timestamp"},
-				}},
-			}},
-			{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
-	}
-	clickCursor, err := DB.Collection.Aggregate(ctx, clicksPipeline)
-	if err != nil {
-		return clicksOverTime, nil
-	}
-	defer clickCursor.Close(ctx)
-	for clickCursor.Next(ctx) {
-		var doc map[string]interface{}
-		if err := clickCursor.Decode(&doc); err == nil {
-			clicksOverTime = append(clicksOverTime, map[string]interface{}{
-				"date":   doc["_id"],
-				"clicks": doc["clicks"],
-			})
-		}
-	}
-	return clicksOverTime, nil
-}
-
-func getTagDistribution(ctx context.Context, userID string) ([]map[string]interface{}, error) {
-	tagDistribution := []map[string]interface{}{}
-	tagPipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "user_id", Value: userID},
-			{Key: "is_active", Value: true},
-		}}},
-		bson.D{{Key: "$unwind", Value: "$tags"}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$tags"},
-			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
-		bson.D{{Key: "$limit", Value: 10}},
-	}
-	tagCursor, err := DB.Collection.Aggregate(ctx, tagPipeline)
-	if err != nil {
-		return tagDistribution, nil
-	}
-	defer tagCursor.Close(ctx)
-	for tagCursor.Next(ctx) {
-		var doc map[string]interface{}
-		if err := tagCursor.Decode(&doc); err == nil {
-			tagDistribution = append(tagDistribution, map[string]interface{}{
-				"tag":   doc["_id"],
-				"count": doc["count"],
-			})
-		}
-	}
-	return tagDistribution, nil
-}
-
-func getDomainDistribution(ctx context.Context, userID string) ([]map[string]interface{}, error) {
-	domainDistribution := []map[string]interface{}{}
-	domainPipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "user_id", Value: userID},
-			{Key: "is_active", Value: true},
-		}}},
-		bson.D{{Key: "$group", Value: bson.D{
-			{Key: "_id", Value: "$domain"},
-			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
-	}
-	domainCursor, err := DB.Collection.Aggregate(ctx, domainPipeline)
-	if err != nil {
-		return domainDistribution, nil
-	}
-	defer domainCursor.Close(ctx)
-	for domainCursor.Next(ctx) {
-		var doc map[string]interface{}
-		if err := domainCursor.Decode(&doc); err == nil {
-			domainDistribution = append(domainDistribution, map[string]interface{}{
-				"domain": doc["_id"],
-				"count":  doc["count"],
-			})
-		}
-	}
-	return domainDistribution, nil
-}
-
-func getTopLinks(ctx context.Context, userID string) ([]map[string]interface{}, error) {
-	topLinks := []map[string]interface{}{}
-	topPipeline := mongo.Pipeline{
-		bson.D{{Key: "$match", Value: bson.D{
-			{Key: "user_id", Value: userID},
-			{Key: "is_active", Value: true},
-			{Key: "clicks", Value: bson.D{{Key: "$gt", Value: 0}}},
-		}}},
-		bson.D{{Key: "$sort", Value: bson.D{{Key: "clicks", Value: -1}}}},
-		bson.D{{Key: "$limit", Value: 10}},
-		bson.D{{Key: "$project", Value: bson.D{
-			{Key: "short_url", Value: 1},
-			{Key: "long_url", Value: 1},
-			{Key: "domain", Value: 1},
-			{Key: "tags", Value: 1},
-			{Key: "clicks", Value: 1},
-			{Key: "created_at", Value: 1},
-			{Key: "expires_at", Value: 1},
-			{Key: "is_active", Value: 1},
-			{Key: "_id", Value: 0},
-		}}},
-	}
-	topCursor, err := DB.Collection.Aggregate(ctx, topPipeline)
-	if err != nil {
-		return topLinks, nil
-	}
-	defer topCursor.Close(ctx)
-	for topCursor.Next(ctx) {
-		var doc map[string]interface{}
-		if err := topCursor.Decode(&doc); err == nil {
-			topLinks = append(topLinks, doc)
-		}
-	}
-	return topLinks, nil
-}
-
-// StartCleanupWorker starts a background goroutine for periodic cleanup of expired URLs
-func StartCleanupWorker() {
-	go func() {
-		log.Println("🧹 Starting cleanup worker for expired URLs...")
-		ticker := time.NewTicker(1 * time.Hour) // Run cleanup every hour
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := CleanupExpiredURLs(); err != nil {
-				log.Printf("Error during cleanup: %v", err)
-			} else {
-				log.Println("✅ Cleanup worker completed successfully")
-			}
-		}
-	}()
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/errgroup"
+)
+
+type DatabaseConfig struct {
+	Client     *mongo.Client
+	Database   *mongo.Database
+	Collection *mongo.Collection
+}
+
+// DatabaseCollections provides logical separation of collections
+type DatabaseCollections struct {
+	Users *mongo.Collection
+	URLs  *mongo.Collection
+}
+
+var DB *DatabaseConfig
+
+// GetCollections returns organized collection references
+func GetCollections() *DatabaseCollections {
+	return &DatabaseCollections{
+		Users: DB.Database.Collection("users"),
+		URLs:  DB.Database.Collection("urls"),
+	}
+}
+
+// InitializeDatabase initializes MongoDB connection with default configuration
+func InitializeDatabase() error {
+	// Get connection string from environment or use default
+	connectionString := os.Getenv("MONGODB_URI")
+	if connectionString == "" {
+		connectionString = "mongodb://localhost:27017"
+	}
+
+	// Get database name from environment or use default
+	databaseName := os.Getenv("MONGODB_DATABASE")
+	if databaseName == "" {
+		databaseName = "url_shortener"
+	}
+
+	log.Println("Attempting to connect to MongoDB...")
+	log.Printf("Connection String: %s", connectionString)
+	log.Printf("Database Name: %s", databaseName)
+
+	if err := InitAnalyticsReadPreference(); err != nil {
+		return fmt.Errorf("refusing to start: %v", err)
+	}
+	if err := InitMongoDB(connectionString, databaseName); err != nil {
+		// A failed required migration means the schema is not what the code expects
+		if errors.Is(err, ErrMigrationFailed) {
+			return fmt.Errorf("refusing to start: %v", err)
+		}
+		log.Printf("⚠️  MongoDB connection failed: %v", err)
+		log.Println("💡 To fix this:")
+		log.Println("   1. Install MongoDB: https://www.mongodb.com/try/download/community")
+		log.Println("   2. Start MongoDB service:")
+		log.Println("      Windows: net start MongoDB")
+		log.Println("      Linux/Mac: sudo systemctl start mongod")
+		log.Println("   3. Or use Docker: docker run -d -p 27017:27017 --name mongodb mongo:latest")
+		log.Println("   4. Set environment variables:")
+		log.Println("      export MONGODB_URI=\"mongodb://localhost:27017\"")
+		log.Println("      export MONGODB_DATABASE=\"url_shortener\"")
+		log.Println("🔄 Starting in demo mode without database...")
+		return nil // Allow startup without database for testing
+	}
+
+	log.Println("✅ MongoDB connected successfully!")
+	return nil
+}
+
+// InitMongoDB initializes the MongoDB connection and creates indexes
+func InitMongoDB(connectionString, databaseName string) error {
+	// Optimize connection pool settings
+	clientOptions := options.Client().ApplyURI(connectionString).
+		SetMaxPoolSize(100).                       // Max 100 connections in pool
+		SetMinPoolSize(10).                        // Min 10 connections always available
+		SetMaxConnIdleTime(30 * time.Second).      // Close idle connections after 30s
+		SetRetryWrites(true).                      // Auto-retry write operations
+		SetRetryReads(true).                       // Auto-retry read operations
+		SetConnectTimeout(10 * time.Second).       // 10s connection timeout
+		SetServerSelectionTimeout(5 * time.Second) // 5s server selection timeout
+
+	// Connect to MongoDB
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+
+	// Check the connection
+	err = client.Ping(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to ping MongoDB: %v", err)
+	}
+
+	database := client.Database(databaseName)
+	collection := database.Collection("urls")
+
+	DB = &DatabaseConfig{
+		Client:     client,
+		Database:   database,
+		Collection: collection,
+	}
+
+	log.Println("Connected to MongoDB!")
+
+	// Log which of the needed privileges the user has before anything depends on them
+	CheckMongoPermissions()
+
+	// Apply pending schema migrations (index creation lives in migration 001)
+	if err := RunMigrations(); err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	// Apply COLLECTION_SHARD_KEY index layout when configured
+	if err := shardKeyStartupCheck(); err != nil {
+		if canCreateMongoIndexes() {
+			return fmt.Errorf("%w: shard key setup: %v", ErrMigrationFailed, err)
+		}
+		log.Printf("⚠️  Shard key setup failed without createIndex, continuing: %v", err)
+	}
+
+	log.Println("MongoDB migrations applied successfully!")
+	return nil
+}
+
+// urlIndexModels returns the base indexes of the urls collection. Every index is named
+// explicitly so later migrations can drop or replace it by name.
+func urlIndexModels() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		// 1. Unique index on short_url (sharded collections can only enforce uniqueness on
+		// shard-key-prefixed indexes, so there it is a plain lookup index - see partition.go)
+		{
+			Keys:    bson.D{{Key: "short_url", Value: 1}},
+			Options: options.Index().SetName("short_url_unique_idx").SetUnique(shardKey() == ""),
+		},
+		// 2. Partial unique index on long_url (only for active URLs); replaced by
+		// migration 002, which drops it under its original default name
+		{
+			Keys: bson.D{{Key: "long_url", Value: 1}},
+			Options: options.Index().
+				SetName("long_url_1").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "is_active", Value: true}}),
+		},
+		// 3. Index on expires_at for cleanup operations
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_idx").SetSparse(true),
+		},
+		// 4. Index on created_at for analytics
+		{
+			Keys:    bson.D{{Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("created_at_idx"),
+		},
+		// 5. Compound index on is_active and created_at (shard key prefixed when sharded)
+		activeCreatedAtIndexModel(),
+		// 6. Index on user_id for user-specific queries
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("user_id_idx"),
+		},
+		// 7. Compound index on user_id and created_at
+		{
+			Keys: bson.D{
+				{Key: "user_id", Value: 1},
+				{Key: "created_at", Value: -1},
+			},
+			Options: options.Index().SetName("user_id_created_at_idx"),
+		},
+	}
+}
+
+// activeCreatedAtIndexModel returns the (is_active, created_at) index, prefixed and named
+// after the shard key when COLLECTION_SHARD_KEY is set
+func activeCreatedAtIndexModel() mongo.IndexModel {
+	name := "active_created_at_idx"
+	if key := shardKey(); key != "" {
+		name = key + "_" + name
+	}
+	return mongo.IndexModel{
+		Keys: withShardKey(bson.D{
+			{Key: "is_active", Value: 1},
+			{Key: "created_at", Value: -1},
+		}),
+		Options: options.Index().SetName(name),
+	}
+}
+
+// createIndexes creates all necessary indexes for the URLs and users collections
+func createIndexes(ctx context.Context, db *mongo.Database) error {
+	// Enhanced indexes for users collection
+	userUsernameIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("username_unique_idx"),
+	}
+
+	userEmailIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("email_unique_idx"),
+	}
+
+	// Compound index for login queries (username/email + active status)
+	userLoginIndex := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "username", Value: 1},
+			{Key: "is_active", Value: 1},
+		},
+		Options: options.Index().SetName("username_active_idx"),
+	}
+
+	// Compound index for email login queries
+	userEmailLoginIndex := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "email", Value: 1},
+			{Key: "is_active", Value: 1},
+		},
+		Options: options.Index().SetName("email_active_idx"),
+	}
+
+	// Index on created_at for user analytics
+	userCreatedAtIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: -1}},
+		Options: options.Index().SetName("user_created_at_idx"),
+	}
+
+	// Create all indexes for urls collection
+	_, err := db.Collection("urls").Indexes().CreateMany(ctx, urlIndexModels())
+	if err != nil {
+		return err
+	}
+
+	// Create all enhanced indexes for users collection
+	userIndexes := []mongo.IndexModel{
+		userUsernameIndex,
+		userEmailIndex,
+		userLoginIndex,
+		userEmailLoginIndex,
+		userCreatedAtIndex,
+	}
+
+	_, err = db.Collection("users").Indexes().CreateMany(ctx, userIndexes)
+	return err
+}
+
+// CleanupExpiredURLs marks expired URLs as inactive and returns how many were deactivated
+func CleanupExpiredURLs() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	modified, err := Links.DeactivateExpired(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if modified > 0 {
+		log.Printf("Marked %d expired URLs as inactive", modified)
+	}
+
+	return modified, nil
+}
+
+// GetDatabaseStats returns collection statistics
+func GetDatabaseStats() (bson.M, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var result bson.M
+	err := DB.Database.RunCommand(ctx, bson.D{
+		{Key: "collStats", Value: "urls"},
+	}).Decode(&result)
+
+	return result, err
+}
+
+// CloseMongoDB closes the MongoDB connection
+func CloseMongoDB() error {
+	if DB != nil && DB.Client != nil {
+		log.Println("🔌 Closing MongoDB connection...")
+		return DB.Client.Disconnect(context.TODO())
+	}
+	return nil
+}
+
+// GetUserURLsPaginated returns the user's links passing filter, newest first, skipping skip
+// and returning at most limit of them (50 when limit is out of range)
+func GetUserURLsPaginated(userID string, filter LinkFilter, skip int, limit int) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if limit <= 0 || limit > 100 {
+		limit = 50 // Default limit
+	}
+	if skip < 0 {
+		skip = 0
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: append(filter.mongoBaseMatch(userID), filter.mongoMatch()...)}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}}}},
+		bson.D{{Key: "$skip", Value: skip}},
+		bson.D{{Key: "$limit", Value: limit}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "short_url", Value: 1},
+			{Key: "long_url", Value: 1},
+			{Key: "domain", Value: 1},
+			{Key: "tags", Value: 1},
+			{Key: "clicks", Value: 1},
+			{Key: "created_at", Value: 1},
+			{Key: "expires_at", Value: 1},
+			{Key: "is_active", Value: 1},
+			{Key: "deep_link", Value: 1},
+			{Key: "deep_link_clicks", Value: 1},
+			{Key: "_id", Value: 0},
+		}}},
+	}
+
+	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var urls []map[string]interface{}
+	if err = cursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+	addFullShortURLs(nil, urls)
+	return urls, nil
+}
+
+// GetUserURLsOptimized retrieves URLs for a user using optimized aggregation
+func GetUserURLsOptimized(userID string, limit int) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if limit <= 0 || limit > 100 {
+		limit = 50 // Default limit
+	}
+
+	// Optimized aggregation pipeline
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "short_url", Value: 1},
+			{Key: "long_url", Value: 1},
+			{Key: "domain", Value: 1},
+			{Key: "tags", Value: 1},
+			{Key: "clicks", Value: 1},
+			{Key: "created_at", Value: 1},
+			{Key: "expires_at", Value: 1},
+			{Key: "is_active", Value: 1},
+			{Key: "_id", Value: 0},
+		}}},
+	}
+
+	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("aggregation failed: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var urls []map[string]interface{}
+	if err = cursor.All(ctx, &urls); err != nil {
+		return nil, fmt.Errorf("cursor processing failed: %v", err)
+	}
+
+	addFullShortURLs(nil, urls)
+	return urls, nil
+}
+
+// userStatsTimeout bounds GetUserStatsOptimized when the caller's deadline is later or unset
+const userStatsTimeout = 5 * time.Second
+
+// userStatsPipeline is one aggregation of GetUserStatsOptimized. A required pipeline that
+// fails fails the whole call and cancels the others; any other failure only leaves its key
+// at the default.
+type userStatsPipeline struct {
+	key      string
+	required bool
+	run      func(ctx context.Context, userID string) (interface{}, error)
+}
+
+// userStatsPipelines lists the aggregations run in parallel; "basic" is merged into the top
+// level of the result, every other one is stored under its key
+var userStatsPipelines = []userStatsPipeline{
+	{key: "basic", required: true, run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getBasicStats(ctx, userID)
+	}},
+	{key: "clicks_over_time", run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getClicksOverTime(ctx, userID)
+	}},
+	{key: "tag_distribution", run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getTagDistribution(ctx, userID)
+	}},
+	{key: "domain_distribution", run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getDomainDistribution(ctx, userID)
+	}},
+	{key: "top_links", run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getTopLinks(ctx, userID)
+	}},
+	{key: "status_counts", run: func(ctx context.Context, userID string) (interface{}, error) {
+		return getStatusBreakdown(ctx, DB.Collection, userID, time.Now())
+	}},
+}
+
+// GetUserStatsOptimized gets user statistics using aggregation. The pipelines run in
+// parallel within ctx's deadline, capped at userStatsTimeout; each one's duration is counted
+// in the user_stats_<key>_ms_total and user_stats_<key>_runs_total metrics.
+func GetUserStatsOptimized(ctx context.Context, userID string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, userStatsTimeout)
+	defer cancel()
+
+	stats := map[string]interface{}{
+		"total_urls":          0,
+		"total_clicks":        0,
+		"avg_clicks_per_url":  0,
+		"clicks_over_time":    []map[string]interface{}{},
+		"tag_distribution":    []map[string]interface{}{},
+		"domain_distribution": []map[string]interface{}{},
+		"top_links":           []map[string]interface{}{},
+		"status_counts":       newStatusCounts(),
+	}
+
+	// Each pipeline writes only its own slot, so the results need no locking
+	values := make([]interface{}, len(userStatsPipelines))
+	succeeded := make([]bool, len(userStatsPipelines))
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i, pipeline := range userStatsPipelines {
+		group.Go(func() error {
+			start := time.Now()
+			value, err := pipeline.run(groupCtx, userID)
+			incMetric("user_stats_"+pipeline.key+"_ms_total", time.Since(start).Milliseconds())
+			incMetric("user_stats_"+pipeline.key+"_runs_total", 1)
+			if err != nil {
+				incMetric("user_stats_"+pipeline.key+"_failed_total", 1)
+				if pipeline.required {
+					return fmt.Errorf("%s statistics: %w", pipeline.key, err)
+				}
+				// Pipelines cancelled because a required one failed are not worth a warning
+				if groupCtx.Err() == nil {
+					log.Printf("Warning: analytics aggregation for %s failed: %v", pipeline.key, err)
+				}
+				return nil
+			}
+			values[i], succeeded[i] = value, true
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	for i, pipeline := range userStatsPipelines {
+		if !succeeded[i] {
+			continue
+		}
+		if pipeline.key == "basic" {
+			if basic, ok := values[i].(map[string]interface{}); ok {
+				for k, v := range basic {
+					stats[k] = v
+				}
+			}
+			continue
+		}
+		stats[pipeline.key] = values[i]
+	}
+
+	return stats, nil
+}
+
+// Helper functions for GetUserStatsOptimized
+
+func getBasicStats(ctx context.Context, userID string) (map[string]interface{}, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "total_urls", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "total_clicks", Value: bson.D{{Key: "$sum", Value: "$clicks"}}},
+			{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$avg", Value: "$clicks"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "total_urls", Value: 1},
+			{Key: "total_clicks", Value: 1},
+			{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$round", Value: bson.A{"$avg_clicks_per_url", 2}}}},
+		}}},
+	}
+	cursor, err := DB.Collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var results []map[string]interface{}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		return results[0], nil
+	}
+	return nil, nil
+}
+
+func getClicksOverTime(ctx context.Context, userID string) ([]map[string]interface{}, error) {
+	clicksOverTime := []map[string]interface{}{}
+	clicksPipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "is_active", Value: true},
+			{Key: "created_at", Value: bson.D{{Key: "$gte", Value: time.Now().AddDate(0, 0, -30)}}},
+		}}},
+		bson.D{{Key: "$unwind", Value: "$click_history"}},
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "click_history.timestamp", Value: bson.D{{Key: "$gte", Value: time.Now().AddDate(0, 0, -30)}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "$dateToString", Value: bson.D{
+					{Key: "format", Value: "%Y-%m-%d"},
+					{Key: "date", Value: "$click_history.timestamp"},
+				}},
+			}},
+			{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	clickCursor, err := DB.Collection.Aggregate(ctx, clicksPipeline)
+	if err != nil {
+		return clicksOverTime, nil
+	}
+	defer clickCursor.Close(ctx)
+	for clickCursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err := clickCursor.Decode(&doc); err == nil {
+			clicksOverTime = append(clicksOverTime, map[string]interface{}{
+				"date":   doc["_id"],
+				"clicks": doc["clicks"],
+			})
+		}
+	}
+	return clicksOverTime, nil
+}
+
+func getTagDistribution(ctx context.Context, userID string) ([]map[string]interface{}, error) {
+	tagDistribution := []map[string]interface{}{}
+	tagPipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "is_active", Value: true},
+		}}},
+		bson.D{{Key: "$unwind", Value: "$tags"}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$tags"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: 10}},
+	}
+	tagCursor, err := DB.Collection.Aggregate(ctx, tagPipeline)
+	if err != nil {
+		return tagDistribution, nil
+	}
+	defer tagCursor.Close(ctx)
+	for tagCursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err := tagCursor.Decode(&doc); err == nil {
+			tagDistribution = append(tagDistribution, map[string]interface{}{
+				"tag":   doc["_id"],
+				"count": doc["count"],
+			})
+		}
+	}
+	return tagDistribution, nil
+}
+
+func getDomainDistribution(ctx context.Context, userID string) ([]map[string]interface{}, error) {
+	domainDistribution := []map[string]interface{}{}
+	domainPipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "is_active", Value: true},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$domain"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+	}
+	domainCursor, err := DB.Collection.Aggregate(ctx, domainPipeline)
+	if err != nil {
+		return domainDistribution, nil
+	}
+	defer domainCursor.Close(ctx)
+	for domainCursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err := domainCursor.Decode(&doc); err == nil {
+			domainDistribution = append(domainDistribution, map[string]interface{}{
+				"domain": doc["_id"],
+				"count":  doc["count"],
+			})
+		}
+	}
+	return domainDistribution, nil
+}
+
+func getTopLinks(ctx context.Context, userID string) ([]map[string]interface{}, error) {
+	topLinks := []map[string]interface{}{}
+	topPipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "is_active", Value: true},
+			{Key: "clicks", Value: bson.D{{Key: "$gt", Value: 0}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "clicks", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: 10}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "short_url", Value: 1},
+			{Key: "long_url", Value: 1},
+			{Key: "domain", Value: 1},
+			{Key: "tags", Value: 1},
+			{Key: "clicks", Value: 1},
+			{Key: "created_at", Value: 1},
+			{Key: "expires_at", Value: 1},
+			{Key: "is_active", Value: 1},
+			{Key: "_id", Value: 0},
+		}}},
+	}
+	topCursor, err := DB.Collection.Aggregate(ctx, topPipeline)
+	if err != nil {
+		return topLinks, nil
+	}
+	defer topCursor.Close(ctx)
+	for topCursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err := topCursor.Decode(&doc); err == nil {
+			topLinks = append(topLinks, doc)
+		}
+	}
+	return topLinks, nil
+}
+
+// GetUserAnalyticsPage returns one page of a user's URLs passing filter, their total count and,
+// when withStats is set, the same statistics as GetUserStatsOptimized - all from a single
+// $facet aggregation instead of one round trip per query. Links are sorted pinned first, then
+// newest first, before the $facet, where user_active_pinned_created_at_idx can serve the sort;
+// a sort inside a $facet never uses an index.
+func GetUserAnalyticsPage(ctx context.Context, urls *mongo.Collection, userID string, filter LinkFilter, skip, limit int, withStats bool, fields []string) ([]map[string]interface{}, int64, map[string]interface{}, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50 // Default limit
+	}
+	if skip < 0 {
+		skip = 0
+	}
+
+	now := clock.Now()
+	pipeline := analyticsPagePipeline(userID, filter, skip, limit, withStats, fields, now)
+
+	cursor, err := urls.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Data               []map[string]interface{} `bson:"data"`
+		Count              []struct{ Total int64 }  `bson:"count"`
+		Basic              []map[string]interface{} `bson:"basic"`
+		ClicksOverTime     []map[string]interface{} `bson:"clicks_over_time"`
+		TagDistribution    []map[string]interface{} `bson:"tag_distribution"`
+		DomainDistribution []map[string]interface{} `bson:"domain_distribution"`
+		TopLinks           []map[string]interface{} `bson:"top_links"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, 0, nil, err
+	}
+	if len(results) == 0 {
+		return nil, 0, nil, nil
+	}
+	page := results[0]
+
+	var total int64
+	if len(page.Count) > 0 {
+		total = page.Count[0].Total
+	}
+	if !withStats {
+		return page.Data, total, nil, nil
+	}
+
+	stats := map[string]interface{}{
+		"total_urls":          0,
+		"total_clicks":        0,
+		"avg_clicks_per_url":  0,
+		"clicks_over_time":    nonNilMaps(page.ClicksOverTime),
+		"tag_distribution":    nonNilMaps(page.TagDistribution),
+		"domain_distribution": nonNilMaps(page.DomainDistribution),
+		"top_links":           nonNilMaps(page.TopLinks),
+	}
+	if len(page.Basic) > 0 {
+		for k, v := range page.Basic[0] {
+			stats[k] = v
+		}
+	}
+	// The statistics only see active links, so the breakdown over all links is a second query
+	statusCounts, err := getStatusBreakdown(ctx, urls, userID, now)
+	if err != nil {
+		log.Printf("Warning: analytics aggregation for status_counts failed: %v", err)
+		statusCounts = newStatusCounts()
+	}
+	stats["status_counts"] = statusCounts
+	return page.Data, total, stats, nil
+}
+
+// analyticsPagePipeline builds the aggregation of GetUserAnalyticsPage, with statistics as of now
+func analyticsPagePipeline(userID string, filter LinkFilter, skip, limit int, withStats bool, fields []string, now time.Time) mongo.Pipeline {
+	// The filter narrows the page and count; the statistics cover every active link. Without
+	// statistics it joins the first $match instead, where user_tags_idx and user_domain_idx
+	// can serve it.
+	first := filter.mongoBaseMatch(userID)
+	listed := filter.mongoMatch()
+	if !withStats {
+		first = append(first, listed...)
+		listed = bson.D{}
+	}
+	activeStages := func(stages ...bson.D) bson.A {
+		pipeline := bson.A{}
+		if !filter.activeOnly() {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "is_active", Value: true}}}})
+		}
+		for _, stage := range stages {
+			pipeline = append(pipeline, stage)
+		}
+		return pipeline
+	}
+	facets := bson.D{
+		{Key: "data", Value: bson.A{
+			bson.D{{Key: "$match", Value: listed}},
+			bson.D{{Key: "$skip", Value: skip}},
+			bson.D{{Key: "$limit", Value: limit}},
+			bson.D{{Key: "$project", Value: linkListProjection(fields)}},
+		}},
+		{Key: "count", Value: bson.A{
+			bson.D{{Key: "$match", Value: listed}},
+			bson.D{{Key: "$count", Value: "total"}},
+		}},
+	}
+	if withStats {
+		since := now.AddDate(0, 0, -30)
+		facets = append(facets,
+			bson.E{Key: "basic", Value: activeStages(
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: nil},
+					{Key: "total_urls", Value: bson.D{{Key: "$sum", Value: 1}}},
+					{Key: "total_clicks", Value: bson.D{{Key: "$sum", Value: "$clicks"}}},
+					{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$avg", Value: "$clicks"}}},
+				}}},
+				bson.D{{Key: "$project", Value: bson.D{
+					{Key: "_id", Value: 0},
+					{Key: "total_urls", Value: 1},
+					{Key: "total_clicks", Value: 1},
+					{Key: "avg_clicks_per_url", Value: bson.D{{Key: "$round", Value: bson.A{"$avg_clicks_per_url", 2}}}},
+				}}},
+			)},
+			bson.E{Key: "clicks_over_time", Value: activeStages(
+				bson.D{{Key: "$match", Value: bson.D{{Key: "created_at", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+				bson.D{{Key: "$unwind", Value: "$click_history"}},
+				bson.D{{Key: "$match", Value: bson.D{{Key: "click_history.timestamp", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+						{Key: "format", Value: "%Y-%m-%d"},
+						{Key: "date", Value: "$click_history.timestamp"},
+					}}}},
+					{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "date", Value: "$_id"}, {Key: "clicks", Value: 1}}}},
+			)},
+			bson.E{Key: "tag_distribution", Value: activeStages(
+				bson.D{{Key: "$unwind", Value: "$tags"}},
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: "$tags"},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+				bson.D{{Key: "$limit", Value: 10}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "tag", Value: "$_id"}, {Key: "count", Value: 1}}}},
+			)},
+			bson.E{Key: "domain_distribution", Value: activeStages(
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: "$domain"},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "domain", Value: "$_id"}, {Key: "count", Value: 1}}}},
+			)},
+			bson.E{Key: "top_links", Value: activeStages(
+				bson.D{{Key: "$match", Value: bson.D{{Key: "clicks", Value: bson.D{{Key: "$gt", Value: 0}}}}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "clicks", Value: -1}}}},
+				bson.D{{Key: "$limit", Value: 10}},
+				bson.D{{Key: "$project", Value: bson.D{
+					{Key: "short_url", Value: 1},
+					{Key: "long_url", Value: 1},
+					{Key: "domain", Value: 1},
+					{Key: "tags", Value: 1},
+					{Key: "clicks", Value: 1},
+					{Key: "created_at", Value: 1},
+					{Key: "expires_at", Value: 1},
+					{Key: "is_active", Value: 1},
+					{Key: "_id", Value: 0},
+				}}},
+			)},
+		)
+	}
+
+	return mongo.Pipeline{
+		bson.D{{Key: "$match", Value: first}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pinned", Value: -1}, {Key: "created_at", Value: -1}}}},
+		bson.D{{Key: "$facet", Value: facets}},
+	}
+}
+
+// nonNilMaps keeps empty facets encoding as [] rather than null
+func nonNilMaps(docs []map[string]interface{}) []map[string]interface{} {
+	if docs == nil {
+		return []map[string]interface{}{}
+	}
+	return docs
+}
+
+// cleanupInterval is how often the cleanup worker runs across the whole deployment
+const cleanupInterval = 1 * time.Hour
+
+// StartCleanupWorker starts a background goroutine for periodic cleanup of expired URLs.
+// Every instance ticks, but a lease in the locks collection ensures only one runs per interval.
+func StartCleanupWorker() {
+	if DB == nil || DB.Database == nil {
+		log.Println("⚠️  Cleanup worker disabled: database not connected")
+		return
+	}
+	go func() {
+		log.Println("🧹 Starting cleanup worker for expired URLs...")
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ran := runExclusive("cleanup", cleanupInterval, func() (map[string]int64, error) {
+				deactivated, err := CleanupExpiredURLs()
+				if err != nil {
+					return map[string]int64{"deactivated": deactivated}, err
+				}
+				scheduled, err := ScheduleUnclickedExpiry()
+				if err != nil {
+					return map[string]int64{"deactivated": deactivated, "unclicked_scheduled": scheduled}, err
+				}
+				// Then prune the auxiliary collections per their retention policies
+				ctx, cancel := context.WithTimeout(context.Background(), cleanupInterval/2)
+				defer cancel()
+				counts, err := runMaintenance(ctx, DB.Database, liveConfig())
+				counts["deactivated"], counts["unclicked_scheduled"] = deactivated, scheduled
+				return counts, err
+			})
+			if ran {
+				log.Println("✅ Cleanup worker run finished")
+			}
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// MOBILE DEEP LINKS
+// ============================================================================
+
+// Device classes derived from the User-Agent, also used as deep-link branch names
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceOther   = "fallback"
+)
+
+// DeepLink holds per-platform destinations for app links
+type DeepLink struct {
+	IOS      string `bson:"ios,omitempty" json:"ios,omitempty"`
+	Android  string `bson:"android,omitempty" json:"android,omitempty"`
+	Fallback string `bson:"fallback,omitempty" json:"fallback,omitempty"`
+}
+
+// detectDeviceClass classifies a User-Agent as ios, android or fallback
+func detectDeviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return DeviceIOS
+	case strings.Contains(ua, "android"):
+		return DeviceAndroid
+	default:
+		return DeviceOther
+	}
+}
+
+// sanitizeDeepLink sanitizes every branch of a deep link in place
+func sanitizeDeepLink(deepLink *DeepLink) {
+	if deepLink == nil {
+		return
+	}
+	deepLink.IOS = sanitizeInput(deepLink.IOS)
+	deepLink.Android = sanitizeInput(deepLink.Android)
+	deepLink.Fallback = sanitizeInput(deepLink.Fallback)
+}
+
+// validateDeepLink runs URL validation on every configured branch
+func validateDeepLink(deepLink *DeepLink) error {
+	if deepLink == nil {
+		return nil
+	}
+	if deepLink.IOS == "" && deepLink.Android == "" && deepLink.Fallback == "" {
+		return fmt.Errorf("deep_link must define at least one of ios, android or fallback")
+	}
+	branches := map[string]string{
+		DeviceIOS:     deepLink.IOS,
+		DeviceAndroid: deepLink.Android,
+	}
+	for name, link := range branches {
+		if link != "" && !validateDeepLinkURL(link) {
+			return fmt.Errorf("invalid deep_link.%s URL", name)
+		}
+	}
+	// The fallback is served to browsers, so it must be a regular web URL
+	if deepLink.Fallback != "" && !validateURL(deepLink.Fallback) {
+		return fmt.Errorf("invalid deep_link.fallback URL. Must be a valid HTTP or HTTPS URL")
+	}
+	return nil
+}
+
+// selectDestination picks the redirect target for a link based on the device class,
+// returning the destination and the deep-link branch taken ("" when no deep link is set)
+func selectDestination(urlData *URLData, userAgent string) (string, string) {
+	deepLink := urlData.DeepLink
+	if deepLink == nil {
+		return urlData.LongURL, ""
+	}
+
+	switch detectDeviceClass(userAgent) {
+	case DeviceIOS:
+		if deepLink.IOS != "" {
+			return deepLink.IOS, DeviceIOS
+		}
+	case DeviceAndroid:
+		if deepLink.Android != "" {
+			return deepLink.Android, DeviceAndroid
+		}
+	}
+
+	if deepLink.Fallback != "" {
+		return deepLink.Fallback, DeviceOther
+	}
+	return urlData.LongURL, DeviceOther
+}
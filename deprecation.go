@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// DEPRECATIONS
+// ============================================================================
+//
+// Every deprecated route, parameter or response shape is an entry of the deprecations registry.
+// deprecationMiddleware matches each request against it and answers matches with a Deprecation
+// header (RFC 9745), a Sunset header (RFC 8594) once a removal date is configured, and a Link
+// to the replacement. The dates come from <ID>_DEPRECATED_AT and <ID>_SUNSET_AT (YYYY-MM-DD, e.g.
+// PROFILE_IMPLICIT_STATS_SUNSET_AT); without the first the header is "Deprecation: true". Each
+// consumer, the user or else the client IP, is logged once a day per deprecation, and
+// GET /admin/deprecation-usage lists who still uses what on this instance since it started.
+// To deprecate something, add an entry with a matcher; the handler itself needs no change.
+
+// deprecation is one deprecated surface of the API
+type deprecation struct {
+	ID          string
+	Description string
+	// Route is the method and path template it applies to, e.g. "GET /auth/profile"
+	Route string
+	// Matches narrows the route to the deprecated usage; nil matches every request
+	Matches func(r *http.Request) bool
+	// Link is the Link header pointing at the replacement, if any
+	Link string
+
+	since, sunset time.Time
+}
+
+// deprecations is the registry of deprecated surfaces
+var deprecations = []*deprecation{
+	{
+		ID:          "profile_implicit_stats",
+		Description: "GET /auth/profile without ?include= returns statistics; request ?include=stats",
+		Route:       "GET /auth/profile",
+		Matches: func(r *http.Request) bool {
+			_, implicit := profileIncludesStats(r)
+			return implicit
+		},
+		Link: `</auth/profile?include=stats>; rel="alternate"`,
+	},
+	{
+		ID:          "analytics_limit_param",
+		Description: "GET /analytics?limit= is replaced by ?pageSize=",
+		Route:       "GET /analytics",
+		Matches: func(r *http.Request) bool {
+			query := r.URL.Query()
+			return query.Get("limit") != "" && query.Get("pageSize") == ""
+		},
+	},
+}
+
+const deprecationConsumersMax = 10000
+
+// deprecationConsumer is how often one consumer used a deprecated surface
+type deprecationConsumer struct {
+	Consumer  string    `json:"consumer"`
+	Requests  int64     `json:"requests"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	warnedDay string
+}
+
+var (
+	deprecationUsage      = make(map[string]map[string]*deprecationConsumer)
+	deprecationUsageMutex sync.Mutex
+)
+
+// InitDeprecations loads the dates of the registry's entries
+func InitDeprecations() error {
+	for _, d := range deprecations {
+		prefix := strings.ToUpper(d.ID)
+		for _, field := range []struct {
+			env  string
+			date *time.Time
+		}{{prefix + "_DEPRECATED_AT", &d.since}, {prefix + "_SUNSET_AT", &d.sunset}} {
+			raw := os.Getenv(field.env)
+			if raw == "" {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", raw)
+			if err != nil {
+				return fmt.Errorf("%s must be a date (YYYY-MM-DD)", field.env)
+			}
+			*field.date = date
+		}
+		if !d.sunset.IsZero() {
+			log.Printf("📅 Deprecated %s is removed on %s", d.ID, d.sunset.Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// matchDeprecations returns the registry entries r uses
+func matchDeprecations(r *http.Request) []*deprecation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	template, _ := route.GetPathTemplate()
+	var matched []*deprecation
+	for _, d := range deprecations {
+		if d.Route == r.Method+" "+template && (d.Matches == nil || d.Matches(r)) {
+			matched = append(matched, d)
+		}
+	}
+	return matched
+}
+
+// deprecationMiddleware sets the deprecation headers of deprecated requests and records who
+// sent them once the handler has run
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched := matchDeprecations(r)
+		for _, d := range matched {
+			if d.since.IsZero() {
+				w.Header().Set("Deprecation", "true")
+			} else {
+				w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.since.Unix()))
+			}
+			if !d.sunset.IsZero() {
+				w.Header().Set("Sunset", d.sunset.Format(http.TimeFormat))
+			}
+			if d.Link != "" {
+				w.Header().Add("Link", d.Link)
+			}
+		}
+		next.ServeHTTP(w, r)
+
+		if len(matched) == 0 {
+			return
+		}
+		consumer := "ip:" + getClientIP(r)
+		if userID := requestInfoFrom(r.Context()).UserID; userID != "" {
+			consumer = "user:" + userID
+		}
+		for _, d := range matched {
+			recordDeprecatedUse(d, consumer, clock.Now())
+		}
+	})
+}
+
+// recordDeprecatedUse counts a use of d by consumer and logs it on the consumer's first use
+// of the day
+func recordDeprecatedUse(d *deprecation, consumer string, now time.Time) {
+	incMetric("deprecated_requests_total", 1)
+	day := now.UTC().Format("2006-01-02")
+
+	deprecationUsageMutex.Lock()
+	consumers := deprecationUsage[d.ID]
+	if consumers == nil {
+		consumers = make(map[string]*deprecationConsumer)
+		deprecationUsage[d.ID] = consumers
+	}
+	entry := consumers[consumer]
+	if entry == nil {
+		if len(consumers) >= deprecationConsumersMax {
+			deprecationUsageMutex.Unlock()
+			return
+		}
+		entry = &deprecationConsumer{Consumer: consumer, FirstSeen: now}
+		consumers[consumer] = entry
+	}
+	entry.Requests++
+	entry.LastSeen = now
+	warn := entry.warnedDay != day
+	entry.warnedDay = day
+	deprecationUsageMutex.Unlock()
+
+	if warn {
+		sunset := "no sunset date yet"
+		if !d.sunset.IsZero() {
+			sunset = "sunset " + d.sunset.Format("2006-01-02")
+		}
+		log.Printf("⚠️  WARN: %s still uses deprecated %s (%s)", consumer, d.ID, sunset)
+	}
+}
+
+// adminDeprecationUsage handles GET /admin/deprecation-usage
+func adminDeprecationUsage(w http.ResponseWriter, r *http.Request) {
+	deprecationUsageMutex.Lock()
+	entries := make([]map[string]interface{}, 0, len(deprecations))
+	for _, d := range deprecations {
+		consumers := make([]deprecationConsumer, 0, len(deprecationUsage[d.ID]))
+		var requests int64
+		for _, consumer := range deprecationUsage[d.ID] {
+			consumers = append(consumers, *consumer)
+			requests += consumer.Requests
+		}
+		sort.Slice(consumers, func(i, j int) bool { return consumers[i].Requests > consumers[j].Requests })
+		entry := map[string]interface{}{
+			"id":          d.ID,
+			"description": d.Description,
+			"route":       d.Route,
+			"requests":    requests,
+			"consumers":   consumers,
+		}
+		if !d.since.IsZero() {
+			entry["deprecated_at"] = d.since.Format("2006-01-02")
+		}
+		if !d.sunset.IsZero() {
+			entry["sunset_at"] = d.sunset.Format("2006-01-02")
+		}
+		entries = append(entries, entry)
+	}
+	deprecationUsageMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"deprecations": entries,
+		"since":        processStartedAt,
+	}); err != nil {
+		log.Printf("error encoding deprecation usage response: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withDeprecationDates configures the dates of the registry from env and starts the test
+// with no recorded usage
+func withDeprecationDates(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	deprecationUsageMutex.Lock()
+	saved := deprecationUsage
+	deprecationUsage = make(map[string]map[string]*deprecationConsumer)
+	deprecationUsageMutex.Unlock()
+	t.Cleanup(func() {
+		deprecationUsageMutex.Lock()
+		deprecationUsage = saved
+		deprecationUsageMutex.Unlock()
+		for _, d := range deprecations {
+			d.since, d.sunset = time.Time{}, time.Time{}
+		}
+	})
+	return InitDeprecations()
+}
+
+func TestInitDeprecationsRejectsBadDates(t *testing.T) {
+	if err := withDeprecationDates(t, map[string]string{"ANALYTICS_LIMIT_PARAM_SUNSET_AT": "30/06/2027"}); err == nil || !strings.Contains(err.Error(), "ANALYTICS_LIMIT_PARAM_SUNSET_AT") {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	err := withDeprecationDates(t, map[string]string{
+		"ANALYTICS_LIMIT_PARAM_DEPRECATED_AT": "2026-01-01",
+		"ANALYTICS_LIMIT_PARAM_SUNSET_AT":     "2027-06-30",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	// The legacy parameter is announced, with the configured dates
+	resp := srv.do("GET", "/analytics?limit=5", token, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Deprecation"); got != "@1767225600" {
+		t.Errorf("Deprecation %q", got)
+	}
+	if got := resp.Header.Get("Sunset"); got != "Wed, 30 Jun 2027 00:00:00 GMT" {
+		t.Errorf("Sunset %q", got)
+	}
+
+	// Its replacement, and the route without either, carry nothing
+	for _, path := range []string{"/analytics?pageSize=5", "/analytics?limit=5&pageSize=5", "/analytics"} {
+		resp := srv.do("GET", path, token, nil, nil)
+		if resp.Header.Get("Deprecation") != "" || resp.Header.Get("Sunset") != "" {
+			t.Errorf("%s: Deprecation %q, Sunset %q", path, resp.Header.Get("Deprecation"), resp.Header.Get("Sunset"))
+		}
+	}
+
+	// Browsers may read the headers
+	req, _ := http.NewRequest("GET", srv.URL+"/analytics?limit=5", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp = srv.send(req, nil)
+	if exposed := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Deprecation") || !strings.Contains(exposed, "Sunset") {
+		t.Errorf("Access-Control-Expose-Headers %q", exposed)
+	}
+}
+
+func TestDeprecationHeaderWithoutDate(t *testing.T) {
+	if err := withDeprecationDates(t, nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	resp := srv.do("GET", "/analytics?limit=5", token, nil, nil)
+	if resp.Header.Get("Deprecation") != "true" || resp.Header.Get("Sunset") != "" {
+		t.Fatalf("Deprecation %q, Sunset %q", resp.Header.Get("Deprecation"), resp.Header.Get("Sunset"))
+	}
+}
+
+func TestDeprecationUsage(t *testing.T) {
+	if err := withDeprecationDates(t, map[string]string{"ANALYTICS_LIMIT_PARAM_SUNSET_AT": "2027-06-30"}); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, userID := srv.register()
+
+	// One warning per consumer and day, however often it calls
+	for i := 0; i < 3; i++ {
+		srv.do("GET", "/analytics?limit=5", token, nil, nil)
+	}
+	warning := "user:" + userID + " still uses deprecated analytics_limit_param (sunset 2027-06-30)"
+	if n := strings.Count(logs.String(), warning); n != 1 {
+		t.Fatalf("%d warnings for three requests on one day", n)
+	}
+	SetClock(FixedClock(clockTestBase.Add(24 * time.Hour)))
+	srv.do("GET", "/analytics?limit=5", token, nil, nil)
+	if n := strings.Count(logs.String(), warning); n != 2 {
+		t.Fatalf("%d warnings after a second day", n)
+	}
+
+	var usage struct {
+		Deprecations []struct {
+			ID        string                `json:"id"`
+			Requests  int64                 `json:"requests"`
+			SunsetAt  string                `json:"sunset_at"`
+			Consumers []deprecationConsumer `json:"consumers"`
+		} `json:"deprecations"`
+	}
+	if resp := srv.do("GET", "/admin/deprecation-usage", admin, nil, &usage); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	found := false
+	for _, d := range usage.Deprecations {
+		if d.ID != "analytics_limit_param" {
+			continue
+		}
+		found = true
+		if d.Requests != 4 || d.SunsetAt != "2027-06-30" || len(d.Consumers) != 1 || d.Consumers[0].Consumer != "user:"+userID || d.Consumers[0].Requests != 4 {
+			t.Fatalf("usage %+v", d)
+		}
+		if !d.Consumers[0].FirstSeen.Equal(clockTestBase) || !d.Consumers[0].LastSeen.Equal(clockTestBase.Add(24*time.Hour)) {
+			t.Fatalf("first seen %s, last seen %s", d.Consumers[0].FirstSeen, d.Consumers[0].LastSeen)
+		}
+	}
+	if !found {
+		t.Fatal("analytics_limit_param missing from the usage")
+	}
+	if resp := srv.do("GET", "/admin/deprecation-usage", token, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("usage for a user: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// DEVELOPMENT SEED DATA
+// ============================================================================
+//
+// With SEED_DEMO_DATA=true an empty development database is filled on startup, so the
+// listing, analytics, folder and pattern views have something to show: a demo account
+// (seedDemoUsername, password SEED_DEMO_PASSWORD or seedDemoDefaultPassword), a "Spring
+// campaign" folder, seedDemoLinks links across several tags and domains with clicks spread
+// over the last seedDemoClickDays days, and one expired link. The tree has neither campaigns
+// nor per-user webhooks, so the campaign is a folder and webhooks are left to WEBHOOK_OPS_URL.
+// Everything goes through UserStore and URLStore, so every backend can be seeded. Seeding is
+// skipped when the demo account exists, and refused with APP_ENV=production.
+
+const (
+	seedDemoUsername        = "demo"
+	seedDemoEmail           = "demo@rapidlink.local"
+	seedDemoDefaultPassword = "demo-password-1"
+	seedDemoLinks           = 50
+	seedDemoClickDays       = 60
+	seedDemoMaxClicks       = 80
+)
+
+var (
+	seedDemoTags    = []string{"marketing", "docs", "social", "product", "events"}
+	seedDemoDomains = []string{"", "go.example.com", "links.example.org"}
+	seedDemoSites   = []string{"example.com", "example.org", "blog.example.net", "shop.example.com"}
+	// seedDemoUserAgents mix desktop, mobile and bot clicks
+	seedDemoUserAgents = []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Mobile Safari/537.36",
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+	}
+	seedDemoReferrers = []string{"", "", "news.ycombinator.com", "twitter.com", "www.google.com", "www.linkedin.com"}
+)
+
+// InitDemoSeed seeds the demo data when SEED_DEMO_DATA is set
+func InitDemoSeed() error {
+	if !strings.EqualFold(os.Getenv("SEED_DEMO_DATA"), "true") {
+		return nil
+	}
+	if strings.EqualFold(os.Getenv("APP_ENV"), "production") {
+		return errors.New("SEED_DEMO_DATA is refused with APP_ENV=production")
+	}
+	password := os.Getenv("SEED_DEMO_PASSWORD")
+	if password == "" {
+		password = seedDemoDefaultPassword
+	}
+	if !validatePassword(password) {
+		return errors.New("SEED_DEMO_PASSWORD must be 8-128 characters with a letter and a number")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	seeded, err := seedDemoData(ctx, Users, Links, password, clock.Now())
+	if err != nil {
+		return fmt.Errorf("seeding demo data: %w", err)
+	}
+	if seeded {
+		log.Printf("🌱 Seeded demo data: log in as %q with password %q", seedDemoUsername, password)
+	} else {
+		log.Printf("🌱 Demo account %q exists, demo data not seeded again", seedDemoUsername)
+	}
+	return nil
+}
+
+// seedDemoData creates the demo account and its links, folder and clicks as of now; false when
+// the demo account already exists
+func seedDemoData(ctx context.Context, users UserStore, links URLStore, password string, now time.Time) (bool, error) {
+	if _, err := users.FindUserByLogin(ctx, seedDemoUsername); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return false, err
+	}
+	user := &User{
+		Username:      seedDemoUsername,
+		Email:         seedDemoEmail,
+		Password:      hashed,
+		CreatedAt:     now.AddDate(0, 0, -seedDemoClickDays),
+		IsActive:      true,
+		EmailVerified: true,
+	}
+	if err := users.CreateUser(ctx, user); errors.Is(err, ErrDuplicate) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	userID := user.ID.Hex()
+
+	campaign := newFolder(userID, "Spring campaign", nil, now)
+	if err := links.InsertFolder(ctx, campaign); err != nil {
+		return false, err
+	}
+
+	// A fixed seed gives every developer the same dashboard
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < seedDemoLinks; i++ {
+		createdAt := now.AddDate(0, 0, -seedDemoClickDays+i%seedDemoClickDays).Add(-time.Hour)
+		link := seedDemoLink(userID, i, createdAt, now)
+		link.ShortURL = generateReadableCode(links, link.LongURL)
+		if i%5 == 0 {
+			link.FolderID = campaign.ID.Hex()
+			link.Tags = append(link.Tags, "campaign")
+		}
+		link.Pinned = i < 3
+		if err := links.InsertLink(ctx, link); err != nil {
+			return false, fmt.Errorf("link %s: %w", link.ShortURL, err)
+		}
+		if err := seedDemoClicks(ctx, links, link, rng, createdAt, now); err != nil {
+			return false, fmt.Errorf("clicks of %s: %w", link.ShortURL, err)
+		}
+	}
+
+	// One link expired a week ago, to show expired links in listings and on redirect
+	expiredAt := now.AddDate(0, 0, -7)
+	expired := seedDemoLink(userID, seedDemoLinks, now.AddDate(0, 0, -seedDemoClickDays), now)
+	expired.ShortURL = generateReadableCode(links, expired.LongURL)
+	expired.ExpiresAt = &expiredAt
+	expired.IsActive = false
+	expired.DeactivatedReason = DeactivatedExpired
+	if err := links.InsertLink(ctx, expired); err != nil {
+		return false, fmt.Errorf("expired link: %w", err)
+	}
+	return true, nil
+}
+
+// seedDemoLink returns the i-th demo link, created at createdAt and expiring a year after now
+func seedDemoLink(userID string, i int, createdAt, now time.Time) *URLData {
+	site := seedDemoSites[i%len(seedDemoSites)]
+	expiresAt := now.AddDate(1, 0, 0)
+	return &URLData{
+		LongURL:      fmt.Sprintf("https://%s/demo/page-%02d", site, i+1),
+		Domain:       seedDemoDomains[i%len(seedDemoDomains)],
+		Tags:         []string{seedDemoTags[i%len(seedDemoTags)]},
+		UserID:       userID,
+		Title:        fmt.Sprintf("Demo page %d", i+1),
+		CreatedAt:    createdAt,
+		UpdatedAt:    &createdAt,
+		ExpiresAt:    &expiresAt,
+		IsActive:     true,
+		ClickHistory: []ClickHistory{},
+	}
+}
+
+// seedDemoClicks records a random number of clicks on link between createdAt and now, oldest
+// first. Visitor addresses come from the documentation ranges.
+func seedDemoClicks(ctx context.Context, links URLStore, link *URLData, rng *rand.Rand, createdAt, now time.Time) error {
+	count := rng.Intn(seedDemoMaxClicks + 1)
+	span := now.Sub(createdAt)
+	offsets := make([]time.Duration, count)
+	for i := range offsets {
+		offsets[i] = time.Duration(rng.Int63n(int64(span)))
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		click := ClickHistory{
+			Timestamp:    createdAt.Add(offset).UTC(),
+			IP:           fmt.Sprintf("203.0.113.%d", 1+rng.Intn(254)),
+			UserAgent:    seedDemoUserAgents[rng.Intn(len(seedDemoUserAgents))],
+			ReferrerHost: seedDemoReferrers[rng.Intn(len(seedDemoReferrers))],
+		}
+		if err := links.RecordClick(ctx, link, click); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+// seededLinks returns "code clicks" for every link of userID, sorted
+func seededLinks(t *testing.T, store URLStore, userID string) []string {
+	t.Helper()
+	docs, _, _, err := store.ListLinks(context.Background(), userID, LinkFilter{Status: linkStatusAll}, 0, 100, false, []string{"short_url", "clicks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		links = append(links, fmt.Sprintf("%v %v", doc["short_url"], doc["clicks"]))
+	}
+	sort.Strings(links)
+	return links
+}
+
+func TestSeedDemoDataTwice(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	now := clock.Now()
+
+	if seeded, err := seedDemoData(ctx, Users, srv.links, seedDemoDefaultPassword, now); err != nil || !seeded {
+		t.Fatalf("first run: %v, %v", seeded, err)
+	}
+	user, err := Users.FindUserByLogin(ctx, seedDemoUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := user.ID.Hex()
+	first := seededLinks(t, srv.links, userID)
+	if len(first) != seedDemoLinks+1 {
+		t.Fatalf("%d links seeded, want %d", len(first), seedDemoLinks+1)
+	}
+	folders, err := srv.links.ListFolders(ctx, userID, "")
+	if err != nil || len(folders) != 1 {
+		t.Fatalf("folders %v, %v", folders, err)
+	}
+
+	// The second run finds the account and adds nothing
+	if seeded, err := seedDemoData(ctx, Users, srv.links, seedDemoDefaultPassword, now.Add(24*time.Hour)); err != nil || seeded {
+		t.Fatalf("second run: %v, %v", seeded, err)
+	}
+	if again := seededLinks(t, srv.links, userID); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Fatalf("links changed by the second run:\n%v\n%v", again, first)
+	}
+	if folders, _ := srv.links.ListFolders(ctx, userID, ""); len(folders) != 1 {
+		t.Fatalf("%d folders after the second run", len(folders))
+	}
+
+	// The demo account works, and sees its clicks, tags and the expired link
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if resp := srv.login(seedDemoUsername, seedDemoDefaultPassword, &auth); resp.StatusCode != http.StatusOK {
+		t.Fatalf("demo login: status %d", resp.StatusCode)
+	}
+	var expired struct {
+		URLs []struct {
+			ShortURL string `json:"short_url"`
+		} `json:"urls"`
+	}
+	srv.do("GET", "/analytics?status=expired", auth.Token, nil, &expired)
+	if len(expired.URLs) != 1 {
+		t.Errorf("%d expired demo links", len(expired.URLs))
+	}
+}
+
+func TestInitDemoSeed(t *testing.T) {
+	newTestServer(t)
+	t.Setenv("SEED_DEMO_DATA", "true")
+	t.Setenv("APP_ENV", "production")
+	if err := InitDemoSeed(); err == nil {
+		t.Fatal("seeding allowed in production")
+	}
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("SEED_DEMO_PASSWORD", "short")
+	if err := InitDemoSeed(); err == nil {
+		t.Fatal("weak demo password accepted")
+	}
+	if _, err := Users.FindUserByLogin(context.Background(), seedDemoUsername); err == nil {
+		t.Fatal("refused seeding created the demo account")
+	}
+
+	t.Setenv("SEED_DEMO_PASSWORD", "")
+	for i := 0; i < 2; i++ {
+		if err := InitDemoSeed(); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	if _, err := Users.FindUserByLogin(context.Background(), seedDemoUsername); err != nil {
+		t.Fatalf("demo account: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// DISPOSABLE EMAIL DOMAINS
+// ============================================================================
+//
+// register() checks the email domain (and its parent domains) against a list of throwaway
+// mail providers: the embedded disposable_domains.txt, or the file named by
+// DISPOSABLE_EMAIL_DOMAINS_FILE, plus the disposable_domains of CONFIG_FILE. The list is
+// reloaded with the live configuration (see runtime_config.go) and by POST
+// /admin/disposable-domains/reload; a reload that fails keeps the current list.
+// DISPOSABLE_EMAIL_MODE decides what a match does:
+//   - "block" (default): registration is refused with DISPOSABLE_EMAIL
+//   - "flag": the account is created restricted
+//   - "off": the list is not checked
+//
+// A restricted account gets RESTRICTED_URL_QUOTA active links (default 10) and its links
+// show an interstitial before the destination, until its email is verified and it is at
+// least 24 hours old. There is no self-service verification yet: an admin marks the email
+// verified with POST /admin/users/{id}/verify-email. Like suspensions, restricted owners
+// are kept in memory on every instance and reloaded every minute.
+
+//go:embed disposable_domains.txt
+var embeddedDisposableDomains string
+
+const (
+	DisposableEmailBlock = "block"
+	DisposableEmailFlag  = "flag"
+	DisposableEmailOff   = "off"
+)
+
+const (
+	restrictedAccountAge          = 24 * time.Hour
+	defaultRestrictedURLQuota     = 10
+	restrictedOwnersRefreshEvery  = time.Minute
+	disposableDomainsEmbeddedName = "embedded list"
+)
+
+// disposableDomainList is the current set of disposable domains
+type disposableDomainList struct {
+	mu      sync.RWMutex
+	domains map[string]bool
+	source  string
+}
+
+var (
+	disposableDomains   = &disposableDomainList{domains: make(map[string]bool)}
+	disposableEmailMode = DisposableEmailBlock
+	restrictedOwners    = newUserIDSet("restricted_users")
+)
+
+// parseDisposableDomains reads one domain per line, skipping blank lines and # comments
+func parseDisposableDomains(raw string) map[string]bool {
+	domains := make(map[string]bool)
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.TrimLeft(strings.ToLower(line), "@.")] = true
+	}
+	return domains
+}
+
+// Reload replaces the list from DISPOSABLE_EMAIL_DOMAINS_FILE, or the embedded list when it
+// is unset, plus the disposable_domains of CONFIG_FILE, returning the number of domains loaded
+func (l *disposableDomainList) Reload() (int, error) {
+	raw, source := embeddedDisposableDomains, disposableDomainsEmbeddedName
+	if path := os.Getenv("DISPOSABLE_EMAIL_DOMAINS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, fmt.Errorf("DISPOSABLE_EMAIL_DOMAINS_FILE: %v", err)
+		}
+		raw, source = string(data), path
+	}
+	domains := parseDisposableDomains(raw)
+	for _, domain := range liveConfig().disposableDomains {
+		domains[domain] = true
+	}
+	l.mu.Lock()
+	l.domains, l.source = domains, source
+	l.mu.Unlock()
+	setGauge("disposable_domains", int64(len(domains)))
+	return len(domains), nil
+}
+
+// Match reports whether email is on a listed domain or a subdomain of one
+func (l *disposableDomainList) Match(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.TrimSuffix(strings.ToLower(email[at+1:]), ".")
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for domain != "" {
+		if l.domains[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+// InitDisposableEmail reads DISPOSABLE_EMAIL_MODE and loads the domain list
+func InitDisposableEmail() error {
+	switch mode := strings.ToLower(os.Getenv("DISPOSABLE_EMAIL_MODE")); mode {
+	case "":
+	case DisposableEmailBlock, DisposableEmailFlag, DisposableEmailOff:
+		disposableEmailMode = mode
+	default:
+		return fmt.Errorf("DISPOSABLE_EMAIL_MODE must be block, flag or off")
+	}
+	if disposableEmailMode == DisposableEmailOff {
+		return nil
+	}
+	count, err := disposableDomains.Reload()
+	if err != nil {
+		return err
+	}
+	log.Printf("📭 Disposable email domains: %d loaded, mode %s", count, disposableEmailMode)
+	return nil
+}
+
+// disposableEmailAction returns what registration does with email: "" to proceed normally,
+// or DisposableEmailBlock / DisposableEmailFlag for a listed domain
+func disposableEmailAction(email string) string {
+	if disposableEmailMode == DisposableEmailOff || !disposableDomains.Match(email) {
+		return ""
+	}
+	return disposableEmailMode
+}
+
+// adminReloadDisposableDomains handles POST /admin/disposable-domains/reload
+func adminReloadDisposableDomains(w http.ResponseWriter, r *http.Request) {
+	count, err := disposableDomains.Reload()
+	if err != nil {
+		log.Printf("error reloading disposable email domains: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	disposableDomains.mu.RLock()
+	source := disposableDomains.source
+	disposableDomains.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"domains": count,
+		"source":  source,
+		"mode":    disposableEmailMode,
+	}); err != nil {
+		log.Printf("error encoding disposable domains response: %v", err)
+	}
+}
+
+// ============================================================================
+// RESTRICTED ACCOUNTS
+// ============================================================================
+
+// restrictedURLQuota returns the active link quota of restricted accounts
+func restrictedURLQuota() int {
+	return envInt("RESTRICTED_URL_QUOTA", defaultRestrictedURLQuota)
+}
+
+// refreshRestrictedOwners reloads the restricted accounts from the user store
+func refreshRestrictedOwners() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ids, err := Users.RestrictedUserIDs(ctx, clock.Now().Add(-restrictedAccountAge))
+	if err != nil {
+		return err
+	}
+	restrictedOwners.replace(ids)
+	return nil
+}
+
+// StartRestrictionRefresh loads the restricted accounts and keeps them current; accounts
+// leave the set once verified and a day old
+func StartRestrictionRefresh() {
+	if err := refreshRestrictedOwners(); err != nil {
+		log.Printf("⚠️  Could not load restricted accounts: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(restrictedOwnersRefreshEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := refreshRestrictedOwners(); err != nil {
+				log.Printf("⚠️  Restricted accounts refresh failed: %v", err)
+			}
+		}
+	}()
+}
+
+// writeRestrictedInterstitial shows the destination of a restricted account's link on a
+// page instead of redirecting to it
+func writeRestrictedInterstitial(w http.ResponseWriter, r *http.Request, destination, note string) {
+	setNoStoreHeaders(w)
+	writeLocalizedNotePage(w, r, http.StatusOK, "link_interstitial", destination, note)
+}
+
+// adminVerifyEmail handles POST /admin/users/{id}/verify-email
+func adminVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	targetID := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(targetID)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found, err := Users.SetEmailVerified(ctx, id)
+	if err != nil {
+		log.Printf("error marking email of user %s verified: %v", targetID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := refreshRestrictedOwners(); err != nil {
+		log.Printf("⚠️  Restricted accounts refresh failed: %v", err)
+	}
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "EMAIL_VERIFIED_BY_ADMIN", adminID, getClientIP(r), r.UserAgent(),
+		"Email of account "+targetID+" marked verified", "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"user_id":        targetID,
+		"email_verified": true,
+		"restricted":     restrictedOwners.Has(targetID),
+	}); err != nil {
+		log.Printf("error encoding verify email response: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// withDisposableEmailMode switches the disposable email mode for one test
+func withDisposableEmailMode(t *testing.T, mode string) {
+	t.Helper()
+	saved := disposableEmailMode
+	disposableEmailMode = mode
+	t.Cleanup(func() { disposableEmailMode = saved })
+}
+
+// registration is the answer to POST /auth/register
+type registration struct {
+	status int
+	code   string // error code of a refused registration
+	token  string
+	userID string
+}
+
+// registerEmail registers an account called name with email
+func (s *testServer) registerEmail(name, email string) registration {
+	s.t.Helper()
+	var auth struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	resp := s.do("POST", "/auth/register", "", map[string]string{
+		"username": name, "email": email, "password": "correct-horse-1",
+	}, &auth)
+	return registration{status: resp.StatusCode, code: auth.Error.Code, token: auth.Token, userID: auth.User.ID.Hex()}
+}
+
+func TestParseDisposableDomains(t *testing.T) {
+	got := parseDisposableDomains("# comment\n\n  Mailinator.COM \n@trash.example\n.sub.example\r\n   # indented comment\n")
+	if len(got) != 3 || !got["mailinator.com"] || !got["trash.example"] || !got["sub.example"] {
+		t.Fatalf("parseDisposableDomains = %v", got)
+	}
+}
+
+func TestDisposableDomainMatch(t *testing.T) {
+	list := &disposableDomainList{domains: parseDisposableDomains("mailinator.com\ntrash.example.org\n")}
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"someone@mailinator.com", true},
+		{"someone@MAILINATOR.COM", true},
+		{"someone@mailinator.com.", true},
+		{"someone@inbox.mailinator.com", true},
+		{"someone@a.b.trash.example.org", true},
+		{"odd@name@mailinator.com", true},
+		{"someone@example.org", false},
+		{"someone@notmailinator.com", false},
+		{"someone@mailinator.com.evil.net", false},
+		{"mailinator.com@example.com", false},
+		{"no-at-sign", false},
+	}
+	for _, tt := range tests {
+		if got := list.Match(tt.email); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestDisposableEmailBlocked(t *testing.T) {
+	withDisposableEmailMode(t, DisposableEmailBlock)
+	srv := newTestServer(t)
+	for _, email := range []string{"blocked@mailinator.com", "blocked@inbox.Guerrillamail.com"} {
+		if got := srv.registerEmail("blocked", email); got.status != http.StatusBadRequest || got.code != ErrCodeDisposableEmail {
+			t.Fatalf("%s: status %d, code %q", email, got.status, got.code)
+		}
+	}
+	if got := srv.registerEmail("welcome", "welcome@example.com"); got.status != http.StatusCreated {
+		t.Fatalf("regular email: status %d", got.status)
+	}
+
+	withDisposableEmailMode(t, DisposableEmailOff)
+	if got := srv.registerEmail("unchecked", "unchecked@mailinator.com"); got.status != http.StatusCreated {
+		t.Fatalf("mode off: status %d", got.status)
+	}
+}
+
+func TestDisposableEmailFlagged(t *testing.T) {
+	withDisposableEmailMode(t, DisposableEmailFlag)
+	t.Setenv("RESTRICTED_URL_QUOTA", "2")
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	flagged := srv.registerEmail("flagged", "flagged@mailinator.com")
+	token, userID := flagged.token, flagged.userID
+	if flagged.status != http.StatusCreated || !restrictedOwners.Has(userID) {
+		t.Fatalf("status %d, restricted %v", flagged.status, restrictedOwners.Has(userID))
+	}
+	t.Cleanup(func() { restrictedOwners.set(userID, false) })
+
+	// Lower quota
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/first"})
+	srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/second"})
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/third"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("link over the restricted quota: status %d", resp.StatusCode)
+	}
+
+	// Interstitial instead of the redirect
+	resp := srv.do("GET", "/"+code, "", nil, nil)
+	if page := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(page, "Before you continue") || !strings.Contains(page, "https://example.com/first") {
+		t.Fatalf("restricted link: status %d\n%s", resp.StatusCode, page)
+	}
+
+	// Verified, but not a day old yet (accounts are created at wall-clock time)
+	now := time.Now().UTC()
+	freezeClock(t, now)
+	var verified struct {
+		EmailVerified bool `json:"email_verified"`
+		Restricted    bool `json:"restricted"`
+	}
+	if resp := srv.do("POST", "/admin/users/"+userID+"/verify-email", admin, map[string]interface{}{}, &verified); resp.StatusCode != http.StatusOK {
+		t.Fatalf("verify-email: status %d", resp.StatusCode)
+	}
+	if !verified.EmailVerified || !verified.Restricted {
+		t.Fatalf("verified on the first day: %+v", verified)
+	}
+	if resp := srv.do("POST", "/admin/users/"+primitive.NewObjectID().Hex()+"/verify-email", admin, map[string]interface{}{}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("verify-email of an unknown user: status %d", resp.StatusCode)
+	}
+
+	// A day later the refresh lifts the restriction
+	SetClock(FixedClock(now.Add(restrictedAccountAge + time.Minute)))
+	if err := refreshRestrictedOwners(); err != nil {
+		t.Fatal(err)
+	}
+	if restrictedOwners.Has(userID) {
+		t.Fatal("verified account still restricted after a day")
+	}
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("link after the restriction ended: status %d", resp.StatusCode)
+	}
+	srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/third"})
+}
+
+func TestDisposableDomainsReload(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	withDisposableEmailMode(t, DisposableEmailBlock)
+	// Runs after t.Setenv has restored DISPOSABLE_EMAIL_DOMAINS_FILE
+	t.Cleanup(func() { disposableDomains.Reload() })
+
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(path, []byte("# ours\nthrowaway.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DISPOSABLE_EMAIL_DOMAINS_FILE", path)
+	if got := srv.registerEmail("before", "before@throwaway.example"); got.status != http.StatusCreated {
+		t.Fatalf("before the reload: status %d", got.status)
+	}
+
+	var reloaded struct {
+		Domains int    `json:"domains"`
+		Source  string `json:"source"`
+		Mode    string `json:"mode"`
+	}
+	if resp := srv.do("POST", "/admin/disposable-domains/reload", admin, map[string]interface{}{}, &reloaded); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload: status %d", resp.StatusCode)
+	}
+	if reloaded.Domains != 1 || reloaded.Source != path || reloaded.Mode != DisposableEmailBlock {
+		t.Fatalf("reload answered %+v", reloaded)
+	}
+	if got := srv.registerEmail("after", "after@throwaway.example"); got.status != http.StatusBadRequest {
+		t.Fatalf("after the reload: status %d", got.status)
+	}
+	// The file replaces the embedded list
+	if got := srv.registerEmail("replaced", "replaced@mailinator.com"); got.status != http.StatusCreated {
+		t.Fatalf("embedded domain after the reload: status %d", got.status)
+	}
+
+	// A failed reload keeps the current list
+	os.Remove(path)
+	if resp := srv.do("POST", "/admin/disposable-domains/reload", admin, map[string]interface{}{}, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("reload of a missing file: status %d", resp.StatusCode)
+	}
+	if !disposableDomains.Match("again@throwaway.example") {
+		t.Fatal("failed reload dropped the list")
+	}
+
+	// Non-admins cannot reload
+	user, _ := srv.register()
+	if resp := srv.do("POST", "/admin/disposable-domains/reload", user, map[string]interface{}{}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("reload by a user: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// ENGAGEMENT PATTERNS
+// ============================================================================
+//
+// When do people click? With ?include_patterns=true, GET /url/{code}/clicks adds the link's
+// clicks by hour of day and by day of week as engagement_patterns, and GET /analytics adds
+// the same for all of the account's links over the last engagementPatternDays. Hours and
+// days are those of the user's time zone, set with PUT /auth/timezone; without one they are
+// UTC and timezone_fallback is true. Bot clicks are left out. heatmap[d][h] is the weekday by
+// hour grid the two breakdowns are the sums of; weekdays run from Monday (0) to Sunday (6).
+// Fewer than lowConfidenceClicks clicks are flagged low_confidence.
+
+const (
+	lowConfidenceClicks = 20
+	// engagementPatternDays bounds the account-wide patterns; a link's cover all its clicks
+	engagementPatternDays = 90
+)
+
+// ClickHeatmap counts clicks per weekday (Monday first) and hour of day
+type ClickHeatmap [7][24]int64
+
+// add counts a click at t in loc
+func (h *ClickHeatmap) add(t time.Time, loc *time.Location) {
+	local := t.In(loc)
+	h[(int(local.Weekday())+6)%7][local.Hour()]++
+}
+
+// EngagementPatterns is the engagement_patterns object of link and account analytics
+type EngagementPatterns struct {
+	Timezone         string       `json:"timezone"`
+	TimezoneFallback bool         `json:"timezone_fallback"`
+	Since            *time.Time   `json:"since,omitempty"`
+	TotalClicks      int64        `json:"total_clicks"`
+	LowConfidence    bool         `json:"low_confidence"`
+	ByHour           [24]int64    `json:"by_hour"`
+	ByWeekday        [7]int64     `json:"by_weekday"`
+	Weekdays         []string     `json:"weekdays"`
+	Heatmap          ClickHeatmap `json:"heatmap"`
+}
+
+// weekdayNames label by_weekday and the heatmap rows
+var weekdayNames = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+// newEngagementPatterns sums heatmap into the hour and weekday breakdowns
+func newEngagementPatterns(heatmap ClickHeatmap, loc *time.Location, fallback bool) *EngagementPatterns {
+	patterns := &EngagementPatterns{
+		Timezone:         loc.String(),
+		TimezoneFallback: fallback,
+		Weekdays:         weekdayNames,
+		Heatmap:          heatmap,
+	}
+	for day, hours := range heatmap {
+		for hour, clicks := range hours {
+			patterns.ByHour[hour] += clicks
+			patterns.ByWeekday[day] += clicks
+			patterns.TotalClicks += clicks
+		}
+	}
+	patterns.LowConfidence = patterns.TotalClicks < lowConfidenceClicks
+	return patterns
+}
+
+// userLocation returns the user's time zone; UTC and true when none is set or it no longer loads
+func userLocation(userID string) (*time.Location, bool) {
+	user, err := GetUserByID(userID)
+	if err != nil || user.Timezone == "" {
+		return time.UTC, true
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		return time.UTC, true
+	}
+	return loc, false
+}
+
+// includePatterns reads ?include_patterns=
+func includePatterns(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("include_patterns")
+	if raw == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
+// engagementPatterns computes the patterns of link or, when link is nil, of the user's account
+func engagementPatterns(ctx context.Context, store URLStore, userID string, link *URLData) (*EngagementPatterns, error) {
+	loc, fallback := userLocation(userID)
+	var since time.Time
+	if link == nil {
+		since = clock.Now().UTC().AddDate(0, 0, -engagementPatternDays)
+	}
+	heatmap, err := store.ClickHeatmap(ctx, userID, link, since, loc)
+	if err != nil {
+		return nil, err
+	}
+	patterns := newEngagementPatterns(heatmap, loc, fallback)
+	if link == nil {
+		patterns.Since = &since
+	}
+	return patterns, nil
+}
+
+// normalizeTimezone validates an IANA time zone name; UTC is stored as ""
+func normalizeTimezone(raw string) (string, error) {
+	timezone := strings.TrimSpace(raw)
+	if timezone == "UTC" {
+		return "", nil
+	}
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return "", fmt.Errorf("timezone must be an IANA time zone such as Europe/Berlin")
+		}
+	}
+	return timezone, nil
+}
+
+// setTimezone handles PUT /auth/timezone {"timezone": "Europe/Berlin"}; "" resets to UTC
+func setTimezone(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	timezone, err := normalizeTimezone(req.Timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "user", "failed to load account")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := Users.SetTimezone(ctx, user.ID, timezone); err != nil {
+		log.Printf("error saving timezone of user %s: %v", userID, err)
+		writeStoreError(w, err, "user", "failed to save timezone")
+		return
+	}
+
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"timezone": timezone,
+	}); err != nil {
+		log.Printf("error encoding timezone response: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// seedClickTimes stores a click with userAgent at each of times on the link
+func seedClickTimes(s *testServer, code, userAgent string, times ...time.Time) {
+	s.t.Helper()
+	for _, at := range times {
+		s.addClicks(code, ClickHistory{Timestamp: at, UserAgent: userAgent})
+	}
+}
+
+func TestClickHeatmapTimezones(t *testing.T) {
+	tests := []struct {
+		at       string
+		timezone string
+		day      int // Monday is 0
+		hour     int
+	}{
+		// Monday early morning in UTC is still Sunday evening in New York
+		{"2031-03-03T02:30:00Z", "America/New_York", 6, 21},
+		{"2031-03-03T02:30:00Z", "UTC", 0, 2},
+		{"2031-03-03T02:30:00Z", "Asia/Kolkata", 0, 8},
+		// Either side of the US switch to daylight saving time on 9 March 2031
+		{"2031-03-09T06:30:00Z", "America/New_York", 6, 1},
+		{"2031-03-09T07:30:00Z", "America/New_York", 6, 3},
+		// New Year's Day in UTC, New Year's Eve in Los Angeles
+		{"2031-01-01T03:00:00Z", "America/Los_Angeles", 1, 19},
+		// Sunday noon in UTC is already Monday in Samoa
+		{"2031-03-02T12:00:00Z", "Pacific/Apia", 0, 1},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.timezone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var heatmap ClickHeatmap
+		heatmap.add(mustParseTime(t, tt.at), loc)
+		if heatmap[tt.day][tt.hour] != 1 {
+			t.Errorf("%s in %s not counted on day %d at %d:00: %v", tt.at, tt.timezone, tt.day, tt.hour, heatmap)
+		}
+	}
+}
+
+func TestEngagementPatterns(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/patterns"})
+	second := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/patterns-2"})
+	foreign := srv.shorten(other, map[string]interface{}{"long-url": "https://example.com/foreign"})
+
+	browser := "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"
+	// Monday 02:30 UTC, which is Sunday 21:30 in New York
+	seedClickTimes(srv, code, browser, mustParseTime(t, "2031-02-24T02:30:00Z"), mustParseTime(t, "2031-02-24T02:45:00Z"))
+	seedClickTimes(srv, code, "Googlebot/2.1 (+http://www.google.com/bot.html)", mustParseTime(t, "2031-02-24T02:30:00Z"))
+	// Wednesday 15:00 UTC, and one from long before the account-wide window
+	seedClickTimes(srv, second, browser, mustParseTime(t, "2031-02-26T15:00:00Z"), mustParseTime(t, "2030-06-01T15:00:00Z"))
+	seedClickTimes(srv, foreign, browser, mustParseTime(t, "2031-02-26T15:00:00Z"))
+
+	var page struct {
+		Patterns EngagementPatterns `json:"engagement_patterns"`
+	}
+	// Without a time zone the patterns are in UTC, and say so
+	srv.do("GET", "/url/"+code+"/clicks?include_patterns=true", token, nil, &page)
+	if p := page.Patterns; !p.TimezoneFallback || p.Timezone != "UTC" || p.TotalClicks != 2 || p.ByHour[2] != 2 || p.ByWeekday[0] != 2 || p.Heatmap[0][2] != 2 || !p.LowConfidence {
+		t.Fatalf("UTC patterns %+v", p)
+	}
+
+	if resp := srv.do("PUT", "/auth/timezone", token, map[string]string{"timezone": "America/New_York"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set timezone: status %d", resp.StatusCode)
+	}
+	page.Patterns = EngagementPatterns{}
+	srv.do("GET", "/url/"+code+"/clicks?include_patterns=true", token, nil, &page)
+	if p := page.Patterns; p.TimezoneFallback || p.Timezone != "America/New_York" || p.ByHour[21] != 2 || p.ByWeekday[6] != 2 || p.Heatmap[6][21] != 2 || p.Since != nil {
+		t.Fatalf("New York patterns %+v", p)
+	}
+
+	// Account-wide: every link of the owner, over the last 90 days only
+	var account struct {
+		Patterns EngagementPatterns `json:"engagement_patterns"`
+	}
+	srv.do("GET", "/analytics?include_patterns=true", token, nil, &account)
+	if p := account.Patterns; p.TotalClicks != 3 || p.Heatmap[6][21] != 2 || p.Heatmap[2][10] != 1 || p.Since == nil || !p.Since.Equal(clockTestBase.AddDate(0, 0, -engagementPatternDays)) {
+		t.Fatalf("account patterns %+v", p)
+	}
+	var plain map[string]interface{}
+	srv.do("GET", "/analytics", token, nil, &plain)
+	if _, ok := plain["engagement_patterns"]; ok {
+		t.Fatal("patterns without ?include_patterns=true")
+	}
+
+	// Confidence comes with 20 clicks
+	more := make([]time.Time, lowConfidenceClicks-2)
+	for i := range more {
+		more[i] = clockTestBase.Add(-time.Duration(i) * time.Hour)
+	}
+	seedClickTimes(srv, code, browser, more...)
+	page.Patterns = EngagementPatterns{}
+	srv.do("GET", "/url/"+code+"/clicks?include_patterns=true", token, nil, &page)
+	if p := page.Patterns; p.TotalClicks != lowConfidenceClicks || p.LowConfidence {
+		t.Fatalf("%d clicks: low_confidence %v", p.TotalClicks, p.LowConfidence)
+	}
+
+	for path, body := range map[string]interface{}{
+		"/url/" + code + "/clicks?include_patterns=maybe": nil,
+		"/auth/timezone": map[string]string{"timezone": "Mars/Olympus_Mons"},
+	} {
+		method := "GET"
+		if body != nil {
+			method = "PUT"
+		}
+		if resp := srv.do(method, path, token, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// JSON ERROR ENVELOPE
+// ============================================================================
+
+// Machine-readable error codes returned in the envelope
+const (
+	ErrCodeRateLimited         = "RATE_LIMITED"
+	ErrCodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	ErrCodeNotFound            = "NOT_FOUND"
+	ErrCodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	ErrCodePreconditionFailed  = "PRECONDITION_FAILED"
+	ErrCodeOverloaded          = "OVERLOADED"
+	ErrCodeDisposableEmail     = "DISPOSABLE_EMAIL"
+	ErrCodeInvalidSourceURL    = "INVALID_SOURCE_URL"
+	ErrCodeSourceFetchFailed   = "SOURCE_FETCH_FAILED"
+	ErrCodeSourceTooLarge      = "SOURCE_TOO_LARGE"
+	ErrCodeSourceNotCSV        = "SOURCE_NOT_CSV"
+	ErrCodeSourceParseFailed   = "SOURCE_PARSE_FAILED"
+	ErrCodeCaptchaRequired     = "CAPTCHA_REQUIRED"
+	ErrCodeCaptchaInvalid      = "CAPTCHA_INVALID"
+	ErrCodeCaptchaUnavailable  = "CAPTCHA_UNAVAILABLE"
+	ErrCodeInvalidFields       = "INVALID_FIELDS"
+	ErrCodeFolderNotEmpty      = "FOLDER_NOT_EMPTY"
+	ErrCodeDestinationBlocked  = "DESTINATION_BLOCKED"
+	ErrCodeTokenMissing        = "TOKEN_MISSING"
+	ErrCodeTokenExpired        = "TOKEN_EXPIRED"
+	ErrCodeTokenMalformed      = "TOKEN_MALFORMED"
+	ErrCodeTokenSignature      = "TOKEN_SIGNATURE_INVALID"
+	ErrCodeTokenInvalid        = "TOKEN_INVALID"
+	ErrCodeAccountDeactivated  = "ACCOUNT_DEACTIVATED"
+	ErrCodeReactivationInvalid = "REACTIVATION_TOKEN_INVALID"
+	ErrCodePinLimitReached     = "PIN_LIMIT_REACHED"
+	ErrCodeInvalidSettings     = "INVALID_SETTINGS"
+	ErrCodeSettingsVersion     = "UNSUPPORTED_SETTINGS_VERSION"
+)
+
+// writeJSONError writes {"success": false, "message": ..., "error": {"code": ..., ...details}}
+func writeJSONError(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	body := map[string]interface{}{"code": code}
+	for k, v := range details {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": message,
+		"error":   body,
+	}); err != nil {
+		log.Printf("error encoding error response: %v", err)
+	}
+}
+
+// writeStoreError answers a data-access error: validation errors 400, ErrNotFound 404,
+// ErrDuplicate 409, quota errors and ErrUnauthorizedOwner 403, an unavailable store 503 and
+// anything else 500 with failure. resource names what was looked up in the 404 and 409
+// messages ("user" gives "user not found").
+func writeStoreError(w http.ResponseWriter, err error, resource, failure string) {
+	var invalid *ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Reason, http.StatusBadRequest)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, resource+" not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicate):
+		http.Error(w, resource+" already exists", http.StatusConflict)
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrLimitReached):
+		writeJSONError(w, http.StatusForbidden, ErrCodeQuotaExceeded, "Limit reached", nil)
+	case errors.Is(err, ErrUnauthorizedOwner):
+		http.Error(w, "You do not own this "+resource, http.StatusForbidden)
+	case errors.Is(err, errStoreUnavailable):
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
+}
+
+// writeRateLimited answers a limited request with 429, Retry-After and the limiter's window state
+func writeRateLimited(w http.ResponseWriter, limit RateLimitResult) {
+	retryAfter := int(math.Ceil(time.Until(limit.ResetAt).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(limit.ResetAt.Unix(), 10))
+	writeJSONError(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Rate limit exceeded. Please try again later.",
+		map[string]interface{}{
+			"limit":               limit.Limit,
+			"reset_at":            limit.ResetAt.UTC().Format(time.RFC3339),
+			"retry_after_seconds": retryAfter,
+		})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rateLimitedBody is the JSON of a 429 from writeRateLimited
+type rateLimitedBody struct {
+	Success bool `json:"success"`
+	Error   struct {
+		Code              string `json:"code"`
+		Limit             int    `json:"limit"`
+		ResetAt           string `json:"reset_at"`
+		RetryAfterSeconds int    `json:"retry_after_seconds"`
+	} `json:"error"`
+}
+
+// checkRateLimited asserts rec is a complete 429 whose Retry-After is within a second of
+// the time left until resetAt
+func checkRateLimited(t *testing.T, rec *httptest.ResponseRecorder, resetAt time.Time) {
+	t.Helper()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	for _, header := range []string{"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+		if rec.Header().Get(header) == "" {
+			t.Errorf("429 without %s", header)
+		}
+	}
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Retry-After %q is not a number of seconds", rec.Header().Get("Retry-After"))
+	}
+	if want := time.Until(resetAt).Seconds(); math.Abs(float64(retryAfter)-want) > 1 {
+		t.Errorf("Retry-After %d, want %.1f within a second", retryAfter, want)
+	}
+
+	var body rateLimitedBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("429 body %q: %v", rec.Body.String(), err)
+	}
+	if body.Success || body.Error.Code != ErrCodeRateLimited || body.Error.RetryAfterSeconds != retryAfter {
+		t.Errorf("429 body %+v does not match Retry-After %d", body, retryAfter)
+	}
+	if parsed, err := time.Parse(time.RFC3339, body.Error.ResetAt); err != nil || math.Abs(parsed.Sub(resetAt).Seconds()) > 1 {
+		t.Errorf("reset_at %q, want %v", body.Error.ResetAt, resetAt)
+	}
+}
+
+func TestWriteRateLimited(t *testing.T) {
+	for _, left := range []time.Duration{30*time.Second + 400*time.Millisecond, 59 * time.Second, 1500 * time.Millisecond} {
+		resetAt := time.Now().Add(left)
+		rec := httptest.NewRecorder()
+		writeRateLimited(rec, RateLimitResult{Limited: true, Limit: 10, ResetAt: resetAt})
+		checkRateLimited(t, rec, resetAt)
+	}
+
+	// A window already over still asks for at least a second
+	rec := httptest.NewRecorder()
+	writeRateLimited(rec, RateLimitResult{Limited: true, Limit: 10, ResetAt: time.Now().Add(-time.Second)})
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("Retry-After %q for an elapsed window, want 1", got)
+	}
+}
+
+func TestGlobalRateLimitAnswers429(t *testing.T) {
+	srv := newTestServer(t)
+	policy := liveConfig().RateLimit("global")
+	start := time.Now()
+	for i := 0; i < policy.Limit; i++ {
+		if rec := srv.serveFrom("203.0.113.66:5000", httptest.NewRequest("GET", "/health", nil)); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d of %d limited", i+1, policy.Limit)
+		}
+	}
+	rec := srv.serveFrom("203.0.113.66:5000", httptest.NewRequest("GET", "/health", nil))
+	checkRateLimited(t, rec, start.Add(policy.Window))
+	if got := rec.Header().Get("X-RateLimit-Limit"); got != strconv.Itoa(policy.Limit) {
+		t.Errorf("X-RateLimit-Limit %q, want %d", got, policy.Limit)
+	}
+
+	// Another client is not affected
+	if rec := srv.serveFrom("203.0.113.67:5000", httptest.NewRequest("GET", "/health", nil)); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("another client was limited")
+	}
+}
+
+// goSources returns the non-test Go files of the package by name
+func goSources(t *testing.T) map[string]string {
+	t.Helper()
+	names, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[name] = string(raw)
+	}
+	return sources
+}
+
+func TestEvery429GoesThroughWriteRateLimited(t *testing.T) {
+	for name, source := range goSources(t) {
+		if name == "errors.go" {
+			continue
+		}
+		if strings.Contains(source, "StatusTooManyRequests") || strings.Contains(source, "WriteHeader(429)") {
+			t.Errorf("%s answers 429 itself; use writeRateLimited so Retry-After and the body are consistent", name)
+		}
+	}
+}
+
+func TestWriteStoreError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{&ValidationError{Field: "user_id", Reason: "invalid user ID"}, http.StatusBadRequest, "invalid user ID"},
+		{fmt.Errorf("loading: %w", &ValidationError{Field: "code", Reason: "bad code"}), http.StatusBadRequest, "bad code"},
+		{fmt.Errorf("finding user: %w", ErrNotFound), http.StatusNotFound, "user not found"},
+		{fmt.Errorf("creating user: %w", ErrDuplicate), http.StatusConflict, "user already exists"},
+		{fmt.Errorf("creating link: %w", ErrQuotaExceeded), http.StatusForbidden, ErrCodeQuotaExceeded},
+		{ErrLimitReached, http.StatusForbidden, ErrCodeQuotaExceeded},
+		{fmt.Errorf("updating: %w", ErrUnauthorizedOwner), http.StatusForbidden, "You do not own this user"},
+		{fmt.Errorf("finding user: %w", errStoreUnavailable), http.StatusServiceUnavailable, "database unavailable"},
+		// Error text is not a category: a driver message mentioning "not found" is a failure
+		{errors.New("(IndexNotFound) index not found with name [short_url_1]"), http.StatusInternalServerError, "failed"},
+		{errors.New("user already exists"), http.StatusInternalServerError, "failed"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeStoreError(rec, tt.err, "user", "failed")
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%v: status %d, body %q; want %d with %q", tt.err, rec.Code, rec.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+func TestUserStoreErrorsAreTyped(t *testing.T) {
+	newTestServer(t)
+	name := fmt.Sprintf("typed%d", time.Now().UnixNano())
+	user, err := CreateUserWithTransaction(name, name+"@example.com", "Str0ng!Passw0rd", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateUserWithTransaction(name, "other-"+name+"@example.com", "Str0ng!Passw0rd", false); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("taken username: %v", err)
+	}
+	if _, err := GetUserByCredentials(name, "wrong password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: %v", err)
+	}
+	if _, err := GetUserByCredentials("nobody-"+name, "Str0ng!Passw0rd"); !errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown login: %v", err)
+	}
+	if _, err := GetUserByID(primitive.NewObjectID().Hex()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown ID: %v", err)
+	}
+	var invalid *ValidationError
+	if _, err := GetUserByID("not-an-id"); !errors.As(err, &invalid) || invalid.Field != "user_id" {
+		t.Errorf("malformed ID: %v", err)
+	}
+	if found, err := GetUserByID(user.ID.Hex()); err != nil || found.Username != name {
+		t.Errorf("existing user: %+v, %v", found, err)
+	}
+}
+
+// TestNoErrorTextMatching keeps handlers from deciding on err.Error() again: errors are
+// compared with errors.Is and errors.As, never by their text
+func TestNoErrorTextMatching(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// isErrorText reports whether e is a call of a method named Error without arguments
+	isErrorText := func(e ast.Expr) bool {
+		call, ok := e.(*ast.CallExpr)
+		if !ok || len(call.Args) != 0 {
+			return false
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		return ok && sel.Sel.Name == "Error"
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				if pkg, ok := sel.X.(*ast.Ident); !ok || (pkg.Name != "strings" && pkg.Name != "regexp") {
+					return true
+				}
+				for _, arg := range n.Args {
+					if isErrorText(arg) {
+						t.Errorf("%s: %s.%s on error text; use errors.Is or errors.As", fset.Position(n.Pos()), sel.X, sel.Sel.Name)
+					}
+				}
+			case *ast.BinaryExpr:
+				if (n.Op == token.EQL || n.Op == token.NEQ) && (isErrorText(n.X) || isErrorText(n.Y)) {
+					t.Errorf("%s: comparison of error text; use errors.Is or errors.As", fset.Position(n.Pos()))
+				}
+			case *ast.SwitchStmt:
+				if n.Tag != nil && isErrorText(n.Tag) {
+					t.Errorf("%s: switch on error text; use errors.Is or errors.As", fset.Position(n.Pos()))
+				}
+			}
+			return true
+		})
+	}
+}
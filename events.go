@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// EVENT DISPATCHER (WEBHOOKS)
+// ============================================================================
+
+// Event types
+const (
+	EventQuotaThreshold     = "quota.threshold_crossed"
+	EventQuotaExceeded      = "quota.exceeded"
+	EventRateLimitThreshold = "rate_limit.threshold_crossed"
+)
+
+const (
+	eventQueueSize     = 1000
+	eventDeliveryTries = 3
+	opsEventDedupTTL   = time.Hour
+)
+
+// Event is the JSON body delivered to webhook destinations
+type Event struct {
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Instance  string                 `json:"instance_id"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+type eventDelivery struct {
+	url    string
+	secret string
+	event  Event
+}
+
+// eventDispatcher delivers events asynchronously so request handlers never wait on receivers
+type eventDispatcher struct {
+	client *http.Client
+	queue  chan eventDelivery
+	once   sync.Once
+}
+
+var events = &eventDispatcher{
+	client: newOutboundClient(outboundOptions{timeout: 5 * time.Second}),
+	queue:  make(chan eventDelivery, eventQueueSize),
+}
+
+// Dispatch queues an event for delivery; events are dropped when the queue is full
+func (d *eventDispatcher) Dispatch(url, secret string, event Event) {
+	d.once.Do(func() { go d.run() })
+	select {
+	case d.queue <- eventDelivery{url: url, secret: secret, event: event}:
+	default:
+		incMetric("events_dropped_total", 1)
+		log.Printf("Warning: event queue full, dropping %s event", event.Type)
+	}
+}
+
+func (d *eventDispatcher) run() {
+	for delivery := range d.queue {
+		if err := d.deliver(delivery); err != nil {
+			incMetric("events_failed_total", 1)
+			log.Printf("Error delivering %s event: %v", delivery.event.Type, err)
+			continue
+		}
+		incMetric("events_delivered_total", 1)
+	}
+}
+
+// deliver POSTs the event, retrying with backoff. When a secret is configured the body is
+// signed with HMAC-SHA256 in X-RapidLink-Signature.
+func (d *eventDispatcher) deliver(delivery eventDelivery) error {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for attempt := 0; attempt < eventDeliveryTries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-RapidLink-Event", delivery.event.Type)
+		if delivery.secret != "" {
+			mac := hmac.New(sha256.New, []byte(delivery.secret))
+			mac.Write(body)
+			req.Header.Set("X-RapidLink-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("receiver returned %d", resp.StatusCode)
+	}
+	return lastErr
+}
+
+// opsEventDedup remembers when an ops event was last sent per type and identifier
+type opsEventDedup struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+var opsDedup = &opsEventDedup{sent: make(map[string]time.Time)}
+
+// allow reports whether an event for key may be sent at now, recording it if so
+func (o *opsEventDedup) allow(key string, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if last, ok := o.sent[key]; ok && now.Sub(last) < opsEventDedupTTL {
+		return false
+	}
+	o.sent[key] = now
+	// Drop stale entries so the map stays bounded by the active identifiers
+	for k, last := range o.sent {
+		if now.Sub(last) >= opsEventDedupTTL {
+			delete(o.sent, k)
+		}
+	}
+	return true
+}
+
+// emitOpsEvent sends an operational event to WEBHOOK_OPS_URL, at most once per event type
+// and identifier (user ID or IP) per hour. Events are always logged, even without a URL.
+func emitOpsEvent(eventType, identifier string, data map[string]interface{}) {
+	now := clock.Now().UTC()
+	if !opsDedup.allow(eventType+"|"+identifier, now) {
+		return
+	}
+	logSecurityEvent(context.Background(), "OPS_EVENT", "", "", "", fmt.Sprintf("%s for %s: %v", eventType, identifier, data), "WARN")
+	url := os.Getenv("WEBHOOK_OPS_URL")
+	if url == "" {
+		return
+	}
+	events.Dispatch(url, os.Getenv("WEBHOOK_OPS_SECRET"), Event{
+		Type:      eventType,
+		Timestamp: now,
+		Instance:  InstanceID,
+		Data:      data,
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// opsReceiver stands in for WEBHOOK_OPS_URL, checking signatures and handing events over in
+// delivery order
+type opsReceiver struct {
+	t      *testing.T
+	events chan Event
+}
+
+func newOpsReceiver(t *testing.T) *opsReceiver {
+	const secret = "ops-secret"
+	rcv := &opsReceiver{t: t, events: make(chan Event, 100)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if r.Header.Get("X-RapidLink-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("ops event with a bad signature: %s", body)
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("ops event %s: %v", body, err)
+		}
+		rcv.events <- event
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("WEBHOOK_OPS_URL", server.URL)
+	t.Setenv("WEBHOOK_OPS_SECRET", secret)
+
+	saved := opsDedup
+	opsDedup = &opsEventDedup{sent: make(map[string]time.Time)}
+	t.Cleanup(func() { opsDedup = saved })
+	return rcv
+}
+
+// next returns the next delivered event. Calling it after emitting a sentinel proves nothing
+// else was sent in between, since deliveries are sequential.
+func (r *opsReceiver) next() Event {
+	r.t.Helper()
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(5 * time.Second):
+		r.t.Fatal("no ops event delivered")
+		return Event{}
+	}
+}
+
+// expectNothingBut emits a sentinel event and fails if anything else arrives first
+func (r *opsReceiver) expectNothingBut() {
+	r.t.Helper()
+	emitOpsEvent("test.sentinel", time.Now().String(), nil)
+	if event := r.next(); event.Type != "test.sentinel" {
+		r.t.Fatalf("unexpected %s event %v", event.Type, event.Data)
+	}
+}
+
+func TestQuotaCrossed(t *testing.T) {
+	tests := []struct {
+		before, after, quota, percent int
+		want                          bool
+	}{
+		{3, 4, 5, 80, true},
+		{4, 5, 5, 80, false},
+		{2, 3, 5, 80, false},
+		{7, 8, 10, 80, true},
+		{8, 9, 10, 80, false},
+		// 80% of 7 is 5.6, so the sixth link crosses
+		{5, 6, 7, 80, true},
+		{4, 5, 7, 80, false},
+		{0, 1, 1, 80, true},
+		{3, 4, 0, 80, false},
+	}
+	for _, tt := range tests {
+		if got := quotaCrossed(tt.before, tt.after, tt.quota, tt.percent); got != tt.want {
+			t.Errorf("quotaCrossed(%d, %d, %d, %d) = %v, want %v", tt.before, tt.after, tt.quota, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestOpsEventDedup(t *testing.T) {
+	dedup := &opsEventDedup{sent: make(map[string]time.Time)}
+	start := clockTestBase
+	steps := []struct {
+		key  string
+		at   time.Duration
+		want bool
+	}{
+		{"quota.exceeded|u1", 0, true},
+		{"quota.exceeded|u1", time.Minute, false},
+		{"quota.exceeded|u2", time.Minute, true},
+		{"quota.threshold_crossed|u1", time.Minute, true},
+		{"quota.exceeded|u1", opsEventDedupTTL - time.Nanosecond, false},
+		{"quota.exceeded|u1", opsEventDedupTTL, true},
+		{"quota.exceeded|u1", opsEventDedupTTL + time.Minute, false},
+	}
+	for _, step := range steps {
+		if got := dedup.allow(step.key, start.Add(step.at)); got != step.want {
+			t.Errorf("allow(%s) at +%v = %v, want %v", step.key, step.at, got, step.want)
+		}
+	}
+	// Entries older than the TTL are dropped
+	if len(dedup.sent) != 3 {
+		t.Errorf("dedup keeps %d entries, want 3", len(dedup.sent))
+	}
+}
+
+func TestQuotaOpsEvents(t *testing.T) {
+	rcv := newOpsReceiver(t)
+	t.Setenv("URL_QUOTA", "5")
+	t.Setenv("QUOTA_ALERT_PERCENT", "80")
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	shorten := func(n int) int {
+		return srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/quota/" + string(rune('a'+n))}, nil).StatusCode
+	}
+
+	for i := 0; i < 3; i++ {
+		shorten(i)
+	}
+	rcv.expectNothingBut()
+
+	shorten(3)
+	event := rcv.next()
+	if event.Type != EventQuotaThreshold || event.Data["user_id"] != userID || event.Data["count"] != 4.0 ||
+		event.Data["quota"] != 5.0 || event.Data["percent"] != 80.0 || event.Instance != InstanceID {
+		t.Fatalf("threshold event %+v", event)
+	}
+
+	shorten(4)
+	rcv.expectNothingBut()
+
+	if status := shorten(5); status != http.StatusForbidden {
+		t.Fatalf("link over quota: status %d", status)
+	}
+	if event := rcv.next(); event.Type != EventQuotaExceeded || event.Data["count"] != 5.0 || event.Data["quota"] != 5.0 {
+		t.Fatalf("exceeded event %+v", event)
+	}
+	// Repeated refusals within the hour are not reported again
+	shorten(6)
+	shorten(7)
+	rcv.expectNothingBut()
+
+	freezeClock(t, time.Now().Add(opsEventDedupTTL))
+	shorten(8)
+	if event := rcv.next(); event.Type != EventQuotaExceeded {
+		t.Fatalf("after an hour: %s event, want %s", event.Type, EventQuotaExceeded)
+	}
+}
+
+func TestRateLimitOpsEvent(t *testing.T) {
+	rcv := newOpsReceiver(t)
+	t.Setenv("RATE_LIMIT_ALERT_REJECTIONS", "3")
+	newTestServer(t)
+
+	const identifier = "198.51.100.200"
+	checkRateLimit(identifier, 1, time.Minute)
+	for i := 0; i < 2; i++ {
+		checkRateLimit(identifier, 1, time.Minute)
+	}
+	rcv.expectNothingBut()
+
+	// The third rejection crosses the threshold; later ones do not repeat it
+	for i := 0; i < 5; i++ {
+		checkRateLimit(identifier, 1, time.Minute)
+	}
+	event := rcv.next()
+	if event.Type != EventRateLimitThreshold || event.Data["identifier"] != identifier ||
+		event.Data["rejections"] != 3.0 || event.Data["limit"] != 1.0 || event.Data["reset_at"] == nil {
+		t.Fatalf("rate limit event %+v", event)
+	}
+	rcv.expectNothingBut()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// purgingStore deletes a link just before reviving it, as if the purge ran between
+// shorten's lookup and its update
+type purgingStore struct {
+	URLStore
+	srv *testServer
+}
+
+func (s *purgingStore) ReviveLink(ctx context.Context, link *URLData, expiresAt time.Time) (bool, error) {
+	s.srv.purge(link.ShortURL)
+	return s.URLStore.ReviveLink(ctx, link, expiresAt)
+}
+
+// expireLink creates a link to longURL that expires in a day, clicks it once and lets the
+// cleanup worker switch it off two days later
+func expireLink(t *testing.T, srv *testServer, token, longURL string) string {
+	t.Helper()
+	SetClock(FixedClock(clockTestBase))
+	code := srv.shorten(token, map[string]interface{}{"long-url": longURL, "expires": clockTestBase.Add(24 * time.Hour).Format(time.RFC3339)})
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("redirect before expiry: status %d", resp.StatusCode)
+	}
+	drainClicks(t)
+	SetClock(FixedClock(clockTestBase.Add(48 * time.Hour)))
+	if _, err := srv.links.DeactivateExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestExpiredDuplicateNotice(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	expired := expireLink(t, srv, token, "https://example.com/seasonal")
+
+	var created URLData
+	resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/seasonal"}, &created)
+	if resp.StatusCode != http.StatusCreated || created.ShortURL == expired {
+		t.Fatalf("status %d, code %s (expired %s)", resp.StatusCode, created.ShortURL, expired)
+	}
+	if len(created.Warnings) != 1 || created.Warnings[0].Code != WarnExpiredDuplicate || created.Warnings[0].ShortURL != expired {
+		t.Fatalf("warnings %+v", created.Warnings)
+	}
+	if resp := srv.do("GET", "/"+expired, "", nil, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("expired link after a new one was created: status %d", resp.StatusCode)
+	}
+
+	// Another user's expired link is not mentioned
+	other, _ := srv.register()
+	var others URLData
+	srv.do("PUT", "/url", other, map[string]interface{}{"long-url": "https://example.com/seasonal"}, &others)
+	if others.ShortURL == "" || len(others.Warnings) != 0 {
+		t.Fatalf("link of another user %s, warnings %+v", others.ShortURL, others.Warnings)
+	}
+}
+
+func TestExpiredDuplicateRevived(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	expired := expireLink(t, srv, token, "https://example.com/yearly")
+	newExpiry := clockTestBase.Add(30 * 24 * time.Hour)
+
+	var revived URLData
+	resp := srv.do("PUT", "/url", token, map[string]interface{}{
+		"long-url": "https://example.com/yearly", "reuse_expired": true, "expires": newExpiry.Format(time.RFC3339),
+	}, &revived)
+	if resp.StatusCode != http.StatusOK || revived.ShortURL != expired || !revived.IsActive {
+		t.Fatalf("status %d, %+v", resp.StatusCode, revived)
+	}
+	if revived.Clicks != 1 || revived.ExpiresAt == nil || !revived.ExpiresAt.Equal(newExpiry) || len(revived.Warnings) != 0 {
+		t.Fatalf("revived link %+v", revived)
+	}
+	if resp := srv.do("GET", "/"+expired, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("revived link: status %d", resp.StatusCode)
+	}
+
+	// Now active, the link is the dedupe answer again
+	var again URLData
+	resp = srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/yearly", "reuse_expired": true}, &again)
+	if again.ShortURL != expired {
+		t.Fatalf("status %d, code %s after revival", resp.StatusCode, again.ShortURL)
+	}
+
+	// A different custom code asks for a new link
+	expired = expireLink(t, srv, token, "https://example.com/custom")
+	again = URLData{}
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/custom", "reuse_expired": true, "custom": "fresh-code"}, &again)
+	if again.ShortURL != "fresh-code" || len(again.Warnings) != 1 || again.Warnings[0].ShortURL != expired {
+		t.Fatalf("custom code with reuse_expired: %+v", again)
+	}
+}
+
+func TestExpiredDuplicatePurged(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	// Purged before the request: nothing to revive or mention
+	expired := expireLink(t, srv, token, "https://example.com/purged")
+	srv.purge(expired)
+	var created URLData
+	resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/purged", "reuse_expired": true}, &created)
+	if resp.StatusCode != http.StatusCreated || created.ShortURL == "" || len(created.Warnings) != 0 {
+		t.Fatalf("status %d, %+v", resp.StatusCode, created)
+	}
+
+	// Purged between the lookup and the revival: a new link, without the stale notice
+	expireLink(t, srv, token, "https://example.com/racing")
+	Links = &purgingStore{URLStore: srv.links, srv: srv}
+	created = URLData{}
+	resp = srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/racing", "reuse_expired": true}, &created)
+	if resp.StatusCode != http.StatusCreated || created.ShortURL == "" || created.Clicks != 0 || len(created.Warnings) != 0 {
+		t.Fatalf("status %d, %+v", resp.StatusCode, created)
+	}
+	if _, err := srv.links.FindLinkByCode(context.Background(), created.ShortURL); err != nil {
+		t.Fatalf("new link %s not stored: %v", created.ShortURL, err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// LINK EXPIRY EXTENSION
+// ============================================================================
+
+// Reasons recorded in deactivated_reason when a link is switched off
+const (
+	DeactivatedExpired = "expired"
+	DeactivatedDeleted = "deleted"
+	// DeactivatedDraft marks a placeholder holding a code reserved through /url/preview
+	DeactivatedDraft = "draft"
+	// DeactivatedDisabled marks a link switched off by an admin, e.g. after abuse reports
+	DeactivatedDisabled = "disabled"
+)
+
+// defaultMaxLinkTTL matches the default expiry given to new links
+const defaultMaxLinkTTL = "5y"
+
+// LinkDuration is a calendar duration such as 30d, 2w, 6m or 1y
+type LinkDuration struct {
+	Days   int
+	Months int
+	Years  int
+}
+
+// parseLinkDuration parses "<n><unit>" with units d (days), w (weeks), m (months), y (years)
+func parseLinkDuration(s string) (LinkDuration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return LinkDuration{}, fmt.Errorf("invalid duration %q (use e.g. 30d, 2w, 6m, 1y)", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return LinkDuration{}, fmt.Errorf("invalid duration %q (use e.g. 30d, 2w, 6m, 1y)", s)
+	}
+	switch s[len(s)-1] {
+	case 'd':
+		return LinkDuration{Days: n}, nil
+	case 'w':
+		return LinkDuration{Days: 7 * n}, nil
+	case 'm':
+		return LinkDuration{Months: n}, nil
+	case 'y':
+		return LinkDuration{Years: n}, nil
+	}
+	return LinkDuration{}, fmt.Errorf("invalid duration unit in %q (use d, w, m or y)", s)
+}
+
+// AddTo returns t advanced by the duration
+func (d LinkDuration) AddTo(t time.Time) time.Time {
+	return t.AddDate(d.Years, d.Months, d.Days)
+}
+
+// maxLinkExpiry returns the latest expiry allowed from now, per MAX_LINK_TTL
+func maxLinkExpiry(now time.Time) time.Time {
+	ttl, err := parseLinkDuration(os.Getenv("MAX_LINK_TTL"))
+	if err != nil {
+		ttl, _ = parseLinkDuration(defaultMaxLinkTTL)
+	}
+	return ttl.AddTo(now)
+}
+
+// ExtendRequest is the body of POST /url/{code}/extend
+type ExtendRequest struct {
+	By string `json:"by"`
+	// ID optionally pins the link document, so a code that was purged and reissued is not
+	// extended by a stale client
+	ID string `json:"id,omitempty"`
+	// ExpectedVersion is the link's updated_at as last seen by the client
+	ExpectedVersion string `json:"expected_version,omitempty"`
+}
+
+// extendURL handles POST /url/{code}/extend
+func extendURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+	code := mux.Vars(r)["code"]
+
+	var req ExtendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	by, err := parseLinkDuration(req.By)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	precondition, err := parseEditPrecondition(r, req.ExpectedVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	urls := tenantURLs(r)
+	var urlData URLData
+	err = urls.FindOne(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "user_id", Value: userID},
+	}).Decode(&urlData)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("error loading link for extend: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if req.ID != "" {
+		if id, err := primitive.ObjectIDFromHex(req.ID); err != nil || id != urlData.ID {
+			http.Error(w, "Short URL has been reissued; reload the link before extending it", http.StatusConflict)
+			return
+		}
+	}
+	if !urlData.IsActive && urlData.DeactivatedReason != DeactivatedExpired {
+		http.Error(w, "Short URL has been deleted and cannot be extended", http.StatusGone)
+		return
+	}
+	if !precondition.Holds(urlData.UpdatedAt) {
+		writePreconditionFailed(w, r, &urlData)
+		return
+	}
+
+	// Extend from the current expiry, or from now if it has already passed
+	now := clock.Now()
+	base := now
+	if urlData.ExpiresAt != nil && urlData.ExpiresAt.After(now) {
+		base = *urlData.ExpiresAt
+	}
+	newExpiry, clampWarning := clampLinkExpiry(by.AddTo(base), now)
+	var warnings []Warning
+	if clampWarning != nil {
+		warnings = append(warnings, *clampWarning)
+	}
+
+	// Match on the expiry we read so a concurrent change is not silently overwritten
+	filter := bson.D{{Key: "_id", Value: urlData.ID}, {Key: "user_id", Value: userID}}
+	if urlData.ExpiresAt != nil {
+		filter = append(filter, bson.E{Key: "expires_at", Value: *urlData.ExpiresAt})
+	} else {
+		filter = append(filter, bson.E{Key: "expires_at", Value: nil})
+	}
+	filter = append(filter, precondition.Filter()...)
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "expires_at", Value: newExpiry},
+			{Key: "is_active", Value: true},
+			{Key: "updated_at", Value: now},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "deactivated_reason", Value: ""}}},
+	}
+	res, err := urls.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Printf("error extending link: %v", err)
+		http.Error(w, "Failed to extend short URL", http.StatusInternalServerError)
+		return
+	}
+	if res.MatchedCount == 0 {
+		var current URLData
+		if precondition != nil && urls.FindOne(ctx, bson.D{{Key: "_id", Value: urlData.ID}}).Decode(&current) == nil &&
+			!precondition.Holds(current.UpdatedAt) {
+			writePreconditionFailed(w, r, &current)
+			return
+		}
+		http.Error(w, "Short URL changed while extending; please retry", http.StatusConflict)
+		return
+	}
+
+	logSecurityEvent(r.Context(), "SHORT_URL_EXTENDED", userID, clientIP, r.UserAgent(),
+		fmt.Sprintf("Short URL extended: %s until %s", code, newExpiry.Format(time.RFC3339)), "INFO")
+
+	response := map[string]interface{}{
+		"success":     true,
+		"short_url":   code,
+		"expires_at":  newExpiry,
+		"updated_at":  now,
+		"reactivated": !urlData.IsActive,
+		"clamped":     clampWarning != nil,
+		"cache":       cacheStalenessNote(&urlData),
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// UNMATCHED ROUTES (404 / 405)
+// ============================================================================
+//
+// Router middleware does not run for requests mux cannot dispatch, so these handlers add
+// the security headers themselves. Bots probing POST /abc123 and the like are routine, so
+// they are logged at debug level only and never raise security events.
+
+// redirectRouteName names the GET catch-all that serves short links
+const redirectRouteName = "redirect"
+
+// routeMethods are the methods probed when building an Allow header
+var routeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// allowedMethods lists the methods some route of router accepts for r's path. The redirect
+// catch-all only counts for paths that could be a short code.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	code := strings.TrimPrefix(r.URL.Path, "/")
+	shortCodePath := code != "" && !strings.Contains(code, "/") && !isReservedCode(code)
+
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if !router.Match(probe, &match) || match.MatchErr != nil {
+			continue
+		}
+		if match.Route.GetName() == redirectRouteName && !shortCodePath {
+			continue
+		}
+		allowed = append(allowed, method)
+	}
+	if len(allowed) > 0 && !containsString(allowed, http.MethodOptions) {
+		allowed = append(allowed, http.MethodOptions)
+	}
+	return allowed
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsHTML reports whether the client is a browser asking for a page rather than JSON
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json")
+}
+
+// routeErrorPages maps error codes to their localized page in the message catalogs
+var routeErrorPages = map[string]string{
+	ErrCodeNotFound:         "not_found",
+	ErrCodeMethodNotAllowed: "method_not_allowed",
+}
+
+// writeRouteError answers an unmatched request with the JSON envelope, or a minimal page for browsers
+func writeRouteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	addSecurityHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+	if !wantsHTML(r) {
+		writeJSONError(w, status, code, message, nil)
+		return
+	}
+	if key, ok := routeErrorPages[code]; ok {
+		writeLocalizedPage(w, r, status, key, "")
+		return
+	}
+	title := strconv.Itoa(status) + " " + http.StatusText(status)
+	renderPage(w, r, status, htmlPage{Lang: "en", Title: title, Message: message})
+}
+
+// notFoundHandler answers paths no route matches
+func notFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debugf("404 %s %s from %s", r.Method, r.URL.Path, getClientIP(r))
+		writeRouteError(w, r, http.StatusNotFound, ErrCodeNotFound, "Not found")
+	})
+}
+
+// methodNotAllowedHandler answers a path that exists under other methods, with an Allow
+// header. OPTIONS reaching the router gets 204 with the same header; CORS preflights are
+// answered before the router.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r)
+		if len(allowed) == 0 {
+			// Only the redirect catch-all matched a path that cannot be a short code
+			notFoundHandler().ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if r.Method == http.MethodOptions {
+			addSecurityHeaders(w)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		debugf("405 %s %s from %s (allow: %s)", r.Method, r.URL.Path, getClientIP(r), strings.Join(allowed, ", "))
+		writeRouteError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed,
+			fmt.Sprintf("Method %s is not allowed for this path", r.Method))
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// routeErrorBody is the JSON envelope of unmatched routes
+type routeErrorBody struct {
+	Success bool `json:"success"`
+	Error   struct {
+		Code string `json:"code"`
+	} `json:"error"`
+}
+
+func TestUnmatchedMethods(t *testing.T) {
+	srv := newTestServer(t)
+	logs := captureLog(t)
+	tests := []struct {
+		name, method, path string
+		status             int
+		allow              []string
+	}{
+		{"POST to a short code", "POST", "/abc123", http.StatusMethodNotAllowed, []string{"GET", "OPTIONS"}},
+		{"DELETE to a short code", "DELETE", "/abc123", http.StatusMethodNotAllowed, []string{"GET", "OPTIONS"}},
+		{"PATCH to login", "PATCH", "/auth/login", http.StatusMethodNotAllowed, []string{"POST", "OPTIONS"}},
+		{"OPTIONS without CORS", "OPTIONS", "/auth/login", http.StatusNoContent, []string{"POST", "OPTIONS"}},
+		{"POST to a reserved path", "POST", "/analytics/nothing", http.StatusNotFound, nil},
+		{"POST to an unknown nested path", "POST", "/no/such/path", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			var body routeErrorBody
+			resp := srv.send(req, &body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("X-Frame-Options") != "DENY" {
+				t.Error("security headers missing")
+			}
+			allow := resp.Header.Get("Allow")
+			for _, method := range tt.allow {
+				if !strings.Contains(allow, method) {
+					t.Errorf("Allow %q lacks %s", allow, method)
+				}
+			}
+			if tt.allow == nil && allow != "" {
+				t.Errorf("Allow %q on a 404", allow)
+			}
+			if tt.method != "OPTIONS" && strings.Contains(allow, tt.method) {
+				t.Errorf("Allow %q lists the refused %s", allow, tt.method)
+			}
+			switch tt.status {
+			case http.StatusMethodNotAllowed:
+				if body.Success || body.Error.Code != ErrCodeMethodNotAllowed {
+					t.Errorf("body %+v", body)
+				}
+			case http.StatusNotFound:
+				if body.Success || body.Error.Code != ErrCodeNotFound {
+					t.Errorf("body %+v", body)
+				}
+			}
+		})
+	}
+
+	// Probes are routine and never raise warnings
+	srv.do("GET", "/bad!code", "", nil, nil)
+	if !logs.waitFor("INVALID_SHORT_URL_ACCESS") {
+		t.Fatal("security events are not captured")
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "[WARN]") && !strings.Contains(line, "INVALID_SHORT_URL_ACCESS") {
+			t.Errorf("unmatched route logged a warning: %s", line)
+		}
+	}
+}
+
+func TestUnmatchedMethodBrowserPage(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest("POST", srv.URL+"/abc123", strings.NewReader("a=b"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp := srv.send(req, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("browser POST: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	srv := newTestServer(t)
+	for _, tt := range []struct{ path, method string }{
+		{"/url/abc123", "PATCH"},
+		{"/url", "PUT"},
+		{"/auth/login", "POST"},
+	} {
+		req, _ := http.NewRequest("OPTIONS", srv.URL+tt.path, nil)
+		req.Header.Set("Origin", "http://localhost:3000")
+		req.Header.Set("Access-Control-Request-Method", tt.method)
+		req.Header.Set("Access-Control-Request-Headers", "Authorization, Content-Type")
+		resp := srv.send(req, nil)
+		if resp.StatusCode >= 300 {
+			t.Errorf("preflight %s %s: status %d", tt.method, tt.path, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" && got != "http://localhost:3000" {
+			t.Errorf("preflight %s %s: Access-Control-Allow-Origin %q", tt.method, tt.path, got)
+		}
+		// Simple methods are allowed without being listed
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); tt.method != "POST" && !strings.Contains(got, tt.method) {
+			t.Errorf("preflight %s %s: Access-Control-Allow-Methods %q", tt.method, tt.path, got)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// ============================================================================
+// FEATURE FLAGS
+// ============================================================================
+//
+// Flags are declared in featureFlags with a default. The features object of CONFIG_FILE (see
+// runtime_config.go) overrides them per flag, either with a plain true/false or a rule:
+//
+//	"features": {"redirect_probe": {"enabled": false, "percentage": 20, "users": ["<user id>"]}}
+//
+// Users on the list always get the flag. Otherwise, with a percentage, a user gets it when the
+// hash of flag name and user ID falls in the first percentage of 100 buckets, so the same
+// users stay in as the percentage grows. Callers without a user, and rules without a
+// percentage, get enabled, or the flag's default when enabled is not set. Code asks with
+// featureEnabled(ctx, name), which reads the user and configuration snapshot pinned to the
+// request and does not allocate. GET /auth/profile returns the caller's flags and
+// GET /admin/features the rules in effect.
+
+// featureFlag is a flag known to the code
+type featureFlag struct {
+	Name        string
+	Description string
+	// Default is the value without a rule in CONFIG_FILE
+	Default func() bool
+}
+
+// featureFlags is the registry of flags; CONFIG_FILE rules for other names are rejected
+var featureFlags = []*featureFlag{
+	{
+		Name:        "redirect_probe",
+		Description: "Probe the redirect chain of new links (REDIRECT_PROBE_ENABLED); evaluated for the link owner",
+		Default:     func() bool { return os.Getenv("REDIRECT_PROBE_ENABLED") == "true" },
+	},
+	{
+		Name:        "profile_stats_by_default",
+		Description: "GET /auth/profile without ?include= returns statistics (PROFILE_STATS_BY_DEFAULT)",
+		Default:     func() bool { return os.Getenv("PROFILE_STATS_BY_DEFAULT") != "false" },
+	},
+}
+
+// featureFlagsByName indexes featureFlags
+var featureFlagsByName = func() map[string]*featureFlag {
+	byName := make(map[string]*featureFlag, len(featureFlags))
+	for _, flag := range featureFlags {
+		byName[flag.Name] = flag
+	}
+	return byName
+}()
+
+// featureRule is a CONFIG_FILE override of one flag
+type featureRule struct {
+	Enabled    *bool           `json:"enabled,omitempty"`
+	Percentage *int            `json:"percentage,omitempty"`
+	Users      map[string]bool `json:"-"`
+}
+
+// UnmarshalJSON accepts true/false as well as {"enabled", "percentage", "users"}
+func (rule *featureRule) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		rule.Enabled = &enabled
+		return nil
+	}
+	var raw struct {
+		Enabled    *bool    `json:"enabled"`
+		Percentage *int     `json:"percentage"`
+		Users      []string `json:"users"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("must be true, false or an object with enabled, percentage and users")
+	}
+	if raw.Percentage != nil && (*raw.Percentage < 0 || *raw.Percentage > 100) {
+		return fmt.Errorf("percentage must be between 0 and 100")
+	}
+	rule.Enabled, rule.Percentage = raw.Enabled, raw.Percentage
+	if len(raw.Users) > 0 {
+		rule.Users = make(map[string]bool, len(raw.Users))
+		for _, userID := range raw.Users {
+			rule.Users[userID] = true
+		}
+	}
+	return nil
+}
+
+// MarshalJSON includes the user list, sorted
+func (rule featureRule) MarshalJSON() ([]byte, error) {
+	users := make([]string, 0, len(rule.Users))
+	for userID := range rule.Users {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return json.Marshal(struct {
+		Enabled    *bool    `json:"enabled,omitempty"`
+		Percentage *int     `json:"percentage,omitempty"`
+		Users      []string `json:"users,omitempty"`
+	}{rule.Enabled, rule.Percentage, users})
+}
+
+// featureBucket places a user in one of 100 buckets of a flag (FNV-1a of name, NUL, user ID)
+func featureBucket(name, userID string) int {
+	const offset, prime = 2166136261, 16777619
+	hash := uint32(offset)
+	for i := 0; i < len(name); i++ {
+		hash = (hash ^ uint32(name[i])) * prime
+	}
+	hash *= prime // the NUL separator
+	for i := 0; i < len(userID); i++ {
+		hash = (hash ^ uint32(userID[i])) * prime
+	}
+	return int(hash % 100)
+}
+
+// Feature evaluates the named flag for userID ("" when there is no user)
+func (c *runtimeConfig) Feature(name, userID string) bool {
+	rule, ok := c.features[name]
+	if !ok {
+		if flag, known := featureFlagsByName[name]; known {
+			return flag.Default()
+		}
+		return false
+	}
+	if userID != "" {
+		if rule.Users[userID] {
+			return true
+		}
+		if rule.Percentage != nil {
+			return featureBucket(name, userID) < *rule.Percentage
+		}
+	}
+	if rule.Enabled != nil {
+		return *rule.Enabled
+	}
+	return featureFlagsByName[name].Default()
+}
+
+// featureEnabled evaluates the named flag for the user and configuration of the request ctx
+// belongs to
+func featureEnabled(ctx context.Context, name string) bool {
+	cfg, userID := liveConfig(), ""
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		userID = info.UserID
+		if info.Config != nil {
+			cfg = info.Config
+		}
+	}
+	return cfg.Feature(name, userID)
+}
+
+// evaluatedFeatures returns every flag's value for the request ctx belongs to
+func evaluatedFeatures(ctx context.Context) map[string]bool {
+	features := make(map[string]bool, len(featureFlags))
+	for _, flag := range featureFlags {
+		features[flag.Name] = featureEnabled(ctx, flag.Name)
+	}
+	return features
+}
+
+// adminListFeatures handles GET /admin/features
+func adminListFeatures(w http.ResponseWriter, r *http.Request) {
+	cfg := requestConfig(r)
+	flags := make([]map[string]interface{}, 0, len(featureFlags))
+	for _, flag := range featureFlags {
+		entry := map[string]interface{}{
+			"name":        flag.Name,
+			"description": flag.Description,
+			"default":     flag.Default(),
+		}
+		if rule, ok := cfg.features[flag.Name]; ok {
+			entry["rule"] = rule
+		}
+		flags = append(flags, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"flags":   flags,
+		"source":  cfg.source,
+	}); err != nil {
+		log.Printf("error encoding feature flags response: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"testing"
+)
+
+// withFeatureRules swaps in a snapshot with the given CONFIG_FILE features object
+func withFeatureRules(t *testing.T, features string) *runtimeConfig {
+	t.Helper()
+	cfg, err := parseRuntimeConfig([]byte(`{"features": `+features+`}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := liveConfigPointer.Load()
+	liveConfigPointer.Store(cfg)
+	t.Cleanup(func() { liveConfigPointer.Store(saved) })
+	return cfg
+}
+
+func TestFeatureBucket(t *testing.T) {
+	// Buckets never change between releases, or users would flip in and out of rollouts
+	tests := []struct {
+		name, userID string
+		want         int
+	}{
+		{"redirect_probe", "user-1", 41},
+		{"redirect_probe", "user-2", 84},
+		{"redirect_probe", "64b7f0c2a1e4d3b2c1a09f8e", 53},
+		{"profile_stats_by_default", "user-1", 9},
+		{"profile_stats_by_default", "64b7f0c2a1e4d3b2c1a09f8e", 25},
+	}
+	for _, tt := range tests {
+		if got := featureBucket(tt.name, tt.userID); got != tt.want {
+			t.Errorf("featureBucket(%q, %q) = %d, want %d", tt.name, tt.userID, got, tt.want)
+		}
+	}
+
+	// It is FNV-1a of name, NUL and user ID, and spreads users evenly
+	counts := make([]int, 100)
+	for i := 0; i < 100000; i++ {
+		userID := fmt.Sprintf("%024x", i)
+		h := fnv.New32a()
+		h.Write([]byte("redirect_probe\x00" + userID))
+		bucket := featureBucket("redirect_probe", userID)
+		if want := int(h.Sum32() % 100); bucket != want {
+			t.Fatalf("featureBucket(%q) = %d, FNV-1a gives %d", userID, bucket, want)
+		}
+		counts[bucket]++
+	}
+	for bucket, n := range counts {
+		if n < 850 || n > 1150 {
+			t.Errorf("bucket %d holds %d of 100000 users", bucket, n)
+		}
+	}
+}
+
+func TestFeatureRules(t *testing.T) {
+	t.Setenv("REDIRECT_PROBE_ENABLED", "true")
+	cfg := withFeatureRules(t, `{"redirect_probe": {"enabled": false, "percentage": 42, "users": ["user-2"]}, "profile_stats_by_default": false}`)
+	tests := []struct {
+		name, userID string
+		want         bool
+	}{
+		{"redirect_probe", "user-1", true},                    // bucket 41
+		{"redirect_probe", "64b7f0c2a1e4d3b2c1a09f8e", false}, // bucket 53
+		{"redirect_probe", "user-2", true},                    // bucket 84, on the list
+		{"redirect_probe", "", false},                         // no user: enabled
+		{"profile_stats_by_default", "user-1", false},
+		{"nope", "user-1", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.Feature(tt.name, tt.userID); got != tt.want {
+			t.Errorf("Feature(%q, %q) = %v, want %v", tt.name, tt.userID, got, tt.want)
+		}
+	}
+
+	// Without a rule, or without enabled, the flag keeps its default
+	for _, features := range []string{`{}`, `{"redirect_probe": {"users": ["user-2"]}}`} {
+		cfg := withFeatureRules(t, features)
+		if !cfg.Feature("redirect_probe", "user-1") || !cfg.Feature("redirect_probe", "") {
+			t.Errorf("%s: default not used", features)
+		}
+	}
+
+	// Raising the percentage only adds users
+	for userID := 0; userID < 1000; userID++ {
+		id := fmt.Sprintf("%024x", userID)
+		was := false
+		for percentage := 0; percentage <= 100; percentage += 10 {
+			cfg := withFeatureRules(t, fmt.Sprintf(`{"redirect_probe": {"percentage": %d}}`, percentage))
+			on := cfg.Feature("redirect_probe", id)
+			if was && !on {
+				t.Fatalf("%s dropped out at %d%%", id, percentage)
+			}
+			if percentage == 0 && on || percentage == 100 && !on {
+				t.Fatalf("%s at %d%%: %v", id, percentage, on)
+			}
+			was = on
+		}
+	}
+
+	for _, bad := range []string{`{"redirect_probe": {"percentage": 101}}`, `{"redirect_probe": "yes"}`} {
+		if _, err := parseRuntimeConfig([]byte(`{"features": `+bad+`}`), "test"); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestFeatureEnabledAllocations(t *testing.T) {
+	cfg := withFeatureRules(t, `{"redirect_probe": {"percentage": 50, "users": ["user-2"]}}`)
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{UserID: "user-1", Config: cfg})
+	if allocs := testing.AllocsPerRun(1000, func() {
+		featureEnabled(ctx, "redirect_probe")
+		featureEnabled(ctx, "profile_stats_by_default")
+	}); allocs != 0 {
+		t.Fatalf("featureEnabled allocates %v times per call", allocs)
+	}
+}
+
+func TestFeatureEndpoints(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, userID := srv.register()
+	withFeatureRules(t, fmt.Sprintf(`{"redirect_probe": {"enabled": false, "users": [%q]}}`, userID))
+
+	var profile struct {
+		Data struct {
+			Features map[string]bool `json:"features"`
+		} `json:"data"`
+	}
+	srv.do("GET", "/auth/profile", token, nil, &profile)
+	if !profile.Data.Features["redirect_probe"] || len(profile.Data.Features) != len(featureFlags) {
+		t.Fatalf("profile features %v", profile.Data.Features)
+	}
+	other, _ := srv.register()
+	profile.Data.Features = nil
+	srv.do("GET", "/auth/profile", other, nil, &profile)
+	if profile.Data.Features["redirect_probe"] {
+		t.Fatalf("flag on for a user off the list: %v", profile.Data.Features)
+	}
+
+	var listed struct {
+		Flags []struct {
+			Name string          `json:"name"`
+			Rule json.RawMessage `json:"rule"`
+		} `json:"flags"`
+	}
+	if resp := srv.do("GET", "/admin/features", admin, nil, &listed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	rules := make(map[string]string)
+	for _, flag := range listed.Flags {
+		rules[flag.Name] = string(flag.Rule)
+	}
+	if want := fmt.Sprintf(`{"enabled":false,"users":[%q]}`, userID); rules["redirect_probe"] != want || rules["profile_stats_by_default"] != "" {
+		t.Fatalf("listed rules %v", rules)
+	}
+	if resp := srv.do("GET", "/admin/features", token, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("flags for a user: status %d", resp.StatusCode)
+	}
+}
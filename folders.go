@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// LINK FOLDERS
+// ============================================================================
+//
+// Folders organize a user's links in a tree ("Products/EU/2024") next to the flat tags. Each
+// folder keeps its parent and a materialized path of folder IDs from the top level down to
+// itself ("/<id>/<id>/"), so a subtree is every folder whose path starts with the folder's.
+// A link sits in at most one folder (folder_id); links outside any folder are unfiled.
+// Folders nest at most maxFolderDepth levels and names are unique per parent, ignoring case.
+// Moving a folder rewrites the paths of its subtree. A folder still holding active links or
+// subfolders is only deleted with ?move_to=, which moves both into another folder (or to the
+// top level with move_to=root); otherwise DELETE answers 409. GET /folders returns each
+// folder with the link and click counts of the folder and of its subtree, summed from one
+// aggregation of the links per folder. GET /analytics?folder_id= lists a folder's links,
+// with &subfolders=true those of its subtree, and folder_id=root the unfiled ones.
+
+const (
+	maxFolderDepth      = 5
+	maxFoldersPerUser   = 1000
+	maxFolderNameLength = 64
+	maxFolderMoveCodes  = 500
+	// rootFolderID names the top level in move_to and the unfiled links in folder filters
+	rootFolderID = "root"
+)
+
+// Folder is a folders document
+type Folder struct {
+	ID     primitive.ObjectID `bson:"_id" json:"id"`
+	UserID string             `bson:"user_id" json:"-"`
+	Name   string             `bson:"name" json:"name"`
+	// NameKey is the lowercased name, unique among the parent's folders
+	NameKey string `bson:"name_key" json:"-"`
+	// ParentID is empty for top-level folders
+	ParentID string `bson:"parent_id" json:"parent_id,omitempty"`
+	// Path holds the IDs from the top-level folder down to this one, "/<id>/.../<id>/"
+	Path      string    `bson:"path" json:"-"`
+	Depth     int       `bson:"depth" json:"depth"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// FolderCounts are the active links in a folder and their clicks
+type FolderCounts struct {
+	Links  int64 `json:"links"`
+	Clicks int64 `json:"clicks"`
+}
+
+// folderView is a folder as the API returns it
+type folderView struct {
+	*Folder
+	FullName string `json:"full_name"`
+	// Counts covers the folder's own links, Subtree adds those of its subfolders
+	Counts  FolderCounts `json:"counts"`
+	Subtree FolderCounts `json:"subtree"`
+}
+
+// folderRequest is the body of POST /folders and PUT /folders/{id}
+type folderRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id"`
+}
+
+var (
+	errFolderCycle = errors.New("a folder cannot be moved into itself or one of its subfolders")
+	errFolderDepth = fmt.Errorf("folders can be nested at most %d levels deep", maxFolderDepth)
+)
+
+// normalizeFolderName validates a folder name and returns it escaped like other user text
+func normalizeFolderName(raw string) (string, error) {
+	name := strings.Join(strings.Fields(raw), " ")
+	// Length is measured before HTML escaping, as for tags
+	if name == "" || utf8.RuneCountInString(name) > maxFolderNameLength {
+		return "", fmt.Errorf("name must be 1 to %d characters", maxFolderNameLength)
+	}
+	if strings.Contains(name, "/") {
+		return "", fmt.Errorf("name must not contain '/'")
+	}
+	return sanitizeInput(name), nil
+}
+
+// folderTree is the owner's folders, indexed for path and depth computations
+type folderTree struct {
+	list []*Folder
+	byID map[string]*Folder
+}
+
+func newFolderTree(folders []*Folder) *folderTree {
+	tree := &folderTree{list: folders, byID: make(map[string]*Folder, len(folders))}
+	for _, folder := range folders {
+		tree.byID[folder.ID.Hex()] = folder
+	}
+	return tree
+}
+
+// loadFolderTree reads every folder of the owner
+func loadFolderTree(ctx context.Context, store URLStore, userID string) (*folderTree, error) {
+	folders, err := store.ListFolders(ctx, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	return newFolderTree(folders), nil
+}
+
+// fullName joins the names from the top-level folder down to folder with "/"
+func (t *folderTree) fullName(folder *Folder) string {
+	ids := strings.Split(strings.Trim(folder.Path, "/"), "/")
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if ancestor, ok := t.byID[id]; ok {
+			names = append(names, ancestor.Name)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// subtree returns folder and all its descendants
+func (t *folderTree) subtree(folder *Folder) []*Folder {
+	var folders []*Folder
+	for _, f := range t.list {
+		if strings.HasPrefix(f.Path, folder.Path) {
+			folders = append(folders, f)
+		}
+	}
+	return folders
+}
+
+// children returns the folders directly inside parent; nil parent means the top level
+func (t *folderTree) children(parent *Folder) []*Folder {
+	parentID := ""
+	if parent != nil {
+		parentID = parent.ID.Hex()
+	}
+	var folders []*Folder
+	for _, f := range t.list {
+		if f.ParentID == parentID {
+			folders = append(folders, f)
+		}
+	}
+	return folders
+}
+
+// checkPlacement reports whether folder, with its subtree, may sit in parent (nil for the top
+// level) under name. A name taken by another folder there is ErrDuplicate.
+func (t *folderTree) checkPlacement(folder, parent *Folder, nameKey string) error {
+	parentDepth := 0
+	if parent != nil {
+		if folder != nil && strings.HasPrefix(parent.Path, folder.Path) {
+			return errFolderCycle
+		}
+		parentDepth = parent.Depth
+	}
+	height := 1
+	if folder != nil {
+		for _, f := range t.subtree(folder) {
+			if f.Depth-folder.Depth+1 > height {
+				height = f.Depth - folder.Depth + 1
+			}
+		}
+	}
+	if parentDepth+height > maxFolderDepth {
+		return errFolderDepth
+	}
+	for _, sibling := range t.children(parent) {
+		if sibling.NameKey == nameKey && (folder == nil || sibling.ID != folder.ID) {
+			return ErrDuplicate
+		}
+	}
+	return nil
+}
+
+// reparent moves folder with its subtree into parent (nil for the top level) and returns the
+// folders whose path changed, folder first
+func (t *folderTree) reparent(folder, parent *Folder, now time.Time) []*Folder {
+	newPath, newDepth, parentID := "/"+folder.ID.Hex()+"/", 1, ""
+	if parent != nil {
+		newPath, newDepth, parentID = parent.Path+folder.ID.Hex()+"/", parent.Depth+1, parent.ID.Hex()
+	}
+	oldPath, oldDepth := folder.Path, folder.Depth
+	moved := t.subtree(folder)
+	sort.Slice(moved, func(i, j int) bool { return moved[i].Depth < moved[j].Depth })
+	for _, f := range moved {
+		f.Path = newPath + strings.TrimPrefix(f.Path, oldPath)
+		f.Depth += newDepth - oldDepth
+		f.UpdatedAt = now
+	}
+	folder.ParentID = parentID
+	return moved
+}
+
+// view returns folder with its full name and counts
+func (t *folderTree) view(folder *Folder, counts map[string]FolderCounts) folderView {
+	v := folderView{Folder: folder, FullName: t.fullName(folder), Counts: counts[folder.ID.Hex()]}
+	for _, f := range t.subtree(folder) {
+		c := counts[f.ID.Hex()]
+		v.Subtree.Links += c.Links
+		v.Subtree.Clicks += c.Clicks
+	}
+	return v
+}
+
+// resolveFolderRef looks up a folder reference of a request: "" and "root" are the top level
+// (nil), anything else must be one of the owner's folders
+func (t *folderTree) resolveFolderRef(ref string) (*Folder, error) {
+	if ref == "" || ref == rootFolderID {
+		return nil, nil
+	}
+	folder, ok := t.byID[ref]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return folder, nil
+}
+
+// folderFilter turns ?folder_id= and ?subfolders= of a link listing into the folder IDs to
+// list; nil without a filter
+func folderFilter(ctx context.Context, store URLStore, userID string, r *http.Request) ([]string, error) {
+	ref := r.URL.Query().Get("folder_id")
+	if ref == "" {
+		return nil, nil
+	}
+	if ref == rootFolderID {
+		return []string{""}, nil
+	}
+	id, err := primitive.ObjectIDFromHex(ref)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	folder, err := store.FindFolder(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if r.URL.Query().Get("subfolders") != "true" {
+		return []string{folder.ID.Hex()}, nil
+	}
+	subtree, err := store.ListFolders(ctx, userID, folder.Path)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(subtree))
+	for i, f := range subtree {
+		ids[i] = f.ID.Hex()
+	}
+	return ids, nil
+}
+
+// writeFolderError answers the placement and lookup errors of folder requests
+func writeFolderError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Folder not found", http.StatusNotFound)
+	case errors.Is(err, ErrDuplicate):
+		http.Error(w, "A folder with this name already exists there", http.StatusConflict)
+	case errors.Is(err, errFolderCycle), errors.Is(err, errFolderDepth):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Printf("error %s: %v", action, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+	}
+}
+
+// writeFolder answers with one folder
+func writeFolder(w http.ResponseWriter, status int, view folderView, children []folderView) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(status)
+	response := map[string]interface{}{
+		"success": true,
+		"folder":  view,
+	}
+	if children != nil {
+		response["children"] = children
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding folder response: %v", err)
+	}
+}
+
+// folderFromPath returns the owner's folder named by {id}, from tree
+func folderFromPath(w http.ResponseWriter, r *http.Request, tree *folderTree) (*Folder, bool) {
+	folder, ok := tree.byID[mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return nil, false
+	}
+	return folder, true
+}
+
+// listFolders handles GET /folders: every folder of the user, by full name, with counts
+func listFolders(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		writeFolderError(w, err, "listing folders")
+		return
+	}
+	counts, err := store.FolderLinkCounts(ctx, userID)
+	if err != nil {
+		writeFolderError(w, err, "counting folder links")
+		return
+	}
+	folders := make([]folderView, 0, len(tree.list))
+	for _, folder := range tree.list {
+		folders = append(folders, tree.view(folder, counts))
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return strings.ToLower(folders[i].FullName) < strings.ToLower(folders[j].FullName)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"folders": folders,
+		"count":   len(folders),
+		"unfiled": counts[""],
+	}); err != nil {
+		log.Printf("error encoding folders response: %v", err)
+	}
+}
+
+// getFolder handles GET /folders/{id}: the folder with its counts and direct subfolders
+func getFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		writeFolderError(w, err, "loading folders")
+		return
+	}
+	folder, ok := folderFromPath(w, r, tree)
+	if !ok {
+		return
+	}
+	counts, err := store.FolderLinkCounts(ctx, userID)
+	if err != nil {
+		writeFolderError(w, err, "counting folder links")
+		return
+	}
+	children := []folderView{}
+	for _, child := range tree.children(folder) {
+		children = append(children, tree.view(child, counts))
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].NameKey < children[j].NameKey })
+	writeFolder(w, http.StatusOK, tree.view(folder, counts), children)
+}
+
+// newFolder returns a folder named name (already normalized) in parent, nil for the top level
+func newFolder(userID, name string, parent *Folder, now time.Time) *Folder {
+	folder := &Folder{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      name,
+		NameKey:   strings.ToLower(name),
+		Depth:     1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	folder.Path = "/" + folder.ID.Hex() + "/"
+	if parent != nil {
+		folder.ParentID = parent.ID.Hex()
+		folder.Path = parent.Path + folder.ID.Hex() + "/"
+		folder.Depth = parent.Depth + 1
+	}
+	return folder
+}
+
+// createFolder handles POST /folders {"name": "...", "parent_id": "..."}
+func createFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	var req folderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	name, err := normalizeFolderName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		writeFolderError(w, err, "loading folders")
+		return
+	}
+	if len(tree.list) >= maxFoldersPerUser {
+		writeJSONError(w, http.StatusForbidden, ErrCodeQuotaExceeded,
+			fmt.Sprintf("An account can have at most %d folders", maxFoldersPerUser),
+			map[string]interface{}{"quota": maxFoldersPerUser})
+		return
+	}
+	parent, err := tree.resolveFolderRef(req.ParentID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Parent folder not found", http.StatusBadRequest)
+		return
+	}
+	nameKey := strings.ToLower(name)
+	if err := tree.checkPlacement(nil, parent, nameKey); err != nil {
+		writeFolderError(w, err, "creating folder")
+		return
+	}
+
+	folder := newFolder(userID, name, parent, clock.Now())
+	if err := store.InsertFolder(ctx, folder); err != nil {
+		writeFolderError(w, err, "creating folder")
+		return
+	}
+	tree = newFolderTree(append(tree.list, folder))
+	w.Header().Set("Location", "/folders/"+folder.ID.Hex())
+	writeFolder(w, http.StatusCreated, tree.view(folder, nil), nil)
+}
+
+// updateFolder handles PUT /folders/{id} {"name": "...", "parent_id": "..."}, renaming the
+// folder and moving it with its subtree; an empty parent_id is the top level
+func updateFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	var req folderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	name, err := normalizeFolderName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		writeFolderError(w, err, "loading folders")
+		return
+	}
+	folder, ok := folderFromPath(w, r, tree)
+	if !ok {
+		return
+	}
+	parent, err := tree.resolveFolderRef(req.ParentID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Parent folder not found", http.StatusBadRequest)
+		return
+	}
+	nameKey := strings.ToLower(name)
+	if err := tree.checkPlacement(folder, parent, nameKey); err != nil {
+		writeFolderError(w, err, "updating folder")
+		return
+	}
+
+	now := clock.Now()
+	changed := []*Folder{folder}
+	if req.ParentID != folder.ParentID && !(parent == nil && folder.ParentID == "") {
+		changed = tree.reparent(folder, parent, now)
+	}
+	folder.Name, folder.NameKey, folder.UpdatedAt = name, nameKey, now
+	if err := store.UpdateFolders(ctx, changed); err != nil {
+		writeFolderError(w, err, "updating folder")
+		return
+	}
+	counts, err := store.FolderLinkCounts(ctx, userID)
+	if err != nil {
+		writeFolderError(w, err, "counting folder links")
+		return
+	}
+	writeFolder(w, http.StatusOK, tree.view(folder, counts), nil)
+}
+
+// deleteFolder handles DELETE /folders/{id}. A folder with active links or subfolders needs
+// ?move_to=<folder id|root>, which receives both; without it the answer is 409.
+func deleteFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		writeFolderError(w, err, "loading folders")
+		return
+	}
+	folder, ok := folderFromPath(w, r, tree)
+	if !ok {
+		return
+	}
+	counts, err := store.FolderLinkCounts(ctx, userID)
+	if err != nil {
+		writeFolderError(w, err, "counting folder links")
+		return
+	}
+	links := counts[folder.ID.Hex()].Links
+	children := tree.children(folder)
+
+	moveTo := r.URL.Query().Get("move_to")
+	if moveTo == "" && (links > 0 || len(children) > 0) {
+		writeJSONError(w, http.StatusConflict, ErrCodeFolderNotEmpty,
+			"The folder is not empty; pass ?move_to= with another folder or root to move its contents",
+			map[string]interface{}{"links": links, "subfolders": len(children)})
+		return
+	}
+	target, err := tree.resolveFolderRef(moveTo)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "move_to folder not found", http.StatusBadRequest)
+		return
+	}
+	if target != nil && strings.HasPrefix(target.Path, folder.Path) {
+		http.Error(w, "move_to must be outside the deleted folder", http.StatusUnprocessableEntity)
+		return
+	}
+	for _, child := range children {
+		if err := tree.checkPlacement(child, target, child.NameKey); err != nil {
+			if errors.Is(err, ErrDuplicate) {
+				http.Error(w, "move_to already has a folder named "+child.Name, http.StatusConflict)
+			} else {
+				writeFolderError(w, err, "deleting folder")
+			}
+			return
+		}
+	}
+
+	// Links and subfolders move first, so a failure never leaves them in a missing folder
+	targetID := ""
+	if target != nil {
+		targetID = target.ID.Hex()
+	}
+	movedLinks, err := store.RefileFolderLinks(ctx, userID, folder.ID.Hex(), targetID)
+	if err != nil {
+		writeFolderError(w, err, "moving folder links")
+		return
+	}
+	now := clock.Now()
+	var moved []*Folder
+	for _, child := range children {
+		moved = append(moved, tree.reparent(child, target, now)...)
+	}
+	if err := store.UpdateFolders(ctx, moved); err != nil {
+		writeFolderError(w, err, "moving subfolders")
+		return
+	}
+	if err := store.DeleteFolder(ctx, folder); err != nil {
+		writeFolderError(w, err, "deleting folder")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"message":          "Folder deleted",
+		"moved_links":      movedLinks,
+		"moved_subfolders": len(children),
+	}); err != nil {
+		log.Printf("error encoding folder deletion response: %v", err)
+	}
+}
+
+// moveLinks files the user's links with codes in the folder ref names and answers with the
+// number moved
+func moveLinks(w http.ResponseWriter, r *http.Request, userID string, codes []string, ref string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	folderID := ""
+	if ref != "" && ref != rootFolderID {
+		id, err := primitive.ObjectIDFromHex(ref)
+		if err != nil {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		if _, err := store.FindFolder(ctx, userID, id); err != nil {
+			writeFolderError(w, err, "loading folder")
+			return
+		}
+		folderID = ref
+	}
+	moved, err := store.MoveLinksToFolder(ctx, userID, codes, folderID)
+	if err != nil {
+		log.Printf("error moving links of user %s: %v", userID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if moved == 0 {
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"folder_id": folderID,
+		"moved":     moved,
+		"requested": len(codes),
+	}); err != nil {
+		log.Printf("error encoding move response: %v", err)
+	}
+}
+
+// moveLinkToFolder handles PUT /url/{code}/folder {"folder_id": "..."}; an empty folder_id or
+// root takes the link out of its folder
+func moveLinkToFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		FolderID string `json:"folder_id"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	moveLinks(w, r, userID, []string{mux.Vars(r)["code"]}, req.FolderID)
+}
+
+// moveLinksToFolder handles POST /folders/move {"codes": [...], "folder_id": "..."}
+func moveLinksToFolder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		Codes    []string `json:"codes"`
+		FolderID string   `json:"folder_id"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.Codes) == 0 || len(req.Codes) > maxFolderMoveCodes {
+		http.Error(w, fmt.Sprintf("codes must list 1 to %d short URLs", maxFolderMoveCodes), http.StatusBadRequest)
+		return
+	}
+	for i, code := range req.Codes {
+		req.Codes[i] = sanitizeInput(code)
+	}
+	moveLinks(w, r, userID, req.Codes, req.FolderID)
+}
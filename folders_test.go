@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// folderAnswer is a folder as the folder endpoints return it
+type folderAnswer struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	ParentID string       `json:"parent_id"`
+	Depth    int          `json:"depth"`
+	FullName string       `json:"full_name"`
+	Counts   FolderCounts `json:"counts"`
+	Subtree  FolderCounts `json:"subtree"`
+}
+
+// createFolder creates a folder named name in parentID ("" for the top level)
+func (s *testServer) createFolder(token, name, parentID string) folderAnswer {
+	s.t.Helper()
+	var created struct {
+		Folder folderAnswer `json:"folder"`
+	}
+	resp := s.do("POST", "/folders", token, map[string]string{"name": name, "parent_id": parentID}, &created)
+	if resp.StatusCode != http.StatusCreated {
+		s.t.Fatalf("create folder %s: status %d: %s", name, resp.StatusCode, readBody(s.t, resp))
+	}
+	return created.Folder
+}
+
+// folders returns the user's folders by full name
+func (s *testServer) folders(token string) map[string]folderAnswer {
+	s.t.Helper()
+	var list struct {
+		Folders []folderAnswer `json:"folders"`
+	}
+	if resp := s.do("GET", "/folders", token, nil, &list); resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("list folders: status %d", resp.StatusCode)
+	}
+	byName := make(map[string]folderAnswer)
+	for _, folder := range list.Folders {
+		byName[folder.FullName] = folder
+	}
+	return byName
+}
+
+// listedCodes returns the codes GET /analytics lists for query, sorted
+func (s *testServer) listedCodes(token, query string) []string {
+	s.t.Helper()
+	var page struct {
+		URLs []struct {
+			ShortURL string `json:"short_url"`
+		} `json:"urls"`
+	}
+	if resp := s.do("GET", "/analytics?"+query, token, nil, &page); resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("analytics?%s: status %d", query, resp.StatusCode)
+	}
+	codes := make([]string, 0, len(page.URLs))
+	for _, link := range page.URLs {
+		codes = append(codes, link.ShortURL)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestFolderTree(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+
+	products := srv.createFolder(token, "Products", "")
+	eu := srv.createFolder(token, "EU", products.ID)
+	year := srv.createFolder(token, "2024", eu.ID)
+	if year.FullName != "Products/EU/2024" || year.Depth != 3 || year.ParentID != eu.ID {
+		t.Fatalf("nested folder %+v", year)
+	}
+	// Names are unique per parent, ignoring case, but may repeat elsewhere
+	if resp := srv.do("POST", "/folders", token, map[string]string{"name": "eu", "parent_id": products.ID}, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("duplicate name: status %d", resp.StatusCode)
+	}
+	srv.createFolder(token, "EU", "")
+	srv.createFolder(other, "Products", "")
+
+	// Five levels at most
+	parent := year.ID
+	parent = srv.createFolder(token, "Q1", parent).ID
+	srv.createFolder(token, "January", parent)
+	if resp := srv.do("POST", "/folders", token, map[string]string{"name": "Too deep", "parent_id": srv.folders(token)["Products/EU/2024/Q1/January"].ID}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("sixth level: status %d", resp.StatusCode)
+	}
+
+	for _, tt := range []struct {
+		name, parentID string
+		status         int
+	}{
+		{"", "", http.StatusBadRequest},
+		{"A/B", "", http.StatusBadRequest},
+		{strings.Repeat("n", maxFolderNameLength+1), "", http.StatusBadRequest},
+		{"Orphan", primitive.NewObjectID().Hex(), http.StatusBadRequest},
+		{"Foreign", srv.folders(other)["Products"].ID, http.StatusBadRequest},
+	} {
+		if resp := srv.do("POST", "/folders", token, map[string]string{"name": tt.name, "parent_id": tt.parentID}, nil); resp.StatusCode != tt.status {
+			t.Errorf("create %q in %q: status %d, want %d", tt.name, tt.parentID, resp.StatusCode, tt.status)
+		}
+	}
+	if resp := srv.do("GET", "/folders/"+products.ID, other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("another user's folder: status %d", resp.StatusCode)
+	}
+}
+
+func TestFolderMoves(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	products := srv.createFolder(token, "Products", "")
+	eu := srv.createFolder(token, "EU", products.ID)
+	year := srv.createFolder(token, "2024", eu.ID)
+
+	filed := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/filed", "folder_id": products.ID})
+	a := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/a"})
+	b := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/b"})
+	c := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/c"})
+	foreign := srv.shorten(other, map[string]interface{}{"long-url": "https://example.com/foreign"})
+
+	// One link, then several
+	if resp := srv.do("PUT", "/url/"+a+"/folder", token, map[string]string{"folder_id": eu.ID}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("move one link: status %d", resp.StatusCode)
+	}
+	var moved struct {
+		Moved     int `json:"moved"`
+		Requested int `json:"requested"`
+	}
+	srv.do("POST", "/folders/move", token, map[string]interface{}{"codes": []string{b, c, foreign}, "folder_id": year.ID}, &moved)
+	if moved.Moved != 2 || moved.Requested != 3 {
+		t.Fatalf("bulk move %+v", moved)
+	}
+	if resp := srv.do("PUT", "/url/"+foreign+"/folder", token, map[string]string{"folder_id": eu.ID}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("another user's link: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("PUT", "/url/"+a+"/folder", other, map[string]string{"folder_id": eu.ID}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("into another user's folder: status %d", resp.StatusCode)
+	}
+
+	// Counts of each folder and of its subtree, with the clicks
+	srv.do("GET", "/"+c, "", nil, nil)
+	srv.do("GET", "/"+c, "", nil, nil)
+	drainClicks(t)
+	folders := srv.folders(token)
+	if got := folders["Products"]; got.Counts != (FolderCounts{Links: 1}) || got.Subtree != (FolderCounts{Links: 4, Clicks: 2}) {
+		t.Fatalf("Products counts %+v, subtree %+v", got.Counts, got.Subtree)
+	}
+	if got := folders["Products/EU/2024"]; got.Counts != (FolderCounts{Links: 2, Clicks: 2}) || got.Subtree != got.Counts {
+		t.Fatalf("2024 counts %+v, subtree %+v", got.Counts, got.Subtree)
+	}
+
+	// Moving a folder takes its subtree along
+	var updated struct {
+		Folder folderAnswer `json:"folder"`
+	}
+	if resp := srv.do("PUT", "/folders/"+eu.ID, token, map[string]string{"name": "Europe", "parent_id": ""}, &updated); resp.StatusCode != http.StatusOK {
+		t.Fatalf("move folder: status %d", resp.StatusCode)
+	}
+	folders = srv.folders(token)
+	if got := folders["Europe/2024"]; got.ID != year.ID || got.Depth != 2 || updated.Folder.Subtree.Links != 3 {
+		t.Fatalf("after the move: %v", folders)
+	}
+	if got := srv.listedCodes(token, "folder_id="+products.ID+"&subfolders=true"); len(got) != 1 || got[0] != filed {
+		t.Fatalf("Products subtree after the move: %v", got)
+	}
+
+	// No cycles, and no subtree deeper than five levels
+	if resp := srv.do("PUT", "/folders/"+eu.ID, token, map[string]string{"name": "Europe", "parent_id": year.ID}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("move into its own subfolder: status %d", resp.StatusCode)
+	}
+	deep := products.ID
+	for _, name := range []string{"L2", "L3", "L4"} {
+		deep = srv.createFolder(token, name, deep).ID
+	}
+	if resp := srv.do("PUT", "/folders/"+eu.ID, token, map[string]string{"name": "Europe", "parent_id": deep}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("move past five levels: status %d", resp.StatusCode)
+	}
+}
+
+func TestFolderListing(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	products := srv.createFolder(token, "Products", "")
+	eu := srv.createFolder(token, "EU", products.ID)
+	top := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/top", "folder_id": products.ID})
+	nested := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/nested", "folder_id": eu.ID})
+	unfiled := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/unfiled"})
+
+	sorted := func(codes ...string) string {
+		sort.Strings(codes)
+		return strings.Join(codes, ",")
+	}
+	for query, want := range map[string]string{
+		"folder_id=" + products.ID:                      sorted(top),
+		"folder_id=" + products.ID + "&subfolders=true": sorted(top, nested),
+		"folder_id=" + eu.ID + "&subfolders=true":       sorted(nested),
+		"folder_id=root":                                sorted(unfiled),
+		"":                                              sorted(top, nested, unfiled),
+	} {
+		if got := strings.Join(srv.listedCodes(token, query), ","); got != want {
+			t.Errorf("analytics?%s lists %s, want %s", query, got, want)
+		}
+	}
+	for _, ref := range []string{primitive.NewObjectID().Hex(), "not-an-id"} {
+		if resp := srv.do("GET", "/analytics?folder_id="+ref, token, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("folder_id=%s: status %d", ref, resp.StatusCode)
+		}
+	}
+}
+
+func TestDeleteFolderGuard(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	products := srv.createFolder(token, "Products", "")
+	eu := srv.createFolder(token, "EU", products.ID)
+	archive := srv.createFolder(token, "Archive", "")
+	srv.createFolder(token, "EU", archive.ID)
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/guarded", "folder_id": products.ID})
+
+	var refused struct {
+		Error struct {
+			Code       string `json:"code"`
+			Links      int    `json:"links"`
+			Subfolders int    `json:"subfolders"`
+		} `json:"error"`
+	}
+	resp := srv.do("DELETE", "/folders/"+products.ID, token, nil, &refused)
+	if resp.StatusCode != http.StatusConflict || refused.Error.Code != ErrCodeFolderNotEmpty || refused.Error.Links != 1 || refused.Error.Subfolders != 1 {
+		t.Fatalf("non-empty folder: status %d, %+v", resp.StatusCode, refused.Error)
+	}
+	for target, status := range map[string]int{
+		eu.ID:                         http.StatusUnprocessableEntity, // inside the deleted folder
+		archive.ID:                    http.StatusConflict,            // already has an EU
+		primitive.NewObjectID().Hex(): http.StatusBadRequest,
+	} {
+		if resp := srv.do("DELETE", "/folders/"+products.ID+"?move_to="+target, token, nil, nil); resp.StatusCode != status {
+			t.Errorf("move_to=%s: status %d, want %d", target, resp.StatusCode, status)
+		}
+	}
+	if _, ok := srv.folders(token)["Products"]; !ok {
+		t.Fatal("refused deletion removed the folder")
+	}
+
+	// Contents go to the top level
+	var deleted struct {
+		MovedLinks      int `json:"moved_links"`
+		MovedSubfolders int `json:"moved_subfolders"`
+	}
+	if resp := srv.do("DELETE", "/folders/"+products.ID+"?move_to=root", token, nil, &deleted); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete with move_to=root: status %d", resp.StatusCode)
+	}
+	if deleted.MovedLinks != 1 || deleted.MovedSubfolders != 1 {
+		t.Fatalf("deleted %+v", deleted)
+	}
+	folders := srv.folders(token)
+	if _, ok := folders["Products"]; ok || folders["EU"].ID != eu.ID || folders["EU"].Depth != 1 {
+		t.Fatalf("after deletion: %v", folders)
+	}
+	if got := srv.listedCodes(token, "folder_id=root"); len(got) != 1 || got[0] != code {
+		t.Fatalf("unfiled after deletion: %v", got)
+	}
+
+	// Empty folders go without ?move_to=
+	if resp := srv.do("DELETE", "/folders/"+eu.ID, token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("empty folder: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ============================================================================
+// COUNTRY RESTRICTIONS
+// ============================================================================
+//
+// A link with allowed_countries only redirects visitors from those countries, and a link with
+// blocked_countries refuses visitors from those; a link sets one list or the other, as ISO
+// 3166-1 alpha-2 codes. A refused visitor is sent to the link's geo_fallback_url or gets a
+// localized 451 page, and the refusal counts as the geo_blocked redirect outcome. The tree has
+// no GeoIP database: countries come from GEO_COUNTRY_HEADER (e.g. CF-IPCountry), read only
+// on requests from TRUSTED_PROXIES, or from a resolver installed with SetCountryResolver.
+// When the country is unknown, GEO_UNKNOWN_POLICY decides: allow (default) or deny. Click
+// locations are not recorded, so there is no per-country click distribution to mark refused
+// visits in; they show up in the link's outcome counts only.
+
+// Redirect behavior for visitors whose country is unknown
+const (
+	GeoUnknownAllow = "allow"
+	GeoUnknownDeny  = "deny"
+)
+
+// errCountryUnknown is returned by resolvers that cannot place a visitor
+var errCountryUnknown = errors.New("country unknown")
+
+// CountryResolver finds the country of a redirect's visitor
+type CountryResolver interface {
+	// Country returns the visitor's ISO 3166-1 alpha-2 code for r, sent from clientIP
+	Country(r *http.Request, clientIP string) (string, error)
+}
+
+// noCountryResolver is used when no source of countries is configured
+type noCountryResolver struct{}
+
+func (noCountryResolver) Country(*http.Request, string) (string, error) {
+	return "", errCountryUnknown
+}
+
+// headerCountryResolver reads the country a CDN or proxy in TRUSTED_PROXIES put in a header
+type headerCountryResolver struct {
+	header string
+}
+
+func (h headerCountryResolver) Country(r *http.Request, _ string) (string, error) {
+	if !fromTrustedProxy(r) {
+		return "", errCountryUnknown
+	}
+	country := strings.ToUpper(strings.TrimSpace(r.Header.Get(h.header)))
+	if !isCountryCode(country) {
+		return "", errCountryUnknown
+	}
+	return country, nil
+}
+
+var (
+	countries        CountryResolver = noCountryResolver{}
+	geoUnknownPolicy                 = GeoUnknownAllow
+)
+
+// SetCountryResolver installs a custom resolver, e.g. one backed by a GeoIP database; call
+// before the server starts
+func SetCountryResolver(resolver CountryResolver) {
+	if resolver == nil {
+		resolver = noCountryResolver{}
+	}
+	countries = resolver
+}
+
+// InitGeoRestrictions configures the country source and the unknown-country policy from the
+// environment
+func InitGeoRestrictions() error {
+	switch policy := strings.ToLower(os.Getenv("GEO_UNKNOWN_POLICY")); policy {
+	case "":
+	case GeoUnknownAllow, GeoUnknownDeny:
+		geoUnknownPolicy = policy
+	default:
+		return fmt.Errorf("GEO_UNKNOWN_POLICY must be %q or %q", GeoUnknownAllow, GeoUnknownDeny)
+	}
+	if header := os.Getenv("GEO_COUNTRY_HEADER"); header != "" {
+		SetCountryResolver(headerCountryResolver{header: http.CanonicalHeaderKey(header)})
+		log.Printf("🌍 Visitor countries are read from %s (unknown countries: %s)", header, geoUnknownPolicy)
+	}
+	return nil
+}
+
+// countryCodes holds the officially assigned ISO 3166-1 alpha-2 codes
+var countryCodes = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, code := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ
+		BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM
+		DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS
+		GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN
+		KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+		MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM
+		PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV
+		SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI
+		VN VU WF WS YE YT ZA ZM ZW`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// isCountryCode reports whether code is an assigned ISO 3166-1 alpha-2 code in upper case
+func isCountryCode(code string) bool {
+	return countryCodes[code]
+}
+
+// normalizeCountries upper-cases, checks and de-duplicates a list of country codes; field
+// names the list in errors
+func normalizeCountries(field string, codes []string) ([]string, error) {
+	if len(codes) > len(countryCodes) {
+		return nil, fmt.Errorf("%s accepts at most %d countries", field, len(countryCodes))
+	}
+	seen := make(map[string]bool, len(codes))
+	var normalized []string
+	for _, raw := range codes {
+		code := strings.ToUpper(strings.TrimSpace(raw))
+		if !isCountryCode(code) {
+			return nil, fmt.Errorf("invalid %s entry %q: use ISO 3166-1 alpha-2 codes such as US or DE", field, raw)
+		}
+		if !seen[code] {
+			seen[code] = true
+			normalized = append(normalized, code)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// validateGeoRestriction normalizes the country options of a new link
+func validateGeoRestriction(allowed, blocked []string, fallbackURL string) ([]string, []string, error) {
+	allowed, err := normalizeCountries("allowed_countries", allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocked, err = normalizeCountries("blocked_countries", blocked)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(allowed) > 0 && len(blocked) > 0 {
+		return nil, nil, errors.New("set either allowed_countries or blocked_countries, not both")
+	}
+	if fallbackURL != "" && !validateURL(fallbackURL) {
+		return nil, nil, errors.New("Invalid geo_fallback_url. Must be a valid HTTP or HTTPS URL")
+	}
+	return allowed, blocked, nil
+}
+
+// geoRestricted reports whether link limits the countries it redirects visitors from
+func geoRestricted(link *URLData) bool {
+	return len(link.AllowedCountries) > 0 || len(link.BlockedCountries) > 0
+}
+
+// countryAllowed reports whether the visitor of r may follow link, and the country found
+func countryAllowed(r *http.Request, clientIP string, link *URLData) (bool, string) {
+	if !geoRestricted(link) {
+		return true, ""
+	}
+	country, err := countries.Country(r, clientIP)
+	if err != nil || !isCountryCode(country) {
+		incMetric("geo_lookups_unknown_total", 1)
+		return geoUnknownPolicy == GeoUnknownAllow, ""
+	}
+	if len(link.AllowedCountries) > 0 {
+		return containsString(link.AllowedCountries, country), country
+	}
+	return !containsString(link.BlockedCountries, country), country
+}
+
+// writeGeoBlocked answers a refused visitor with the link's country fallback URL, when it has
+// one, or a localized 451 page; other clients get plain text
+func writeGeoBlocked(w http.ResponseWriter, r *http.Request, link *URLData) {
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	if link.GeoFallbackURL != "" && !isSelfRedirect(r, link.GeoFallbackURL) {
+		http.Redirect(w, r, link.GeoFallbackURL, http.StatusFound)
+		return
+	}
+	if !wantsHTML(r) {
+		http.Error(w, "This link is not available in your country", http.StatusUnavailableForLegalReasons)
+		return
+	}
+	writeLocalizedPage(w, r, http.StatusUnavailableForLegalReasons, "geo_blocked", "")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubCountries places the fixture IPs of tests in countries
+type stubCountries map[string]string
+
+func (s stubCountries) Country(_ *http.Request, clientIP string) (string, error) {
+	if country, ok := s[clientIP]; ok {
+		return country, nil
+	}
+	return "", errCountryUnknown
+}
+
+// withCountries makes redirects look visitor countries up with resolver
+func withCountries(t *testing.T, resolver CountryResolver) {
+	t.Helper()
+	saved, savedPolicy := countries, geoUnknownPolicy
+	SetCountryResolver(resolver)
+	t.Cleanup(func() { countries, geoUnknownPolicy = saved, savedPolicy })
+}
+
+const (
+	germanVisitor   = "198.51.100.10"
+	americanVisitor = "203.0.113.20"
+	unknownVisitor  = "192.0.2.30"
+)
+
+func TestGeoRestrictedRedirects(t *testing.T) {
+	srv := newTestServer(t)
+	withCountries(t, stubCountries{germanVisitor: "DE", americanVisitor: "US"})
+	token, _ := srv.register()
+	allowed := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/de", "allowed_countries": []string{"de"}})
+	blocked := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/embargo", "blocked_countries": []string{"US", "CU"}})
+	fallback := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/de-only", "allowed_countries": []string{"DE"}, "geo_fallback_url": "https://example.com/elsewhere"})
+	open := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/open"})
+
+	visit := func(code, ip string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+code, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return srv.serveFrom(ip+":4000", req)
+	}
+
+	tests := []struct {
+		code, ip string
+		status   int
+	}{
+		{allowed, germanVisitor, http.StatusMovedPermanently},
+		{allowed, americanVisitor, http.StatusUnavailableForLegalReasons},
+		{allowed, unknownVisitor, http.StatusMovedPermanently},
+		{blocked, germanVisitor, http.StatusMovedPermanently},
+		{blocked, americanVisitor, http.StatusUnavailableForLegalReasons},
+		{blocked, unknownVisitor, http.StatusMovedPermanently},
+		{open, americanVisitor, http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		resp := visit(tt.code, tt.ip, nil)
+		if resp.Code != tt.status {
+			t.Errorf("%s from %s: status %d, want %d", tt.code, tt.ip, resp.Code, tt.status)
+		}
+		if tt.code != open && resp.Header().Get("Cache-Control") != "no-cache, no-store, must-revalidate" {
+			t.Errorf("%s from %s: Cache-Control %q", tt.code, tt.ip, resp.Header().Get("Cache-Control"))
+		}
+	}
+
+	// A refused visitor follows the fallback URL or gets a localized page
+	if resp := visit(fallback, americanVisitor, nil); resp.Code != http.StatusFound || resp.Header().Get("Location") != "https://example.com/elsewhere" {
+		t.Errorf("fallback: status %d, Location %q", resp.Code, resp.Header().Get("Location"))
+	}
+	page := visit(allowed, americanVisitor, http.Header{"Accept": {"text/html"}, "Accept-Language": {"de-DE,de;q=0.9"}})
+	if page.Code != http.StatusUnavailableForLegalReasons || !strings.Contains(page.Body.String(), "Dieser Link ist in Ihrem Land nicht verfügbar.") {
+		t.Errorf("German page: status %d\n%s", page.Code, page.Body.String())
+	}
+	drainClicks(t)
+
+	// Refusals count as geo_blocked, allowed visits as success
+	for code, want := range map[string][2]int64{allowed: {2, 2}, blocked: {2, 1}, fallback: {0, 1}, open: {1, 0}} {
+		totals, _ := srv.linkOutcomeTotals(token, code)
+		if totals[OutcomeSuccess] != want[0] || totals[OutcomeGeoBlocked] != want[1] {
+			t.Errorf("%s: %d success, %d geo_blocked; want %v", code, totals[OutcomeSuccess], totals[OutcomeGeoBlocked], want)
+		}
+	}
+
+	// Under the deny policy unknown visitors are refused, by restricted links only
+	geoUnknownPolicy = GeoUnknownDeny
+	unknown := metricValue("geo_lookups_unknown_total")
+	if resp := visit(allowed, unknownVisitor, nil); resp.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("unknown visitor under deny: status %d", resp.Code)
+	}
+	if resp := visit(open, unknownVisitor, nil); resp.Code != http.StatusMovedPermanently {
+		t.Errorf("unrestricted link under deny: status %d", resp.Code)
+	}
+	if got := metricValue("geo_lookups_unknown_total"); got != unknown+1 {
+		t.Errorf("geo_lookups_unknown_total %d, want %d", got, unknown+1)
+	}
+}
+
+func TestCountryHeader(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	withCountries(t, nil)
+	t.Setenv("GEO_COUNTRY_HEADER", "cf-ipcountry")
+	t.Setenv("GEO_UNKNOWN_POLICY", "DENY")
+	if err := InitGeoRestrictions(); err != nil {
+		t.Fatal(err)
+	}
+	if geoUnknownPolicy != GeoUnknownDeny {
+		t.Errorf("policy %q", geoUnknownPolicy)
+	}
+
+	link := &URLData{AllowedCountries: []string{"DE"}}
+	tests := []struct {
+		peer, header string
+		allowed      bool
+		country      string
+	}{
+		{"10.0.0.1:4000", "de", true, "DE"},
+		{"10.0.0.1:4000", "US", false, "US"},
+		{"10.0.0.1:4000", "XX", false, ""},
+		{"10.0.0.1:4000", "", false, ""},
+		// Only proxies are believed about the visitor's country
+		{"203.0.113.20:4000", "DE", false, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/code", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("CF-IPCountry", tt.header)
+		if allowed, country := countryAllowed(r, splitHost(tt.peer), link); allowed != tt.allowed || country != tt.country {
+			t.Errorf("%s with %q: %v, %q; want %v, %q", tt.peer, tt.header, allowed, country, tt.allowed, tt.country)
+		}
+	}
+
+	t.Setenv("GEO_UNKNOWN_POLICY", "maybe")
+	if err := InitGeoRestrictions(); err == nil {
+		t.Error("GEO_UNKNOWN_POLICY=maybe accepted")
+	}
+}
+
+func TestValidateGeoRestriction(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowed, blocked []string
+		fallback         string
+		wantAllowed      string
+		valid            bool
+	}{
+		{"allowed", []string{" us", "de", "US"}, nil, "", "DE US", true},
+		{"blocked", nil, []string{"cu", "ir"}, "https://example.com/", "", true},
+		{"none", nil, nil, "", "", true},
+		{"both lists", []string{"DE"}, []string{"US"}, "", "", false},
+		{"UK is not a code", []string{"UK"}, nil, "", "", false},
+		{"alpha-3", []string{"DEU"}, nil, "", "", false},
+		{"empty entry", []string{""}, nil, "", "", false},
+		{"fallback not http", []string{"DE"}, nil, "javascript:alert(1)", "", false},
+	}
+	for _, tt := range tests {
+		allowed, _, err := validateGeoRestriction(tt.allowed, tt.blocked, tt.fallback)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.valid && strings.Join(allowed, " ") != tt.wantAllowed {
+			t.Errorf("%s: allowed %v, want %s", tt.name, allowed, tt.wantAllowed)
+		}
+	}
+}
@@ -1,1349 +1,2072 @@
-package main
-
-import (
-	"context"
-	"crypto/sha256"
-	"encoding/csv"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"math/big"
-	"math/rand"
-	"mime/multipart"
-	"net/http"
-	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
-	"sync"
-	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-)
-
-// ============================================================================
-// BASE58 ENCODING CONFIGURATION
-// ============================================================================
-
-// Base58 alphabet (Bitcoin-style) - excludes confusing characters 0, O, I, l
-const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
-
-// encodeBase58 converts a big integer to base58 string
-func encodeBase58(num *big.Int) string {
-	if num.Cmp(big.NewInt(0)) == 0 {
-		return "1"
-	}
-
-	var result []byte
-	base := big.NewInt(58)
-	zero := big.NewInt(0)
-	mod := new(big.Int)
-	numCopy := new(big.Int).Set(num) // Create a copy to avoid modifying original
-
-	for numCopy.Cmp(zero) > 0 {
-		numCopy.DivMod(numCopy, base, mod)
-		result = append([]byte{base58Alphabet[mod.Int64()]}, result...)
-	}
-
-	return string(result)
-}
-
-// padBase58 ensures minimum length by prepending '1' characters
-func padBase58(code string, minLength int) string {
-	for len(code) < minLength {
-		code = "1" + code // "1" represents zero in base58
-	}
-	return code
-}
-
-// generateBase58Suffix creates a random base58 suffix
-func generateBase58Suffix(length int) string {
-	suffix := ""
-	for i := 0; i < length; i++ {
-		suffix += string(base58Alphabet[rand.Intn(58)])
-	}
-	return suffix
-}
-
-// sanitizeStringSlice sanitizes each string in a slice
-func sanitizeStringSlice(input []string) []string {
-	result := make([]string, len(input))
-	for i, s := range input {
-		result[i] = sanitizeInput(s)
-	}
-	return result
-}
-
-// ============================================================================
-// DATA STRUCTURES
-// ============================================================================
-
-type ClickHistory struct {
-	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
-	IP        string    `bson:"ip" json:"ip"`
-	UserAgent string    `bson:"user_agent" json:"user_agent"`
-}
-
-// ShortenRequest represents the JSON payload for URL shortening
-type ShortenRequest struct {
-	LongURL string   `json:"long-url"`
-	Custom  string   `json:"custom,omitempty"`
-	Expires string   `json:"expires,omitempty"`
-	Domain  string   `json:"domain,omitempty"`
-	Tags    []string `json:"tags,omitempty"`
-}
-
-type URLData struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	ShortURL     string             `bson:"short_url" json:"short-url"`
-	LongURL      string             `bson:"long_url" json:"long-url"`
-	Domain       string             `bson:"domain,omitempty" json:"domain,omitempty"`
-	Tags         []string           `bson:"tags,omitempty" json:"tags,omitempty"`
-	UserID       string             `bson:"user_id" json:"user_id"`
-	CreatedAt    time.Time          `bson:"created_at" json:"created-at"`
-	ExpiresAt    *time.Time         `bson:"expires_at,omitempty" json:"expires-at,omitempty"`
-	Clicks       int                `bson:"clicks" json:"clicks"`
-	IsActive     bool               `bson:"is_active" json:"is-active"`
-	LastClicked  *time.Time         `bson:"last_clicked,omitempty" json:"last-clicked,omitempty"`
-	ClickHistory []ClickHistory     `bson:"click_history" json:"click_history"`
-}
-
-// ============================================================================
-// BULK UPLOAD DATA STRUCTURES
-// ============================================================================
-
-type BulkURLRequest struct {
-	LongURL     string   `json:"long_url"`
-	Domain      string   `json:"domain,omitempty"`
-	CustomAlias string   `json:"custom,omitempty"`
-	Tags        []string `json:"tags,omitempty"`
-	Expires     string   `json:"expires,omitempty"`
-}
-
-type BulkURLResult struct {
-	LongURL   string   `json:"long_url"`
-	ShortURL  string   `json:"short_url,omitempty"`
-	Domain    string   `json:"domain,omitempty"`
-	Tags      []string `json:"tags,omitempty"`
-	Success   bool     `json:"success"`
-	Error     string   `json:"error,omitempty"`
-	CreatedAt string   `json:"created_at,omitempty"`
-}
-
-type BulkResponse struct {
-	TotalProcessed int             `json:"total_processed"`
-	Successful     int             `json:"successful"`
-	Failed         int             `json:"failed"`
-	Results        []BulkURLResult `json:"results"`
-	ProcessingTime string          `json:"processing_time"`
-}
-
-// ============================================================================
-// AUTHENTICATION HANDLERS
-// ============================================================================
-
-// register handles POST /auth/register requests
-func register(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-
-	var req AuthRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("error decoding register request: %v", err)
-		logSecurityEvent("INVALID_REGISTER_PAYLOAD", "", clientIP, r.UserAgent(),
-			"Invalid JSON payload", "WARN")
-		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
-		return
-	}
-
-	// Sanitize all inputs to prevent XSS
-	req.Username = sanitizeInput(req.Username)
-	req.Email = sanitizeInput(req.Email)
-	req.Password = sanitizeInput(req.Password)
-
-	// Validate inputs with enhanced security checks
-	if !validateUsername(req.Username) {
-		logSecurityEvent("INVALID_USERNAME", "", clientIP, r.UserAgent(),
-			"Invalid username format: "+req.Username, "WARN")
-		http.Error(w, "Invalid username format. Use 3-30 alphanumeric characters, dots, underscores, or hyphens", http.StatusBadRequest)
-		return
-	}
-
-	if !validateEmail(req.Email) {
-		logSecurityEvent("INVALID_EMAIL", "", clientIP, r.UserAgent(),
-			"Invalid email format: "+req.Email, "WARN")
-		http.Error(w, "Invalid email format", http.StatusBadRequest)
-		return
-	}
-
-	if !validatePassword(req.Password) {
-		logSecurityEvent("WEAK_PASSWORD", "", clientIP, r.UserAgent(),
-			"Password does not meet security requirements", "WARN")
-		http.Error(w, "Password must be 8-128 characters with at least one letter and one number", http.StatusBadRequest)
-		return
-	}
-
-	// Create user with enhanced security
-	user, err := CreateUserWithTransaction(req.Username, req.Email, req.Password)
-	if err != nil {
-		log.Printf("error creating user: %v", err)
-		logSecurityEvent("USER_CREATION_FAILED", "", clientIP, r.UserAgent(),
-			err.Error(), "ERROR")
-		if strings.Contains(err.Error(), "already exists") {
-			http.Error(w, "user with this username or email already exists", http.StatusConflict)
-		} else {
-			http.Error(w, "failed to create user", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Generate access token
-	token, expiresAt, err := GenerateToken(user)
-	if err != nil {
-		log.Printf("error generating token: %v", err)
-		logSecurityEvent("TOKEN_GENERATION_FAILED", user.ID.Hex(), clientIP, r.UserAgent(),
-			"Token generation failed", "ERROR")
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
-		return
-	}
-
-	// Generate refresh token
-	refreshToken, err := GenerateRefreshToken()
-	if err != nil {
-		log.Printf("error generating refresh token: %v", err)
-		http.Error(w, "failed to generate refresh token", http.StatusInternalServerError)
-		return
-	}
-	refreshExpiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
-	if err := SetRefreshToken(user.ID.Hex(), refreshToken, refreshExpiry); err != nil {
-		log.Printf("error saving refresh token: %v", err)
-		http.Error(w, "failed to save refresh token", http.StatusInternalServerError)
-		return
-	}
-
-	// Set refresh token as HttpOnly, Secure cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Path:     "/",
-		Expires:  refreshExpiry,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
-
-	// Log successful registration
-	logSecurityEvent("USER_REGISTERED", user.ID.Hex(), clientIP, r.UserAgent(),
-		"User successfully registered", "INFO")
-
-	response := AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
-		User:      *user,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("error encoding register response: %v", err)
-	}
-}
-
-// login handles POST /auth/login requests
-func login(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-
-	var req struct {
-		UsernameOrEmail string `json:"username_or_email"`
-		Password        string `json:"password"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("error decoding login request: %v", err)
-		logSecurityEvent("INVALID_LOGIN_PAYLOAD", "", clientIP, r.UserAgent(),
-			"Invalid JSON payload", "WARN")
-		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
-		return
-	}
-
-	// Sanitize inputs to prevent XSS
-	req.UsernameOrEmail = sanitizeInput(req.UsernameOrEmail)
-	req.Password = sanitizeInput(req.Password)
-
-	// Validate required fields
-	if req.UsernameOrEmail == "" || req.Password == "" {
-		logSecurityEvent("INCOMPLETE_LOGIN_DATA", "", clientIP, r.UserAgent(),
-			"Missing username/email or password", "WARN")
-		http.Error(w, "username/email and password are required", http.StatusBadRequest)
-		return
-	}
-
-	// Validate email format if it looks like an email
-	if strings.Contains(req.UsernameOrEmail, "@") && !validateEmail(req.UsernameOrEmail) {
-		logSecurityEvent("INVALID_LOGIN_EMAIL", "", clientIP, r.UserAgent(),
-			"Invalid email format in login", "WARN")
-		http.Error(w, "Invalid email format", http.StatusBadRequest)
-		return
-	}
-
-	// Get user and verify password
-	user, err := GetUserByCredentials(req.UsernameOrEmail, req.Password)
-	if err != nil {
-		log.Printf("login failed for %s: %v", req.UsernameOrEmail, err)
-		logSecurityEvent("LOGIN_FAILED", "", clientIP, r.UserAgent(),
-			"Login failed for: "+req.UsernameOrEmail, "WARN")
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
-		return
-	}
-
-	// Generate access token
-	token, expiresAt, err := GenerateToken(user)
-	if err != nil {
-		log.Printf("error generating token: %v", err)
-		logSecurityEvent("TOKEN_GENERATION_FAILED", user.ID.Hex(), clientIP, r.UserAgent(),
-			"Token generation failed after successful login", "ERROR")
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
-		return
-	}
-
-	// Generate refresh token
-	refreshToken, err := GenerateRefreshToken()
-	if err != nil {
-		log.Printf("error generating refresh token: %v", err)
-		http.Error(w, "failed to generate refresh token", http.StatusInternalServerError)
-		return
-	}
-	refreshExpiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
-	if err := SetRefreshToken(user.ID.Hex(), refreshToken, refreshExpiry); err != nil {
-		log.Printf("error saving refresh token: %v", err)
-		http.Error(w, "failed to save refresh token", http.StatusInternalServerError)
-		return
-	}
-
-	// Set refresh token as HttpOnly, Secure cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Path:     "/",
-		Expires:  refreshExpiry,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
-
-	// Log successful login
-	logSecurityEvent("USER_LOGIN", user.ID.Hex(), clientIP, r.UserAgent(),
-		"User successfully logged in", "INFO")
-
-	response := AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
-		User:      *user,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("error encoding login response: %v", err)
-	}
-}
-
-// profile handles GET /auth/profile requests (protected) - Enhanced with statistics
-func profile(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from context (set by JWT middleware)
-	userID, ok := r.Context().Value("user_id").(string)
-	if !ok {
-		http.Error(w, "user information not found", http.StatusInternalServerError)
-		return
-	}
-
-	// Get user profile with statistics using optimized function
-	profile, err := GetUserProfile(userID)
-	if err != nil {
-		log.Printf("error getting user profile: %v", err)
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, "user not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "failed to get user profile", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Profile retrieved successfully",
-		"data":    profile,
-	}); err != nil {
-		log.Printf("error encoding profile response: %v", err)
-	}
-}
-
-// validateToken handles POST /auth/validate requests
-func validateToken(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Token string `json:"token"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("error decoding validate request: %v", err)
-		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
-		return
-	}
-
-	if req.Token == "" {
-		http.Error(w, "token is required", http.StatusBadRequest)
-		return
-	}
-
-	claims, err := ValidateToken(req.Token)
-	if err != nil {
-		log.Printf("token validation failed: %v", err)
-		http.Error(w, "invalid or expired token", http.StatusUnauthorized)
-		return
-	}
-
-	response := map[string]interface{}{
-		"valid":    true,
-		"user_id":  claims.UserID,
-		"username": claims.Username,
-		"email":    claims.Email,
-		"expires":  claims.ExpiresAt.Time,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("error encoding validate response: %v", err)
-	}
-}
-
-// refreshTokenHandler handles POST /auth/refresh requests (secure, cookie-based)
-func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// Get refresh token from HttpOnly cookie
-	cookie, err := r.Cookie("refresh_token")
-	if err != nil || cookie.Value == "" {
-		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
-		return
-	}
-	refreshToken := cookie.Value
-
-	// Find user by refresh token (must scan for matching hash)
-	if DB == nil {
-		http.Error(w, "Database not connected", http.StatusInternalServerError)
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	hashed := HashRefreshToken(refreshToken)
-	var user User
-	err = DB.Database.Collection("users").FindOne(ctx, bson.M{"refresh_token": hashed}).Decode(&user)
-	if err != nil {
-		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
-		return
-	}
-	// Validate expiry
-	if !ValidateRefreshToken(&user, refreshToken) {
-		// Clear cookie and DB
-		_ = ClearRefreshToken(user.ID.Hex())
-		http.SetCookie(w, &http.Cookie{
-			Name:     "refresh_token",
-			Value:    "",
-			Path:     "/",
-			Expires:  time.Now().Add(-1 * time.Hour),
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteStrictMode,
-		})
-		http.Error(w, "Refresh token expired or invalid", http.StatusUnauthorized)
-		return
-	}
-
-	// Rotate: generate new refresh token
-	newRefreshToken, err := GenerateRefreshToken()
-	if err != nil {
-		http.Error(w, "Failed to generate refresh token", http.StatusInternalServerError)
-		return
-	}
-	refreshExpiry := time.Now().Add(7 * 24 * time.Hour)
-	if err := SetRefreshToken(user.ID.Hex(), newRefreshToken, refreshExpiry); err != nil {
-		http.Error(w, "Failed to save refresh token", http.StatusInternalServerError)
-		return
-	}
-	// Set new refresh token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    newRefreshToken,
-		Path:     "/",
-		Expires:  refreshExpiry,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
-
-	// Issue new access token
-	accessToken, expiresAt, err := GenerateToken(&user)
-	if err != nil {
-		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
-		return
-	}
-
-	response := map[string]interface{}{
-		"success":    true,
-		"message":    "Token refreshed successfully",
-		"token":      accessToken,
-		"expires_at": expiresAt,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding refresh token response: %v", err)
-	}
-}
-
-// ============================================================================
-// URL MANAGEMENT HANDLERS
-// ============================================================================
-
-// shorten handles PUT /url requests with payload:
-//
-//	{
-//	  "long-url": "https://example.com/very/long/url",     // required: original URL to shorten
-//	  "expires": "2025-12-31T23:59:59Z",                   // optional: define expiration date and time of short URL; default to 5 years
-//	  "custom": "my-custom-url"                            // optional: define custom short URL
-//	}
-//
-// Response:
-//
-//	{
-//	  "long-url": "https://example.com/very/long/url",
-//	  "short-url": "abc123",
-//	  "created-at": "2025-11-17T10:30:00Z",
-//	  "expires-at": "2030-11-17T10:30:00Z",
-//	  "is-active": true
-//	}
-func shorten(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(string)
-	clientIP := getClientIP(r)
-	var req ShortenRequest
-	log.Printf("req: %+v", req)
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("error decoding shorten request: %v", err)
-		logSecurityEvent("INVALID_SHORTEN_PAYLOAD", userID, clientIP, r.UserAgent(),
-			"Invalid JSON payload", "WARN")
-		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
-		return
-	}
-
-	// Sanitize inputs to prevent XSS and other attacks
-	req.LongURL = sanitizeInput(req.LongURL)
-	req.Custom = sanitizeInput(req.Custom)
-	req.Expires = sanitizeInput(req.Expires)
-	req.Domain = sanitizeInput(req.Domain)
-	req.Tags = sanitizeStringSlice(req.Tags)
-	// Default domain to BASE_URL if not provided
-	if req.Domain == "" {
-		req.Domain = os.Getenv("BASE_URL")
-	}
-
-	// Validate URL with enhanced security checks
-	if !validateURL(req.LongURL) {
-		logSecurityEvent("INVALID_URL_FORMAT", userID, clientIP, r.UserAgent(),
-			"Invalid URL format: "+req.LongURL, "WARN")
-		http.Error(w, "Invalid URL format. Must be a valid HTTP or HTTPS URL (no localhost/internal IPs)", http.StatusBadRequest)
-		return
-	}
-
-	// Validate domain if provided
-	if req.Domain != "" && !validateURL(req.Domain) {
-		logSecurityEvent("INVALID_DOMAIN_FORMAT", userID, clientIP, r.UserAgent(),
-			"Invalid domain format: "+req.Domain, "WARN")
-		http.Error(w, "Invalid domain format. Must be a valid HTTP or HTTPS URL (no localhost/internal IPs)", http.StatusBadRequest)
-		return
-	}
-
-	// Validate custom short URL if provided
-	if req.Custom != "" && !validateCustomURL(req.Custom) {
-		logSecurityEvent("INVALID_CUSTOM_URL", userID, clientIP, r.UserAgent(),
-			"Invalid custom URL format: "+req.Custom, "WARN")
-		http.Error(w, "Custom URL must be 3-20 characters, alphanumeric with hyphens/underscores only", http.StatusBadRequest)
-		return
-	}
-
-	// Check if this URL already exists for this user (1-to-1 mapping)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	var existingURL URLData
-	err := DB.Collection.FindOne(ctx, bson.D{
-		{Key: "long_url", Value: req.LongURL},
-		{Key: "domain", Value: req.Domain},
-		{Key: "user_id", Value: userID},
-		{Key: "is_active", Value: true},
-	}).Decode(&existingURL)
-
-	if err == nil {
-		// URL already exists for this user, return existing short URL
-		// Format with BASE_URL for consistent client response
-		// existingURL.ShortURL = os.Getenv("BASE_URL") + "/" + existingURL.ShortURL
-		log.Printf("Returning existing short URL for user %s: %s", userID, existingURL.ShortURL)
-		w.Header().Set("Content-Type", "application/json")
-		addSecurityHeaders(w)
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(existingURL); err != nil {
-			log.Printf("error encoding existing URL response: %v", err)
-		}
-		return
-	} else if err != mongo.ErrNoDocuments {
-		log.Printf("error checking existing URL: %v", err)
-		http.Error(w, "database error", http.StatusInternalServerError)
-		return
-	}
-
-	// Use custom ID if provided, otherwise generate a Base58 short code
-	code := req.Custom
-	if code == "" {
-		// Generate Base58 encoded short code
-		code = generateReadableCode(req.LongURL)
-	}
-
-	// Parse expiry time if provided, otherwise default to 5 years
-	var expiresAt *time.Time
-	if req.Expires != "" {
-		if expiry, err := time.Parse(time.RFC3339, req.Expires); err == nil {
-			expiresAt = &expiry
-		} else {
-			http.Error(w, "invalid expires format, use RFC3339 (e.g., 2025-12-31T23:59:59Z)", http.StatusBadRequest)
-			return
-		}
-	} else {
-		// Default to 5 years from now
-		defaultExpiry := time.Now().UTC().AddDate(5, 0, 0)
-		expiresAt = &defaultExpiry
-	}
-
-	// Create URL data
-	urlData := &URLData{
-		ShortURL:     code,
-		LongURL:      req.LongURL,
-		Domain:       req.Domain,
-		Tags:         req.Tags,
-		UserID:       userID,
-		CreatedAt:    time.Now().UTC(),
-		ExpiresAt:    expiresAt,
-		Clicks:       0,
-		IsActive:     true,
-		ClickHistory: []ClickHistory{},
-	}
-
-	// Check if short URL already exists (collision detection)
-	var existingShort URLData
-	err = DB.Collection.FindOne(ctx, bson.D{{Key: "short_url", Value: code}}).Decode(&existingShort)
-	if err == nil {
-		// Collision detected, generate a new code with suffix
-		log.Printf("Short URL collision detected: %s", code)
-		code = code + generateBase58Suffix(2)
-		urlData.ShortURL = code
-	} else if err != mongo.ErrNoDocuments {
-		log.Printf("error checking short URL collision: %v", err)
-		http.Error(w, "database error", http.StatusInternalServerError)
-		return
-	}
-
-	// Insert into MongoDB
-	result, err := DB.Collection.InsertOne(ctx, urlData)
-	if err != nil {
-		log.Printf("error inserting URL data: %v", err)
-		http.Error(w, "failed to create short URL", http.StatusInternalServerError)
-		return
-	}
-	urlData.ID = result.InsertedID.(primitive.ObjectID)
-
-	// Format short URL with BASE_URL for client response
-	// urlData.ShortURL = os.Getenv("BASE_URL") + "/" + code
-
-	// Log successful URL creation
-	logSecurityEvent("URL_CREATED", userID, clientIP, r.UserAgent(),
-		"URL created: "+req.LongURL+" -> "+code, "INFO")
-
-	log.Printf("✅ Base58 URL created: %s → %s for user %s", req.LongURL, code, userID)
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(urlData); err != nil {
-		log.Printf("error encoding shorten response: %v", err)
-	}
-}
-
-// generateReadableCode creates deterministic, collision-resistant short codes using Base58 encoding
-func generateReadableCode(longURL string) string {
-	// Create SHA256 hash for deterministic generation (maintains 1:1 mapping)
-	hash := sha256.Sum256([]byte(longURL))
-
-	// Convert first 8 bytes to big integer for base58 conversion
-	hashInt := new(big.Int).SetBytes(hash[:8])
-
-	// Convert to base58 - produces shorter, more readable URLs
-	base58Code := encodeBase58(hashInt)
-
-	// Ensure minimum length of 6 characters for consistency
-	if len(base58Code) < 6 {
-		base58Code = padBase58(base58Code, 6)
-	}
-
-	// Truncate if too long (rare case)
-	if len(base58Code) > 10 {
-		base58Code = base58Code[:10]
-	}
-
-	// Check for collision in database (rare with SHA256 + base58)
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Safety check for database connection
-	if DB == nil || DB.Collection == nil {
-		log.Printf("Database not connected, using base58 fallback")
-		return generateBase58Suffix(7) // Fallback to random base58
-	}
-
-	// Check if code exists (very rare collision)
-	var existing URLData
-	err := DB.Collection.FindOne(ctx, bson.D{{Key: "short_url", Value: base58Code}}).Decode(&existing)
-	if err == mongo.ErrNoDocuments {
-		// Code is unique - perfect!
-		return base58Code
-	}
-	if err != nil {
-		log.Printf("Error checking base58 code uniqueness: %v", err)
-		// Add random suffix as fallback
-		return base58Code + generateBase58Suffix(2)
-	}
-
-	// Rare collision detected - add random suffix
-	log.Printf("Base58 collision detected for URL")
-	return base58Code + generateBase58Suffix(2)
-}
-
-// RandString generates a random string using Base58 characters for consistency
-func RandString(n int) string {
-	// Use base58 alphabet for all random generation
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = rune(base58Alphabet[rand.Intn(len(base58Alphabet))])
-	}
-	return string(b)
-}
-
-// analytics returns user's URL statistics with optimized queries
-func analytics(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from context (set by JWT middleware)
-	userID, ok := r.Context().Value("user_id").(string)
-	if !ok {
-		http.Error(w, "user information not found", http.StatusInternalServerError)
-		return
-	}
-
-	// Parse pagination parameters
-	pageStr := r.URL.Query().Get("page")
-	pageSizeStr := r.URL.Query().Get("pageSize")
-	limitStr := r.URL.Query().Get("limit") // fallback for legacy
-	page := 1
-	pageSize := 20
-	if pageStr != "" {
-		if parsedPage, err := strconv.Atoi(pageStr); err == nil && parsedPage > 0 {
-			page = parsedPage
-		}
-	}
-	if pageSizeStr != "" {
-		if parsedSize, err := strconv.Atoi(pageSizeStr); err == nil && parsedSize > 0 && parsedSize <= 100 {
-			pageSize = parsedSize
-		}
-	} else if limitStr != "" {
-		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 && parsedLimit <= 100 {
-			pageSize = parsedLimit
-		}
-	}
-	skip := (page - 1) * pageSize
-
-	// Get user statistics using optimized aggregation
-	stats, err := GetUserStatsOptimized(userID)
-	if err != nil {
-		log.Printf("Stats error for user %s: %v", userID, err)
-		stats = map[string]interface{}{
-			"total_urls":         0,
-			"total_clicks":       0,
-			"avg_clicks_per_url": 0,
-		}
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Get total count for pagination
-	totalCount, err := DB.Collection.CountDocuments(ctx, bson.M{"user_id": userID, "is_active": true})
-	if err != nil {
-		log.Printf("Count error for user %s: %v", userID, err)
-		totalCount = 0
-	}
-
-	// Get user URLs with pagination
-	urls, err := GetUserURLsPaginated(userID, skip, pageSize)
-	if err != nil {
-		log.Printf("Analytics error for user %s: %v", userID, err)
-		http.Error(w, "Failed to retrieve analytics", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	addSecurityHeaders(w)
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":    true,
-		"message":    "Analytics retrieved successfully",
-		"statistics": stats,
-		"urls":       urls,
-		"page":       page,
-		"pageSize":   pageSize,
-		"total":      totalCount,
-		"count":      len(urls),
-	}); err != nil {
-		log.Printf("error encoding analytics response: %v", err)
-	}
-}
-
-// ============================================================================
-// URL REDIRECT HANDLER
-// ============================================================================
-
-// redirect handles GET /{short-url} requests
-func redirect(w http.ResponseWriter, r *http.Request) {
-	// Extract the short URL from the request path
-	shortURL := strings.TrimPrefix(r.URL.Path, "/")
-
-	// Sanitize short URL input to prevent injection attacks
-	shortURL = sanitizeInput(shortURL)
-
-	// Validate short URL format and length
-	if shortURL == "" || shortURL == "url" || shortURL == "analytics" ||
-		len(shortURL) > 50 || !validateCustomURL(shortURL) {
-		logSecurityEvent("INVALID_SHORT_URL_ACCESS", "", getClientIP(r), r.UserAgent(),
-			"Invalid short URL attempted: "+shortURL, "WARN")
-		http.NotFound(w, r)
-		return
-	}
-
-	// Safety check for database connection
-	if DB == nil || DB.Collection == nil {
-		log.Printf("Database not connected")
-		http.Error(w, "database connection error", http.StatusInternalServerError)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// 1. Try to find in main URLs collection (authenticated/registered users)
-	var urlData URLData
-	err := DB.Collection.FindOne(ctx, bson.D{
-		{Key: "short_url", Value: shortURL},
-		{Key: "is_active", Value: true},
-		{Key: "$or", Value: []bson.D{
-			{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
-			{{Key: "expires_at", Value: nil}},
-		}},
-	}).Decode(&urlData)
-
-	if err == nil {
-		// Found in main collection: update analytics and redirect
-		clientIP := getClientIP(r)
-		update := bson.D{
-			{Key: "$inc", Value: bson.D{{Key: "clicks", Value: 1}}},
-			{Key: "$set", Value: bson.D{{Key: "last_clicked", Value: time.Now().UTC()}}},
-			{Key: "$push", Value: bson.D{{Key: "click_history", Value: ClickHistory{
-				Timestamp: time.Now().UTC(),
-				IP:        clientIP,
-				UserAgent: r.Header.Get("User-Agent"),
-			}}}},
-		}
-		_, updateErr := DB.Collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: urlData.ID}}, update)
-		if updateErr != nil {
-			log.Printf("error updating analytics: %v", updateErr)
-		}
-		logSecurityEvent("URL_REDIRECT", urlData.UserID, clientIP, r.UserAgent(),
-			"Redirect: "+shortURL+" -> "+urlData.LongURL, "INFO")
-		log.Printf("Analytics: Short URL %s clicked, total clicks: %d", shortURL, urlData.Clicks+1)
-		addSecurityHeaders(w)
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		w.Header().Set("Pragma", "no-cache")
-		w.Header().Set("Expires", "0")
-		if !validateURL(urlData.LongURL) {
-			logSecurityEvent("MALICIOUS_URL_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
-				"Malicious URL blocked: "+urlData.LongURL, "CRITICAL")
-			http.Error(w, "URL blocked for security reasons", http.StatusForbidden)
-			return
-		}
-		http.Redirect(w, r, urlData.LongURL, http.StatusMovedPermanently)
-		return
-	}
-
-	// 2. If not found, try demo_urls collection (anonymous/demo users)
-	demoCollection := DB.Database.Collection("demo_urls")
-	var demoURL struct {
-		LongURL   string    `bson:"long_url"`
-		ExpiresAt time.Time `bson:"expires_at"`
-	}
-	err = demoCollection.FindOne(ctx, bson.M{
-		"short_url":  shortURL,
-		"expires_at": bson.M{"$gt": time.Now()},
-	}).Decode(&demoURL)
-	if err == nil {
-		// Found in demo collection: just redirect (no analytics)
-		addSecurityHeaders(w)
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		w.Header().Set("Pragma", "no-cache")
-		w.Header().Set("Expires", "0")
-		if !validateURL(demoURL.LongURL) {
-			logSecurityEvent("MALICIOUS_URL_BLOCKED", "", getClientIP(r), r.UserAgent(),
-				"Malicious URL blocked: "+demoURL.LongURL, "CRITICAL")
-			http.Error(w, "URL blocked for security reasons", http.StatusForbidden)
-			return
-		}
-		http.Redirect(w, r, demoURL.LongURL, http.StatusMovedPermanently)
-		return
-	}
-
-	// Not found in either collection
-	log.Printf("Short URL not found or expired: %s", shortURL)
-	logSecurityEvent("URL_NOT_FOUND", "", getClientIP(r), r.UserAgent(),
-		"URL not found: "+shortURL, "INFO")
-	http.NotFound(w, r)
-}
-
-// ============================================================================
-// BULK UPLOAD HANDLERS
-// ============================================================================
-
-// bulkShorten handles POST /bulk requests for bulk URL creation
-func bulkShorten(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-
-	// Validate request method
-	if r.Method != http.MethodPost {
-		logSecurityEvent("INVALID_METHOD", "", clientIP, r.UserAgent(),
-			"Invalid method for bulk upload: "+r.Method, "WARN")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract user ID from JWT context
-	userID, ok := r.Context().Value("user_id").(string)
-	if !ok {
-		logSecurityEvent("UNAUTHORIZED_BULK_ACCESS", "", clientIP, r.UserAgent(),
-			"Unauthorized bulk upload attempt", "WARN")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Parse multipart form data with size limit (10MB)
-	err := r.ParseMultipartForm(10 << 20) // 10MB max
-	if err != nil {
-		logSecurityEvent("BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
-			"Failed to parse multipart form: "+err.Error(), "ERROR")
-		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
-		return
-	}
-
-	// Get uploaded file
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		logSecurityEvent("BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
-			"No file uploaded: "+err.Error(), "WARN")
-		http.Error(w, "No file uploaded", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// Validate file
-	if err := validateUploadedFile(header); err != nil {
-		logSecurityEvent("BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
-			"Invalid file: "+err.Error(), "WARN")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Log bulk upload start
-	logSecurityEvent("BULK_UPLOAD_START", userID, clientIP, r.UserAgent(),
-		fmt.Sprintf("Processing file: %s (%.2f KB)", header.Filename, float64(header.Size)/1024), "INFO")
-
-	// Process the file
-	results, err := processBulkFile(file, header, userID, clientIP, r.UserAgent())
-	if err != nil {
-		logSecurityEvent("BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
-			"Failed to process file: "+err.Error(), "ERROR")
-		http.Error(w, fmt.Sprintf("Failed to process file: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Log completion
-	logSecurityEvent("BULK_UPLOAD_COMPLETE", userID, clientIP, r.UserAgent(),
-		fmt.Sprintf("Processed %d URLs, %d successful, %d failed",
-			results.TotalProcessed, results.Successful, results.Failed), "INFO")
-
-	// Return results
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(results)
-}
-
-// validateUploadedFile validates file type and size
-func validateUploadedFile(header *multipart.FileHeader) error {
-	// Check file size (10MB limit)
-	if header.Size > 10<<20 {
-		return fmt.Errorf("file too large. Maximum size: 10MB (current: %.2f MB)",
-			float64(header.Size)/(1024*1024))
-	}
-
-	// Check file extension
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if ext != ".csv" {
-		return fmt.Errorf("invalid file type. Only CSV files are supported (got: %s)", ext)
-	}
-
-	return nil
-}
-
-// processBulkFile processes the uploaded file and creates URLs
-func processBulkFile(file multipart.File, header *multipart.FileHeader, userID, clientIP, userAgent string) (*BulkResponse, error) {
-	startTime := time.Now()
-
-	// Parse CSV file
-	urls, err := parseCSVFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse CSV: %v", err)
-	}
-
-	if len(urls) == 0 {
-		return nil, fmt.Errorf("no valid URLs found in file")
-	}
-
-	// Limit number of URLs to process (prevent abuse)
-	const maxURLsPerBatch = 1000
-	if len(urls) > maxURLsPerBatch {
-		return nil, fmt.Errorf("too many URLs in file. Maximum allowed: %d (found: %d)",
-			maxURLsPerBatch, len(urls))
-	}
-
-	// Process URLs concurrently with goroutines
-	results := make([]BulkURLResult, len(urls))
-	successful := 0
-	failed := 0
-
-	// Use worker pool pattern for controlled concurrency
-	const maxWorkers = 10
-	jobs := make(chan int, len(urls))
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
-	// Start workers
-	for i := 0; i < maxWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for index := range jobs {
-				result := processSingleURL(urls[index], userID, clientIP, userAgent)
-
-				mu.Lock()
-				results[index] = result
-				if result.Success {
-					successful++
-				} else {
-					failed++
-				}
-				mu.Unlock()
-			}
-		}()
-	}
-
-	// Send jobs to workers
-	for i := range urls {
-		jobs <- i
-	}
-	close(jobs)
-
-	// Wait for all workers to complete
-	wg.Wait()
-
-	processingTime := time.Since(startTime)
-
-	return &BulkResponse{
-		TotalProcessed: len(urls),
-		Successful:     successful,
-		Failed:         failed,
-		Results:        results,
-		ProcessingTime: processingTime.String(),
-	}, nil
-}
-
-// parseCSVFile parses CSV file and returns slice of BulkURLRequest
-func parseCSVFile(file multipart.File) ([]BulkURLRequest, error) {
-	// Reset file pointer to beginning
-	file.Seek(0, io.SeekStart)
-
-	reader := csv.NewReader(file)
-	reader.TrimLeadingSpace = true
-
-	// Read all records
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CSV: %v", err)
-	}
-
-	if len(records) < 2 {
-		return nil, fmt.Errorf("CSV must contain header row and at least one data row")
-	}
-
-	// Validate header (first row)
-	header := records[0]
-	if len(header) == 0 || strings.TrimSpace(header[0]) == "" {
-		return nil, fmt.Errorf("invalid CSV header: first column must be 'Long URL'")
-	}
-
-	// Parse data rows
-	var urls []BulkURLRequest
-	for _, record := range records[1:] {
-		// Skip empty rows
-		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
-			continue
-		}
-
-		url := BulkURLRequest{
-			LongURL: strings.TrimSpace(record[0]),
-		}
-
-		// Validate required field
-		if url.LongURL == "" {
-			continue // Skip rows without URL
-		}
-
-		// Parse optional fields
-		if len(record) > 1 && strings.TrimSpace(record[1]) != "" {
-			url.Domain = strings.TrimSpace(record[1])
-		}
-		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
-			url.CustomAlias = strings.TrimSpace(record[2])
-		}
-		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
-			tagString := strings.TrimSpace(record[3])
-			tags := strings.Split(tagString, ";")
-			var cleanTags []string
-			for _, tag := range tags {
-				cleaned := strings.TrimSpace(tag)
-				if cleaned != "" {
-					cleanTags = append(cleanTags, cleaned)
-				}
-			}
-			url.Tags = cleanTags
-		}
-		if len(record) > 4 && strings.TrimSpace(record[4]) != "" {
-			url.Expires = strings.TrimSpace(record[4])
-		}
-
-		urls = append(urls, url)
-	}
-
-	return urls, nil
-}
-
-// processSingleURL processes a single URL and returns the result
-func processSingleURL(req BulkURLRequest, userID, clientIP, userAgent string) BulkURLResult {
-	result := BulkURLResult{
-		LongURL: req.LongURL,
-		Domain:  req.Domain,
-		Tags:    req.Tags,
-	}
-
-	// Validate URL
-	if !validateURL(req.LongURL) {
-		result.Error = "Invalid URL format"
-		return result
-	}
-
-	// Set default domain if not provided
-	if req.Domain == "" {
-		req.Domain = os.Getenv("BASE_URL")
-		if req.Domain == "" {
-			req.Domain = "http://localhost:8080"
-		}
-		result.Domain = req.Domain
-	}
-
-	// Sanitize tags
-	if len(req.Tags) > 0 {
-		req.Tags = sanitizeStringSlice(req.Tags)
-		result.Tags = req.Tags
-	}
-
-	// Check for existing URL to avoid duplicates
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	var existingURL URLData
-	err := DB.Collection.FindOne(ctx, bson.D{
-		{Key: "long_url", Value: req.LongURL},
-		{Key: "domain", Value: req.Domain},
-		{Key: "user_id", Value: userID},
-		{Key: "is_active", Value: true},
-	}).Decode(&existingURL)
-
-	if err == nil {
-		// URL already exists, return existing
-		result.ShortURL = existingURL.ShortURL
-		result.Success = true
-		result.CreatedAt = existingURL.CreatedAt.Format(time.RFC3339)
-		return result
-	}
-
-	// Generate new short URL
-	shortCode, err := generateShortCodeForBulk(req.LongURL, req.CustomAlias)
-	if err != nil {
-		result.Error = fmt.Sprintf("Failed to generate short code: %v", err)
-		return result
-	}
-
-	// Parse expiration if provided
-	var expiresAt *time.Time
-	if req.Expires != "" {
-		if parsed, err := time.Parse(time.RFC3339, req.Expires); err == nil {
-			expiresAt = &parsed
-		} else if parsed, err := time.Parse("2006-01-02", req.Expires); err == nil {
-			// Set to end of day for date-only format
-			endOfDay := time.Date(parsed.Year(), parsed.Month(), parsed.Day(), 23, 59, 59, 999999999, parsed.Location())
-			expiresAt = &endOfDay
-		} else {
-			result.Error = fmt.Sprintf("Invalid expiration date format: %s (use YYYY-MM-DD or RFC3339)", req.Expires)
-			return result
-		}
-	} else {
-		// Default to 5 years
-		defaultExpiry := time.Now().AddDate(5, 0, 0)
-		expiresAt = &defaultExpiry
-	}
-
-	// Create URL document
-	urlData := URLData{
-		ID:           primitive.NewObjectID(),
-		ShortURL:     shortCode,
-		LongURL:      req.LongURL,
-		Domain:       req.Domain,
-		Tags:         req.Tags,
-		UserID:       userID,
-		CreatedAt:    time.Now().UTC(),
-		ExpiresAt:    expiresAt,
-		Clicks:       0,
-		IsActive:     true,
-		ClickHistory: []ClickHistory{},
-	}
-
-	// Insert into database
-	_, err = DB.Collection.InsertOne(ctx, urlData)
-	if err != nil {
-		result.Error = fmt.Sprintf("Database error: %v", err)
-		return result
-	}
-
-	result.ShortURL = shortCode
-	result.Success = true
-	result.CreatedAt = urlData.CreatedAt.Format(time.RFC3339)
-
-	return result
-}
-
-// generateShortCodeForBulk generates short code for bulk processing
-func generateShortCodeForBulk(longURL, customAlias string) (string, error) {
-	if customAlias != "" {
-		// Validate custom alias
-		if !validateCustomURL(customAlias) {
-			return "", fmt.Errorf("invalid custom alias format")
-		}
-
-		// Check if custom alias already exists
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		var existing URLData
-		err := DB.Collection.FindOne(ctx, bson.D{
-			{Key: "short_url", Value: customAlias},
-			{Key: "is_active", Value: true},
-		}).Decode(&existing)
-
-		if err == nil {
-			return "", fmt.Errorf("custom alias '%s' already exists", customAlias)
-		}
-
-		return customAlias, nil
-	}
-
-	// Generate using existing logic
-	code := generateReadableCode(longURL)
-	return code, nil
-}
-
-// deleteShortURL handles DELETE /url requests for deleting a user's short URL
-func deleteShortURL(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-
-	// Only allow DELETE method
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract user ID from JWT context
-	userID, ok := r.Context().Value("user_id").(string)
-	if !ok {
-		logSecurityEvent("UNAUTHORIZED_DELETE_ACCESS", "", clientIP, r.UserAgent(),
-			"Unauthorized delete attempt", "WARN")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Parse short_url from query or JSON body
-	shortURL := r.URL.Query().Get("short_url")
-	if shortURL == "" {
-		// Try to parse from JSON body
-		var req struct {
-			ShortURL string `json:"short_url"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
-			shortURL = req.ShortURL
-		}
-	}
-	if shortURL == "" {
-		http.Error(w, "Missing short_url parameter", http.StatusBadRequest)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Find and delete the URL if it belongs to the user
-	res, err := DB.Collection.UpdateOne(ctx, bson.M{"short_url": shortURL, "user_id": userID}, bson.M{"$set": bson.M{"is_active": false}})
-	if err != nil {
-		log.Printf("error deleting short URL: %v", err)
-		http.Error(w, "Failed to delete short URL", http.StatusInternalServerError)
-		return
-	}
-	if res.MatchedCount == 0 {
-		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
-		return
-	}
-
-	logSecurityEvent("SHORT_URL_DELETED", userID, clientIP, r.UserAgent(), "Short URL deleted: "+shortURL, "INFO")
-	w.WriteHeader(http.StatusNoContent)
-}
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// BASE58 ENCODING CONFIGURATION
+// ============================================================================
+
+// Base58 alphabet (Bitcoin-style) - excludes confusing characters 0, O, I, l
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// encodeBase58 converts a big integer to base58 string
+func encodeBase58(num *big.Int) string {
+	if num.Cmp(big.NewInt(0)) == 0 {
+		return "1"
+	}
+
+	var result []byte
+	base := big.NewInt(58)
+	zero := big.NewInt(0)
+	mod := new(big.Int)
+	numCopy := new(big.Int).Set(num) // Create a copy to avoid modifying original
+
+	for numCopy.Cmp(zero) > 0 {
+		numCopy.DivMod(numCopy, base, mod)
+		result = append([]byte{base58Alphabet[mod.Int64()]}, result...)
+	}
+
+	return string(result)
+}
+
+// padBase58 ensures minimum length by prepending '1' characters
+func padBase58(code string, minLength int) string {
+	for len(code) < minLength {
+		code = "1" + code // "1" represents zero in base58
+	}
+	return code
+}
+
+// generateBase58Suffix creates a random base58 suffix
+func generateBase58Suffix(length int) string {
+	suffix := ""
+	for i := 0; i < length; i++ {
+		suffix += string(base58Alphabet[rand.Intn(58)])
+	}
+	return suffix
+}
+
+// ============================================================================
+// DATA STRUCTURES
+// ============================================================================
+
+type ClickHistory struct {
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	IP        string    `bson:"ip" json:"ip"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	Branch    string    `bson:"branch,omitempty" json:"branch,omitempty"`
+	Signed    bool      `bson:"signed,omitempty" json:"signed,omitempty"`
+	// ReferrerHost is the host of the click's Referer; the full referrer is never stored
+	ReferrerHost string `bson:"referrer_host,omitempty" json:"referrer_host,omitempty"`
+}
+
+// ShortenRequest represents the JSON payload for URL shortening
+type ShortenRequest struct {
+	LongURL     string       `json:"long-url"`
+	Custom      string       `json:"custom,omitempty"`
+	Expires     string       `json:"expires,omitempty"`
+	Domain      string       `json:"domain,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Title       string       `json:"title,omitempty"`
+	Description string       `json:"description,omitempty"`
+	OG          *OGOverrides `json:"og,omitempty"`
+	DeepLink    *DeepLink    `json:"deep_link,omitempty"`
+	// RedirectType is "permanent" (301, edge-cacheable) or "temporary" (302, never cached)
+	RedirectType string `json:"redirect_type,omitempty"`
+	CacheMaxAge  *int   `json:"cache_max_age,omitempty"`
+	// Signed links only redirect with a sig/exp pair from POST /url/{code}/sign
+	Signed bool `json:"signed,omitempty"`
+	// ResolveChain consents to storing the final destination when long-url is another short link
+	ResolveChain bool `json:"resolve_chain,omitempty"`
+	// AllowedReferrers restricts redirects to clicks from these hosts and their subdomains
+	AllowedReferrers    []string `json:"allowed_referrers,omitempty"`
+	DenyMissingReferrer bool     `json:"deny_missing_referrer,omitempty"`
+	ReferrerFallbackURL string   `json:"referrer_fallback_url,omitempty"`
+	// OnExpire is gone (default), fallback or archive; see link_expiry.go
+	OnExpire          string `json:"on_expire,omitempty"`
+	ExpireFallbackURL string `json:"expire_fallback_url,omitempty"`
+	// ReuseExpired revives the owner's expired link to the same destination, keeping its
+	// code and clicks, instead of creating a new one
+	ReuseExpired bool `json:"reuse_expired,omitempty"`
+	// DailyClickLimit pauses the link until the next midnight in DailyClickTimezone once it
+	// got this many clicks that day; see click_budget.go
+	DailyClickLimit    int    `json:"daily_click_limit,omitempty"`
+	DailyClickTimezone string `json:"daily_click_timezone,omitempty"`
+	BudgetFallbackURL  string `json:"budget_fallback_url,omitempty"`
+	// FolderID files the new link in one of the owner's folders
+	FolderID string `json:"folder_id,omitempty"`
+	// AnalyticsDisabled redirects without recording any click
+	AnalyticsDisabled bool `json:"analytics_disabled,omitempty"`
+	// AllowedCountries or BlockedCountries restrict redirects by visitor country, see geo_fence.go
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+	GeoFallbackURL   string   `json:"geo_fallback_url,omitempty"`
+	// PublicNote is shown to visitors; Internal lets the public resolve API return it, see link_notes.go
+	PublicNote string `json:"public_note,omitempty"`
+	Internal   bool   `json:"internal,omitempty"`
+}
+
+// OGOverrides holds optional Open Graph values used by link cards instead of the destination's own tags
+type OGOverrides struct {
+	Title       string `bson:"title,omitempty" json:"title,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Image       string `bson:"image,omitempty" json:"image,omitempty"`
+}
+
+type URLData struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	ShortURL       string             `bson:"short_url" json:"short-url"`
+	LongURL        string             `bson:"long_url" json:"long-url"`
+	Domain         string             `bson:"domain,omitempty" json:"domain,omitempty"`
+	Tags           []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	UserID         string             `bson:"user_id" json:"user_id"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created-at"`
+	ExpiresAt      *time.Time         `bson:"expires_at,omitempty" json:"expires-at,omitempty"`
+	Clicks         int                `bson:"clicks" json:"clicks"`
+	IsActive       bool               `bson:"is_active" json:"is-active"`
+	LastClicked    *time.Time         `bson:"last_clicked,omitempty" json:"last-clicked,omitempty"`
+	ClickHistory   []ClickHistory     `bson:"click_history" json:"click_history"`
+	Title          string             `bson:"title,omitempty" json:"title,omitempty"`
+	Description    string             `bson:"description,omitempty" json:"description,omitempty"`
+	OG             *OGOverrides       `bson:"og,omitempty" json:"og,omitempty"`
+	DeepLink       *DeepLink          `bson:"deep_link,omitempty" json:"deep_link,omitempty"`
+	DeepLinkClicks map[string]int     `bson:"deep_link_clicks,omitempty" json:"deep_link_clicks,omitempty"`
+	// DeactivatedReason records why is_active was cleared (expired or deleted)
+	DeactivatedReason   string     `bson:"deactivated_reason,omitempty" json:"deactivated_reason,omitempty"`
+	RedirectType        string     `bson:"redirect_type,omitempty" json:"redirect_type,omitempty"`
+	CacheMaxAge         *int       `bson:"cache_max_age,omitempty" json:"cache_max_age,omitempty"`
+	UpdatedAt           *time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+	Signed              bool       `bson:"signed,omitempty" json:"signed,omitempty"`
+	AllowedReferrers    []string   `bson:"allowed_referrers,omitempty" json:"allowed_referrers,omitempty"`
+	DenyMissingReferrer bool       `bson:"deny_missing_referrer,omitempty" json:"deny_missing_referrer,omitempty"`
+	ReferrerFallbackURL string     `bson:"referrer_fallback_url,omitempty" json:"referrer_fallback_url,omitempty"`
+	// BlockedClicks counts clicks refused by the referrer restriction
+	BlockedClicks int `bson:"blocked_clicks,omitempty" json:"blocked_clicks,omitempty"`
+	// OnExpire decides what the short URL does after expiry; empty means gone
+	OnExpire          string `bson:"on_expire,omitempty" json:"on_expire,omitempty"`
+	ExpireFallbackURL string `bson:"expire_fallback_url,omitempty" json:"expire_fallback_url,omitempty"`
+	// Favicon metadata filled in by the background favicon fetcher
+	FaviconURL       string     `bson:"favicon_url,omitempty" json:"favicon_url,omitempty"`
+	FaviconData      string     `bson:"favicon_data,omitempty" json:"favicon_data,omitempty"`
+	AccentColor      string     `bson:"accent_color,omitempty" json:"accent_color,omitempty"`
+	FaviconFetchedAt *time.Time `bson:"favicon_fetched_at,omitempty" json:"favicon_fetched_at,omitempty"`
+	// Creation client context, stored per IP_PRIVACY_MODE and never serialized with the link;
+	// null for links created before it was recorded
+	CreatedIP        *string `bson:"created_ip" json:"-"`
+	CreatedUserAgent *string `bson:"created_user_agent" json:"-"`
+	// Where the destination itself redirects to, found by the background redirect probe;
+	// empty and 0 when it does not redirect or was never probed
+	ResolvedDestination string `bson:"resolved_destination,omitempty" json:"resolved_destination,omitempty"`
+	RedirectChainLength int    `bson:"redirect_chain_length,omitempty" json:"redirect_chain_length,omitempty"`
+	// AbuseFlagged puts the link behind an interstitial after repeated abuse reports
+	AbuseFlagged bool `bson:"abuse_flagged,omitempty" json:"abuse_flagged,omitempty"`
+	// Daily click budget, see click_budget.go; PausedUntil is set while the day's budget is used up
+	DailyClickLimit    int        `bson:"daily_click_limit,omitempty" json:"daily_click_limit,omitempty"`
+	DailyClickTimezone string     `bson:"daily_click_timezone,omitempty" json:"daily_click_timezone,omitempty"`
+	BudgetFallbackURL  string     `bson:"budget_fallback_url,omitempty" json:"budget_fallback_url,omitempty"`
+	PausedUntil        *time.Time `bson:"paused_until,omitempty" json:"paused_until,omitempty"`
+	// FolderID is the owner's folder holding the link, see folders.go; empty outside any
+	FolderID string `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	// Pinned exempts the link from auto-expiry; AutoExpiryNotifiedAt is when auto-expiry gave
+	// it its expiry, see link_auto_expiry.go
+	Pinned               bool       `bson:"pinned,omitempty" json:"pinned,omitempty"`
+	AutoExpiryNotifiedAt *time.Time `bson:"auto_expiry_notified_at,omitempty" json:"auto_expiry_notified_at,omitempty"`
+	// AnalyticsDisabled redirects without recording clicks, see link_analytics_toggle.go
+	AnalyticsDisabled bool `bson:"analytics_disabled,omitempty" json:"analytics_disabled,omitempty"`
+	// Country restriction, see geo_fence.go
+	AllowedCountries []string `bson:"allowed_countries,omitempty" json:"allowed_countries,omitempty"`
+	BlockedCountries []string `bson:"blocked_countries,omitempty" json:"blocked_countries,omitempty"`
+	GeoFallbackURL   string   `bson:"geo_fallback_url,omitempty" json:"geo_fallback_url,omitempty"`
+	// Visitor-facing note and the internal flag that publishes it, see link_notes.go
+	PublicNote string `bson:"public_note,omitempty" json:"public_note,omitempty"`
+	Internal   bool   `bson:"internal,omitempty" json:"internal,omitempty"`
+	// FullShortURL is computed for responses and never stored
+	FullShortURL string `bson:"-" json:"full_short_url,omitempty"`
+	// Warnings lists adjustments made to the request; response-only
+	Warnings []Warning `bson:"-" json:"warnings,omitempty"`
+	// Cache tells an editor how long caches may serve the previous version; response-only
+	Cache map[string]interface{} `bson:"-" json:"cache,omitempty"`
+}
+
+// ============================================================================
+// BULK UPLOAD DATA STRUCTURES
+// ============================================================================
+
+type BulkURLRequest struct {
+	LongURL     string   `json:"long_url"`
+	Domain      string   `json:"domain,omitempty"`
+	CustomAlias string   `json:"custom,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Expires     string   `json:"expires,omitempty"`
+	// Row is the data row of the CSV, counting from 1 after the header
+	Row int `json:"-"`
+}
+
+type BulkURLResult struct {
+	LongURL      string   `json:"long_url"`
+	ShortURL     string   `json:"short_url,omitempty"`
+	FullShortURL string   `json:"full_short_url,omitempty"`
+	Domain       string   `json:"domain,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Success      bool     `json:"success"`
+	// Status is "created" for a new link or "existing" when an identical active link was reused
+	Status    string    `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt string    `json:"created_at,omitempty"`
+	Warnings  []Warning `json:"warnings,omitempty"`
+	// Conflict is reported in BulkResponse.Conflicts of code-preserving imports
+	Conflict *CodeConflict `json:"-"`
+}
+
+type BulkResponse struct {
+	TotalProcessed int             `json:"total_processed"`
+	Successful     int             `json:"successful"`
+	Failed         int             `json:"failed"`
+	Results        []BulkURLResult `json:"results"`
+	ProcessingTime string          `json:"processing_time"`
+	// JobID identifies a source_url import for POST /bulk/resync/{job_id}
+	JobID string `json:"job_id,omitempty"`
+	// Skipped counts the rows a resync left out because an earlier run already created them
+	Skipped int `json:"skipped,omitempty"`
+	// DryRun and Conflicts are set by code-preserving imports; see code_import.go
+	DryRun    bool           `json:"dry_run,omitempty"`
+	Conflicts []BulkConflict `json:"conflicts,omitempty"`
+}
+
+// ============================================================================
+// AUTHENTICATION HANDLERS
+// ============================================================================
+
+// register handles POST /auth/register requests
+func register(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("error decoding register request: %v", err)
+		logSecurityEvent(r.Context(), "INVALID_REGISTER_PAYLOAD", "", clientIP, r.UserAgent(),
+			"Invalid JSON payload", "WARN")
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	// Networks with repeated failed logins must solve a CAPTCHA
+	if !requireLoginCaptcha(w, r, clientIP, req.CaptchaToken) {
+		return
+	}
+
+	// Sanitize all inputs to prevent XSS
+	req.Username = sanitizeInput(req.Username)
+	req.Email = sanitizeInput(req.Email)
+	req.Password = sanitizeInput(req.Password)
+
+	// Validate inputs with enhanced security checks
+	if !validateUsername(req.Username) {
+		logSecurityEvent(r.Context(), "INVALID_USERNAME", "", clientIP, r.UserAgent(),
+			"Invalid username format: "+req.Username, "WARN")
+		http.Error(w, "Invalid username format. Use 3-30 alphanumeric characters, dots, underscores, or hyphens", http.StatusBadRequest)
+		return
+	}
+
+	if !validateEmail(req.Email) {
+		logSecurityEvent(r.Context(), "INVALID_EMAIL", "", clientIP, r.UserAgent(),
+			"Invalid email format: "+req.Email, "WARN")
+		http.Error(w, "Invalid email format", http.StatusBadRequest)
+		return
+	}
+
+	// Throwaway mail providers are refused, or accepted as restricted accounts in flag mode
+	restricted := false
+	switch disposableEmailAction(req.Email) {
+	case DisposableEmailBlock:
+		logSecurityEvent(r.Context(), "DISPOSABLE_EMAIL_BLOCKED", "", clientIP, r.UserAgent(),
+			"Registration with disposable email: "+req.Email, "WARN")
+		writeJSONError(w, http.StatusBadRequest, ErrCodeDisposableEmail,
+			"Registration with a disposable email address is not allowed", nil)
+		return
+	case DisposableEmailFlag:
+		logSecurityEvent(r.Context(), "DISPOSABLE_EMAIL_FLAGGED", "", clientIP, r.UserAgent(),
+			"Restricted registration with disposable email: "+req.Email, "INFO")
+		restricted = true
+	}
+
+	if !validatePassword(req.Password) {
+		logSecurityEvent(r.Context(), "WEAK_PASSWORD", "", clientIP, r.UserAgent(),
+			"Password does not meet security requirements", "WARN")
+		http.Error(w, "Password must be 8-128 characters with at least one letter and one number", http.StatusBadRequest)
+		return
+	}
+
+	// Create user with enhanced security
+	user, err := CreateUserWithTransaction(req.Username, req.Email, req.Password, restricted)
+	if err != nil {
+		log.Printf("error creating user: %v", err)
+		logSecurityEvent(r.Context(), "USER_CREATION_FAILED", "", clientIP, r.UserAgent(),
+			err.Error(), "ERROR")
+		writeStoreError(w, err, "user with this username or email", "failed to create user")
+		return
+	}
+	if restricted {
+		restrictedOwners.set(user.ID.Hex(), true)
+	}
+
+	// Generate access token
+	token, expiresAt, err := GenerateToken(user)
+	if err != nil {
+		log.Printf("error generating token: %v", err)
+		logSecurityEvent(r.Context(), "TOKEN_GENERATION_FAILED", user.ID.Hex(), clientIP, r.UserAgent(),
+			"Token generation failed", "ERROR")
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Generate refresh token
+	refreshToken, err := GenerateRefreshToken()
+	if err != nil {
+		log.Printf("error generating refresh token: %v", err)
+		http.Error(w, "failed to generate refresh token", http.StatusInternalServerError)
+		return
+	}
+	refreshExpiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
+	if err := SetRefreshToken(user.ID.Hex(), refreshToken, refreshExpiry); err != nil {
+		log.Printf("error saving refresh token: %v", err)
+		http.Error(w, "failed to save refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	// Set refresh token as HttpOnly, Secure cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/",
+		Expires:  refreshExpiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// Log successful registration
+	logSecurityEvent(r.Context(), "USER_REGISTERED", user.ID.Hex(), clientIP, r.UserAgent(),
+		"User successfully registered", "INFO")
+
+	// Cookie sessions also carry the access token in a cookie
+	csrfToken, err := setSessionCookies(w, r, token, expiresAt)
+	if err != nil {
+		log.Printf("error generating CSRF token: %v", err)
+		http.Error(w, "failed to generate CSRF token", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuthResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+		User:      *user,
+		CSRFToken: csrfToken,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding register response: %v", err)
+	}
+}
+
+// login handles POST /auth/login requests
+func login(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	var req struct {
+		UsernameOrEmail string `json:"username_or_email"`
+		Password        string `json:"password"`
+		CaptchaToken    string `json:"captcha_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("error decoding login request: %v", err)
+		logSecurityEvent(r.Context(), "INVALID_LOGIN_PAYLOAD", "", clientIP, r.UserAgent(),
+			"Invalid JSON payload", "WARN")
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	// Networks with repeated failed logins must solve a CAPTCHA
+	if !requireLoginCaptcha(w, r, clientIP, req.CaptchaToken) {
+		return
+	}
+
+	// Sanitize inputs to prevent XSS
+	req.UsernameOrEmail = sanitizeInput(req.UsernameOrEmail)
+	req.Password = sanitizeInput(req.Password)
+
+	// Validate required fields
+	if req.UsernameOrEmail == "" || req.Password == "" {
+		logSecurityEvent(r.Context(), "INCOMPLETE_LOGIN_DATA", "", clientIP, r.UserAgent(),
+			"Missing username/email or password", "WARN")
+		http.Error(w, "username/email and password are required", http.StatusBadRequest)
+		return
+	}
+
+	// Validate email format if it looks like an email
+	if strings.Contains(req.UsernameOrEmail, "@") && !validateEmail(req.UsernameOrEmail) {
+		logSecurityEvent(r.Context(), "INVALID_LOGIN_EMAIL", "", clientIP, r.UserAgent(),
+			"Invalid email format in login", "WARN")
+		http.Error(w, "Invalid email format", http.StatusBadRequest)
+		return
+	}
+
+	// Get user and verify password
+	user, err := GetUserByCredentials(req.UsernameOrEmail, req.Password)
+	if errors.Is(err, ErrAccountDeactivated) {
+		writeAccountDeactivated(w, r, user)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+		log.Printf("login of %s failed with a database error: %v", req.UsernameOrEmail, err)
+		writeStoreError(w, err, "user", "failed to log in")
+		return
+	}
+	if err != nil {
+		log.Printf("login failed for %s: %v", req.UsernameOrEmail, err)
+		logSecurityEvent(r.Context(), "LOGIN_FAILED", "", clientIP, r.UserAgent(),
+			"Login failed for: "+req.UsernameOrEmail, "WARN")
+		noteLoginFailure(clientIP)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// Generate access token
+	token, expiresAt, err := GenerateToken(user)
+	if err != nil {
+		log.Printf("error generating token: %v", err)
+		logSecurityEvent(r.Context(), "TOKEN_GENERATION_FAILED", user.ID.Hex(), clientIP, r.UserAgent(),
+			"Token generation failed after successful login", "ERROR")
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Generate refresh token
+	refreshToken, err := GenerateRefreshToken()
+	if err != nil {
+		log.Printf("error generating refresh token: %v", err)
+		http.Error(w, "failed to generate refresh token", http.StatusInternalServerError)
+		return
+	}
+	refreshExpiry := time.Now().Add(7 * 24 * time.Hour) // 7 days
+	if err := SetRefreshToken(user.ID.Hex(), refreshToken, refreshExpiry); err != nil {
+		log.Printf("error saving refresh token: %v", err)
+		http.Error(w, "failed to save refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	// Set refresh token as HttpOnly, Secure cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/",
+		Expires:  refreshExpiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// Log successful login
+	logSecurityEvent(r.Context(), "USER_LOGIN", user.ID.Hex(), clientIP, r.UserAgent(),
+		"User successfully logged in", "INFO")
+
+	// Cookie sessions also carry the access token in a cookie
+	csrfToken, err := setSessionCookies(w, r, token, expiresAt)
+	if err != nil {
+		log.Printf("error generating CSRF token: %v", err)
+		http.Error(w, "failed to generate CSRF token", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuthResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+		User:      *user,
+		CSRFToken: csrfToken,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding login response: %v", err)
+	}
+}
+
+// profile handles GET /auth/profile requests (protected); ?include=stats adds statistics
+func profile(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context (set by JWT middleware)
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+
+	// Implicit statistics are announced as deprecated by deprecationMiddleware
+	withStats, _ := profileIncludesStats(r)
+	profile, err := GetUserProfile(userID, withStats)
+	if err != nil {
+		log.Printf("error getting user profile: %v", err)
+		writeStoreError(w, err, "user", "failed to get user profile")
+		return
+	}
+	if stats, ok := profile["statistics"].(map[string]interface{}); ok {
+		profile["statistics"] = statsWithFullShortURLs(r, stats)
+	}
+	// The caller's feature flags, so frontends can branch the same way
+	profile["features"] = evaluatedFeatures(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Profile retrieved successfully",
+		"data":    profile,
+	}); err != nil {
+		log.Printf("error encoding profile response: %v", err)
+	}
+}
+
+// validateToken handles GET and POST /auth/validate requests. The token is read from a JSON
+// body ({"token": "..."}) or, when there is no body, from the Authorization: Bearer header.
+func validateToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Printf("error decoding validate request: %v", err)
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+	} else if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		bearerToken := strings.Split(authHeader, " ")
+		if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
+			writeJSONError(w, http.StatusUnauthorized, ErrCodeTokenMalformed,
+				"Invalid authorization header format. Use: Bearer <token>", nil)
+			return
+		}
+		req.Token = bearerToken[1]
+	} else {
+		writeJSONError(w, http.StatusUnauthorized, ErrCodeTokenMissing,
+			"Send the token as {\"token\": \"...\"} or in the Authorization header", nil)
+		return
+	}
+
+	claims, err := ValidateToken(req.Token)
+	if err != nil {
+		log.Printf("token validation failed: %v", err)
+		code, message := tokenErrorCode(err)
+		writeJSONError(w, http.StatusUnauthorized, code, message, nil)
+		return
+	}
+
+	tokenType := "access"
+	if claims.Impersonator != "" {
+		tokenType = "impersonation"
+	}
+	response := map[string]interface{}{
+		"valid":      true,
+		"user_id":    claims.UserID,
+		"username":   claims.Username,
+		"email":      claims.Email,
+		"token_type": tokenType,
+		"issuer":     claims.Issuer,
+	}
+	if claims.ExpiresAt != nil {
+		response["expires"] = claims.ExpiresAt.Time
+		response["seconds_remaining"] = int64(time.Until(claims.ExpiresAt.Time).Seconds())
+	}
+	if claims.IssuedAt != nil {
+		response["issued_at"] = claims.IssuedAt.Time
+	}
+	// Impersonation tokens say so, for a "viewing as" banner
+	if claims.Impersonator != "" {
+		response["impersonation"] = map[string]interface{}{
+			"impersonator_id":       claims.Impersonator,
+			"impersonator_username": claims.ImpersonatorUsername,
+			"session_id":            claims.ID,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding validate response: %v", err)
+	}
+}
+
+// refreshTokenHandler handles POST /auth/refresh requests (secure, cookie-based)
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Get refresh token from HttpOnly cookie
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil || cookie.Value == "" {
+		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
+		return
+	}
+	refreshToken := cookie.Value
+
+	// Find user by refresh token hash
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, err := Users.FindUserByRefreshToken(ctx, HashRefreshToken(refreshToken))
+	if errors.Is(err, errStoreUnavailable) {
+		http.Error(w, "Database not connected", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	// Validate expiry
+	if !ValidateRefreshToken(user, refreshToken) {
+		// Clear cookie and DB
+		_ = ClearRefreshToken(user.ID.Hex())
+		http.SetCookie(w, &http.Cookie{
+			Name:     "refresh_token",
+			Value:    "",
+			Path:     "/",
+			Expires:  time.Now().Add(-1 * time.Hour),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Error(w, "Refresh token expired or invalid", http.StatusUnauthorized)
+		return
+	}
+
+	// Rotate: generate new refresh token
+	newRefreshToken, err := GenerateRefreshToken()
+	if err != nil {
+		http.Error(w, "Failed to generate refresh token", http.StatusInternalServerError)
+		return
+	}
+	refreshExpiry := time.Now().Add(7 * 24 * time.Hour)
+	if err := SetRefreshToken(user.ID.Hex(), newRefreshToken, refreshExpiry); err != nil {
+		http.Error(w, "Failed to save refresh token", http.StatusInternalServerError)
+		return
+	}
+	// Set new refresh token cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    newRefreshToken,
+		Path:     "/",
+		Expires:  refreshExpiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// Issue new access token
+	accessToken, expiresAt, err := GenerateToken(user)
+	if err != nil {
+		http.Error(w, "Failed to generate access token", http.StatusInternalServerError)
+		return
+	}
+	if _, err := setSessionCookies(w, r, accessToken, expiresAt); err != nil {
+		http.Error(w, "Failed to generate CSRF token", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Token refreshed successfully",
+		"token":      accessToken,
+		"expires_at": expiresAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding refresh token response: %v", err)
+	}
+}
+
+// ============================================================================
+// URL MANAGEMENT HANDLERS
+// ============================================================================
+
+// shorten handles PUT /url requests with payload:
+//
+//	{
+//	  "long-url": "https://example.com/very/long/url",     // required: original URL to shorten
+//	  "expires": "2025-12-31T23:59:59Z",                   // optional: define expiration date and time of short URL; default to 5 years
+//	  "custom": "my-custom-url"                            // optional: define custom short URL
+//	}
+//
+// Response:
+//
+//	{
+//	  "long-url": "https://example.com/very/long/url",
+//	  "short-url": "abc123",
+//	  "created-at": "2025-11-17T10:30:00Z",
+//	  "expires-at": "2030-11-17T10:30:00Z",
+//	  "is-active": true
+//	}
+func shorten(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+	var req ShortenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("error decoding shorten request: %v", err)
+		logSecurityEvent(r.Context(), "INVALID_SHORTEN_PAYLOAD", userID, clientIP, r.UserAgent(),
+			"Invalid JSON payload", "WARN")
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	// Sanitize inputs to prevent XSS and other attacks
+	req.LongURL = sanitizeInput(req.LongURL)
+	req.Custom = sanitizeInput(req.Custom)
+	req.Expires = sanitizeInput(req.Expires)
+	req.Domain = sanitizeInput(req.Domain)
+	tags, warnings, tagErr := normalizeTags(req.Tags)
+	if tagErr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      false,
+			"message":      tagErr.Reason,
+			"invalid_tags": tagErr.InvalidTags,
+		})
+		return
+	}
+	// The user's auto-tag rules add to the request's own tags
+	tags, ruleWarnings := applyTagRules(loadTagRules(userID), req.LongURL, tags)
+	warnings = append(warnings, ruleWarnings...)
+	req.Tags = tags
+	req.Title = sanitizeInput(req.Title)
+	req.Description = sanitizeInput(req.Description)
+	if req.OG != nil {
+		req.OG.Title = sanitizeInput(req.OG.Title)
+		req.OG.Description = sanitizeInput(req.OG.Description)
+		req.OG.Image = sanitizeInput(req.OG.Image)
+		if req.OG.Image != "" && !validateURL(req.OG.Image) {
+			http.Error(w, "Invalid og.image URL. Must be a valid HTTP or HTTPS URL", http.StatusBadRequest)
+			return
+		}
+	}
+	sanitizeDeepLink(req.DeepLink)
+	logLinkRequest("shorten", userID, req.LongURL, req.Custom, req.Tags)
+	// Default domain to BASE_URL if not provided
+	if req.Domain == "" {
+		req.Domain = os.Getenv("BASE_URL")
+	}
+
+	// Validate URL with enhanced security checks
+	if !validateURL(req.LongURL) {
+		logSecurityEvent(r.Context(), "INVALID_URL_FORMAT", userID, clientIP, r.UserAgent(),
+			"Invalid URL format: "+redactURL(req.LongURL), "WARN")
+		http.Error(w, "Invalid URL format. Must be a valid HTTP or HTTPS URL (no localhost/internal IPs)", http.StatusBadRequest)
+		return
+	}
+
+	// Destinations on the block list of the live configuration are refused, warn-listed ones noted
+	switch requestConfig(r).DestinationListed(req.LongURL) {
+	case "block":
+		logSecurityEvent(r.Context(), "DESTINATION_BLOCKED", userID, clientIP, r.UserAgent(),
+			"Blocked destination: "+redactURL(req.LongURL), "WARN")
+		writeJSONError(w, http.StatusUnprocessableEntity, ErrCodeDestinationBlocked,
+			"Links to this destination are not allowed", nil)
+		return
+	case "warn":
+		warnings = append(warnings, destinationWarnedWarning())
+	}
+
+	// Validate domain if provided; it is stored as a normalized origin
+	if req.Domain != "" {
+		origin, err := validateDomainOrigin(req.Domain)
+		if err != nil {
+			logSecurityEvent(r.Context(), "INVALID_DOMAIN_FORMAT", userID, clientIP, r.UserAgent(),
+				"Invalid domain format: "+redactURL(req.Domain), "WARN")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Domain = origin
+	}
+
+	// Validate every deep-link branch if provided
+	if err := validateDeepLink(req.DeepLink); err != nil {
+		logSecurityEvent(r.Context(), "INVALID_DEEP_LINK", userID, clientIP, r.UserAgent(),
+			err.Error(), "WARN")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateRedirectOptions(req.RedirectType, req.CacheMaxAge); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate the referrer restriction if provided
+	allowedReferrers, err := normalizeAllowedReferrers(req.AllowedReferrers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.AllowedReferrers = allowedReferrers
+	req.ReferrerFallbackURL = sanitizeInput(req.ReferrerFallbackURL)
+	if req.ReferrerFallbackURL != "" && !validateURL(req.ReferrerFallbackURL) {
+		http.Error(w, "Invalid referrer_fallback_url. Must be a valid HTTP or HTTPS URL", http.StatusBadRequest)
+		return
+	}
+	req.GeoFallbackURL = sanitizeInput(req.GeoFallbackURL)
+	if req.AllowedCountries, req.BlockedCountries, err = validateGeoRestriction(req.AllowedCountries, req.BlockedCountries, req.GeoFallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.ExpireFallbackURL = sanitizeInput(req.ExpireFallbackURL)
+	if req.OnExpire, err = validateOnExpire(req.OnExpire, req.ExpireFallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.BudgetFallbackURL = sanitizeInput(req.BudgetFallbackURL)
+	if req.DailyClickTimezone, err = validateDailyClickLimit(req.DailyClickLimit, req.DailyClickTimezone, req.BudgetFallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AnalyticsDisabled && req.DailyClickLimit > 0 {
+		http.Error(w, "daily_click_limit needs clicks counted and cannot be combined with analytics_disabled", http.StatusBadRequest)
+		return
+	}
+	if req.PublicNote, err = normalizePublicNote(req.PublicNote); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate custom short URL if provided
+	if req.Custom != "" && !validateCustomURL(req.Custom) {
+		logSecurityEvent(r.Context(), "INVALID_CUSTOM_URL", userID, clientIP, r.UserAgent(),
+			"Invalid custom URL format: "+req.Custom, "WARN")
+		http.Error(w, "Custom URL must be 3-20 characters, alphanumeric with hyphens/underscores only", http.StatusBadRequest)
+		return
+	}
+	if req.Custom != "" && isReservedCode(req.Custom) {
+		http.Error(w, "Custom URL is reserved. Please choose another", http.StatusBadRequest)
+		return
+	}
+
+	// Check if this URL already exists for this user (1-to-1 mapping)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	urls := linkStore(r)
+
+	// Refuse links back to the shortener; one-level chains are flattened with consent
+	destination, err := checkSelfReference(ctx, urls, req.LongURL, req.Custom, req.ResolveChain)
+	if err != nil {
+		logSecurityEvent(r.Context(), "SELF_REFERENCE_BLOCKED", userID, clientIP, r.UserAgent(),
+			err.Error()+": "+redactURL(req.LongURL), "WARN")
+		http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.LongURL = destination
+
+	existingURL, err := urls.FindActiveLink(ctx, userID, req.LongURL, req.Domain)
+	if err == nil {
+		// URL already exists for this user, return existing short URL
+		existingURL.FullShortURL = fullShortURL(r, existingURL.Domain, existingURL.ShortURL)
+		log.Printf("Returning existing short URL for user %s: %s", userID, existingURL.ShortURL)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", linkResourcePath(existingURL.ShortURL))
+		addSecurityHeaders(w)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(existingURL); err != nil {
+			log.Printf("error encoding existing URL response: %v", err)
+		}
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Printf("error checking existing URL: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// An expired link to the same destination is revived with reuse_expired, and otherwise
+	// pointed out in the response
+	expiredLink, err := urls.FindExpiredDuplicate(ctx, userID, req.LongURL, req.Domain)
+	if errors.Is(err, ErrNotFound) {
+		expiredLink = nil
+	} else if err != nil {
+		log.Printf("error checking expired URL: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Enforce the per-user link quota (returning an existing link above does not consume it)
+	activeCount, allowed, err := checkURLQuota(ctx, urls, userID)
+	if err != nil {
+		log.Printf("error checking URL quota: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	} else if !allowed {
+		logSecurityEvent(r.Context(), "URL_QUOTA_EXCEEDED", userID, clientIP, r.UserAgent(),
+			fmt.Sprintf("URL quota reached (%d active links)", activeCount), "WARN")
+		writeJSONError(w, http.StatusForbidden, ErrCodeQuotaExceeded, "URL quota reached. Delete unused links or contact support.",
+			map[string]interface{}{"count": activeCount, "quota": urlQuotaFor(userID)})
+		return
+	}
+
+	// The link may be filed in one of the user's folders right away
+	if req.FolderID != "" {
+		folderID, err := primitive.ObjectIDFromHex(req.FolderID)
+		if err != nil {
+			http.Error(w, "Invalid folder_id", http.StatusBadRequest)
+			return
+		}
+		if _, err := urls.FindFolder(ctx, userID, folderID); err != nil {
+			writeFolderError(w, err, "loading folder")
+			return
+		}
+	}
+
+	// Parse expiry time if provided, otherwise default to 5 years
+	var expiresAt *time.Time
+	if req.Expires != "" {
+		if expiry, err := time.Parse(time.RFC3339, req.Expires); err == nil {
+			expiresAt = &expiry
+		} else {
+			http.Error(w, "invalid expires format, use RFC3339 (e.g., 2025-12-31T23:59:59Z)", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Default to 5 years from now
+		defaultExpiry := clock.Now().AddDate(5, 0, 0)
+		expiresAt = &defaultExpiry
+	}
+	if clamped, warning := clampLinkExpiry(*expiresAt, clock.Now()); warning != nil {
+		expiresAt = &clamped
+		// The default expiry is capped silently; only a requested one was adjusted
+		if req.Expires != "" {
+			warnings = append(warnings, *warning)
+		}
+	}
+
+	// Revive on request, unless a custom code other than the expired link's asks for a new link
+	if expiredLink != nil && req.ReuseExpired && (req.Custom == "" || req.Custom == expiredLink.ShortURL) {
+		revived, err := urls.ReviveLink(ctx, expiredLink, *expiresAt)
+		if errors.Is(err, ErrDuplicate) {
+			http.Error(w, "An active short URL for this destination was just created; retry to get it", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("error reviving expired URL: %v", err)
+			http.Error(w, "failed to revive short URL", http.StatusInternalServerError)
+			return
+		}
+		if revived {
+			forgetResolvedLink(expiredLink.ShortURL)
+			noteURLCreated(userID, activeCount)
+			link, err := urls.FindLinkByCode(ctx, expiredLink.ShortURL)
+			if err != nil {
+				log.Printf("error loading revived URL: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			link.FullShortURL = fullShortURL(r, link.Domain, link.ShortURL)
+			link.Warnings = warnings
+			logSecurityEvent(r.Context(), "URL_REVIVED", userID, clientIP, r.UserAgent(),
+				"Expired URL revived: "+redactURL(req.LongURL)+" -> "+link.ShortURL, "INFO")
+			log.Printf("Revived expired short URL for user %s: %s", userID, link.ShortURL)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", linkResourcePath(link.ShortURL))
+			addSecurityHeaders(w)
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(link); err != nil {
+				log.Printf("error encoding revived URL response: %v", err)
+			}
+			return
+		}
+		// The expired link was purged or changed meanwhile; a new link is created instead
+		expiredLink = nil
+	}
+	if expiredLink != nil {
+		warnings = append(warnings, expiredDuplicateWarning(expiredLink.ShortURL))
+	}
+
+	// A code this user reserved through /url/preview, or an expired reservation, is freed for this link
+	if err := releaseClaimableDraft(ctx, urls, userID, req.LongURL, req.Custom); err != nil {
+		log.Printf("error releasing reserved code: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Use custom ID if provided, otherwise generate a Base58 short code
+	code := req.Custom
+	if code == "" {
+		// Generate Base58 encoded short code
+		code = generateReadableCode(urls, req.LongURL)
+	}
+
+	// Create URL data
+	now := time.Now().UTC()
+	urlData := &URLData{
+		ShortURL:            code,
+		LongURL:             req.LongURL,
+		Domain:              req.Domain,
+		Tags:                req.Tags,
+		UserID:              userID,
+		CreatedAt:           now,
+		UpdatedAt:           &now,
+		ExpiresAt:           expiresAt,
+		Clicks:              0,
+		IsActive:            true,
+		ClickHistory:        []ClickHistory{},
+		Title:               req.Title,
+		Description:         req.Description,
+		OG:                  req.OG,
+		DeepLink:            req.DeepLink,
+		RedirectType:        req.RedirectType,
+		CacheMaxAge:         req.CacheMaxAge,
+		Signed:              req.Signed,
+		AllowedReferrers:    req.AllowedReferrers,
+		DenyMissingReferrer: req.DenyMissingReferrer,
+		ReferrerFallbackURL: req.ReferrerFallbackURL,
+		OnExpire:            req.OnExpire,
+		ExpireFallbackURL:   req.ExpireFallbackURL,
+		DailyClickLimit:     req.DailyClickLimit,
+		DailyClickTimezone:  req.DailyClickTimezone,
+		BudgetFallbackURL:   req.BudgetFallbackURL,
+		FolderID:            req.FolderID,
+		AnalyticsDisabled:   req.AnalyticsDisabled,
+		AllowedCountries:    req.AllowedCountries,
+		BlockedCountries:    req.BlockedCountries,
+		GeoFallbackURL:      req.GeoFallbackURL,
+		PublicNote:          req.PublicNote,
+		Internal:            req.Internal,
+		CreatedIP:           protectCreatedIP(clientIP),
+		CreatedUserAgent:    createdUserAgent(r.UserAgent()),
+	}
+
+	// Check if short URL already exists (collision detection)
+	_, err = urls.CodeHolder(ctx, code)
+	if err == nil {
+		// Collision detected, generate a new code with suffix
+		log.Printf("Short URL collision detected: %s", code)
+		requested := code
+		code = code + generateBase58Suffix(2)
+		urlData.ShortURL = code
+		if req.Custom != "" {
+			warnings = append(warnings, codeRenamedWarning(requested, code))
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Printf("error checking short URL collision: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Insert into the link store
+	if err := urls.InsertLink(ctx, urlData); err != nil {
+		log.Printf("error inserting URL data: %v", err)
+		http.Error(w, "failed to create short URL", http.StatusInternalServerError)
+		return
+	}
+	noteURLCreated(userID, activeCount)
+	favicons.Enqueue(urls, urlData)
+	redirectProbes.Enqueue(urls, urlData)
+
+	urlData.FullShortURL = fullShortURL(r, urlData.Domain, code)
+	urlData.Warnings = warnings
+
+	// Log successful URL creation
+	logSecurityEvent(r.Context(), "URL_CREATED", userID, clientIP, r.UserAgent(),
+		"URL created: "+redactURL(req.LongURL)+" -> "+code, "INFO")
+
+	log.Printf("✅ Base58 URL created: %s → %s for user %s", redactURL(req.LongURL), code, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", linkResourcePath(code))
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(urlData); err != nil {
+		log.Printf("error encoding shorten response: %v", err)
+	}
+}
+
+// generateReadableCode creates deterministic, collision-resistant short codes using Base58 encoding
+func generateReadableCode(urls URLStore, longURL string) string {
+	base58Code := deterministicCode(longURL)
+
+	// Check for collision in database (rare with SHA256 + base58)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Check if code is held by a link, demo link or reserved word (very rare collision)
+	_, err := urls.CodeHolder(ctx, base58Code)
+	if errors.Is(err, errStoreUnavailable) {
+		log.Printf("Database not connected, using base58 fallback")
+		return generateBase58Suffix(7) // Fallback to random base58
+	}
+	if errors.Is(err, ErrNotFound) {
+		// Code is unique - perfect!
+		return base58Code
+	}
+	if err != nil {
+		log.Printf("Error checking base58 code uniqueness: %v", err)
+		// Add random suffix as fallback
+		return base58Code + generateBase58Suffix(2)
+	}
+
+	// Rare collision detected - add random suffix
+	log.Printf("Base58 collision detected for URL")
+	return base58Code + generateBase58Suffix(2)
+}
+
+// deterministicCode returns the Base58 code a long URL maps to before collision handling
+func deterministicCode(longURL string) string {
+	// Create SHA256 hash for deterministic generation (maintains 1:1 mapping)
+	hash := sha256.Sum256([]byte(longURL))
+
+	// Convert first 8 bytes to big integer for base58 conversion
+	hashInt := new(big.Int).SetBytes(hash[:8])
+
+	// Convert to base58 - produces shorter, more readable URLs
+	base58Code := encodeBase58(hashInt)
+
+	// Ensure minimum length of 6 characters for consistency
+	if len(base58Code) < 6 {
+		base58Code = padBase58(base58Code, 6)
+	}
+
+	// Truncate if too long (rare case)
+	if len(base58Code) > 10 {
+		base58Code = base58Code[:10]
+	}
+	return base58Code
+}
+
+// RandString generates a random string using Base58 characters for consistency
+func RandString(n int) string {
+	// Use base58 alphabet for all random generation
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = rune(base58Alphabet[rand.Intn(len(base58Alphabet))])
+	}
+	return string(b)
+}
+
+// analytics returns user's URL statistics with optimized queries
+func analytics(w http.ResponseWriter, r *http.Request) {
+	// Get user ID from context (set by JWT middleware)
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse pagination parameters
+	pageStr := r.URL.Query().Get("page")
+	pageSizeStr := r.URL.Query().Get("pageSize")
+	limitStr := r.URL.Query().Get("limit") // fallback for legacy
+	page := 1
+	pageSize := 20
+	if pageStr != "" {
+		if parsedPage, err := strconv.Atoi(pageStr); err == nil && parsedPage > 0 {
+			page = parsedPage
+		}
+	}
+	if pageSizeStr != "" {
+		if parsedSize, err := strconv.Atoi(pageSizeStr); err == nil && parsedSize > 0 && parsedSize <= 100 {
+			pageSize = parsedSize
+		}
+	} else if limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 && parsedLimit <= 100 {
+			pageSize = parsedLimit
+		}
+	}
+	skip := (page - 1) * pageSize
+
+	// Statistics are included unless the client opts out with ?stats=false
+	withStats := r.URL.Query().Get("stats") != "false"
+	// ?include_patterns=true adds the account's clicks by hour and weekday
+	withPatterns, err := includePatterns(r)
+	if err != nil {
+		http.Error(w, "include_patterns must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	// ?fields= limits each link to the named fields
+	fields, err := parseLinkFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrCodeInvalidFields, err.Error(),
+			map[string]interface{}{"valid_fields": linkListFieldNames()})
+		return
+	}
+
+	// URL page, total count and statistics in a single faceted aggregation
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := linkStore(r)
+
+	// ?folder_id= limits the page to one folder, with &subfolders=true to its subtree
+	folderIDs, err := folderFilter(ctx, store, userID, r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Analytics folder error for user %s: %v", userID, err)
+		http.Error(w, "Failed to retrieve analytics", http.StatusInternalServerError)
+		return
+	}
+	// ?pinned=true|false lists only pinned or unpinned links
+	pinned, err := parsePinnedFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// ?tag=, ?domain= and ?status=active|expired|all narrow the page further
+	filter, err := parseLinkFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.FolderIDs, filter.Pinned = folderIDs, pinned
+	urls, totalCount, stats, err := store.ListLinks(ctx, userID, filter, skip, pageSize, withStats, fields)
+	if err != nil {
+		log.Printf("Analytics error for user %s: %v", userID, err)
+		http.Error(w, "Failed to retrieve analytics", http.StatusInternalServerError)
+		return
+	}
+
+	addFullShortURLs(r, urls)
+	markAnalyticsOff(urls)
+	selectLinkFields(urls, fields)
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	response := map[string]interface{}{
+		"success":  true,
+		"message":  "Analytics retrieved successfully",
+		"urls":     urls,
+		"page":     page,
+		"pageSize": pageSize,
+		"total":    totalCount,
+		"count":    len(urls),
+		// Where the page was read; a secondary may not have the latest links and clicks yet
+		"served_from": analyticsServedFrom(),
+	}
+	if withStats {
+		response["statistics"] = statsWithFullShortURLs(r, stats)
+	}
+	if withPatterns {
+		patterns, err := engagementPatterns(ctx, store, userID, nil)
+		if err != nil {
+			log.Printf("Engagement patterns error for user %s: %v", userID, err)
+			http.Error(w, "Failed to retrieve analytics", http.StatusInternalServerError)
+			return
+		}
+		response["engagement_patterns"] = patterns
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding analytics response: %v", err)
+	}
+}
+
+// ============================================================================
+// URL REDIRECT HANDLER
+// ============================================================================
+
+// redirect handles GET /{short-url} requests
+func redirect(w http.ResponseWriter, r *http.Request) {
+	// Extract the short URL from the request path
+	shortURL, _ := codeFromPath(r.URL.Path)
+
+	// Sanitize short URL input to prevent injection attacks
+	shortURL = sanitizeInput(shortURL)
+
+	// Validate short URL format and length
+	if shortURL == "" || isReservedCode(shortURL) ||
+		len(shortURL) > 50 || !validateCustomURL(shortURL) {
+		logSecurityEvent(r.Context(), "INVALID_SHORT_URL_ACCESS", "", getClientIP(r), r.UserAgent(),
+			"Invalid short URL attempted: "+shortURL, "WARN")
+		writeShortLinkNotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 1. Try to find in the link store (authenticated/registered users)
+	urls := linkStore(r)
+	urlData, err := urls.FindRedirectTarget(ctx, shortURL)
+	if errors.Is(err, errStoreUnavailable) {
+		log.Printf("Database not connected")
+		http.Error(w, "database connection error", http.StatusInternalServerError)
+		return
+	}
+
+	// Expired links answer per their on_expire mode; archived ones keep redirecting for a while
+	var expired *URLData
+	if errors.Is(err, ErrNotFound) {
+		now := clock.Now()
+		stopped, isExpired := findStoppedLink(ctx, urls, shortURL, now)
+		switch {
+		case stopped == nil:
+		case isExpired && expiredLinkResolves(stopped, now):
+			urlData, err = stopped, nil
+		case isExpired:
+			expired = stopped
+		case !stopped.IsActive:
+			// Deactivated links answer like unknown codes but count for their owner
+			recordOutcome(urls, stopped, OutcomeDisabled)
+		}
+	}
+
+	if err == nil {
+		// Found in main collection: update analytics and redirect
+		clientIP := getClientIP(r)
+		if suspendedOwners.Has(urlData.UserID) {
+			logSecurityEvent(r.Context(), "SUSPENDED_OWNER_LINK_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				"Link of suspended account requested: "+shortURL, "INFO")
+			recordOutcome(urls, urlData, OutcomeDisabled)
+			writeLinkUnavailable(w, r)
+			return
+		}
+		if urlData.Signed && !verifyLinkAccess(urlData, r.URL.Query(), clock.Now()) {
+			logSecurityEvent(r.Context(), "SIGNED_LINK_DENIED", urlData.UserID, clientIP, r.UserAgent(),
+				"Missing or invalid signature for "+shortURL, "WARN")
+			recordOutcome(urls, urlData, OutcomeSignatureFailed)
+			addSecurityHeaders(w)
+			setNoStoreHeaders(w)
+			http.Error(w, "This link requires a valid signature", http.StatusForbidden)
+			return
+		}
+		if linkPaused(urlData, clock.Now()) {
+			recordOutcome(urls, urlData, OutcomePaused)
+			writePausedLink(w, r, urlData)
+			return
+		}
+		if !referrerAllowed(r.Referer(), urlData) {
+			logSecurityEvent(r.Context(), "REFERRER_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				"Referrer not allowed for "+shortURL+": "+redactURL(r.Referer()), "INFO")
+			if !urlData.AnalyticsDisabled {
+				clicks.RecordBlocked(urls, urlData)
+			}
+			recordOutcome(urls, urlData, OutcomeBlockedReferrer)
+			writeReferrerBlocked(w, r, urlData)
+			return
+		}
+		if allowed, country := countryAllowed(r, clientIP, urlData); !allowed {
+			logSecurityEvent(r.Context(), "GEO_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				fmt.Sprintf("Country %q not allowed for %s", country, shortURL), "INFO")
+			recordOutcome(urls, urlData, OutcomeGeoBlocked)
+			writeGeoBlocked(w, r, urlData)
+			return
+		}
+		destination, branch := selectDestination(urlData, r.UserAgent())
+		// Links without analytics leave no trace of the click, in the click store or the log
+		if !urlData.AnalyticsDisabled {
+			clicks.Record(urls, urlData, ClickHistory{
+				Timestamp: time.Now().UTC(),
+				IP:        clientIP,
+				UserAgent: r.Header.Get("User-Agent"),
+				Branch:    branch,
+				Signed:    urlData.Signed,
+			}, r.Referer(), r.RemoteAddr)
+			logSecurityEvent(r.Context(), "URL_REDIRECT", urlData.UserID, clientIP, r.UserAgent(),
+				"Redirect: "+shortURL+" -> "+redactURL(destination), "INFO")
+			log.Printf("Analytics: Short URL %s clicked, total clicks: %d", shortURL, urlData.Clicks+1)
+		}
+		addSecurityHeaders(w)
+		if isSelfRedirect(r, destination) {
+			logSecurityEvent(r.Context(), "REDIRECT_LOOP_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				"Redirect loop blocked: "+shortURL, "WARN")
+			recordOutcome(urls, urlData, OutcomeBlockedDestination)
+			http.Error(w, "Redirect loop detected", http.StatusLoopDetected)
+			return
+		}
+		destinationValid := validateURL(destination)
+		if branch != "" {
+			destinationValid = validateDeepLinkURL(destination)
+		}
+		if !destinationValid {
+			logSecurityEvent(r.Context(), "MALICIOUS_URL_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				"Malicious URL blocked: "+redactURL(destination), "CRITICAL")
+			recordOutcome(urls, urlData, OutcomeBlockedDestination)
+			http.Error(w, "URL blocked for security reasons", http.StatusForbidden)
+			return
+		}
+		// The destination's own redirect target, when probed, must pass the same check
+		if branch == "" && urlData.ResolvedDestination != "" && !resolvedTargetAllowed(urlData.ResolvedDestination) {
+			logSecurityEvent(r.Context(), "MALICIOUS_URL_BLOCKED", urlData.UserID, clientIP, r.UserAgent(),
+				"Malicious redirect target blocked: "+redactURL(urlData.ResolvedDestination), "CRITICAL")
+			recordOutcome(urls, urlData, OutcomeBlockedDestination)
+			http.Error(w, "URL blocked for security reasons", http.StatusForbidden)
+			return
+		}
+		// Links of restricted accounts show their destination instead of redirecting to it
+		if restrictedOwners.Has(urlData.UserID) {
+			recordOutcome(urls, urlData, OutcomeRestricted)
+			writeRestrictedInterstitial(w, r, destination, urlData.PublicNote)
+			return
+		}
+		// So do links flagged by abuse reports while they wait for review
+		if urlData.AbuseFlagged {
+			recordOutcome(urls, urlData, OutcomeFlagged)
+			writeReportedInterstitial(w, r, destination, urlData.PublicNote)
+			return
+		}
+		// Device-specific deep-link redirects vary by User-Agent, signed redirects depend on the
+		// signature check, country-restricted ones on the visitor and budgeted ones must reach
+		// the click counter, so none is ever shared-cached
+		if branch != "" || urlData.Signed || len(urlData.AllowedReferrers) > 0 || geoRestricted(urlData) || urlData.DailyClickLimit > 0 {
+			setNoStoreHeaders(w)
+		} else {
+			setRedirectCacheHeaders(w, urlData)
+		}
+		recordOutcome(urls, urlData, OutcomeSuccess)
+		http.Redirect(w, r, destination, redirectStatus(urlData))
+		return
+	}
+
+	if expired != nil {
+		if suspendedOwners.Has(expired.UserID) {
+			recordOutcome(urls, expired, OutcomeDisabled)
+		} else {
+			recordOutcome(urls, expired, OutcomeExpired)
+		}
+		writeExpiredLink(w, r, expired)
+		return
+	}
+
+	// 2. If not found, try demo_urls collection (anonymous/demo users; MongoDB only)
+	var demoURL struct {
+		ID        primitive.ObjectID `bson:"_id"`
+		LongURL   string             `bson:"long_url"`
+		ExpiresAt time.Time          `bson:"expires_at"`
+	}
+	err = ErrNotFound
+	if usesMongo() {
+		err = DB.Database.Collection("demo_urls").FindOne(ctx, bson.D{
+			{Key: "short_url", Value: shortURL},
+			notExpiredFilter(),
+		}).Decode(&demoURL)
+	}
+	if err == nil {
+		// Found in demo collection: redirect, counting the click without any history
+		addSecurityHeaders(w)
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		if !validateURL(demoURL.LongURL) {
+			logSecurityEvent(r.Context(), "MALICIOUS_URL_BLOCKED", "", getClientIP(r), r.UserAgent(),
+				"Malicious URL blocked: "+redactURL(demoURL.LongURL), "CRITICAL")
+			http.Error(w, "URL blocked for security reasons", http.StatusForbidden)
+			return
+		}
+		clicks.RecordDemo(demoURL.ID)
+		http.Redirect(w, r, demoURL.LongURL, http.StatusMovedPermanently)
+		return
+	}
+
+	// Not found in either collection
+	log.Printf("Short URL not found or expired: %s", shortURL)
+	logSecurityEvent(r.Context(), "URL_NOT_FOUND", "", getClientIP(r), r.UserAgent(),
+		"URL not found: "+shortURL, "INFO")
+	writeShortLinkNotFound(w, r)
+}
+
+// writeShortLinkNotFound shows browsers the localized 404 page; other clients keep the
+// plain-text answer
+func writeShortLinkNotFound(w http.ResponseWriter, r *http.Request) {
+	if wantsHTML(r) {
+		writeRouteError(w, r, http.StatusNotFound, ErrCodeNotFound, "Not found")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// ============================================================================
+// BULK UPLOAD HANDLERS
+// ============================================================================
+
+// maxURLsPerBatch limits the rows of one upload or source fetch (prevents abuse)
+const maxURLsPerBatch = 1000
+
+// bulkShorten handles POST /bulk requests for bulk URL creation
+func bulkShorten(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	// Validate request method
+	if r.Method != http.MethodPost {
+		logSecurityEvent(r.Context(), "INVALID_METHOD", "", clientIP, r.UserAgent(),
+			"Invalid method for bulk upload: "+r.Method, "WARN")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract user ID from JWT context
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		logSecurityEvent(r.Context(), "UNAUTHORIZED_BULK_ACCESS", "", clientIP, r.UserAgent(),
+			"Unauthorized bulk upload attempt", "WARN")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A JSON body names a remote CSV to fetch instead of an uploaded file
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/json") {
+		bulkFromSource(w, r, userID)
+		return
+	}
+
+	// Parse multipart form data with size limit (10MB)
+	err := r.ParseMultipartForm(10 << 20) // 10MB max
+	if err != nil {
+		logSecurityEvent(r.Context(), "BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
+			"Failed to parse multipart form: "+err.Error(), "ERROR")
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+	opts, err := parseBulkImportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get uploaded file
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		logSecurityEvent(r.Context(), "BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
+			"No file uploaded: "+err.Error(), "WARN")
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// Validate file
+	if err := validateUploadedFile(header); err != nil {
+		logSecurityEvent(r.Context(), "BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
+			"Invalid file: "+err.Error(), "WARN")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Log bulk upload start
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_START", userID, clientIP, r.UserAgent(),
+		fmt.Sprintf("Processing file: %s (%.2f KB)", header.Filename, float64(header.Size)/1024), "INFO")
+
+	// Process the file
+	results, err := processBulkFile(r, file, header, userID, clientIP, r.UserAgent(), opts)
+	if err != nil {
+		logSecurityEvent(r.Context(), "BULK_UPLOAD_ERROR", userID, clientIP, r.UserAgent(),
+			"Failed to process file: "+err.Error(), "ERROR")
+		http.Error(w, fmt.Sprintf("Failed to process file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Log completion
+	logSecurityEvent(r.Context(), "BULK_UPLOAD_COMPLETE", userID, clientIP, r.UserAgent(),
+		fmt.Sprintf("Processed %d URLs, %d successful, %d failed",
+			results.TotalProcessed, results.Successful, results.Failed), "INFO")
+
+	// Return results
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+// validateUploadedFile validates file type and size
+func validateUploadedFile(header *multipart.FileHeader) error {
+	// Check file size (10MB limit)
+	if header.Size > 10<<20 {
+		return fmt.Errorf("file too large. Maximum size: 10MB (current: %.2f MB)",
+			float64(header.Size)/(1024*1024))
+	}
+
+	// Check file extension
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if ext != ".csv" {
+		return fmt.Errorf("invalid file type. Only CSV files are supported (got: %s)", ext)
+	}
+
+	return nil
+}
+
+// processBulkFile processes the uploaded file and creates URLs
+func processBulkFile(r *http.Request, file multipart.File, header *multipart.FileHeader, userID, clientIP, userAgent string, opts bulkImportOptions) (*BulkResponse, error) {
+	startTime := time.Now()
+
+	// Parse CSV file
+	urls, err := parseCSVFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %v", err)
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no valid URLs found in file")
+	}
+
+	// Limit number of URLs to process
+	if len(urls) > maxURLsPerBatch {
+		return nil, fmt.Errorf("too many URLs in file. Maximum allowed: %d (found: %d)",
+			maxURLsPerBatch, len(urls))
+	}
+
+	return processBulkRows(r, urls, userID, clientIP, userAgent, startTime, opts), nil
+}
+
+// processBulkRows creates the links of urls with a worker pool; startTime is when the batch
+// was received, for the reported processing time
+func processBulkRows(r *http.Request, urls []BulkURLRequest, userID, clientIP, userAgent string, startTime time.Time, opts bulkImportOptions) *BulkResponse {
+	// Auto-tag rules are loaded once for the whole file
+	tagRules := loadTagRules(userID)
+
+	// Codes kept by an import go to the first row that has them
+	duplicates := make([]bool, len(urls))
+	if opts.PreserveCodes {
+		duplicates = opts.claimFileCodes(urls)
+	}
+
+	// Process URLs concurrently with goroutines
+	results := make([]BulkURLResult, len(urls))
+	successful := 0
+	failed := 0
+
+	// Use worker pool pattern for controlled concurrency
+	const maxWorkers = 10
+	jobs := make(chan int, len(urls))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	// Start workers
+	for i := 0; i < maxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				result := processSingleURL(r, urls[index], userID, clientIP, userAgent, tagRules, opts, duplicates[index])
+
+				mu.Lock()
+				results[index] = result
+				if result.Success {
+					successful++
+				} else {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Send jobs to workers
+	for i := range urls {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Wait for all workers to complete
+	wg.Wait()
+
+	processingTime := time.Since(startTime)
+
+	response := &BulkResponse{
+		TotalProcessed: len(urls),
+		Successful:     successful,
+		Failed:         failed,
+		Results:        results,
+		ProcessingTime: processingTime.String(),
+	}
+	if opts.PreserveCodes {
+		response.DryRun = opts.DryRun
+		response.Conflicts = bulkConflicts(urls, results)
+	}
+	return response
+}
+
+// parseCSVFile parses CSV file and returns slice of BulkURLRequest
+func parseCSVFile(file multipart.File) ([]BulkURLRequest, error) {
+	// Reset file pointer to beginning
+	file.Seek(0, io.SeekStart)
+	return parseCSV(file)
+}
+
+// parseCSV reads bulk rows (Long URL, Domain, Custom Alias, Tags, Expires) after a header row
+func parseCSV(source io.Reader) ([]BulkURLRequest, error) {
+	reader := csv.NewReader(source)
+	reader.TrimLeadingSpace = true
+
+	// Read all records
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %v", err)
+	}
+
+	if len(records) < 2 {
+		return nil, fmt.Errorf("CSV must contain header row and at least one data row")
+	}
+
+	// Validate header (first row)
+	header := records[0]
+	if len(header) == 0 || strings.TrimSpace(header[0]) == "" {
+		return nil, fmt.Errorf("invalid CSV header: first column must be 'Long URL'")
+	}
+
+	// Parse data rows
+	var urls []BulkURLRequest
+	for i, record := range records[1:] {
+		// Skip empty rows
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		url := BulkURLRequest{
+			LongURL: strings.TrimSpace(record[0]),
+			Row:     i + 1,
+		}
+
+		// Validate required field
+		if url.LongURL == "" {
+			continue // Skip rows without URL
+		}
+
+		// Parse optional fields
+		if len(record) > 1 && strings.TrimSpace(record[1]) != "" {
+			url.Domain = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			url.CustomAlias = strings.TrimSpace(record[2])
+		}
+		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
+			tagString := strings.TrimSpace(record[3])
+			tags := strings.Split(tagString, ";")
+			var cleanTags []string
+			for _, tag := range tags {
+				cleaned := strings.TrimSpace(tag)
+				if cleaned != "" {
+					cleanTags = append(cleanTags, cleaned)
+				}
+			}
+			url.Tags = cleanTags
+		}
+		if len(record) > 4 && strings.TrimSpace(record[4]) != "" {
+			url.Expires = strings.TrimSpace(record[4])
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// processSingleURL processes a single URL and returns the result. duplicate marks an import
+// row whose code an earlier row of the file has; a dry run stops before anything is written.
+func processSingleURL(r *http.Request, req BulkURLRequest, userID, clientIP, userAgent string, tagRules []TagRule, opts bulkImportOptions, duplicate bool) BulkURLResult {
+	result := BulkURLResult{
+		LongURL: req.LongURL,
+		Domain:  req.Domain,
+		Tags:    req.Tags,
+	}
+
+	logLinkRequest("bulk", userID, req.LongURL, req.CustomAlias, req.Tags)
+
+	// Validate URL
+	if !validateURL(req.LongURL) {
+		result.Error = "Invalid URL format"
+		return result
+	}
+	switch requestConfig(r).DestinationListed(req.LongURL) {
+	case "block":
+		result.Error = "Links to this destination are not allowed"
+		return result
+	case "warn":
+		result.Warnings = append(result.Warnings, destinationWarnedWarning())
+	}
+
+	// Set default domain if not provided, otherwise require a bare origin
+	if req.Domain == "" {
+		req.Domain = os.Getenv("BASE_URL")
+		if req.Domain == "" {
+			req.Domain = "http://localhost:8080"
+		}
+	} else {
+		origin, err := validateDomainOrigin(req.Domain)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		req.Domain = origin
+	}
+	result.Domain = req.Domain
+
+	// Normalize tags
+	if len(req.Tags) > 0 {
+		tags, warnings, tagErr := normalizeTags(req.Tags)
+		if tagErr != nil {
+			result.Error = tagErr.Error()
+			return result
+		}
+		req.Tags = tags
+		result.Tags = req.Tags
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+	if tags, ruleWarnings := applyTagRules(tagRules, req.LongURL, req.Tags); len(tags) > 0 {
+		req.Tags = tags
+		result.Tags = req.Tags
+		result.Warnings = append(result.Warnings, ruleWarnings...)
+	}
+
+	// Check for existing URL to avoid duplicates
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Bulk rows cannot consent to chain resolution, so links to short links are refused
+	if _, err := checkSelfReference(ctx, Links, req.LongURL, req.CustomAlias, false); err != nil {
+		result.Error = "Invalid destination: " + err.Error()
+		return result
+	}
+
+	existingResult := func(existingURL *URLData) BulkURLResult {
+		result.ShortURL = existingURL.ShortURL
+		result.FullShortURL = fullShortURL(r, existingURL.Domain, existingURL.ShortURL)
+		result.Status = "existing"
+		result.Success = true
+		result.CreatedAt = existingURL.CreatedAt.Format(time.RFC3339)
+		return result
+	}
+
+	var shortCode string
+	if opts.PreserveCodes {
+		// Imports keep the row's code, or report why they cannot
+		code, conflict, existing, err := resolveImportCode(ctx, req, userID, duplicate, opts)
+		if err != nil {
+			result.Error = fmt.Sprintf("Database error: %v", err)
+			return result
+		}
+		if existing != nil {
+			return existingResult(existing)
+		}
+		result.Conflict = conflict
+		if code == "" {
+			result.Error = describeConflict(conflict)
+			return result
+		}
+		shortCode = code
+	} else {
+		var existingURL URLData
+		err := DB.Collection.FindOne(ctx, bson.D{
+			{Key: "long_url", Value: req.LongURL},
+			{Key: "domain", Value: req.Domain},
+			{Key: "user_id", Value: userID},
+			{Key: "is_active", Value: true},
+		}).Decode(&existingURL)
+
+		if err == nil {
+			// URL already exists, return existing
+			return existingResult(&existingURL)
+		}
+
+		// Generate new short URL
+		shortCode, err = generateShortCodeForBulk(req.LongURL, req.CustomAlias)
+		if err != nil {
+			result.Error = fmt.Sprintf("Failed to generate short code: %v", err)
+			return result
+		}
+	}
+
+	// Parse expiration if provided
+	var expiresAt *time.Time
+	if req.Expires != "" {
+		if parsed, err := time.Parse(time.RFC3339, req.Expires); err == nil {
+			expiresAt = &parsed
+		} else if parsed, err := time.Parse("2006-01-02", req.Expires); err == nil {
+			// Set to end of day for date-only format
+			endOfDay := time.Date(parsed.Year(), parsed.Month(), parsed.Day(), 23, 59, 59, 999999999, parsed.Location())
+			expiresAt = &endOfDay
+		} else {
+			result.Error = fmt.Sprintf("Invalid expiration date format: %s (use YYYY-MM-DD or RFC3339)", req.Expires)
+			return result
+		}
+	} else {
+		// Default to 5 years
+		defaultExpiry := clock.Now().AddDate(5, 0, 0)
+		expiresAt = &defaultExpiry
+	}
+	if clamped, warning := clampLinkExpiry(*expiresAt, clock.Now()); warning != nil {
+		expiresAt = &clamped
+		// The default expiry is capped silently; only a requested one was adjusted
+		if req.Expires != "" {
+			result.Warnings = append(result.Warnings, *warning)
+		}
+	}
+
+	// Create URL document
+	now := time.Now().UTC()
+	urlData := URLData{
+		ID:               primitive.NewObjectID(),
+		ShortURL:         shortCode,
+		LongURL:          req.LongURL,
+		Domain:           req.Domain,
+		Tags:             req.Tags,
+		UserID:           userID,
+		CreatedAt:        now,
+		UpdatedAt:        &now,
+		ExpiresAt:        expiresAt,
+		Clicks:           0,
+		IsActive:         true,
+		ClickHistory:     []ClickHistory{},
+		CreatedIP:        protectCreatedIP(clientIP),
+		CreatedUserAgent: createdUserAgent(userAgent),
+	}
+
+	// A dry run has validated the row like a real one and stops before the first write
+	if opts.DryRun {
+		result.ShortURL = shortCode
+		result.FullShortURL = fullShortURL(r, req.Domain, shortCode)
+		result.Status = "would_create"
+		result.Success = true
+		return result
+	}
+
+	// Reserve the code first, so no demo link or draft can hold it too
+	if err := reserveCode(ctx, DB.Database, linkCodeReservation(&urlData)); errors.Is(err, ErrDuplicate) {
+		result.Error = fmt.Sprintf("Short code '%s' is already taken", shortCode)
+		if opts.PreserveCodes {
+			// Taken since the check above
+			result.Conflict = &CodeConflict{Code: shortCode, Reason: ConflictTaken}
+		}
+		return result
+	} else if err != nil {
+		result.Error = fmt.Sprintf("Database error: %v", err)
+		return result
+	}
+
+	// Insert into database
+	inserted, err := DB.Collection.InsertOne(ctx, urlData)
+	if err != nil {
+		if releaseErr := releaseCode(ctx, DB.Database, shortCode, urlData.ID.Hex()); releaseErr != nil {
+			log.Printf("error releasing code %s after failed insert: %v", shortCode, releaseErr)
+		}
+		result.Error = fmt.Sprintf("Database error: %v", err)
+		return result
+	}
+	if id, ok := inserted.InsertedID.(primitive.ObjectID); ok {
+		urlData.ID = id
+		favicons.Enqueue(Links, &urlData)
+		redirectProbes.Enqueue(Links, &urlData)
+	}
+
+	result.ShortURL = shortCode
+	result.FullShortURL = fullShortURL(r, req.Domain, shortCode)
+	result.Status = "created"
+	result.Success = true
+	result.CreatedAt = urlData.CreatedAt.Format(time.RFC3339)
+
+	return result
+}
+
+// generateShortCodeForBulk generates short code for bulk processing
+func generateShortCodeForBulk(longURL, customAlias string) (string, error) {
+	if customAlias != "" {
+		// Validate custom alias
+		if !validateCustomURL(customAlias) {
+			return "", fmt.Errorf("invalid custom alias format")
+		}
+		if isReservedCode(customAlias) {
+			return "", fmt.Errorf("custom alias '%s' is reserved", customAlias)
+		}
+
+		// Check if custom alias is held by any link, draft or demo link
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := findCodeReservation(ctx, DB.Database, customAlias); err == nil {
+			return "", fmt.Errorf("custom alias '%s' already exists", customAlias)
+		}
+
+		return customAlias, nil
+	}
+
+	// Generate using existing logic
+	code := generateReadableCode(Links, longURL)
+	return code, nil
+}
+
+// deleteShortURL handles DELETE /url requests for deleting a user's short URL
+func deleteShortURL(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract user ID from JWT context
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		logSecurityEvent(r.Context(), "UNAUTHORIZED_DELETE_ACCESS", "", clientIP, r.UserAgent(),
+			"Unauthorized delete attempt", "WARN")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse short_url from query or JSON body
+	shortURL := r.URL.Query().Get("short_url")
+	if shortURL == "" {
+		// Try to parse from JSON body
+		var req struct {
+			ShortURL string `json:"short_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+			shortURL = req.ShortURL
+		}
+	}
+	if shortURL == "" {
+		http.Error(w, "Missing short_url parameter", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Find and delete the URL if it belongs to the user
+	found, err := linkStore(r).DeactivateLink(ctx, userID, shortURL, DeactivatedDeleted)
+	if err != nil {
+		log.Printf("error deleting short URL: %v", err)
+		http.Error(w, "Failed to delete short URL", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	forgetResolvedLink(shortURL)
+
+	logSecurityEvent(r.Context(), "SHORT_URL_DELETED", userID, clientIP, r.UserAgent(), "Short URL deleted: "+shortURL, "INFO")
+	w.WriteHeader(http.StatusNoContent)
+}
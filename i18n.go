@@ -0,0 +1,192 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// LOCALIZED HTML PAGES
+// ============================================================================
+//
+// End users reach the HTML pages (404 fallback, referrer interstitial) from anywhere, so they
+// are rendered in the best language of Accept-Language, falling back to English. JSON API
+// errors stay English and carry stable machine codes instead. Every catalog must define
+// exactly the keys of en.json; InitCatalogs refuses to start otherwise.
+
+//go:embed i18n/*.json
+var catalogFiles embed.FS
+
+// defaultLanguage is served when no supported language is acceptable
+const defaultLanguage = "en"
+
+// supportedLanguages have a catalog in i18n/
+var supportedLanguages = []string{"en", "es", "hi", "de"}
+
+var catalogs map[string]map[string]string
+
+// InitCatalogs loads the embedded message catalogs and checks they are complete
+func InitCatalogs() error {
+	loaded := make(map[string]map[string]string, len(supportedLanguages))
+	for _, lang := range supportedLanguages {
+		raw, err := catalogFiles.ReadFile("i18n/" + lang + ".json")
+		if err != nil {
+			return fmt.Errorf("message catalog %s: %v", lang, err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return fmt.Errorf("message catalog %s: %v", lang, err)
+		}
+		loaded[lang] = messages
+	}
+	if err := checkCatalogs(loaded); err != nil {
+		return err
+	}
+	catalogs = loaded
+	return nil
+}
+
+// checkCatalogs reports keys missing from, or unknown to, any catalog compared with English
+func checkCatalogs(loaded map[string]map[string]string) error {
+	var problems []string
+	for lang, messages := range loaded {
+		for key := range loaded[defaultLanguage] {
+			if messages[key] == "" {
+				problems = append(problems, lang+" is missing "+key)
+			}
+		}
+		for key := range messages {
+			if _, ok := loaded[defaultLanguage][key]; !ok {
+				problems = append(problems, lang+" has unknown key "+key)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("incomplete message catalogs: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// negotiateLanguage picks the supported language with the highest quality in an
+// Accept-Language header; regional tags match their language (de-CH -> de)
+func negotiateLanguage(acceptLanguage string) string {
+	best, bestQ := defaultLanguage, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		lang, _, _ := strings.Cut(tag, "-")
+		if tag == "*" {
+			lang = defaultLanguage
+		}
+		// Earlier entries win ties, as listed order is the client's preference
+		if q > bestQ && containsString(supportedLanguages, lang) {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// translate returns the message for key in lang, formatted with args; English fills gaps
+func translate(lang, key string, args ...interface{}) string {
+	message, ok := catalogs[lang][key]
+	if !ok {
+		message = catalogs[defaultLanguage][key]
+	}
+	if message == "" {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// htmlPage is the data of pageTemplate. The brand fields come from the domain's
+// DomainBranding and are already validated; the template escapes them all the same.
+type htmlPage struct {
+	Lang         string
+	Stylesheet   string
+	Title        string
+	Message      string
+	NoteLabel    string
+	Note         string
+	LinkURL      string
+	LinkText     string
+	BrandColor   string
+	LogoURL      string
+	SupportEmail string
+	FooterText   string
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title><link rel="stylesheet" href="{{.Stylesheet}}"></head><body{{if .BrandColor}} style="--brand: {{.BrandColor}}"{{end}}>
+{{if .LogoURL}}<img class="logo" src="{{.LogoURL}}" alt="">
+{{end}}<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Note}}<p class="note"><strong>{{.NoteLabel}}</strong> {{.Note}}</p>
+{{end}}{{if .LinkURL}}<p><a href="{{.LinkURL}}">{{.LinkText}}</a></p>
+{{end}}{{if or .FooterText .SupportEmail}}<footer>{{.FooterText}}{{if .SupportEmail}} <a href="mailto:{{.SupportEmail}}">{{.SupportEmail}}</a>{{end}}</footer>
+{{end}}</body></html>
+`))
+
+// renderPage writes page with the branding of the request's domain, if it has any
+func renderPage(w http.ResponseWriter, r *http.Request, status int, page htmlPage) {
+	page.Stylesheet = staticURL("page.css")
+	if branding := brandingForRequest(r); branding != nil {
+		page.BrandColor = branding.PrimaryColor
+		page.LogoURL = branding.logoPath()
+		page.SupportEmail = branding.SupportEmail
+		page.FooterText = branding.FooterText
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := pageTemplate.Execute(w, page); err != nil {
+		log.Printf("error rendering %q page: %v", page.Title, err)
+	}
+}
+
+// writeLocalizedPage renders the page for key ("<key>.title" and "<key>.message") in the
+// request's language. linkURL, when set, is offered with the "<key>.continue" text.
+func writeLocalizedPage(w http.ResponseWriter, r *http.Request, status int, key, linkURL string) {
+	writeLocalizedNotePage(w, r, status, key, linkURL, "")
+}
+
+// writeLocalizedNotePage is writeLocalizedPage with the owner's public note of the link, as
+// stored by normalizePublicNote
+func writeLocalizedNotePage(w http.ResponseWriter, r *http.Request, status int, key, linkURL, note string) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	page := htmlPage{
+		Lang:    lang,
+		Title:   translate(lang, key+".title"),
+		Message: translate(lang, key+".message"),
+	}
+	if note != "" {
+		// Stored notes are HTML-escaped and the template escapes them again
+		page.NoteLabel = translate(lang, "public_note.label")
+		page.Note = html.UnescapeString(note)
+	}
+	if linkURL != "" {
+		page.LinkURL = linkURL
+		page.LinkText = translate(lang, key+".continue", linkURL)
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	renderPage(w, r, status, page)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCatalogsComplete(t *testing.T) {
+	if err := InitCatalogs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range supportedLanguages {
+		if len(catalogs[lang]) != len(catalogs[defaultLanguage]) {
+			t.Errorf("%s has %d messages, en has %d", lang, len(catalogs[lang]), len(catalogs[defaultLanguage]))
+		}
+	}
+
+	// Every page key used in the code has a title and a message in English, and so in every
+	// catalog
+	used := regexp.MustCompile(`writeLocalized(?:Note)?Page\(w, r, [^,]+, "([a-z_]+)"`)
+	for name, src := range goSources(t) {
+		for _, m := range used.FindAllStringSubmatch(src, -1) {
+			for _, key := range []string{m[1] + ".title", m[1] + ".message"} {
+				if _, ok := catalogs[defaultLanguage][key]; !ok {
+					t.Errorf("%s renders %s, which en.json lacks", name, key)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckCatalogs(t *testing.T) {
+	complete := map[string]map[string]string{
+		"en": {"a.title": "A", "a.message": "Message"},
+		"de": {"a.title": "A", "a.message": "Nachricht"},
+	}
+	if err := checkCatalogs(complete); err != nil {
+		t.Fatalf("complete catalogs: %v", err)
+	}
+	broken := map[string]map[string]string{
+		"en": {"a.title": "A", "a.message": "Message"},
+		"de": {"a.title": "A", "b.title": "B"},
+		"es": {"a.title": "A", "a.message": ""},
+	}
+	err := checkCatalogs(broken)
+	if err == nil {
+		t.Fatal("incomplete catalogs accepted")
+	}
+	for _, problem := range []string{"de is missing a.message", "de has unknown key b.title", "es is missing a.message"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not report %q", err, problem)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"de-CH", "de"},
+		{"DE-de", "de"},
+		{"fr, es;q=0.8", "es"},
+		{"es;q=0.5, hi;q=0.9", "hi"},
+		{"de, es", "de"},
+		{"es;q=0.7, de;q=0.7", "es"},
+		{"fr, ja", "en"},
+		{"*", "en"},
+		{"de;q=0", "en"},
+		{"de;q=bogus", "de"},
+		{" , ;q=1, hi", "hi"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLanguage(tt.header); got != tt.want {
+			t.Errorf("negotiateLanguage(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGermanInterstitial(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/new-account"})
+	restrictedOwners.set(userID, true)
+	t.Cleanup(func() { restrictedOwners.set(userID, false) })
+
+	req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+	req.Header.Set("Accept-Language", "fr-FR, de-CH;q=0.9, en;q=0.5")
+	resp := srv.send(req, nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{`<html lang="de">`, "<title>Bevor Sie fortfahren</title>", "Weiter zu https://example.com/new-account"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("interstitial lacks %q:\n%s", want, body)
+		}
+	}
+
+	// Without a supported language the page is English
+	req.Header.Set("Accept-Language", "fr-FR")
+	if body := readBody(t, srv.send(req, nil)); !strings.Contains(body, `<html lang="en">`) || !strings.Contains(body, "Before you continue") {
+		t.Errorf("fallback interstitial:\n%s", body)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// ADMIN IMPERSONATION
+// ============================================================================
+//
+// POST /admin/impersonate lets support see exactly what a user sees. It issues a 15-minute
+// access token for the user that also carries the admin's ID in an impersonator claim, and
+// records the session in the impersonations collection. There is no refresh: the admin asks
+// for a new token once it lapses. JWTMiddleware puts the impersonator in the request context
+// and refuses the token as soon as the admin loses the admin role. Every security event raised
+// under impersonation carries the impersonator, and each mutating request is appended to the
+// session and logged as IMPERSONATED_ACTION. Admin routes, and any handler wrapped in
+// refuseImpersonation, answer 403 to impersonation tokens, so support can neither escalate
+// nor take irreversible decisions in the user's name. GET /admin/impersonation-log lists the
+// sessions. Sessions are only issued where they can be recorded, i.e. on MongoDB.
+
+const (
+	impersonationTokenDuration = 15 * time.Minute
+	impersonationActionsKept   = 100
+	impersonationLogDefault    = 50
+	impersonationLogMax        = 500
+)
+
+// ImpersonationAction is a mutating request made under impersonation
+type ImpersonationAction struct {
+	At        time.Time `bson:"at" json:"at"`
+	Method    string    `bson:"method" json:"method"`
+	Path      string    `bson:"path" json:"path"`
+	RequestID string    `bson:"request_id,omitempty" json:"request_id,omitempty"`
+}
+
+// ImpersonationSession is an impersonations document, one per issued token
+type ImpersonationSession struct {
+	ID            primitive.ObjectID    `bson:"_id" json:"id"`
+	AdminID       string                `bson:"admin_id" json:"admin_id"`
+	AdminUsername string                `bson:"admin_username" json:"admin_username"`
+	UserID        string                `bson:"user_id" json:"user_id"`
+	Username      string                `bson:"username" json:"username"`
+	Reason        string                `bson:"reason,omitempty" json:"reason,omitempty"`
+	IP            string                `bson:"ip" json:"ip"`
+	StartedAt     time.Time             `bson:"started_at" json:"started_at"`
+	ExpiresAt     time.Time             `bson:"expires_at" json:"expires_at"`
+	Actions       []ImpersonationAction `bson:"actions" json:"actions"`
+}
+
+// impersonatorFrom returns the admin impersonating the request's user; empty otherwise
+func impersonatorFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	impersonator, _ := ctx.Value("impersonator").(string)
+	return impersonator
+}
+
+// refuseImpersonation wraps handlers that must only run for the account holder themself
+func refuseImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if impersonator := impersonatorFrom(r.Context()); impersonator != "" {
+			userID, _ := r.Context().Value("user_id").(string)
+			logSecurityEvent(r.Context(), "IMPERSONATION_ACTION_REFUSED", userID, getClientIP(r), r.UserAgent(),
+				r.Method+" "+r.URL.Path, "WARN")
+			http.Error(w, "Not allowed while impersonating a user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// GenerateImpersonationToken creates a short-lived access token for user on behalf of admin,
+// identified by the session ID
+func GenerateImpersonationToken(user, admin *User, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(impersonationTokenDuration)
+	claims := &Claims{
+		UserID:               user.ID.Hex(),
+		Username:             user.Username,
+		Email:                user.Email,
+		Impersonator:         admin.ID.Hex(),
+		ImpersonatorUsername: admin.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    "rapidlink-api",
+		},
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(JWTSecret)
+	return tokenString, expiresAt, err
+}
+
+// impersonatorStillAdmin reports whether the admin of an impersonation token may still use it
+func impersonatorStillAdmin(adminID string) bool {
+	admin, err := GetUserByID(adminID)
+	return err == nil && admin.IsActive && admin.Role == RoleAdmin
+}
+
+// recordImpersonatedAction logs a mutating request made with an impersonation token and
+// appends it to the session, in the background
+func recordImpersonatedAction(r *http.Request, claims *Claims) {
+	info := requestInfoFrom(r.Context())
+	logSecurityEvent(r.Context(), "IMPERSONATED_ACTION", claims.UserID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("%s %s by admin %s", r.Method, r.URL.Path, claims.ImpersonatorUsername), "INFO")
+	sessionID, err := primitive.ObjectIDFromHex(claims.ID)
+	if err != nil || !usesMongo() {
+		return
+	}
+	action := ImpersonationAction{At: clock.Now(), Method: r.Method, Path: r.URL.Path, RequestID: info.ID}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := DB.Database.Collection("impersonations").UpdateOne(ctx, bson.D{{Key: "_id", Value: sessionID}},
+			bson.D{{Key: "$push", Value: bson.D{{Key: "actions", Value: bson.D{
+				{Key: "$each", Value: bson.A{action}},
+				{Key: "$slice", Value: -impersonationActionsKept},
+			}}}}})
+		if err != nil {
+			log.Printf("error recording impersonated action: %v", err)
+		}
+	}()
+}
+
+// adminImpersonate handles POST /admin/impersonate {"user_id": "...", "reason": "..."}
+func adminImpersonate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID string `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	targetID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	adminID, _ := r.Context().Value("user_id").(string)
+	if adminID == req.UserID {
+		http.Error(w, "You cannot impersonate your own account", http.StatusBadRequest)
+		return
+	}
+	reason := sanitizeInput(req.Reason)
+	if len(reason) > 500 {
+		http.Error(w, "reason must be at most 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	target, err := Users.GetUserByID(ctx, targetID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("error loading user %s for impersonation: %v", req.UserID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if target.Role == RoleAdmin {
+		http.Error(w, "Admin accounts cannot be impersonated", http.StatusForbidden)
+		return
+	}
+	admin, err := GetUserByID(adminID)
+	if err != nil {
+		http.Error(w, "Admin privileges required", http.StatusForbidden)
+		return
+	}
+
+	session := ImpersonationSession{
+		ID:            primitive.NewObjectID(),
+		AdminID:       adminID,
+		AdminUsername: admin.Username,
+		UserID:        req.UserID,
+		Username:      target.Username,
+		Reason:        reason,
+		IP:            getClientIP(r),
+		Actions:       []ImpersonationAction{},
+	}
+	token, expiresAt, err := GenerateImpersonationToken(target, admin, session.ID.Hex())
+	if err != nil {
+		log.Printf("error generating impersonation token: %v", err)
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	session.StartedAt, session.ExpiresAt = clock.Now(), expiresAt.UTC()
+	// No token without its log entry
+	if _, err := DB.Database.Collection("impersonations").InsertOne(ctx, session); err != nil {
+		log.Printf("error recording impersonation session: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	details := fmt.Sprintf("Admin %s started impersonating %s (%s)", admin.Username, target.Username, req.UserID)
+	if reason != "" {
+		details += ": " + reason
+	}
+	logSecurityEvent(r.Context(), "IMPERSONATION_STARTED", adminID, session.IP, r.UserAgent(), details, "WARN")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"token":      token,
+		"expires_at": expiresAt,
+		"session_id": session.ID.Hex(),
+		"user":       target,
+	}); err != nil {
+		log.Printf("error encoding impersonation response: %v", err)
+	}
+}
+
+// adminImpersonationLog handles GET /admin/impersonation-log, newest sessions first,
+// optionally filtered by ?user_id= or ?admin_id=
+func adminImpersonationLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := bson.D{}
+	for _, field := range []string{"user_id", "admin_id"} {
+		if value := sanitizeInput(query.Get(field)); value != "" {
+			filter = append(filter, bson.E{Key: field, Value: value})
+		}
+	}
+	limit := impersonationLogDefault
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > impersonationLogMax {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(impersonationLogMax), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := DB.Database.Collection("impersonations").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		log.Printf("error listing impersonation sessions: %v", err)
+		http.Error(w, "Failed to list impersonation sessions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []ImpersonationSession{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		log.Printf("error decoding impersonation sessions: %v", err)
+		http.Error(w, "Failed to list impersonation sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"sessions": sessions,
+		"count":    len(sessions),
+	}); err != nil {
+		log.Printf("error encoding impersonation log response: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// impersonate issues an impersonation token of admin for user, as POST /admin/impersonate does
+func (s *testServer) impersonate(adminID, userID string) string {
+	s.t.Helper()
+	load := func(hex string) *User {
+		id, _ := primitive.ObjectIDFromHex(hex)
+		user, err := Users.GetUserByID(context.Background(), id)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		return user
+	}
+	token, _, err := GenerateImpersonationToken(load(userID), load(adminID), primitive.NewObjectID().Hex())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+func TestImpersonationToken(t *testing.T) {
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	_, adminID := srv.registerAdmin()
+	_, userID := srv.register()
+	token := srv.impersonate(adminID, userID)
+
+	// The token acts as the user, and every change is logged with the admin
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/support"})
+	link, err := srv.links.FindLinkByCode(context.Background(), code)
+	if err != nil || link.UserID != userID {
+		t.Fatalf("link %+v, %v", link, err)
+	}
+	if !logs.waitFor("IMPERSONATED_ACTION") || !logs.waitFor("via admin "+adminID) {
+		t.Fatalf("impersonated change not logged:\n%s", logs)
+	}
+
+	var validated struct {
+		UserID        string `json:"user_id"`
+		TokenType     string `json:"token_type"`
+		Impersonation struct {
+			ImpersonatorID string `json:"impersonator_id"`
+			SessionID      string `json:"session_id"`
+		} `json:"impersonation"`
+	}
+	srv.do("POST", "/auth/validate", "", map[string]string{"token": token}, &validated)
+	if validated.UserID != userID || validated.TokenType != "impersonation" || validated.Impersonation.ImpersonatorID != adminID || validated.Impersonation.SessionID == "" {
+		t.Fatalf("validate answered %+v", validated)
+	}
+	// Ordinary tokens carry no banner
+	user, _ := srv.register()
+	var plain map[string]interface{}
+	srv.do("POST", "/auth/validate", "", map[string]string{"token": user}, &plain)
+	if _, ok := plain["impersonation"]; ok || plain["token_type"] != "access" {
+		t.Fatalf("validate of an access token: %v", plain)
+	}
+}
+
+func TestImpersonationRefusedOnAdminRoutes(t *testing.T) {
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	_, adminID := srv.registerAdmin()
+	_, otherAdminID := srv.registerAdmin()
+	_, userID := srv.register()
+
+	// Not even an admin's own account can be reached through an impersonation token
+	for _, target := range []string{userID, otherAdminID} {
+		token := srv.impersonate(adminID, target)
+		if resp := srv.do("GET", "/admin/security-events", token, nil, nil); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("admin route impersonating %s: status %d", target, resp.StatusCode)
+		}
+		if resp := srv.do("POST", "/admin/impersonate", token, map[string]string{"user_id": userID}, nil); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("impersonation from an impersonation token: status %d", resp.StatusCode)
+		}
+	}
+	if !logs.waitFor("IMPERSONATION_ACTION_REFUSED") {
+		t.Fatal("refusal not logged")
+	}
+}
+
+func TestImpersonationEndsWithAdminRole(t *testing.T) {
+	srv := newTestServer(t)
+	_, adminID := srv.registerAdmin()
+	_, userID := srv.register()
+	id, _ := primitive.ObjectIDFromHex(adminID)
+
+	token := srv.impersonate(adminID, userID)
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("while admin: status %d", resp.StatusCode)
+	}
+	srv.setRole(adminID, "")
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("after demotion: status %d", resp.StatusCode)
+	}
+	srv.setRole(adminID, RoleAdmin)
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("after promotion: status %d", resp.StatusCode)
+	}
+	if _, err := Users.SetUserActive(context.Background(), id, false); err != nil {
+		t.Fatal(err)
+	}
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("after deactivation: status %d", resp.StatusCode)
+	}
+}
+
+func TestImpersonateNeedsMongo(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	_, userID := srv.register()
+	if resp := srv.do("POST", "/admin/impersonate", admin, map[string]string{"user_id": userID}, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("without MongoDB: status %d", resp.StatusCode)
+	}
+}
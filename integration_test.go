@@ -0,0 +1,1506 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The integration suite runs NewServer against MongoDB, which catches the index,
+// aggregation and session bugs the in-memory store cannot:
+//
+//	go test -tags integration -run Integration ./...
+//
+// It starts a mongo:7 container through testcontainers-go, so it needs a Docker daemon.
+// INTEGRATION_MONGODB_URI points it at a running server instead. The tests that need a
+// replica set or authentication get containers of their own, or use
+// INTEGRATION_MONGODB_REPLSET_URI and INTEGRATION_MONGODB_AUTH_URI (with root credentials).
+// Every test gets its own database, migrated from scratch; the containers are shared and
+// removed when the test binary exits.
+
+const integrationMongoImage = "mongo:7"
+
+var (
+	integrationMongoOnce sync.Once
+	integrationMongoURI  string
+	integrationMongoErr  error
+
+	integrationReplicaSetOnce sync.Once
+	integrationReplicaSetURI  string
+	integrationReplicaSetErr  error
+
+	integrationAuthMongoOnce sync.Once
+	integrationAuthMongoURI  string
+	integrationAuthMongoErr  error
+)
+
+// integrationMongo returns the URI of the suite's MongoDB, starting the container on first use
+func integrationMongo(tb testing.TB) string {
+	tb.Helper()
+	integrationMongoOnce.Do(func() {
+		if uri := os.Getenv("INTEGRATION_MONGODB_URI"); uri != "" {
+			integrationMongoURI = uri
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+		defer cancel()
+		// Not tied to the first test's cleanup: the reaper removes it after the last test
+		container, err := testcontainers.Run(ctx, integrationMongoImage,
+			testcontainers.WithExposedPorts("27017/tcp"),
+			testcontainers.WithWaitStrategy(
+				wait.ForLog("Waiting for connections"),
+				wait.ForListeningPort("27017/tcp"),
+			),
+		)
+		if err != nil {
+			integrationMongoErr = err
+			return
+		}
+		integrationMongoURI, integrationMongoErr = container.PortEndpoint(ctx, "27017/tcp", "mongodb")
+	})
+	if integrationMongoErr != nil {
+		tb.Fatalf("starting MongoDB: %v", integrationMongoErr)
+	}
+	return integrationMongoURI
+}
+
+// integrationReplicaSet returns the direct-connection URI of a single-member replica set,
+// started and initiated on first use, for tests that need what a standalone server lacks
+func integrationReplicaSet(tb testing.TB) string {
+	tb.Helper()
+	integrationReplicaSetOnce.Do(func() {
+		if uri := os.Getenv("INTEGRATION_MONGODB_REPLSET_URI"); uri != "" {
+			integrationReplicaSetURI = uri
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+		defer cancel()
+		container, err := testcontainers.Run(ctx, integrationMongoImage,
+			testcontainers.WithCmd("--replSet", "rs0", "--bind_ip_all"),
+			testcontainers.WithExposedPorts("27017/tcp"),
+			testcontainers.WithWaitStrategy(
+				wait.ForLog("Waiting for connections"),
+				wait.ForListeningPort("27017/tcp"),
+			),
+		)
+		if err != nil {
+			integrationReplicaSetErr = err
+			return
+		}
+		endpoint, err := container.PortEndpoint(ctx, "27017/tcp", "mongodb")
+		if err != nil {
+			integrationReplicaSetErr = err
+			return
+		}
+		// The member is known by its in-container address, so clients connect to it directly
+		uri := endpoint + "/?directConnection=true"
+		integrationReplicaSetErr = initiateReplicaSet(ctx, uri)
+		integrationReplicaSetURI = uri
+	})
+	if integrationReplicaSetErr != nil {
+		tb.Fatalf("starting the MongoDB replica set: %v", integrationReplicaSetErr)
+	}
+	return integrationReplicaSetURI
+}
+
+// integrationAuthMongo returns the URI of a MongoDB with authentication enabled, logged in as
+// its root user, for tests that create restricted users
+func integrationAuthMongo(tb testing.TB) string {
+	tb.Helper()
+	integrationAuthMongoOnce.Do(func() {
+		if uri := os.Getenv("INTEGRATION_MONGODB_AUTH_URI"); uri != "" {
+			integrationAuthMongoURI = uri
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+		defer cancel()
+		container, err := testcontainers.Run(ctx, integrationMongoImage,
+			testcontainers.WithEnv(map[string]string{
+				"MONGO_INITDB_ROOT_USERNAME": "root",
+				"MONGO_INITDB_ROOT_PASSWORD": "root-password",
+			}),
+			testcontainers.WithExposedPorts("27017/tcp"),
+			testcontainers.WithWaitStrategy(
+				// The entrypoint starts mongod once to create the root user, then for real
+				wait.ForLog("Waiting for connections").WithOccurrence(2),
+				wait.ForListeningPort("27017/tcp"),
+			),
+		)
+		if err != nil {
+			integrationAuthMongoErr = err
+			return
+		}
+		endpoint, err := container.PortEndpoint(ctx, "27017/tcp", "mongodb")
+		if err != nil {
+			integrationAuthMongoErr = err
+			return
+		}
+		integrationAuthMongoURI = strings.Replace(endpoint, "mongodb://", "mongodb://root:root-password@", 1)
+	})
+	if integrationAuthMongoErr != nil {
+		tb.Fatalf("starting MongoDB with authentication: %v", integrationAuthMongoErr)
+	}
+	return integrationAuthMongoURI
+}
+
+// initiateReplicaSet makes the server at uri the only member of rs0 and waits until it is primary
+func initiateReplicaSet(ctx context.Context, uri string) error {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	admin := client.Database("admin")
+	if err := admin.RunCommand(ctx, bson.D{{Key: "replSetInitiate", Value: bson.D{
+		{Key: "_id", Value: "rs0"},
+		{Key: "members", Value: bson.A{bson.D{{Key: "_id", Value: 0}, {Key: "host", Value: "localhost:27017"}}}},
+	}}}).Err(); err != nil {
+		return err
+	}
+	for {
+		var hello struct {
+			IsWritablePrimary bool `bson:"isWritablePrimary"`
+		}
+		if err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err == nil && hello.IsWritablePrimary {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("replica set has no primary: %w", ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// useMongoDatabase points DB and the stores at a fresh, migrated database named after the
+// test, dropped when it ends
+func useMongoDatabase(tb testing.TB) {
+	tb.Helper()
+	useMongoDatabaseAt(tb, integrationMongo(tb))
+}
+
+// useMongoDatabaseAt is useMongoDatabase on the server at uri
+func useMongoDatabaseAt(tb testing.TB, uri string) {
+	tb.Helper()
+	tb.Setenv("STORAGE_BACKEND", "mongo")
+	database := "it_" + strings.ToLower(regexp.MustCompile(`[^A-Za-z0-9]+`).ReplaceAllString(tb.Name(), "_"))
+	if len(database) > 60 {
+		database = database[:60]
+	}
+
+	savedDB, savedUsers, savedLinks := DB, Users, Links
+	if err := InitMongoDB(uri, database); err != nil {
+		tb.Fatal(err)
+	}
+	Users = &mongoUserStore{users: DB.Database.Collection("users")}
+	Links = &mongoURLStore{coll: DB.Collection}
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := DB.Database.Drop(ctx); err != nil {
+			tb.Errorf("dropping %s: %v", database, err)
+		}
+		CloseMongoDB()
+		DB, Users, Links = savedDB, savedUsers, savedLinks
+	})
+}
+
+// newMongoTestServer is newTestServer on a fresh, migrated MongoDB database
+func newMongoTestServer(t *testing.T) *testServer {
+	t.Helper()
+	useMongoDatabase(t)
+	return startMongoTestServer(t)
+}
+
+// startMongoTestServer serves NewServer on the database the test already points DB at
+func startMongoTestServer(t *testing.T) *testServer {
+	t.Helper()
+	links := Links
+
+	rateLimitMutex.Lock()
+	ipRateLimits = make(map[string]*RateLimitInfo)
+	rateLimitMutex.Unlock()
+	srv := httptest.NewServer(NewServer().Handler)
+	t.Cleanup(func() {
+		srv.Close()
+		drainWorkers(t)
+	})
+	return &testServer{Server: srv, links: links, t: t}
+}
+
+// registerMongoAdmin is registerAdmin on MongoDB: it registers an account and grants it the
+// admin role in the users collection
+func (s *testServer) registerMongoAdmin() (token, userID string) {
+	s.t.Helper()
+	token, userID = s.register()
+	id, _ := primitive.ObjectIDFromHex(userID)
+	if _, err := DB.Database.Collection("users").UpdateByID(context.Background(), id,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "role", Value: RoleAdmin}}}}); err != nil {
+		s.t.Fatal(err)
+	}
+	return token, userID
+}
+
+// mongoDocument returns the single document of collection matching filter
+func mongoDocument(t *testing.T, collection string, filter bson.D) bson.M {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc bson.M
+	if err := DB.Database.Collection(collection).FindOne(ctx, filter).Decode(&doc); err != nil {
+		t.Fatalf("%s %v: %v", collection, filter, err)
+	}
+	return doc
+}
+
+// mongoCount counts the documents of collection matching filter
+func mongoCount(t *testing.T, collection string, filter bson.D) int64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := DB.Database.Collection(collection).CountDocuments(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// uploadCSV posts csv to POST /bulk as a multipart file
+func (s *testServer) uploadCSV(token, csv string, out interface{}) *http.Response {
+	s.t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "links.csv")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	part.Write([]byte(csv))
+	form.Close()
+	req, _ := http.NewRequest("POST", s.URL+"/bulk", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.send(req, out)
+}
+
+func TestIntegrationCriticalFlow(t *testing.T) {
+	srv := newMongoTestServer(t)
+
+	// Register: the users document holds a bcrypt hash, never the password
+	token, userID := srv.register()
+	objectID, _ := primitive.ObjectIDFromHex(userID)
+	user := mongoDocument(t, "users", bson.D{{Key: "_id", Value: objectID}})
+	if password, _ := user["password"].(string); !strings.HasPrefix(password, "$2") || user["is_active"] != true {
+		t.Fatalf("users document %v", user)
+	}
+	if _, ok := user["created_at"].(primitive.DateTime); !ok {
+		t.Fatalf("created_at stored as %T", user["created_at"])
+	}
+
+	// Shorten with a custom code
+	code := srv.shorten(token, map[string]interface{}{
+		"long-url": "https://example.com/integration", "custom": "it-launch", "tags": []string{"Launch", "q3"},
+	})
+	if code != "it-launch" {
+		t.Fatalf("custom code %s", code)
+	}
+	link := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: code}})
+	if link["long_url"] != "https://example.com/integration" || link["user_id"] != userID || link["is_active"] != true {
+		t.Fatalf("urls document %v", link)
+	}
+	if clicks, ok := link["clicks"].(int32); !ok || clicks != 0 {
+		t.Fatalf("clicks stored as %T %v", link["clicks"], link["clicks"])
+	}
+	if history, ok := link["click_history"].(bson.A); !ok || len(history) != 0 {
+		t.Fatalf("click_history stored as %T %v", link["click_history"], link["click_history"])
+	}
+
+	// Collision: a second owner asking for the same code gets it with a suffix and a warning
+	other, otherID := srv.register()
+	var renamed URLData
+	srv.do("PUT", "/url", other, map[string]interface{}{"long-url": "https://example.org/other", "custom": "it-launch"}, &renamed)
+	if !strings.HasPrefix(renamed.ShortURL, "it-launch") || renamed.ShortURL == code || len(renamed.Warnings) != 1 || renamed.Warnings[0].Code != WarnCodeRenamed {
+		t.Fatalf("colliding custom code: %s, warnings %+v", renamed.ShortURL, renamed.Warnings)
+	}
+	if n := mongoCount(t, "urls", bson.D{{Key: "short_url", Value: code}}); n != 1 {
+		t.Fatalf("%d documents with code %s", n, code)
+	}
+	// The same destination again is the existing link, not a second document
+	if again := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/integration"}); again != code {
+		t.Fatalf("dedupe returned %s", again)
+	}
+	if n := mongoCount(t, "urls", bson.D{{Key: "user_id", Value: userID}}); n != 1 {
+		t.Fatalf("%d documents after the dedupe", n)
+	}
+
+	// Redirect and click recording: the counter, click_history and the clicks collection
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+		req.Header.Set("Referer", "https://news.example.net/story")
+		if resp := srv.send(req, nil); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/integration" {
+			t.Fatalf("redirect: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	drainClicks(t)
+	link = mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: code}})
+	history, _ := link["click_history"].(bson.A)
+	if link["clicks"] != int32(3) || len(history) != 3 {
+		t.Fatalf("after 3 clicks: clicks %v, click_history %d", link["clicks"], len(history))
+	}
+	click := history[0].(bson.M)
+	if _, ok := click["timestamp"].(primitive.DateTime); !ok || click["referrer_host"] != "news.example.net" || click["user_agent"] == "" {
+		t.Fatalf("click_history entry %v", click)
+	}
+	if _, ok := link["last_clicked"].(primitive.DateTime); !ok {
+		t.Fatalf("last_clicked stored as %T", link["last_clicked"])
+	}
+	event := mongoDocument(t, "clicks", bson.D{{Key: "short_url", Value: code}})
+	if event["url_id"] != link["_id"] || event["user_id"] != userID || event["device"] != DeviceIOS || event["bot"] != false {
+		t.Fatalf("clicks document %v", event)
+	}
+	if n := mongoCount(t, "clicks", bson.D{{Key: "url_id", Value: link["_id"]}}); n != 3 {
+		t.Fatalf("%d click documents", n)
+	}
+
+	// Analytics: the aggregations agree with the documents
+	var listing struct {
+		Total      int64 `json:"total"`
+		Statistics struct {
+			TotalURLs       int     `json:"total_urls"`
+			TotalClicks     int     `json:"total_clicks"`
+			AvgClicksPerURL float64 `json:"avg_clicks_per_url"`
+			TagDistribution []struct {
+				Tag   string `json:"tag"`
+				Count int    `json:"count"`
+			} `json:"tag_distribution"`
+			TopLinks []struct {
+				ShortURL string `json:"short_url"`
+				Clicks   int    `json:"clicks"`
+			} `json:"top_links"`
+		} `json:"statistics"`
+	}
+	if resp := srv.do("GET", "/analytics", token, nil, &listing); resp.StatusCode != http.StatusOK {
+		t.Fatalf("analytics: status %d", resp.StatusCode)
+	}
+	stats := listing.Statistics
+	if listing.Total != 1 || stats.TotalURLs != 1 || stats.TotalClicks != 3 || stats.AvgClicksPerURL != 3 {
+		t.Fatalf("analytics total %d, statistics %+v", listing.Total, stats)
+	}
+	if len(stats.TopLinks) != 1 || stats.TopLinks[0].ShortURL != code || stats.TopLinks[0].Clicks != 3 {
+		t.Fatalf("top_links %+v", stats.TopLinks)
+	}
+	if len(stats.TagDistribution) != 2 {
+		t.Fatalf("tag_distribution %+v", stats.TagDistribution)
+	}
+
+	// Bulk upload of 100 rows: 98 plain, one custom alias and one refused destination
+	var csv strings.Builder
+	csv.WriteString("Long URL,Domain,Custom Alias,Tags,Expires\n")
+	for row := 1; row <= 100; row++ {
+		switch row {
+		case 50:
+			csv.WriteString("https://example.com/bulk/050,,bulk-fifty,bulk;fifty,\n")
+		case 100:
+			csv.WriteString("javascript:alert(1),,,bulk,\n")
+		default:
+			fmt.Fprintf(&csv, "https://example.com/bulk/%03d,,,bulk,\n", row)
+		}
+	}
+	var bulk BulkResponse
+	if resp := srv.uploadCSV(token, csv.String(), &bulk); resp.StatusCode != http.StatusOK {
+		t.Fatalf("bulk: status %d: %s", resp.StatusCode, readBody(t, resp))
+	}
+	if bulk.TotalProcessed != 100 || bulk.Successful != 99 || bulk.Failed != 1 {
+		t.Fatalf("bulk processed %d, successful %d, failed %d", bulk.TotalProcessed, bulk.Successful, bulk.Failed)
+	}
+	if n := mongoCount(t, "urls", bson.D{{Key: "user_id", Value: userID}, {Key: "tags", Value: "bulk"}}); n != 99 {
+		t.Fatalf("%d bulk documents", n)
+	}
+	fifty := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: "bulk-fifty"}})
+	if fifty["long_url"] != "https://example.com/bulk/050" || fifty["user_id"] != userID || fifty["is_active"] != true {
+		t.Fatalf("custom alias document %v", fifty)
+	}
+	if tags, ok := fifty["tags"].(bson.A); !ok || len(tags) != 2 {
+		t.Fatalf("tags stored as %T %v", fifty["tags"], fifty["tags"])
+	}
+	if n := mongoCount(t, "urls", bson.D{{Key: "long_url", Value: "javascript:alert(1)"}}); n != 0 {
+		t.Fatal("refused row was stored")
+	}
+
+	// Expiry cleanup: a lapsed link is switched off on the database clock
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	past := time.Now().Add(-time.Hour)
+	if _, err := DB.Collection.UpdateOne(ctx, bson.D{{Key: "short_url", Value: "bulk-fifty"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: past}}}}); err != nil {
+		t.Fatal(err)
+	}
+	deactivated, err := CleanupExpiredURLs()
+	if err != nil || deactivated != 1 {
+		t.Fatalf("cleanup deactivated %d: %v", deactivated, err)
+	}
+	fifty = mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: "bulk-fifty"}})
+	if fifty["is_active"] != false || fifty["deactivated_reason"] != DeactivatedExpired {
+		t.Fatalf("expired document %v", fifty)
+	}
+	if _, ok := fifty["updated_at"].(primitive.DateTime); !ok {
+		t.Fatalf("updated_at stored as %T", fifty["updated_at"])
+	}
+	if resp := srv.do("GET", "/bulk-fifty", "", nil, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("expired link: status %d", resp.StatusCode)
+	}
+	if n, _ := CleanupExpiredURLs(); n != 0 {
+		t.Fatalf("second cleanup deactivated %d", n)
+	}
+
+	// The other owner's renamed link was never touched
+	if n := mongoCount(t, "urls", bson.D{{Key: "user_id", Value: otherID}, {Key: "is_active", Value: true}}); n != 1 {
+		t.Fatalf("other owner has %d active links", n)
+	}
+}
+
+func TestIntegrationUnclickedExpiry(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "")
+	logs := captureLog(t)
+	srv := newMongoTestServer(t)
+	token, userID := srv.register()
+	other, _ := srv.register()
+
+	if resp := srv.do("PUT", "/link-policy", token, map[string]string{"auto_expire_unclicked_after": "29d"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("policy under 30 days: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("PUT", "/link-policy", token, map[string]string{"auto_expire_unclicked_after": "180d"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set policy: status %d", resp.StatusCode)
+	}
+	objectID, _ := primitive.ObjectIDFromHex(userID)
+	if user := mongoDocument(t, "users", bson.D{{Key: "_id", Value: objectID}}); user["auto_expire_unclicked_after"] != "180d" {
+		t.Fatalf("policy stored as %v", user["auto_expire_unclicked_after"])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Now()
+	old := now.AddDate(0, 0, -200)
+	set := func(code string, fields bson.D) {
+		t.Helper()
+		if _, err := DB.Collection.UpdateOne(ctx, bson.D{{Key: "short_url", Value: code}}, bson.D{{Key: "$set", Value: fields}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, code := range []string{"it-stale", "it-clicked", "it-pinned", "it-fresh", "it-custom", "it-soon"} {
+		srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/" + code, "custom": code})
+		if code != "it-fresh" {
+			set(code, bson.D{{Key: "created_at", Value: old}})
+		}
+	}
+	srv.shorten(other, map[string]interface{}{"long-url": "https://example.com/it-foreign", "custom": "it-foreign"})
+	set("it-foreign", bson.D{{Key: "created_at", Value: old}})
+	set("it-clicked", bson.D{{Key: "clicks", Value: 3}})
+	set("it-custom", bson.D{{Key: "domain", Value: "https://links.example.org"}})
+	soon := now.Add(24 * time.Hour)
+	set("it-soon", bson.D{{Key: "expires_at", Value: soon}})
+	if resp := srv.do("POST", "/url/it-pinned/pin", token, map[string]string{}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pin: status %d", resp.StatusCode)
+	}
+
+	scheduled, err := ScheduleUnclickedExpiry()
+	if err != nil || scheduled != 1 {
+		t.Fatalf("scheduled %d: %v", scheduled, err)
+	}
+	stale := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: "it-stale"}})
+	expires, _ := stale["expires_at"].(primitive.DateTime)
+	if d := expires.Time().Sub(now.Add(unclickedExpiryGrace)); d < -time.Minute || d > time.Minute {
+		t.Fatalf("never-clicked link expires at %v, want 7 days out", expires.Time())
+	}
+	if _, ok := stale["auto_expiry_notified_at"].(primitive.DateTime); !ok {
+		t.Fatalf("auto_expiry_notified_at stored as %T", stale["auto_expiry_notified_at"])
+	}
+	// Pinned, clicked, recent, custom-domain and other accounts' links are left alone
+	for _, code := range []string{"it-clicked", "it-pinned", "it-fresh", "it-custom", "it-foreign"} {
+		doc := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: code}})
+		if _, ok := doc["auto_expiry_notified_at"]; ok || doc["expires_at"] != nil {
+			t.Errorf("%s scheduled: %v", code, doc)
+		}
+	}
+	if doc := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: "it-soon"}}); !doc["expires_at"].(primitive.DateTime).Time().Equal(soon.Truncate(time.Millisecond)) {
+		t.Errorf("link expiring within the grace period moved to %v", doc["expires_at"])
+	}
+
+	// The owner is told which links go and how to keep them
+	if !logs.waitFor("Unused links will expire in 7 days") || !logs.waitFor("UNCLICKED_LINKS_SCHEDULED") {
+		t.Fatalf("no notification:\n%s", logs)
+	}
+	mail := logs.String()
+	if !strings.Contains(mail, "/it-stale -> https://example.com/it-stale") || strings.Contains(mail, "/it-pinned -> ") {
+		t.Fatalf("notification lists the wrong links:\n%s", mail)
+	}
+
+	// A rescued link is not picked again
+	if resp := srv.do("POST", "/url/it-stale/extend", token, map[string]string{"by": "1y"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("extend: status %d", resp.StatusCode)
+	}
+	if scheduled, err := ScheduleUnclickedExpiry(); err != nil || scheduled != 0 {
+		t.Fatalf("second run scheduled %d: %v", scheduled, err)
+	}
+}
+
+func TestIntegrationReencryptionResumes(t *testing.T) {
+	newMongoTestServer(t)
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	if err := withEncryptionKeys(t, oldKey, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	// More documents than one batch, and one no key opens
+	const total = reencryptBatchSize + 100
+	docs := make([]interface{}, 0, total+1)
+	for i := 0; i < total; i++ {
+		ciphertext, err := EncryptSensitiveData(fmt.Sprintf("198.51.100.%d", i%250))
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "short_url", Value: fmt.Sprintf("rk%04d", i)}, {Key: "created_ip", Value: "enc:" + ciphertext}})
+	}
+	docs = append(docs, bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "short_url", Value: "rkbroken"}, {Key: "created_ip", Value: "enc:" + legacyCiphertext(t, newTestKey(t), "lost")}})
+	ctx := context.Background()
+	if _, err := DB.Collection.InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+	if err := withEncryptionKeys(t, newKey, oldKey, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := acquireLease(ctx, reencryptLockName, InstanceID, workerLeaseTTL); err != nil || !ok {
+		t.Fatalf("lease: %v, %v", ok, err)
+	}
+	t.Cleanup(releaseReencryptLease)
+
+	// The first run stops after its first batch, as a restart would stop it
+	runCtx, stop := context.WithCancel(ctx)
+	go func() {
+		for runCtx.Err() == nil {
+			if last, _ := loadReencryptCheckpoint(ctx, DB.Database); last != nil && last.Checked >= reencryptBatchSize {
+				stop()
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	checkpoint := nextReencryptRun(nil, clock.Now())
+	if err := runReencryption(runCtx, DB.Database, checkpoint); err == nil {
+		t.Fatal("interrupted run finished")
+	}
+	stop()
+	last, err := loadReencryptCheckpoint(ctx, DB.Database)
+	if err != nil || last == nil || last.Checked != reencryptBatchSize || last.Reencrypted != reencryptBatchSize || last.Remaining != 101 {
+		t.Fatalf("checkpoint after the interruption %+v, %v", last, err)
+	}
+
+	// The next run picks up after the last document checked
+	resumed := nextReencryptRun(last, clock.Now())
+	if err := runReencryption(ctx, DB.Database, resumed); err != nil {
+		t.Fatal(err)
+	}
+	last, _ = loadReencryptCheckpoint(ctx, DB.Database)
+	if last.Checked != total+1 || last.Reencrypted != total || last.Failed != 1 || last.Remaining != 0 {
+		t.Fatalf("checkpoint after resuming %+v", last)
+	}
+	if remaining := metricValue("encryption_reencrypt_remaining"); remaining != 0 {
+		t.Errorf("encryption_reencrypt_remaining %v", remaining)
+	}
+
+	// Every readable value is now under version 2, and reads the same
+	cursor, err := DB.Collection.Find(ctx, bson.D{{Key: "short_url", Value: bson.D{{Key: "$ne", Value: "rkbroken"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rewritten []struct {
+		ShortURL  string `bson:"short_url"`
+		CreatedIP string `bson:"created_ip"`
+	}
+	if err := cursor.All(ctx, &rewritten); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range rewritten {
+		var i int
+		fmt.Sscanf(doc.ShortURL, "rk%04d", &i)
+		plaintext, version, err := decryptVersioned(strings.TrimPrefix(doc.CreatedIP, "enc:"))
+		if err != nil || version != 2 || plaintext != fmt.Sprintf("198.51.100.%d", i%250) {
+			t.Fatalf("%s: %q, version %d, %v", doc.ShortURL, plaintext, version, err)
+		}
+	}
+}
+
+func TestIntegrationPublicNoteResolve(t *testing.T) {
+	srv := newMongoTestServer(t)
+	token, _ := srv.register()
+	note := "Maintained by <b>HR</b>, updated 2024-05"
+	internal := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/payroll", "public_note": note, "internal": true})
+	external := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/press", "public_note": note})
+	if doc := mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: internal}}); doc["public_note"] != sanitizeInput(note) || doc["internal"] != true {
+		t.Fatalf("urls document %v", doc)
+	}
+
+	// The signed public resolve API publishes the notes of internal links only
+	for code, want := range map[string]interface{}{internal: sanitizeInput(note), external: nil} {
+		var resolved map[string]interface{}
+		if resp := srv.do("GET", srv.publicResolvePath(token, code), "", nil, &resolved); resp.StatusCode != http.StatusOK {
+			t.Fatalf("resolve %s: status %d", code, resp.StatusCode)
+		}
+		if resolved["public_note"] != want {
+			t.Errorf("resolve %s: public_note %v, want %v", code, resolved["public_note"], want)
+		}
+	}
+	var owned map[string]interface{}
+	srv.do("GET", "/api/v1/resolve?code="+external, token, nil, &owned)
+	if owned["public_note"] != sanitizeInput(note) || owned["internal"] != false {
+		t.Errorf("owner resolve %v", owned)
+	}
+}
+
+// TestIntegrationTagRuleVersion checks that the update pipeline moves updated_at with the tags,
+// and only then
+func TestIntegrationTagRuleVersion(t *testing.T) {
+	srv := newMongoTestServer(t)
+	token, userID := srv.register()
+	full := make([]string, MaxTagsPerLink)
+	for i := range full {
+		full[i] = fmt.Sprintf("t%d", i)
+	}
+	tagged := srv.shorten(token, map[string]interface{}{"long-url": "https://docs.google.com/it-tagged"})
+	capped := srv.shorten(token, map[string]interface{}{"long-url": "https://docs.google.com/it-capped", "tags": full})
+	updatedAt := func(code string) interface{} {
+		return mongoDocument(t, "urls", bson.D{{Key: "short_url", Value: code}})["updated_at"]
+	}
+	before, cappedBefore := updatedAt(tagged), updatedAt(capped)
+
+	time.Sleep(5 * time.Millisecond)
+	modified, err := Links.ApplyTagRule(context.Background(), userID, TagRule{HostSuffix: "google.com", Tags: []string{"google"}})
+	if err != nil || modified != 1 {
+		t.Fatalf("ApplyTagRule: %d, %v", modified, err)
+	}
+	if after := updatedAt(tagged); after == nil || after == before {
+		t.Errorf("tagged link updated_at %v, before %v", after, before)
+	}
+	if after := updatedAt(capped); after != cappedBefore {
+		t.Errorf("link at the tag cap moved from %v to %v", cappedBefore, after)
+	}
+}
+
+func TestIntegrationResolveCountsNoClicks(t *testing.T) {
+	srv := newMongoTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/card", "tags": []string{"cms"}})
+	srv.do("GET", "/"+code, "", nil, nil)
+	drainClicks(t)
+	filter := bson.D{{Key: "short_url", Value: code}}
+	before := mongoDocument(t, "urls", filter)
+	clicksBefore := mongoCount(t, "clicks", filter)
+	if before["clicks"] != int32(1) || clicksBefore != 1 {
+		t.Fatalf("clicks %v, %d click documents", before["clicks"], clicksBefore)
+	}
+
+	// Owner and public resolves, repeated, leave every click counter as it was
+	var owned, public map[string]interface{}
+	path := srv.publicResolvePath(token, code)
+	for i := 0; i < 3; i++ {
+		if resp := srv.do("GET", "/api/v1/resolve?code="+code, token, nil, &owned); resp.StatusCode != http.StatusOK {
+			t.Fatalf("owner resolve: status %d", resp.StatusCode)
+		}
+		if resp := srv.do("GET", path, "", nil, &public); resp.StatusCode != http.StatusOK {
+			t.Fatalf("public resolve: status %d", resp.StatusCode)
+		}
+	}
+	drainClicks(t)
+	after := mongoDocument(t, "urls", filter)
+	for _, field := range []string{"clicks", "last_clicked", "click_history", "updated_at"} {
+		if fmt.Sprint(after[field]) != fmt.Sprint(before[field]) {
+			t.Errorf("%s changed by resolving: %v -> %v", field, before[field], after[field])
+		}
+	}
+	if n := mongoCount(t, "clicks", filter); n != clicksBefore {
+		t.Errorf("%d click documents after resolving, want %d", n, clicksBefore)
+	}
+	if owned["destination"] != "https://example.com/card" || owned["clicks"] != float64(1) || owned["status"] != "active" {
+		t.Errorf("owner resolve %v", owned)
+	}
+	if _, ok := public["clicks"]; ok || public["destination"] != "https://example.com/card" {
+		t.Errorf("public resolve %v", public)
+	}
+
+	// Other accounts and bad signatures get nothing
+	if resp := srv.do("GET", "/api/v1/resolve?code="+code, other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resolve by another account: status %d", resp.StatusCode)
+	}
+	neighbour := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/neighbour"})
+	if resp := srv.do("GET", strings.Replace(srv.publicResolvePath(token, neighbour), "code="+neighbour, "code="+code, 1), "", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("resolve with another code's signature: status %d", resp.StatusCode)
+	}
+}
+
+func TestIntegrationWorkerLeaseContention(t *testing.T) {
+	srv := newMongoTestServer(t)
+	ctx := context.Background()
+	const lease = "worker:it_contention"
+
+	// Two instances race for the lease: only one of them ever holds it
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	winners := make(map[string]int)
+	for i := 0; i < 16; i++ {
+		holder := []string{"instance-a", "instance-b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquired, err := acquireLease(ctx, lease, holder, 500*time.Millisecond)
+			if err != nil {
+				t.Error(err)
+			}
+			if acquired {
+				mu.Lock()
+				winners[holder]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(winners) != 1 {
+		t.Fatalf("lease held by %v", winners)
+	}
+	holder, loser := "instance-a", "instance-b"
+	if winners[holder] == 0 {
+		holder, loser = loser, holder
+	}
+	if ok, err := acquireLease(ctx, lease, loser, time.Minute); err != nil || ok {
+		t.Fatalf("%s took a live lease: %v, %v", loser, ok, err)
+	}
+	if err := releaseLease(ctx, lease, loser); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := acquireLease(ctx, lease, loser, time.Minute); ok {
+		t.Fatalf("%s released a lease it does not hold", loser)
+	}
+
+	// When the holder dies its lease lapses and the other instance takes over
+	time.Sleep(600 * time.Millisecond)
+	if ok, err := acquireLease(ctx, lease, loser, time.Minute); err != nil || !ok {
+		t.Fatalf("takeover of a lapsed lease: %v, %v", ok, err)
+	}
+	if ok, _ := acquireLease(ctx, lease, holder, time.Minute); ok {
+		t.Fatalf("%s got its lease back from %s", holder, loser)
+	}
+
+	// A worker runs on one instance per interval and records the run for /health and /metrics
+	saved := InstanceID
+	t.Cleanup(func() { InstanceID = saved })
+	runs := 0
+	task := func() (map[string]int64, error) {
+		runs++
+		return map[string]int64{"expired": 3}, nil
+	}
+	skipped := metricValue("worker_it_cleanup_skipped_total")
+	InstanceID = "instance-a"
+	if !runExclusive("it_cleanup", time.Hour, task) {
+		t.Fatal("first instance did not run")
+	}
+	InstanceID = "instance-b"
+	if runExclusive("it_cleanup", time.Hour, task) || runs != 1 {
+		t.Fatalf("second instance ran too: %d runs", runs)
+	}
+	if got := metricValue("worker_it_cleanup_skipped_total"); got != skipped+1 {
+		t.Errorf("worker_it_cleanup_skipped_total %d, want %d", got, skipped+1)
+	}
+	var health struct {
+		Workers []WorkerRun `json:"workers"`
+	}
+	srv.do("GET", "/health", "", nil, &health)
+	if len(health.Workers) != 1 || health.Workers[0].Name != "it_cleanup" || health.Workers[0].InstanceID != "instance-a" || health.Workers[0].Counts["expired"] != 3 {
+		t.Errorf("health workers %+v", health.Workers)
+	}
+}
+
+func TestIntegrationFacetedAnalyticsMatchesLegacy(t *testing.T) {
+	useMongoDatabase(t)
+	ctx := context.Background()
+	const userID = "it-analytics"
+	if err := seedAnalyticsBenchmark(ctx, userID, 2000); err != nil {
+		t.Fatal(err)
+	}
+	// Links of other accounts and switched-off links must not leak into either answer
+	var others []interface{}
+	for i := 0; i < 5; i++ {
+		others = append(others, URLData{
+			ShortURL: fmt.Sprintf("it-other-%d", i), LongURL: "https://example.com/other", UserID: "it-analytics-other",
+			Domain: "https://go.example.com", Tags: []string{"technology"}, Clicks: 5000, IsActive: true, CreatedAt: time.Now(),
+		})
+	}
+	if _, err := DB.Collection.InsertMany(ctx, others); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Collection.UpdateMany(ctx, bson.D{{Key: "user_id", Value: userID}, {Key: "clicks", Value: bson.D{{Key: "$lt", Value: 5}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "is_active", Value: false}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		filter      LinkFilter
+		skip, limit int
+	}{
+		{"first page", LinkFilter{}, 0, 20},
+		{"middle page", LinkFilter{}, 400, 50},
+		{"past the end", LinkFilter{}, 5000, 20},
+		{"tag", LinkFilter{Tags: []string{"technology"}}, 0, 100},
+		{"domain", LinkFilter{Domain: "https://go.example.com"}, 20, 20},
+		{"all statuses", LinkFilter{Status: linkStatusAll}, 0, 20},
+	}
+	for _, tt := range tests {
+		legacy, err := legacyAnalyticsPage(ctx, userID, tt.filter, tt.skip, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: legacy: %v", tt.name, err)
+		}
+		faceted, err := facetedAnalyticsPage(userID, tt.filter, tt.skip, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: faceted: %v", tt.name, err)
+		}
+		if !sameAnalyticsResult(legacy, faceted) {
+			t.Errorf("%s: faceted result differs\nlegacy:  %v\nfaceted: %v", tt.name, legacy, faceted)
+		}
+	}
+}
+
+// BenchmarkIntegrationAnalytics times the legacy analytics queries against the faceted
+// aggregation over benchAnalyticsLinks links:
+//
+//	go test -tags integration -run '^$' -bench IntegrationAnalytics
+func BenchmarkIntegrationAnalytics(b *testing.B) {
+	useMongoDatabase(b)
+	ctx := context.Background()
+	const userID = "bench-analytics"
+	if err := seedAnalyticsBenchmark(ctx, userID, benchAnalyticsLinks); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("legacy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := legacyAnalyticsPage(ctx, userID, LinkFilter{}, 0, benchAnalyticsPageSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("faceted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := facetedAnalyticsPage(userID, LinkFilter{}, 0, benchAnalyticsPageSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestIntegrationDemoListing(t *testing.T) {
+	srv := newMongoTestServer(t)
+	demo := func(method, session string, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/rapidlink-demo", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "rapidlink_demo_session", Value: session})
+		}
+		resp := srv.send(req, nil)
+		return resp, readBody(t, resp)
+	}
+	type listing struct {
+		URLs  []DemoURL `json:"urls"`
+		Quota struct {
+			Limit, Used, Remaining int
+		} `json:"quota"`
+	}
+	list := func(session string) listing {
+		t.Helper()
+		resp, body := demo("GET", session, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" ||
+			resp.Header.Get("X-Content-Type-Options") != "nosniff" || !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+			t.Fatalf("listing: status %d, headers %v", resp.StatusCode, resp.Header)
+		}
+		if !strings.Contains(body, `"urls":[`) {
+			t.Fatalf("urls not an array: %s", body)
+		}
+		var out listing
+		if err := json.Unmarshal([]byte(body), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// An empty session lists an empty array with its whole quota; no session is refused
+	if got := list("it-empty-session"); len(got.URLs) != 0 || got.Quota.Limit != demoSessionLinkLimit || got.Quota.Used != 0 || got.Quota.Remaining != demoSessionLinkLimit {
+		t.Fatalf("empty session %+v", got)
+	}
+	if resp, _ := demo("GET", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no session: status %d", resp.StatusCode)
+	}
+
+	const session = "it-demo-session"
+	for i := 0; i < 3; i++ {
+		if resp, body := demo("PUT", session, fmt.Sprintf(`{"long_url":"https://example.com/demo/%d"}`, i)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("demo link %d: status %d: %s", i, resp.StatusCode, body)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	demo("PUT", "it-other-session", `{"long_url":"https://example.com/other"}`)
+
+	// Expired links drop out of the listing before the TTL monitor removes them, but still
+	// count against the quota
+	ctx := context.Background()
+	if _, err := DB.Database.Collection("demo_urls").UpdateOne(ctx, bson.D{{Key: "long_url", Value: "https://example.com/demo/1"}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: time.Now().Add(-time.Minute)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	got := list(session)
+	if len(got.URLs) != 2 || got.URLs[0].LongURL != "https://example.com/demo/2" || got.URLs[1].LongURL != "https://example.com/demo/0" {
+		t.Fatalf("listing %+v", got.URLs)
+	}
+	if got.Quota.Used != 3 || got.Quota.Remaining != demoSessionLinkLimit-3 || got.URLs[0].FullShortURL == "" {
+		t.Fatalf("listing %+v", got)
+	}
+
+	// The listing never exceeds the session limit, even past a full quota
+	for i := 0; i < demoSessionLinkLimit; i++ {
+		demo("PUT", session, fmt.Sprintf(`{"long_url":"https://example.com/more/%d"}`, i))
+	}
+	if got := list(session); len(got.URLs) > demoSessionLinkLimit || got.Quota.Remaining != 0 {
+		t.Fatalf("full session lists %d links, quota %+v", len(got.URLs), got.Quota)
+	}
+}
+
+// winningIndexes explains pipeline on the urls collection and returns the indexes its
+// winning plan reads
+func winningIndexes(t *testing.T, pipeline mongo.Pipeline) []string {
+	t.Helper()
+	var explained bson.M
+	if err := DB.Database.RunCommand(context.Background(), bson.D{
+		{Key: "explain", Value: bson.D{{Key: "aggregate", Value: "urls"}, {Key: "pipeline", Value: pipeline}, {Key: "cursor", Value: bson.D{}}}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}).Decode(&explained); err != nil {
+		t.Fatal(err)
+	}
+	var indexes []string
+	var walk func(v interface{}, winning bool)
+	walk = func(v interface{}, winning bool) {
+		switch v := v.(type) {
+		case bson.M:
+			for key, value := range v {
+				if name, ok := value.(string); ok && key == "indexName" && winning {
+					indexes = append(indexes, name)
+				}
+				walk(value, winning || key == "winningPlan")
+			}
+		case bson.A:
+			for _, value := range v {
+				walk(value, winning)
+			}
+		}
+	}
+	walk(explained, false)
+	return indexes
+}
+
+func TestIntegrationFilteredListingIndexes(t *testing.T) {
+	useMongoDatabase(t)
+	ctx := context.Background()
+	const userID = "it-indexes"
+	if err := seedAnalyticsBenchmark(ctx, userID, 3000); err != nil {
+		t.Fatal(err)
+	}
+	var rare []interface{}
+	for i := 0; i < 10; i++ {
+		rare = append(rare, URLData{
+			ShortURL: fmt.Sprintf("it-rare-%d", i), LongURL: fmt.Sprintf("https://rare.example/%d", i), UserID: userID,
+			Domain: "https://rare.example", Tags: []string{"rare"}, IsActive: true, CreatedAt: time.Now().Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	if _, err := DB.Collection.InsertMany(ctx, rare); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter LinkFilter
+		index  string
+	}{
+		{"tag", LinkFilter{Tags: []string{"rare"}}, "user_tags_idx"},
+		{"domain", LinkFilter{Domain: "https://rare.example"}, "user_domain_idx"},
+	}
+	for _, tt := range tests {
+		indexes := winningIndexes(t, analyticsPagePipeline(userID, tt.filter, 0, 20, false, nil, time.Now()))
+		if !containsString(indexes, tt.index) {
+			t.Errorf("%s-filtered listing uses %v, want %s", tt.name, indexes, tt.index)
+		}
+
+		// The page is the same with the filter before or inside the $facet
+		without, total, _, err := GetUserAnalyticsPage(ctx, DB.Collection, userID, tt.filter, 0, 20, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		with, totalWith, _, err := GetUserAnalyticsPage(ctx, DB.Collection, userID, tt.filter, 0, 20, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 10 || totalWith != 10 || fmt.Sprint(without) != fmt.Sprint(with) {
+			t.Errorf("%s: %d links without statistics, %d with\n%v\n%v", tt.name, total, totalWith, without, with)
+		}
+	}
+}
+
+func TestIntegrationStatusCounts(t *testing.T) {
+	useMongoDatabase(t)
+	ctx := context.Background()
+	now := time.Now()
+	links, want := statusMix("it-status", now)
+	others, _ := statusMix("it-status-other", now)
+	var docs []interface{}
+	for _, link := range append(links, others...) {
+		docs = append(docs, link)
+	}
+	if _, err := DB.Collection.InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := getStatusBreakdown(ctx, DB.Collection, "it-status", now)
+	if err != nil || !sameStatusCounts(counts, want) {
+		t.Fatalf("status counts %v, %v; want %v", counts, err, want)
+	}
+	// The same block reaches both statistics paths
+	stats, err := GetUserStatsOptimized(ctx, "it-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, page, err := GetUserAnalyticsPage(ctx, DB.Collection, "it-status", LinkFilter{}, 0, 20, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]interface{}{"GetUserStatsOptimized": stats["status_counts"], "GetUserAnalyticsPage": page["status_counts"]} {
+		if counts, ok := block.(map[string]interface{}); !ok || !sameStatusCounts(counts, want) {
+			t.Errorf("%s status_counts %v", name, block)
+		}
+	}
+	if counts, err := getStatusBreakdown(ctx, DB.Collection, "it-nobody", now); err != nil || !sameStatusCounts(counts, map[string]int64{
+		statusActive: 0, statusExpired: 0, statusDisabled: 0, statusScheduled: 0, statusDraft: 0, "expiring_7d": 0, "expiring_30d": 0,
+	}) {
+		t.Errorf("user without links: %v, %v", counts, err)
+	}
+}
+
+func TestIntegrationPinnedListingIndex(t *testing.T) {
+	useMongoDatabase(t)
+	ctx := context.Background()
+	const userID = "it-pinned"
+	if err := seedAnalyticsBenchmark(ctx, userID, 3000); err != nil {
+		t.Fatal(err)
+	}
+	// The oldest links are pinned, so only the sort brings them to the top
+	pinned := true
+	oldest := bson.M{"user_id": userID, "created_at": bson.M{"$lte": time.Now().Add(-2995 * time.Minute)}}
+	if result, err := DB.Collection.UpdateMany(ctx, oldest, bson.M{"$set": bson.M{"pinned": true}}); err != nil || result.ModifiedCount != 5 {
+		t.Fatalf("pinning: %+v, %v", result, err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    LinkFilter
+		withStats bool
+	}{
+		{"listing", LinkFilter{}, false},
+		{"listing with statistics", LinkFilter{}, true},
+		{"pinned filter", LinkFilter{Pinned: &pinned}, false},
+	}
+	for _, tt := range tests {
+		indexes := winningIndexes(t, analyticsPagePipeline(userID, tt.filter, 0, 20, tt.withStats, nil, time.Now()))
+		if !containsString(indexes, "user_active_pinned_created_at_idx") {
+			t.Errorf("%s uses %v, want user_active_pinned_created_at_idx", tt.name, indexes)
+		}
+	}
+
+	page, total, _, err := GetUserAnalyticsPage(ctx, DB.Collection, userID, LinkFilter{}, 0, 20, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3000 || len(page) != 20 {
+		t.Fatalf("%d of %d links", len(page), total)
+	}
+	for i, link := range page {
+		if isPinned, _ := link["pinned"].(bool); isPinned != (i < 5) {
+			t.Errorf("link %d (%v) pinned %v", i, link["short_url"], link["pinned"])
+		}
+	}
+	if page[0]["short_url"] != fmt.Sprintf("bench-%s-%d", InstanceID, 2995) {
+		t.Errorf("first pinned link %v, want the newest of them", page[0]["short_url"])
+	}
+}
+
+// monitoredCommand is a command the driver sent, with the read preference it carried
+type monitoredCommand struct {
+	name, collection, readPreference string
+}
+
+func TestIntegrationAnalyticsReadPreference(t *testing.T) {
+	uri := integrationReplicaSet(t)
+	t.Setenv("MONGODB_READ_PREFERENCE", "secondaryPreferred")
+	if err := InitAnalyticsReadPreference(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { analyticsReadPref = nil })
+	useMongoDatabaseAt(t, uri)
+
+	// The same database through a client that records every command it sends
+	var mu sync.Mutex
+	var commands []monitoredCommand
+	monitor := &event.CommandMonitor{Started: func(_ context.Context, e *event.CommandStartedEvent) {
+		collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+		mode, _ := e.Command.Lookup("$readPreference", "mode").StringValueOK()
+		mu.Lock()
+		commands = append(commands, monitoredCommand{e.CommandName, collection, mode})
+		mu.Unlock()
+	}}
+	monitored, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri).SetMonitor(monitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedUsers, savedLinks := DB, Users, Links
+	database := monitored.Database(DB.Database.Name())
+	DB = &DatabaseConfig{Client: monitored, Database: database, Collection: database.Collection("urls")}
+	Users = &mongoUserStore{users: database.Collection("users")}
+	Links = &mongoURLStore{coll: DB.Collection}
+	t.Cleanup(func() {
+		DB, Users, Links = saved, savedUsers, savedLinks
+		monitored.Disconnect(context.Background())
+	})
+	// sent runs request and returns the commands it sent
+	sent := func(request func()) []monitoredCommand {
+		t.Helper()
+		drainClicks(t)
+		mu.Lock()
+		commands = nil
+		mu.Unlock()
+		request()
+		drainClicks(t)
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]monitoredCommand(nil), commands...)
+	}
+
+	srv := startMongoTestServer(t)
+	token, _ := srv.register()
+	var code string
+
+	// Creation, its duplicate lookup and redirects stay on the primary
+	for _, step := range []struct {
+		name    string
+		request func()
+	}{
+		{"creation", func() { code = srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/replica"}) }},
+		{"redirect", func() { srv.do("GET", "/"+code, "", nil, nil) }},
+	} {
+		// Reads on a direct connection to the primary carry primaryPreferred, writes nothing
+		for _, command := range sent(step.request) {
+			if command.readPreference != "" && command.readPreference != "primaryPreferred" {
+				t.Errorf("%s sent %+v", step.name, command)
+			}
+		}
+	}
+
+	// The dashboard reads go to a secondary when one is up and say so
+	today := time.Now().UTC().Format("2006-01-02")
+	tests := []struct {
+		name, path, command, collection string
+	}{
+		{"analytics", "/analytics", "aggregate", "urls"},
+		{"click list", "/url/" + code + "/clicks", "find", "clicks"},
+		{"click export", "/analytics/clicks/export?date=" + today, "find", "clicks"},
+	}
+	for _, tt := range tests {
+		var resp *http.Response
+		var body struct {
+			ServedFrom string `json:"served_from"`
+		}
+		var read *monitoredCommand
+		for _, command := range sent(func() { resp = srv.do("GET", tt.path, token, nil, &body) }) {
+			if command.name == tt.command && command.collection == tt.collection {
+				command := command
+				read = &command
+			}
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", tt.name, resp.StatusCode)
+			continue
+		}
+		if read == nil || read.readPreference != "secondaryPreferred" {
+			t.Errorf("%s: %s on %s sent %+v", tt.name, tt.command, tt.collection, read)
+		}
+		if served := body.ServedFrom + resp.Header.Get("X-Served-From"); served != "secondary" {
+			t.Errorf("%s: served from %q", tt.name, served)
+		}
+	}
+}
+
+func TestIntegrationCollectionMaintenance(t *testing.T) {
+	srv := newMongoTestServer(t)
+	admin, _ := srv.registerMongoAdmin()
+	ctx := context.Background()
+	now := time.Now()
+	// aged returns the _id of a document created age ago; n keeps ids of one age apart
+	aged := func(age time.Duration, n int) primitive.ObjectID {
+		return primitive.NewObjectIDFromTimestamp(now.Add(-age - time.Duration(n)*time.Second))
+	}
+	insert := func(collection string, docs ...interface{}) {
+		t.Helper()
+		if _, err := DB.Database.Collection(collection).InsertMany(ctx, docs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := 24 * time.Hour
+
+	var outbox []interface{}
+	for i := 0; i < 5; i++ {
+		outbox = append(outbox, bson.D{{Key: "_id", Value: aged(40*day, i)}, {Key: "short_url", Value: "stale"}})
+	}
+	for i := 0; i < 8; i++ {
+		outbox = append(outbox, bson.D{{Key: "_id", Value: aged(time.Hour, i)}, {Key: "short_url", Value: fmt.Sprintf("recent-%d", i)}})
+	}
+	insert("clicks_outbox", outbox...)
+	resolvedAt := func(age time.Duration) time.Time { return now.Add(-age) }
+	insert("abuse_reports",
+		bson.D{{Key: "short_url", Value: "closed-long-ago"}, {Key: "status", Value: AbuseReportDismissed}, {Key: "resolved_at", Value: resolvedAt(400 * day)}},
+		bson.D{{Key: "short_url", Value: "closed-lately"}, {Key: "status", Value: AbuseReportDisabled}, {Key: "resolved_at", Value: resolvedAt(30 * day)}},
+		bson.D{{Key: "short_url", Value: "open-long-ago"}, {Key: "status", Value: AbuseReportOpen}, {Key: "created_at", Value: resolvedAt(400 * day)}},
+	)
+	insert("security_events",
+		bson.D{{Key: "_id", Value: aged(400*day, 0)}, {Key: "event_type", Value: "old"}},
+		bson.D{{Key: "_id", Value: aged(400*day, 1)}, {Key: "event_type", Value: "old"}},
+		bson.D{{Key: "_id", Value: aged(day, 0)}, {Key: "event_type", Value: "new"}},
+	)
+	insert("bulk_sources", bson.D{{Key: "name", Value: "idle"}, {Key: "last_synced_at", Value: resolvedAt(1000 * day)}})
+
+	// Security events are kept until configured; the outbox is capped below its default
+	cfg, err := parseRuntimeConfig([]byte(`{"retention": {
+		"security_events": {"max_age": "1y"},
+		"clicks_outbox": {"max_documents": 6},
+		"api_usage": {"max_age": "30d"}
+	}}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedBefore := metricValue("maintenance_clicks_outbox_deleted_total")
+	counts, err := runMaintenance(ctx, DB.Database, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"clicks_outbox_deleted": 7, "abuse_reports_deleted": 1, "security_events_deleted": 2,
+		"bulk_sources_deleted": 0, "api_usage_deleted": 0, "link_outcomes_deleted": 0}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("deleted %v, want %v", counts, want)
+	}
+	if got := metricValue("maintenance_clicks_outbox_deleted_total"); got != deletedBefore+7 {
+		t.Errorf("maintenance_clicks_outbox_deleted_total %d, want %d", got, deletedBefore+7)
+	}
+
+	// Exactly the stale and the oldest excess documents are gone
+	for _, tt := range []struct {
+		collection string
+		filter     bson.D
+		want       int64
+	}{
+		{"clicks_outbox", bson.D{{Key: "short_url", Value: "stale"}}, 0},
+		{"clicks_outbox", bson.D{{Key: "short_url", Value: bson.D{{Key: "$in", Value: bson.A{"recent-6", "recent-7"}}}}}, 0},
+		{"clicks_outbox", bson.D{}, 6},
+		{"abuse_reports", bson.D{{Key: "short_url", Value: "closed-long-ago"}}, 0},
+		{"abuse_reports", bson.D{}, 2},
+		{"security_events", bson.D{{Key: "event_type", Value: "old"}}, 0},
+		{"security_events", bson.D{{Key: "event_type", Value: "new"}}, 1},
+		{"bulk_sources", bson.D{}, 1},
+	} {
+		if got := mongoCount(t, tt.collection, tt.filter); got != tt.want {
+			t.Errorf("%s %v: %d documents, want %d", tt.collection, tt.filter, got, tt.want)
+		}
+	}
+
+	// TTL collections are pruned by their index, whose expiry follows the policy
+	specs, err := DB.Database.Collection("api_usage").Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expiry int32
+	for _, spec := range specs {
+		if spec.Name == "day_ttl_idx" && spec.ExpireAfterSeconds != nil {
+			expiry = *spec.ExpireAfterSeconds
+		}
+	}
+	if expiry != 30*24*60*60 {
+		t.Errorf("api_usage day_ttl_idx expires after %ds", expiry)
+	}
+
+	// The admin endpoint runs one collection under the live, default policies
+	insert("clicks_outbox", bson.D{{Key: "_id", Value: aged(31*day, 0)}}, bson.D{{Key: "_id", Value: aged(31*day, 1)}})
+	var run struct {
+		Deleted      int64  `json:"deleted"`
+		MaxAge       string `json:"max_age"`
+		MaxDocuments int64  `json:"max_documents"`
+	}
+	if resp := srv.do("POST", "/admin/maintenance/clicks_outbox", admin, map[string]interface{}{}, &run); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin maintenance: status %d", resp.StatusCode)
+	}
+	if run.Deleted != 2 || run.MaxAge != "30d" || run.MaxDocuments != 1_000_000 || mongoCount(t, "clicks_outbox", bson.D{}) != 6 {
+		t.Errorf("admin maintenance %+v", run)
+	}
+	if resp := srv.do("POST", "/admin/maintenance/urls", admin, map[string]interface{}{}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("maintenance of urls: status %d", resp.StatusCode)
+	}
+	// A run already in progress elsewhere is not started twice
+	if acquired, err := acquireLease(ctx, "maintenance:clicks_outbox", "other-instance", time.Minute); err != nil || !acquired {
+		t.Fatalf("holding the lease: %v, %v", acquired, err)
+	}
+	if resp := srv.do("POST", "/admin/maintenance/clicks_outbox", admin, map[string]interface{}{}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("concurrent maintenance: status %d", resp.StatusCode)
+	}
+}
+
+func TestIntegrationMongoPermissions(t *testing.T) {
+	rootURI := integrationAuthMongo(t)
+	ctx := context.Background()
+	root, err := mongo.Connect(ctx, options.Client().ApplyURI(rootURI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Disconnect(context.Background()) })
+
+	// minimalRole returns the privileges of GET /admin/required-permissions on database, less
+	// the actions in except
+	minimalRole := func(database string, except ...string) bson.A {
+		privileges := bson.A{}
+		for _, privilege := range requiredMongoPrivileges() {
+			var actions bson.A
+			for _, action := range privilege.Actions {
+				if !containsString(except, action) {
+					actions = append(actions, action)
+				}
+			}
+			privileges = append(privileges, bson.D{
+				{Key: "resource", Value: bson.D{{Key: "db", Value: database}, {Key: "collection", Value: privilege.Collection}}},
+				{Key: "actions", Value: actions},
+			})
+		}
+		return privileges
+	}
+
+	tests := []struct {
+		name      string
+		except    []string
+		builtin   string
+		missing   map[string][]string
+		dangerous []string
+	}{
+		{name: "minimal role"},
+		{name: "without index management", except: []string{"createIndex", "dropIndex"},
+			missing: map[string][]string{"*": {"createIndex", "dropIndex"}}},
+		{name: "readWrite", builtin: "readWrite", dangerous: []string{"dropCollection"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := fmt.Sprintf("it_permissions_%d", i)
+			admin := root.Database(database)
+			roles := bson.A{}
+			if tt.builtin == "" {
+				if err := admin.RunCommand(ctx, bson.D{
+					{Key: "createRole", Value: "rapidlinkApp"},
+					{Key: "privileges", Value: minimalRole(database, tt.except...)},
+					{Key: "roles", Value: bson.A{}},
+				}).Err(); err != nil {
+					t.Fatal(err)
+				}
+				roles = append(roles, bson.D{{Key: "role", Value: "rapidlinkApp"}, {Key: "db", Value: database}})
+			} else {
+				roles = append(roles, bson.D{{Key: "role", Value: tt.builtin}, {Key: "db", Value: database}})
+			}
+			if err := admin.RunCommand(ctx, bson.D{
+				{Key: "createUser", Value: "app"},
+				{Key: "pwd", Value: "app-password"},
+				{Key: "roles", Value: roles},
+			}).Err(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				for _, command := range []bson.D{
+					{{Key: "dropAllUsersFromDatabase", Value: 1}},
+					{{Key: "dropAllRolesFromDatabase", Value: 1}},
+					{{Key: "dropDatabase", Value: 1}},
+				} {
+					if err := admin.RunCommand(context.Background(), command).Err(); err != nil {
+						t.Errorf("cleaning up %s: %v", database, err)
+					}
+				}
+			})
+
+			uri, err := url.Parse(rootURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uri.User = url.UserPassword("app", "app-password")
+			uri.Path = "/"
+			uri.RawQuery = url.Values{"authSource": {database}}.Encode()
+
+			// Startup succeeds whatever the user lacks, and reports it
+			saved, savedUsers, savedLinks, savedPermissions := DB, Users, Links, mongoPermissions
+			if err := InitMongoDB(uri.String(), database); err != nil {
+				t.Fatalf("startup: %v", err)
+			}
+			t.Cleanup(func() {
+				CloseMongoDB()
+				DB, Users, Links, mongoPermissions = saved, savedUsers, savedLinks, savedPermissions
+			})
+			report := mongoPermissions
+			if report == nil || !report.AuthEnabled || len(report.Users) != 1 || report.Users[0] != "app@"+database {
+				t.Fatalf("report %+v", report)
+			}
+			if fmt.Sprint(report.Missing) != fmt.Sprint(tt.missing) || fmt.Sprint(report.Dangerous) != fmt.Sprint(tt.dangerous) {
+				t.Errorf("missing %v, dangerous %v; want %v, %v", report.Missing, report.Dangerous, tt.missing, tt.dangerous)
+			}
+			if canCreateMongoIndexes() != (tt.missing == nil) {
+				t.Errorf("canCreateMongoIndexes %v", canCreateMongoIndexes())
+			}
+
+			// The server still stores and finds links; indexes exist only where it may create them
+			Links = &mongoURLStore{coll: DB.Collection}
+			link := &URLData{ShortURL: "perm" + fmt.Sprint(i), LongURL: "https://example.com/perm", UserID: "it-permissions", IsActive: true, CreatedAt: time.Now()}
+			if err := Links.InsertLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Links.FindLinkByCode(ctx, link.ShortURL); err != nil {
+				t.Fatal(err)
+			}
+			specs, err := DB.Collection.Indexes().ListSpecifications(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if indexed := len(specs) > 1; indexed != (tt.missing == nil) {
+				t.Errorf("urls has %d indexes", len(specs))
+			}
+		})
+	}
+}
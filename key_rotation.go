@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// ENCRYPTION KEY ROTATION
+// ============================================================================
+//
+// Ciphertexts start with the version of the key that wrote them (ENCRYPTION_KEY_VERSION,
+// 1 by default). To rotate, move the old key to ENCRYPTION_KEY_PREVIOUS, set the new one as
+// ENCRYPTION_KEY and raise ENCRYPTION_KEY_VERSION by one: new data is written under the new
+// key while data under the old one still decrypts. Ciphertexts written before keys were
+// versioned are tried under both keys. POST /admin/encryption/reencrypt then rewrites the
+// stored ciphertexts of older versions under the current key in batches of reencryptBatchSize,
+// in the background. Its progress is checkpointed in the key_rotations collection after every
+// batch, so a run interrupted by a restart resumes where it stopped when started again; GET
+// shows the checkpoint. Once a run for the current version completed without failures,
+// ENCRYPTION_KEY_PREVIOUS can be removed. Only the default database is rewritten. The
+// encryption_reencrypt_remaining gauge is how many encrypted documents the run still has to
+// check, an upper bound of those left under an older key.
+//
+// The IP hashes of clicks and creation contexts are keyed with ENCRYPTION_KEY too, so visitors
+// hashed before a rotation count as new ones after it.
+
+const (
+	reencryptBatchSize    = 500
+	reencryptBatchPause   = 100 * time.Millisecond
+	reencryptLockName     = "encryption:reencrypt"
+	reencryptCheckpointID = "reencrypt"
+)
+
+// Re-encryption run states
+const (
+	ReencryptRunning   = "running"
+	ReencryptCompleted = "completed"
+	ReencryptFailed    = "failed"
+)
+
+// encryptedField is a stored field holding prefix + an EncryptSensitiveData ciphertext
+type encryptedField struct {
+	Collection string
+	Field      string
+	Prefix     string
+}
+
+// encryptedFields lists every field the re-encryption job rewrites, in the order it does
+var encryptedFields = []encryptedField{
+	{Collection: "urls", Field: "created_ip", Prefix: "enc:"},
+}
+
+// name identifies the field in checkpoints
+func (f encryptedField) name() string {
+	return f.Collection + "." + f.Field
+}
+
+// ReencryptCheckpoint is the key_rotations document of the re-encryption job
+type ReencryptCheckpoint struct {
+	ID         string `bson:"_id" json:"-"`
+	KeyVersion int    `bson:"key_version" json:"key_version"`
+	Status     string `bson:"status" json:"status"`
+	// Field and LastID are where the run stopped: the field being rewritten and the last
+	// document it checked
+	Field       string             `bson:"field" json:"field"`
+	LastID      primitive.ObjectID `bson:"last_id" json:"last_id"`
+	Checked     int64              `bson:"checked" json:"checked"`
+	Reencrypted int64              `bson:"reencrypted" json:"reencrypted"`
+	// Failed counts ciphertexts that open under neither key; they are left as they are
+	Failed int64 `bson:"failed" json:"failed"`
+	// Remaining is how many encrypted documents of the field were still to check
+	Remaining  int64      `bson:"remaining" json:"remaining"`
+	StartedAt  time.Time  `bson:"started_at" json:"started_at"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// initKeyRotation reads the key version and the previous key
+func initKeyRotation() error {
+	encryptionKeyVersion = 1
+	if raw := os.Getenv("ENCRYPTION_KEY_VERSION"); raw != "" {
+		version, err := strconv.Atoi(raw)
+		if err != nil || version < 1 || version > 255 {
+			return errors.New("ENCRYPTION_KEY_VERSION must be between 1 and 255")
+		}
+		encryptionKeyVersion = byte(version)
+	}
+	previousEncryptionKey = nil
+	raw := os.Getenv("ENCRYPTION_KEY_PREVIOUS")
+	if raw == "" {
+		return nil
+	}
+	previous, err := decodeEncryptionKey(raw)
+	if err != nil {
+		return errors.New("ENCRYPTION_KEY_PREVIOUS must be a base64-encoded 32-byte key")
+	}
+	if encryptionKeyVersion < 2 {
+		return errors.New("ENCRYPTION_KEY_PREVIOUS is version ENCRYPTION_KEY_VERSION-1, so ENCRYPTION_KEY_VERSION must be 2 or more")
+	}
+	if bytes.Equal(previous, encryptionKey) {
+		return errors.New("ENCRYPTION_KEY_PREVIOUS must differ from ENCRYPTION_KEY")
+	}
+	previousEncryptionKey = previous
+	return nil
+}
+
+// decryptVersioned decrypts ciphertext and returns the version of the key that opened it, 0
+// for a ciphertext written before keys were versioned. The key named by the version byte is
+// tried first. An unversioned ciphertext starts with a random nonce byte instead, so when that
+// fails the whole data is tried under the current and the previous key.
+func decryptVersioned(ciphertext string) (string, byte, error) {
+	if len(encryptionKey) != 32 {
+		return "", 0, errors.New("encryption not initialized")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(data) > 0 {
+		switch {
+		case data[0] == encryptionKeyVersion:
+			if plaintext, err := openSealed(encryptionKey, data[1:]); err == nil {
+				return plaintext, data[0], nil
+			}
+		case previousEncryptionKey != nil && data[0] == encryptionKeyVersion-1:
+			if plaintext, err := openSealed(previousEncryptionKey, data[1:]); err == nil {
+				return plaintext, data[0], nil
+			}
+		}
+	}
+	for _, key := range [][]byte{encryptionKey, previousEncryptionKey} {
+		if key == nil {
+			continue
+		}
+		if plaintext, err := openSealed(key, data); err == nil {
+			return plaintext, 0, nil
+		}
+	}
+	return "", 0, errors.New("ciphertext opens under neither the current nor the previous key")
+}
+
+// loadReencryptCheckpoint returns the checkpoint of the last run; nil when there never was one
+func loadReencryptCheckpoint(ctx context.Context, db *mongo.Database) (*ReencryptCheckpoint, error) {
+	var checkpoint ReencryptCheckpoint
+	err := db.Collection("key_rotations").FindOne(ctx, bson.D{{Key: "_id", Value: reencryptCheckpointID}}).Decode(&checkpoint)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// saveReencryptCheckpoint stores checkpoint
+func saveReencryptCheckpoint(ctx context.Context, db *mongo.Database, checkpoint *ReencryptCheckpoint) error {
+	checkpoint.UpdatedAt = clock.Now().UTC()
+	_, err := db.Collection("key_rotations").ReplaceOne(ctx, bson.D{{Key: "_id", Value: reencryptCheckpointID}},
+		checkpoint, options.Replace().SetUpsert(true))
+	return err
+}
+
+// nextReencryptRun returns the checkpoint a run starts from: the unfinished run for the
+// current key version, or a new one
+func nextReencryptRun(last *ReencryptCheckpoint, now time.Time) *ReencryptCheckpoint {
+	if last != nil && last.KeyVersion == int(encryptionKeyVersion) && last.Status != ReencryptCompleted {
+		resumed := *last
+		resumed.Status = ReencryptRunning
+		resumed.Error = ""
+		resumed.FinishedAt = nil
+		return &resumed
+	}
+	return &ReencryptCheckpoint{
+		ID:         reencryptCheckpointID,
+		KeyVersion: int(encryptionKeyVersion),
+		Status:     ReencryptRunning,
+		Field:      encryptedFields[0].name(),
+		StartedAt:  now,
+	}
+}
+
+// runReencryption rewrites the ciphertexts of every encrypted field from checkpoint on,
+// saving the checkpoint after every batch. The caller holds reencryptLockName.
+func runReencryption(ctx context.Context, db *mongo.Database, checkpoint *ReencryptCheckpoint) error {
+	started := false
+	for _, field := range encryptedFields {
+		if !started && field.name() != checkpoint.Field {
+			continue
+		}
+		if started {
+			checkpoint.Field = field.name()
+			checkpoint.LastID = primitive.NilObjectID
+		}
+		started = true
+		if err := reencryptField(ctx, db, field, checkpoint); err != nil {
+			return err
+		}
+	}
+	if !started {
+		return fmt.Errorf("checkpoint names unknown field %q", checkpoint.Field)
+	}
+	return nil
+}
+
+// reencryptField rewrites the older-version ciphertexts of field after checkpoint.LastID
+func reencryptField(ctx context.Context, db *mongo.Database, field encryptedField, checkpoint *ReencryptCheckpoint) error {
+	coll := db.Collection(field.Collection)
+	for {
+		filter := bson.D{{Key: field.Field, Value: bson.D{{Key: "$regex", Value: "^" + field.Prefix}}}}
+		if !checkpoint.LastID.IsZero() {
+			filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$gt", Value: checkpoint.LastID}}})
+		}
+		remaining, err := coll.CountDocuments(ctx, filter)
+		if err != nil {
+			return err
+		}
+		checkpoint.Remaining = remaining
+		setGauge("encryption_reencrypt_remaining", remaining)
+		if remaining == 0 {
+			return saveReencryptCheckpoint(ctx, db, checkpoint)
+		}
+
+		cursor, err := coll.Find(ctx, filter, options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(reencryptBatchSize).
+			SetProjection(bson.D{{Key: field.Field, Value: 1}}))
+		if err != nil {
+			return err
+		}
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			id, _ := doc["_id"].(primitive.ObjectID)
+			stored, _ := doc[field.Field].(string)
+			checkpoint.LastID = id
+			checkpoint.Checked++
+			rewritten, err := reencryptValue(stored, field.Prefix)
+			if err != nil {
+				checkpoint.Failed++
+				incMetric("encryption_reencrypt_failed_total", 1)
+				log.Printf("Warning: %s of %s does not decrypt: %v", field.name(), id.Hex(), err)
+				continue
+			}
+			if rewritten == "" {
+				continue
+			}
+			// The value may have changed since it was read; then it is left to the next run
+			res, err := coll.UpdateOne(ctx,
+				bson.D{{Key: "_id", Value: id}, {Key: field.Field, Value: stored}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: field.Field, Value: rewritten}}}})
+			if err != nil {
+				return err
+			}
+			checkpoint.Reencrypted += res.ModifiedCount
+			incMetric("encryption_reencrypted_total", res.ModifiedCount)
+		}
+		checkpoint.Remaining = remaining - int64(len(docs))
+		setGauge("encryption_reencrypt_remaining", checkpoint.Remaining)
+		if err := saveReencryptCheckpoint(ctx, db, checkpoint); err != nil {
+			return err
+		}
+		if ok, err := acquireLease(ctx, reencryptLockName, InstanceID, workerLeaseTTL); err != nil || !ok {
+			return fmt.Errorf("lost the re-encryption lease: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reencryptBatchPause):
+		}
+	}
+}
+
+// reencryptValue returns stored (prefix + ciphertext) rewritten under the current key, or ""
+// when it already is
+func reencryptValue(stored, prefix string) (string, error) {
+	ciphertext, ok := strings.CutPrefix(stored, prefix)
+	if !ok {
+		return "", errors.New("missing " + prefix + " prefix")
+	}
+	plaintext, version, err := decryptVersioned(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if version == encryptionKeyVersion {
+		return "", nil
+	}
+	rewritten, err := EncryptSensitiveData(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return prefix + rewritten, nil
+}
+
+// adminStartReencryption handles POST /admin/encryption/reencrypt. The run continues in the
+// background; poll GET /admin/encryption/reencrypt.
+func adminStartReencryption(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	acquired, err := acquireLease(ctx, reencryptLockName, InstanceID, workerLeaseTTL)
+	if err != nil {
+		log.Printf("error acquiring %s lease: %v", reencryptLockName, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !acquired {
+		http.Error(w, "Re-encryption is already running", http.StatusConflict)
+		return
+	}
+	last, err := loadReencryptCheckpoint(ctx, DB.Database)
+	if err != nil {
+		releaseReencryptLease()
+		log.Printf("error loading re-encryption checkpoint: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	checkpoint := nextReencryptRun(last, clock.Now().UTC())
+	resumed := checkpoint.Checked > 0
+	if err := saveReencryptCheckpoint(ctx, DB.Database, checkpoint); err != nil {
+		releaseReencryptLease()
+		log.Printf("error saving re-encryption checkpoint: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "REENCRYPTION_STARTED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Re-encryption under key version %d started (resumed: %t)", checkpoint.KeyVersion, resumed), "INFO")
+
+	run := *checkpoint
+	go func() {
+		defer releaseReencryptLease()
+		runErr := runReencryption(context.Background(), DB.Database, &run)
+		finished := clock.Now().UTC()
+		run.FinishedAt = &finished
+		run.Status = ReencryptCompleted
+		if runErr != nil {
+			run.Status = ReencryptFailed
+			run.Error = runErr.Error()
+			log.Printf("❌ Re-encryption stopped after %d documents: %v", run.Checked, runErr)
+		} else {
+			log.Printf("✅ Re-encryption completed: %d rewritten, %d undecryptable", run.Reencrypted, run.Failed)
+		}
+		saveCtx, saveCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer saveCancel()
+		if err := saveReencryptCheckpoint(saveCtx, DB.Database, &run); err != nil {
+			log.Printf("error saving re-encryption checkpoint: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "Re-encryption started. Check GET /admin/encryption/reencrypt for progress",
+		"resumed":    resumed,
+		"checkpoint": checkpoint,
+	}); err != nil {
+		log.Printf("error encoding re-encryption response: %v", err)
+	}
+}
+
+// adminReencryptionStatus handles GET /admin/encryption/reencrypt
+func adminReencryptionStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	checkpoint, err := loadReencryptCheckpoint(ctx, DB.Database)
+	if err != nil {
+		log.Printf("error loading re-encryption checkpoint: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if checkpoint == nil {
+		http.Error(w, "Re-encryption has never run", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":             true,
+		"current_key_version": encryptionKeyVersion,
+		"previous_key_loaded": previousEncryptionKey != nil,
+		"checkpoint":          checkpoint,
+	}); err != nil {
+		log.Printf("error encoding re-encryption status: %v", err)
+	}
+}
+
+// releaseReencryptLease frees the re-encryption lease
+func releaseReencryptLease() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLease(ctx, reencryptLockName, InstanceID); err != nil {
+		log.Printf("Warning: failed to release %s lease: %v", reencryptLockName, err)
+	}
+}
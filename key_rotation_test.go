@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// withEncryptionKeys initializes encryption with the given ENCRYPTION_KEY, ENCRYPTION_KEY_PREVIOUS
+// and ENCRYPTION_KEY_VERSION, restoring the keys in use before afterwards
+func withEncryptionKeys(t *testing.T, current, previous, version string) error {
+	t.Helper()
+	savedKey, savedPrevious, savedVersion := encryptionKey, previousEncryptionKey, encryptionKeyVersion
+	t.Cleanup(func() {
+		encryptionKey, previousEncryptionKey, encryptionKeyVersion = savedKey, savedPrevious, savedVersion
+	})
+	t.Setenv("ENCRYPTION_KEY", current)
+	t.Setenv("ENCRYPTION_KEY_PREVIOUS", previous)
+	t.Setenv("ENCRYPTION_KEY_VERSION", version)
+	return InitEncryption()
+}
+
+// newTestKey returns a random base64-encoded 32-byte key
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// legacyCiphertext encrypts plaintext the way EncryptSensitiveData did before keys were
+// versioned: the nonce, then the sealed data
+func legacyCiphertext(t *testing.T, key, plaintext string) string {
+	t.Helper()
+	raw, _ := base64.StdEncoding.DecodeString(key)
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func TestDecryptAcrossKeyVersions(t *testing.T) {
+	oldKey, newKey, otherKey := newTestKey(t), newTestKey(t), newTestKey(t)
+
+	if err := withEncryptionKeys(t, oldKey, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := EncryptSensitiveData("198.51.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(v1); raw[0] != 1 {
+		t.Fatalf("version byte %d, want 1", raw[0])
+	}
+	// Unversioned ciphertexts start with a random nonce byte, sometimes equal to a version
+	var legacy []string
+	for i := 0; i < 300; i++ {
+		legacy = append(legacy, legacyCiphertext(t, oldKey, "legacy-"+strconv.Itoa(i)))
+	}
+
+	// After the rotation both keys decrypt, the new one writes
+	if err := withEncryptionKeys(t, newKey, oldKey, "2"); err != nil {
+		t.Fatal(err)
+	}
+	v2, _ := EncryptSensitiveData("203.0.113.9")
+	if raw, _ := base64.StdEncoding.DecodeString(v2); raw[0] != 2 {
+		t.Fatalf("version byte %d, want 2", raw[0])
+	}
+	for _, tt := range []struct {
+		ciphertext, plaintext string
+		version               byte
+	}{{v1, "198.51.100.7", 1}, {v2, "203.0.113.9", 2}} {
+		if plaintext, version, err := decryptVersioned(tt.ciphertext); err != nil || plaintext != tt.plaintext || version != tt.version {
+			t.Errorf("decryptVersioned = %q, %d, %v; want %q, %d", plaintext, version, err, tt.plaintext, tt.version)
+		}
+	}
+	for i, ciphertext := range legacy {
+		if plaintext, version, err := decryptVersioned(ciphertext); err != nil || plaintext != "legacy-"+strconv.Itoa(i) || version != 0 {
+			t.Fatalf("legacy ciphertext %d = %q, %d, %v", i, plaintext, version, err)
+		}
+	}
+
+	// Re-encryption rewrites everything not under the current key
+	for _, ciphertext := range []string{v1, legacy[0]} {
+		rewritten, err := reencryptValue("enc:"+ciphertext, "enc:")
+		if err != nil || !strings.HasPrefix(rewritten, "enc:") {
+			t.Fatalf("reencryptValue = %q, %v", rewritten, err)
+		}
+		if _, version, err := decryptVersioned(strings.TrimPrefix(rewritten, "enc:")); err != nil || version != 2 {
+			t.Fatalf("rewritten ciphertext: version %d, %v", version, err)
+		}
+	}
+	if rewritten, err := reencryptValue("enc:"+v2, "enc:"); err != nil || rewritten != "" {
+		t.Fatalf("current ciphertext rewritten: %q, %v", rewritten, err)
+	}
+	if _, err := reencryptValue(v1, "enc:"); err == nil {
+		t.Fatal("value without its prefix accepted")
+	}
+
+	// Once the previous key is gone, or under unrelated keys, old data no longer opens
+	if err := withEncryptionKeys(t, newKey, "", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptSensitiveData(v1); err == nil {
+		t.Error("version 1 opened without the previous key")
+	}
+	if _, err := DecryptSensitiveData(v2); err != nil {
+		t.Errorf("version 2: %v", err)
+	}
+	if err := withEncryptionKeys(t, otherKey, newKey, "5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptSensitiveData(v1); err == nil {
+		t.Error("version 1 opened under unrelated keys")
+	}
+}
+
+func TestKeyRotationConfig(t *testing.T) {
+	current, previous := newTestKey(t), newTestKey(t)
+	tests := []struct {
+		name, previous, version string
+		valid                   bool
+	}{
+		{"current only", "", "", true},
+		{"rotated", previous, "2", true},
+		{"high version", "", "255", true},
+		{"previous without a version", previous, "", false},
+		{"previous at version 1", previous, "1", false},
+		{"same key twice", current, "2", false},
+		{"short previous", base64.StdEncoding.EncodeToString([]byte("short")), "2", false},
+		{"version 0", "", "0", false},
+		{"version 256", "", "256", false},
+		{"version x", "", "x", false},
+	}
+	for _, tt := range tests {
+		if err := withEncryptionKeys(t, current, tt.previous, tt.version); (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestNextReencryptRun(t *testing.T) {
+	if err := withEncryptionKeys(t, newTestKey(t), newTestKey(t), "3"); err != nil {
+		t.Fatal(err)
+	}
+	now := clockTestBase
+	stopped := &ReencryptCheckpoint{
+		ID: reencryptCheckpointID, KeyVersion: 3, Status: ReencryptFailed, Field: "urls.created_ip",
+		LastID: primitive.NewObjectID(), Checked: 500, Reencrypted: 420, Error: "lost the lease",
+		StartedAt: now.Add(-time.Hour),
+	}
+
+	// An interrupted run for the current version resumes where it stopped
+	for _, status := range []string{ReencryptFailed, ReencryptRunning} {
+		last := *stopped
+		last.Status = status
+		next := nextReencryptRun(&last, now)
+		if next.LastID != last.LastID || next.Checked != 500 || next.Reencrypted != 420 || next.Status != ReencryptRunning || next.Error != "" || !next.StartedAt.Equal(last.StartedAt) {
+			t.Errorf("resuming a %s run: %+v", status, next)
+		}
+	}
+
+	// A completed run, or one for another version, starts over
+	completed := *stopped
+	completed.Status = ReencryptCompleted
+	older := *stopped
+	older.KeyVersion = 2
+	for _, last := range []*ReencryptCheckpoint{nil, &completed, &older} {
+		next := nextReencryptRun(last, now)
+		if !next.LastID.IsZero() || next.Checked != 0 || next.KeyVersion != 3 || next.Field != encryptedFields[0].name() || !next.StartedAt.Equal(now) {
+			t.Errorf("after %+v: %+v", last, next)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// PER-LINK ANALYTICS SWITCH
+// ============================================================================
+//
+// Links to privacy-sensitive destinations can opt out of click tracking, at creation with
+// "analytics_disabled": true or later with PUT /url/{code}/analytics {"enabled": false}.
+// Their redirects record nothing: no click event is queued, so counters, history, webhooks
+// and budgets never see the click. Listings show "analytics": "off" and a null clicks
+// count, and the link's click listing, click export and share attribution answer with a
+// notice instead of data. Switching tracking off keeps the clicks recorded before unless
+// ?purge=true is passed, which deletes the link's click events and resets its counters.
+// A daily click limit needs clicks counted, so the two cannot be combined.
+
+const (
+	analyticsOn  = "on"
+	analyticsOff = "off"
+)
+
+// analyticsOffNotice explains the empty answers of per-link analytics endpoints
+const analyticsOffNotice = "Analytics are disabled for this link; no clicks are recorded."
+
+// linkAnalyticsState is the "analytics" field of listings
+func linkAnalyticsState(disabled bool) string {
+	if disabled {
+		return analyticsOff
+	}
+	return analyticsOn
+}
+
+// markAnalyticsOff replaces the click count of listed links without analytics by null, so
+// they don't read as never clicked
+func markAnalyticsOff(docs []map[string]interface{}) {
+	for _, doc := range docs {
+		if doc["analytics"] != analyticsOff {
+			continue
+		}
+		if _, ok := doc["clicks"]; ok {
+			doc["clicks"] = nil
+		}
+	}
+}
+
+// writeAnalyticsOff answers a per-link analytics request on a link without analytics
+func writeAnalyticsOff(w http.ResponseWriter, link *URLData) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"short_url": link.ShortURL,
+		"analytics": analyticsOff,
+		"notice":    analyticsOffNotice,
+	}); err != nil {
+		log.Printf("error encoding analytics-off response: %v", err)
+	}
+}
+
+// setLinkAnalytics handles PUT /url/{code}/analytics {"enabled": true|false}; ?purge=true
+// with enabled false also deletes the clicks recorded so far
+func setLinkAnalytics(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if req.Enabled == nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	purge := false
+	if raw := r.URL.Query().Get("purge"); raw != "" {
+		var err error
+		if purge, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "purge must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if purge && *req.Enabled {
+		http.Error(w, "purge=true only applies when disabling analytics", http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(string)
+	code := sanitizeInput(mux.Vars(r)["code"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	if !*req.Enabled {
+		link, err := store.FindLinkByCode(ctx, code)
+		if err == nil && link.UserID == userID && link.DailyClickLimit > 0 {
+			http.Error(w, "Links with a daily click limit need their clicks counted; remove the limit first", http.StatusConflict)
+			return
+		}
+	}
+	link, purged, err := store.SetLinkAnalytics(ctx, userID, code, !*req.Enabled, purge)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error switching analytics of link %s: %v", code, err)
+		writeStoreError(w, err, "short URL", "Database error")
+		return
+	}
+
+	details := fmt.Sprintf("Analytics of %s turned %s", code, linkAnalyticsState(link.AnalyticsDisabled))
+	if purge {
+		details += fmt.Sprintf(", %d click events purged", purged)
+	}
+	logSecurityEvent(r.Context(), "LINK_ANALYTICS_UPDATED", userID, getClientIP(r), r.UserAgent(), details, "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"short_url":     link.ShortURL,
+		"analytics":     linkAnalyticsState(link.AnalyticsDisabled),
+		"purged":        purge,
+		"purged_clicks": purged,
+	}); err != nil {
+		log.Printf("error encoding link analytics response: %v", err)
+	}
+}
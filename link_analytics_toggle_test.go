@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// listedAnalytics returns the "analytics" field and raw clicks count of code in /analytics
+func (s *testServer) listedAnalytics(token, code string) (state string, clicks json.RawMessage) {
+	s.t.Helper()
+	var page struct {
+		URLs []struct {
+			ShortURL  string          `json:"short_url"`
+			Analytics string          `json:"analytics"`
+			Clicks    json.RawMessage `json:"clicks"`
+		} `json:"urls"`
+	}
+	s.do("GET", "/analytics", token, nil, &page)
+	for _, link := range page.URLs {
+		if link.ShortURL == code {
+			return link.Analytics, link.Clicks
+		}
+	}
+	s.t.Fatalf("%s not listed", code)
+	return "", nil
+}
+
+func TestAnalyticsDisabledLink(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	private := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/clinic", "analytics_disabled": true})
+	tracked := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/shop"})
+
+	for i := 0; i < 3; i++ {
+		for _, code := range []string{private, tracked} {
+			if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+				t.Fatalf("/%s: status %d", code, resp.StatusCode)
+			}
+		}
+	}
+	drainClicks(t)
+	privateClicks, privateHistory := srv.stored(private).Clicks, len(srv.clickEvents(private))
+	trackedClicks := srv.stored(tracked).Clicks
+	if privateClicks != 0 || privateHistory != 0 || trackedClicks != 3 {
+		t.Fatalf("clicks recorded: private %d (%d events), tracked %d", privateClicks, privateHistory, trackedClicks)
+	}
+
+	// The listing says analytics are off rather than zero clicks
+	if state, clicks := srv.listedAnalytics(token, private); state != analyticsOff || string(clicks) != "null" {
+		t.Errorf("listed private link: analytics %q, clicks %s", state, clicks)
+	}
+	if state, clicks := srv.listedAnalytics(token, tracked); state != analyticsOn || string(clicks) != "3" {
+		t.Errorf("listed tracked link: analytics %q, clicks %s", state, clicks)
+	}
+
+	// Per-link analytics answer with a notice, the export with an empty 204
+	var notice struct {
+		Analytics string `json:"analytics"`
+		Notice    string `json:"notice"`
+	}
+	if resp := srv.do("GET", "/url/"+private+"/clicks", token, nil, &notice); resp.StatusCode != http.StatusOK || notice.Analytics != analyticsOff || notice.Notice != analyticsOffNotice {
+		t.Errorf("click listing: status %d, %+v", resp.StatusCode, notice)
+	}
+	resp := srv.do("GET", "/url/"+private+"/clicks/export?date="+clock.Now().UTC().Format("2006-01-02"), token, nil, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusNoContent || resp.Header.Get("X-Analytics") != analyticsOff || body != "" {
+		t.Errorf("click export: status %d, X-Analytics %q, body %q", resp.StatusCode, resp.Header.Get("X-Analytics"), body)
+	}
+
+	// A click limit needs the clicks counted
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/x", "analytics_disabled": true, "daily_click_limit": 10}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("analytics_disabled with daily_click_limit: status %d", resp.StatusCode)
+	}
+}
+
+func TestLinkAnalyticsSwitch(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/report"})
+	click := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			srv.do("GET", "/"+code, "", nil, nil)
+		}
+		drainClicks(t)
+	}
+	recorded := func() (int, int) {
+		return srv.stored(code).Clicks, len(srv.clickEvents(code))
+	}
+	type switched struct {
+		Analytics    string `json:"analytics"`
+		Purged       bool   `json:"purged"`
+		PurgedClicks int64  `json:"purged_clicks"`
+	}
+	click(2)
+
+	// Turning tracking off keeps what was recorded and records nothing more
+	var answer switched
+	if resp := srv.do("PUT", "/url/"+code+"/analytics", token, map[string]bool{"enabled": false}, &answer); resp.StatusCode != http.StatusOK || answer.Analytics != analyticsOff || answer.Purged {
+		t.Fatalf("switch off: status %d, %+v", resp.StatusCode, answer)
+	}
+	click(3)
+	if clicks, events := recorded(); clicks != 2 || events != 2 {
+		t.Fatalf("after switching off: %d clicks, %d events", clicks, events)
+	}
+
+	// Back on, clicks count again
+	if resp := srv.do("PUT", "/url/"+code+"/analytics", token, map[string]bool{"enabled": true}, &answer); resp.StatusCode != http.StatusOK || answer.Analytics != analyticsOn {
+		t.Fatalf("switch on: status %d, %+v", resp.StatusCode, answer)
+	}
+	click(1)
+	if clicks, events := recorded(); clicks != 3 || events != 3 {
+		t.Fatalf("after switching on: %d clicks, %d events", clicks, events)
+	}
+
+	// purge=true deletes the click events and resets the counters
+	answer = switched{}
+	if resp := srv.do("PUT", "/url/"+code+"/analytics?purge=true", token, map[string]bool{"enabled": false}, &answer); resp.StatusCode != http.StatusOK || !answer.Purged || answer.PurgedClicks != 3 {
+		t.Fatalf("purge: status %d, %+v", resp.StatusCode, answer)
+	}
+	if clicks, events := recorded(); clicks != 0 || events != 0 {
+		t.Fatalf("after the purge: %d clicks, %d events", clicks, events)
+	}
+	if lastClicked := srv.stored(code).LastClicked; lastClicked != nil {
+		t.Errorf("last_clicked kept after the purge: %v", lastClicked)
+	}
+
+	tests := []struct {
+		name, token, path string
+		body              interface{}
+		status            int
+	}{
+		{"purge while enabling", token, "/url/" + code + "/analytics?purge=true", map[string]bool{"enabled": true}, http.StatusBadRequest},
+		{"bad purge", token, "/url/" + code + "/analytics?purge=maybe", map[string]bool{"enabled": false}, http.StatusBadRequest},
+		{"no enabled", token, "/url/" + code + "/analytics", map[string]string{}, http.StatusBadRequest},
+		{"foreign link", other, "/url/" + code + "/analytics?purge=true", map[string]bool{"enabled": false}, http.StatusNotFound},
+		{"unknown link", token, "/url/nosuchcode/analytics", map[string]bool{"enabled": false}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp := srv.do("PUT", tt.path, tt.token, tt.body, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+
+	// A link with a click limit cannot stop counting
+	limited := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/limited", "daily_click_limit": 5})
+	if resp := srv.do("PUT", "/url/"+limited+"/analytics", token, map[string]bool{"enabled": false}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("limited link: status %d", resp.StatusCode)
+	}
+}
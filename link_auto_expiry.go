@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// AUTO-EXPIRY OF UNCLICKED LINKS
+// ============================================================================
+//
+// An account can set auto_expire_unclicked_after (e.g. "180d", see parseLinkDuration) with
+// PUT /link-policy. On each run the cleanup worker finds the account's active links that
+// are older than that and were never clicked, gives them an expiry unclickedExpiryGrace
+// away (links already expiring sooner are left alone) and mails the owner the list, so
+// links worth keeping can be rescued with POST /url/{code}/extend. Each link is only picked
+// once: auto_expiry_notified_at marks it, so a rescued link is not scheduled again. Links
+// on custom domains and pinned links (see link_pins.go) are never touched. MongoDB only, like the cleanup worker.
+
+const (
+	unclickedExpiryGrace = 7 * 24 * time.Hour
+	// minUnclickedExpiryAfter keeps the policy from sweeping links the day after creation
+	minUnclickedExpiryAfter = 30 * 24 * time.Hour
+	// maxUnclickedExpiryPerUser bounds the links one run schedules for one account
+	maxUnclickedExpiryPerUser = 1000
+)
+
+// parseUnclickedExpiryPolicy validates an auto_expire_unclicked_after value
+func parseUnclickedExpiryPolicy(s string) (LinkDuration, error) {
+	after, err := parseLinkDuration(s)
+	if err != nil {
+		return LinkDuration{}, err
+	}
+	now := time.Now()
+	if after.AddTo(now).Sub(now) < minUnclickedExpiryAfter {
+		return LinkDuration{}, fmt.Errorf("auto_expire_unclicked_after must be at least 30d")
+	}
+	return after, nil
+}
+
+// servingDomainValues are the domain values of links that are not on a custom domain
+func servingDomainValues() bson.A {
+	values := bson.A{"", nil, baseURL(), baseURL() + "/"}
+	for _, d := range DefaultDomains {
+		d = strings.TrimRight(d, "/")
+		values = append(values, d, d+"/")
+	}
+	return values
+}
+
+// unclickedExpiryFilter matches userID's links that the policy schedules: active, never
+// clicked, created before cutoff, not pinned, not yet picked, on a serving domain and not
+// expiring before graceEnd anyway
+func unclickedExpiryFilter(userID string, cutoff, graceEnd time.Time) bson.D {
+	return bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+		{Key: "clicks", Value: 0},
+		{Key: "created_at", Value: bson.D{{Key: "$lt", Value: cutoff}}},
+		{Key: "pinned", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: "auto_expiry_notified_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "domain", Value: bson.D{{Key: "$in", Value: servingDomainValues()}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expires_at", Value: nil}},
+			bson.D{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: graceEnd}}}},
+		}},
+	}
+}
+
+// unclickedExpiryMail is the notification listing the links scheduled to expire at graceEnd
+func unclickedExpiryMail(user *User, links []URLData, graceEnd time.Time, base string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hello %s,\n\n", user.Username)
+	fmt.Fprintf(&b, "These links are older than %s and were never clicked, so they will expire on %s:\n\n",
+		user.AutoExpireUnclickedAfter, graceEnd.UTC().Format("2006-01-02 15:04 MST"))
+	for _, link := range links {
+		fmt.Fprintf(&b, "  %s%s -> %s\n", base, shortCodePath(link.ShortURL), link.LongURL)
+	}
+	fmt.Fprintf(&b, "\nTo keep one, extend it with POST %s/url/<code>/extend or pin it with "+
+		"POST %s/url/<code>/pin.\n", base, base)
+	return b.String()
+}
+
+// ScheduleUnclickedExpiry applies the accounts' auto_expire_unclicked_after policies and
+// returns the number of links scheduled
+func ScheduleUnclickedExpiry() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	cursor, err := DB.Database.Collection("users").Find(ctx, bson.D{
+		{Key: "auto_expire_unclicked_after", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "is_active", Value: true},
+	}, options.Find().SetProjection(bson.D{
+		{Key: "username", Value: 1},
+		{Key: "email", Value: 1},
+		{Key: "auto_expire_unclicked_after", Value: 1},
+	}))
+	if err != nil {
+		return 0, err
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		return 0, err
+	}
+
+	var scheduled int64
+	for i := range users {
+		n, err := scheduleUserUnclickedExpiry(ctx, &users[i], clock.Now())
+		if err != nil {
+			return scheduled, err
+		}
+		scheduled += n
+	}
+	if scheduled > 0 {
+		log.Printf("Scheduled %d never-clicked links to expire", scheduled)
+	}
+	return scheduled, nil
+}
+
+// scheduleUserUnclickedExpiry schedules and announces the expiry of one account's links
+func scheduleUserUnclickedExpiry(ctx context.Context, user *User, now time.Time) (int64, error) {
+	after, err := parseLinkDuration(user.AutoExpireUnclickedAfter)
+	if err != nil {
+		log.Printf("Warning: ignoring auto_expire_unclicked_after of user %s: %v", user.ID.Hex(), err)
+		return 0, nil
+	}
+	userID := user.ID.Hex()
+	cutoff := now.AddDate(-after.Years, -after.Months, -after.Days)
+	graceEnd := now.Add(unclickedExpiryGrace)
+	filter := unclickedExpiryFilter(userID, cutoff, graceEnd)
+
+	cursor, err := DB.Collection.Find(ctx, filter, options.Find().
+		SetProjection(bson.D{{Key: "short_url", Value: 1}, {Key: "long_url", Value: 1}}).
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetLimit(maxUnclickedExpiryPerUser))
+	if err != nil {
+		return 0, err
+	}
+	var links []URLData
+	if err := cursor.All(ctx, &links); err != nil {
+		return 0, err
+	}
+	if len(links) == 0 {
+		return 0, nil
+	}
+	ids := make(bson.A, len(links))
+	for i, link := range links {
+		ids[i] = link.ID
+	}
+
+	// The filter is applied again so links clicked or pinned meanwhile are skipped
+	res, err := DB.Collection.UpdateMany(ctx, append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "expires_at", Value: graceEnd},
+			{Key: "auto_expiry_notified_at", Value: now},
+			{Key: "updated_at", Value: now},
+		}}})
+	if err != nil {
+		return 0, err
+	}
+	if res.ModifiedCount == 0 {
+		return 0, nil
+	}
+	if res.ModifiedCount < int64(len(links)) {
+		// Some changed in between; list only what was scheduled
+		cursor, err := DB.Collection.Find(ctx, bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}},
+			{Key: "auto_expiry_notified_at", Value: now},
+		}, options.Find().SetProjection(bson.D{{Key: "short_url", Value: 1}, {Key: "long_url", Value: 1}}))
+		if err != nil {
+			return res.ModifiedCount, err
+		}
+		links = nil
+		if err := cursor.All(ctx, &links); err != nil {
+			return res.ModifiedCount, err
+		}
+	}
+
+	body := unclickedExpiryMail(user, links, graceEnd, baseURL())
+	if err := sendMail(user.Email, "Unused links will expire in 7 days", body); err != nil {
+		log.Printf("error sending unclicked-expiry mail to user %s: %v", userID, err)
+	}
+	logSecurityEvent(ctx, "UNCLICKED_LINKS_SCHEDULED", userID, "", "",
+		fmt.Sprintf("%d never-clicked links set to expire at %s", len(links), graceEnd.Format(time.RFC3339)), "INFO")
+	return res.ModifiedCount, nil
+}
+
+// getLinkPolicy handles GET /link-policy
+func getLinkPolicy(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+	writeLinkPolicy(w, user.AutoExpireUnclickedAfter)
+}
+
+// putLinkPolicy handles PUT /link-policy with {"auto_expire_unclicked_after": "180d"}; an
+// empty value turns the policy off
+func putLinkPolicy(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		AutoExpireUnclickedAfter string `json:"auto_expire_unclicked_after"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	policy := strings.ToLower(strings.TrimSpace(req.AutoExpireUnclickedAfter))
+	if policy != "" {
+		if _, err := parseUnclickedExpiryPolicy(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := saveLinkPolicy(ctx, id, policy); err != nil {
+		log.Printf("error saving link policy for user %s: %v", userID, err)
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+	logSecurityEvent(r.Context(), "LINK_POLICY_UPDATED", userID, getClientIP(r), r.UserAgent(),
+		"auto_expire_unclicked_after set to "+fmt.Sprintf("%q", policy), "INFO")
+	writeLinkPolicy(w, policy)
+}
+
+// saveLinkPolicy stores a validated policy, "" turning it off; ErrNotFound without the user
+func saveLinkPolicy(ctx context.Context, id primitive.ObjectID, policy string) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "auto_expire_unclicked_after", Value: ""}}}}
+	if policy != "" {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "auto_expire_unclicked_after", Value: policy}}}}
+	}
+	res, err := DB.Database.Collection("users").UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// writeLinkPolicy writes an account's link policy
+func writeLinkPolicy(w http.ResponseWriter, autoExpireUnclickedAfter string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":                     true,
+		"auto_expire_unclicked_after": autoExpireUnclickedAfter,
+		"grace_period_days":           int(unclickedExpiryGrace.Hours() / 24),
+	}); err != nil {
+		log.Printf("error encoding link policy response: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseUnclickedExpiryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		valid bool
+	}{
+		{"180d", true},
+		{"30d", true},
+		{"6m", true},
+		{"1y", true},
+		{"26w", true},
+		{"29d", false},
+		{"4w", false},
+		{"0d", false},
+		{"-180d", false},
+		{"180", false},
+		{"forever", false},
+	} {
+		if _, err := parseUnclickedExpiryPolicy(tt.in); (err == nil) != tt.valid {
+			t.Errorf("parseUnclickedExpiryPolicy(%q) = %v", tt.in, err)
+		}
+	}
+}
+
+func TestUnclickedExpiryFilter(t *testing.T) {
+	newTestServer(t)
+	cutoff, graceEnd := clockTestBase.AddDate(0, 0, -180), clockTestBase.Add(unclickedExpiryGrace)
+	filter := unclickedExpiryFilter("u1", cutoff, graceEnd).Map()
+
+	if filter["pinned"].(bson.D).Map()["$ne"] != true {
+		t.Errorf("pinned links not exempt: %v", filter["pinned"])
+	}
+	if filter["clicks"] != 0 || filter["is_active"] != true || filter["user_id"] != "u1" {
+		t.Errorf("filter %v", filter)
+	}
+	if filter["created_at"].(bson.D).Map()["$lt"] != cutoff {
+		t.Errorf("created_at %v", filter["created_at"])
+	}
+	// Only links on the serving domains qualify, never custom domains
+	domains := filter["domain"].(bson.D).Map()["$in"].(bson.A)
+	for _, want := range []interface{}{"", nil, "https://go.example.com", "http://rapidlink.com/"} {
+		found := false
+		for _, d := range domains {
+			found = found || d == want
+		}
+		if !found {
+			t.Errorf("serving domain %v missing from %v", want, domains)
+		}
+	}
+	for _, d := range domains {
+		if s, _ := d.(string); strings.Contains(s, "links.example.org") {
+			t.Errorf("custom domain %v matched", d)
+		}
+	}
+	// Links already expiring within the grace period are left alone
+	expiry := filter["$or"].(bson.A)
+	if len(expiry) != 2 || expiry[1].(bson.D).Map()["expires_at"].(bson.D).Map()["$gt"] != graceEnd {
+		t.Errorf("expiry condition %v", expiry)
+	}
+}
+
+func TestUnclickedExpiryMail(t *testing.T) {
+	user := &User{Username: "carol", AutoExpireUnclickedAfter: "180d"}
+	links := []URLData{
+		{ShortURL: "spring", LongURL: "https://example.com/spring"},
+		{ShortURL: "summer", LongURL: "https://example.com/summer"},
+	}
+	body := unclickedExpiryMail(user, links, time.Date(2031, 3, 8, 12, 0, 0, 0, time.UTC), "https://go.example.com")
+	for _, want := range []string{
+		"Hello carol,",
+		"older than 180d and were never clicked, so they will expire on 2031-03-08 12:00 UTC",
+		"  https://go.example.com/spring -> https://example.com/spring\n",
+		"  https://go.example.com/summer -> https://example.com/summer\n",
+		"POST https://go.example.com/url/<code>/extend",
+		"POST https://go.example.com/url/<code>/pin",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("mail without %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestLinkPolicyNeedsMongo(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	if resp := srv.do("PUT", "/link-policy", token, map[string]string{"auto_expire_unclicked_after": "180d"}, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("without MongoDB: status %d", resp.StatusCode)
+	}
+}
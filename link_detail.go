@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// LINK DETAIL
+// ============================================================================
+//
+// GET /url/{code} returns one of the caller's links in full, in any state, so a dashboard's
+// link page does not have to page through /analytics. Clicks are listed separately by
+// GET /url/{code}/clicks, so click_history is always empty here. updated_at doubles as
+// Last-Modified, to be sent back as If-Unmodified-Since on edits.
+
+// getURL handles GET /url/{code}
+func getURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := linkStore(r).FindLinkByCode(ctx, code)
+	if err == nil && link.DeactivatedReason == DeactivatedDraft {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err, "Short URL", "Database error")
+		return
+	}
+	if link.UserID != userID {
+		logSecurityEvent(r.Context(), "UNAUTHORIZED_LINK_ACCESS", userID, getClientIP(r), r.UserAgent(),
+			"Attempt to read short URL "+code+" of another user", "WARN")
+		writeStoreError(w, ErrUnauthorizedOwner, "short URL", "Database error")
+		return
+	}
+
+	link.ClickHistory = []ClickHistory{}
+	link.FullShortURL = fullShortURL(r, link.Domain, link.ShortURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if link.UpdatedAt != nil {
+		w.Header().Set("Last-Modified", link.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(link); err != nil {
+		log.Printf("error encoding link detail response: %v", err)
+	}
+}
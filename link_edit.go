@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// LINK EDITS
+// ============================================================================
+//
+// PATCH /url/{code} changes a link in place, so its code and clicks stay. The body may set
+// any of long-url, tags, expires, is-active, public_note and internal (see link_notes.go),
+// plus pinned (see link_pins.go). Fields left out are not changed. A new destination passes
+// the same checks as on creation. Tags replace the old ones and are not run through the
+// auto-tag rules. A future expiry on a link that expired switches it back on, as /extend
+// does. With is-active false the owner switches the link off, and with true switches it back
+// on, subject to the link quota. Deleted, disabled and draft links cannot be edited. The
+// answer is the updated link.
+
+// DeactivatedByOwner marks a link switched off by its owner with PATCH /url/{code}
+const DeactivatedByOwner = "deactivated"
+
+// LinkEdit holds the fields of a link to change; nil fields are kept
+type LinkEdit struct {
+	LongURL   *string
+	Tags      *[]string
+	ExpiresAt *time.Time
+	// Active switches the link on or off; switching off records DeactivatedByOwner
+	Active *bool
+	// PublicNote replaces the note shown to visitors; "" removes it
+	PublicNote *string
+	Internal   *bool
+	// Pinned sets the pinned flag; pinning fails with ErrLimitReached when the owner already
+	// has PinLimit other pinned active links
+	Pinned   *bool
+	PinLimit int
+}
+
+// PatchLinkRequest is the body of PATCH /url/{code}
+type PatchLinkRequest struct {
+	LongURL  *string   `json:"long-url"`
+	Tags     *[]string `json:"tags"`
+	Expires  *string   `json:"expires"`
+	IsActive *bool     `json:"is-active"`
+	Pinned   *bool     `json:"pinned"`
+	// PublicNote and Internal, see link_notes.go
+	PublicNote *string `json:"public_note"`
+	Internal   *bool   `json:"internal"`
+	// ExpectedVersion is the link's updated_at as last seen by the client
+	ExpectedVersion string `json:"expected_version,omitempty"`
+}
+
+// patchURL handles PATCH /url/{code}. A body with only pinned keeps the short answer of the
+// pin endpoints.
+func patchURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+	code := mux.Vars(r)["code"]
+
+	var req PatchLinkRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload (long-url, tags, expires, is-active, public_note, internal and pinned can be changed)", http.StatusBadRequest)
+		return
+	}
+	if req.LongURL == nil && req.Tags == nil && req.Expires == nil && req.IsActive == nil && req.PublicNote == nil && req.Internal == nil {
+		if req.Pinned == nil {
+			http.Error(w, "nothing to change", http.StatusBadRequest)
+			return
+		}
+		setLinkPinned(w, r, code, *req.Pinned)
+		return
+	}
+	precondition, err := parseEditPrecondition(r, req.ExpectedVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	urls := linkStore(r)
+	link, err := urls.FindLinkByCode(ctx, code)
+	if err == nil && link.DeactivatedReason == DeactivatedDraft {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err, "Short URL", "Database error")
+		return
+	}
+	if link.UserID != userID {
+		logSecurityEvent(r.Context(), "UNAUTHORIZED_LINK_EDIT", userID, clientIP, r.UserAgent(),
+			"Attempt to edit short URL "+code+" of another user", "WARN")
+		writeStoreError(w, ErrUnauthorizedOwner, "short URL", "Database error")
+		return
+	}
+	switch {
+	case !link.IsActive && link.DeactivatedReason == DeactivatedDeleted:
+		http.Error(w, "Short URL has been deleted and cannot be edited", http.StatusGone)
+		return
+	case !link.IsActive && link.DeactivatedReason == DeactivatedDisabled:
+		http.Error(w, "Short URL has been disabled by an administrator and cannot be edited", http.StatusForbidden)
+		return
+	}
+	if !precondition.Holds(link.UpdatedAt) {
+		writePreconditionFailed(w, r, link)
+		return
+	}
+
+	now := clock.Now()
+	var edit LinkEdit
+	var warnings []Warning
+	if req.LongURL != nil {
+		longURL := sanitizeInput(*req.LongURL)
+		if !validateURL(longURL) {
+			logSecurityEvent(r.Context(), "INVALID_URL_FORMAT", userID, clientIP, r.UserAgent(),
+				"Invalid URL format: "+redactURL(longURL), "WARN")
+			http.Error(w, "Invalid URL format. Must be a valid HTTP or HTTPS URL (no localhost/internal IPs)", http.StatusBadRequest)
+			return
+		}
+		switch requestConfig(r).DestinationListed(longURL) {
+		case "block":
+			logSecurityEvent(r.Context(), "DESTINATION_BLOCKED", userID, clientIP, r.UserAgent(),
+				"Blocked destination: "+redactURL(longURL), "WARN")
+			writeJSONError(w, http.StatusUnprocessableEntity, ErrCodeDestinationBlocked,
+				"Links to this destination are not allowed", nil)
+			return
+		case "warn":
+			warnings = append(warnings, destinationWarnedWarning())
+		}
+		if longURL, err = checkSelfReference(ctx, urls, longURL, code, false); err != nil {
+			logSecurityEvent(r.Context(), "SELF_REFERENCE_BLOCKED", userID, clientIP, r.UserAgent(),
+				err.Error()+": "+redactURL(*req.LongURL), "WARN")
+			http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if longURL != link.LongURL {
+			edit.LongURL = &longURL
+		}
+	}
+	if req.Tags != nil {
+		tags, tagWarnings, tagErr := normalizeTags(*req.Tags)
+		if tagErr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":      false,
+				"message":      tagErr.Reason,
+				"invalid_tags": tagErr.InvalidTags,
+			})
+			return
+		}
+		if tags == nil {
+			tags = []string{}
+		}
+		warnings = append(warnings, tagWarnings...)
+		edit.Tags = &tags
+	}
+	if req.Expires != nil {
+		expiry, err := time.Parse(time.RFC3339, sanitizeInput(*req.Expires))
+		if err != nil {
+			http.Error(w, "invalid expires format, use RFC3339 (e.g., 2025-12-31T23:59:59Z)", http.StatusBadRequest)
+			return
+		}
+		if !expiry.After(now) {
+			http.Error(w, "expires must be in the future; set is-active to false to switch the link off", http.StatusBadRequest)
+			return
+		}
+		if clamped, warning := clampLinkExpiry(expiry, now); warning != nil {
+			expiry = clamped
+			warnings = append(warnings, *warning)
+		}
+		edit.ExpiresAt = &expiry
+		if !link.IsActive && link.DeactivatedReason == DeactivatedExpired && req.IsActive == nil {
+			active := true
+			edit.Active = &active
+		}
+	}
+	if req.IsActive != nil {
+		active := *req.IsActive
+		edit.Active = &active
+	}
+	if req.PublicNote != nil {
+		note, err := normalizePublicNote(*req.PublicNote)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if note != link.PublicNote {
+			edit.PublicNote = &note
+		}
+	}
+	if req.Internal != nil && *req.Internal != link.Internal {
+		internal := *req.Internal
+		edit.Internal = &internal
+	}
+
+	// Switching a link on counts against the quota and needs an expiry still ahead
+	if edit.Active != nil && *edit.Active && !link.IsActive {
+		if edit.ExpiresAt == nil && isExpiredAt(link.ExpiresAt, now) {
+			http.Error(w, "Short URL has expired; set a future expires to switch it back on", http.StatusBadRequest)
+			return
+		}
+		activeCount, allowed, err := checkURLQuota(ctx, urls, userID)
+		if err != nil {
+			log.Printf("error checking URL quota: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		} else if !allowed {
+			writeJSONError(w, http.StatusForbidden, ErrCodeQuotaExceeded, "URL quota reached. Delete unused links or contact support.",
+				map[string]interface{}{"count": activeCount, "quota": urlQuotaFor(userID)})
+			return
+		}
+	} else if edit.Active != nil && *edit.Active == link.IsActive {
+		edit.Active = nil
+	}
+	// Only active links can be pinned; the pin goes in the same update so a refused pin
+	// leaves the other fields unchanged too
+	active := link.IsActive
+	if edit.Active != nil {
+		active = *edit.Active
+	}
+	if req.Pinned != nil && *req.Pinned != link.Pinned && active {
+		pinned := *req.Pinned
+		edit.Pinned = &pinned
+		edit.PinLimit = maxPinnedLinks
+	}
+
+	if edit.LongURL != nil || edit.Tags != nil || edit.ExpiresAt != nil || edit.Active != nil || edit.PublicNote != nil || edit.Internal != nil || edit.Pinned != nil {
+		updated, err := urls.EditLink(ctx, link, edit)
+		if errors.Is(err, ErrDuplicate) {
+			http.Error(w, "You already have an active short URL for this destination", http.StatusConflict)
+			return
+		} else if errors.Is(err, ErrLimitReached) {
+			writeJSONError(w, http.StatusConflict, ErrCodePinLimitReached,
+				fmt.Sprintf("At most %d links can be pinned; unpin one first", maxPinnedLinks),
+				map[string]interface{}{"max_pinned": maxPinnedLinks})
+			return
+		} else if err != nil {
+			log.Printf("error editing link %s: %v", code, err)
+			writeStoreError(w, err, "Short URL", "Failed to update short URL")
+			return
+		}
+		if !updated {
+			if current, err := urls.FindLinkByCode(ctx, code); err == nil && precondition != nil && !precondition.Holds(current.UpdatedAt) {
+				writePreconditionFailed(w, r, current)
+				return
+			}
+			http.Error(w, "Short URL changed while updating; please retry", http.StatusConflict)
+			return
+		}
+		forgetResolvedLink(code)
+	}
+
+	current, err := urls.FindLinkByCode(ctx, code)
+	if err != nil {
+		log.Printf("error loading edited link %s: %v", code, err)
+		writeStoreError(w, err, "Short URL", "Database error")
+		return
+	}
+	if edit.LongURL != nil {
+		favicons.Enqueue(urls, current)
+		redirectProbes.Enqueue(urls, current)
+	}
+	current.FullShortURL = fullShortURL(r, current.Domain, current.ShortURL)
+	current.Warnings = warnings
+	current.Cache = cacheStalenessNote(current)
+
+	logSecurityEvent(r.Context(), "SHORT_URL_UPDATED", userID, clientIP, r.UserAgent(),
+		fmt.Sprintf("Short URL %s edited: %s", code, describeLinkEdit(edit)), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(current); err != nil {
+		log.Printf("error encoding link update response: %v", err)
+	}
+}
+
+// describeLinkEdit lists the changed fields for the security log, without the destination
+func describeLinkEdit(edit LinkEdit) string {
+	var fields []string
+	if edit.LongURL != nil {
+		fields = append(fields, "long-url")
+	}
+	if edit.Tags != nil {
+		fields = append(fields, "tags")
+	}
+	if edit.ExpiresAt != nil {
+		fields = append(fields, "expires="+edit.ExpiresAt.Format(time.RFC3339))
+	}
+	if edit.Active != nil {
+		fields = append(fields, fmt.Sprintf("is-active=%t", *edit.Active))
+	}
+	if edit.PublicNote != nil {
+		fields = append(fields, "public_note")
+	}
+	if edit.Internal != nil {
+		fields = append(fields, fmt.Sprintf("internal=%t", *edit.Internal))
+	}
+	if edit.Pinned != nil {
+		fields = append(fields, fmt.Sprintf("pinned=%t", *edit.Pinned))
+	}
+	if len(fields) == 0 {
+		return "no changes"
+	}
+	return strings.Join(fields, ", ")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEditLinkPinLimitChangesNothing(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	for _, code := range []string{"pinned1", "pinned2", "edited"} {
+		link := &URLData{ShortURL: code, LongURL: "https://example.com/" + code, UserID: "user-1", IsActive: true, Pinned: code != "edited"}
+		if err := store.InsertLink(ctx, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link, err := store.FindLinkByCode(ctx, "edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longURL, pinned := "https://example.com/changed", true
+	edit := LinkEdit{LongURL: &longURL, Pinned: &pinned, PinLimit: 2}
+	if _, err := store.EditLink(ctx, link, edit); !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("EditLink past the pin limit = %v, want ErrLimitReached", err)
+	}
+	after, _ := store.FindLinkByCode(ctx, "edited")
+	if after.LongURL != link.LongURL || after.Pinned || !sameVersion(after.UpdatedAt, link.UpdatedAt) {
+		t.Fatalf("refused edit changed the link: %+v", after)
+	}
+
+	edit.PinLimit = 3
+	if updated, err := store.EditLink(ctx, link, edit); err != nil || !updated {
+		t.Fatalf("EditLink within the pin limit = %v, %v", updated, err)
+	}
+	after, _ = store.FindLinkByCode(ctx, "edited")
+	if after.LongURL != longURL || !after.Pinned {
+		t.Fatalf("edit not applied: %+v", after)
+	}
+}
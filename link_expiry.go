@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ============================================================================
+// EXPIRED LINK BEHAVIOUR
+// ============================================================================
+//
+// on_expire chooses what a link's short URL does once expires_at has passed:
+//   - "gone" (default): answers 410 with the localized link_expired page
+//   - "fallback": redirects (302, never cached) to the link's expire_fallback_url
+//   - "archive": keeps redirecting, counting clicks, for EXPIRED_ARCHIVE_RETENTION (default
+//     90d) after expiry, then behaves like "gone"
+// Whatever the mode, the cleanup worker deactivates expired links, which drops them from
+// listings; the mode only decides how the short URL keeps answering. Nothing is deleted, and
+// extending the link's expiry brings it back as usual.
+
+const (
+	OnExpireGone     = "gone"
+	OnExpireFallback = "fallback"
+	OnExpireArchive  = "archive"
+)
+
+const defaultArchiveRetention = "90d"
+
+// validateOnExpire checks the on_expire mode and fallback URL of a shorten request; the mode
+// is returned normalized, empty for the default
+func validateOnExpire(onExpire, fallbackURL string) (string, error) {
+	switch onExpire {
+	case "", OnExpireGone:
+		onExpire = ""
+	case OnExpireArchive:
+	case OnExpireFallback:
+		if fallbackURL == "" {
+			return "", fmt.Errorf("on_expire \"fallback\" requires expire_fallback_url")
+		}
+	default:
+		return "", fmt.Errorf("on_expire must be one of gone, fallback or archive")
+	}
+	if fallbackURL != "" && !validateURL(fallbackURL) {
+		return "", fmt.Errorf("Invalid expire_fallback_url. Must be a valid HTTP or HTTPS URL")
+	}
+	return onExpire, nil
+}
+
+// linkOnExpire returns the link's on_expire mode, "gone" when none was chosen
+func linkOnExpire(link *URLData) string {
+	if link.OnExpire == "" {
+		return OnExpireGone
+	}
+	return link.OnExpire
+}
+
+// archiveRetentionEnd returns when an archived link that expired at expiresAt stops resolving
+func archiveRetentionEnd(expiresAt time.Time) time.Time {
+	retention, err := parseLinkDuration(os.Getenv("EXPIRED_ARCHIVE_RETENTION"))
+	if err != nil {
+		retention, _ = parseLinkDuration(defaultArchiveRetention)
+	}
+	return retention.AddTo(expiresAt)
+}
+
+// findStoppedLink returns the link with code for a redirect that found no live link, and
+// whether it is there only because it expired; nil for unknown and draft codes
+func findStoppedLink(ctx context.Context, store URLStore, code string, now time.Time) (*URLData, bool) {
+	link, err := store.FindLinkByCode(ctx, code)
+	if err != nil || link.DeactivatedReason == DeactivatedDraft {
+		return nil, false
+	}
+	if link.ExpiresAt == nil || link.ExpiresAt.After(now) {
+		return link, false
+	}
+	if !link.IsActive && link.DeactivatedReason != DeactivatedExpired {
+		return link, false
+	}
+	return link, true
+}
+
+// expiredLinkResolves reports whether an expired link still redirects to its destination
+func expiredLinkResolves(link *URLData, now time.Time) bool {
+	return link.OnExpire == OnExpireArchive && now.Before(archiveRetentionEnd(*link.ExpiresAt))
+}
+
+// writeExpiredLink answers a request for an expired link per its on_expire mode
+func writeExpiredLink(w http.ResponseWriter, r *http.Request, link *URLData) {
+	if suspendedOwners.Has(link.UserID) {
+		writeLinkUnavailable(w, r)
+		return
+	}
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	if link.OnExpire == OnExpireFallback && validateURL(link.ExpireFallbackURL) && !isSelfRedirect(r, link.ExpireFallbackURL) {
+		log.Printf("Expired short URL %s sent to its fallback", link.ShortURL)
+		http.Redirect(w, r, link.ExpireFallbackURL, http.StatusFound)
+		return
+	}
+	if wantsHTML(r) {
+		writeLocalizedPage(w, r, http.StatusGone, "link_expired", "")
+		return
+	}
+	http.Error(w, "This link has expired", http.StatusGone)
+}
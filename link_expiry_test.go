@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestValidateOnExpire(t *testing.T) {
+	tests := []struct {
+		mode, fallback string
+		want           string
+		ok             bool
+	}{
+		{"", "", "", true},
+		{"gone", "", "", true},
+		{"archive", "", "archive", true},
+		{"fallback", "https://example.com/landing", "fallback", true},
+		{"gone", "https://example.com/landing", "", true},
+		{"fallback", "", "", false},
+		{"fallback", "javascript:alert(1)", "", false},
+		{"archive", "not a url", "", false},
+		{"delete", "", "", false},
+		{"GONE", "", "", false},
+	}
+	for _, tt := range tests {
+		got, err := validateOnExpire(tt.mode, tt.fallback)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("validateOnExpire(%q, %q) = %q, %v", tt.mode, tt.fallback, got, err)
+		}
+	}
+}
+
+func TestOnExpireModes(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	expires := clockTestBase.Add(24 * time.Hour).Format(time.RFC3339)
+	create := func(mode, fallback string) string {
+		return srv.shorten(token, map[string]interface{}{
+			"long-url": "https://example.com/campaign-" + mode, "expires": expires,
+			"on_expire": mode, "expire_fallback_url": fallback,
+		})
+	}
+	gone := create("", "")
+	fallback := create("fallback", "https://example.com/landing")
+	archive := create("archive", "")
+
+	redirect := func(code string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		return srv.send(req, nil)
+	}
+	for _, code := range []string{gone, fallback, archive} {
+		if resp := redirect(code); resp.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("%s before expiry: status %d", code, resp.StatusCode)
+		}
+	}
+
+	// The listing shows every link's mode
+	var listing struct {
+		URLs []struct {
+			ShortURL string `json:"short_url"`
+			OnExpire string `json:"on_expire"`
+		} `json:"urls"`
+	}
+	srv.do("GET", "/analytics", token, nil, &listing)
+	modes := map[string]string{}
+	for _, link := range listing.URLs {
+		modes[link.ShortURL] = link.OnExpire
+	}
+	if modes[gone] != OnExpireGone || modes[fallback] != OnExpireFallback || modes[archive] != OnExpireArchive {
+		t.Fatalf("listed modes %v", modes)
+	}
+
+	// After expiry, both before and after the cleanup worker deactivated the links
+	SetClock(FixedClock(clockTestBase.Add(48 * time.Hour)))
+	for _, cleaned := range []bool{false, true} {
+		if cleaned {
+			if _, err := srv.links.DeactivateExpired(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if resp := redirect(gone); resp.StatusCode != http.StatusGone {
+			t.Errorf("gone (cleaned %v): status %d", cleaned, resp.StatusCode)
+		}
+		resp := redirect(fallback)
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://example.com/landing" || resp.Header.Get("Cache-Control") == "" {
+			t.Errorf("fallback (cleaned %v): status %d, Location %q, Cache-Control %q", cleaned, resp.StatusCode, resp.Header.Get("Location"), resp.Header.Get("Cache-Control"))
+		}
+		resp = redirect(archive)
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/campaign-archive" {
+			t.Errorf("archive (cleaned %v): status %d, Location %q", cleaned, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	drainClicks(t)
+	if clicks := srv.stored(archive).Clicks; clicks != 3 {
+		t.Errorf("archived link counted %d clicks, want 3", clicks)
+	}
+
+	// Deactivated expired links leave the active listing, archived ones included
+	listing.URLs = nil
+	srv.do("GET", "/analytics", token, nil, &listing)
+	for _, link := range listing.URLs {
+		if link.ShortURL == archive {
+			t.Error("archived link still listed as active")
+		}
+	}
+
+	// Once the retention lapses the archived link is gone too
+	SetClock(FixedClock(clockTestBase.Add(24*time.Hour).AddDate(0, 0, 90)))
+	if resp := redirect(archive); resp.StatusCode != http.StatusGone {
+		t.Errorf("archive after retention: status %d", resp.StatusCode)
+	}
+}
+
+func TestOnExpireRequestValidation(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	for _, body := range []map[string]interface{}{
+		{"long-url": "https://example.com/a", "on_expire": "delete"},
+		{"long-url": "https://example.com/b", "on_expire": "fallback"},
+		{"long-url": "https://example.com/c", "on_expire": "fallback", "expire_fallback_url": "ftp://example.com/"},
+	} {
+		if resp := srv.do("PUT", "/url", token, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
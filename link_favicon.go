@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// LINK FAVICONS AND ACCENT COLORS
+// ============================================================================
+//
+// The dashboard cannot load third-party favicons (CSP), so a background fetcher stores each
+// destination's /favicon.ico - inline as a data URI when it is at most faviconMaxInlineBytes,
+// otherwise as a URL - plus an accent color: the favicon's average opaque color, or a color
+// derived from the host name when the icon is missing or not decodable. Results are shared
+// per host, refreshed weekly, and each host is fetched at most once per faviconHostInterval.
+
+const (
+	faviconMaxInlineBytes = 10 * 1024
+	faviconRefreshAge     = 7 * 24 * time.Hour
+	faviconHostInterval   = time.Minute
+	faviconQueueSize      = 1000
+	faviconRefreshEvery   = 24 * time.Hour
+	faviconRefreshBatch   = 500
+	faviconHostCacheSize  = 5000
+)
+
+// LinkFavicon is the favicon metadata stored on a link
+type LinkFavicon struct {
+	URL         string
+	Data        string
+	AccentColor string
+	// FetchedAt is nil when only the fallback color is known, so the link is retried
+	FetchedAt *time.Time
+}
+
+// faviconTypes are the raster types accepted; SVG is refused because it can carry script
+var faviconTypes = map[string]bool{
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+	"image/png":                true,
+	"image/gif":                true,
+	"image/jpeg":               true,
+}
+
+// accentColorFor derives a stable mid-saturation color from a host or user name
+func accentColorFor(name string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(name)))
+	// Keep every channel within 64-191 so the color reads on light and dark backgrounds
+	return fmt.Sprintf("#%02x%02x%02x", 64+sum[0]%128, 64+sum[1]%128, 64+sum[2]%128)
+}
+
+// averageColor returns the mean color of the opaque pixels of an encoded image
+func averageColor(data []byte) (string, bool) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", false
+	}
+	var r, g, b, n uint64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			if ca < 0x8000 {
+				continue
+			}
+			r, g, b, n = r+uint64(cr>>8), g+uint64(cg>>8), b+uint64(cb>>8), n+1
+		}
+	}
+	if n == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r/n, g/n, b/n), true
+}
+
+// fetchHostFavicon fetches origin/favicon.ico; the accent color always has a value
+func fetchHostFavicon(ctx context.Context, origin, host string) LinkFavicon {
+	favicon := LinkFavicon{AccentColor: accentColorFor(host)}
+	iconURL := origin + "/favicon.ico"
+	body, contentType, truncated, err := safeFetch(ctx, iconURL, faviconMaxInlineBytes)
+	now := clock.Now().UTC()
+	favicon.FetchedAt = &now
+	if err != nil {
+		debugf("favicon fetch for %s failed: %v", host, err)
+		return favicon
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !faviconTypes[mediaType] {
+		return favicon
+	}
+	if truncated {
+		favicon.URL = iconURL
+		return favicon
+	}
+	favicon.Data = "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(body)
+	if color, ok := averageColor(body); ok {
+		favicon.AccentColor = color
+	}
+	return favicon
+}
+
+// faviconJob is one link to fetch the favicon of. A job with done set only marks a point in
+// the queue: it is closed once every job queued before it has been processed.
+type faviconJob struct {
+	store URLStore
+	link  *URLData
+	done  chan struct{}
+}
+
+// faviconFetcher fetches favicons one at a time in the background
+type faviconFetcher struct {
+	queue chan faviconJob
+	once  sync.Once
+
+	mu        sync.Mutex
+	byHost    map[string]LinkFavicon
+	lastFetch map[string]time.Time
+}
+
+var favicons = &faviconFetcher{
+	queue:     make(chan faviconJob, faviconQueueSize),
+	byHost:    make(map[string]LinkFavicon),
+	lastFetch: make(map[string]time.Time),
+}
+
+// Enqueue schedules a favicon fetch for link; jobs are dropped when the queue is full and
+// picked up again by the weekly refresh
+func (f *faviconFetcher) Enqueue(store URLStore, link *URLData) {
+	f.once.Do(func() { go f.run() })
+	select {
+	case f.queue <- faviconJob{store: store, link: link}:
+	default:
+		incMetric("favicon_jobs_dropped_total", 1)
+	}
+}
+
+// Drain waits until every job queued so far has been processed
+func (f *faviconFetcher) Drain(ctx context.Context) {
+	f.once.Do(func() { go f.run() })
+	done := make(chan struct{})
+	select {
+	case f.queue <- faviconJob{done: done}:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Warning: favicon queue drain interrupted: %v", ctx.Err())
+	}
+}
+
+func (f *faviconFetcher) run() {
+	for job := range f.queue {
+		if job.done != nil {
+			close(job.done)
+			continue
+		}
+		if err := f.process(job); err != nil {
+			incMetric("favicon_jobs_failed_total", 1)
+			log.Printf("error storing favicon: %v", err)
+		}
+	}
+}
+
+func (f *faviconFetcher) process(job faviconJob) error {
+	parsed, err := url.Parse(job.link.LongURL)
+	if err != nil || parsed.Hostname() == "" {
+		return nil
+	}
+	host := strings.ToLower(parsed.Hostname())
+	origin := strings.ToLower(parsed.Scheme) + "://" + strings.ToLower(parsed.Host)
+	now := clock.Now()
+
+	f.mu.Lock()
+	favicon, cached := f.byHost[host]
+	fresh := cached && favicon.FetchedAt != nil && now.Sub(*favicon.FetchedAt) < faviconRefreshAge
+	limited := !fresh && now.Sub(f.lastFetch[host]) < faviconHostInterval
+	if !fresh && !limited {
+		f.lastFetch[host] = now
+	}
+	f.mu.Unlock()
+
+	switch {
+	case fresh:
+	case limited:
+		// Another link to this host was fetched moments ago: store the fallback color
+		// now and leave FetchedAt unset so the next refresh fills in the icon
+		favicon = LinkFavicon{AccentColor: accentColorFor(host)}
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), 2*safeFetchTimeout)
+		favicon = fetchHostFavicon(ctx, origin, host)
+		cancel()
+		f.mu.Lock()
+		if len(f.byHost) >= faviconHostCacheSize {
+			// Start over rather than track recency; a cold cache only costs refetches
+			f.byHost = make(map[string]LinkFavicon)
+			f.lastFetch = map[string]time.Time{host: now}
+		}
+		f.byHost[host] = favicon
+		f.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return job.store.SetFavicon(ctx, job.link, favicon)
+}
+
+// StartFaviconRefresh re-queues links whose favicon is missing or older than a week, once
+// a day. On MongoDB a worker lease ensures only one instance does so.
+func StartFaviconRefresh() {
+	refresh := func() (map[string]int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		links, err := Links.StaleFavicons(ctx, clock.Now().Add(-faviconRefreshAge), faviconRefreshBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			favicons.Enqueue(Links, link)
+		}
+		return map[string]int64{"queued": int64(len(links))}, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(faviconRefreshEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if usesMongo() {
+				runExclusive("favicon_refresh", faviconRefreshEvery, refresh)
+			} else if _, err := refresh(); err != nil {
+				log.Printf("⚠️  Favicon refresh failed: %v", err)
+			}
+		}
+	}()
+}
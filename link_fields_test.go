@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseLinkFields(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		invalid bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"short_url,clicks", []string{"short_url", "clicks"}, false},
+		{" clicks , short_url,clicks ", []string{"clicks", "short_url"}, false},
+		{"short_url,user_id", nil, true},
+		{"click_history", nil, true},
+		{"created_ip", nil, true},
+		{"Short_URL", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLinkFields(tt.raw)
+		if (err != nil) != tt.invalid || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLinkFields(%q) = %v, %v", tt.raw, got, err)
+		}
+	}
+}
+
+func TestLinkListProjection(t *testing.T) {
+	keys := func(fields []string) []string {
+		var names []string
+		for _, e := range linkListProjection(fields) {
+			names = append(names, e.Key)
+		}
+		return names
+	}
+	if got := keys([]string{"clicks"}); !reflect.DeepEqual(got, []string{"clicks", "_id"}) {
+		t.Errorf("projection of clicks: %v", got)
+	}
+	if got := keys([]string{"full_short_url"}); !reflect.DeepEqual(got, []string{"short_url", "domain", "_id"}) {
+		t.Errorf("projection of full_short_url: %v", got)
+	}
+	// Protected fields are never projected, whatever is asked for
+	for _, key := range keys(nil) {
+		switch key {
+		case "user_id", "click_history", "created_ip", "creation_context":
+			t.Errorf("default projection includes %s", key)
+		}
+	}
+}
+
+func TestAnalyticsFieldSelection(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/fields", "tags": []string{"docs"}})
+
+	var page struct {
+		URLs []map[string]interface{} `json:"urls"`
+	}
+	if resp := srv.do("GET", "/analytics?fields=short_url,clicks,full_short_url", token, nil, &page); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if len(page.URLs) != 1 {
+		t.Fatalf("%d links", len(page.URLs))
+	}
+	var got []string
+	for key := range page.URLs[0] {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"clicks", "full_short_url", "short_url"}) {
+		t.Fatalf("selected keys %v", got)
+	}
+
+	// Without ?fields= the listing is unchanged
+	page.URLs = nil
+	srv.do("GET", "/analytics", token, nil, &page)
+	for _, key := range []string{"short_url", "long_url", "tags", "clicks", "created_at", "is_active"} {
+		if _, ok := page.URLs[0][key]; !ok {
+			t.Errorf("default listing without %s", key)
+		}
+	}
+	for _, key := range []string{"user_id", "click_history"} {
+		if _, ok := page.URLs[0][key]; ok {
+			t.Errorf("default listing with %s", key)
+		}
+	}
+
+	for _, fields := range []string{"short_url,user_id", "click_history", "created_ip", "nope"} {
+		var answer struct {
+			Error struct {
+				Code        string   `json:"code"`
+				ValidFields []string `json:"valid_fields"`
+			} `json:"error"`
+		}
+		resp := srv.do("GET", "/analytics?fields="+fields, token, nil, &answer)
+		if resp.StatusCode != http.StatusBadRequest || answer.Error.Code != ErrCodeInvalidFields {
+			t.Errorf("?fields=%s: status %d, code %q", fields, resp.StatusCode, answer.Error.Code)
+		}
+		if !reflect.DeepEqual(answer.Error.ValidFields, linkListFieldNames()) {
+			t.Errorf("?fields=%s: valid_fields %v", fields, answer.Error.ValidFields)
+		}
+	}
+}
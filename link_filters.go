@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ============================================================================
+// LINK LIST FILTERS
+// ============================================================================
+//
+// GET /analytics lists active links unless filtered. ?tag=a,b keeps links with any of those
+// tags, ?domain= links on that short domain, and ?status=active|expired|all picks links by
+// status as status_counts classifies them. all covers every link but drafts and deleted
+// ones. These filters combine with folder_id and pinned, and they narrow the page and total
+// only; the statistics still cover every active link. On MongoDB the user_tags_idx and
+// user_domain_idx indexes of migration 003 serve the tag and domain filters.
+
+// linkStatusAll is the ?status= of listings covering every link but drafts and deleted ones
+const linkStatusAll = "all"
+
+// LinkFilter narrows a link listing; the zero value lists every active link
+type LinkFilter struct {
+	// FolderIDs, when non-nil, keeps links in those folders, "" standing for links outside any
+	FolderIDs []string
+	// Pinned, when non-nil, keeps links with that pinned flag
+	Pinned *bool
+	// Tags keeps links with at least one of them
+	Tags []string
+	// Domain keeps links on that domain origin
+	Domain string
+	// Status is statusActive (also for ""), statusExpired or linkStatusAll
+	Status string
+}
+
+// activeOnly reports whether the filter only lists active links
+func (f LinkFilter) activeOnly() bool {
+	return f.Status == "" || f.Status == statusActive
+}
+
+// matches reports whether link passes the filter at now
+func (f LinkFilter) matches(link *URLData, now time.Time) bool {
+	if f.FolderIDs != nil && !containsString(f.FolderIDs, link.FolderID) {
+		return false
+	}
+	if f.Pinned != nil && link.Pinned != *f.Pinned {
+		return false
+	}
+	if f.Domain != "" && link.Domain != f.Domain {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		tagged := false
+		for _, tag := range link.Tags {
+			if containsString(f.Tags, tag) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	switch f.Status {
+	case linkStatusAll:
+		return link.DeactivatedReason != DeactivatedDraft && link.DeactivatedReason != DeactivatedDeleted
+	case statusExpired:
+		return statusCategory(link, now) == statusExpired
+	default:
+		return statusCategory(link, now) == statusActive
+	}
+}
+
+// mongoBaseMatch selects the user's links a listing with f starts from: the active ones
+// when f lists only those, so the pinned-first sort can use user_active_pinned_created_at_idx
+func (f LinkFilter) mongoBaseMatch(userID string) bson.D {
+	if f.activeOnly() {
+		return bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}
+	}
+	return bson.D{{Key: "user_id", Value: userID}}
+}
+
+// mongoMatch returns the conditions of f on top of mongoBaseMatch. Expiry is compared with
+// the database clock ($$NOW), like redirects and the cleanup worker.
+func (f LinkFilter) mongoMatch() bson.D {
+	match := bson.D{}
+	if f.FolderIDs != nil {
+		in := bson.A{}
+		for _, id := range f.FolderIDs {
+			if id == "" {
+				in = append(in, nil) // matches links without folder_id
+			} else {
+				in = append(in, id)
+			}
+		}
+		match = append(match, bson.E{Key: "folder_id", Value: bson.D{{Key: "$in", Value: in}}})
+	}
+	if f.Pinned != nil && *f.Pinned {
+		match = append(match, bson.E{Key: "pinned", Value: true})
+	} else if f.Pinned != nil {
+		match = append(match, bson.E{Key: "pinned", Value: bson.D{{Key: "$ne", Value: true}}})
+	}
+	if len(f.Tags) > 0 {
+		match = append(match, bson.E{Key: "tags", Value: bson.D{{Key: "$in", Value: f.Tags}}})
+	}
+	if f.Domain != "" {
+		match = append(match, bson.E{Key: "domain", Value: f.Domain})
+	}
+	switch f.Status {
+	case linkStatusAll:
+		match = append(match, bson.E{Key: "deactivated_reason", Value: bson.D{
+			{Key: "$nin", Value: bson.A{DeactivatedDraft, DeactivatedDeleted}},
+		}})
+	case statusExpired:
+		match = append(match, bson.E{Key: "$or", Value: bson.A{
+			append(bson.D{{Key: "is_active", Value: true}}, expiredFilter()...),
+			bson.D{{Key: "deactivated_reason", Value: DeactivatedExpired}},
+		}})
+	default:
+		match = append(match, notExpiredFilter())
+	}
+	return match
+}
+
+// parseLinkFilter reads ?tag=, ?domain= and ?status= of a link listing; folder_id and pinned
+// are read by folderFilter and parsePinnedFilter
+func parseLinkFilter(r *http.Request) (LinkFilter, error) {
+	var filter LinkFilter
+	query := r.URL.Query()
+
+	if raw := query.Get("tag"); raw != "" {
+		seen := make(map[string]bool)
+		for _, part := range strings.Split(raw, ",") {
+			// Spelled the way normalizeTags stores tags
+			tag := sanitizeInput(strings.ToLower(strings.Join(strings.Fields(part), " ")))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			filter.Tags = append(filter.Tags, tag)
+		}
+		if len(filter.Tags) > MaxTagsPerLink {
+			return LinkFilter{}, fmt.Errorf("tag accepts at most %d tags", MaxTagsPerLink)
+		}
+	}
+
+	if raw := query.Get("domain"); raw != "" {
+		domain, err := validateDomainOrigin(raw)
+		if err != nil {
+			return LinkFilter{}, fmt.Errorf("domain must be a domain origin such as https://go.example.com")
+		}
+		filter.Domain = domain
+	}
+
+	switch status := query.Get("status"); status {
+	case "", statusActive:
+	case statusExpired, linkStatusAll:
+		filter.Status = status
+	default:
+		return LinkFilter{}, fmt.Errorf("status must be active, expired or all")
+	}
+	return filter, nil
+}
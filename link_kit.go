@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// LINK KIT (EVERYTHING NEEDED TO SHARE A LINK)
+// ============================================================================
+//
+// GET /url/{code}/kit lets the dashboard's share dialog make one request instead of
+// several: full short URL, QR code, title/OG metadata, a UTM-tagged example destination and
+// the current click counts. QR images are capped at qrMaxSize pixels, which keeps a kit
+// well under 200KB, and cached since they only depend on the URL and size.
+
+const (
+	qrDefaultSize   = 256
+	qrMinSize       = 64
+	qrMaxSize       = 1024
+	qrCacheTTL      = time.Hour
+	qrCacheCapacity = 2000
+)
+
+type qrCacheEntry struct {
+	dataURI   string
+	expiresAt time.Time
+}
+
+var (
+	qrCache      = make(map[string]qrCacheEntry)
+	qrCacheMutex = sync.RWMutex{}
+)
+
+// qrDataURI returns content as a PNG QR code data URI of about size pixels
+func qrDataURI(content string, size int) (string, error) {
+	key := strconv.Itoa(size) + " " + content
+	qrCacheMutex.RLock()
+	entry, cached := qrCache[key]
+	qrCacheMutex.RUnlock()
+	if cached && time.Now().Before(entry.expiresAt) {
+		return entry.dataURI, nil
+	}
+
+	code, err := encodeQR([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	image, err := code.PNG(size)
+	if err != nil {
+		return "", err
+	}
+	dataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+
+	qrCacheMutex.Lock()
+	if len(qrCache) >= qrCacheCapacity {
+		// Regenerating a QR code is cheap; start over rather than track recency
+		qrCache = make(map[string]qrCacheEntry)
+	}
+	qrCache[key] = qrCacheEntry{dataURI: dataURI, expiresAt: time.Now().Add(qrCacheTTL)}
+	qrCacheMutex.Unlock()
+	return dataURI, nil
+}
+
+// utmExample adds utm_source, utm_medium and utm_campaign to destination, keeping any UTM
+// parameters it already has
+func utmExample(destination, code string) string {
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+	query := parsed.Query()
+	for key, value := range map[string]string{
+		"utm_source":   "rapidlink",
+		"utm_medium":   "short_link",
+		"utm_campaign": code,
+	} {
+		if query.Get(key) == "" {
+			query.Set(key, value)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// linkKit handles GET /url/{code}/kit (owner only); ?qr_size= sets the QR width in pixels
+func linkKit(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+	size := qrDefaultSize
+	if raw := r.URL.Query().Get("qr_size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			http.Error(w, "qr_size must be between "+strconv.Itoa(qrMinSize)+" and "+strconv.Itoa(qrMaxSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := linkStore(r).FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error loading link kit for %s: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	shortURL := fullShortURL(r, link.Domain, link.ShortURL)
+	qr := map[string]interface{}{"size": size, "content": shortURL}
+	if dataURI, err := qrDataURI(shortURL, size); err != nil {
+		log.Printf("error rendering QR code for %s: %v", code, err)
+		qr = nil
+	} else {
+		qr["image"] = dataURI
+	}
+	var kitClicks interface{} = link.Clicks
+	if link.AnalyticsDisabled {
+		kitClicks = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"short_url":      link.ShortURL,
+		"full_short_url": shortURL,
+		"destination":    link.LongURL,
+		"utm_example":    utmExample(link.LongURL, link.ShortURL),
+		"title":          link.Title,
+		"description":    link.Description,
+		"og":             link.OG,
+		"status":         linkStatus(link),
+		"clicks":         kitClicks,
+		"blocked_clicks": link.BlockedClicks,
+		"analytics":      linkAnalyticsState(link.AnalyticsDisabled),
+		"qr":             qr,
+	}); err != nil {
+		log.Printf("error encoding link kit response: %v", err)
+	}
+}
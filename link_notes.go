@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// PUBLIC LINK NOTES
+// ============================================================================
+//
+// public_note is a short line for a link's visitors, e.g. "Maintained by HR, updated 2024-05"
+// on a go/payroll link of an internal deployment. It is set on creation or with PATCH
+// /url/{code} ("" removes it), sanitized like other free text and capped at
+// maxPublicNoteLength characters. Visitors see it on the link's interstitial pages, marked as
+// written by the owner. internal=true marks a link of such a deployment: the signed public
+// resolve API returns the note of internal links only. The server has no visitor-facing
+// preview page and no organizations, so there is no preview to show the note on and no
+// org-wide directory (GET /org/{id}/directory) listing internal links.
+
+const maxPublicNoteLength = 500
+
+// normalizePublicNote sanitizes a public note and checks its length
+func normalizePublicNote(note string) (string, error) {
+	note = sanitizeInput(strings.TrimSpace(note))
+	if utf8.RuneCountInString(note) > maxPublicNoteLength {
+		return "", fmt.Errorf("public_note must be at most %d characters", maxPublicNoteLength)
+	}
+	return note, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePublicNote(t *testing.T) {
+	tests := []struct {
+		in, want string
+		valid    bool
+	}{
+		{"  Maintained by HR, updated 2024-05 ", "Maintained by HR, updated 2024-05", true},
+		{`<script>alert("x")</script>`, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;", true},
+		{"HR\x00 \x1b[31mteam\x7f", "HR [31mteam", true},
+		{"", "", true},
+		{strings.Repeat("é", maxPublicNoteLength), strings.Repeat("é", maxPublicNoteLength), true},
+		{strings.Repeat("a", maxPublicNoteLength+1), "", false},
+		// The cap applies to the stored, escaped text
+		{strings.Repeat("&", maxPublicNoteLength/5+1), "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizePublicNote(tt.in)
+		if (err == nil) != tt.valid || got != tt.want {
+			t.Errorf("normalizePublicNote(%.40q) = %.60q, %v; want %.60q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestPublicNote(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	note := `Maintained by <b>HR</b> & "payroll", updated 2024-05`
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/payroll", "public_note": note, "internal": true})
+
+	var link URLData
+	if resp := srv.do("GET", "/url/"+code, token, nil, &link); resp.StatusCode != http.StatusOK {
+		t.Fatalf("detail: status %d", resp.StatusCode)
+	}
+	if link.PublicNote != sanitizeInput(note) || !link.Internal {
+		t.Fatalf("stored note %q, internal %v", link.PublicNote, link.Internal)
+	}
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/long", "public_note": strings.Repeat("a", maxPublicNoteLength+1)}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("501-character note: status %d", resp.StatusCode)
+	}
+
+	// Visitors of the interstitial see the note escaped once, in their language
+	if _, err := srv.links.SetAbuseFlag(context.Background(), code, true); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/"+code, nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "de")
+	page := srv.serveFrom("198.51.100.1:4000", req).Body.String()
+	if !strings.Contains(page, "Maintained by &lt;b&gt;HR&lt;/b&gt; &amp; &#34;payroll&#34;, updated 2024-05") || strings.Contains(page, "&amp;lt;") {
+		t.Errorf("interstitial note:\n%s", page)
+	}
+	if !strings.Contains(page, translate("de", "public_note.label")) {
+		t.Errorf("interstitial without the German note label:\n%s", page)
+	}
+
+	// PATCH replaces the note and clears it with ""; only the owner may
+	for _, tt := range []struct {
+		body     map[string]interface{}
+		token    string
+		status   int
+		note     string
+		internal bool
+	}{
+		{map[string]interface{}{"public_note": "<i>new</i>"}, token, http.StatusOK, "&lt;i&gt;new&lt;/i&gt;", true},
+		{map[string]interface{}{"public_note": "stolen"}, other, http.StatusForbidden, "&lt;i&gt;new&lt;/i&gt;", true},
+		{map[string]interface{}{"public_note": strings.Repeat("a", maxPublicNoteLength+1)}, token, http.StatusBadRequest, "&lt;i&gt;new&lt;/i&gt;", true},
+		{map[string]interface{}{"public_note": "", "internal": false}, token, http.StatusOK, "", false},
+	} {
+		if resp := srv.do("PATCH", "/url/"+code, tt.token, tt.body, nil); resp.StatusCode != tt.status {
+			t.Errorf("PATCH %v: status %d, want %d", tt.body, resp.StatusCode, tt.status)
+		}
+		if stored := srv.stored(code); stored.PublicNote != tt.note || stored.Internal != tt.internal {
+			t.Errorf("after PATCH %v: note %q, internal %v", tt.body, stored.PublicNote, stored.Internal)
+		}
+	}
+	page = srv.serveFrom("198.51.100.1:4000", req).Body.String()
+	if strings.Contains(page, `class="note"`) {
+		t.Errorf("cleared note still shown:\n%s", page)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// REDIRECT OUTCOMES
+// ============================================================================
+//
+// When a link "doesn't work", its owner needs to know how its redirects ended: how often the
+// code redirected, and how often it answered expired, disabled or blocked instead. Each
+// request for a registered link counts one outcome per link and UTC day. Outcomes travel
+// through the click queue, so the redirect never waits for them, and the click worker sums
+// them in memory and upserts them every outcomeFlushInterval, like API usage. Failed outcomes
+// are counted although they write no click. Links with analytics disabled count nothing, and
+// purging their analytics drops the counters too. Counters are kept for outcomeRetentionDays.
+// GET /url/{code}/clicks?include_outcomes=true returns them as "outcomes", with totals and a
+// daily series over the listing's from/to range (the last defaultOutcomeDays days without one).
+
+// Redirect outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeExpired = "expired"
+	// OutcomeDisabled is a deactivated link or one of a suspended account
+	OutcomeDisabled = "disabled"
+	// OutcomePaused is a link whose daily click limit is used up
+	OutcomePaused          = "paused"
+	OutcomeBlockedReferrer = "blocked_referrer"
+	// OutcomeGeoBlocked is a visitor refused by the link's country restriction
+	OutcomeGeoBlocked = "geo_blocked"
+	// OutcomeSignatureFailed is a signed link requested without a valid signature
+	OutcomeSignatureFailed = "signature_failed"
+	// OutcomeFlagged is the interstitial of a link flagged by abuse reports
+	OutcomeFlagged = "flagged"
+	// OutcomeRestricted is the interstitial of a link of a restricted account
+	OutcomeRestricted = "restricted"
+	// OutcomeBlockedDestination is a redirect loop or a destination failing the URL checks
+	OutcomeBlockedDestination = "blocked_destination"
+)
+
+// redirectOutcomes lists every outcome, in the order responses show them
+var redirectOutcomes = []string{
+	OutcomeSuccess, OutcomeExpired, OutcomeDisabled, OutcomePaused, OutcomeBlockedReferrer,
+	OutcomeGeoBlocked, OutcomeSignatureFailed, OutcomeFlagged, OutcomeRestricted,
+	OutcomeBlockedDestination,
+}
+
+const (
+	outcomeFlushInterval = 10 * time.Second
+	outcomeRetentionDays = 90
+	defaultOutcomeDays   = 30
+)
+
+// LinkOutcomeCount is how many redirects of one link ended in one outcome on one UTC day
+type LinkOutcomeCount struct {
+	URLID   primitive.ObjectID `bson:"url_id"`
+	Day     time.Time          `bson:"day"`
+	Outcome string             `bson:"outcome"`
+	Count   int64              `bson:"count"`
+}
+
+// outcomeKey identifies the counter an outcome adds to. The store is part of it because links
+// of different tenants live in different stores.
+type outcomeKey struct {
+	store   interface{}
+	urlID   primitive.ObjectID
+	day     time.Time
+	outcome string
+}
+
+// pendingOutcome is an outcome counter not written yet
+type pendingOutcome struct {
+	store URLStore
+	count int64
+}
+
+// outcomeStoreKey identifies store in an outcomeKey. linkStore returns a new MongoDB store per
+// request, so those are told apart by their collection.
+func outcomeStoreKey(store URLStore) interface{} {
+	if mongoStore, ok := store.(*mongoURLStore); ok {
+		return mongoStore.coll.Database().Name() + "." + mongoStore.coll.Name()
+	}
+	return store
+}
+
+// countOutcome adds the outcome of job to pending
+func countOutcome(pending map[outcomeKey]*pendingOutcome, job clickJob, at time.Time) {
+	key := outcomeKey{store: outcomeStoreKey(job.store), urlID: job.link.ID, day: usageDay(at), outcome: job.outcome}
+	counter, ok := pending[key]
+	if !ok {
+		counter = &pendingOutcome{store: job.store}
+		pending[key] = counter
+	}
+	counter.count++
+}
+
+// flushOutcomes writes the summed outcomes, one batch per store
+func flushOutcomes(pending map[outcomeKey]*pendingOutcome) {
+	if len(pending) == 0 {
+		return
+	}
+	stores := make(map[interface{}]URLStore)
+	batches := make(map[interface{}][]LinkOutcomeCount)
+	for key, counter := range pending {
+		stores[key.store] = counter.store
+		batches[key.store] = append(batches[key.store],
+			LinkOutcomeCount{URLID: key.urlID, Day: key.day, Outcome: key.outcome, Count: counter.count})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for key, counts := range batches {
+		if err := stores[key].AddLinkOutcomes(ctx, counts); err != nil {
+			incMetric("outcome_flush_failed_total", 1)
+			log.Printf("error writing redirect outcome counters: %v", err)
+		}
+	}
+}
+
+// LinkOutcomes is the "outcomes" object of the click listing
+type LinkOutcomes struct {
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"`
+	Totals map[string]int64 `json:"totals"`
+	Daily  []OutcomeDay     `json:"daily"`
+}
+
+// OutcomeDay is one UTC day of LinkOutcomes, with every outcome present
+type OutcomeDay struct {
+	Date     string           `json:"date"`
+	Outcomes map[string]int64 `json:"outcomes"`
+}
+
+// outcomeRange returns the whole UTC days covering [from, to), defaulting to the last
+// defaultOutcomeDays days and clipped to the retained ones
+func outcomeRange(from, to, now time.Time) (time.Time, time.Time) {
+	today := usageDay(now)
+	if to.IsZero() || to.After(today.AddDate(0, 0, 1)) {
+		to = today.AddDate(0, 0, 1)
+	} else if day := usageDay(to); day.Before(to) {
+		to = day.AddDate(0, 0, 1)
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -defaultOutcomeDays)
+	}
+	from = usageDay(from)
+	if oldest := today.AddDate(0, 0, -outcomeRetentionDays); from.Before(oldest) {
+		from = oldest
+	}
+	if from.After(to) {
+		from = to
+	}
+	return from, to
+}
+
+// linkOutcomes reads the outcome counters of link over [from, to) as whole UTC days
+func linkOutcomes(ctx context.Context, store URLStore, link *URLData, from, to time.Time) (*LinkOutcomes, error) {
+	from, to = outcomeRange(from, to, clock.Now())
+	counts, err := store.ListLinkOutcomes(ctx, link, from, to)
+	if err != nil {
+		return nil, err
+	}
+	result := &LinkOutcomes{From: from, To: to, Totals: emptyOutcomeCounts(), Daily: []OutcomeDay{}}
+	byDay := make(map[string]map[string]int64)
+	for _, count := range counts {
+		date := count.Day.UTC().Format(usageDayLayout)
+		if byDay[date] == nil {
+			byDay[date] = emptyOutcomeCounts()
+		}
+		byDay[date][count.Outcome] += count.Count
+		result.Totals[count.Outcome] += count.Count
+	}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(usageDayLayout)
+		outcomes := byDay[date]
+		if outcomes == nil {
+			outcomes = emptyOutcomeCounts()
+		}
+		result.Daily = append(result.Daily, OutcomeDay{Date: date, Outcomes: outcomes})
+	}
+	return result, nil
+}
+
+// recordOutcome queues outcome for link unless its analytics are off
+func recordOutcome(store URLStore, link *URLData, outcome string) {
+	if !link.AnalyticsDisabled {
+		clicks.RecordOutcome(store, link, outcome)
+	}
+}
+
+// emptyOutcomeCounts returns a zero count for every outcome
+func emptyOutcomeCounts() map[string]int64 {
+	counts := make(map[string]int64, len(redirectOutcomes))
+	for _, outcome := range redirectOutcomes {
+		counts[outcome] = 0
+	}
+	return counts
+}
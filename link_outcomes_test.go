@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// linkOutcomeTotals returns the outcome totals of code from its click listing
+func (s *testServer) linkOutcomeTotals(token, code string) (map[string]int64, *LinkOutcomes) {
+	s.t.Helper()
+	var listing struct {
+		Outcomes *LinkOutcomes `json:"outcomes"`
+	}
+	if resp := s.do("GET", "/url/"+code+"/clicks?include_outcomes=true", token, nil, &listing); resp.StatusCode != http.StatusOK || listing.Outcomes == nil {
+		s.t.Fatalf("outcomes of %s: status %d", code, resp.StatusCode)
+	}
+	return listing.Outcomes.Totals, listing.Outcomes
+}
+
+func TestRedirectOutcomes(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	restricted, restrictedID := srv.register()
+	t.Cleanup(func() {
+		suspendedOwners.set(userID, false)
+		restrictedOwners.set(restrictedID, false)
+		geoUnknownPolicy = GeoUnknownAllow
+	})
+	// The test server has no country database, so every visitor's country is unknown
+	geoUnknownPolicy = GeoUnknownDeny
+
+	visit := func(code, referrer string) int {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		if referrer != "" {
+			req.Header.Set("Referer", referrer)
+		}
+		return srv.send(req, nil).StatusCode
+	}
+
+	tests := []struct {
+		outcome  string
+		create   map[string]interface{}
+		owner    string
+		prepare  func(code string)
+		referrer string
+		status   int
+	}{
+		{OutcomeSuccess, nil, token, nil, "", http.StatusMovedPermanently},
+		{OutcomeExpired, nil, token, func(code string) {
+			expired := time.Now().Add(-time.Hour)
+			srv.editStored(code, LinkEdit{ExpiresAt: &expired})
+		}, "", http.StatusGone},
+		{OutcomeDisabled, nil, token, func(code string) {
+			off := false
+			srv.editStored(code, LinkEdit{Active: &off})
+		}, "", http.StatusNotFound},
+		{OutcomePaused, map[string]interface{}{"daily_click_limit": 5}, token, func(code string) {
+			if _, err := srv.links.PauseLink(context.Background(), srv.stored(code), time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}, "", http.StatusGone},
+		{OutcomeBlockedReferrer, map[string]interface{}{"allowed_referrers": []string{"partner.example"}}, token, nil, "https://elsewhere.example/", http.StatusForbidden},
+		{OutcomeGeoBlocked, map[string]interface{}{"allowed_countries": []string{"DE"}}, token, nil, "", http.StatusUnavailableForLegalReasons},
+		{OutcomeSignatureFailed, map[string]interface{}{"signed": true}, token, nil, "", http.StatusForbidden},
+		{OutcomeFlagged, nil, token, func(code string) {
+			if _, err := srv.links.SetAbuseFlag(context.Background(), code, true); err != nil {
+				t.Fatal(err)
+			}
+		}, "", http.StatusOK},
+		{OutcomeRestricted, nil, restricted, func(string) { restrictedOwners.set(restrictedID, true) }, "", http.StatusOK},
+		{OutcomeBlockedDestination, nil, token, func(code string) {
+			blocked := "javascript:alert(1)"
+			srv.editStored(code, LinkEdit{LongURL: &blocked})
+		}, "", http.StatusForbidden},
+	}
+	refused := map[string]bool{OutcomeExpired: true, OutcomeDisabled: true, OutcomePaused: true, OutcomeBlockedReferrer: true, OutcomeGeoBlocked: true, OutcomeSignatureFailed: true}
+	codes := make(map[string]string, len(tests))
+	for _, tt := range tests {
+		body := map[string]interface{}{"long-url": "https://example.com/" + tt.outcome}
+		for key, value := range tt.create {
+			body[key] = value
+		}
+		code := srv.shorten(tt.owner, body)
+		codes[tt.outcome] = code
+		if tt.prepare != nil {
+			tt.prepare(code)
+		}
+		for i := 0; i < 2; i++ {
+			if status := visit(code, tt.referrer); status != tt.status {
+				t.Errorf("%s: status %d, want %d", tt.outcome, status, tt.status)
+			}
+		}
+	}
+	drainClicks(t)
+
+	for _, tt := range tests {
+		totals, _ := srv.linkOutcomeTotals(tt.owner, codes[tt.outcome])
+		for _, outcome := range redirectOutcomes {
+			want := int64(0)
+			if outcome == tt.outcome {
+				want = 2
+			}
+			if totals[outcome] != want {
+				t.Errorf("%s link: %s counted %d times, want %d", tt.outcome, outcome, totals[outcome], want)
+			}
+		}
+		// Refusals before the redirect are counted without writing clicks
+		if history := len(srv.clickEvents(codes[tt.outcome])); refused[tt.outcome] && history != 0 {
+			t.Errorf("%s link: %d clicks recorded", tt.outcome, history)
+		}
+	}
+
+	// A suspended account's links count as disabled, the daily series has every outcome
+	suspendedOwners.set(userID, true)
+	visit(codes[OutcomeSuccess], "")
+	suspendedOwners.set(userID, false)
+	drainClicks(t)
+	totals, outcomes := srv.linkOutcomeTotals(token, codes[OutcomeSuccess])
+	if totals[OutcomeSuccess] != 2 || totals[OutcomeDisabled] != 1 {
+		t.Errorf("after suspension: %v", totals)
+	}
+	if len(outcomes.Daily) != defaultOutcomeDays {
+		t.Fatalf("%d days in the series", len(outcomes.Daily))
+	}
+	today := outcomes.Daily[len(outcomes.Daily)-1]
+	if today.Date != time.Now().UTC().Format(usageDayLayout) || today.Outcomes[OutcomeSuccess] != 2 || len(today.Outcomes) != len(redirectOutcomes) {
+		t.Errorf("today %+v", today)
+	}
+	if earlier := outcomes.Daily[0]; earlier.Outcomes[OutcomeSuccess] != 0 || len(earlier.Outcomes) != len(redirectOutcomes) {
+		t.Errorf("first day %+v", earlier)
+	}
+}
+
+func TestRedirectOutcomesWithoutAnalytics(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/", "analytics_disabled": true})
+	srv.do("GET", "/"+code, "", nil, nil)
+	drainClicks(t)
+	srv.do("PUT", "/url/"+code+"/analytics", token, map[string]bool{"enabled": true}, nil)
+	if totals, _ := srv.linkOutcomeTotals(token, code); totals[OutcomeSuccess] != 0 {
+		t.Fatalf("outcomes counted with analytics off: %v", totals)
+	}
+
+	// Purging the analytics drops the counters
+	srv.do("GET", "/"+code, "", nil, nil)
+	drainClicks(t)
+	if totals, _ := srv.linkOutcomeTotals(token, code); totals[OutcomeSuccess] != 1 {
+		t.Fatalf("outcomes with analytics on: %v", totals)
+	}
+	srv.do("PUT", "/url/"+code+"/analytics?purge=true", token, map[string]bool{"enabled": false}, nil)
+	srv.do("PUT", "/url/"+code+"/analytics", token, map[string]bool{"enabled": true}, nil)
+	if totals, _ := srv.linkOutcomeTotals(token, code); totals[OutcomeSuccess] != 0 {
+		t.Fatalf("outcomes after the purge: %v", totals)
+	}
+	if resp := srv.do("GET", "/url/"+code+"/clicks?include_outcomes=maybe", token, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("include_outcomes=maybe: status %d", resp.StatusCode)
+	}
+}
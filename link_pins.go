@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// PINNED LINKS
+// ============================================================================
+//
+// A user can pin up to maxPinnedLinks of their links with POST /url/{code}/pin (DELETE
+// unpins) or PATCH /url/{code} {"pinned": true|false}. Pinned links come first in
+// GET /analytics, newest first among themselves, and ?pinned=true|false lists only pinned or
+// unpinned ones. Pinned links are never picked by the auto-expiry of unclicked links.
+
+// maxPinnedLinks is how many links one user can pin
+const maxPinnedLinks = 50
+
+// parsePinnedFilter reads ?pinned= of a link listing; nil when absent
+func parsePinnedFilter(r *http.Request) (*bool, error) {
+	switch r.URL.Query().Get("pinned") {
+	case "":
+		return nil, nil
+	case "true":
+		pinned := true
+		return &pinned, nil
+	case "false":
+		pinned := false
+		return &pinned, nil
+	}
+	return nil, fmt.Errorf("pinned must be true or false")
+}
+
+// setLinkPinned pins or unpins the caller's link with code and writes the response
+func setLinkPinned(w http.ResponseWriter, r *http.Request, code string, pinned bool) {
+	userID, _ := r.Context().Value("user_id").(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, err := linkStore(r).PinLink(ctx, userID, code, pinned, maxPinnedLinks)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrLimitReached) {
+		writeJSONError(w, http.StatusConflict, ErrCodePinLimitReached,
+			fmt.Sprintf("At most %d links can be pinned; unpin one first", maxPinnedLinks),
+			map[string]interface{}{"max_pinned": maxPinnedLinks})
+		return
+	}
+	if err != nil {
+		log.Printf("error pinning link %s: %v", code, err)
+		writeStoreError(w, err, "short URL", "Database error")
+		return
+	}
+
+	logSecurityEvent(r.Context(), "SHORT_URL_UPDATED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Short URL %s pinned=%t", code, link.Pinned), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"short_url":      link.ShortURL,
+		"full_short_url": fullShortURL(r, link.Domain, link.ShortURL),
+		"pinned":         link.Pinned,
+		"expires_at":     link.ExpiresAt,
+		"updated_at":     link.UpdatedAt,
+	}); err != nil {
+		log.Printf("error encoding link update response: %v", err)
+	}
+}
+
+// pinLink handles POST /url/{code}/pin
+func pinLink(w http.ResponseWriter, r *http.Request) {
+	setLinkPinned(w, r, mux.Vars(r)["code"], true)
+}
+
+// unpinLink handles DELETE /url/{code}/pin
+func unpinLink(w http.ResponseWriter, r *http.Request) {
+	setLinkPinned(w, r, mux.Vars(r)["code"], false)
+}
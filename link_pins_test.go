@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPinnedLinks(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	other, _ := srv.register()
+	ctx := context.Background()
+	now := time.Now()
+	codes := make([]string, maxPinnedLinks+2)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("pin%d", i)
+		if err := srv.links.InsertLink(ctx, &URLData{
+			ShortURL: codes[i], LongURL: fmt.Sprintf("https://example.com/pin/%d", i), UserID: userID,
+			IsActive: true, CreatedAt: now.Add(-time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest links are pinned; the last one is refused over the cap
+	for i := len(codes) - maxPinnedLinks; i < len(codes); i++ {
+		if resp := srv.do("POST", "/url/"+codes[i]+"/pin", token, map[string]interface{}{}, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("pin %s: status %d", codes[i], resp.StatusCode)
+		}
+	}
+	var refused struct {
+		Error struct {
+			Code      string `json:"code"`
+			MaxPinned int    `json:"max_pinned"`
+		} `json:"error"`
+	}
+	if resp := srv.do("POST", "/url/"+codes[0]+"/pin", token, map[string]interface{}{}, &refused); resp.StatusCode != http.StatusConflict ||
+		refused.Error.Code != ErrCodePinLimitReached || refused.Error.MaxPinned != maxPinnedLinks {
+		t.Fatalf("pin over the cap: status %d, %+v", resp.StatusCode, refused)
+	}
+	// Pinning an already pinned link does not count it twice
+	if resp := srv.do("PATCH", "/url/"+codes[len(codes)-1], token, map[string]interface{}{"pinned": true}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("re-pin at the cap: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("POST", "/url/"+codes[0]+"/pin", other, map[string]interface{}{}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("pin of another user's link: status %d", resp.StatusCode)
+	}
+
+	type listing struct {
+		URLs []struct {
+			ShortURL string `json:"short_url"`
+		} `json:"urls"`
+		Total int `json:"total"`
+	}
+	list := func(query string) listing {
+		t.Helper()
+		var page listing
+		if resp := srv.do("GET", "/analytics?stats=false&pageSize=100"+query, token, nil, &page); resp.StatusCode != http.StatusOK {
+			t.Fatalf("analytics%s: status %d", query, resp.StatusCode)
+		}
+		return page
+	}
+
+	// Pinned links come first, newest first among themselves, then the rest
+	page := list("")
+	want := append(append([]string{}, codes[2:]...), codes[:2]...)
+	if len(page.URLs) != len(want) {
+		t.Fatalf("listed %d links, want %d", len(page.URLs), len(want))
+	}
+	for i, link := range page.URLs {
+		if link.ShortURL != want[i] {
+			t.Fatalf("link %d is %s, want %s", i, link.ShortURL, want[i])
+		}
+	}
+	if page := list("&pinned=true"); page.Total != maxPinnedLinks {
+		t.Errorf("pinned=true lists %d links", page.Total)
+	}
+	if page := list("&pinned=false"); page.Total != 2 || page.URLs[0].ShortURL != codes[0] {
+		t.Errorf("pinned=false lists %+v", page)
+	}
+	if resp := srv.do("GET", "/analytics?pinned=yes", token, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("pinned=yes: status %d", resp.StatusCode)
+	}
+
+	// Unpinning frees a slot
+	if resp := srv.do("DELETE", "/url/"+codes[2]+"/pin", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unpin: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("POST", "/url/"+codes[0]+"/pin", token, map[string]interface{}{}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("pin after unpinning: status %d", resp.StatusCode)
+	}
+	if page := list(""); page.URLs[0].ShortURL != codes[0] || page.URLs[maxPinnedLinks].ShortURL != codes[1] {
+		t.Errorf("after unpinning %s, listing starts %s and continues %s", codes[2], page.URLs[0].ShortURL, page.URLs[maxPinnedLinks].ShortURL)
+	}
+}
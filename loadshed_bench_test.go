@@ -0,0 +1,140 @@
+//go:build loadtest
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The load-shedding benchmark keeps 80 clients busy for six seconds, so it is kept out of the
+// regular suite:
+//
+//	go test -tags loadtest -run LoadShed -v .
+
+const (
+	benchShedDuration       = 3 * time.Second
+	benchShedPoolSize       = 8 // simulated database connections
+	benchShedHeavyClients   = 64
+	benchShedRedirectClient = 16
+	benchShedHeavyHold      = 100 * time.Millisecond
+	benchShedRedirectHold   = time.Millisecond
+)
+
+// TestLoadShedBenchmark saturates a simulated analytics endpoint while measuring redirect
+// latency, once without load shedding and once with it. Both handlers share a small
+// connection pool, as they share MongoDB in production. Runs in process; no database is
+// needed.
+func TestLoadShedBenchmark(t *testing.T) {
+	unshed := benchShedScenario(nil)
+	shed := benchShedScenario(newLoadShedder(map[string]int{
+		ShedClassRedirect: 256,
+		ShedClassAPI:      32,
+		ShedClassHeavy:    benchShedPoolSize / 2,
+	}, defaultShedQueueWait))
+
+	t.Logf("without shedding: redirect p50 %v, p99 %v (%d redirects)", unshed.p50, unshed.p99, unshed.redirects)
+	t.Logf("with shedding:    redirect p50 %v, p99 %v (%d redirects, %d analytics requests shed)",
+		shed.p50, shed.p99, shed.redirects, shed.shed)
+	if shed.p99 >= unshed.p99 {
+		t.Errorf("redirect p99 with shedding (%v) is not below p99 without (%v)", shed.p99, unshed.p99)
+	}
+}
+
+type shedBenchResult struct {
+	p50, p99  time.Duration
+	redirects int
+	shed      int
+}
+
+func benchShedScenario(s *loadShedder) shedBenchResult {
+	pool := make(chan struct{}, benchShedPoolSize)
+	hold := func(d time.Duration) {
+		pool <- struct{}{}
+		time.Sleep(d)
+		<-pool
+	}
+
+	r := mux.NewRouter()
+	if s != nil {
+		r.Use(s.middleware)
+	}
+	r.HandleFunc("/analytics", func(w http.ResponseWriter, r *http.Request) {
+		hold(benchShedHeavyHold)
+		w.WriteHeader(http.StatusOK)
+	}).Methods("GET")
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hold(benchShedRedirectHold)
+		http.Redirect(w, r, "https://example.com/", http.StatusMovedPermanently)
+	}).Methods("GET").Name(redirectRouteName)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: benchShedHeavyClients + benchShedRedirectClient},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		shed      int
+		wg        sync.WaitGroup
+	)
+	deadline := time.Now().Add(benchShedDuration)
+	for i := 0; i < benchShedHeavyClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				resp, err := client.Get(server.URL + "/analytics")
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusServiceUnavailable {
+					mu.Lock()
+					shed++
+					mu.Unlock()
+					// Clients honour Retry-After loosely; back off a little
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}()
+	}
+	for i := 0; i < benchShedRedirectClient; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				resp, err := client.Get(server.URL + "/aQ8YHAC1ZU")
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+				elapsed := time.Since(start)
+				mu.Lock()
+				latencies = append(latencies, elapsed)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := shedBenchResult{redirects: len(latencies), shed: shed}
+	if len(latencies) > 0 {
+		result.p50 = latencies[len(latencies)/2]
+		result.p99 = latencies[len(latencies)*99/100]
+	}
+	return result
+}
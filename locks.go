@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// DISTRIBUTED LEASE LOCKS
+// ============================================================================
+
+// InstanceID identifies this process when holding distributed locks
+var InstanceID = newInstanceID()
+
+// newInstanceID builds a hostname-pid-random identifier for this process
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// LeaseLock is a lock document in the locks collection
+type LeaseLock struct {
+	Name       string    `bson:"_id" json:"name"`
+	Holder     string    `bson:"holder" json:"holder"`
+	LockedAt   time.Time `bson:"locked_at" json:"locked_at"`
+	LockedTill time.Time `bson:"locked_until" json:"locked_until"`
+}
+
+// acquireLease tries to take (or renew) the named lease for holder. It succeeds when the
+// lease is free, expired (its previous holder died), or already held by the same holder.
+func acquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if DB == nil || DB.Database == nil {
+		return false, fmt.Errorf("database not connected")
+	}
+
+	now := time.Now().UTC()
+	filter := bson.D{
+		{Key: "_id", Value: name},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "locked_until", Value: bson.D{{Key: "$lte", Value: now}}}},
+			bson.D{{Key: "holder", Value: holder}},
+		}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "holder", Value: holder},
+		{Key: "locked_at", Value: now},
+		{Key: "locked_until", Value: now.Add(ttl)},
+	}}}
+
+	err := DB.Database.Collection("locks").FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetUpsert(true)).Err()
+	if err == nil || err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	// The upsert collides with the existing document when another holder owns a live lease
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// releaseLease frees the named lease if it is still held by holder
+func releaseLease(ctx context.Context, name, holder string) error {
+	if DB == nil || DB.Database == nil {
+		return fmt.Errorf("database not connected")
+	}
+	_, err := DB.Database.Collection("locks").UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: name}, {Key: "holder", Value: holder}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "locked_until", Value: time.Unix(0, 0).UTC()}}}})
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// LOG LEVELS AND REDACTION
+// ============================================================================
+
+// isDebugLogging reports whether LOG_LEVEL=debug is configured
+func isDebugLogging() bool {
+	return strings.EqualFold(os.Getenv("LOG_LEVEL"), "debug")
+}
+
+// debugf logs only when LOG_LEVEL=debug
+func debugf(format string, args ...interface{}) {
+	if isDebugLogging() {
+		log.Printf("[DEBUG] "+format, args...)
+	}
+}
+
+// redactURL strips credentials, query string and fragment from a URL before it is logged,
+// since destinations frequently carry tokens or personal data in their parameters
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		// Not parseable as an absolute URL: keep only what precedes any query marker
+		if i := strings.IndexAny(raw, "?#"); i >= 0 {
+			return raw[:i] + "?[redacted]"
+		}
+		return raw
+	}
+
+	redacted := parsed.Scheme + "://" + parsed.Host + parsed.EscapedPath()
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		redacted += "?[redacted]"
+	}
+	return redacted
+}
+
+// redactRequestURI hides the token of a public analytics share in an access log line, with
+// the query after it: the URL alone grants access to the share
+func redactRequestURI(uri string) string {
+	const sharePrefix = "/public/analytics/"
+	if !strings.HasPrefix(uri, sharePrefix) {
+		return uri
+	}
+	redacted := sharePrefix + "[redacted]"
+	if strings.ContainsAny(uri, "?#") {
+		redacted += "?[redacted]"
+	}
+	return redacted
+}
+
+// logLinkRequest logs a decoded link-creation request. Custom codes and tags are user content,
+// so the whole line is debug-only, and the long URL is redacted even then.
+func logLinkRequest(source, userID, longURL, custom string, tags []string) {
+	debugf("%s request: user=%s long_url=%s custom=%q tags=%q", source, userID, redactURL(longURL), custom, tags)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// OUTGOING MAIL
+// ============================================================================
+//
+// Account mails (so far only reactivation links) go through the SMTP server at SMTP_ADDR
+// (host:port) from SMTP_FROM, with PLAIN auth when SMTP_USERNAME is set (SMTP_PASSWORD).
+// Without SMTP_ADDR nothing is sent and the mail is written to the log instead, which is
+// enough for development but means users never receive it.
+
+// sendMail delivers a plain-text mail to one recipient
+func sendMail(to, subject, body string) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Printf("📧 SMTP_ADDR not set; mail to %s not sent:\nSubject: %s\n%s", to, subject, body)
+		return nil
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		return fmt.Errorf("SMTP_FROM is required with SMTP_ADDR")
+	}
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid recipient or subject")
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("SMTP_ADDR must be host:port: %v", err)
+		}
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	message := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(message))
+}
@@ -21,12 +21,24 @@ func main() {
 		log.Printf("Warning: .env file not found, using system environment variables: %v", err)
 	}
 
-	// Verify critical environment variables
-	if baseURL := os.Getenv("BASE_URL"); baseURL == "" {
-		log.Println("⚠️  BASE_URL not set, using default: http://localhost:8080")
-		os.Setenv("BASE_URL", "http://localhost:8080")
-	} else {
-		log.Printf("✅ BASE_URL loaded: %s", baseURL)
+	// Verify BASE_URL (an invalid one falls back to the default) and the proxy header settings
+	if err := InitBaseURL(); err != nil {
+		log.Fatalf("❌ Base URL configuration failed: %v", err)
+	}
+
+	// Serve short links under SHORT_PATH_PREFIX instead of the root, when set
+	if err := InitShortPathPrefix(); err != nil {
+		log.Fatalf("❌ Short link prefix configuration failed: %v", err)
+	}
+
+	// Load the dates of the deprecation registry
+	if err := InitDeprecations(); err != nil {
+		log.Fatalf("❌ Deprecation configuration failed: %v", err)
+	}
+
+	// Configure the proxy and per-host rate limit of outbound requests
+	if err := InitOutboundHTTP(); err != nil {
+		log.Fatalf("❌ Outbound HTTP configuration failed: %v", err)
 	}
 
 	// Initialize encryption for sensitive data
@@ -35,88 +47,108 @@ func main() {
 	}
 	log.Println("✅ Encryption initialized successfully!")
 
-	// Initialize MongoDB connection
-	if err := InitializeDatabase(); err != nil {
+	// Load the message catalogs of the HTML pages
+	if err := InitCatalogs(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	// Initialize the storage backend (MongoDB unless STORAGE_BACKEND=memory)
+	if err := InitStorage(); err != nil {
 		log.Fatalf("❌ %v", err)
 	}
 	defer CloseMongoDB()
 
+	// CLI modes: "backup" dumps collections, "restore <source>" re-imports a dump
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	// Ensure TTL index for demo_urls
-	if err := EnsureDemoURLTTLIndex(); err != nil {
-		log.Fatalf("❌ Failed to ensure TTL index for demo_urls: %v", err)
+	if usesMongo() {
+		if err := EnsureDemoURLTTLIndex(); err != nil && canCreateMongoIndexes() {
+			log.Fatalf("❌ Failed to ensure TTL index for demo_urls: %v", err)
+		}
+		if err := EnsureReservedCodes(); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
 	}
 
-	// Initialize JWT
-	InitJWT()
-	log.Println("✅ JWT initialized successfully!")
+	// Fill an empty development database with a demo account when SEED_DEMO_DATA is set
+	if err := InitDemoSeed(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Start cleanup worker for expired URLs
-	StartCleanupWorker()
+	// Concurrency budgets for redirects, the API and heavy API calls
+	if err := InitLoadShedding(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Create router with Gorilla Mux for better performance
-	r := mux.NewRouter()
+	// Forward clicks to an external analytics pipeline when CLICK_SINK_URL is set
+	if err := InitClickSink(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Add security middleware
-	r.Use(securityMiddleware)
+	// Country source and unknown-country policy of per-link country restrictions
+	if err := InitGeoRestrictions(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Authentication routes (public)
-	authRouter := r.PathPrefix("/auth").Subrouter()
-	authRouter.HandleFunc("/register", register).Methods("POST")
-	authRouter.HandleFunc("/login", login).Methods("POST")
-	authRouter.HandleFunc("/validate", validateToken).Methods("POST")
-	authRouter.HandleFunc("/refresh", refreshTokenHandler).Methods("POST")
+	// Fingerprint embedded assets and load favicon/robots.txt overrides
+	InitStaticAssets()
 
-	// Protected authentication route
-	authRouter.HandleFunc("/profile", JWTMiddleware(profile)).Methods("GET")
+	// CAPTCHA provider for abuse reports and the login failure gate
+	InitCaptcha()
 
-	// Protected URL shortening endpoint
-	r.HandleFunc("/url", JWTMiddleware(shorten)).Methods("PUT")
-	// Protected URL delete endpoint
-	r.HandleFunc("/url", JWTMiddleware(deleteShortURL)).Methods("DELETE")
+	// Initialize JWT
+	InitJWT()
+	log.Println("✅ JWT initialized successfully!")
 
-	// Protected bulk upload endpoint
-	r.HandleFunc("/bulk", JWTMiddleware(bulkShorten)).Methods("POST")
+	// Accept the access token from a cookie for browser sessions when COOKIE_AUTH is set
+	if err := InitCookieAuth(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Protected analytics endpoint
-	r.HandleFunc("/analytics", JWTMiddleware(analytics)).Methods("GET")
+	// Load CONFIG_FILE (block lists, rate limits, feature flags) and reload it on changes
+	if err := InitRuntimeConfig(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Public demo shortener endpoints
-	r.HandleFunc("/rapidlink-demo", rapidLinkDemo).Methods("PUT")
-	r.HandleFunc("/rapidlink-demo", getDemoURLs).Methods("GET")
+	// Load the disposable email domains checked at registration
+	if err := InitDisposableEmail(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Catch-all route to handle redirect via short_url
-	// This must be last to avoid conflicts
-	r.PathPrefix("/").HandlerFunc(redirect).Methods("GET")
+	// Threshold of the click spike alerts
+	if err := InitClickSpikes(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Add compression middleware for better performance
-	compressedHandler := handlers.CompressHandler(r)
+	// Start cleanup worker for expired URLs
+	StartCleanupWorker()
 
-	// Add CORS middleware for cross-origin requests (production: restrict origins)
-	allowedOrigins := []string{"*"} // TODO: Restrict in production
-	if corsOrigins := os.Getenv("ALLOWED_ORIGINS"); corsOrigins != "" {
-		allowedOrigins = strings.Split(corsOrigins, ",")
-	}
+	// Refresh link favicons and accent colors once a day
+	StartFaviconRefresh()
 
-	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins(allowedOrigins),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
-		handlers.AllowCredentials(),
-	)(compressedHandler)
+	// Keep the suspended accounts in memory so redirects can refuse their links
+	StartSuspensionRefresh()
 
-	// Add request logging middleware
-	loggedHandler := handlers.LoggingHandler(os.Stdout, corsHandler)
+	// Likewise the restricted accounts, for their lower quota and link interstitial
+	StartRestrictionRefresh()
 
-	// Configure server with optimized settings
-	server := &http.Server{
-		Addr:           ":8080",
-		Handler:        loggedHandler,
-		ReadTimeout:    15 * time.Second, // Time to read request
-		WriteTimeout:   15 * time.Second, // Time to write response
-		IdleTimeout:    60 * time.Second, // Time to keep connections alive
-		MaxHeaderBytes: 1 << 20,          // Max header size (1MB)
+	// Notify owners when links paused by their daily click limit resume
+	StartBudgetResumeWorker()
+
+	// Compare a daily sample of click counters with the click events
+	StartClickConsistencyWorker()
+
+	// Start the landing-page stats aggregation unless the endpoint is disabled
+	if publicStatsEnabled() {
+		StartPublicStatsWorker()
 	}
 
+	server := NewServer()
+
 	// Start server in a goroutine
 	go func() {
 		log.Println("🚀 Server starting...")
@@ -133,16 +165,60 @@ func main() {
 		log.Println("   Public:")
 		log.Println("     POST /auth/register - Create new user account")
 		log.Println("     POST /auth/login - Login and get JWT token")
-		log.Println("     POST /auth/validate - Validate JWT token")
+		log.Println("     GET|POST /auth/validate - Validate JWT token (body or Bearer header)")
+		log.Println("     POST /auth/logout - Revoke the refresh token and clear session cookies")
+		log.Println("     POST /auth/reactivate - Reactivate a paused account with the emailed token")
 		log.Println("     GET  /<short-url> - Redirect to long URL")
+		log.Println("     GET  /health - Health check with worker status")
+		log.Println("     GET  /metrics - Instance metrics")
+		log.Println("     POST /report - Report an abusive short link")
+		if publicStatsEnabled() {
+			log.Println("     GET  /stats/public - Rounded global counters for the landing page")
+		}
+		log.Println("     GET  /public/analytics/{token} - Read-only stats of a shared link or folder (JSON or page)")
 		log.Println("   Protected (requires Bearer token):")
 		log.Println("     GET  /auth/profile - Get user profile")
+		log.Println("     PUT  /auth/timezone - Set the time zone of engagement patterns")
+		log.Println("     GET  /auth/settings/export, POST /auth/settings/import - Move account settings between accounts")
+		log.Println("     POST /auth/deactivate - Pause the account and all its links (password required)")
 		log.Println("     PUT  /url - Create short URL")
-		log.Println("     POST /bulk - Bulk create short URLs from CSV")
-		log.Println("     GET  /analytics - Get URL analytics")
+		log.Println("     POST /url/preview - Preview (and optionally reserve) the code for a URL")
+		log.Println("     POST /bulk - Bulk create short URLs from CSV (file upload or {\"source_url\"})")
+		log.Println("     POST /bulk/resync/{job_id} - Create the new rows of a source_url import")
+		log.Println("     GET  /analytics - Get URL analytics (?folder_id=&subfolders=true)")
+		log.Println("     GET|POST /analytics/shares, DELETE /analytics/shares/{id} - Share a link's or folder's stats publicly")
+		log.Println("     GET|POST /folders, GET|PUT|DELETE /folders/{id} - Organize links in nested folders")
+		log.Println("     POST /folders/move, PUT /url/{code}/folder - Move links between folders")
+		log.Println("     GET  /usage - Your API calls per day and endpoint (?from=&to=)")
+		log.Println("     GET  /url/{code} - One of your links in full")
+		log.Println("     PATCH /url/{code} - Edit a link's destination, tags, expiry, active or pinned flag")
+		log.Println("     POST|DELETE /url/{code}/pin - Pin a link to the top of listings (max 50)")
+		log.Println("     PUT  /url/{code}/analytics - Turn click tracking of a link on or off (?purge=true)")
+		log.Println("     POST /url/{code}/recount - Recount a link's clicks from its click events")
+		log.Println("     GET|PUT /link-policy - Expire links never clicked after e.g. 180d (7-day notice)")
+		log.Println("   Admin (requires admin role):")
+		log.Println("     POST /admin/backup - Start a backup to BACKUP_DESTINATION")
+		log.Println("     GET  /admin/backups - List backup manifests")
+		log.Println("     GET  /admin/security-events - Stored security events (?request_id=&user_id=&event=)")
+		log.Println("     POST /admin/users/{id}/suspend|unsuspend - Take an account's links offline or restore them")
+		log.Println("     POST /admin/users/{id}/verify-email - Mark an account's email verified")
+		log.Println("     POST /admin/disposable-domains/reload - Reload the disposable email domain list")
+		log.Println("     POST /admin/reload - Reload block lists, rate limits and feature flags from CONFIG_FILE")
+		log.Println("     POST /admin/maintenance/{collection} - Prune an auxiliary collection per its retention policy now")
+		log.Println("     GET|POST /admin/encryption/reencrypt - Rewrite ciphertexts under the current ENCRYPTION_KEY (resumable)")
+		log.Println("     GET  /admin/features - Feature flags and their rollout rules")
+		log.Println("     POST /admin/urls/{code}/disable - Take a link offline and notify its owner")
+		log.Println("     POST /admin/recount?user_id= - Recount the clicks of a user's links from their click events")
+		log.Println("     GET  /admin/reports - Abuse reports by link; POST /admin/reports/{code}/dismiss|disable")
+		log.Println("     GET|PUT|DELETE /admin/domains/{host}/branding - Branding of a custom domain's pages")
+		log.Println("     POST /admin/impersonate - Short-lived token to act as a user for support")
+		log.Println("     GET  /admin/impersonation-log - Impersonation sessions and their actions")
+		log.Println("     GET  /admin/deprecation-usage - Consumers still using deprecated routes and parameters")
+		log.Println("     GET  /admin/required-permissions - Minimal MongoDB role and the startup privilege check")
+		log.Println("     GET  /api/v1/resolve?code= - Resolve link metadata without a click (public with ?sig=)")
 		log.Println("")
 		log.Printf("🌐 Server running on http://localhost%s", server.Addr)
-		log.Printf("🔧 Features: Compression ✓ | CORS ✓ | Request Logging ✓ | Graceful Shutdown ✓")
+		log.Printf("🔧 Features: Selective Compression ✓ | CORS ✓ | Request Logging ✓ | Graceful Shutdown ✓")
 		log.Printf("⚡ Optimizations: Connection Pool ✓ | Timeouts ✓ | Performance Routing ✓")
 		log.Printf("🛡️  Security: Input Validation ✓ | Encryption ✓ | Headers ✓ | Rate Limiting Ready ✓")
 		log.Println("")
@@ -169,14 +245,294 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	// Write queued clicks and hand buffered click events to the sink (or its outbox)
+	clicks.Drain(ctx)
+	if clickSinkEnabled() {
+		clickEvents.Drain(ctx)
+	}
+	// Write the API usage counters summed since the last flush
+	apiUsage.Drain(ctx)
+
 	// Close database connection
 	CloseMongoDB()
 	log.Println("✅ Server stopped gracefully")
 }
 
+// NewServer builds the HTTP server with every route and middleware. Storage, encryption and
+// JWT must be initialized first; the server is returned unstarted.
+func NewServer() *http.Server {
+	// Create router with Gorilla Mux for better performance
+	r := mux.NewRouter()
+
+	// Refuse requests beyond the per-class concurrency budgets before doing any work
+	r.Use(loadSheddingMiddleware)
+
+	// Count authenticated requests per user and endpoint for GET /usage
+	r.Use(usageMiddleware)
+
+	// Announce deprecated routes and parameters and record who still uses them
+	r.Use(deprecationMiddleware)
+
+	// Add security middleware
+	r.Use(securityMiddleware)
+
+	// Compress eligible responses (skips redirects, small bodies and event streams)
+	r.Use(compressionMiddleware)
+
+	// Authentication routes (public)
+	authRouter := r.PathPrefix("/auth").Subrouter()
+	authRouter.HandleFunc("/register", register).Methods("POST")
+	authRouter.HandleFunc("/login", login).Methods("POST")
+	authRouter.HandleFunc("/validate", validateToken).Methods("GET", "POST")
+	authRouter.HandleFunc("/refresh", refreshTokenHandler).Methods("POST")
+	authRouter.HandleFunc("/logout", logout).Methods("POST")
+	// Self-service account pause (password required) and its emailed reactivation token
+	authRouter.HandleFunc("/deactivate", JWTMiddleware(refuseImpersonation(deactivateAccount))).Methods("POST")
+	authRouter.HandleFunc("/reactivate", reactivateAccount).Methods("POST")
+
+	// Protected authentication route
+	authRouter.HandleFunc("/profile", JWTMiddleware(profile)).Methods("GET")
+	// Protected time zone setting (hours and days of engagement patterns)
+	authRouter.HandleFunc("/timezone", JWTMiddleware(setTimezone)).Methods("PUT")
+	// Protected settings export and idempotent import (tag rules, link policy, time zone, folders)
+	authRouter.HandleFunc("/settings/export", JWTMiddleware(exportSettings)).Methods("GET")
+	authRouter.HandleFunc("/settings/import", JWTMiddleware(importSettings)).Methods("POST")
+
+	// Protected URL shortening endpoint
+	r.HandleFunc("/url", JWTMiddleware(shorten)).Methods("PUT")
+	// Protected short-code preview endpoint (optionally reserves the code for 15 minutes)
+	r.HandleFunc("/url/preview", JWTMiddleware(previewShortURL)).Methods("POST")
+	// Protected URL delete endpoint
+	r.HandleFunc("/url", JWTMiddleware(deleteShortURL)).Methods("DELETE")
+	// Protected link detail endpoint (the full link in any state)
+	r.HandleFunc("/url/{code}", JWTMiddleware(getURL)).Methods("GET")
+	// Protected link edit endpoint (destination, tags, expiry, active and pinned flags)
+	r.HandleFunc("/url/{code}", JWTMiddleware(patchURL)).Methods("PATCH")
+	// Protected expiry extension endpoint
+	r.HandleFunc("/url/{code}/extend", JWTMiddleware(requireMongo(extendURL))).Methods("POST")
+	// Protected pin endpoints (pinned links come first in listings)
+	r.HandleFunc("/url/{code}/pin", JWTMiddleware(pinLink)).Methods("POST")
+	r.HandleFunc("/url/{code}/pin", JWTMiddleware(unpinLink)).Methods("DELETE")
+	// Protected per-link analytics switch (?purge=true deletes the clicks recorded so far)
+	r.HandleFunc("/url/{code}/analytics", JWTMiddleware(setLinkAnalytics)).Methods("PUT")
+	// Protected click recount (counters rebuilt from the link's click events)
+	r.HandleFunc("/url/{code}/recount", JWTMiddleware(recountURL)).Methods("POST")
+	// Protected signed-access endpoint for private links
+	r.HandleFunc("/url/{code}/sign", JWTMiddleware(requireMongo(signURL))).Methods("POST")
+	// Protected share kit endpoint (short URL, QR code, metadata and clicks in one call)
+	r.HandleFunc("/url/{code}/kit", JWTMiddleware(linkKit)).Methods("GET")
+	// Protected social card endpoint (1200x630 PNG, ?style=light|dark)
+	r.HandleFunc("/url/{code}/card", JWTMiddleware(linkCard)).Methods("GET")
+	// Protected click history endpoint (keyset-paginated, ?cursor=&limit=&from=&to=&device=&bot=)
+	r.HandleFunc("/url/{code}/clicks", JWTMiddleware(listLinkClicks)).Methods("GET")
+	// Protected daily click export, streamed as NDJSON or CSV (?date=&format=&cursor=&limit=)
+	r.HandleFunc("/analytics/clicks/export", JWTMiddleware(exportClicks)).Methods("GET")
+	r.HandleFunc("/url/{code}/clicks/export", JWTMiddleware(exportClicks)).Methods("GET")
+	// Where a link was shared, for correlating click spikes (owner only)
+	r.HandleFunc("/url/{code}/shares", JWTMiddleware(createShareEvent)).Methods("POST")
+	r.HandleFunc("/url/{code}/shares", JWTMiddleware(listShareEvents)).Methods("GET")
+	// Public read-only analytics links for a link or folder (owner manages, anyone with the URL reads)
+	r.HandleFunc("/analytics/shares", JWTMiddleware(createAnalyticsShare)).Methods("POST")
+	r.HandleFunc("/analytics/shares", JWTMiddleware(listAnalyticsShares)).Methods("GET")
+	r.HandleFunc("/analytics/shares/{id}", JWTMiddleware(revokeAnalyticsShare)).Methods("DELETE")
+	r.HandleFunc("/public/analytics/{token}", publicAnalyticsShare).Methods("GET", "POST")
+	// Protected click attribution of a share event (window after it vs. before it)
+	r.HandleFunc("/url/{code}/shares/{id}/attribution", JWTMiddleware(shareAttribution)).Methods("GET")
+
+	// Protected auto-tagging rules endpoints (replace with PUT; apply runs them over existing links)
+	r.HandleFunc("/tag-rules", JWTMiddleware(getTagRules)).Methods("GET")
+	r.HandleFunc("/tag-rules", JWTMiddleware(putTagRules)).Methods("PUT")
+	r.HandleFunc("/tag-rules/apply", JWTMiddleware(applyTagRulesToLinks)).Methods("POST")
+	// Account policy expiring never-clicked links
+	r.HandleFunc("/link-policy", JWTMiddleware(requireMongo(getLinkPolicy))).Methods("GET")
+	r.HandleFunc("/link-policy", JWTMiddleware(requireMongo(putLinkPolicy))).Methods("PUT")
+
+	// Protected folder endpoints (DELETE of a non-empty folder needs ?move_to=<id|root>)
+	r.HandleFunc("/folders", JWTMiddleware(listFolders)).Methods("GET")
+	r.HandleFunc("/folders", JWTMiddleware(createFolder)).Methods("POST")
+	r.HandleFunc("/folders/move", JWTMiddleware(moveLinksToFolder)).Methods("POST")
+	r.HandleFunc("/folders/{id}", JWTMiddleware(getFolder)).Methods("GET")
+	r.HandleFunc("/folders/{id}", JWTMiddleware(updateFolder)).Methods("PUT")
+	r.HandleFunc("/folders/{id}", JWTMiddleware(deleteFolder)).Methods("DELETE")
+	r.HandleFunc("/url/{code}/folder", JWTMiddleware(moveLinkToFolder)).Methods("PUT")
+
+	// Protected bulk upload endpoint
+	r.HandleFunc("/bulk", JWTMiddleware(requireMongo(bulkShorten))).Methods("POST")
+	// Fetch a source_url import again and create only its new rows
+	r.HandleFunc("/bulk/resync/{job_id}", JWTMiddleware(requireMongo(bulkResync))).Methods("POST")
+
+	// Protected analytics endpoint
+	r.HandleFunc("/analytics", JWTMiddleware(analytics)).Methods("GET")
+
+	// Protected API usage endpoint (the caller's own daily call counts and rate-limit rejections)
+	r.HandleFunc("/usage", JWTMiddleware(getUsage)).Methods("GET")
+
+	// Link metadata resolve endpoint (owner via Bearer token, or public with ?sig=)
+	r.HandleFunc("/api/v1/resolve", resolveLink).Methods("GET")
+
+	// Public abuse report endpoint (always 202; rate limited per IP)
+	r.HandleFunc("/report", reportLink).Methods("POST")
+
+	// Operational endpoints
+	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+
+	// Public landing-page counters (PUBLIC_STATS_ENABLED=false removes the route)
+	if publicStatsEnabled() {
+		r.HandleFunc("/stats/public", publicStats).Methods("GET")
+	}
+
+	// Browser and crawler housekeeping files (must precede the catch-all)
+	r.HandleFunc("/favicon.ico", favicon).Methods("GET", "HEAD")
+	r.HandleFunc("/robots.txt", robotsTxt).Methods("GET", "HEAD")
+	// Fingerprinted embedded assets (immutable) and their plain names (revalidated)
+	r.HandleFunc("/static/{name}", serveStatic).Methods("GET", "HEAD")
+	// Logo of the custom domain the request was sent to
+	r.HandleFunc("/branding/logo", brandingLogo).Methods("GET", "HEAD")
+
+	// Admin endpoints (require the admin role)
+	adminRouter := r.PathPrefix("/admin").Subrouter()
+	adminRouter.HandleFunc("/backup", AdminMiddleware(requireMongo(adminBackup))).Methods("POST")
+	adminRouter.HandleFunc("/backups", AdminMiddleware(requireMongo(adminListBackups))).Methods("GET")
+	adminRouter.HandleFunc("/security-events", AdminMiddleware(requireMongo(adminSecurityEvents))).Methods("GET")
+	adminRouter.HandleFunc("/urls/{code}", AdminMiddleware(adminInspectURL)).Methods("GET")
+	adminRouter.HandleFunc("/urls/{code}/disable", AdminMiddleware(adminDisableURL)).Methods("POST")
+	adminRouter.HandleFunc("/recount", AdminMiddleware(adminRecount)).Methods("POST")
+	// Abuse report review queue; a link is dismissed (flag lifted) or disabled
+	adminRouter.HandleFunc("/reports", AdminMiddleware(adminListReports)).Methods("GET")
+	adminRouter.HandleFunc("/reports/{code}/dismiss", AdminMiddleware(adminDismissReports)).Methods("POST")
+	adminRouter.HandleFunc("/reports/{code}/disable", AdminMiddleware(adminDisableReported)).Methods("POST")
+	// Suspending an account takes its links offline (410) until it is restored
+	adminRouter.HandleFunc("/users/{id}/suspend", AdminMiddleware(adminSetUserActive(false))).Methods("POST")
+	adminRouter.HandleFunc("/users/{id}/unsuspend", AdminMiddleware(adminSetUserActive(true))).Methods("POST")
+	// Lift the disposable-email restriction (with the 24h account age) and reload the domain list
+	adminRouter.HandleFunc("/users/{id}/verify-email", AdminMiddleware(adminVerifyEmail)).Methods("POST")
+	adminRouter.HandleFunc("/disposable-domains/reload", AdminMiddleware(adminReloadDisposableDomains)).Methods("POST")
+	// Re-read CONFIG_FILE, like SIGHUP
+	adminRouter.HandleFunc("/reload", AdminMiddleware(adminReloadConfig)).Methods("POST")
+	// Retention maintenance of one auxiliary collection, outside the hourly cleanup run
+	adminRouter.HandleFunc("/maintenance/{collection}", AdminMiddleware(requireMongo(adminRunMaintenance))).Methods("POST")
+	// Rewrite stored ciphertexts under the current ENCRYPTION_KEY after a key rotation
+	adminRouter.HandleFunc("/encryption/reencrypt", AdminMiddleware(requireMongo(adminStartReencryption))).Methods("POST")
+	adminRouter.HandleFunc("/encryption/reencrypt", AdminMiddleware(requireMongo(adminReencryptionStatus))).Methods("GET")
+	// Feature flags with their defaults and the CONFIG_FILE rules in effect
+	adminRouter.HandleFunc("/features", AdminMiddleware(adminListFeatures)).Methods("GET")
+	// Logo, color, support email and footer of the pages served on a custom domain
+	adminRouter.HandleFunc("/domains/{host}/branding", AdminMiddleware(adminGetBranding)).Methods("GET")
+	adminRouter.HandleFunc("/domains/{host}/branding", AdminMiddleware(adminPutBranding)).Methods("PUT")
+	adminRouter.HandleFunc("/domains/{host}/branding", AdminMiddleware(adminDeleteBranding)).Methods("DELETE")
+	// Short-lived tokens for support to see what a user sees, and the log of those sessions
+	adminRouter.HandleFunc("/impersonate", AdminMiddleware(requireMongo(adminImpersonate))).Methods("POST")
+	adminRouter.HandleFunc("/impersonation-log", AdminMiddleware(requireMongo(adminImpersonationLog))).Methods("GET")
+	// Who still uses each deprecated surface on this instance
+	adminRouter.HandleFunc("/deprecation-usage", AdminMiddleware(adminDeprecationUsage)).Methods("GET")
+	// Minimal MongoDB role of the server and what the startup probe found
+	adminRouter.HandleFunc("/required-permissions", AdminMiddleware(adminRequiredPermissions)).Methods("GET")
+
+	// Public demo shortener endpoints
+	r.HandleFunc("/rapidlink-demo", requireMongo(rapidLinkDemo)).Methods("PUT")
+	r.HandleFunc("/rapidlink-demo", requireMongo(getDemoURLs)).Methods("GET")
+	r.HandleFunc("/rapidlink-demo/{code}/stats", requireMongo(getDemoURLStats)).Methods("GET")
+
+	// Catch-all route to handle redirect via short_url, under SHORT_PATH_PREFIX when set
+	// This must be last to avoid conflicts
+	if shortPathPrefix != "" {
+		r.HandleFunc("/", rootLanding).Methods("GET", "HEAD")
+	}
+	r.PathPrefix(shortPathPrefix + "/").HandlerFunc(redirect).Methods("GET").Name(redirectRouteName)
+
+	// JSON (or HTML for browsers) 404/405 responses with security headers and an Allow header
+	r.NotFoundHandler = notFoundHandler()
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	// Add CORS middleware for cross-origin requests (production: restrict origins)
+	allowedOrigins := []string{"*"} // TODO: Restrict in production
+	if corsOrigins := os.Getenv("ALLOWED_ORIGINS"); corsOrigins != "" {
+		allowedOrigins = strings.Split(corsOrigins, ",")
+	}
+
+	corsHandler := handlers.CORS(
+		handlers.AllowedOrigins(allowedOrigins),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", csrfTokenHeader, "If-Unmodified-Since", "X-Share-Passcode"}),
+		handlers.ExposedHeaders([]string{"Deprecation", "Sunset", "Link"}),
+		handlers.AllowCredentials(),
+	)(r)
+	// OPTIONS without an Origin is not a preflight; the router answers it with an Allow header
+	withCORS := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodOptions && req.Header.Get("Origin") == "" {
+			r.ServeHTTP(w, req)
+			return
+		}
+		corsHandler.ServeHTTP(w, req)
+	})
+
+	// Add request logging middleware; the request ID wraps it so access log lines carry the ID
+	loggedHandler := requestIDMiddleware(handlers.CustomLoggingHandler(os.Stdout, withCORS, accessLogFormatter))
+
+	// Configure server with optimized settings
+	server := &http.Server{
+		Addr:           ":8080",
+		Handler:        loggedHandler,
+		ReadTimeout:    15 * time.Second, // Time to read request
+		WriteTimeout:   15 * time.Second, // Time to write response
+		IdleTimeout:    60 * time.Second, // Time to keep connections alive
+		MaxHeaderBytes: 1 << 20,          // Max header size (1MB)
+	}
+
+	return server
+}
+
+// runCommand executes a one-shot CLI mode instead of starting the server
+func runCommand(args []string) {
+	// The compression benchmark runs in process and needs no database
+	if args[0] == "bench-compression" {
+		if err := runCompressionBenchmark(); err != nil {
+			log.Fatalf("❌ Compression benchmark failed: %v", err)
+		}
+		return
+	}
+	if DB == nil {
+		log.Fatalf("❌ %s requires a database connection", args[0])
+	}
+
+	switch args[0] {
+	case "backup":
+		manifest, err := StartBackup("cli", "")
+		if err != nil {
+			log.Fatalf("❌ Backup failed: %v", err)
+		}
+		for _, c := range manifest.Collections {
+			log.Printf("   %s: %d documents, %d bytes, sha256 %s -> %s", c.Name, c.Count, c.Bytes, c.SHA256, c.Location)
+		}
+		log.Printf("✅ Backup %s completed in %dms", manifest.ID.Hex(), manifest.DurationMS)
+	case "restore":
+		if len(args) < 2 {
+			log.Fatalf("❌ Usage: %s restore <backup directory or s3://bucket/prefix/timestamp>", os.Args[0])
+		}
+		if err := RunRestore(args[1]); err != nil {
+			log.Fatalf("❌ Restore failed: %v", err)
+		}
+		log.Println("✅ Restore completed")
+	case "bench-analytics":
+		if err := runAnalyticsBenchmark(); err != nil {
+			log.Fatalf("❌ Analytics benchmark failed: %v", err)
+		}
+	case "bench-profile":
+		if err := runProfileBenchmark(); err != nil {
+			log.Fatalf("❌ Profile benchmark failed: %v", err)
+		}
+	default:
+		log.Fatalf("❌ Unknown command %q (available: backup, restore, bench-analytics, bench-profile, bench-compression)", args[0])
+	}
+}
+
 // securityMiddleware adds security headers and validation to all requests
 func securityMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Tag the request with its route for the access log and security events
+		recordRoute(r)
+
 		// Add security headers to all responses
 		addSecurityHeaders(w)
 
@@ -184,25 +540,33 @@ func securityMiddleware(next http.Handler) http.Handler {
 		if r.Method == "POST" || r.Method == "PUT" {
 			contentType := r.Header.Get("Content-Type")
 			if !isValidContentType(contentType) {
-				logSecurityEvent("INVALID_CONTENT_TYPE", "", getClientIP(r), r.UserAgent(),
+				logSecurityEvent(r.Context(), "INVALID_CONTENT_TYPE", "", getClientIP(r), r.UserAgent(),
 					"Invalid content type: "+contentType, "WARN")
 				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
 				return
 			}
 		}
 
-		// Basic rate limiting check (can be enhanced)
+		// Housekeeping files skip rate limiting and security logging entirely
+		if isQuietPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Basic rate limiting check, with the "global" policy of the live configuration
 		clientIP := getClientIP(r)
-		if checkRateLimit(clientIP, 100, time.Minute) {
-			logSecurityEvent("RATE_LIMIT_EXCEEDED", "", clientIP, r.UserAgent(),
+		policy := requestConfig(r).RateLimit("global")
+		if limit := checkRateLimit(rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+			requestInfoFrom(r.Context()).RateLimited = true
+			logSecurityEvent(r.Context(), "RATE_LIMIT_EXCEEDED", "", clientIP, r.UserAgent(),
 				"Rate limit exceeded", "WARN")
-			http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			writeRateLimited(w, limit)
 			return
 		}
 
 		// Log security events for sensitive endpoints
 		if r.Method == "POST" && (strings.Contains(r.URL.Path, "/auth/") || strings.Contains(r.URL.Path, "/url")) {
-			logSecurityEvent("API_ACCESS", "", clientIP, r.UserAgent(),
+			logSecurityEvent(r.Context(), "API_ACCESS", "", clientIP, r.UserAgent(),
 				r.Method+" "+r.URL.Path, "INFO")
 		}
 
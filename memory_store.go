@@ -0,0 +1,1377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// IN-MEMORY STORE
+// ============================================================================
+//
+// memoryStore backs STORAGE_BACKEND=memory for local development and demos without a
+// MongoDB instance. It is safe for concurrent use; nothing survives a restart.
+
+type memoryStore struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]*User
+	links map[string]*URLData // keyed by short code
+	// shares holds share events by link ID, oldest first
+	shares map[primitive.ObjectID][]ShareEvent
+	usage  map[usageKey]*UsageCount
+	// reports holds abuse reports, oldest first
+	reports []AbuseReport
+	// branding is keyed by host
+	branding map[string]DomainBranding
+	// dailyClicks holds the click budget counters
+	dailyClicks map[dailyClickKey]*dailyClickCounter
+	// outcomes holds the redirect outcome counters
+	outcomes map[linkOutcomeKey]int64
+	folders  map[primitive.ObjectID]*Folder
+	// analyticsShares holds public analytics shares, oldest first
+	analyticsShares []AnalyticsShare
+}
+
+// dailyClickKey identifies a link's click budget counter for one day
+type dailyClickKey struct {
+	linkID primitive.ObjectID
+	day    string
+}
+
+type dailyClickCounter struct {
+	clicks    int
+	expiresAt time.Time
+}
+
+// linkOutcomeKey identifies a link's counter of one redirect outcome on one UTC day
+type linkOutcomeKey struct {
+	urlID   primitive.ObjectID
+	day     time.Time
+	outcome string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:       make(map[primitive.ObjectID]*User),
+		links:       make(map[string]*URLData),
+		shares:      make(map[primitive.ObjectID][]ShareEvent),
+		usage:       make(map[usageKey]*UsageCount),
+		branding:    make(map[string]DomainBranding),
+		dailyClicks: make(map[dailyClickKey]*dailyClickCounter),
+		outcomes:    make(map[linkOutcomeKey]int64),
+		folders:     make(map[primitive.ObjectID]*Folder),
+	}
+}
+
+func (s *memoryStore) CreateUser(_ context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.IsActive && (u.Username == user.Username || u.Email == user.Email) {
+			return ErrDuplicate
+		}
+	}
+	user.ID = primitive.NewObjectID()
+	stored := *user
+	s.users[user.ID] = &stored
+	return nil
+}
+
+func (s *memoryStore) FindUserByLogin(_ context.Context, usernameOrEmail string) (*User, error) {
+	return s.findUser(func(u *User) bool {
+		return u.IsActive && (u.Username == usernameOrEmail || u.Email == usernameOrEmail)
+	})
+}
+
+func (s *memoryStore) GetUserByID(_ context.Context, id primitive.ObjectID) (*User, error) {
+	return s.findUser(func(u *User) bool { return u.ID == id && u.IsActive })
+}
+
+func (s *memoryStore) FindUserByRefreshToken(_ context.Context, hashed string) (*User, error) {
+	if hashed == "" {
+		return nil, ErrNotFound
+	}
+	return s.findUser(func(u *User) bool { return u.RefreshToken == hashed })
+}
+
+func (s *memoryStore) SetRefreshToken(_ context.Context, id primitive.ObjectID, hashed string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil // matches an update that matched nothing
+	}
+	if hashed == "" {
+		expiry = time.Time{}
+	}
+	u.RefreshToken, u.RefreshTokenExpiry = hashed, expiry
+	return nil
+}
+
+func (s *memoryStore) SetTagRules(_ context.Context, id primitive.ObjectID, rules []TagRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[id]; ok {
+		u.TagRules = rules
+	}
+	return nil
+}
+
+func (s *memoryStore) SetTimezone(_ context.Context, id primitive.ObjectID, timezone string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[id]; ok {
+		u.Timezone = timezone
+	}
+	return nil
+}
+
+func (s *memoryStore) SetUserActive(_ context.Context, id primitive.ObjectID, active bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return false, nil
+	}
+	u.IsActive, u.DeactivatedAt = active, time.Time{}
+	return true, nil
+}
+
+func (s *memoryStore) DeactivateUser(_ context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok || !u.IsActive {
+		return false, nil
+	}
+	u.IsActive, u.DeactivatedAt = false, at
+	u.RefreshToken, u.RefreshTokenExpiry = "", time.Time{}
+	return true, nil
+}
+
+func (s *memoryStore) FindDeactivatedUser(_ context.Context, usernameOrEmail string) (*User, error) {
+	return s.findUser(func(u *User) bool {
+		return !u.IsActive && !u.DeactivatedAt.IsZero() && (u.Username == usernameOrEmail || u.Email == usernameOrEmail)
+	})
+}
+
+func (s *memoryStore) ReactivateUser(_ context.Context, id primitive.ObjectID, deactivatedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok || u.IsActive || u.DeactivatedAt.IsZero() || !u.DeactivatedAt.Equal(deactivatedAt) {
+		return false, nil
+	}
+	u.IsActive, u.DeactivatedAt = true, time.Time{}
+	return true, nil
+}
+
+func (s *memoryStore) InactiveUserIDs(context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for id, u := range s.users {
+		if !u.IsActive {
+			ids = append(ids, id.Hex())
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) RestrictedUserIDs(_ context.Context, youngerThan time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for id, u := range s.users {
+		if u.Restricted && u.IsActive && (!u.EmailVerified || u.CreatedAt.After(youngerThan)) {
+			ids = append(ids, id.Hex())
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) SetEmailVerified(_ context.Context, id primitive.ObjectID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return false, nil
+	}
+	u.EmailVerified = true
+	return true, nil
+}
+
+func (s *memoryStore) AddUsage(_ context.Context, counts []UsageCount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, count := range counts {
+		key := usageKey{userID: count.UserID, day: count.Day, endpoint: count.Endpoint}
+		stored, ok := s.usage[key]
+		if !ok {
+			stored = &UsageCount{UserID: count.UserID, Day: count.Day, Endpoint: count.Endpoint}
+			s.usage[key] = stored
+		}
+		stored.Requests += count.Requests
+		stored.RateLimited += count.RateLimited
+	}
+	cutoff := usageDay(clock.Now()).AddDate(0, 0, -usageRetentionDays)
+	for key := range s.usage {
+		if key.day.Before(cutoff) {
+			delete(s.usage, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListUsage(_ context.Context, userID string, from, to time.Time) ([]UsageCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var counts []UsageCount
+	for key, count := range s.usage {
+		if key.userID == userID && !key.day.Before(from) && key.day.Before(to) {
+			counts = append(counts, *count)
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) findUser(match func(*User) bool) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if match(u) {
+			found := *u
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) InsertLink(_ context.Context, link *URLData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, taken := s.links[link.ShortURL]; taken {
+		return ErrDuplicate
+	}
+	link.ID = primitive.NewObjectID()
+	s.links[link.ShortURL] = copyLink(link)
+	return nil
+}
+
+func (s *memoryStore) FindLinkByCode(_ context.Context, code string) (*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if link, ok := s.links[code]; ok {
+		return copyLink(link), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) FindRedirectTarget(_ context.Context, code string) (*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	link, ok := s.links[code]
+	if !ok || !link.IsActive || isExpiredAt(link.ExpiresAt, clock.Now()) {
+		return nil, ErrNotFound
+	}
+	return copyLink(link), nil
+}
+
+func (s *memoryStore) FindActiveLink(_ context.Context, userID, longURL, domain string) (*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, link := range s.links {
+		if link.IsActive && link.UserID == userID && link.LongURL == longURL && link.Domain == domain {
+			return copyLink(link), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) FindExpiredDuplicate(_ context.Context, userID, longURL, domain string) (*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var latest *URLData
+	for _, link := range s.links {
+		if link.IsActive || link.DeactivatedReason != DeactivatedExpired ||
+			link.UserID != userID || link.LongURL != longURL || link.Domain != domain {
+			continue
+		}
+		if latest == nil || (link.ExpiresAt != nil && (latest.ExpiresAt == nil || link.ExpiresAt.After(*latest.ExpiresAt))) {
+			latest = link
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	return copyLink(latest), nil
+}
+
+func (s *memoryStore) ReviveLink(_ context.Context, link *URLData, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID || stored.IsActive || stored.DeactivatedReason != DeactivatedExpired {
+		return false, nil
+	}
+	for _, other := range s.links {
+		if other.IsActive && other.UserID == stored.UserID && other.LongURL == stored.LongURL && other.Domain == stored.Domain {
+			return false, ErrDuplicate
+		}
+	}
+	now := clock.Now()
+	expiry := expiresAt
+	stored.IsActive = true
+	stored.DeactivatedReason = ""
+	stored.ExpiresAt = &expiry
+	stored.UpdatedAt = &now
+	return true, nil
+}
+
+func (s *memoryStore) RecordClick(_ context.Context, link *URLData, click ClickHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID {
+		return nil
+	}
+	stored.Clicks++
+	if click.Branch != "" {
+		if stored.DeepLinkClicks == nil {
+			stored.DeepLinkClicks = make(map[string]int)
+		}
+		stored.DeepLinkClicks[click.Branch]++
+	}
+	clickedAt := click.Timestamp
+	stored.LastClicked = &clickedAt
+	stored.ClickHistory = append(stored.ClickHistory, click)
+	return nil
+}
+
+func (s *memoryStore) RecordBlockedClick(_ context.Context, link *URLData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.links[link.ShortURL]; ok && stored.ID == link.ID {
+		stored.BlockedClicks++
+	}
+	return nil
+}
+
+func (s *memoryStore) AddLinkOutcomes(_ context.Context, counts []LinkOutcomeCount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, count := range counts {
+		s.outcomes[linkOutcomeKey{urlID: count.URLID, day: count.Day, outcome: count.Outcome}] += count.Count
+	}
+	cutoff := usageDay(clock.Now()).AddDate(0, 0, -outcomeRetentionDays)
+	for key := range s.outcomes {
+		if key.day.Before(cutoff) {
+			delete(s.outcomes, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListLinkOutcomes(_ context.Context, link *URLData, from, to time.Time) ([]LinkOutcomeCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var counts []LinkOutcomeCount
+	for key, count := range s.outcomes {
+		if key.urlID == link.ID && !key.day.Before(from) && key.day.Before(to) {
+			counts = append(counts, LinkOutcomeCount{URLID: key.urlID, Day: key.day, Outcome: key.outcome, Count: count})
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) CountDailyClick(_ context.Context, link *URLData, day string, keepUntil time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := dailyClickKey{linkID: link.ID, day: day}
+	counter, ok := s.dailyClicks[key]
+	if !ok {
+		counter = &dailyClickCounter{expiresAt: keepUntil}
+		s.dailyClicks[key] = counter
+	}
+	counter.clicks++
+	return counter.clicks, nil
+}
+
+func (s *memoryStore) PauseLink(_ context.Context, link *URLData, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID || (stored.PausedUntil != nil && !stored.PausedUntil.Before(until)) {
+		return false, nil
+	}
+	pausedUntil := until
+	stored.PausedUntil = &pausedUntil
+	return true, nil
+}
+
+func (s *memoryStore) ResumePausedLinks(_ context.Context, now time.Time, limit int) ([]*URLData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resumed := []*URLData{}
+	for _, link := range s.links {
+		if len(resumed) >= limit {
+			break
+		}
+		if link.PausedUntil != nil && !link.PausedUntil.After(now) {
+			resumed = append(resumed, copyLink(link))
+			link.PausedUntil = nil
+		}
+	}
+	for key, counter := range s.dailyClicks {
+		if !counter.expiresAt.After(now) {
+			delete(s.dailyClicks, key)
+		}
+	}
+	return resumed, nil
+}
+
+func (s *memoryStore) CountActiveLinks(_ context.Context, userID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var n int64
+	for _, link := range s.links {
+		if link.IsActive && link.UserID == userID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ListLinks computes the same page and statistics as the MongoDB $facet aggregation
+func (s *memoryStore) ListLinks(_ context.Context, userID string, filter LinkFilter, skip, limit int, withStats bool, _ []string) ([]map[string]interface{}, int64, map[string]interface{}, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	if skip < 0 {
+		skip = 0
+	}
+
+	now := clock.Now()
+	s.mu.RLock()
+	var owned, listed, all []*URLData
+	for _, link := range s.links {
+		if link.UserID != userID {
+			continue
+		}
+		all = append(all, link)
+		if link.IsActive {
+			owned = append(owned, copyLink(link))
+		}
+		if filter.matches(link, now) {
+			listed = append(listed, copyLink(link))
+		}
+	}
+	statusCounts := statusCountsOf(all, now)
+	s.mu.RUnlock()
+
+	// Pinned first, then newest first; the short code breaks ties so pages are stable
+	sort.Slice(listed, func(i, j int) bool {
+		if listed[i].Pinned != listed[j].Pinned {
+			return listed[i].Pinned
+		}
+		if !listed[i].CreatedAt.Equal(listed[j].CreatedAt) {
+			return listed[i].CreatedAt.After(listed[j].CreatedAt)
+		}
+		return listed[i].ShortURL < listed[j].ShortURL
+	})
+
+	page := []map[string]interface{}{}
+	for i := skip; i < len(listed) && i < skip+limit; i++ {
+		doc := linkSummary(listed[i])
+		if listed[i].DeepLink != nil {
+			doc["deep_link"] = listed[i].DeepLink
+		}
+		if len(listed[i].DeepLinkClicks) > 0 {
+			doc["deep_link_clicks"] = listed[i].DeepLinkClicks
+		}
+		page = append(page, doc)
+	}
+
+	total := int64(len(listed))
+	if !withStats {
+		return page, total, nil, nil
+	}
+	stats := memoryLinkStats(owned)
+	stats["status_counts"] = statusCounts
+	return page, total, stats, nil
+}
+
+func (s *memoryStore) PinLink(_ context.Context, userID, code string, pinned bool, limit int) (*URLData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok || link.UserID != userID || !link.IsActive {
+		return nil, ErrNotFound
+	}
+	if pinned {
+		count := 0
+		for _, other := range s.links {
+			if other.UserID == userID && other.IsActive && other.Pinned && other.ShortURL != code {
+				count++
+			}
+		}
+		if count >= limit {
+			return nil, ErrLimitReached
+		}
+	}
+	now := clock.Now()
+	link.Pinned = pinned
+	link.UpdatedAt = &now
+	return copyLink(link), nil
+}
+
+func (s *memoryStore) SetLinkAnalytics(_ context.Context, userID, code string, disabled, purge bool) (*URLData, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok || link.UserID != userID || !link.IsActive {
+		return nil, 0, ErrNotFound
+	}
+	now := clock.Now()
+	link.AnalyticsDisabled = disabled
+	link.UpdatedAt = &now
+	var purged int64
+	if purge {
+		purged = int64(len(link.ClickHistory))
+		link.Clicks = 0
+		link.ClickHistory = nil
+		link.DeepLinkClicks = nil
+		link.LastClicked = nil
+		for key := range s.outcomes {
+			if key.urlID == link.ID {
+				delete(s.outcomes, key)
+			}
+		}
+	}
+	return copyLink(link), purged, nil
+}
+
+func (s *memoryStore) EditLink(_ context.Context, link *URLData, edit LinkEdit) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID || stored.UserID != link.UserID || !sameVersion(stored.UpdatedAt, link.UpdatedAt) {
+		return false, nil
+	}
+	longURL := stored.LongURL
+	if edit.LongURL != nil {
+		longURL = *edit.LongURL
+	}
+	active := stored.IsActive
+	if edit.Active != nil {
+		active = *edit.Active
+	}
+	if active {
+		for _, other := range s.links {
+			if other != stored && other.IsActive && other.UserID == stored.UserID && other.LongURL == longURL && other.Domain == stored.Domain {
+				return false, ErrDuplicate
+			}
+		}
+	}
+	if edit.Pinned != nil && *edit.Pinned {
+		count := 0
+		for _, other := range s.links {
+			if other != stored && other.UserID == stored.UserID && other.IsActive && other.Pinned {
+				count++
+			}
+		}
+		if count >= edit.PinLimit {
+			return false, ErrLimitReached
+		}
+	}
+	if edit.LongURL != nil {
+		stored.LongURL = longURL
+		stored.ResolvedDestination = ""
+		stored.RedirectChainLength = 0
+		stored.FaviconURL = ""
+		stored.FaviconData = ""
+		stored.AccentColor = ""
+		stored.FaviconFetchedAt = nil
+	}
+	if edit.Tags != nil {
+		stored.Tags = append([]string(nil), (*edit.Tags)...)
+	}
+	if edit.ExpiresAt != nil {
+		expiry := *edit.ExpiresAt
+		stored.ExpiresAt = &expiry
+	}
+	if edit.Active != nil {
+		stored.IsActive = active
+		stored.DeactivatedReason = ""
+		if !active {
+			stored.DeactivatedReason = DeactivatedByOwner
+		}
+	}
+	if edit.PublicNote != nil {
+		stored.PublicNote = *edit.PublicNote
+	}
+	if edit.Internal != nil {
+		stored.Internal = *edit.Internal
+	}
+	if edit.Pinned != nil {
+		stored.Pinned = *edit.Pinned
+	}
+	now := clock.Now()
+	stored.UpdatedAt = &now
+	return true, nil
+}
+
+func (s *memoryStore) DeactivateLink(_ context.Context, userID, code, reason string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok || link.UserID != userID {
+		return false, nil
+	}
+	now := clock.Now()
+	link.IsActive = false
+	link.DeactivatedReason = reason
+	link.UpdatedAt = &now
+	return true, nil
+}
+
+func (s *memoryStore) CodeHolder(ctx context.Context, code string) (*CodeReservation, error) {
+	return linkCodeHolder(ctx, s, code)
+}
+
+func (s *memoryStore) ReleaseDraft(_ context.Context, code string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok || link.DeactivatedReason != DeactivatedDraft {
+		return false, nil
+	}
+	delete(s.links, code)
+	return true, nil
+}
+
+func (s *memoryStore) SetFavicon(_ context.Context, link *URLData, favicon LinkFavicon) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID {
+		return nil
+	}
+	stored.FaviconURL = favicon.URL
+	stored.FaviconData = favicon.Data
+	stored.AccentColor = favicon.AccentColor
+	if favicon.FetchedAt != nil {
+		fetchedAt := *favicon.FetchedAt
+		stored.FaviconFetchedAt = &fetchedAt
+	}
+	return nil
+}
+
+func (s *memoryStore) StaleFavicons(_ context.Context, before time.Time, limit int) ([]*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	links := []*URLData{}
+	for _, link := range s.links {
+		if len(links) >= limit {
+			break
+		}
+		if link.IsActive && (link.FaviconFetchedAt == nil || link.FaviconFetchedAt.Before(before)) {
+			links = append(links, copyLink(link))
+		}
+	}
+	return links, nil
+}
+
+func (s *memoryStore) SetRedirectProbe(_ context.Context, link *URLData, resolved string, hops int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.links[link.ShortURL]; ok && stored.ID == link.ID {
+		stored.ResolvedDestination = resolved
+		stored.RedirectChainLength = hops
+	}
+	return nil
+}
+
+func (s *memoryStore) ApplyTagRule(_ context.Context, userID string, rule TagRule) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var modified int64
+	for _, link := range s.links {
+		if link.UserID != userID || !link.IsActive {
+			continue
+		}
+		if tags, _ := applyTagRules([]TagRule{rule}, link.LongURL, link.Tags); len(tags) != len(link.Tags) {
+			now := clock.Now()
+			link.Tags, link.UpdatedAt = tags, &now
+			modified++
+		}
+	}
+	return modified, nil
+}
+
+func (s *memoryStore) ClickHeatmap(_ context.Context, userID string, link *URLData, since time.Time, loc *time.Location) (ClickHeatmap, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var heatmap ClickHeatmap
+	for _, stored := range s.links {
+		if (link != nil && stored.ID != link.ID) || (link == nil && stored.UserID != userID) {
+			continue
+		}
+		for _, click := range stored.ClickHistory {
+			if !click.Timestamp.Before(since) && !isBotUserAgent(click.UserAgent) {
+				heatmap.add(click.Timestamp, loc)
+			}
+		}
+	}
+	return heatmap, nil
+}
+
+func (s *memoryStore) CountClickWindow(_ context.Context, link *URLData, from, to time.Time) (*ClickWindow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	window := newClickWindow(from, to)
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID {
+		return window, nil
+	}
+	visitors := make(map[string]bool)
+	for _, click := range stored.ClickHistory {
+		if click.Timestamp.Before(from) || !click.Timestamp.Before(to) || isBotUserAgent(click.UserAgent) {
+			continue
+		}
+		window.Clicks++
+		window.addReferrer(click.ReferrerHost, 1)
+		if hash := clickIPHash(click.IP); hash != "" {
+			visitors[hash] = true
+		}
+	}
+	window.UniqueVisitors = int64(len(visitors))
+	return window, nil
+}
+
+func (s *memoryStore) CountLinkClicks(_ context.Context, link *URLData) (*ClickCounters, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counters := &ClickCounters{}
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID {
+		return counters, nil
+	}
+	visitors := make(map[string]bool)
+	for _, click := range stored.ClickHistory {
+		counters.add(click.Timestamp)
+		if isBotUserAgent(click.UserAgent) {
+			counters.BotClicks++
+		} else if hash := clickIPHash(click.IP); hash != "" {
+			visitors[hash] = true
+		}
+	}
+	counters.UniqueClicks = int64(len(visitors))
+	return counters, nil
+}
+
+func (s *memoryStore) SetClickCounters(_ context.Context, link *URLData, counters ClickCounters) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.links[link.ShortURL]
+	if !ok || stored.ID != link.ID || stored.Clicks != link.Clicks {
+		return false, nil
+	}
+	stored.Clicks = int(counters.Clicks)
+	stored.LastClicked = counters.LastClicked
+	return true, nil
+}
+
+func (s *memoryStore) ListUserLinks(_ context.Context, userID string, limit int) ([]*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	links := []*URLData{}
+	for _, link := range s.links {
+		if link.UserID == userID && link.DeactivatedReason != DeactivatedDraft {
+			links = append(links, copyLink(link))
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].ShortURL < links[j].ShortURL })
+	if len(links) > limit {
+		links = links[:limit]
+	}
+	return links, nil
+}
+
+func (s *memoryStore) SampleLinks(_ context.Context, size int) ([]*URLData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	links := []*URLData{}
+	for _, link := range s.links {
+		if link.DeactivatedReason != DeactivatedDraft {
+			links = append(links, copyLink(link))
+		}
+	}
+	rand.Shuffle(len(links), func(i, j int) { links[i], links[j] = links[j], links[i] })
+	if len(links) > size {
+		links = links[:size]
+	}
+	return links, nil
+}
+
+func (s *memoryStore) ListClicks(_ context.Context, link *URLData, query ClickQuery) ([]ClickRecord, error) {
+	s.mu.RLock()
+	stored, ok := s.links[link.ShortURL]
+	var history []ClickHistory
+	if ok && stored.ID == link.ID {
+		history = append(history, stored.ClickHistory...)
+	}
+	s.mu.RUnlock()
+
+	// Clicks have no ID here; their position in the history stands in for one
+	all := make([]ClickRecord, len(history))
+	for i, click := range history {
+		all[i] = clickRecordFor(fmt.Sprintf("%024x", i), click)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].Timestamp.Equal(all[j].Timestamp) {
+			return all[i].Timestamp.After(all[j].Timestamp)
+		}
+		return all[i].ID > all[j].ID
+	})
+	records := []ClickRecord{}
+	for _, rec := range all {
+		if len(records) == query.Limit {
+			break
+		}
+		if query.admits(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func (s *memoryStore) ExportClicks(_ context.Context, query ClickExportQuery, fn func(ClickExportRow) error) error {
+	s.mu.RLock()
+	var rows []ClickExportRow
+	for _, link := range s.links {
+		if link.UserID != query.UserID || (query.Link != nil && link.ID != query.Link.ID) {
+			continue
+		}
+		for i, click := range link.ClickHistory {
+			// Clicks have no ID here; the link's ID (minus its timestamp) and the position
+			// in its history stand in for one
+			id := link.ID.Hex()[8:] + fmt.Sprintf("%08x", i)
+			if !query.admits(click.Timestamp, id) {
+				continue
+			}
+			rec := clickRecordFor(id, click)
+			rows = append(rows, ClickExportRow{
+				EventID:   id,
+				Timestamp: rec.Timestamp,
+				ShortURL:  link.ShortURL,
+				Device:    rec.Device,
+				Bot:       rec.Bot,
+				Branch:    rec.Branch,
+				Signed:    rec.Signed,
+				IPHash:    clickIPHash(click.IP),
+			})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Timestamp.Equal(rows[j].Timestamp) {
+			return rows[i].Timestamp.Before(rows[j].Timestamp)
+		}
+		return rows[i].EventID < rows[j].EventID
+	})
+	if query.Skip >= len(rows) {
+		return nil
+	}
+	rows = rows[query.Skip:]
+	if len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertFolder(_ context.Context, folder *Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.folderNameTaken(folder) {
+		return ErrDuplicate
+	}
+	stored := *folder
+	s.folders[folder.ID] = &stored
+	return nil
+}
+
+// folderNameTaken reports whether another folder of the owner in folder's parent has its
+// name; s.mu must be held
+func (s *memoryStore) folderNameTaken(folder *Folder) bool {
+	for _, other := range s.folders {
+		if other.ID != folder.ID && other.UserID == folder.UserID && other.ParentID == folder.ParentID && other.NameKey == folder.NameKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) FindFolder(_ context.Context, userID string, id primitive.ObjectID) (*Folder, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	folder, ok := s.folders[id]
+	if !ok || folder.UserID != userID {
+		return nil, ErrNotFound
+	}
+	found := *folder
+	return &found, nil
+}
+
+func (s *memoryStore) ListFolders(_ context.Context, userID, pathPrefix string) ([]*Folder, error) {
+	s.mu.RLock()
+	folders := []*Folder{}
+	for _, folder := range s.folders {
+		if folder.UserID == userID && strings.HasPrefix(folder.Path, pathPrefix) {
+			found := *folder
+			folders = append(folders, &found)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+	return folders, nil
+}
+
+func (s *memoryStore) UpdateFolders(_ context.Context, folders []*Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, folder := range folders {
+		stored, ok := s.folders[folder.ID]
+		if !ok || stored.UserID != folder.UserID {
+			continue
+		}
+		if s.folderNameTaken(folder) {
+			return ErrDuplicate
+		}
+		updated := *folder
+		updated.CreatedAt = stored.CreatedAt
+		s.folders[folder.ID] = &updated
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteFolder(_ context.Context, folder *Folder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.folders[folder.ID]; ok && stored.UserID == folder.UserID {
+		delete(s.folders, folder.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) MoveLinksToFolder(_ context.Context, userID string, codes []string, folderID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	var matched int64
+	for _, code := range codes {
+		if link, ok := s.links[code]; ok && link.UserID == userID {
+			link.FolderID = folderID
+			link.UpdatedAt = &now
+			matched++
+		}
+	}
+	return matched, nil
+}
+
+func (s *memoryStore) RefileFolderLinks(_ context.Context, userID, from, to string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	var moved int64
+	for _, link := range s.links {
+		if link.UserID == userID && link.FolderID == from {
+			link.FolderID = to
+			link.UpdatedAt = &now
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (s *memoryStore) FolderLinkCounts(_ context.Context, userID string) (map[string]FolderCounts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[string]FolderCounts)
+	for _, link := range s.links {
+		if link.UserID == userID && link.IsActive {
+			c := counts[link.FolderID]
+			c.Links++
+			c.Clicks += int64(link.Clicks)
+			counts[link.FolderID] = c
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) InsertShareEvent(_ context.Context, link *URLData, event *ShareEvent, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.shares[link.ID]) >= limit {
+		return ErrLimitReached
+	}
+	s.shares[link.ID] = append(s.shares[link.ID], *event)
+	return nil
+}
+
+func (s *memoryStore) ListShareEvents(_ context.Context, link *URLData, from, to time.Time) ([]ShareEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shares := []ShareEvent{}
+	for _, event := range s.shares[link.ID] {
+		if (from.IsZero() || !event.SharedAt.Before(from)) && (to.IsZero() || event.SharedAt.Before(to)) {
+			shares = append(shares, event)
+		}
+	}
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].SharedAt.After(shares[j].SharedAt) })
+	return shares, nil
+}
+
+func (s *memoryStore) InsertAnalyticsShare(_ context.Context, share *AnalyticsShare, limit int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for i := range s.analyticsShares {
+		if s.analyticsShares[i].UserID == share.UserID && s.analyticsShares[i].activeAt(now) {
+			active++
+		}
+	}
+	if active >= limit {
+		return ErrLimitReached
+	}
+	s.analyticsShares = append(s.analyticsShares, *share)
+	return nil
+}
+
+func (s *memoryStore) FindAnalyticsShare(_ context.Context, tokenHash string) (*AnalyticsShare, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, share := range s.analyticsShares {
+		if share.TokenHash == tokenHash {
+			return &share, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) ListAnalyticsShares(_ context.Context, userID string) ([]AnalyticsShare, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shares := []AnalyticsShare{}
+	for i := len(s.analyticsShares) - 1; i >= 0; i-- {
+		if s.analyticsShares[i].UserID == userID {
+			shares = append(shares, s.analyticsShares[i])
+		}
+	}
+	return shares, nil
+}
+
+func (s *memoryStore) RevokeAnalyticsShare(_ context.Context, userID string, id primitive.ObjectID, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.analyticsShares {
+		share := &s.analyticsShares[i]
+		if share.ID == id && share.UserID == userID && share.RevokedAt == nil {
+			revokedAt := now.UTC()
+			share.RevokedAt = &revokedAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) InsertAbuseReport(_ context.Context, report *AbuseReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.reports {
+		if existing.URLID == report.URLID && existing.IPHash == report.IPHash && existing.Status == AbuseReportOpen {
+			return ErrDuplicate
+		}
+	}
+	s.reports = append(s.reports, *report)
+	return nil
+}
+
+func (s *memoryStore) CountAbuseReporters(_ context.Context, linkID primitive.ObjectID, since time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var n int64
+	for _, report := range s.reports {
+		if report.URLID == linkID && report.Status == AbuseReportOpen && !report.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) ListAbuseReports(_ context.Context, limit int) ([]AbuseReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reports := []AbuseReport{}
+	for _, report := range s.reports {
+		if report.Status == AbuseReportOpen && len(reports) < limit {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+func (s *memoryStore) ResolveAbuseReports(_ context.Context, code, resolution string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	var n int64
+	for i := range s.reports {
+		if s.reports[i].ShortURL == code && s.reports[i].Status == AbuseReportOpen {
+			s.reports[i].Status = resolution
+			s.reports[i].ResolvedAt = &now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) SetAbuseFlag(_ context.Context, code string, flagged bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return false, nil
+	}
+	link.AbuseFlagged = flagged
+	return true, nil
+}
+
+func (s *memoryStore) GetDomainBranding(_ context.Context, host string) (*DomainBranding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	branding, ok := s.branding[host]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &branding, nil
+}
+
+func (s *memoryStore) SaveDomainBranding(_ context.Context, branding *DomainBranding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.branding[branding.Host] = *branding
+	return nil
+}
+
+func (s *memoryStore) DeleteDomainBranding(_ context.Context, host string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.branding[host]
+	delete(s.branding, host)
+	return ok, nil
+}
+
+func (s *memoryStore) DeactivateExpired(_ context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := clock.Now()
+	var n int64
+	for _, link := range s.links {
+		if link.IsActive && isExpiredAt(link.ExpiresAt, now) {
+			stamp := now
+			link.IsActive = false
+			link.DeactivatedReason = DeactivatedExpired
+			link.UpdatedAt = &stamp
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) GlobalCounts(_ context.Context, since time.Time) (links, clicks, recent int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, link := range s.links {
+		links++
+		clicks += int64(link.Clicks)
+		if !link.CreatedAt.Before(since) {
+			recent++
+		}
+	}
+	return links, clicks, recent, nil
+}
+
+// copyLink returns a copy that shares no slices or maps with the stored link
+func copyLink(link *URLData) *URLData {
+	c := *link
+	c.Tags = append([]string(nil), link.Tags...)
+	c.ClickHistory = append([]ClickHistory{}, link.ClickHistory...)
+	if link.DeepLinkClicks != nil {
+		c.DeepLinkClicks = make(map[string]int, len(link.DeepLinkClicks))
+		for k, v := range link.DeepLinkClicks {
+			c.DeepLinkClicks[k] = v
+		}
+	}
+	return &c
+}
+
+// sameVersion reports whether two updated_at values name the same version of a link
+func sameVersion(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// linkSummary mirrors the fields projected by the analytics aggregation
+func linkSummary(link *URLData) map[string]interface{} {
+	doc := map[string]interface{}{
+		"short_url":  link.ShortURL,
+		"long_url":   link.LongURL,
+		"clicks":     link.Clicks,
+		"created_at": link.CreatedAt,
+		"is_active":  link.IsActive,
+	}
+	if link.Domain != "" {
+		doc["domain"] = link.Domain
+	}
+	if len(link.Tags) > 0 {
+		doc["tags"] = link.Tags
+	}
+	if link.ExpiresAt != nil {
+		doc["expires_at"] = *link.ExpiresAt
+	}
+	if link.BlockedClicks > 0 {
+		doc["blocked_clicks"] = link.BlockedClicks
+	}
+	if link.DailyClickLimit > 0 {
+		doc["daily_click_limit"] = link.DailyClickLimit
+	}
+	if link.PausedUntil != nil {
+		doc["paused_until"] = *link.PausedUntil
+	}
+	if link.FolderID != "" {
+		doc["folder_id"] = link.FolderID
+	}
+	if link.Pinned {
+		doc["pinned"] = true
+	}
+	if link.Internal {
+		doc["internal"] = true
+	}
+	doc["analytics"] = linkAnalyticsState(link.AnalyticsDisabled)
+	doc["on_expire"] = linkOnExpire(link)
+	for key, value := range map[string]string{
+		"expire_fallback_url": link.ExpireFallbackURL,
+		"favicon_url":         link.FaviconURL,
+		"favicon_data":        link.FaviconData,
+		"accent_color":        link.AccentColor,
+		"public_note":         link.PublicNote,
+	} {
+		if value != "" {
+			doc[key] = value
+		}
+	}
+	return doc
+}
+
+// memoryLinkStats builds the analytics statistics for one user's active links
+func memoryLinkStats(links []*URLData) map[string]interface{} {
+	stats := map[string]interface{}{
+		"total_urls":         0,
+		"total_clicks":       0,
+		"avg_clicks_per_url": 0,
+	}
+	if len(links) > 0 {
+		clicks := 0
+		for _, link := range links {
+			clicks += link.Clicks
+		}
+		stats["total_urls"] = len(links)
+		stats["total_clicks"] = clicks
+		stats["avg_clicks_per_url"] = math.Round(float64(clicks)/float64(len(links))*100) / 100
+	}
+
+	since := time.Now().AddDate(0, 0, -30)
+	perDay := map[string]int{}
+	tags := map[string]int{}
+	domains := map[string]int{}
+	for _, link := range links {
+		if !link.CreatedAt.Before(since) {
+			for _, click := range link.ClickHistory {
+				if !click.Timestamp.Before(since) {
+					perDay[click.Timestamp.UTC().Format("2006-01-02")]++
+				}
+			}
+		}
+		for _, tag := range link.Tags {
+			tags[tag]++
+		}
+		domains[link.Domain]++
+	}
+
+	days := make([]string, 0, len(perDay))
+	for day := range perDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	clicksOverTime := []map[string]interface{}{}
+	for _, day := range days {
+		clicksOverTime = append(clicksOverTime, map[string]interface{}{"date": day, "clicks": perDay[day]})
+	}
+	stats["clicks_over_time"] = clicksOverTime
+	stats["tag_distribution"] = countDistribution(tags, "tag", 10)
+	stats["domain_distribution"] = countDistribution(domains, "domain", 0)
+
+	clicked := make([]*URLData, 0, len(links))
+	for _, link := range links {
+		if link.Clicks > 0 {
+			clicked = append(clicked, link)
+		}
+	}
+	sort.SliceStable(clicked, func(i, j int) bool { return clicked[i].Clicks > clicked[j].Clicks })
+	topLinks := []map[string]interface{}{}
+	for i := 0; i < len(clicked) && i < 10; i++ {
+		topLinks = append(topLinks, linkSummary(clicked[i]))
+	}
+	stats["top_links"] = topLinks
+	return stats
+}
+
+// countDistribution sorts counts descending (then by key) into {label, count} rows;
+// limit 0 keeps every row
+func countDistribution(counts map[string]int, label string, limit int) []map[string]interface{} {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	rows := []map[string]interface{}{}
+	for _, k := range keys {
+		rows = append(rows, map[string]interface{}{label: k, "count": counts[k]})
+	}
+	return rows
+}
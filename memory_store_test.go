@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestMemoryBackendEndToEnd runs the core API against STORAGE_BACKEND=memory, as a developer
+// without MongoDB would
+func TestMemoryBackendEndToEnd(t *testing.T) {
+	srv := newTestServer(t)
+	account := map[string]string{"username": "endtoend", "email": "endtoend@example.com", "password": "correct-horse-1"}
+	if resp := srv.do("POST", "/auth/register", "", account, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: status %d", resp.StatusCode)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	resp := srv.do("POST", "/auth/login", "", map[string]string{"username_or_email": account["email"], "password": account["password"]}, &login)
+	if resp.StatusCode != http.StatusOK || login.Token == "" {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	token := login.Token
+	if resp := srv.do("GET", "/auth/validate", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("validate: status %d", resp.StatusCode)
+	}
+
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/end-to-end"})
+	for i := 0; i < 3; i++ {
+		resp := srv.do("GET", "/"+code, "", nil, nil)
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/end-to-end" {
+			t.Fatalf("redirect: status %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	drainClicks(t)
+
+	var analytics struct {
+		Total      int `json:"total"`
+		Statistics struct {
+			TotalClicks int `json:"total_clicks"`
+			TotalURLs   int `json:"total_urls"`
+		} `json:"statistics"`
+		URLs []struct {
+			ShortURL string `json:"short_url"`
+			Clicks   int    `json:"clicks"`
+		} `json:"urls"`
+	}
+	if resp := srv.do("GET", "/analytics", token, nil, &analytics); resp.StatusCode != http.StatusOK {
+		t.Fatalf("analytics: status %d", resp.StatusCode)
+	}
+	if analytics.Total != 1 || analytics.Statistics.TotalURLs != 1 || analytics.Statistics.TotalClicks != 3 ||
+		len(analytics.URLs) != 1 || analytics.URLs[0].ShortURL != code || analytics.URLs[0].Clicks != 3 {
+		t.Fatalf("analytics %+v", analytics)
+	}
+
+	var detail URLData
+	if resp := srv.do("GET", "/url/"+code, token, nil, &detail); resp.StatusCode != http.StatusOK || detail.Clicks != 3 {
+		t.Fatalf("detail: status %d, clicks %d", resp.StatusCode, detail.Clicks)
+	}
+
+	if resp := srv.do("DELETE", "/url", token, map[string]string{"short_url": code}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", "/"+code, "", nil, nil); resp.StatusCode < 400 {
+		t.Fatalf("redirect after delete: status %d", resp.StatusCode)
+	}
+}
+
+// TestMemoryBackendConcurrentCreation is the load step of benchmark.go at test size
+func TestMemoryBackendConcurrentCreation(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	const n = 50
+	codes := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var link URLData
+			resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": fmt.Sprintf("https://example.com/benchmark-url-%d", i)}, &link)
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("link %d: status %d", i, resp.StatusCode)
+			}
+			codes[i] = link.ShortURL
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if code == "" || seen[code] {
+			t.Fatalf("codes %v are not distinct", codes)
+		}
+		seen[code] = true
+	}
+	if got := len(srv.memory().links); got != n {
+		t.Fatalf("store holds %d links, want %d", got, n)
+	}
+}
+
+// TestSecurityScriptChecks runs the checks of security_testing.go against the memory backend
+func TestSecurityScriptChecks(t *testing.T) {
+	srv := newTestServer(t)
+
+	t.Run("registration input", func(t *testing.T) {
+		for name, payload := range map[string]map[string]string{
+			"xss in username": {"username": "<script>alert('XSS')</script>", "email": "xss@example.com", "password": "password123"},
+			"sql in email":    {"username": "sqluser", "email": "'; DROP TABLE users; --", "password": "password123"},
+			"weak password":   {"username": "weakuser", "email": "weak@example.com", "password": "123"},
+			"invalid email":   {"username": "invaliduser", "email": "not-an-email", "password": "password123"},
+			"too short":       {"username": "a", "email": "short@example.com", "password": "password123"},
+			"missing fields":  {"username": "incomplete"},
+			"oversized":       {"username": strings.Repeat("A", 10000), "email": "big@example.com", "password": "password123"},
+		} {
+			if resp := srv.do("POST", "/auth/register", "", payload, nil); resp.StatusCode < 400 {
+				t.Errorf("%s: accepted with status %d", name, resp.StatusCode)
+			}
+		}
+
+		// Control characters and null bytes are stripped rather than stored
+		for _, name := range []string{"test\x00user\x01", "null\x00admin"} {
+			var auth struct {
+				User User `json:"user"`
+			}
+			srv.do("POST", "/auth/register", "", map[string]string{
+				"username": name, "email": strings.Map(func(r rune) rune {
+					if r < 32 {
+						return -1
+					}
+					return r
+				}, name) + "@example.com", "password": "correct-horse-1",
+			}, &auth)
+			if strings.ContainsAny(auth.User.Username, "\x00\x01") {
+				t.Errorf("%q stored as %q", name, auth.User.Username)
+			}
+		}
+	})
+
+	t.Run("destinations", func(t *testing.T) {
+		token, _ := srv.register()
+		for _, destination := range []string{
+			"http://localhost:3000/malicious",
+			"http://192.168.1.1/internal",
+			"http://127.0.0.1/dangerous",
+			"file:///etc/passwd",
+			"javascript:alert('XSS')",
+			"data:text/html,<script>alert('XSS')</script>",
+		} {
+			if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": destination}, nil); resp.StatusCode < 400 {
+				t.Errorf("%s: accepted with status %d", destination, resp.StatusCode)
+			}
+		}
+		if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://www.google.com"}, nil); resp.StatusCode >= 400 {
+			t.Errorf("valid destination refused with status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("security headers", func(t *testing.T) {
+		resp := srv.do("GET", "/", "", nil, nil)
+		for header, want := range map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "DENY",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+			"Content-Security-Policy":   "default-src 'self'",
+			"Strict-Transport-Security": "max-age=31536000",
+			"Permissions-Policy":        "geolocation=()",
+		} {
+			if got := resp.Header.Get(header); !strings.Contains(got, want) {
+				t.Errorf("%s: %q, want %q", header, got, want)
+			}
+		}
+	})
+
+	t.Run("content type", func(t *testing.T) {
+		body := []byte(`{"username":"cttest","email":"ct@example.com","password":"password123"}`)
+		for _, contentType := range []string{"text/plain", "", "application/xml"} {
+			req, _ := http.NewRequest("POST", srv.URL+"/auth/register", bytes.NewReader(body))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			if resp := srv.send(req, nil); resp.StatusCode != http.StatusUnsupportedMediaType {
+				t.Errorf("Content-Type %q: status %d, want 415", contentType, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("mass assignment", func(t *testing.T) {
+		var auth struct {
+			User map[string]interface{} `json:"user"`
+		}
+		srv.do("POST", "/auth/register", "", map[string]interface{}{
+			"username": "massassign", "email": "mass@example.com", "password": "correct-horse-1", "admin": true, "role": "admin",
+		}, &auth)
+		if auth.User["role"] == "admin" || auth.User["admin"] == true {
+			t.Errorf("registration granted admin: %v", auth.User)
+		}
+	})
+}
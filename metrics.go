@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// IN-PROCESS METRICS
+// ============================================================================
+
+// metricsRegistry holds named counters and gauges for this instance
+type metricsRegistry struct {
+	mu     sync.RWMutex
+	values map[string]*int64
+}
+
+var appMetrics = &metricsRegistry{values: make(map[string]*int64)}
+
+var processStartedAt = time.Now()
+
+// value returns the cell for name, creating it on first use
+func (m *metricsRegistry) value(name string) *int64 {
+	m.mu.RLock()
+	v, ok := m.values[name]
+	m.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok = m.values[name]; !ok {
+		v = new(int64)
+		m.values[name] = v
+	}
+	return v
+}
+
+// incMetric adds delta to a counter
+func incMetric(name string, delta int64) {
+	atomic.AddInt64(appMetrics.value(name), delta)
+}
+
+// setGauge sets a gauge to an absolute value
+func setGauge(name string, value int64) {
+	atomic.StoreInt64(appMetrics.value(name), value)
+}
+
+// metricValue returns the current value of a counter or gauge
+func metricValue(name string) int64 {
+	return atomic.LoadInt64(appMetrics.value(name))
+}
+
+// metricsSnapshot returns a copy of every metric
+func metricsSnapshot() map[string]int64 {
+	appMetrics.mu.RLock()
+	defer appMetrics.mu.RUnlock()
+	snapshot := make(map[string]int64, len(appMetrics.values))
+	for name, v := range appMetrics.values {
+		snapshot[name] = atomic.LoadInt64(v)
+	}
+	return snapshot
+}
+
+// metricsHandler handles GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := metricsSnapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"instance_id":    InstanceID,
+		"uptime_seconds": int64(time.Since(processStartedAt).Seconds()),
+		"metrics":        snapshot,
+		"workers":        workerStatuses(ctx),
+	}); err != nil {
+		log.Printf("error encoding metrics response: %v", err)
+	}
+}
+
+// healthHandler handles GET /health
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	status := http.StatusOK
+	database := "ok"
+	if DB == nil || DB.Client == nil {
+		database = "not_connected"
+		status = http.StatusServiceUnavailable
+	} else if err := DB.Client.Ping(ctx, nil); err != nil {
+		database = "unreachable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      map[bool]string{true: "ok", false: "degraded"}[status == http.StatusOK],
+		"instance_id": InstanceID,
+		"database":    database,
+		"base_url":    baseURLHealth(r),
+		"workers":     workerStatuses(ctx),
+	}); err != nil {
+		log.Printf("error encoding health response: %v", err)
+	}
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// STARTUP MIGRATIONS
+// ============================================================================
+
+const (
+	migrationLockName     = "migrations"
+	migrationLockTTL      = 2 * time.Minute
+	migrationLockWait     = 90 * time.Second
+	defaultMigrationLimit = 60 * time.Second
+)
+
+// ErrMigrationFailed is returned when a required migration could not be applied;
+// the server must not start serving traffic in that case
+var ErrMigrationFailed = errors.New("required migration failed")
+
+// Migration is a versioned, one-time schema or data change. Up must be idempotent so a
+// migration interrupted half-way can safely run again on the next start.
+type Migration struct {
+	Version  int
+	Name     string
+	Required bool
+	Timeout  time.Duration
+	Up       func(ctx context.Context, db *mongo.Database) error
+}
+
+// AppliedMigration records a migration in the migrations collection
+type AppliedMigration struct {
+	Version    int       `bson:"_id" json:"version"`
+	Name       string    `bson:"name" json:"name"`
+	AppliedAt  time.Time `bson:"applied_at" json:"applied_at"`
+	DurationMS int64     `bson:"duration_ms" json:"duration_ms"`
+	AppliedBy  string    `bson:"applied_by" json:"applied_by"`
+}
+
+// migrationRegistry lists every migration in version order. Append only - never renumber.
+var migrationRegistry = []Migration{
+	{Version: 1, Name: "create_base_indexes", Required: true, Up: migration001CreateIndexes},
+	{Version: 2, Name: "long_url_unique_per_user", Required: true, Up: migration002LongURLPerUser},
+	{Version: 3, Name: "name_url_indexes_add_tag_domain", Required: true, Up: migration003NameIndexesTagDomain},
+	{Version: 4, Name: "security_events_indexes", Up: migration004SecurityEventIndexes},
+	{Version: 5, Name: "normalize_link_domains", Up: migration005NormalizeLinkDomains},
+	{Version: 6, Name: "favicon_fetched_at_index", Up: migration006FaviconFetchedAtIndex},
+	{Version: 7, Name: "null_creation_context", Up: migration007NullCreationContext},
+	{Version: 8, Name: "clicks_collection", Up: migration008ClicksCollection},
+	{Version: 9, Name: "share_events_indexes", Up: migration009ShareEventIndexes},
+	{Version: 10, Name: "clicks_user_id", Up: migration010ClicksUserID},
+	{Version: 11, Name: "api_usage_indexes", Up: migration011APIUsageIndexes},
+	{Version: 12, Name: "expired_duplicate_index", Up: migration012ExpiredDuplicateIndex},
+	{Version: 13, Name: "abuse_reports_indexes", Up: migration013AbuseReportIndexes},
+	{Version: 14, Name: "code_reservations", Timeout: 10 * time.Minute, Up: migration014CodeReservations},
+	{Version: 15, Name: "daily_click_budget_indexes", Up: migration015DailyClickBudgetIndexes},
+	{Version: 16, Name: "impersonations_indexes", Up: migration016ImpersonationIndexes},
+	{Version: 17, Name: "folders_indexes", Up: migration017FolderIndexes},
+	{Version: 18, Name: "pinned_listing_index", Up: migration018PinnedListingIndex},
+	{Version: 19, Name: "analytics_shares_indexes", Up: migration019AnalyticsShareIndexes},
+	{Version: 20, Name: "link_outcomes_indexes", Up: migration020LinkOutcomeIndexes},
+}
+
+// migrationStore abstracts migration bookkeeping so the runner can be exercised without MongoDB
+type migrationStore interface {
+	AppliedVersions(ctx context.Context) (map[int]bool, error)
+	MarkApplied(ctx context.Context, m Migration, duration time.Duration) error
+	AcquireLock(ctx context.Context) (bool, error)
+	ReleaseLock(ctx context.Context) error
+	Database() *mongo.Database
+}
+
+// mongoMigrationStore keeps applied versions in the migrations collection
+type mongoMigrationStore struct {
+	db *mongo.Database
+}
+
+func (s *mongoMigrationStore) AppliedVersions(ctx context.Context) (map[int]bool, error) {
+	cursor, err := s.db.Collection("migrations").Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	applied := make(map[int]bool)
+	for cursor.Next(ctx) {
+		var m AppliedMigration
+		if err := cursor.Decode(&m); err != nil {
+			return nil, err
+		}
+		applied[m.Version] = true
+	}
+	return applied, cursor.Err()
+}
+
+func (s *mongoMigrationStore) MarkApplied(ctx context.Context, m Migration, duration time.Duration) error {
+	record := AppliedMigration{
+		Version:    m.Version,
+		Name:       m.Name,
+		AppliedAt:  time.Now().UTC(),
+		DurationMS: duration.Milliseconds(),
+		AppliedBy:  InstanceID,
+	}
+	_, err := s.db.Collection("migrations").ReplaceOne(ctx, bson.D{{Key: "_id", Value: m.Version}}, record,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoMigrationStore) AcquireLock(ctx context.Context) (bool, error) {
+	return acquireLease(ctx, migrationLockName, InstanceID, migrationLockTTL)
+}
+
+func (s *mongoMigrationStore) ReleaseLock(ctx context.Context) error {
+	return releaseLease(ctx, migrationLockName, InstanceID)
+}
+
+func (s *mongoMigrationStore) Database() *mongo.Database {
+	return s.db
+}
+
+// RunMigrations applies all pending migrations against the connected database
+func RunMigrations() error {
+	if DB == nil || DB.Database == nil {
+		return fmt.Errorf("database not connected")
+	}
+	registry := migrationRegistry
+	if !canCreateMongoIndexes() {
+		// Most migrations create indexes; a user without createIndex must still be able to serve
+		registry = make([]Migration, len(migrationRegistry))
+		for i, m := range migrationRegistry {
+			m.Required = false
+			registry[i] = m
+		}
+	}
+	return runMigrations(context.Background(), &mongoMigrationStore{db: DB.Database}, registry)
+}
+
+// runMigrations applies pending migrations in version order while holding the migration lock
+func runMigrations(ctx context.Context, store migrationStore, registry []Migration) error {
+	pending := make([]Migration, len(registry))
+	copy(pending, registry)
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+	// Wait for the lock so concurrently starting instances don't race each other
+	deadline := time.Now().Add(migrationLockWait)
+	for {
+		acquired, err := store.AcquireLock(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: could not acquire migration lock: %v", ErrMigrationFailed, err)
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: timed out waiting for migration lock held by another instance", ErrMigrationFailed)
+		}
+		log.Println("⏳ Another instance is running migrations, waiting...")
+		time.Sleep(2 * time.Second)
+	}
+	defer func() {
+		if err := store.ReleaseLock(context.Background()); err != nil {
+			log.Printf("Warning: failed to release migration lock: %v", err)
+		}
+	}()
+
+	// Read applied versions only after taking the lock, so work done by the previous holder is seen
+	applied, err := store.AppliedVersions(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: could not read applied migrations: %v", ErrMigrationFailed, err)
+	}
+
+	for _, m := range pending {
+		if applied[m.Version] {
+			continue
+		}
+
+		timeout := m.Timeout
+		if timeout == 0 {
+			timeout = defaultMigrationLimit
+		}
+
+		log.Printf("🔧 Applying migration %03d_%s...", m.Version, m.Name)
+		start := time.Now()
+		migrationCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := m.Up(migrationCtx, store.Database())
+		cancel()
+
+		if err != nil {
+			if m.Required {
+				return fmt.Errorf("%w: %03d_%s: %v", ErrMigrationFailed, m.Version, m.Name, err)
+			}
+			// Optional migrations are retried on the next start
+			log.Printf("⚠️  Optional migration %03d_%s failed, continuing: %v", m.Version, m.Name, err)
+			continue
+		}
+
+		if err := store.MarkApplied(ctx, m, time.Since(start)); err != nil {
+			return fmt.Errorf("%w: could not record %03d_%s: %v", ErrMigrationFailed, m.Version, m.Name, err)
+		}
+		log.Printf("✅ Migration %03d_%s applied in %v", m.Version, m.Name, time.Since(start))
+	}
+
+	return nil
+}
+
+// migration001CreateIndexes creates the original urls and users indexes
+func migration001CreateIndexes(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db)
+}
+
+// migration002LongURLPerUser replaces the global unique long_url index, which prevented two
+// users from shortening the same URL, with one scoped to the owner and domain
+func migration002LongURLPerUser(ctx context.Context, db *mongo.Database) error {
+	urls := db.Collection("urls")
+
+	if _, err := urls.Indexes().DropOne(ctx, "long_url_1"); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+
+	_, err := urls.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "long_url", Value: 1},
+			{Key: "domain", Value: 1},
+		},
+		Options: options.Index().
+			SetName("user_long_url_domain_active_unique_idx").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "is_active", Value: true}}),
+	})
+	return err
+}
+
+// migration003NameIndexesTagDomain gives the base urls indexes created by migration 001 on
+// older deployments their explicit names, then adds the multikey (user_id, tags) and
+// (user_id, domain) indexes used by the tag/domain distributions and filtered listings.
+// Each extra index costs a write per link creation and, for tags, one entry per tag.
+func migration003NameIndexesTagDomain(ctx context.Context, db *mongo.Database) error {
+	urls := db.Collection("urls")
+
+	cursor, err := urls.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var existing []struct {
+		Name string `bson:"name"`
+		Key  bson.D `bson:"key"`
+	}
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	namesByKey := make(map[string]string, len(existing))
+	for _, idx := range existing {
+		namesByKey[indexKeySignature(idx.Key)] = idx.Name
+	}
+
+	for _, model := range urlIndexModels() {
+		want := *model.Options.Name
+		if want == "long_url_1" {
+			continue // replaced by migration 002
+		}
+		current, ok := namesByKey[indexKeySignature(model.Keys.(bson.D))]
+		if ok && current == want {
+			continue
+		}
+		if ok {
+			if _, err := urls.Indexes().DropOne(ctx, current); err != nil && !isIndexNotFound(err) {
+				return fmt.Errorf("dropping %s: %w", current, err)
+			}
+		}
+		if _, err := urls.Indexes().CreateOne(ctx, model); err != nil {
+			return fmt.Errorf("creating %s: %w", want, err)
+		}
+	}
+
+	_, err = urls.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "tags", Value: 1}},
+			Options: options.Index().SetName("user_tags_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "domain", Value: 1}},
+			Options: options.Index().SetName("user_domain_idx"),
+		},
+	})
+	return err
+}
+
+// migration004SecurityEventIndexes indexes security_events for lookups by request ID (from
+// an access log line) and for a user's events over time
+func migration004SecurityEventIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("security_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "request_id", Value: 1}},
+			Options: options.Index().SetName("request_id_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("user_id_timestamp_idx"),
+		},
+	})
+	return err
+}
+
+// migration005NormalizeLinkDomains rewrites stored link domains to bare origins, dropping
+// credentials, paths, queries and trailing slashes accepted before validateDomainOrigin.
+// A rewrite that would duplicate an active link of the same owner is skipped and logged.
+// Already-normalized documents are skipped, so a run cut short by the timeout resumes on the next start.
+func migration005NormalizeLinkDomains(ctx context.Context, db *mongo.Database) error {
+	urls := db.Collection("urls")
+	cursor, err := urls.Find(ctx, bson.D{{Key: "domain", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "domain", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var rewritten, skipped int
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID     interface{} `bson:"_id"`
+			Domain string      `bson:"domain"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		origin := domainOrigin(doc.Domain)
+		if origin == "" || origin == doc.Domain {
+			continue
+		}
+		_, err := urls.UpdateOne(ctx, bson.D{{Key: "_id", Value: doc.ID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "domain", Value: origin}}}})
+		if mongo.IsDuplicateKeyError(err) {
+			skipped++
+			log.Printf("⚠️  Domain of link %v left as is: an active link already uses %s", doc.ID, origin)
+			continue
+		} else if err != nil {
+			return err
+		}
+		rewritten++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	log.Printf("Normalized %d link domains to bare origins (%d skipped)", rewritten, skipped)
+	return nil
+}
+
+// migration006FaviconFetchedAtIndex indexes favicon_fetched_at for the daily favicon refresh
+func migration006FaviconFetchedAtIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "favicon_fetched_at", Value: 1}},
+		Options: options.Index().SetName("favicon_fetched_at_idx"),
+	})
+	return err
+}
+
+// migration007NullCreationContext sets created_ip and created_user_agent to null on links
+// created before they were recorded, so every document has the fields
+func migration007NullCreationContext(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"urls", "demo_urls"} {
+		for _, field := range []string{"created_ip", "created_user_agent"} {
+			if _, err := db.Collection(name).UpdateMany(ctx,
+				bson.D{{Key: field, Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: nil}}}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migration008ClicksCollection indexes the clicks collection for keyset pagination and
+// copies the click_history of existing links into it. Links are marked clicks_backfilled once
+// copied, so a large backfill cut off by the migration timeout resumes on the next start; a
+// link interrupted half-way has its partial copy replaced.
+func migration008ClicksCollection(ctx context.Context, db *mongo.Database) error {
+	clicksColl := db.Collection("clicks")
+	if _, err := clicksColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "short_url", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("short_url_timestamp_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "short_url", Value: 1}, {Key: "device", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("short_url_device_timestamp_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "short_url", Value: 1}, {Key: "bot", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("short_url_bot_timestamp_idx"),
+		},
+	}); err != nil {
+		return err
+	}
+
+	urls := db.Collection("urls")
+	cursor, err := urls.Find(ctx, bson.D{
+		{Key: "click_history.0", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "clicks_backfilled", Value: bson.D{{Key: "$ne", Value: true}}},
+	}, options.Find().SetProjection(bson.D{
+		{Key: "_id", Value: 1}, {Key: "short_url", Value: 1}, {Key: "click_history", Value: 1},
+	}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	copied := 0
+	for cursor.Next(ctx) {
+		var link URLData
+		if err := cursor.Decode(&link); err != nil {
+			return err
+		}
+		if _, err := clicksColl.DeleteMany(ctx, bson.D{
+			{Key: "url_id", Value: link.ID},
+			{Key: "backfilled", Value: true},
+		}); err != nil {
+			return err
+		}
+		docs := make([]interface{}, len(link.ClickHistory))
+		for i, click := range link.ClickHistory {
+			doc := newClickDocument(&link, primitive.NewObjectIDFromTimestamp(click.Timestamp), click)
+			doc.Backfilled = true
+			docs[i] = doc
+		}
+		if _, err := clicksColl.InsertMany(ctx, docs); err != nil {
+			return err
+		}
+		if _, err := urls.UpdateOne(ctx, bson.D{{Key: "_id", Value: link.ID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "clicks_backfilled", Value: true}}}}); err != nil {
+			return err
+		}
+		copied += len(docs)
+	}
+	if copied > 0 {
+		log.Printf("📦 Copied %d clicks into the clicks collection", copied)
+	}
+	return cursor.Err()
+}
+
+// migration009ShareEventIndexes indexes share_events for listing a link's shares by date
+func migration009ShareEventIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("share_events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url_id", Value: 1}, {Key: "shared_at", Value: -1}},
+		Options: options.Index().SetName("url_shared_at_idx"),
+	})
+	return err
+}
+
+// migration010ClicksUserID indexes the clicks collection by owner and day for the click
+// export and stamps user_id on clicks stored before it was recorded. Only clicks without
+// user_id are updated, so an interrupted run picks up where it stopped.
+func migration010ClicksUserID(ctx context.Context, db *mongo.Database) error {
+	clicksColl := db.Collection("clicks")
+	if _, err := clicksColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("user_timestamp_idx"),
+	}); err != nil {
+		return err
+	}
+
+	cursor, err := db.Collection("urls").Find(ctx, bson.D{{Key: "clicks", Value: bson.D{{Key: "$gt", Value: 0}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "user_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var stamped int64
+	for cursor.Next(ctx) {
+		var link URLData
+		if err := cursor.Decode(&link); err != nil {
+			return err
+		}
+		res, err := clicksColl.UpdateMany(ctx, bson.D{
+			{Key: "url_id", Value: link.ID},
+			{Key: "user_id", Value: bson.D{{Key: "$exists", Value: false}}},
+		}, bson.D{{Key: "$set", Value: bson.D{{Key: "user_id", Value: link.UserID}}}})
+		if err != nil {
+			return err
+		}
+		stamped += res.ModifiedCount
+	}
+	if stamped > 0 {
+		log.Printf("📦 Stamped user_id on %d clicks", stamped)
+	}
+	return cursor.Err()
+}
+
+// migration011APIUsageIndexes makes (user_id, day, endpoint) unique for the usage counter
+// upserts and expires counters usageRetentionDays after their day
+func migration011APIUsageIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("api_usage").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "day", Value: 1}, {Key: "endpoint", Value: 1}},
+			Options: options.Index().SetName("user_day_endpoint_idx").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "day", Value: 1}},
+			Options: options.Index().SetName("day_ttl_idx").SetExpireAfterSeconds(usageRetentionDays * 24 * 60 * 60),
+		},
+	})
+	return err
+}
+
+// migration012ExpiredDuplicateIndex indexes expired links by owner and destination, for the
+// expired-duplicate lookup of shorten; the unique index only covers active links
+func migration012ExpiredDuplicateIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "long_url", Value: 1},
+			{Key: "domain", Value: 1},
+			{Key: "expires_at", Value: -1},
+		},
+		Options: options.Index().
+			SetName("user_long_url_domain_expired_idx").
+			SetPartialFilterExpression(bson.D{{Key: "deactivated_reason", Value: DeactivatedExpired}}),
+	})
+	return err
+}
+
+// migration013AbuseReportIndexes allows one open abuse report per link and IP, and serves
+// the oldest-first review queue and the per-code resolution
+func migration013AbuseReportIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("abuse_reports").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "url_id", Value: 1}, {Key: "ip_hash", Value: 1}},
+			Options: options.Index().
+				SetName("url_ip_open_unique_idx").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "status", Value: AbuseReportOpen}}),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("status_created_at_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "short_url", Value: 1}},
+			Options: options.Index().SetName("short_url_idx"),
+		},
+	})
+	return err
+}
+
+// migration014CodeReservations adds the TTL index of demo reservations and reserves the code
+// of every link, draft and unexpired demo link. Links go first, so where a demo link shares a
+// code with a link the link keeps it; such collisions are logged and counted. Reservations
+// already held by the same document are skipped, so an interrupted run can start over.
+func migration014CodeReservations(ctx context.Context, db *mongo.Database) error {
+	codes := db.Collection("codes")
+	if _, err := codes.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl_idx").SetExpireAfterSeconds(0),
+	}); err != nil {
+		return err
+	}
+
+	var reserved, collisions int
+	backfill := func(source string, filter bson.D, reservationOf func(bson.Raw) (*CodeReservation, error)) error {
+		cursor, err := db.Collection(source).Find(ctx, filter, options.Find().SetProjection(bson.D{
+			{Key: "_id", Value: 1}, {Key: "short_url", Value: 1}, {Key: "user_id", Value: 1},
+			{Key: "created_at", Value: 1}, {Key: "expires_at", Value: 1}, {Key: "deactivated_reason", Value: 1},
+		}))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			reservation, err := reservationOf(cursor.Current)
+			if err != nil {
+				return err
+			}
+			_, err = codes.InsertOne(ctx, reservation)
+			if err == nil {
+				reserved++
+				continue
+			}
+			if !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+			holder, err := findCodeReservation(ctx, db, reservation.Code)
+			if err != nil {
+				return err
+			}
+			if holder.Ref != reservation.Ref {
+				collisions++
+				log.Printf("⚠️  Code collision: %s is held by %s %s and by %s %s in %s",
+					reservation.Code, holder.OwnerType, holder.Ref, reservation.OwnerType, reservation.Ref, source)
+			}
+		}
+		return cursor.Err()
+	}
+
+	if err := backfill("urls", bson.D{}, func(raw bson.Raw) (*CodeReservation, error) {
+		var link URLData
+		if err := bson.Unmarshal(raw, &link); err != nil {
+			return nil, err
+		}
+		return linkCodeReservation(&link), nil
+	}); err != nil {
+		return err
+	}
+	if err := backfill("demo_urls", bson.D{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: clock.Now()}}}},
+		func(raw bson.Raw) (*CodeReservation, error) {
+			var demo DemoURL
+			if err := bson.Unmarshal(raw, &demo); err != nil {
+				return nil, err
+			}
+			return &CodeReservation{
+				Code:      demo.ShortURL,
+				OwnerType: CodeOwnerDemo,
+				Ref:       demo.ID.Hex(),
+				CreatedAt: demo.CreatedAt,
+				ExpiresAt: &demo.ExpiresAt,
+			}, nil
+		}); err != nil {
+		return err
+	}
+
+	if reserved > 0 || collisions > 0 {
+		log.Printf("🔖 Reserved %d short codes (%d collisions between links and demo links)", reserved, collisions)
+	}
+	return nil
+}
+
+// migration015DailyClickBudgetIndexes expires daily_clicks counters and indexes the paused
+// links the budget resume worker looks for
+func migration015DailyClickBudgetIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("daily_clicks").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl_idx").SetExpireAfterSeconds(0),
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "paused_until", Value: 1}},
+		Options: options.Index().SetName("paused_until_idx").SetSparse(true),
+	})
+	return err
+}
+
+// migration016ImpersonationIndexes indexes the impersonation log by user and by admin
+func migration016ImpersonationIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("impersonations").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("user_started_at_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "admin_id", Value: 1}, {Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("admin_started_at_idx"),
+		},
+		{
+			Keys:    bson.D{{Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("started_at_idx"),
+		},
+	})
+	return err
+}
+
+// migration017FolderIndexes keeps folder names unique per parent, serves subtree lookups by
+// path prefix and lists the links of a folder
+func migration017FolderIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("folders").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "parent_id", Value: 1}, {Key: "name_key", Value: 1}},
+			Options: options.Index().SetName("user_parent_name_unique_idx").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "path", Value: 1}},
+			Options: options.Index().SetName("user_path_idx"),
+		},
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "folder_id", Value: 1}, {Key: "created_at", Value: -1}},
+		Options: options.Index().SetName("user_folder_created_idx"),
+	})
+	return err
+}
+
+// migration018PinnedListingIndex adds the index behind the pinned-first link listing: it
+// serves both the (user_id, is_active) match and the (pinned, created_at) sort, so pages are
+// read in index order instead of being sorted in memory. user_id_created_at_idx stays for the
+// queries that sort by creation only.
+func migration018PinnedListingIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "is_active", Value: 1},
+			{Key: "pinned", Value: -1},
+			{Key: "created_at", Value: -1},
+		},
+		Options: options.Index().SetName("user_active_pinned_created_at_idx"),
+	})
+	return err
+}
+
+// migration019AnalyticsShareIndexes indexes analytics_shares by token hash for the public
+// lookup and by owner for listing
+func migration019AnalyticsShareIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("analytics_shares").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetName("token_hash_idx").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("user_created_at_idx"),
+		},
+	})
+	return err
+}
+
+// migration020LinkOutcomeIndexes makes (url_id, day, outcome) unique for the redirect outcome
+// upserts and expires counters outcomeRetentionDays after their day
+func migration020LinkOutcomeIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("link_outcomes").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "url_id", Value: 1}, {Key: "day", Value: 1}, {Key: "outcome", Value: 1}},
+			Options: options.Index().SetName("url_day_outcome_idx").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "day", Value: 1}},
+			Options: options.Index().SetName("day_ttl_idx").SetExpireAfterSeconds(outcomeRetentionDays * 24 * 60 * 60),
+		},
+	})
+	return err
+}
+
+// indexKeySignature renders an index key pattern comparably, ignoring numeric types
+func indexKeySignature(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s:%v", k.Key, k.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// isIndexNotFound reports whether err is MongoDB's IndexNotFound (code 27)
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 27
+}
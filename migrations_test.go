@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// fakeMigrationState is the database side shared by the fakeMigrationStores of several
+// instances: applied versions and the lock
+type fakeMigrationState struct {
+	mu      sync.Mutex
+	applied map[int]bool
+	holder  string
+}
+
+// fakeMigrationStore is one instance's view of fakeMigrationState
+type fakeMigrationStore struct {
+	state    *fakeMigrationState
+	instance string
+}
+
+func newFakeMigrationState() *fakeMigrationState {
+	return &fakeMigrationState{applied: make(map[int]bool)}
+}
+
+func (s *fakeMigrationStore) AppliedVersions(context.Context) (map[int]bool, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	applied := make(map[int]bool, len(s.state.applied))
+	for version := range s.state.applied {
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+func (s *fakeMigrationStore) MarkApplied(_ context.Context, m Migration, _ time.Duration) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.applied[m.Version] = true
+	return nil
+}
+
+func (s *fakeMigrationStore) AcquireLock(context.Context) (bool, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if s.state.holder != "" && s.state.holder != s.instance {
+		return false, nil
+	}
+	s.state.holder = s.instance
+	return true, nil
+}
+
+func (s *fakeMigrationStore) ReleaseLock(context.Context) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if s.state.holder == s.instance {
+		s.state.holder = ""
+	}
+	return nil
+}
+
+func (s *fakeMigrationStore) Database() *mongo.Database { return nil }
+
+// migrationRecorder builds migrations that note each run
+type migrationRecorder struct {
+	mu   sync.Mutex
+	runs []int
+}
+
+func (r *migrationRecorder) migration(version int, required bool, err error) Migration {
+	return Migration{Version: version, Name: "test", Required: required, Up: func(context.Context, *mongo.Database) error {
+		r.mu.Lock()
+		r.runs = append(r.runs, version)
+		r.mu.Unlock()
+		return err
+	}}
+}
+
+func (r *migrationRecorder) ran() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.runs...)
+}
+
+func TestRunMigrationsAppliesInVersionOrder(t *testing.T) {
+	rec := &migrationRecorder{}
+	store := &fakeMigrationStore{state: newFakeMigrationState(), instance: "a"}
+	registry := []Migration{rec.migration(3, true, nil), rec.migration(1, true, nil), rec.migration(2, false, nil)}
+	if err := runMigrations(context.Background(), store, registry); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.ran(); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("migrations ran in order %v, want [1 2 3]", got)
+	}
+	if store.state.holder != "" {
+		t.Fatalf("lock still held by %q", store.state.holder)
+	}
+}
+
+func TestRunMigrationsIsIdempotent(t *testing.T) {
+	rec := &migrationRecorder{}
+	store := &fakeMigrationStore{state: newFakeMigrationState(), instance: "a"}
+	registry := []Migration{rec.migration(1, true, nil), rec.migration(2, true, nil)}
+	for i := 0; i < 3; i++ {
+		if err := runMigrations(context.Background(), store, registry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := rec.ran(); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("three starts ran %v, want each migration once", got)
+	}
+
+	// A migration added later is the only one to run on the next start
+	registry = append(registry, rec.migration(3, true, nil))
+	if err := runMigrations(context.Background(), store, registry); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.ran(); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("after adding 3 ran %v", got)
+	}
+}
+
+func TestRunMigrationsFailures(t *testing.T) {
+	boom := errors.New("boom")
+	rec := &migrationRecorder{}
+	store := &fakeMigrationStore{state: newFakeMigrationState(), instance: "a"}
+
+	// An optional failure is retried on the next start; later migrations still run
+	registry := []Migration{rec.migration(1, false, boom), rec.migration(2, true, nil)}
+	if err := runMigrations(context.Background(), store, registry); err != nil {
+		t.Fatalf("optional failure stopped the start: %v", err)
+	}
+	if store.state.applied[1] || !store.state.applied[2] {
+		t.Fatalf("applied %v, want only 2", store.state.applied)
+	}
+
+	// A required failure stops the start before later migrations and releases the lock
+	registry = []Migration{rec.migration(3, true, boom), rec.migration(4, true, nil)}
+	if err := runMigrations(context.Background(), store, registry); !errors.Is(err, ErrMigrationFailed) {
+		t.Fatalf("required failure returned %v, want ErrMigrationFailed", err)
+	}
+	if store.state.applied[3] || store.state.applied[4] {
+		t.Fatalf("applied %v after a required failure", store.state.applied)
+	}
+	if store.state.holder != "" {
+		t.Fatalf("lock still held by %q", store.state.holder)
+	}
+}
+
+func TestRunMigrationsWaitsForTheLock(t *testing.T) {
+	state := newFakeMigrationState()
+	state.holder = "other"
+	rec := &migrationRecorder{}
+	store := &fakeMigrationStore{state: state, instance: "a"}
+
+	done := make(chan error, 1)
+	go func() { done <- runMigrations(context.Background(), store, []Migration{rec.migration(1, true, nil)}) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if got := rec.ran(); len(got) != 0 {
+		t.Fatalf("ran %v while another instance held the lock", got)
+	}
+	(&fakeMigrationStore{state: state, instance: "other"}).ReleaseLock(context.Background())
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runMigrations did not take the released lock")
+	}
+	if got := rec.ran(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("ran %v after the lock was released", got)
+	}
+}
+
+func TestConcurrentInstancesApplyEachMigrationOnce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the migration lock retry")
+	}
+	state := newFakeMigrationState()
+	rec := &migrationRecorder{}
+	var registry []Migration
+	for version := 1; version <= 5; version++ {
+		m := rec.migration(version, true, nil)
+		up := m.Up
+		m.Up = func(ctx context.Context, db *mongo.Database) error {
+			time.Sleep(10 * time.Millisecond) // keeps the lock held while the others try
+			return up(ctx, db)
+		}
+		registry = append(registry, m)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for _, instance := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			errs <- runMigrations(context.Background(), &fakeMigrationStore{state: state, instance: instance}, registry)
+		}(instance)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := rec.ran(); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("three instances ran %v, want each migration once in order", got)
+	}
+}
+
+func TestMigrationRegistryIsAppendOnly(t *testing.T) {
+	for i, m := range migrationRegistry {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d (%s) has version %d; versions must run 1, 2, 3... without gaps", i, m.Name, m.Version)
+		}
+		if m.Name == "" || m.Up == nil {
+			t.Fatalf("migration %d lacks a name or Up", m.Version)
+		}
+	}
+}
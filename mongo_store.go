@@ -0,0 +1,1498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// MONGODB STORE
+// ============================================================================
+
+// mongoUserStore keeps users in the users collection
+type mongoUserStore struct {
+	users *mongo.Collection
+}
+
+// CreateUser checks for an existing account and inserts the new one in a single session
+func (s *mongoUserStore) CreateUser(ctx context.Context, user *User) error {
+	session, err := DB.Client.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	return mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		var existingUser User
+		err := s.users.FindOne(sc, bson.D{
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "username", Value: user.Username}},
+				bson.D{{Key: "email", Value: user.Email}},
+			}},
+			{Key: "is_active", Value: true},
+		}).Decode(&existingUser)
+		if err == nil {
+			return ErrDuplicate
+		} else if err != mongo.ErrNoDocuments {
+			return fmt.Errorf("error checking existing user: %v", err)
+		}
+
+		result, err := s.users.InsertOne(sc, user)
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicate
+		} else if err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		user.ID = result.InsertedID.(primitive.ObjectID)
+		return nil
+	})
+}
+
+func (s *mongoUserStore) FindUserByLogin(ctx context.Context, usernameOrEmail string) (*User, error) {
+	// Each $or branch matches a compound index
+	return s.findOne(ctx, bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "username", Value: usernameOrEmail}, {Key: "is_active", Value: true}},
+			bson.D{{Key: "email", Value: usernameOrEmail}, {Key: "is_active", Value: true}},
+		}},
+	})
+}
+
+func (s *mongoUserStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	return s.findOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "is_active", Value: true}})
+}
+
+func (s *mongoUserStore) FindUserByRefreshToken(ctx context.Context, hashed string) (*User, error) {
+	return s.findOne(ctx, bson.D{{Key: "refresh_token", Value: hashed}})
+}
+
+func (s *mongoUserStore) SetTagRules(ctx context.Context, id primitive.ObjectID, rules []TagRule) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "tag_rules", Value: ""}}}}
+	if len(rules) > 0 {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "tag_rules", Value: rules}}}}
+	}
+	_, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (s *mongoUserStore) SetTimezone(ctx context.Context, id primitive.ObjectID, timezone string) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "timezone", Value: ""}}}}
+	if timezone != "" {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "timezone", Value: timezone}}}}
+	}
+	_, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (s *mongoUserStore) SetUserActive(ctx context.Context, id primitive.ObjectID, active bool) (bool, error) {
+	res, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "is_active", Value: active}}},
+		{Key: "$unset", Value: bson.D{{Key: "deactivated_at", Value: ""}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoUserStore) DeactivateUser(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	res, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "is_active", Value: true}}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "is_active", Value: false}, {Key: "deactivated_at", Value: at}}},
+		{Key: "$unset", Value: bson.D{{Key: "refresh_token", Value: ""}, {Key: "refresh_token_expiry", Value: ""}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoUserStore) FindDeactivatedUser(ctx context.Context, usernameOrEmail string) (*User, error) {
+	deactivated := bson.D{{Key: "$exists", Value: true}}
+	return s.findOne(ctx, bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "username", Value: usernameOrEmail}, {Key: "is_active", Value: false}},
+			bson.D{{Key: "email", Value: usernameOrEmail}, {Key: "is_active", Value: false}},
+		}},
+		{Key: "deactivated_at", Value: deactivated},
+	})
+}
+
+func (s *mongoUserStore) ReactivateUser(ctx context.Context, id primitive.ObjectID, deactivatedAt time.Time) (bool, error) {
+	res, err := s.users.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "is_active", Value: false},
+		{Key: "deactivated_at", Value: deactivatedAt},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "is_active", Value: true}}},
+		{Key: "$unset", Value: bson.D{{Key: "deactivated_at", Value: ""}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoUserStore) InactiveUserIDs(ctx context.Context) ([]string, error) {
+	return s.userIDs(ctx, bson.D{{Key: "is_active", Value: false}})
+}
+
+func (s *mongoUserStore) RestrictedUserIDs(ctx context.Context, youngerThan time.Time) ([]string, error) {
+	return s.userIDs(ctx, bson.D{
+		{Key: "restricted", Value: true},
+		{Key: "is_active", Value: true},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "email_verified", Value: bson.D{{Key: "$ne", Value: true}}}},
+			bson.D{{Key: "created_at", Value: bson.D{{Key: "$gt", Value: youngerThan}}}},
+		}},
+	})
+}
+
+func (s *mongoUserStore) SetEmailVerified(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	res, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "email_verified", Value: true}}}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// userIDs returns the hex IDs of the users matching filter
+func (s *mongoUserStore) userIDs(ctx context.Context, filter bson.D) ([]string, error) {
+	cursor, err := s.users.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var ids []string
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		ids = append(ids, doc.ID.Hex())
+	}
+	return ids, cursor.Err()
+}
+
+func (s *mongoUserStore) AddUsage(ctx context.Context, counts []UsageCount) error {
+	models := make([]mongo.WriteModel, 0, len(counts))
+	for _, count := range counts {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				{Key: "user_id", Value: count.UserID},
+				{Key: "day", Value: count.Day},
+				{Key: "endpoint", Value: count.Endpoint},
+			}).
+			SetUpdate(bson.D{{Key: "$inc", Value: bson.D{
+				{Key: "requests", Value: count.Requests},
+				{Key: "rate_limited", Value: count.RateLimited},
+			}}}).
+			SetUpsert(true))
+	}
+	_, err := s.users.Database().Collection("api_usage").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *mongoUserStore) ListUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageCount, error) {
+	cursor, err := s.users.Database().Collection("api_usage").Find(ctx, bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "day", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lt", Value: to}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var counts []UsageCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (s *mongoUserStore) SetRefreshToken(ctx context.Context, id primitive.ObjectID, hashed string, expiry time.Time) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{
+		{Key: "refresh_token", Value: ""},
+		{Key: "refresh_token_expiry", Value: ""},
+	}}}
+	if hashed != "" {
+		update = bson.D{{Key: "$set", Value: bson.D{
+			{Key: "refresh_token", Value: hashed},
+			{Key: "refresh_token_expiry", Value: expiry},
+		}}}
+	}
+	_, err := s.users.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	return err
+}
+
+func (s *mongoUserStore) findOne(ctx context.Context, filter bson.D) (*User, error) {
+	var user User
+	err := s.users.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// mongoURLStore keeps links in one urls collection (the tenant's, when a resolver is set)
+type mongoURLStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoURLStore) InsertLink(ctx context.Context, link *URLData) error {
+	if link.ID.IsZero() {
+		link.ID = primitive.NewObjectID()
+	}
+	db := s.coll.Database()
+	if err := reserveCode(ctx, db, linkCodeReservation(link)); err != nil {
+		return err
+	}
+	_, err := s.coll.InsertOne(ctx, link)
+	if err != nil {
+		if releaseErr := releaseCode(ctx, db, link.ShortURL, link.ID.Hex()); releaseErr != nil {
+			log.Printf("error releasing code %s after failed insert: %v", link.ShortURL, releaseErr)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *mongoURLStore) CodeHolder(ctx context.Context, code string) (*CodeReservation, error) {
+	return findCodeReservation(ctx, s.coll.Database(), code)
+}
+
+func (s *mongoURLStore) FindLinkByCode(ctx context.Context, code string) (*URLData, error) {
+	return s.findOne(ctx, bson.D{{Key: "short_url", Value: code}})
+}
+
+func (s *mongoURLStore) FindRedirectTarget(ctx context.Context, code string) (*URLData, error) {
+	// The owner is unknown here, so on sharded deployments this is a scatter-gather query
+	return s.findOne(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "is_active", Value: true},
+		notExpiredFilter(),
+	})
+}
+
+func (s *mongoURLStore) FindActiveLink(ctx context.Context, userID, longURL, domain string) (*URLData, error) {
+	return s.findOne(ctx, bson.D{
+		{Key: "long_url", Value: longURL},
+		{Key: "domain", Value: domain},
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+	})
+}
+
+func (s *mongoURLStore) FindExpiredDuplicate(ctx context.Context, userID, longURL, domain string) (*URLData, error) {
+	var link URLData
+	err := s.coll.FindOne(ctx, bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "long_url", Value: longURL},
+		{Key: "domain", Value: domain},
+		{Key: "is_active", Value: false},
+		{Key: "deactivated_reason", Value: DeactivatedExpired},
+	}, options.FindOne().SetSort(bson.D{{Key: "expires_at", Value: -1}})).Decode(&link)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (s *mongoURLStore) ReviveLink(ctx context.Context, link *URLData, expiresAt time.Time) (bool, error) {
+	// The partial unique index on (user_id, long_url, domain) for active links refuses the
+	// update when another active link to the destination was created meanwhile
+	res, err := s.coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: link.ID},
+			{Key: "user_id", Value: link.UserID},
+			{Key: "is_active", Value: false},
+			{Key: "deactivated_reason", Value: DeactivatedExpired},
+		},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "expires_at", Value: expiresAt},
+				{Key: "is_active", Value: true},
+				{Key: "updated_at", Value: clock.Now()},
+			}},
+			{Key: "$unset", Value: bson.D{{Key: "deactivated_reason", Value: ""}}},
+		})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, ErrDuplicate
+	} else if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoURLStore) RecordClick(ctx context.Context, link *URLData, click ClickHistory) error {
+	increments := bson.D{{Key: "clicks", Value: 1}}
+	if click.Branch != "" {
+		increments = append(increments, bson.E{Key: "deep_link_clicks." + click.Branch, Value: 1})
+	}
+	update := bson.D{
+		{Key: "$inc", Value: increments},
+		{Key: "$set", Value: bson.D{{Key: "last_clicked", Value: click.Timestamp}}},
+		{Key: "$push", Value: bson.D{{Key: "click_history", Value: click}}},
+	}
+	result, err := s.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: link.ID}, {Key: "user_id", Value: link.UserID}}, update)
+	if err != nil || result.MatchedCount == 0 {
+		return err
+	}
+	_, err = s.coll.Database().Collection("clicks").InsertOne(ctx, newClickDocument(link, primitive.NewObjectID(), click))
+	return err
+}
+
+// clickDocument is a clicks collection document. click_history keeps feeding the analytics
+// aggregations; the clicks collection serves paging through a link's clicks.
+type clickDocument struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	URLID        primitive.ObjectID `bson:"url_id"`
+	ShortURL     string             `bson:"short_url"`
+	UserID       string             `bson:"user_id,omitempty"`
+	Timestamp    time.Time          `bson:"timestamp"`
+	Device       string             `bson:"device"`
+	Bot          bool               `bson:"bot"`
+	Branch       string             `bson:"branch,omitempty"`
+	Signed       bool               `bson:"signed,omitempty"`
+	IPHash       string             `bson:"ip_hash,omitempty"`
+	ReferrerHost string             `bson:"referrer_host,omitempty"`
+	Backfilled   bool               `bson:"backfilled,omitempty"`
+}
+
+func newClickDocument(link *URLData, id primitive.ObjectID, click ClickHistory) clickDocument {
+	rec := clickRecordFor(id.Hex(), click)
+	return clickDocument{
+		ID:           id,
+		URLID:        link.ID,
+		ShortURL:     link.ShortURL,
+		UserID:       link.UserID,
+		Timestamp:    rec.Timestamp,
+		Device:       rec.Device,
+		Bot:          rec.Bot,
+		Branch:       rec.Branch,
+		Signed:       rec.Signed,
+		IPHash:       clickIPHash(click.IP),
+		ReferrerHost: click.ReferrerHost,
+	}
+}
+
+func (s *mongoURLStore) ExportClicks(ctx context.Context, query ClickExportQuery, fn func(ClickExportRow) error) error {
+	filter := bson.D{{Key: "user_id", Value: query.UserID}}
+	if query.Link != nil {
+		// Same index as click paging; url_id keeps a reused code's old clicks out
+		filter = bson.D{{Key: "short_url", Value: query.Link.ShortURL}, {Key: "url_id", Value: query.Link.ID}}
+	}
+	timestamp := bson.D{{Key: "$gte", Value: query.From}, {Key: "$lt", Value: query.To}}
+	if query.After != nil {
+		afterID, err := primitive.ObjectIDFromHex(query.After.ID)
+		if err != nil {
+			return fmt.Errorf("invalid cursor")
+		}
+		if query.After.Timestamp.After(query.From) {
+			timestamp[0].Value = query.After.Timestamp
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: query.After.Timestamp}}}},
+			bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: afterID}}}},
+		}})
+	}
+	filter = append(filter, bson.E{Key: "timestamp", Value: timestamp})
+
+	clicks := analyticsCollection(s.coll.Database().Collection("clicks"))
+	cursor, err := clicks.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(query.Skip)).
+		SetLimit(int64(query.Limit)).
+		SetBatchSize(1000))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	exportHashes := ipPrivacyMode() != "none"
+	for cursor.Next(ctx) {
+		var doc clickDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		row := ClickExportRow{
+			EventID:   doc.ID.Hex(),
+			Timestamp: doc.Timestamp.UTC(),
+			ShortURL:  doc.ShortURL,
+			Device:    doc.Device,
+			Bot:       doc.Bot,
+			Branch:    doc.Branch,
+			Signed:    doc.Signed,
+		}
+		if exportHashes {
+			row.IPHash = doc.IPHash
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ApplyTagRule matches the destination host with a regular expression on long_url and
+// appends the missing tags in an update pipeline, so links are changed in one UpdateMany.
+// updated_at moves only where the tags change: a link already at MaxTagsPerLink keeps it.
+func (s *mongoURLStore) ApplyTagRule(ctx context.Context, userID string, rule TagRule) (int64, error) {
+	hostPattern := `^[a-zA-Z][a-zA-Z0-9+.-]*://([^/?#@]*@)?([^/?#:@]*\.)?` + regexp.QuoteMeta(rule.HostSuffix) + `(:[0-9]+)?([/?#]|$)`
+	filter := bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+		{Key: "long_url", Value: primitive.Regex{Pattern: hostPattern, Options: "i"}},
+		{Key: "tags", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$all", Value: rule.Tags}}}}},
+	}
+	current := bson.D{{Key: "$ifNull", Value: bson.A{"$tags", bson.A{}}}}
+	missing := bson.D{{Key: "$filter", Value: bson.D{
+		{Key: "input", Value: rule.Tags},
+		{Key: "cond", Value: bson.D{{Key: "$not", Value: bson.A{
+			bson.D{{Key: "$in", Value: bson.A{"$$this", current}}},
+		}}}},
+	}}}
+	tags := bson.D{{Key: "$slice", Value: bson.A{
+		bson.D{{Key: "$concatArrays", Value: bson.A{current, missing}}},
+		MaxTagsPerLink,
+	}}}
+	// Both fields are computed from the document as it was before the stage
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+		{Key: "updated_at", Value: bson.D{{Key: "$cond", Value: bson.A{
+			bson.D{{Key: "$eq", Value: bson.A{tags, current}}}, "$updated_at", clock.Now(),
+		}}}},
+		{Key: "tags", Value: tags},
+	}}}}
+	result, err := s.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *mongoURLStore) ClickHeatmap(ctx context.Context, userID string, link *URLData, since time.Time, loc *time.Location) (ClickHeatmap, error) {
+	// Served by short_url_timestamp_idx for one link and by user_timestamp_idx for an account
+	match := bson.D{{Key: "user_id", Value: userID}}
+	if link != nil {
+		match = bson.D{{Key: "short_url", Value: link.ShortURL}, {Key: "url_id", Value: link.ID}}
+	}
+	match = append(match,
+		bson.E{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: since}}},
+		bson.E{Key: "bot", Value: false})
+
+	clicks := analyticsCollection(s.coll.Database().Collection("clicks"))
+	cursor, err := clicks.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "parts", Value: bson.D{{Key: "$dateToParts", Value: bson.D{
+			{Key: "date", Value: "$timestamp"},
+			{Key: "timezone", Value: loc.String()},
+			{Key: "iso8601", Value: true},
+		}}}}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "weekday", Value: "$parts.isoDayOfWeek"}, {Key: "hour", Value: "$parts.hour"}}},
+			{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return ClickHeatmap{}, err
+	}
+	var groups []struct {
+		ID struct {
+			Weekday int `bson:"weekday"`
+			Hour    int `bson:"hour"`
+		} `bson:"_id"`
+		Clicks int64 `bson:"clicks"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return ClickHeatmap{}, err
+	}
+	var heatmap ClickHeatmap
+	for _, g := range groups {
+		// isoDayOfWeek runs from 1 (Monday) to 7 (Sunday)
+		if g.ID.Weekday >= 1 && g.ID.Weekday <= 7 && g.ID.Hour >= 0 && g.ID.Hour < 24 {
+			heatmap[g.ID.Weekday-1][g.ID.Hour] += g.Clicks
+		}
+	}
+	return heatmap, nil
+}
+
+func (s *mongoURLStore) ListClicks(ctx context.Context, link *URLData, query ClickQuery) ([]ClickRecord, error) {
+	filter := bson.D{{Key: "short_url", Value: link.ShortURL}}
+	if query.Device != "" {
+		filter = append(filter, bson.E{Key: "device", Value: query.Device})
+	}
+	if query.Bot != nil {
+		filter = append(filter, bson.E{Key: "bot", Value: *query.Bot})
+	}
+	timestamp := bson.D{}
+	if !query.From.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$gte", Value: query.From})
+	}
+	if !query.To.IsZero() {
+		timestamp = append(timestamp, bson.E{Key: "$lt", Value: query.To})
+	}
+	if query.After != nil {
+		afterID, err := primitive.ObjectIDFromHex(query.After.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		// The bound on timestamp keeps the index scan range tight; $or breaks ties on _id
+		timestamp = append(timestamp, bson.E{Key: "$lte", Value: query.After.Timestamp})
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: query.After.Timestamp}}}},
+			bson.D{{Key: "_id", Value: bson.D{{Key: "$lt", Value: afterID}}}},
+		}})
+	}
+	if len(timestamp) > 0 {
+		filter = append(filter, bson.E{Key: "timestamp", Value: timestamp})
+	}
+	// A reused short code must not list the clicks of its previous link
+	filter = append(filter, bson.E{Key: "url_id", Value: link.ID})
+
+	clicks := analyticsCollection(s.coll.Database().Collection("clicks"))
+	cursor, err := clicks.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(query.Limit)))
+	if err != nil {
+		return nil, err
+	}
+	var docs []clickDocument
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	records := make([]ClickRecord, len(docs))
+	for i, doc := range docs {
+		records[i] = ClickRecord{
+			ID:        doc.ID.Hex(),
+			Timestamp: doc.Timestamp.UTC(),
+			Device:    doc.Device,
+			Bot:       doc.Bot,
+			Branch:    doc.Branch,
+			Signed:    doc.Signed,
+		}
+	}
+	return records, nil
+}
+
+func (s *mongoURLStore) RecordBlockedClick(ctx context.Context, link *URLData) error {
+	_, err := s.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: link.ID}, {Key: "user_id", Value: link.UserID}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "blocked_clicks", Value: 1}}}})
+	return err
+}
+
+func (s *mongoURLStore) AddLinkOutcomes(ctx context.Context, counts []LinkOutcomeCount) error {
+	models := make([]mongo.WriteModel, 0, len(counts))
+	for _, count := range counts {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				{Key: "url_id", Value: count.URLID},
+				{Key: "day", Value: count.Day},
+				{Key: "outcome", Value: count.Outcome},
+			}).
+			SetUpdate(bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: count.Count}}}}).
+			SetUpsert(true))
+	}
+	_, err := s.coll.Database().Collection("link_outcomes").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *mongoURLStore) ListLinkOutcomes(ctx context.Context, link *URLData, from, to time.Time) ([]LinkOutcomeCount, error) {
+	cursor, err := s.coll.Database().Collection("link_outcomes").Find(ctx, bson.D{
+		{Key: "url_id", Value: link.ID},
+		{Key: "day", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lt", Value: to}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var counts []LinkOutcomeCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// dailyClickDocument is a daily_clicks document, one per link and budget day
+type dailyClickDocument struct {
+	ID        string             `bson:"_id"`
+	URLID     primitive.ObjectID `bson:"url_id"`
+	Day       string             `bson:"day"`
+	Clicks    int                `bson:"clicks"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+func (s *mongoURLStore) CountDailyClick(ctx context.Context, link *URLData, day string, keepUntil time.Time) (int, error) {
+	var counter dailyClickDocument
+	err := s.coll.Database().Collection("daily_clicks").FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: link.ID.Hex() + ":" + day}},
+		bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "clicks", Value: 1}}},
+			{Key: "$setOnInsert", Value: bson.D{
+				{Key: "url_id", Value: link.ID},
+				{Key: "day", Value: day},
+				{Key: "expires_at", Value: keepUntil},
+			}},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Clicks, nil
+}
+
+func (s *mongoURLStore) PauseLink(ctx context.Context, link *URLData, until time.Time) (bool, error) {
+	res, err := s.coll.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: link.ID},
+		{Key: "user_id", Value: link.UserID},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "paused_until", Value: nil}},
+			bson.D{{Key: "paused_until", Value: bson.D{{Key: "$lt", Value: until}}}},
+		}},
+	}, bson.D{{Key: "$set", Value: bson.D{{Key: "paused_until", Value: until}}}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (s *mongoURLStore) ResumePausedLinks(ctx context.Context, now time.Time, limit int) ([]*URLData, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{{Key: "paused_until", Value: bson.D{{Key: "$lte", Value: now}}}},
+		options.Find().
+			SetProjection(bson.D{
+				{Key: "_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "short_url", Value: 1},
+				{Key: "daily_click_limit", Value: 1}, {Key: "daily_click_timezone", Value: 1}, {Key: "paused_until", Value: 1},
+			}).
+			SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var paused []*URLData
+	if err := cursor.All(ctx, &paused); err != nil {
+		return nil, err
+	}
+	resumed := []*URLData{}
+	for _, link := range paused {
+		// Only the run that clears this pause reports it
+		res, err := s.coll.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: link.ID}, {Key: "paused_until", Value: *link.PausedUntil}},
+			bson.D{{Key: "$unset", Value: bson.D{{Key: "paused_until", Value: ""}}}})
+		if err != nil {
+			return resumed, err
+		}
+		if res.ModifiedCount > 0 {
+			resumed = append(resumed, link)
+		}
+	}
+	return resumed, nil
+}
+
+func (s *mongoURLStore) CountActiveLinks(ctx context.Context, userID string) (int64, error) {
+	return s.coll.CountDocuments(ctx, bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+	})
+}
+
+func (s *mongoURLStore) ListLinks(ctx context.Context, userID string, filter LinkFilter, skip, limit int, withStats bool, fields []string) ([]map[string]interface{}, int64, map[string]interface{}, error) {
+	return GetUserAnalyticsPage(ctx, analyticsCollection(s.coll), userID, filter, skip, limit, withStats, fields)
+}
+
+func (s *mongoURLStore) PinLink(ctx context.Context, userID, code string, pinned bool, limit int) (*URLData, error) {
+	now := clock.Now()
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: now}}},
+		{Key: "$unset", Value: bson.D{{Key: "pinned", Value: ""}}},
+	}
+	if pinned {
+		// Concurrent pins can overshoot the limit by a few; it only keeps the top of listings short
+		count, err := s.coll.CountDocuments(ctx, bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "pinned", Value: true},
+			{Key: "is_active", Value: true},
+			{Key: "short_url", Value: bson.D{{Key: "$ne", Value: code}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if count >= int64(limit) {
+			return nil, ErrLimitReached
+		}
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "pinned", Value: true}, {Key: "updated_at", Value: now}}}}
+	}
+	var link URLData
+	err := s.coll.FindOneAndUpdate(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+	}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&link)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (s *mongoURLStore) SetLinkAnalytics(ctx context.Context, userID, code string, disabled, purge bool) (*URLData, int64, error) {
+	set := bson.D{{Key: "updated_at", Value: clock.Now()}}
+	unset := bson.D{}
+	if disabled {
+		set = append(set, bson.E{Key: "analytics_disabled", Value: true})
+	} else {
+		unset = append(unset, bson.E{Key: "analytics_disabled", Value: ""})
+	}
+	if purge {
+		set = append(set, bson.E{Key: "clicks", Value: 0}, bson.E{Key: "click_history", Value: bson.A{}})
+		unset = append(unset, bson.E{Key: "last_clicked", Value: ""}, bson.E{Key: "deep_link_clicks", Value: ""})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	var link URLData
+	err := s.coll.FindOneAndUpdate(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+	}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&link)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !purge {
+		return &link, 0, nil
+	}
+	// url_id keeps the clicks of an earlier link with the same code
+	res, err := s.coll.Database().Collection("clicks").DeleteMany(ctx, bson.D{
+		{Key: "short_url", Value: link.ShortURL},
+		{Key: "url_id", Value: link.ID},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := s.coll.Database().Collection("link_outcomes").DeleteMany(ctx,
+		bson.D{{Key: "url_id", Value: link.ID}}); err != nil {
+		return nil, 0, err
+	}
+	return &link, res.DeletedCount, nil
+}
+
+func (s *mongoURLStore) folders() *mongo.Collection {
+	return s.coll.Database().Collection("folders")
+}
+
+func (s *mongoURLStore) InsertFolder(ctx context.Context, folder *Folder) error {
+	_, err := s.folders().InsertOne(ctx, folder)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoURLStore) FindFolder(ctx context.Context, userID string, id primitive.ObjectID) (*Folder, error) {
+	var folder Folder
+	err := s.folders().FindOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "user_id", Value: userID}}).Decode(&folder)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func (s *mongoURLStore) ListFolders(ctx context.Context, userID, pathPrefix string) ([]*Folder, error) {
+	filter := bson.D{{Key: "user_id", Value: userID}}
+	if pathPrefix != "" {
+		// An anchored prefix regex uses the user_id+path index
+		filter = append(filter, bson.E{Key: "path", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(pathPrefix)}})
+	}
+	cursor, err := s.folders().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "path", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	folders := []*Folder{}
+	if err := cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (s *mongoURLStore) UpdateFolders(ctx context.Context, folders []*Folder) error {
+	for _, folder := range folders {
+		_, err := s.folders().UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: folder.ID}, {Key: "user_id", Value: folder.UserID}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "name", Value: folder.Name},
+				{Key: "name_key", Value: folder.NameKey},
+				{Key: "parent_id", Value: folder.ParentID},
+				{Key: "path", Value: folder.Path},
+				{Key: "depth", Value: folder.Depth},
+				{Key: "updated_at", Value: folder.UpdatedAt},
+			}}})
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicate
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoURLStore) DeleteFolder(ctx context.Context, folder *Folder) error {
+	_, err := s.folders().DeleteOne(ctx, bson.D{{Key: "_id", Value: folder.ID}, {Key: "user_id", Value: folder.UserID}})
+	return err
+}
+
+// folderUpdate sets folder_id to folderID, or removes it for ""
+func folderUpdate(folderID string) bson.D {
+	now := bson.D{{Key: "updated_at", Value: clock.Now()}}
+	if folderID == "" {
+		return bson.D{{Key: "$set", Value: now}, {Key: "$unset", Value: bson.D{{Key: "folder_id", Value: ""}}}}
+	}
+	return bson.D{{Key: "$set", Value: append(now, bson.E{Key: "folder_id", Value: folderID})}}
+}
+
+func (s *mongoURLStore) MoveLinksToFolder(ctx context.Context, userID string, codes []string, folderID string) (int64, error) {
+	res, err := s.coll.UpdateMany(ctx, bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "short_url", Value: bson.D{{Key: "$in", Value: codes}}},
+	}, folderUpdate(folderID))
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+func (s *mongoURLStore) RefileFolderLinks(ctx context.Context, userID, from, to string) (int64, error) {
+	res, err := s.coll.UpdateMany(ctx, bson.D{{Key: "user_id", Value: userID}, {Key: "folder_id", Value: from}}, folderUpdate(to))
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoURLStore) FolderLinkCounts(ctx context.Context, userID string) (map[string]FolderCounts, error) {
+	cursor, err := s.coll.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}, {Key: "is_active", Value: true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$folder_id", ""}}}},
+			{Key: "links", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "clicks", Value: bson.D{{Key: "$sum", Value: "$clicks"}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		FolderID string `bson:"_id"`
+		Links    int64  `bson:"links"`
+		Clicks   int64  `bson:"clicks"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]FolderCounts, len(rows))
+	for _, row := range rows {
+		counts[row.FolderID] = FolderCounts{Links: row.Links, Clicks: row.Clicks}
+	}
+	return counts, nil
+}
+
+func (s *mongoURLStore) InsertShareEvent(ctx context.Context, link *URLData, event *ShareEvent, limit int) error {
+	shares := s.coll.Database().Collection("share_events")
+	// Concurrent inserts can overshoot the limit by a few; it only bounds list size
+	count, err := shares.CountDocuments(ctx, bson.D{{Key: "url_id", Value: link.ID}})
+	if err != nil {
+		return err
+	}
+	if count >= int64(limit) {
+		return ErrLimitReached
+	}
+	_, err = shares.InsertOne(ctx, event)
+	return err
+}
+
+func (s *mongoURLStore) CountClickWindow(ctx context.Context, link *URLData, from, to time.Time) (*ClickWindow, error) {
+	clicks := analyticsCollection(s.coll.Database().Collection("clicks"))
+	// A range on short_url_timestamp_idx; url_id keeps a reused code's old clicks out
+	cursor, err := clicks.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "short_url", Value: link.ShortURL},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lt", Value: to}}},
+			{Key: "url_id", Value: link.ID},
+			{Key: "bot", Value: false},
+		}}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "clicks"}}}},
+			{Key: "uniques", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "ip_hash", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}}}},
+				bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$ip_hash"}}}},
+				bson.D{{Key: "$count", Value: "visitors"}},
+			}},
+			{Key: "referrers", Value: bson.A{
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$referrer_host", ""}}}},
+					{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+			}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Total []struct {
+			Clicks int64 `bson:"clicks"`
+		} `bson:"total"`
+		Uniques []struct {
+			Visitors int64 `bson:"visitors"`
+		} `bson:"uniques"`
+		Referrers []struct {
+			Host   string `bson:"_id"`
+			Clicks int64  `bson:"clicks"`
+		} `bson:"referrers"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	window := newClickWindow(from, to)
+	if len(results) == 0 {
+		return window, nil
+	}
+	if len(results[0].Total) > 0 {
+		window.Clicks = results[0].Total[0].Clicks
+	}
+	if len(results[0].Uniques) > 0 {
+		window.UniqueVisitors = results[0].Uniques[0].Visitors
+	}
+	for _, ref := range results[0].Referrers {
+		window.addReferrer(ref.Host, ref.Clicks)
+	}
+	return window, nil
+}
+
+// CountLinkClicks reads the primary, unlike the analytics, since its counts replace the
+// link's counter
+func (s *mongoURLStore) CountLinkClicks(ctx context.Context, link *URLData) (*ClickCounters, error) {
+	cursor, err := s.coll.Database().Collection("clicks").Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "short_url", Value: link.ShortURL},
+			{Key: "url_id", Value: link.ID},
+		}}},
+		bson.D{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: nil},
+				{Key: "clicks", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "bots", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{"$bot", 1, 0}}}}}},
+				{Key: "last", Value: bson.D{{Key: "$max", Value: "$timestamp"}}},
+			}}}}},
+			{Key: "uniques", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{
+					{Key: "bot", Value: false},
+					{Key: "ip_hash", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}},
+				}}},
+				bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$ip_hash"}}}},
+				bson.D{{Key: "$count", Value: "visitors"}},
+			}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Total []struct {
+			Clicks int64     `bson:"clicks"`
+			Bots   int64     `bson:"bots"`
+			Last   time.Time `bson:"last"`
+		} `bson:"total"`
+		Uniques []struct {
+			Visitors int64 `bson:"visitors"`
+		} `bson:"uniques"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	counters := &ClickCounters{}
+	if len(results) == 0 {
+		return counters, nil
+	}
+	if len(results[0].Total) > 0 {
+		total := results[0].Total[0]
+		counters.Clicks = total.Clicks
+		counters.BotClicks = total.Bots
+		if total.Clicks > 0 {
+			last := total.Last
+			counters.LastClicked = &last
+		}
+	}
+	if len(results[0].Uniques) > 0 {
+		counters.UniqueClicks = results[0].Uniques[0].Visitors
+	}
+	return counters, nil
+}
+
+func (s *mongoURLStore) SetClickCounters(ctx context.Context, link *URLData, counters ClickCounters) (bool, error) {
+	set := bson.D{{Key: "clicks", Value: counters.Clicks}}
+	var update bson.D
+	if counters.LastClicked != nil {
+		update = bson.D{{Key: "$set", Value: append(set, bson.E{Key: "last_clicked", Value: *counters.LastClicked})}}
+	} else {
+		update = bson.D{{Key: "$set", Value: set}, {Key: "$unset", Value: bson.D{{Key: "last_clicked", Value: ""}}}}
+	}
+	res, err := s.coll.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: link.ID},
+		{Key: "user_id", Value: link.UserID},
+		{Key: "clicks", Value: link.Clicks},
+	}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// counterProjection loads what recounts need of a link
+var counterProjection = bson.D{
+	{Key: "_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "short_url", Value: 1},
+	{Key: "clicks", Value: 1}, {Key: "last_clicked", Value: 1},
+}
+
+func (s *mongoURLStore) ListUserLinks(ctx context.Context, userID string, limit int) ([]*URLData, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{
+		{Key: "user_id", Value: userID},
+		{Key: "deactivated_reason", Value: bson.D{{Key: "$ne", Value: DeactivatedDraft}}},
+	}, options.Find().
+		SetProjection(counterProjection).
+		SetSort(bson.D{{Key: "short_url", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	links := []*URLData{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongoURLStore) SampleLinks(ctx context.Context, size int) ([]*URLData, error) {
+	cursor, err := s.coll.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "deactivated_reason", Value: bson.D{{Key: "$ne", Value: DeactivatedDraft}}}}}},
+		bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}},
+		bson.D{{Key: "$project", Value: counterProjection}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	links := []*URLData{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongoURLStore) ListShareEvents(ctx context.Context, link *URLData, from, to time.Time) ([]ShareEvent, error) {
+	filter := bson.D{{Key: "url_id", Value: link.ID}}
+	sharedAt := bson.D{}
+	if !from.IsZero() {
+		sharedAt = append(sharedAt, bson.E{Key: "$gte", Value: from})
+	}
+	if !to.IsZero() {
+		sharedAt = append(sharedAt, bson.E{Key: "$lt", Value: to})
+	}
+	if len(sharedAt) > 0 {
+		filter = append(filter, bson.E{Key: "shared_at", Value: sharedAt})
+	}
+	cursor, err := s.coll.Database().Collection("share_events").Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "shared_at", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	shares := []ShareEvent{}
+	if err := cursor.All(ctx, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (s *mongoURLStore) analyticsShares() *mongo.Collection {
+	return s.coll.Database().Collection("analytics_shares")
+}
+
+func (s *mongoURLStore) InsertAnalyticsShare(ctx context.Context, share *AnalyticsShare, limit int, now time.Time) error {
+	// Concurrent inserts can overshoot the limit by a few, like share events
+	count, err := s.analyticsShares().CountDocuments(ctx, bson.D{
+		{Key: "user_id", Value: share.UserID},
+		{Key: "revoked_at", Value: nil},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: now}}},
+	})
+	if err != nil {
+		return err
+	}
+	if count >= int64(limit) {
+		return ErrLimitReached
+	}
+	_, err = s.analyticsShares().InsertOne(ctx, share)
+	return err
+}
+
+func (s *mongoURLStore) FindAnalyticsShare(ctx context.Context, tokenHash string) (*AnalyticsShare, error) {
+	var share AnalyticsShare
+	err := s.analyticsShares().FindOne(ctx, bson.D{{Key: "token_hash", Value: tokenHash}}).Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+func (s *mongoURLStore) ListAnalyticsShares(ctx context.Context, userID string) ([]AnalyticsShare, error) {
+	cursor, err := s.analyticsShares().Find(ctx, bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	shares := []AnalyticsShare{}
+	if err := cursor.All(ctx, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (s *mongoURLStore) RevokeAnalyticsShare(ctx context.Context, userID string, id primitive.ObjectID, now time.Time) error {
+	res, err := s.analyticsShares().UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "user_id", Value: userID}, {Key: "revoked_at", Value: nil}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: now.UTC()}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoURLStore) EditLink(ctx context.Context, link *URLData, edit LinkEdit) (bool, error) {
+	filter := bson.D{{Key: "_id", Value: link.ID}, {Key: "user_id", Value: link.UserID}}
+	if link.UpdatedAt != nil {
+		filter = append(filter, bson.E{Key: "updated_at", Value: *link.UpdatedAt})
+	} else {
+		filter = append(filter, bson.E{Key: "updated_at", Value: bson.D{{Key: "$exists", Value: false}}})
+	}
+	set := bson.D{{Key: "updated_at", Value: clock.Now()}}
+	unset := bson.D{}
+	if edit.LongURL != nil {
+		set = append(set, bson.E{Key: "long_url", Value: *edit.LongURL})
+		for _, field := range []string{"resolved_destination", "redirect_chain_length", "favicon_url", "favicon_data", "accent_color", "favicon_fetched_at"} {
+			unset = append(unset, bson.E{Key: field, Value: ""})
+		}
+	}
+	if edit.Tags != nil {
+		if len(*edit.Tags) > 0 {
+			set = append(set, bson.E{Key: "tags", Value: *edit.Tags})
+		} else {
+			unset = append(unset, bson.E{Key: "tags", Value: ""})
+		}
+	}
+	if edit.ExpiresAt != nil {
+		set = append(set, bson.E{Key: "expires_at", Value: *edit.ExpiresAt})
+	}
+	if edit.Active != nil {
+		set = append(set, bson.E{Key: "is_active", Value: *edit.Active})
+		if *edit.Active {
+			unset = append(unset, bson.E{Key: "deactivated_reason", Value: ""})
+		} else {
+			set = append(set, bson.E{Key: "deactivated_reason", Value: DeactivatedByOwner})
+		}
+	}
+	if edit.PublicNote != nil {
+		if *edit.PublicNote != "" {
+			set = append(set, bson.E{Key: "public_note", Value: *edit.PublicNote})
+		} else {
+			unset = append(unset, bson.E{Key: "public_note", Value: ""})
+		}
+	}
+	if edit.Internal != nil {
+		if *edit.Internal {
+			set = append(set, bson.E{Key: "internal", Value: true})
+		} else {
+			unset = append(unset, bson.E{Key: "internal", Value: ""})
+		}
+	}
+	if edit.Pinned != nil && *edit.Pinned {
+		// Concurrent pins can overshoot the limit by a few, as with PinLink
+		count, err := s.coll.CountDocuments(ctx, bson.D{
+			{Key: "user_id", Value: link.UserID},
+			{Key: "pinned", Value: true},
+			{Key: "is_active", Value: true},
+			{Key: "_id", Value: bson.D{{Key: "$ne", Value: link.ID}}},
+		})
+		if err != nil {
+			return false, err
+		}
+		if count >= int64(edit.PinLimit) {
+			return false, ErrLimitReached
+		}
+		set = append(set, bson.E{Key: "pinned", Value: true})
+	} else if edit.Pinned != nil {
+		unset = append(unset, bson.E{Key: "pinned", Value: ""})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	// The partial unique index on (user_id, long_url, domain) for active links refuses a
+	// second active link to the same destination
+	res, err := s.coll.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, ErrDuplicate
+	} else if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoURLStore) DeactivateLink(ctx context.Context, userID, code, reason string) (bool, error) {
+	res, err := s.coll.UpdateOne(ctx,
+		bson.D{{Key: "short_url", Value: code}, {Key: "user_id", Value: userID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "is_active", Value: false},
+			{Key: "deactivated_reason", Value: reason},
+			{Key: "updated_at", Value: clock.Now()},
+		}}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoURLStore) ReleaseDraft(ctx context.Context, code string) (bool, error) {
+	var draft URLData
+	err := s.coll.FindOneAndDelete(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "deactivated_reason", Value: DeactivatedDraft},
+	}, options.FindOneAndDelete().SetProjection(bson.D{{Key: "_id", Value: 1}})).Decode(&draft)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, releaseCode(ctx, s.coll.Database(), code, draft.ID.Hex())
+}
+
+func (s *mongoURLStore) SetFavicon(ctx context.Context, link *URLData, favicon LinkFavicon) error {
+	set := bson.D{{Key: "accent_color", Value: favicon.AccentColor}}
+	unset := bson.D{}
+	for _, field := range []struct {
+		key   string
+		value string
+	}{{"favicon_url", favicon.URL}, {"favicon_data", favicon.Data}} {
+		if field.value != "" {
+			set = append(set, bson.E{Key: field.key, Value: field.value})
+		} else {
+			unset = append(unset, bson.E{Key: field.key, Value: ""})
+		}
+	}
+	if favicon.FetchedAt != nil {
+		set = append(set, bson.E{Key: "favicon_fetched_at", Value: *favicon.FetchedAt})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	_, err := s.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: link.ID}, {Key: "user_id", Value: link.UserID}}, update)
+	return err
+}
+
+func (s *mongoURLStore) StaleFavicons(ctx context.Context, before time.Time, limit int) ([]*URLData, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{
+		{Key: "is_active", Value: true},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "favicon_fetched_at", Value: nil}},
+			bson.D{{Key: "favicon_fetched_at", Value: bson.D{{Key: "$lt", Value: before}}}},
+		}},
+	}, options.Find().
+		SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "short_url", Value: 1}, {Key: "long_url", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	links := []*URLData{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongoURLStore) SetRedirectProbe(ctx context.Context, link *URLData, resolved string, hops int) error {
+	_, err := s.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: link.ID}, {Key: "user_id", Value: link.UserID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "resolved_destination", Value: resolved},
+			{Key: "redirect_chain_length", Value: hops},
+		}}})
+	return err
+}
+
+func (s *mongoURLStore) InsertAbuseReport(ctx context.Context, report *AbuseReport) error {
+	// A partial unique index on (url_id, ip_hash) for open reports refuses a second report
+	// from the same IP
+	_, err := s.coll.Database().Collection("abuse_reports").InsertOne(ctx, report)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoURLStore) CountAbuseReporters(ctx context.Context, linkID primitive.ObjectID, since time.Time) (int64, error) {
+	return s.coll.Database().Collection("abuse_reports").CountDocuments(ctx, bson.D{
+		{Key: "url_id", Value: linkID},
+		{Key: "status", Value: AbuseReportOpen},
+		{Key: "created_at", Value: bson.D{{Key: "$gte", Value: since}}},
+	})
+}
+
+func (s *mongoURLStore) ListAbuseReports(ctx context.Context, limit int) ([]AbuseReport, error) {
+	cursor, err := s.coll.Database().Collection("abuse_reports").Find(ctx,
+		bson.D{{Key: "status", Value: AbuseReportOpen}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	reports := []AbuseReport{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+func (s *mongoURLStore) ResolveAbuseReports(ctx context.Context, code, resolution string) (int64, error) {
+	res, err := s.coll.Database().Collection("abuse_reports").UpdateMany(ctx,
+		bson.D{{Key: "short_url", Value: code}, {Key: "status", Value: AbuseReportOpen}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: resolution},
+			{Key: "resolved_at", Value: clock.Now()},
+		}}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoURLStore) SetAbuseFlag(ctx context.Context, code string, flagged bool) (bool, error) {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "abuse_flagged", Value: true}}}}
+	if !flagged {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "abuse_flagged", Value: ""}}}}
+	}
+	res, err := s.coll.UpdateOne(ctx, bson.D{{Key: "short_url", Value: code}}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoURLStore) GetDomainBranding(ctx context.Context, host string) (*DomainBranding, error) {
+	var branding DomainBranding
+	err := s.coll.Database().Collection("domain_branding").FindOne(ctx, bson.D{{Key: "_id", Value: host}}).Decode(&branding)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &branding, nil
+}
+
+func (s *mongoURLStore) SaveDomainBranding(ctx context.Context, branding *DomainBranding) error {
+	_, err := s.coll.Database().Collection("domain_branding").ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: branding.Host}}, branding, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoURLStore) DeleteDomainBranding(ctx context.Context, host string) (bool, error) {
+	res, err := s.coll.Database().Collection("domain_branding").DeleteOne(ctx, bson.D{{Key: "_id", Value: host}})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (s *mongoURLStore) DeactivateExpired(ctx context.Context) (int64, error) {
+	// Expiry is evaluated on the database clock ($$NOW), the same one redirects use
+	filter := append(expiredFilter(), bson.E{Key: "is_active", Value: true})
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "is_active", Value: false},
+			{Key: "deactivated_reason", Value: DeactivatedExpired},
+		}},
+		// Stamped with the database clock, like the expiry check itself
+		{Key: "$currentDate", Value: bson.D{{Key: "updated_at", Value: true}}},
+	}
+	result, err := s.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *mongoURLStore) GlobalCounts(ctx context.Context, since time.Time) (int64, int64, int64, error) {
+	cursor, err := s.coll.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "links", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "clicks", Value: bson.D{{Key: "$sum", Value: "$clicks"}}},
+			{Key: "recent", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$gte", Value: bson.A{"$created_at", since}}}, 1, 0,
+			}}}}}},
+		}}},
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer cursor.Close(ctx)
+	var totals []struct {
+		Links  int64 `bson:"links"`
+		Clicks int64 `bson:"clicks"`
+		Recent int64 `bson:"recent"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil || len(totals) == 0 {
+		return 0, 0, 0, err
+	}
+	return totals[0].Links, totals[0].Clicks, totals[0].Recent, nil
+}
+
+func (s *mongoURLStore) findOne(ctx context.Context, filter bson.D) (*URLData, error) {
+	var link URLData
+	err := s.coll.FindOne(ctx, filter).Decode(&link)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
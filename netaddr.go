@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// ============================================================================
+// HOST AND ADDRESS PARSING
+// ============================================================================
+//
+// Hosts and client addresses arrive with and without ports, IPv6 ones with and without
+// brackets: "192.0.2.1:5000", "[2001:db8::1]:443", "2001:db8::1", "[::1]". Everything that
+// reads one goes through splitHost and parseIPAddress rather than cutting at the last colon,
+// which mangles a bare IPv6 address. Addresses are kept in canonical form, with IPv4-mapped
+// IPv6 addresses as plain IPv4, so one client always has one key. Rate limits count IPv6
+// clients by their /64: a subscriber usually holds a whole /64 and could otherwise rotate
+// through it to reset every limit.
+
+// ipv6RateLimitPrefix is the prefix length IPv6 clients are rate limited by
+const ipv6RateLimitPrefix = 64
+
+// splitHost returns the host of hostport, dropping a port and IPv6 brackets. A bare IPv6
+// address is returned whole.
+func splitHost(hostport string) string {
+	hostport = strings.TrimSpace(hostport)
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	if strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]") {
+		return hostport[1 : len(hostport)-1]
+	}
+	return hostport
+}
+
+// parseIPAddress parses an address as found in headers and RemoteAddr, with or without a
+// port, brackets or IPv6 zone; nil when it is not an IP address. IPv4-mapped IPv6 addresses
+// are returned as IPv4.
+func parseIPAddress(raw string) net.IP {
+	host, _, _ := strings.Cut(splitHost(raw), "%")
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// canonicalIP returns raw in canonical form, e.g. "2001:db8::1" or "192.0.2.1"; "" when it
+// is not an IP address
+func canonicalIP(raw string) string {
+	ip := parseIPAddress(raw)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// clientAddress returns the client address of a request that came from peer (its
+// RemoteAddr) with the given X-Forwarded-For and X-Real-IP headers. The headers are only
+// read when peer is in TRUSTED_PROXIES, as anyone else can put any address in them. Each
+// proxy appends the address it got the request from to X-Forwarded-For, so the list is
+// walked from the right, past the trusted proxies, and the first other address is the
+// client: everything to its left came from the client and may be forged. X-Real-IP is used
+// when X-Forwarded-For holds no address, and peer when neither does.
+func clientAddress(peer, forwardedFor, realIP string) string {
+	peerIP := parseIPAddress(peer)
+	if peerIP == nil {
+		return splitHost(peer)
+	}
+	if !trustedProxyIP(peerIP) {
+		return peerIP.String()
+	}
+	client := ""
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIPAddress(hops[i])
+		if ip == nil {
+			// Nothing left of a hop that is not an address can be told apart from forgery
+			break
+		}
+		client = ip.String()
+		if !trustedProxyIP(ip) {
+			return client
+		}
+	}
+	if client != "" {
+		// Every hop is a trusted proxy: the client is on the trusted network itself
+		return client
+	}
+	if ip := canonicalIP(realIP); ip != "" {
+		return ip
+	}
+	return peerIP.String()
+}
+
+// rateLimitSubject returns what rate limits count ip as: the IPv4 address, or the IPv6
+// address's /64 such as "2001:db8:1:2::/64". Anything that is not an address is returned as is.
+func rateLimitSubject(ip string) string {
+	parsed := parseIPAddress(ip)
+	if parsed == nil {
+		return ip
+	}
+	if parsed.To4() != nil {
+		return parsed.String()
+	}
+	prefix := net.IPNet{IP: parsed.Mask(net.CIDRMask(ipv6RateLimitPrefix, 128)), Mask: net.CIDRMask(ipv6RateLimitPrefix, 128)}
+	return prefix.String()
+}
+
+// isNumericHost reports whether host looks like an IP address in a form net.ParseIP does not
+// accept but resolvers may, e.g. "2130706433", "0x7f.1" or "127.1": its last label is a number
+func isNumericHost(host string) bool {
+	label := strings.ToLower(host[strings.LastIndex(host, ".")+1:])
+	digits := "0123456789"
+	if hex, ok := strings.CutPrefix(label, "0x"); ok {
+		label, digits = hex, "0123456789abcdef"
+	}
+	return label != "" && strings.Trim(label, digits) == ""
+}
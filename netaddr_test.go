@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// withTrustedProxies sets TRUSTED_PROXIES for the duration of a test
+func withTrustedProxies(t *testing.T, raw string) {
+	t.Helper()
+	nets, err := parseTrustedProxies(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	trustedProxies = nets
+	t.Cleanup(func() { trustedProxies = saved })
+}
+
+func TestSplitHost(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:5000", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"::1", "::1"},
+		{"[::1]:8080", "::1"},
+		{"localhost:3000", "localhost"},
+		{"example.com", "example.com"},
+		{" 192.0.2.1:80 ", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := splitHost(tt.in); got != tt.want {
+			t.Errorf("splitHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:5000", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%25eth0]:80", "fe80::1"},
+		{"localhost", ""},
+		{"2001:db8:", ""},
+		{"", ""},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		if got := canonicalIP(tt.in); got != tt.want {
+			t.Errorf("canonicalIP(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitSubject(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:ffff:ffff:ffff:ffff", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:3::1]:443", "2001:db8:1:3::/64"},
+		{"user-123", "user-123"},
+	}
+	for _, tt := range tests {
+		if got := rateLimitSubject(tt.in); got != tt.want {
+			t.Errorf("rateLimitSubject(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsNumericHost(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"2130706433", true},
+		{"127.1", true},
+		{"0x7f.1", true},
+		{"0x7f000001", true},
+		{"example.com", false},
+		{"1.example.com", false},
+		{"example.123x", false},
+	}
+	for _, tt := range tests {
+		if got := isNumericHost(tt.in); got != tt.want {
+			t.Errorf("isNumericHost(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateURLHosts(t *testing.T) {
+	t.Setenv("ALLOW_LOCALHOST", "")
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"https://example.com/page", true},
+		{"https://example.com:8443/page", true},
+		{"http://10.1.2.3/", false},
+		{"http://93.184.216.34/", true},
+		{"http://93.184.216.34:8080/", true},
+		{"http://localhost:3000/", false},
+		{"http://app.localhost/", false},
+		{"http://127.0.0.1:8080/", false},
+		{"http://[::1]/", false},
+		{"http://[::1]:8080/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://[fc00::1]/", false},
+		{"http://[2606:4700::1111]/", true},
+		{"http://[2606:4700::1111]:8443/", true},
+		{"http://2130706433/", false},
+		{"http://127.1/", false},
+		{"http://0x7f.1/", false},
+	}
+	for _, tt := range tests {
+		if got := validateURL(tt.in); got != tt.want {
+			t.Errorf("validateURL(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	t.Setenv("ALLOW_LOCALHOST", "true")
+	for _, in := range []string{"http://localhost:3000/", "http://127.0.0.1:8080/", "http://[::1]:8080/"} {
+		if !validateURL(in) {
+			t.Errorf("validateURL(%q) = false with ALLOW_LOCALHOST=true", in)
+		}
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8,2001:db8:ffff::/48")
+	tests := []struct {
+		name                       string
+		peer, forwardedFor, realIP string
+		want                       string
+	}{
+		{"direct v4", "198.51.100.7:51000", "", "", "198.51.100.7"},
+		{"direct v6", "[2001:db8:1::7]:51000", "", "", "2001:db8:1::7"},
+		{"direct v4-mapped v6", "[::ffff:198.51.100.7]:51000", "", "", "198.51.100.7"},
+		{"untrusted peer cannot forward", "198.51.100.7:51000", "203.0.113.9", "203.0.113.8", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.2:40000", "203.0.113.9", "", "203.0.113.9"},
+		{"forged hops left of the client", "10.0.0.2:40000", "1.2.3.4, 5.6.7.8, 203.0.113.9", "", "203.0.113.9"},
+		{"chain of trusted proxies", "10.0.0.2:40000", "203.0.113.9, 10.0.0.5, 10.0.0.3", "", "203.0.113.9"},
+		{"forged hop behind proxy chain", "10.0.0.2:40000", "1.2.3.4, 203.0.113.9, 10.0.0.3", "", "203.0.113.9"},
+		{"v6 hop with brackets and port", "[2001:db8:ffff::2]:40000", "[2001:db8:2::9]:5555", "", "2001:db8:2::9"},
+		{"v4-mapped hop", "10.0.0.2:40000", "::ffff:203.0.113.9", "", "203.0.113.9"},
+		{"garbage right of the client", "10.0.0.2:40000", "203.0.113.9, garbage", "", "10.0.0.2"},
+		{"garbage left of the client", "10.0.0.2:40000", "garbage, 203.0.113.9", "", "203.0.113.9"},
+		{"client on the trusted network", "10.0.0.2:40000", "10.1.2.3, 10.0.0.3", "", "10.1.2.3"},
+		{"x-real-ip from trusted proxy", "10.0.0.2:40000", "", "203.0.113.9", "203.0.113.9"},
+		{"x-forwarded-for wins over x-real-ip", "10.0.0.2:40000", "203.0.113.9", "203.0.113.8", "203.0.113.9"},
+		{"unusable headers from trusted proxy", "10.0.0.2:40000", "", "nonsense", "10.0.0.2"},
+		{"peer that is not an address", "pipe", "203.0.113.9", "", "pipe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientAddress(tt.peer, tt.forwardedFor, tt.realIP); got != tt.want {
+				t.Errorf("clientAddress(%q, %q, %q) = %q, want %q", tt.peer, tt.forwardedFor, tt.realIP, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetClientIPJoinsForwardedForHeaders(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	r := httptest.NewRequest("GET", "/abc123", nil)
+	r.RemoteAddr = "10.0.0.2:40000"
+	r.Header.Add("X-Forwarded-For", "1.2.3.4")
+	r.Header.Add("X-Forwarded-For", "203.0.113.9")
+	if got := getClientIP(r); got != "203.0.113.9" {
+		t.Fatalf("getClientIP = %q, want 203.0.113.9", got)
+	}
+
+	// Rotating the header from an untrusted peer does not change the address
+	r.RemoteAddr = "198.51.100.7:51000"
+	for _, forged := range []string{"1.1.1.1", "2.2.2.2", "2001:db8::1"} {
+		r.Header.Set("X-Forwarded-For", forged)
+		r.Header.Set("X-Real-IP", forged)
+		if got := getClientIP(r); got != "198.51.100.7" {
+			t.Fatalf("getClientIP with forged %s = %q, want the peer", forged, got)
+		}
+	}
+}
+
+func TestNormalizeClickIP(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name, recorded, peer string
+		want                 string
+		changed              bool
+	}{
+		{"trusted peer keeps recorded", "203.0.113.9", "10.0.0.2:40000", "203.0.113.9", false},
+		{"untrusted peer replaces recorded", "203.0.113.9", "198.51.100.7:51000", "198.51.100.7", true},
+		{"canonical v6", "2001:DB8::1", "[2001:db8::1]:443", "2001:db8::1", true},
+		{"v4-mapped", "::ffff:203.0.113.9", "10.0.0.2:40000", "203.0.113.9", true},
+		{"unparseable recorded is dropped", "<script>", "10.0.0.2:40000", "", true},
+		{"no peer trusts recorded", "203.0.113.9", "", "203.0.113.9", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := normalizeClickIP(tt.recorded, tt.peer)
+			if got != tt.want || changed != tt.changed {
+				t.Errorf("normalizeClickIP(%q, %q) = %q, %v; want %q, %v", tt.recorded, tt.peer, got, changed, tt.want, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// OUTBOUND HTTP CLIENTS
+// ============================================================================
+//
+// Every request the server makes to another host uses a client from newOutboundClient. That
+// way timeouts, TLS verification, the RapidLinkBot User-Agent, the response size cap, the
+// OUTBOUND_PROXY_URL proxy and the per-host rate limit apply everywhere. Clients for
+// user-supplied URLs set publicOnly and refuse non-public addresses (see safefetch.go):
+//   - Without a proxy, the check runs on the dialed IP. That also covers redirects and DNS
+//     names that rebind to an internal address after an earlier lookup.
+//   - Through a proxy, the destination is resolved and checked before the request is sent.
+//     The proxy resolves it again, so it should refuse internal addresses itself.
+// Clients for endpoints the operator configured (click sink, webhooks, CAPTCHA, S3) may reach
+// internal addresses. The benchmark and security test tools keep their own clients, since
+// they load-test this server itself.
+
+const (
+	outboundDefaultTimeout  = 10 * time.Second
+	outboundDefaultMaxBytes = 10 << 20
+	outboundMaxRedirects    = 3
+	outboundUserAgent       = "RapidLinkBot/1.0"
+	// outboundDefaultHostRate is the default number of requests per second to one host
+	outboundDefaultHostRate = 10
+	outboundHostBucketLimit = 10000
+)
+
+var errResponseTooLarge = errors.New("response body exceeds the size limit")
+
+// ipResolver looks up the addresses of a host name
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var (
+	outboundProxy    *url.URL
+	outboundHostRate float64 = outboundDefaultHostRate
+	outboundLimiter          = &hostRateLimiter{buckets: make(map[string]*hostBucket)}
+	// outboundResolver resolves every outbound destination, for the dial and the host checks
+	outboundResolver ipResolver = net.DefaultResolver
+)
+
+// InitOutboundHTTP reads OUTBOUND_PROXY_URL and OUTBOUND_HOST_RATE_PER_SECOND (0 disables the
+// per-host limit)
+func InitOutboundHTTP() error {
+	if raw := os.Getenv("OUTBOUND_PROXY_URL"); raw != "" {
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("OUTBOUND_PROXY_URL must be an http or https URL")
+		}
+		outboundProxy = parsed
+		log.Printf("🌐 Outbound requests go through the proxy %s", redactURL(raw))
+	}
+	if raw := os.Getenv("OUTBOUND_HOST_RATE_PER_SECOND"); raw != "" {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("OUTBOUND_HOST_RATE_PER_SECOND must be a non-negative number")
+		}
+		outboundHostRate = rate
+	}
+	return nil
+}
+
+// outboundOptions configures a client from newOutboundClient
+type outboundOptions struct {
+	// timeout bounds a whole request including reading the body; outboundDefaultTimeout when 0
+	timeout time.Duration
+	// maxBytes caps every response body, reads past it fail with errResponseTooLarge;
+	// outboundDefaultMaxBytes when 0, no cap when negative
+	maxBytes int64
+	// publicOnly refuses destinations with a non-public address
+	publicOnly bool
+	// noRedirects hands every 3xx back to the caller instead of following up to
+	// outboundMaxRedirects
+	noRedirects bool
+	// userAgent replaces outboundUserAgent for requests without one of their own
+	userAgent string
+}
+
+// newOutboundClient returns a hardened client for requests to other hosts
+func newOutboundClient(opts outboundOptions) *http.Client {
+	if opts.timeout == 0 {
+		opts.timeout = outboundDefaultTimeout
+	}
+	if opts.maxBytes == 0 {
+		opts.maxBytes = outboundDefaultMaxBytes
+	}
+	if opts.userAgent == "" {
+		opts.userAgent = outboundUserAgent
+	}
+	dialer := &net.Dialer{Timeout: opts.timeout}
+	if opts.publicOnly {
+		dialer.Control = func(network, address string, conn syscall.RawConn) error {
+			// Through a proxy the check would judge the proxy's address, RoundTrip checks instead
+			if outboundProxy != nil {
+				return nil
+			}
+			return safeDialControl(network, address, conn)
+		}
+	}
+	transport := &http.Transport{
+		Proxy:                 outboundProxyFor,
+		DialContext:           resolvingDialer(dialer),
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   opts.timeout,
+		ResponseHeaderTimeout: opts.timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	return &http.Client{
+		Timeout:   opts.timeout,
+		Transport: &outboundTransport{base: transport, opts: opts},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if opts.noRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= outboundMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", outboundMaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// resolvingDialer dials the addresses outboundResolver returns for the host, in order, so the
+// dialer's Control sees each address actually connected to
+func resolvingDialer(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if parseIPAddress(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addrs, err := outboundResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// outboundProxyFor is the Proxy function of every outbound transport
+func outboundProxyFor(*http.Request) (*url.URL, error) {
+	return outboundProxy, nil
+}
+
+// outboundTransport applies the User-Agent, the host checks and rate limit and the body cap
+// to each request, redirects included
+type outboundTransport struct {
+	base *http.Transport
+	opts outboundOptions
+}
+
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	if t.opts.publicOnly && outboundProxy != nil {
+		if err := checkPublicHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	if err := outboundLimiter.wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.opts.userAgent)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.opts.maxBytes > 0 {
+		if resp.ContentLength > t.opts.maxBytes {
+			resp.Body.Close()
+			return nil, errResponseTooLarge
+		}
+		resp.Body = &cappedBody{ReadCloser: resp.Body, remaining: t.opts.maxBytes}
+	}
+	return resp, nil
+}
+
+// checkPublicHost resolves host and refuses it when any of its addresses is non-public
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := parseIPAddress(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errBlockedAddress
+		}
+		return nil
+	}
+	addrs, err := outboundResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errBlockedAddress
+		}
+	}
+	return nil
+}
+
+// cappedBody fails reads once more than remaining bytes were read
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		incMetric("outbound_responses_too_large_total", 1)
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+// hostBucket is the token bucket of one destination host
+type hostBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// hostRateLimiter spaces out requests to the same host at outboundHostRate per second, with
+// bursts of up to one second's worth
+type hostRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*hostBucket
+}
+
+// wait blocks until a request to host may be sent, or fails when ctx ends first
+func (l *hostRateLimiter) wait(ctx context.Context, host string) error {
+	delay := l.reserve(host, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	incMetric("outbound_rate_limited_total", 1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token for host at now and returns how long to wait until it is valid
+func (l *hostRateLimiter) reserve(host string, now time.Time) time.Duration {
+	rate := outboundHostRate
+	if rate <= 0 {
+		return 0
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[host]
+	if !ok {
+		if len(l.buckets) >= outboundHostBucketLimit {
+			// Drop buckets that have refilled, they behave like new ones
+			for h, b := range l.buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+					delete(l.buckets, h)
+				}
+			}
+		}
+		bucket = &hostBucket{tokens: burst, last: now}
+		l.buckets[host] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// DATA PARTITIONING HOOKS (SHARDING AND MULTI-TENANCY)
+// ============================================================================
+//
+// COLLECTION_SHARD_KEY=user_id prepares the urls collection for sharding by owner:
+// compound indexes are created with the shard key as prefix so owner-scoped queries
+// (listing, analytics, dedupe, delete - all of which filter on user_id) are routed to a
+// single shard.
+//
+// Routing implications operators must know about:
+//   - redirect() and the public resolve API look links up by short_url alone because the
+//     visitor does not know the owner. On a sharded cluster these are scatter-gather
+//     queries hitting every shard; the short_url index keeps each shard's part cheap.
+//   - MongoDB only enforces unique indexes on sharded collections when they are prefixed
+//     by the shard key, so short_url uniqueness is then guaranteed by the application's
+//     collision checks rather than by the database.
+//
+// When COLLECTION_SHARD_KEY is unset, nothing in this file changes behavior.
+
+// supportedShardKeys lists fields present on every urls document that can partition it
+var supportedShardKeys = map[string]bool{
+	"user_id": true,
+}
+
+// shardKey returns the configured shard key, or "" for unsharded deployments
+func shardKey() string {
+	return os.Getenv("COLLECTION_SHARD_KEY")
+}
+
+// validateShardKey checks COLLECTION_SHARD_KEY at startup
+func validateShardKey() error {
+	key := shardKey()
+	if key == "" || supportedShardKeys[key] {
+		return nil
+	}
+	return fmt.Errorf("unsupported COLLECTION_SHARD_KEY %q (supported: user_id)", key)
+}
+
+// withShardKey prefixes compound index keys with the shard key. Keys are returned unchanged
+// when no shard key is configured or the index already starts with it.
+func withShardKey(keys bson.D) bson.D {
+	key := shardKey()
+	if key == "" || (len(keys) > 0 && keys[0].Key == key) {
+		return keys
+	}
+	prefixed := make(bson.D, 0, len(keys)+1)
+	prefixed = append(prefixed, bson.E{Key: key, Value: 1})
+	for _, k := range keys {
+		if k.Key != key {
+			prefixed = append(prefixed, k)
+		}
+	}
+	return prefixed
+}
+
+// ensureShardKeyIndexes creates the shard-key-prefixed compound indexes on deployments that
+// enabled COLLECTION_SHARD_KEY after migration 001 already ran. Index creation is idempotent.
+func ensureShardKeyIndexes(ctx context.Context, db *mongo.Database) error {
+	if shardKey() == "" {
+		return nil
+	}
+	_, err := db.Collection("urls").Indexes().CreateOne(ctx, activeCreatedAtIndexModel())
+	if err == nil {
+		log.Printf("✅ Shard-key indexes ensured (COLLECTION_SHARD_KEY=%s)", shardKey())
+	}
+	return err
+}
+
+// TenantResolver maps a request to the database holding that tenant's data, allowing
+// enterprise tenants to live in physically separate databases
+type TenantResolver interface {
+	ResolveDatabase(r *http.Request) *mongo.Database
+}
+
+// defaultTenantResolver serves every request from the configured database
+type defaultTenantResolver struct{}
+
+func (defaultTenantResolver) ResolveDatabase(r *http.Request) *mongo.Database {
+	return DB.Database
+}
+
+var tenantResolver TenantResolver = defaultTenantResolver{}
+
+// SetTenantResolver installs a custom resolver; call before the server starts
+func SetTenantResolver(resolver TenantResolver) {
+	if resolver == nil {
+		resolver = defaultTenantResolver{}
+	}
+	tenantResolver = resolver
+}
+
+// tenantURLs returns the urls collection for the request's tenant. Request handlers on the
+// core link paths (shorten, redirect, delete) use it; background workers and the analytics
+// aggregations still operate on the default database.
+func tenantURLs(r *http.Request) *mongo.Collection {
+	if db := tenantResolver.ResolveDatabase(r); db != nil && db != DB.Database {
+		return db.Collection("urls")
+	}
+	return DB.Collection
+}
+
+// shardKeyStartupCheck validates and applies the shard key configuration
+func shardKeyStartupCheck() error {
+	if err := validateShardKey(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return ensureShardKeyIndexes(ctx, DB.Database)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// MONGODB PERMISSIONS
+// ============================================================================
+//
+// The server only needs to read and write its own collections and to manage their indexes.
+// At startup connectionStatus is asked for the privileges of the MONGODB_URI user, without
+// touching any data, and the result is logged: what is granted, what is missing, and any
+// destructive privilege the app never uses (dropping collections or databases, managing
+// users). Without createIndex the index migrations are downgraded to optional and retried
+// on every start, so a locked-down cluster whose indexes a DBA manages still serves
+// traffic. GET /admin/required-permissions returns the minimal role as a createRole
+// document. Tenant databases of a TenantResolver are not probed.
+
+// mongoPrivilege is a set of actions on one collection; an empty collection means every
+// collection of the database
+type mongoPrivilege struct {
+	Collection string
+	Actions    []string
+}
+
+// mongoReadWriteActions are needed on every collection the server stores data in
+var mongoReadWriteActions = []string{"find", "insert", "update", "remove"}
+
+// mongoIndexActions are needed by migrations and startup index checks, on any collection
+var mongoIndexActions = []string{"createIndex", "dropIndex", "listIndexes"}
+
+// mongoAppCollections lists every collection the server reads and writes
+var mongoAppCollections = []string{
+	"abuse_reports", "analytics_shares", "api_usage", "backups", "bulk_sources", "clicks", "clicks_outbox", "codes",
+	"daily_clicks", "demo_urls", "domain_branding", "folders", "impersonations", "key_rotations", "link_outcomes", "locks", "migrations", "security_events", "share_events",
+	"stats", "urls", "users", "worker_status",
+}
+
+// mongoDangerousActions are never used by the server; holding them means a bug or a leaked
+// credential could destroy data
+var mongoDangerousActions = []string{
+	"dropCollection", "dropDatabase", "createUser", "dropUser", "grantRole", "dropRole", "shutdown",
+}
+
+// requiredMongoPrivileges returns the minimal privileges of the server's MongoDB user
+func requiredMongoPrivileges() []mongoPrivilege {
+	privileges := make([]mongoPrivilege, 0, len(mongoAppCollections)+1)
+	for _, coll := range mongoAppCollections {
+		actions := append([]string(nil), mongoReadWriteActions...)
+		if coll == "urls" {
+			actions = append(actions, "collStats") // GetDatabaseStats
+		}
+		privileges = append(privileges, mongoPrivilege{Collection: coll, Actions: actions})
+	}
+	return append(privileges, mongoPrivilege{Actions: mongoIndexActions})
+}
+
+// MongoPermissionReport is the outcome of the startup permission probe
+type MongoPermissionReport struct {
+	AuthEnabled bool                `json:"auth_enabled"`
+	Users       []string            `json:"users,omitempty"`
+	Missing     map[string][]string `json:"missing,omitempty"`
+	Dangerous   []string            `json:"dangerous,omitempty"`
+	CheckedAt   time.Time           `json:"checked_at"`
+}
+
+// canCreateIndexes reports whether the probe found createIndex granted on every collection
+func (p *MongoPermissionReport) canCreateIndexes() bool {
+	if p == nil {
+		return true
+	}
+	for _, actions := range p.Missing {
+		for _, action := range actions {
+			if action == "createIndex" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mongoPermissions holds the last probe result; nil until probed, which is treated as full access
+var mongoPermissions *MongoPermissionReport
+
+// connectionStatusPrivilege is one entry of connectionStatus' authenticatedUserPrivileges
+type connectionStatusPrivilege struct {
+	Resource struct {
+		DB          *string `bson:"db"`
+		Collection  *string `bson:"collection"`
+		AnyResource bool    `bson:"anyResource"`
+	} `bson:"resource"`
+	Actions []string `bson:"actions"`
+}
+
+// covers reports whether the privilege's resource includes collection coll of database db
+// (an empty coll stands for all of the database's collections)
+func (p connectionStatusPrivilege) covers(db, coll string) bool {
+	if p.Resource.AnyResource {
+		return true
+	}
+	if p.Resource.DB == nil || p.Resource.Collection == nil {
+		return false // cluster or system resources
+	}
+	if *p.Resource.DB != "" && *p.Resource.DB != db {
+		return false
+	}
+	return *p.Resource.Collection == "" || *p.Resource.Collection == coll
+}
+
+// probeMongoPermissions compares the privileges of the connected user with the ones the
+// server needs
+func probeMongoPermissions(ctx context.Context, db *mongo.Database) (*MongoPermissionReport, error) {
+	var status struct {
+		AuthInfo struct {
+			AuthenticatedUsers []struct {
+				User string `bson:"user"`
+				DB   string `bson:"db"`
+			} `bson:"authenticatedUsers"`
+			Privileges []connectionStatusPrivilege `bson:"authenticatedUserPrivileges"`
+		} `bson:"authInfo"`
+	}
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "connectionStatus", Value: 1},
+		{Key: "showPrivileges", Value: true},
+	}).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MongoPermissionReport{CheckedAt: clock.Now()}
+	if len(status.AuthInfo.AuthenticatedUsers) == 0 {
+		// Authentication disabled: every action is allowed
+		return report, nil
+	}
+	report.AuthEnabled = true
+	for _, user := range status.AuthInfo.AuthenticatedUsers {
+		report.Users = append(report.Users, user.User+"@"+user.DB)
+	}
+
+	granted := func(coll, action string) bool {
+		for _, privilege := range status.AuthInfo.Privileges {
+			if !privilege.covers(db.Name(), coll) {
+				continue
+			}
+			for _, a := range privilege.Actions {
+				if a == action || a == "anyAction" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	report.Missing = make(map[string][]string)
+	for _, required := range requiredMongoPrivileges() {
+		colls := []string{required.Collection}
+		if required.Collection == "" {
+			colls = mongoAppCollections
+		}
+		for _, action := range required.Actions {
+			for _, coll := range colls {
+				if !granted(coll, action) {
+					resource := required.Collection
+					if resource == "" {
+						resource = "*"
+					}
+					report.Missing[resource] = append(report.Missing[resource], action)
+					break
+				}
+			}
+		}
+	}
+	for _, action := range mongoDangerousActions {
+		for _, privilege := range status.AuthInfo.Privileges {
+			if containsString(privilege.Actions, action) || containsString(privilege.Actions, "anyAction") {
+				report.Dangerous = append(report.Dangerous, action)
+				break
+			}
+		}
+	}
+	return report, nil
+}
+
+// CheckMongoPermissions probes the connected user's privileges and logs the result. A
+// failed probe is logged and treated as full access, as before the probe existed.
+func CheckMongoPermissions() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := probeMongoPermissions(ctx, DB.Database)
+	if err != nil {
+		log.Printf("⚠️  Could not check MongoDB privileges, assuming full access: %v", err)
+		return
+	}
+	mongoPermissions = report
+
+	if !report.AuthEnabled {
+		log.Println("🔐 MongoDB authentication is disabled; every action is allowed")
+		return
+	}
+	if len(report.Missing) == 0 {
+		log.Printf("🔐 MongoDB user %s has every privilege the server needs", strings.Join(report.Users, ", "))
+	} else {
+		resources := make([]string, 0, len(report.Missing))
+		for resource := range report.Missing {
+			resources = append(resources, resource)
+		}
+		sort.Strings(resources)
+		for _, resource := range resources {
+			log.Printf("⚠️  MongoDB user %s lacks %s on %s.%s", strings.Join(report.Users, ", "),
+				strings.Join(report.Missing[resource], ", "), DB.Database.Name(), resource)
+		}
+	}
+	if !report.canCreateIndexes() {
+		log.Println("⚠️  Without createIndex, index migrations are optional and retried on every start.")
+		log.Println("💡 Grant the role from GET /admin/required-permissions, or run the server once")
+		log.Println("   with a user that may create indexes, then switch back to the restricted one.")
+	}
+	if len(report.Dangerous) > 0 {
+		log.Printf("⚠️  MongoDB user %s holds privileges the server never uses: %s. Consider the minimal role from GET /admin/required-permissions.",
+			strings.Join(report.Users, ", "), strings.Join(report.Dangerous, ", "))
+	}
+}
+
+// canCreateMongoIndexes reports whether startup may treat failed index creation as fatal
+func canCreateMongoIndexes() bool {
+	return mongoPermissions.canCreateIndexes()
+}
+
+// mongoDatabaseName returns the name of the configured database
+func mongoDatabaseName() string {
+	if DB != nil && DB.Database != nil {
+		return DB.Database.Name()
+	}
+	if name := os.Getenv("MONGODB_DATABASE"); name != "" {
+		return name
+	}
+	return "url_shortener"
+}
+
+// adminRequiredPermissions handles GET /admin/required-permissions with the minimal role,
+// ready for db.createRole, and the result of the startup probe
+func adminRequiredPermissions(w http.ResponseWriter, r *http.Request) {
+	database := mongoDatabaseName()
+	privileges := make([]bson.M, 0)
+	for _, privilege := range requiredMongoPrivileges() {
+		privileges = append(privileges, bson.M{
+			"resource": bson.M{"db": database, "collection": privilege.Collection},
+			"actions":  privilege.Actions,
+		})
+	}
+	response := map[string]interface{}{
+		"role": map[string]interface{}{
+			"role":       "rapidlinkApp",
+			"privileges": privileges,
+			"roles":      []string{},
+		},
+		"note": "Create the role in the " + database + " database with db.createRole(role) and grant only it to the server's user",
+	}
+	if mongoPermissions != nil {
+		response["current"] = mongoPermissions
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPrivilegeCovers(t *testing.T) {
+	name := func(s string) *string { return &s }
+	privilege := func(db, coll *string, any bool) connectionStatusPrivilege {
+		var p connectionStatusPrivilege
+		p.Resource.DB, p.Resource.Collection, p.Resource.AnyResource = db, coll, any
+		return p
+	}
+	tests := []struct {
+		name      string
+		privilege connectionStatusPrivilege
+		coll      string
+		covers    bool
+	}{
+		{"collection", privilege(name("app"), name("urls"), false), "urls", true},
+		{"other collection", privilege(name("app"), name("users"), false), "urls", false},
+		{"whole database", privilege(name("app"), name(""), false), "urls", true},
+		{"other database", privilege(name("other"), name(""), false), "urls", false},
+		{"every database", privilege(name(""), name("urls"), false), "urls", true},
+		{"any resource", privilege(nil, nil, true), "urls", true},
+		{"cluster", privilege(nil, nil, false), "urls", false},
+	}
+	for _, tt := range tests {
+		if got := tt.privilege.covers("app", tt.coll); got != tt.covers {
+			t.Errorf("%s: covers %v", tt.name, got)
+		}
+	}
+
+	var unprobed *MongoPermissionReport
+	if !unprobed.canCreateIndexes() {
+		t.Error("an unprobed server cannot create indexes")
+	}
+	locked := &MongoPermissionReport{Missing: map[string][]string{"*": {"createIndex"}, "urls": {"collStats"}}}
+	if locked.canCreateIndexes() {
+		t.Error("a user without createIndex can create indexes")
+	}
+}
+
+// TestRequiredPrivilegesCoverCollections keeps the minimal role in step with the code: every
+// collection the server names must be granted
+func TestRequiredPrivilegesCoverCollections(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(parsed, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) != 1 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			lit, isLit := call.Args[0].(*ast.BasicLit)
+			if !ok || sel.Sel.Name != "Collection" || !isLit || lit.Kind != token.STRING {
+				return true
+			}
+			if name, _ := strconv.Unquote(lit.Value); !containsString(mongoAppCollections, name) {
+				t.Errorf("%s: collection %s is missing from mongoAppCollections", fset.Position(lit.Pos()), name)
+			}
+			return true
+		})
+	}
+}
+
+func TestAdminRequiredPermissions(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, _ := srv.register()
+	t.Setenv("MONGODB_DATABASE", "rapidlink")
+
+	var body struct {
+		Role struct {
+			Role       string `json:"role"`
+			Privileges []struct {
+				Resource struct {
+					DB         string `json:"db"`
+					Collection string `json:"collection"`
+				} `json:"resource"`
+				Actions []string `json:"actions"`
+			} `json:"privileges"`
+		} `json:"role"`
+	}
+	if resp := srv.do("GET", "/admin/required-permissions", admin, nil, &body); resp.StatusCode != http.StatusOK {
+		t.Fatalf("required permissions: status %d", resp.StatusCode)
+	}
+	if body.Role.Role != "rapidlinkApp" || len(body.Role.Privileges) != len(mongoAppCollections)+1 {
+		t.Fatalf("role %+v", body.Role)
+	}
+	for _, privilege := range body.Role.Privileges {
+		if privilege.Resource.DB != "rapidlink" {
+			t.Errorf("privilege on database %q", privilege.Resource.DB)
+		}
+		for _, action := range privilege.Actions {
+			if containsString(mongoDangerousActions, action) {
+				t.Errorf("minimal role grants %s on %q", action, privilege.Resource.Collection)
+			}
+		}
+		switch privilege.Resource.Collection {
+		case "":
+			if strings.Join(privilege.Actions, " ") != "createIndex dropIndex listIndexes" {
+				t.Errorf("database-wide actions %v", privilege.Actions)
+			}
+		case "urls":
+			if !containsString(privilege.Actions, "collStats") {
+				t.Errorf("urls actions %v", privilege.Actions)
+			}
+		}
+	}
+	if resp := srv.do("GET", "/admin/required-permissions", token, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("as a regular user: status %d", resp.StatusCode)
+	}
+}
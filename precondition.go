@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ============================================================================
+// OPTIMISTIC CONCURRENCY ON LINK EDITS
+// ============================================================================
+//
+// Every mutation of a link sets updated_at. Edit endpoints accept the version the client
+// last saw, either as an If-Unmodified-Since header or as expected_version (the exact
+// updated_at from a previous response). The check is part of the update filter, so it is
+// atomic with the write; a mismatch answers 412 with the current document to merge against.
+
+// EditPrecondition is the version a client expects a link to still be at
+type EditPrecondition struct {
+	// UnmodifiedSince comes from If-Unmodified-Since (second precision)
+	UnmodifiedSince *time.Time
+	// Version comes from expected_version and must match updated_at exactly
+	Version *time.Time
+}
+
+// parseEditPrecondition reads If-Unmodified-Since and expectedVersion (RFC 3339); nil when neither is set
+func parseEditPrecondition(r *http.Request, expectedVersion string) (*EditPrecondition, error) {
+	var p EditPrecondition
+	if header := r.Header.Get("If-Unmodified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return nil, errors.New("invalid If-Unmodified-Since header")
+		}
+		p.UnmodifiedSince = &since
+	}
+	if expectedVersion != "" {
+		version, err := time.Parse(time.RFC3339Nano, expectedVersion)
+		if err != nil {
+			return nil, errors.New("invalid expected_version, use the updated_at value from the link")
+		}
+		p.Version = &version
+	}
+	if p.UnmodifiedSince == nil && p.Version == nil {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// Holds reports whether a link last modified at updatedAt still satisfies the precondition.
+// Links saved before updated_at existed only satisfy If-Unmodified-Since.
+func (p *EditPrecondition) Holds(updatedAt *time.Time) bool {
+	if p == nil {
+		return true
+	}
+	// MongoDB stores dates to the millisecond, so versions are compared at that precision
+	if p.Version != nil && (updatedAt == nil || !updatedAt.Truncate(time.Millisecond).Equal(p.Version.Truncate(time.Millisecond))) {
+		return false
+	}
+	if p.UnmodifiedSince != nil && updatedAt != nil && !updatedAt.Before(p.UnmodifiedSince.Add(time.Second)) {
+		return false
+	}
+	return true
+}
+
+// Filter returns the conditions to add to an update filter so the check-and-set is atomic
+func (p *EditPrecondition) Filter() bson.D {
+	if p == nil {
+		return nil
+	}
+	var filter bson.D
+	if p.Version != nil {
+		filter = append(filter, bson.E{Key: "updated_at", Value: *p.Version})
+	}
+	if p.UnmodifiedSince != nil {
+		// HTTP dates drop sub-second precision, so anything within that second still matches
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "updated_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "updated_at", Value: bson.D{{Key: "$lt", Value: p.UnmodifiedSince.Add(time.Second)}}}},
+		}})
+	}
+	return filter
+}
+
+// writePreconditionFailed answers 412 with the link as it is now
+func writePreconditionFailed(w http.ResponseWriter, r *http.Request, current *URLData) {
+	current.FullShortURL = fullShortURL(r, current.Domain, current.ShortURL)
+	addSecurityHeaders(w)
+	writeJSONError(w, http.StatusPreconditionFailed, ErrCodePreconditionFailed,
+		"Short URL was modified by someone else; merge with the current version and retry",
+		map[string]interface{}{"current": current})
+}
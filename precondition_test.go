@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEditPreconditionHolds(t *testing.T) {
+	version := clockTestBase.Add(123456789 * time.Nanosecond)
+	later := version.Add(time.Millisecond)
+	sameSecond := clockTestBase.Add(900 * time.Millisecond)
+	nextSecond := clockTestBase.Add(time.Second)
+	tests := []struct {
+		name      string
+		p         *EditPrecondition
+		updatedAt *time.Time
+		want      bool
+	}{
+		{"no precondition", nil, &version, true},
+		{"version matches", &EditPrecondition{Version: &version}, &version, true},
+		{"version matches at millisecond precision", &EditPrecondition{Version: ptrTime(version.Truncate(time.Millisecond))}, &version, true},
+		{"version moved on", &EditPrecondition{Version: &version}, &later, false},
+		{"version of a link without updated_at", &EditPrecondition{Version: &version}, nil, false},
+		{"unmodified within the second", &EditPrecondition{UnmodifiedSince: &clockTestBase}, &sameSecond, true},
+		{"modified the next second", &EditPrecondition{UnmodifiedSince: &clockTestBase}, &nextSecond, false},
+		{"unmodified since, link without updated_at", &EditPrecondition{UnmodifiedSince: &clockTestBase}, nil, true},
+		{"both, header stale", &EditPrecondition{Version: &nextSecond, UnmodifiedSince: &clockTestBase}, &nextSecond, false},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Holds(tt.updatedAt); got != tt.want {
+			t.Errorf("%s: Holds = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func ptrTime(t time.Time) *time.Time { return &t }
+
+func TestParseEditPrecondition(t *testing.T) {
+	req := httptest.NewRequest("PATCH", "/url/abc", nil)
+	if p, err := parseEditPrecondition(req, ""); p != nil || err != nil {
+		t.Fatalf("no precondition: %+v, %v", p, err)
+	}
+	req.Header.Set("If-Unmodified-Since", clockTestBase.Format(http.TimeFormat))
+	p, err := parseEditPrecondition(req, clockTestBase.Format(time.RFC3339Nano))
+	if err != nil || !p.UnmodifiedSince.Equal(clockTestBase) || !p.Version.Equal(clockTestBase) {
+		t.Fatalf("both: %+v, %v", p, err)
+	}
+	if _, err := parseEditPrecondition(req, "yesterday"); err == nil {
+		t.Fatal("invalid expected_version accepted")
+	}
+	req.Header.Set("If-Unmodified-Since", "soon")
+	if _, err := parseEditPrecondition(req, ""); err == nil {
+		t.Fatal("invalid If-Unmodified-Since accepted")
+	}
+}
+
+func TestEditPreconditionFilter(t *testing.T) {
+	p := &EditPrecondition{Version: &clockTestBase}
+	if got := p.Filter(); len(got) != 1 || got[0].Key != "updated_at" || got[0].Value != clockTestBase {
+		t.Fatalf("version filter %v", got)
+	}
+	p = &EditPrecondition{UnmodifiedSince: &clockTestBase}
+	got := p.Filter()
+	if len(got) != 1 || got[0].Key != "$or" {
+		t.Fatalf("If-Unmodified-Since filter %v", got)
+	}
+	or := got[0].Value.(bson.A)
+	bound := or[1].(bson.D)[0].Value.(bson.D)[0]
+	if bound.Key != "$lt" || bound.Value != clockTestBase.Add(time.Second) {
+		t.Fatalf("If-Unmodified-Since bound %v", bound)
+	}
+	if (*EditPrecondition)(nil).Filter() != nil {
+		t.Fatal("nil precondition adds conditions")
+	}
+}
+
+// linkVersion is the part of a link the interleaved edit tests look at
+type linkVersion struct {
+	LongURL   string     `json:"long-url"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// editVersion is an edit response: the link, or on 412 the current one
+type editVersion struct {
+	linkVersion
+	Error struct {
+		Code    string      `json:"code"`
+		Current linkVersion `json:"current"`
+	} `json:"error"`
+}
+
+func TestInterleavedEdits(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/v1"})
+
+	// Both clients load the link
+	var seen editVersion
+	resp := srv.do("GET", "/url/"+code, token, nil, &seen)
+	lastModified := resp.Header.Get("Last-Modified")
+	if seen.UpdatedAt == nil || lastModified == "" {
+		t.Fatalf("detail lacks its version: updated_at %v, Last-Modified %q", seen.UpdatedAt, lastModified)
+	}
+	version := seen.UpdatedAt.Format(time.RFC3339Nano)
+
+	// Client A saves first
+	SetClock(FixedClock(clockTestBase.Add(2 * time.Second)))
+	var a editVersion
+	resp = srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.com/from-a", "expected_version": version}, &a)
+	if resp.StatusCode != http.StatusOK || a.UpdatedAt == nil || !a.UpdatedAt.After(*seen.UpdatedAt) {
+		t.Fatalf("first edit: status %d, updated_at %v", resp.StatusCode, a.UpdatedAt)
+	}
+
+	// Client B's edit from the same version is refused with A's document to merge against
+	var b editVersion
+	resp = srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.com/from-b", "expected_version": version}, &b)
+	if resp.StatusCode != http.StatusPreconditionFailed || b.Error.Code != ErrCodePreconditionFailed || b.Error.Current.LongURL != "https://example.com/from-a" {
+		t.Fatalf("stale edit: status %d, body %+v", resp.StatusCode, b)
+	}
+
+	// The same through If-Unmodified-Since
+	req, _ := http.NewRequest("PATCH", srv.URL+"/url/"+code, jsonBody(t, map[string]interface{}{"long-url": "https://example.com/from-b"}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-Unmodified-Since", lastModified)
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Unmodified-Since: status %d", resp.StatusCode)
+	}
+
+	// After merging, B retries against A's version
+	resp = srv.do("PATCH", "/url/"+code, token, map[string]interface{}{
+		"long-url": "https://example.com/merged", "expected_version": b.Error.Current.UpdatedAt.Format(time.RFC3339Nano),
+	}, &b)
+	if resp.StatusCode != http.StatusOK || b.LongURL != "https://example.com/merged" {
+		t.Fatalf("merged edit: status %d, long_url %q", resp.StatusCode, b.LongURL)
+	}
+}
+
+func TestConcurrentEditsFromOneVersion(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/start"})
+	var seen editVersion
+	srv.do("GET", "/url/"+code, token, nil, &seen)
+	version := seen.UpdatedAt.Format(time.RFC3339Nano)
+
+	const editors = 10
+	statuses := make([]int, editors)
+	var wg sync.WaitGroup
+	for i := 0; i < editors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := srv.do("PATCH", "/url/"+code, token, map[string]interface{}{
+				"long-url": "https://example.com/editor/" + string(rune('a'+i)), "expected_version": version,
+			}, nil)
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	won := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("concurrent edit: status %d", status)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d edits from the same version succeeded, want exactly 1: %v", won, statuses)
+	}
+}
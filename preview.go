@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ============================================================================
+// SHORT-CODE PREVIEW
+// ============================================================================
+//
+// Codes are derived from the long URL, so integrators can learn a link's code before
+// creating it (e.g. to pre-render QR codes). A previewed code is only guaranteed once the
+// link is created; reserve=true holds it for draftReservationTTL with an inactive draft
+// placeholder that PUT /url by the same user for the same URL takes over.
+
+const draftReservationTTL = 15 * time.Minute
+
+// PreviewRequest mirrors the ShortenRequest fields that decide the code
+type PreviewRequest struct {
+	LongURL      string `json:"long-url"`
+	Custom       string `json:"custom,omitempty"`
+	Domain       string `json:"domain,omitempty"`
+	ResolveChain bool   `json:"resolve_chain,omitempty"`
+	Reserve      bool   `json:"reserve,omitempty"`
+}
+
+// claimableDraft reports whether link is a reservation that userID may take over for longURL
+func claimableDraft(link *URLData, userID, longURL string) bool {
+	if link.DeactivatedReason != DeactivatedDraft {
+		return false
+	}
+	return isExpiredAt(link.ExpiresAt, clock.Now()) || (link.UserID == userID && link.LongURL == longURL)
+}
+
+// releaseClaimableDraft frees the code longURL (or custom) would get when it is held by a
+// reservation userID may take over
+func releaseClaimableDraft(ctx context.Context, urls URLStore, userID, longURL, custom string) error {
+	code := custom
+	if code == "" {
+		code = deterministicCode(longURL)
+	}
+	link, err := urls.FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !claimableDraft(link, userID, longURL) {
+		return nil
+	}
+	_, err = urls.ReleaseDraft(ctx, code)
+	forgetResolvedLink(code)
+	return err
+}
+
+// previewShortURL handles POST /url/preview
+func previewShortURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+
+	var req PreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.LongURL = sanitizeInput(req.LongURL)
+	req.Custom = sanitizeInput(req.Custom)
+	req.Domain = sanitizeInput(req.Domain)
+	if req.Domain == "" {
+		req.Domain = os.Getenv("BASE_URL")
+	}
+
+	if !validateURL(req.LongURL) {
+		http.Error(w, "Invalid URL format. Must be a valid HTTP or HTTPS URL (no localhost/internal IPs)", http.StatusBadRequest)
+		return
+	}
+	origin, err := validateDomainOrigin(req.Domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Domain = origin
+	if req.Custom != "" && (!validateCustomURL(req.Custom) || isReservedCode(req.Custom)) {
+		http.Error(w, "Custom URL must be 3-20 characters, alphanumeric with hyphens/underscores only, and not reserved", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	urls := linkStore(r)
+
+	destination, err := checkSelfReference(ctx, urls, req.LongURL, req.Custom, req.ResolveChain)
+	if err != nil {
+		http.Error(w, "Invalid destination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.LongURL = destination
+
+	response := map[string]interface{}{
+		"long_url": req.LongURL,
+		"note":     "The code is only guaranteed once the link is created with PUT /url",
+	}
+
+	// PUT /url returns the user's existing link for the same destination
+	existing, err := urls.FindActiveLink(ctx, userID, req.LongURL, req.Domain)
+	if err == nil {
+		response["code"] = existing.ShortURL
+		response["full_short_url"] = fullShortURL(r, existing.Domain, existing.ShortURL)
+		response["available"] = false
+		response["existing"] = true
+		response["note"] = "You already have an active link for this URL; PUT /url returns it"
+		writePreview(w, response)
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Printf("error checking existing URL: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	code := req.Custom
+	if code == "" {
+		code = deterministicCode(req.LongURL)
+	}
+	response["code"] = code
+	response["full_short_url"] = fullShortURL(r, req.Domain, code)
+	response["existing"] = false
+
+	if !guardCodeProbe(w, r, probePreview, userID, code) {
+		return
+	}
+
+	// One lookup covers links, drafts, demo links and reserved words; only a draft needs
+	// its link loaded, to see whether this caller may claim it
+	reservation, err := urls.CodeHolder(ctx, code)
+	available := errors.Is(err, ErrNotFound)
+	if available {
+		delayCodeMiss()
+	}
+	var holder *URLData
+	if err == nil && reservation.OwnerType == CodeOwnerDraft {
+		if holder, err = urls.FindLinkByCode(ctx, code); errors.Is(err, ErrNotFound) {
+			available = true // released since
+		}
+	}
+	if err != nil && !available {
+		log.Printf("error checking short URL availability: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if holder != nil && claimableDraft(holder, userID, req.LongURL) {
+		available = true
+		if holder.UserID == userID && !isExpiredAt(holder.ExpiresAt, clock.Now()) {
+			response["reserved_until"] = holder.ExpiresAt
+		}
+	}
+	response["available"] = available
+	if !available {
+		response["note"] = "The code is taken; creating this link would add a random suffix to it"
+	}
+
+	if req.Reserve && available && response["reserved_until"] == nil {
+		if holder != nil {
+			if _, err := urls.ReleaseDraft(ctx, code); err != nil {
+				log.Printf("error releasing expired reservation: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			forgetResolvedLink(code)
+		}
+		now := clock.Now().UTC()
+		until := now.Add(draftReservationTTL)
+		draft := &URLData{
+			ShortURL:          code,
+			LongURL:           req.LongURL,
+			Domain:            req.Domain,
+			UserID:            userID,
+			CreatedAt:         now,
+			UpdatedAt:         &now,
+			ExpiresAt:         &until,
+			IsActive:          false,
+			ClickHistory:      []ClickHistory{},
+			DeactivatedReason: DeactivatedDraft,
+		}
+		if err := urls.InsertLink(ctx, draft); errors.Is(err, ErrDuplicate) {
+			response["available"] = false
+			response["note"] = "The code was taken while reserving; creating this link would add a random suffix to it"
+		} else if err != nil {
+			log.Printf("error reserving short URL: %v", err)
+			http.Error(w, "failed to reserve short URL", http.StatusInternalServerError)
+			return
+		} else {
+			response["reserved_until"] = until
+			logSecurityEvent(r.Context(), "URL_CODE_RESERVED", userID, clientIP, r.UserAgent(),
+				"Code reserved: "+code, "INFO")
+		}
+	}
+
+	writePreview(w, response)
+}
+
+func writePreview(w http.ResponseWriter, response map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding preview response: %v", err)
+	}
+}
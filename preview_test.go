@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// previewAnswer is the body of POST /url/preview
+type previewAnswer struct {
+	Code          string     `json:"code"`
+	FullShortURL  string     `json:"full_short_url"`
+	Available     bool       `json:"available"`
+	Existing      bool       `json:"existing"`
+	ReservedUntil *time.Time `json:"reserved_until"`
+}
+
+func (s *testServer) preview(token string, body map[string]interface{}) previewAnswer {
+	s.t.Helper()
+	var answer previewAnswer
+	if resp := s.do("POST", "/url/preview", token, body, &answer); resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("preview %v: status %d", body, resp.StatusCode)
+	}
+	return answer
+}
+
+func TestPreviewThenCreate(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	for _, body := range []map[string]interface{}{
+		{"long-url": "https://example.com/previewed"},
+		{"long-url": "https://example.com/previewed-custom", "custom": "launch-day"},
+	} {
+		previewed := srv.preview(token, body)
+		if !previewed.Available || previewed.Existing || previewed.Code == "" {
+			t.Fatalf("preview %v: %+v", body, previewed)
+		}
+		if _, err := srv.links.FindLinkByCode(context.Background(), previewed.Code); !errors.Is(err, ErrNotFound) {
+			t.Fatal("preview without reserve stored a link")
+		}
+
+		var created URLData
+		srv.do("PUT", "/url", token, body, &created)
+		if created.ShortURL != previewed.Code || created.FullShortURL != previewed.FullShortURL {
+			t.Fatalf("created %s (%s), previewed %s (%s)", created.ShortURL, created.FullShortURL, previewed.Code, previewed.FullShortURL)
+		}
+
+		again := srv.preview(token, body)
+		if again.Code != created.ShortURL || again.Available || !again.Existing {
+			t.Fatalf("preview after creation: %+v", again)
+		}
+	}
+}
+
+func TestPreviewIsNotAReservation(t *testing.T) {
+	srv := newTestServer(t)
+	alice, _ := srv.register()
+	bob, _ := srv.register()
+	body := map[string]interface{}{"long-url": "https://example.com/contested"}
+
+	previewed := srv.preview(alice, body)
+	// Someone else creates the link between preview and create
+	if code := srv.shorten(bob, body); code != previewed.Code {
+		t.Fatalf("bob got %s, preview said %s", code, previewed.Code)
+	}
+	if now := srv.preview(alice, body); now.Available || now.Code != previewed.Code {
+		t.Fatalf("preview of a taken code: %+v", now)
+	}
+	code := srv.shorten(alice, body)
+	if code == previewed.Code || !strings.HasPrefix(code, previewed.Code) {
+		t.Fatalf("alice got %s after the code was taken, want %s with a suffix", code, previewed.Code)
+	}
+}
+
+func TestPreviewReserve(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	alice, _ := srv.register()
+	bob, _ := srv.register()
+	body := map[string]interface{}{"long-url": "https://example.com/reserved", "reserve": true}
+
+	reserved := srv.preview(alice, body)
+	if !reserved.Available || reserved.ReservedUntil == nil || !reserved.ReservedUntil.Equal(clockTestBase.Add(draftReservationTTL)) {
+		t.Fatalf("reserve: %+v", reserved)
+	}
+	// The draft does not redirect
+	if resp := srv.do("GET", "/"+reserved.Code, "", nil, nil); resp.StatusCode < 400 {
+		t.Fatalf("draft redirects with status %d", resp.StatusCode)
+	}
+	if other := srv.preview(bob, map[string]interface{}{"long-url": "https://example.com/reserved"}); other.Available {
+		t.Fatalf("reserved code offered to another user: %+v", other)
+	}
+
+	// Once the reservation lapses, others may take the code
+	SetClock(FixedClock(clockTestBase.Add(draftReservationTTL)))
+	if code := srv.shorten(bob, map[string]interface{}{"long-url": "https://example.com/reserved"}); code != reserved.Code {
+		t.Fatalf("after the reservation lapsed bob got %s, want %s", code, reserved.Code)
+	}
+}
+
+func TestPreviewReserveThenCreate(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	alice, _ := srv.register()
+	bob, _ := srv.register()
+
+	reserved := srv.preview(alice, map[string]interface{}{"long-url": "https://example.com/held", "reserve": true})
+	// Another user creating the same destination meanwhile gets a suffix
+	if code := srv.shorten(bob, map[string]interface{}{"long-url": "https://example.com/held"}); code == reserved.Code {
+		t.Fatal("another user took the reserved code")
+	}
+	SetClock(FixedClock(clockTestBase.Add(draftReservationTTL - time.Second)))
+	var created URLData
+	if resp := srv.do("PUT", "/url", alice, map[string]interface{}{"long-url": "https://example.com/held"}, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create over own reservation: status %d", resp.StatusCode)
+	}
+	if created.ShortURL != reserved.Code || !created.IsActive {
+		t.Fatalf("created %s (active %v), reserved %s", created.ShortURL, created.IsActive, reserved.Code)
+	}
+	if resp := srv.do("GET", "/"+reserved.Code, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("created link: status %d", resp.StatusCode)
+	}
+}
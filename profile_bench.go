@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ============================================================================
+// PROFILE BENCHMARK (CLI: bench-profile)
+// ============================================================================
+
+const (
+	benchProfileLinks      = 5000
+	benchProfileIterations = 50
+)
+
+// runProfileBenchmark seeds a throwaway user with benchProfileLinks links and compares the
+// p50 latency of the lean profile with the profile including (uncached and cached)
+// statistics. The seeded user and links are removed afterwards.
+func runProfileBenchmark() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	user := &User{
+		Username:  "benchprofile" + InstanceID,
+		Email:     "bench-profile-" + InstanceID + "@example.com",
+		CreatedAt: time.Now().UTC(),
+		IsActive:  true,
+	}
+	if err := Users.CreateUser(ctx, user); err != nil {
+		return fmt.Errorf("creating benchmark user: %w", err)
+	}
+	userID := user.ID.Hex()
+	defer func() {
+		if _, err := DB.Database.Collection("users").DeleteOne(context.Background(), bson.M{"_id": user.ID}); err != nil {
+			log.Printf("Warning: failed to remove benchmark user: %v", err)
+		}
+		if _, err := DB.Collection.DeleteMany(context.Background(), bson.M{"user_id": userID}); err != nil {
+			log.Printf("Warning: failed to remove benchmark links: %v", err)
+		}
+	}()
+
+	log.Printf("🌱 Seeding %d links for %s...", benchProfileLinks, userID)
+	if err := seedAnalyticsBenchmark(ctx, userID, benchProfileLinks); err != nil {
+		return err
+	}
+
+	lean, err := profileLatencyP50(func() error {
+		_, err := GetUserProfile(userID, false)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	uncached, err := profileLatencyP50(func() error {
+		invalidateUserStats(userID)
+		_, err := GetUserProfile(userID, true)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cached, err := profileLatencyP50(func() error {
+		_, err := GetUserProfile(userID, true)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("⏱️  profile (lean): p50 %v over %d runs", lean, benchProfileIterations)
+	log.Printf("⏱️  profile ?include=stats, uncached: p50 %v", uncached)
+	log.Printf("⏱️  profile ?include=stats, cached: p50 %v", cached)
+	return nil
+}
+
+// profileLatencyP50 runs call benchProfileIterations times and returns the median latency
+func profileLatencyP50(call func() error) (time.Duration, error) {
+	durations := make([]time.Duration, 0, benchProfileIterations)
+	for i := 0; i < benchProfileIterations; i++ {
+		start := time.Now()
+		if err := call(); err != nil {
+			return 0, err
+		}
+		durations = append(durations, time.Since(start))
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], nil
+}
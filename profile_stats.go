@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// PROFILE STATISTICS (OPT-IN)
+// ============================================================================
+//
+// GET /auth/profile is called on every page load as a "who am I" check, so the statistics
+// block (the dashboard aggregation) is only added with ?include=stats. During the deprecation
+// cycle PROFILE_STATS_BY_DEFAULT=true (the default) keeps the old shape for requests without
+// an include parameter; set it to false to serve the lean profile by default.
+
+const (
+	userStatsCacheTTL  = 30 * time.Second
+	userStatsCacheSize = 10000
+)
+
+type userStatsEntry struct {
+	stats     map[string]interface{}
+	expiresAt time.Time
+}
+
+var (
+	userStatsCache      = make(map[string]userStatsEntry)
+	userStatsCacheMutex = sync.RWMutex{}
+)
+
+// profileStatsByDefault reports whether requests without ?include= still get statistics
+// (PROFILE_STATS_BY_DEFAULT, or the profile_stats_by_default flag of CONFIG_FILE)
+func profileStatsByDefault(r *http.Request) bool {
+	return featureEnabled(r.Context(), "profile_stats_by_default")
+}
+
+// profileIncludesStats decides whether a profile request gets the statistics block.
+// implicit is set when only the deprecated default asked for them.
+func profileIncludesStats(r *http.Request) (include, implicit bool) {
+	values, ok := r.URL.Query()["include"]
+	if !ok {
+		byDefault := profileStatsByDefault(r)
+		return byDefault, byDefault
+	}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if strings.TrimSpace(part) == "stats" {
+				return true, false
+			}
+		}
+	}
+	return false, false
+}
+
+// cachedUserStats returns the user's dashboard statistics, reusing a result up to
+// userStatsCacheTTL old
+func cachedUserStats(ctx context.Context, userID string) (map[string]interface{}, error) {
+	userStatsCacheMutex.RLock()
+	entry, cached := userStatsCache[userID]
+	userStatsCacheMutex.RUnlock()
+	if cached && time.Now().Before(entry.expiresAt) {
+		return entry.stats, nil
+	}
+
+	_, _, stats, err := Links.ListLinks(ctx, userID, LinkFilter{}, 0, 1, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	userStatsCacheMutex.Lock()
+	if len(userStatsCache) >= userStatsCacheSize {
+		// Entries are short-lived; starting over is cheaper than tracking recency
+		userStatsCache = make(map[string]userStatsEntry)
+	}
+	userStatsCache[userID] = userStatsEntry{stats: stats, expiresAt: time.Now().Add(userStatsCacheTTL)}
+	userStatsCacheMutex.Unlock()
+	return stats, nil
+}
+
+// invalidateUserStats drops the cached statistics of userID
+func invalidateUserStats(userID string) {
+	userStatsCacheMutex.Lock()
+	delete(userStatsCache, userID)
+	userStatsCacheMutex.Unlock()
+}
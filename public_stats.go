@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// PUBLIC LANDING-PAGE STATS
+// ============================================================================
+//
+// GET /stats/public serves coarse global counters for the marketing site. A background
+// worker aggregates them every publicStatsInterval into a single document (_id "public" in
+// the stats collection, or process memory on the other backends), so a request is one read.
+// Counts are rounded before they are stored and never leave the aggregation precisely.
+
+const (
+	publicStatsInterval   = 10 * time.Minute
+	publicStatsDocID      = "public"
+	publicStatsRateLimit  = 30 // requests per minute per IP
+	publicStatsRateWindow = time.Minute
+)
+
+// PublicStats is the stored landing-page counters document
+type PublicStats struct {
+	ID                   string    `bson:"_id" json:"-"`
+	TotalLinks           int64     `bson:"total_links" json:"total_links"`
+	TotalClicks          int64     `bson:"total_clicks" json:"total_clicks"`
+	LinksCreatedThisWeek int64     `bson:"links_created_this_week" json:"links_created_this_week"`
+	ComputedAt           time.Time `bson:"computed_at" json:"as_of"`
+}
+
+var (
+	// localPublicStats holds the document on backends without the stats collection
+	localPublicStats      *PublicStats
+	localPublicStatsMutex sync.RWMutex
+)
+
+// publicStatsEnabled reports whether GET /stats/public is served (PUBLIC_STATS_ENABLED, default true)
+func publicStatsEnabled() bool {
+	return os.Getenv("PUBLIC_STATS_ENABLED") != "false"
+}
+
+// roundCoarse floors n to two significant digits, and to at least the nearest ten,
+// e.g. 12,345 -> 12,000, 987 -> 980, 57 -> 50
+func roundCoarse(n int64) int64 {
+	step := int64(10)
+	for n/step >= 100 {
+		step *= 10
+	}
+	return n / step * step
+}
+
+// AggregatePublicStats recomputes the counters from the link store and saves the stats document
+func AggregatePublicStats(ctx context.Context) (*PublicStats, error) {
+	links, clicks, recent, err := Links.GlobalCounts(ctx, clock.Now().AddDate(0, 0, -7))
+	if err != nil {
+		return nil, err
+	}
+	stats := &PublicStats{
+		ID:                   publicStatsDocID,
+		TotalLinks:           roundCoarse(links),
+		TotalClicks:          roundCoarse(clicks),
+		LinksCreatedThisWeek: roundCoarse(recent),
+		ComputedAt:           clock.Now().UTC().Truncate(time.Second),
+	}
+
+	if !usesMongo() {
+		localPublicStatsMutex.Lock()
+		localPublicStats = stats
+		localPublicStatsMutex.Unlock()
+		return stats, nil
+	}
+	_, err = DB.Database.Collection("stats").ReplaceOne(ctx, bson.D{{Key: "_id", Value: publicStatsDocID}}, stats,
+		options.Replace().SetUpsert(true))
+	return stats, err
+}
+
+// loadPublicStats reads the stats document; nil when no aggregation has run yet
+func loadPublicStats(ctx context.Context) (*PublicStats, error) {
+	if !usesMongo() {
+		localPublicStatsMutex.RLock()
+		defer localPublicStatsMutex.RUnlock()
+		return localPublicStats, nil
+	}
+	var stats PublicStats
+	err := DB.Database.Collection("stats").FindOne(ctx, bson.D{{Key: "_id", Value: publicStatsDocID}}).Decode(&stats)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// StartPublicStatsWorker aggregates the public stats now and every publicStatsInterval.
+// On MongoDB a worker lease ensures only one instance aggregates per interval.
+func StartPublicStatsWorker() {
+	aggregate := func() (map[string]int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		stats, err := AggregatePublicStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int64{"total_links": stats.TotalLinks, "total_clicks": stats.TotalClicks}, nil
+	}
+	tick := func() {
+		if usesMongo() {
+			runExclusive("public_stats", publicStatsInterval, aggregate)
+		} else if _, err := aggregate(); err != nil {
+			log.Printf("⚠️  Public stats aggregation failed: %v", err)
+		}
+	}
+
+	go func() {
+		log.Println("📊 Starting public stats worker...")
+		tick()
+		ticker := time.NewTicker(publicStatsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			tick()
+		}
+	}()
+}
+
+// publicStats handles GET /stats/public
+func publicStats(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	policy := requestConfig(r).RateLimit("public_stats")
+	if limit := checkRateLimit("public-stats:"+rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+		logSecurityEvent(r.Context(), "PUBLIC_STATS_RATE_LIMIT_EXCEEDED", "", clientIP, r.UserAgent(),
+			"Public stats rate limit exceeded", "WARN")
+		writeRateLimited(w, limit)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	stats, err := loadPublicStats(ctx)
+	if err != nil {
+		log.Printf("error loading public stats: %v", err)
+		http.Error(w, "Stats are temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if stats == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(publicStatsInterval.Seconds())))
+		http.Error(w, "Stats are not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(publicStatsInterval.Seconds())))
+	w.Header().Set("Last-Modified", stats.ComputedAt.Format(http.TimeFormat))
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("error encoding public stats response: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+)
+
+// ============================================================================
+// URL QUOTAS AND OPS THRESHOLDS
+// ============================================================================
+
+const (
+	defaultQuotaAlertPercent     = 80
+	defaultRateLimitAlertRejects = 20
+)
+
+// envInt reads a non-negative integer from the environment
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+// urlQuota returns the per-user active link quota (URL_QUOTA); 0 means unlimited
+func urlQuota() int {
+	return envInt("URL_QUOTA", 0)
+}
+
+// urlQuotaFor returns the active link quota of userID: urlQuota, lowered to
+// RESTRICTED_URL_QUOTA while the account is restricted
+func urlQuotaFor(userID string) int {
+	quota := urlQuota()
+	if restrictedOwners.Has(userID) {
+		if restricted := restrictedURLQuota(); quota == 0 || restricted < quota {
+			quota = restricted
+		}
+	}
+	return quota
+}
+
+// quotaCrossed reports whether going from before to after active links crosses percent of quota
+func quotaCrossed(before, after, quota, percent int) bool {
+	if quota <= 0 {
+		return false
+	}
+	threshold := (quota*percent + 99) / 100
+	return before < threshold && after >= threshold
+}
+
+// checkURLQuota counts the user's active links. It returns the count and whether one more
+// link is allowed, emitting a quota.exceeded ops event when it is not.
+func checkURLQuota(ctx context.Context, urls URLStore, userID string) (int, bool, error) {
+	quota := urlQuotaFor(userID)
+	if quota == 0 {
+		return 0, true, nil
+	}
+	count, err := urls.CountActiveLinks(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	if int(count) >= quota {
+		emitOpsEvent(EventQuotaExceeded, userID, map[string]interface{}{
+			"user_id": userID,
+			"count":   count,
+			"quota":   quota,
+		})
+		return int(count), false, nil
+	}
+	return int(count), true, nil
+}
+
+// noteURLCreated emits a quota.threshold_crossed ops event when a new link takes the user
+// past QUOTA_ALERT_PERCENT (default 80) of their quota
+func noteURLCreated(userID string, countBefore int) {
+	quota := urlQuotaFor(userID)
+	percent := envInt("QUOTA_ALERT_PERCENT", defaultQuotaAlertPercent)
+	if quotaCrossed(countBefore, countBefore+1, quota, percent) {
+		emitOpsEvent(EventQuotaThreshold, userID, map[string]interface{}{
+			"user_id": userID,
+			"count":   countBefore + 1,
+			"quota":   quota,
+			"percent": percent,
+		})
+	}
+}
+
+// noteRateLimitRejection emits a rate_limit.threshold_crossed ops event when an identifier
+// has been rejected RATE_LIMIT_ALERT_REJECTIONS times (default 20) within one window
+func noteRateLimitRejection(identifier string, rejections int, limit RateLimitResult) {
+	threshold := envInt("RATE_LIMIT_ALERT_REJECTIONS", defaultRateLimitAlertRejects)
+	if threshold == 0 || rejections != threshold {
+		return
+	}
+	emitOpsEvent(EventRateLimitThreshold, identifier, map[string]interface{}{
+		"identifier": identifier,
+		"rejections": rejections,
+		"limit":      limit.Limit,
+		"reset_at":   limit.ResetAt.UTC(),
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
@@ -18,8 +19,17 @@ type DemoURL struct {
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
 	SessionID string             `bson:"session_id" json:"session_id"`
+	Clicks    int                `bson:"clicks" json:"clicks"`
+	// Creation client context, as on URLData; never serialized
+	CreatedIP        *string `bson:"created_ip" json:"-"`
+	CreatedUserAgent *string `bson:"created_user_agent" json:"-"`
+	// FullShortURL is computed for responses and never stored
+	FullShortURL string `bson:"-" json:"full_short_url,omitempty"`
 }
 
+// demoSessionLinkLimit is how many demo links one session may create
+const demoSessionLinkLimit = 5
+
 // Handler for anonymous/demo shortener
 func rapidLinkDemo(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -47,7 +57,7 @@ func rapidLinkDemo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	if count >= 5 {
+	if count >= demoSessionLinkLimit {
 		http.Error(w, "Demo limit reached. Please sign up to create more short URLs.", http.StatusForbidden)
 		return
 	}
@@ -60,27 +70,63 @@ func rapidLinkDemo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	logLinkRequest("demo", "", req.LongURL, "", nil)
+	if req.Domain != "" {
+		origin, err := validateDomainOrigin(req.Domain)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Domain = origin
+	}
+	if _, ours := shortenerPath(req.LongURL); ours {
+		http.Error(w, "Invalid destination: "+errSelfReference.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Generate short code (reuse your existing logic)
-	code := generateReadableCode(req.LongURL)
+	code := generateReadableCode(Links, req.LongURL)
 
 	// Set expiry to session expiry (1h for demo)
-	expiresAt := time.Now().Add(1 * time.Hour)
+	expiresAt := clock.Now().Add(1 * time.Hour)
 
 	demoURL := DemoURL{
-		ShortURL:  code,
-		LongURL:   req.LongURL,
-		Domain:    req.Domain,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: expiresAt,
-		SessionID: sessionCookie.Value,
+		ID:               primitive.NewObjectID(),
+		ShortURL:         code,
+		LongURL:          req.LongURL,
+		Domain:           req.Domain,
+		CreatedAt:        time.Now().UTC(),
+		ExpiresAt:        expiresAt,
+		SessionID:        sessionCookie.Value,
+		CreatedIP:        protectCreatedIP(getClientIP(r)),
+		CreatedUserAgent: createdUserAgent(r.UserAgent()),
+	}
+	// Reserve the code until the demo link expires, so no link can take it meanwhile
+	reservation := &CodeReservation{
+		Code:      code,
+		OwnerType: CodeOwnerDemo,
+		Ref:       demoURL.ID.Hex(),
+		CreatedAt: demoURL.CreatedAt,
+		ExpiresAt: &expiresAt,
+	}
+	if err := reserveCode(ctx, DB.Database, reservation); errors.Is(err, ErrDuplicate) {
+		http.Error(w, "Short code is taken, please try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
 	_, err = collection.InsertOne(ctx, demoURL)
 	if err != nil {
+		releaseCode(ctx, DB.Database, code, demoURL.ID.Hex())
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
+	demoURL.FullShortURL = fullShortURL(r, demoURL.Domain, demoURL.ShortURL)
 	w.Header().Set("Content-Type", "application/json")
+	// Demo links have no owner API resource, so Location is the short link itself
+	w.Header().Set("Location", demoURL.FullShortURL)
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(demoURL)
 }
@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// GET /rapidlink-demo - fetch all demo URLs for the current session
+// GET /rapidlink-demo - the current session's unexpired demo URLs, newest first, with its quota
 func getDemoURLs(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -19,21 +23,85 @@ func getDemoURLs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	collection := DB.Database.Collection("demo_urls")
-	cursor, err := collection.Find(ctx, map[string]interface{}{"session_id": sessionCookie.Value})
+	// Counted the same way as on creation, so remaining matches what PUT will allow
+	used, err := collection.CountDocuments(ctx, bson.D{{Key: "session_id", Value: sessionCookie.Value}})
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// The TTL monitor deletes expired links only about once a minute
+	cursor, err := collection.Find(ctx, bson.D{
+		{Key: "session_id", Value: sessionCookie.Value},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: clock.Now()}}},
+	}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(demoSessionLinkLimit))
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var urls []DemoURL
+	urls := []DemoURL{}
 	for cursor.Next(ctx) {
 		var url DemoURL
 		if err := cursor.Decode(&url); err == nil {
+			url.FullShortURL = fullShortURL(r, url.Domain, url.ShortURL)
 			urls = append(urls, url)
 		}
 	}
 
+	remaining := demoSessionLinkLimit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("Content-Type", "application/json")
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"urls": urls,
+		"quota": map[string]interface{}{
+			"limit":     demoSessionLinkLimit,
+			"used":      used,
+			"remaining": remaining,
+		},
+	})
+}
+
+// GET /rapidlink-demo/{code}/stats - click count for one demo URL of the current session
+func getDemoURLStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sessionCookie, err := r.Cookie("rapidlink_demo_session")
+	if err != nil || sessionCookie.Value == "" {
+		http.Error(w, "No demo session found", http.StatusUnauthorized)
+		return
+	}
+
+	code := mux.Vars(r)["code"]
+	if !guardCodeProbe(w, r, probeDemoStats, "", code) {
+		return
+	}
+
+	// Scoped to the session so one visitor cannot read another's numbers
+	var url DemoURL
+	err = DB.Database.Collection("demo_urls").FindOne(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "session_id", Value: sessionCookie.Value},
+	}).Decode(&url)
+	if err != nil {
+		delayCodeMiss()
+		http.Error(w, "Demo URL not found", http.StatusNotFound)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(urls)
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"short_url":      url.ShortURL,
+		"full_short_url": fullShortURL(r, url.Domain, url.ShortURL),
+		"clicks":         url.Clicks,
+		"created_at":     url.CreatedAt,
+		"expires_at":     url.ExpiresAt,
+	})
 }
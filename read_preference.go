@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// ============================================================================
+// ANALYTICS READ PREFERENCE
+// ============================================================================
+//
+// On a replica set, MONGODB_READ_PREFERENCE (e.g. secondaryPreferred) moves the heavy reads
+// of the dashboard off the primary: the link listing and statistics of GET /analytics and the
+// profile, the click list and the click export. They use a copy of the collection with that
+// read preference; the client itself stays on primary, so redirects, duplicate checks,
+// creation and every write keep reading their own writes. A secondary may lag, so freshly
+// created links and recent clicks can be missing from those responses for a moment; they
+// report served_from ("secondary" unless the preference is primary, even though
+// secondaryPreferred falls back to the primary when no secondary is up).
+
+// analyticsReadPref is the read preference of analytics reads; nil keeps them on primary
+var analyticsReadPref *readpref.ReadPref
+
+// InitAnalyticsReadPreference parses MONGODB_READ_PREFERENCE
+func InitAnalyticsReadPreference() error {
+	raw := os.Getenv("MONGODB_READ_PREFERENCE")
+	if raw == "" {
+		return nil
+	}
+	mode, err := readpref.ModeFromString(raw)
+	if err != nil {
+		return fmt.Errorf("MONGODB_READ_PREFERENCE must be primary, primaryPreferred, secondary, secondaryPreferred or nearest")
+	}
+	if mode == readpref.PrimaryMode {
+		analyticsReadPref = nil
+		return nil
+	}
+	if analyticsReadPref, err = readpref.New(mode); err != nil {
+		return fmt.Errorf("MONGODB_READ_PREFERENCE: %v", err)
+	}
+	log.Printf("📖 Analytics reads use read preference %s; writes and redirects stay on primary", raw)
+	return nil
+}
+
+// analyticsCollection returns coll with the analytics read preference applied
+func analyticsCollection(coll *mongo.Collection) *mongo.Collection {
+	if analyticsReadPref == nil {
+		return coll
+	}
+	clone, err := coll.Clone(options.Collection().SetReadPreference(analyticsReadPref))
+	if err != nil {
+		log.Printf("Warning: analytics read preference not applied: %v", err)
+		return coll
+	}
+	return clone
+}
+
+// analyticsServedFrom is the served_from of analytics responses
+func analyticsServedFrom() string {
+	if analyticsReadPref == nil || !usesMongo() {
+		return "primary"
+	}
+	return "secondary"
+}
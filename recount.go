@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// CLICK RECOUNTS
+// ============================================================================
+//
+// A link's clicks and last_clicked are counters bumped by the click worker next to the click
+// event it stores. A crash between the two, a failed write or a bad migration lets them drift
+// from the events. POST /url/{code}/recount (owner) and POST /admin/recount?user_id= count the
+// link's events again and replace the counters with the result, returning the counters before
+// and after. The write only succeeds while clicks still holds the value that was read, so a
+// click recorded meanwhile is not lost; the recount is then retried. unique_clicks (distinct
+// IP hashes of human clicks) and bot_clicks are reported but not stored, as no counter of them
+// exists. On MongoDB the worker bumps the counter before storing the event, so a click landing
+// mid-recount can still leave the counter one off; recount again to settle it.
+//
+// Once a day a checker counts the events of CLICK_CHECK_SAMPLE_SIZE random links (default 100,
+// 0 disables it) and compares them with their counters. It reports the drifted links in the
+// click_counter_drift_links and click_counter_max_drift gauges, and sends the
+// clicks.counter_drift ops event when a link is off by more than CLICK_DRIFT_THRESHOLD clicks
+// (default 10; clicks still queued count as drift). The checker only reports, it does not
+// correct.
+
+const (
+	recountAttempts            = 3
+	recountRateLimit           = 10
+	recountRateWindow          = time.Hour
+	adminRecountLimit          = 1000
+	clickCheckEvery            = 24 * time.Hour
+	defaultClickCheckSample    = 100
+	defaultClickDriftThreshold = 10
+)
+
+// EventClickCounterDrift is the ops event of the daily click consistency check
+const EventClickCounterDrift = "clicks.counter_drift"
+
+// errRecountContended is returned when clicks kept changing the counter during every attempt
+var errRecountContended = errors.New("clicks kept arriving while recounting")
+
+// ClickCounters is what a link's click events add up to
+type ClickCounters struct {
+	Clicks       int64      `json:"clicks"`
+	UniqueClicks int64      `json:"unique_clicks"`
+	BotClicks    int64      `json:"bot_clicks"`
+	LastClicked  *time.Time `json:"last_clicked"`
+}
+
+// add counts a click at clickedAt in Clicks and LastClicked
+func (c *ClickCounters) add(clickedAt time.Time) {
+	c.Clicks++
+	if c.LastClicked == nil || clickedAt.After(*c.LastClicked) {
+		last := clickedAt
+		c.LastClicked = &last
+	}
+}
+
+// StoredClickCounters is the counters kept on a link
+type StoredClickCounters struct {
+	Clicks      int64      `json:"clicks"`
+	LastClicked *time.Time `json:"last_clicked"`
+}
+
+// RecountResult is the outcome of recounting one link
+type RecountResult struct {
+	ShortURL    string              `json:"short_url"`
+	Before      StoredClickCounters `json:"before"`
+	After       ClickCounters       `json:"after"`
+	ClicksDelta int64               `json:"clicks_delta"`
+	// Corrected is false when the counters already matched the events
+	Corrected bool `json:"corrected"`
+}
+
+// recountLink counts link's click events and writes the result to its counters, reloading
+// the link and counting again when a click changed them meanwhile
+func recountLink(ctx context.Context, store URLStore, link *URLData) (*RecountResult, error) {
+	for attempt := 0; attempt < recountAttempts; attempt++ {
+		if attempt > 0 {
+			current, err := store.FindLinkByCode(ctx, link.ShortURL)
+			if err != nil {
+				return nil, err
+			}
+			if current.ID != link.ID {
+				return nil, ErrNotFound
+			}
+			link = current
+		}
+		counted, err := store.CountLinkClicks(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+		result := &RecountResult{
+			ShortURL:    link.ShortURL,
+			Before:      StoredClickCounters{Clicks: int64(link.Clicks), LastClicked: link.LastClicked},
+			After:       *counted,
+			ClicksDelta: counted.Clicks - int64(link.Clicks),
+		}
+		if result.ClicksDelta == 0 && sameInstant(link.LastClicked, counted.LastClicked) {
+			return result, nil
+		}
+		updated, err := store.SetClickCounters(ctx, link, *counted)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			result.Corrected = true
+			incMetric("click_counters_corrected_total", 1)
+			return result, nil
+		}
+	}
+	return nil, errRecountContended
+}
+
+// sameInstant reports whether a and b are both unset or the same time
+func sameInstant(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// recountURL handles POST /url/{code}/recount
+func recountURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	clientIP := getClientIP(r)
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return
+	}
+	policy := requestConfig(r).RateLimit("recount")
+	if limit := checkRateLimit("recount:"+userID, policy.Limit, policy.Window); limit.Limited {
+		logSecurityEvent(r.Context(), "RECOUNT_RATE_LIMIT_EXCEEDED", userID, clientIP, r.UserAgent(),
+			"Click recount rate limit exceeded", "WARN")
+		writeRateLimited(w, limit)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	urls := linkStore(r)
+	link, err := urls.FindLinkByCode(ctx, code)
+	if err == nil && link.DeactivatedReason == DeactivatedDraft {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err, "Short URL", "Database error")
+		return
+	}
+	if link.UserID != userID {
+		logSecurityEvent(r.Context(), "UNAUTHORIZED_LINK_RECOUNT", userID, clientIP, r.UserAgent(),
+			"Attempt to recount short URL "+code+" of another user", "WARN")
+		writeStoreError(w, ErrUnauthorizedOwner, "short URL", "Database error")
+		return
+	}
+
+	// Clicks still queued would otherwise count as drift
+	clicks.Drain(ctx)
+	result, err := recountLink(ctx, urls, link)
+	if errors.Is(err, errRecountContended) {
+		http.Error(w, "Short URL kept getting clicks while recounting; please retry", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("error recounting clicks of %s: %v", code, err)
+		writeStoreError(w, err, "Short URL", "Failed to recount clicks")
+		return
+	}
+	if result.Corrected {
+		logSecurityEvent(r.Context(), "CLICKS_RECOUNTED", userID, clientIP, r.UserAgent(),
+			fmt.Sprintf("Clicks of %s recounted: %d -> %d", code, result.Before.Clicks, result.After.Clicks), "INFO")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("error encoding recount response: %v", err)
+	}
+}
+
+// adminRecount handles POST /admin/recount?user_id=, recounting up to adminRecountLimit of
+// the user's links by code. Only the corrected links are listed.
+func adminRecount(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "user_id must be a user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if _, err := Users.GetUserByID(ctx, objectID); err != nil {
+		writeStoreError(w, err, "User", "Database error")
+		return
+	}
+	links, err := Links.ListUserLinks(ctx, userID, adminRecountLimit+1)
+	if err != nil {
+		log.Printf("error listing links of %s to recount: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	truncated := len(links) > adminRecountLimit
+	if truncated {
+		links = links[:adminRecountLimit]
+	}
+
+	clicks.Drain(ctx)
+	corrected := []*RecountResult{}
+	contended := []string{}
+	var delta int64
+	for _, link := range links {
+		result, err := recountLink(ctx, Links, link)
+		if errors.Is(err, errRecountContended) {
+			contended = append(contended, link.ShortURL)
+			continue
+		} else if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			log.Printf("error recounting clicks of %s: %v", link.ShortURL, err)
+			http.Error(w, "Failed to recount clicks", http.StatusInternalServerError)
+			return
+		}
+		if result.Corrected {
+			corrected = append(corrected, result)
+			delta += result.ClicksDelta
+		}
+	}
+
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "CLICKS_RECOUNTED_BY_ADMIN", adminID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Clicks of user %s recounted: %d of %d links corrected, %+d clicks", userID, len(corrected), len(links), delta), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":      userID,
+		"checked":      len(links),
+		"truncated":    truncated,
+		"corrected":    corrected,
+		"contended":    contended,
+		"clicks_delta": delta,
+	}); err != nil {
+		log.Printf("error encoding admin recount response: %v", err)
+	}
+}
+
+// StartClickConsistencyWorker compares the counters of a random sample of links with their
+// click events once a day. On MongoDB a worker lease ensures only one instance does so.
+func StartClickConsistencyWorker() {
+	size := envInt("CLICK_CHECK_SAMPLE_SIZE", defaultClickCheckSample)
+	if size == 0 {
+		return
+	}
+	threshold := int64(envInt("CLICK_DRIFT_THRESHOLD", defaultClickDriftThreshold))
+	check := func() (map[string]int64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		links, err := Links.SampleLinks(ctx, size)
+		if err != nil {
+			return nil, err
+		}
+		var drifted []map[string]interface{}
+		var maxDrift int64
+		for _, link := range links {
+			counted, err := Links.CountLinkClicks(ctx, link)
+			if err != nil {
+				return nil, err
+			}
+			drift := counted.Clicks - int64(link.Clicks)
+			if drift < 0 {
+				drift = -drift
+			}
+			if drift > maxDrift {
+				maxDrift = drift
+			}
+			if drift > threshold {
+				drifted = append(drifted, map[string]interface{}{
+					"short_url": link.ShortURL,
+					"user_id":   link.UserID,
+					"clicks":    link.Clicks,
+					"counted":   counted.Clicks,
+				})
+			}
+		}
+		setGauge("click_counter_drift_links", int64(len(drifted)))
+		setGauge("click_counter_max_drift", maxDrift)
+		if len(drifted) > 0 {
+			log.Printf("⚠️  %d of %d sampled links have click counters off by more than %d", len(drifted), len(links), threshold)
+			emitOpsEvent(EventClickCounterDrift, clock.Now().UTC().Format("2006-01-02"), map[string]interface{}{
+				"sampled":   len(links),
+				"threshold": threshold,
+				"links":     drifted,
+			})
+		}
+		return map[string]int64{"sampled": int64(len(links)), "drifted": int64(len(drifted)), "max_drift": maxDrift}, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(clickCheckEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if usesMongo() {
+				runExclusive("click_consistency", clickCheckEvery, check)
+			} else if _, err := check(); err != nil {
+				log.Printf("⚠️  Click consistency check failed: %v", err)
+			}
+		}
+	}()
+}
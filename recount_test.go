@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// skewClicks overwrites the stored counters of code, as a crashed worker or a bad migration
+// would, and returns the last_clicked the events add up to
+func skewClicks(srv *testServer, code string, clicks int) *time.Time {
+	srv.t.Helper()
+	link := srv.stored(code)
+	if updated, err := srv.links.SetClickCounters(context.Background(), link, ClickCounters{Clicks: int64(clicks)}); err != nil || !updated {
+		srv.t.Fatalf("skew %s: %v, %v", code, updated, err)
+	}
+	return link.LastClicked
+}
+
+func TestRecountRepairsSkewedCounter(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/recount"})
+
+	// Three human clicks from two visitors and a bot
+	for _, visit := range []struct{ peer, agent string }{
+		{"198.51.100.1:4000", "Mozilla/5.0"},
+		{"198.51.100.1:4001", "Mozilla/5.0"},
+		{"198.51.100.2:4000", "Mozilla/5.0"},
+		{"198.51.100.3:4000", "curl/8.0"},
+	} {
+		req := httptest.NewRequest("GET", "/"+code, nil)
+		req.Header.Set("User-Agent", visit.agent)
+		srv.serveFrom(visit.peer, req)
+	}
+	drainClicks(t)
+	last := skewClicks(srv, code, 42)
+
+	var result RecountResult
+	if resp := srv.do("POST", "/url/"+code+"/recount", token, map[string]interface{}{}, &result); resp.StatusCode != http.StatusOK {
+		t.Fatalf("recount: status %d", resp.StatusCode)
+	}
+	if result.Before.Clicks != 42 || result.Before.LastClicked != nil || !result.Corrected || result.ClicksDelta != -38 {
+		t.Errorf("recount %+v", result)
+	}
+	if after := result.After; after.Clicks != 4 || after.UniqueClicks != 2 || after.BotClicks != 1 || !sameInstant(after.LastClicked, last) {
+		t.Errorf("recounted %+v, last click at %v", after, last)
+	}
+	if stored := srv.stored(code); stored.Clicks != 4 || !sameInstant(stored.LastClicked, last) {
+		t.Errorf("stored clicks %d, last_clicked %v", stored.Clicks, stored.LastClicked)
+	}
+
+	// Counters that match their events are left alone
+	result = RecountResult{}
+	srv.do("POST", "/url/"+code+"/recount", token, map[string]interface{}{}, &result)
+	if result.Corrected || result.ClicksDelta != 0 || result.Before.Clicks != 4 {
+		t.Errorf("second recount %+v", result)
+	}
+
+	for _, tt := range []struct {
+		code, token string
+		status      int
+	}{
+		{code, other, http.StatusForbidden},
+		{"missing", token, http.StatusNotFound},
+		{"no_such!", token, http.StatusBadRequest},
+	} {
+		if resp := srv.do("POST", "/url/"+tt.code+"/recount", tt.token, map[string]interface{}{}, nil); resp.StatusCode != tt.status {
+			t.Errorf("recount of %s: status %d, want %d", tt.code, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestAdminRecount(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, userID := srv.register()
+	clicked := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/clicked"})
+	inflated := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/inflated"})
+	exact := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/exact"})
+	for _, code := range []string{clicked, clicked, exact} {
+		req := httptest.NewRequest("GET", "/"+code, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		srv.serveFrom("198.51.100.1:4000", req)
+	}
+	drainClicks(t)
+	skewClicks(srv, clicked, 0)
+	skewClicks(srv, inflated, 7)
+
+	var report struct {
+		Checked     int              `json:"checked"`
+		Corrected   []*RecountResult `json:"corrected"`
+		ClicksDelta int64            `json:"clicks_delta"`
+	}
+	if resp := srv.do("POST", "/admin/recount?user_id="+userID, admin, map[string]interface{}{}, &report); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin recount: status %d", resp.StatusCode)
+	}
+	if report.Checked != 3 || len(report.Corrected) != 2 || report.ClicksDelta != 2-7 {
+		t.Fatalf("admin recount %+v", report)
+	}
+	for _, result := range report.Corrected {
+		if want := map[string]int64{clicked: 2, inflated: 0}[result.ShortURL]; result.After.Clicks != want {
+			t.Errorf("%s recounted to %d, want %d", result.ShortURL, result.After.Clicks, want)
+		}
+	}
+	counts := []int{srv.stored(clicked).Clicks, srv.stored(inflated).Clicks, srv.stored(exact).Clicks}
+	if counts[0] != 2 || counts[1] != 0 || counts[2] != 1 {
+		t.Errorf("stored clicks %v", counts)
+	}
+
+	for _, tt := range []struct {
+		query, token string
+		status       int
+	}{
+		{"user_id=" + userID, token, http.StatusForbidden},
+		{"user_id=nobody", admin, http.StatusBadRequest},
+		{"user_id=000000000000000000000000", admin, http.StatusNotFound},
+	} {
+		if resp := srv.do("POST", "/admin/recount?"+tt.query, tt.token, map[string]interface{}{}, nil); resp.StatusCode != tt.status {
+			t.Errorf("admin recount ?%s: status %d, want %d", tt.query, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// contendedStore is a store whose counters change between every count and write
+type contendedStore struct {
+	URLStore
+	writes int
+}
+
+func (s *contendedStore) SetClickCounters(context.Context, *URLData, ClickCounters) (bool, error) {
+	s.writes++
+	return false, nil
+}
+
+func TestRecountContended(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/busy"})
+	srv.do("GET", "/"+code, "", nil, nil)
+	drainClicks(t)
+	ctx := context.Background()
+
+	// A write from a stale read is refused, so a click recorded meanwhile is not lost
+	link, err := srv.links.FindLinkByCode(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *link
+	stale.Clicks = 0
+	if updated, err := srv.links.SetClickCounters(ctx, &stale, ClickCounters{}); err != nil || updated {
+		t.Fatalf("stale write: %v, %v", updated, err)
+	}
+	if count := srv.stored(code).Clicks; count != 1 {
+		t.Fatalf("stale write changed clicks to %d", count)
+	}
+
+	// Recounting retries from a fresh read, and gives up when clicks keep arriving
+	skewClicks(srv, code, 9)
+	link, _ = srv.links.FindLinkByCode(ctx, code)
+	busy := &contendedStore{URLStore: srv.links}
+	if _, err := recountLink(ctx, busy, link); !errors.Is(err, errRecountContended) || busy.writes != recountAttempts {
+		t.Fatalf("recountLink: %v after %d writes", err, busy.writes)
+	}
+	if result, err := recountLink(ctx, srv.links, &stale); err != nil || !result.Corrected || result.After.Clicks != 1 {
+		t.Fatalf("recount from a stale read: %+v, %v", result, err)
+	}
+}
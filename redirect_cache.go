@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// REDIRECT TYPE AND CACHE POLICY
+// ============================================================================
+//
+// Permanent redirects are cacheable by browsers and CDNs for cache_max_age seconds
+// (default 300), so a viral link is absorbed at the edge. The cost is that clicks served
+// from a cache never reach redirect() and are not counted, and an edited destination can
+// be served stale for up to max-age. Temporary redirects are never cached.
+
+// Redirect types accepted in redirect_type
+const (
+	RedirectPermanent = "permanent"
+	RedirectTemporary = "temporary"
+)
+
+const (
+	defaultRedirectMaxAge = 300
+	maxRedirectMaxAge     = 24 * 60 * 60
+)
+
+// validateRedirectOptions checks the redirect_type and cache_max_age creation options
+func validateRedirectOptions(redirectType string, maxAge *int) error {
+	switch redirectType {
+	case "", RedirectPermanent, RedirectTemporary:
+	default:
+		return fmt.Errorf("redirect_type must be %q or %q", RedirectPermanent, RedirectTemporary)
+	}
+	if maxAge != nil && (*maxAge < 0 || *maxAge > maxRedirectMaxAge) {
+		return fmt.Errorf("cache_max_age must be between 0 and %d seconds", maxRedirectMaxAge)
+	}
+	return nil
+}
+
+// isPermanentRedirect reports whether a link uses 301 semantics; links created before
+// redirect_type existed were always 301
+func isPermanentRedirect(urlData *URLData) bool {
+	return urlData.RedirectType != RedirectTemporary
+}
+
+// redirectMaxAge returns the edge cache lifetime of a permanent redirect
+func redirectMaxAge(urlData *URLData) int {
+	if urlData.CacheMaxAge != nil {
+		return *urlData.CacheMaxAge
+	}
+	return defaultRedirectMaxAge
+}
+
+// redirectStatus returns the HTTP status used when redirecting to the link
+func redirectStatus(urlData *URLData) int {
+	if isPermanentRedirect(urlData) {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusFound
+}
+
+// setRedirectCacheHeaders applies the link's cache policy to a redirect response
+func setRedirectCacheHeaders(w http.ResponseWriter, urlData *URLData) {
+	maxAge := redirectMaxAge(urlData)
+	if !isPermanentRedirect(urlData) || maxAge == 0 {
+		setNoStoreHeaders(w)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	lastModified := urlData.CreatedAt
+	if urlData.UpdatedAt != nil {
+		lastModified = *urlData.UpdatedAt
+	}
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+}
+
+// setNoStoreHeaders disables caching of a response
+func setNoStoreHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// cacheStalenessNote describes how long edits to a link may take to reach visitors
+func cacheStalenessNote(urlData *URLData) map[string]interface{} {
+	if !isPermanentRedirect(urlData) || redirectMaxAge(urlData) == 0 {
+		return map[string]interface{}{
+			"max_age": 0,
+			"note":    "Redirect is not cached; changes apply immediately.",
+		}
+	}
+	maxAge := redirectMaxAge(urlData)
+	return map[string]interface{}{
+		"max_age":      maxAge,
+		"stale_before": time.Now().UTC().Add(time.Duration(maxAge) * time.Second).Format(time.RFC3339),
+		"note": fmt.Sprintf("Permanent redirect cached for up to %d seconds; browsers and CDNs "+
+			"may keep serving the previous version until then.", maxAge),
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// lastModifiedOf returns the Last-Modified a redirect to code should carry
+func (s *testServer) lastModifiedOf(code string) string {
+	s.t.Helper()
+	link, err := s.links.FindLinkByCode(context.Background(), code)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return link.UpdatedAt.UTC().Format(http.TimeFormat)
+}
+
+func TestRedirectCacheHeaders(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	tests := []struct {
+		name         string
+		options      map[string]interface{}
+		status       int
+		cacheControl string
+		lastModified bool
+	}{
+		{"default is permanent", nil, http.StatusMovedPermanently, "public, max-age=300", true},
+		{"permanent with max-age", map[string]interface{}{"redirect_type": RedirectPermanent, "cache_max_age": 60}, http.StatusMovedPermanently, "public, max-age=60", true},
+		{"permanent without caching", map[string]interface{}{"redirect_type": RedirectPermanent, "cache_max_age": 0}, http.StatusMovedPermanently, "no-cache, no-store, must-revalidate", false},
+		{"temporary", map[string]interface{}{"redirect_type": RedirectTemporary}, http.StatusFound, "no-cache, no-store, must-revalidate", false},
+		{"temporary ignores max-age", map[string]interface{}{"redirect_type": RedirectTemporary, "cache_max_age": 600}, http.StatusFound, "no-cache, no-store, must-revalidate", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"long-url": "https://example.com/cache/" + strconv.Itoa(i)}
+			for k, v := range tt.options {
+				body[k] = v
+			}
+			code := srv.shorten(token, body)
+			resp := srv.do("GET", "/"+code, "", nil, nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control %q, want %q", got, tt.cacheControl)
+			}
+			got := resp.Header.Get("Last-Modified")
+			if !tt.lastModified && got != "" {
+				t.Errorf("uncached redirect sent Last-Modified %q", got)
+			}
+			if tt.lastModified && got != srv.lastModifiedOf(code) {
+				t.Errorf("Last-Modified %q, want %q", got, srv.lastModifiedOf(code))
+			}
+		})
+	}
+}
+
+func TestRejectsInvalidRedirectOptions(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	for _, options := range []map[string]interface{}{
+		{"redirect_type": "sometimes"},
+		{"cache_max_age": -1},
+		{"cache_max_age": maxRedirectMaxAge + 1},
+	} {
+		options["long-url"] = "https://example.com/cache"
+		if resp := srv.do("PUT", "/url", token, options, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", options, resp.StatusCode)
+		}
+	}
+}
+
+func TestEditReportsCacheStaleness(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	var edited struct {
+		Cache struct {
+			MaxAge      int    `json:"max_age"`
+			StaleBefore string `json:"stale_before"`
+		} `json:"cache"`
+	}
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/old", "cache_max_age": 120})
+	resp := srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.com/new"}, &edited)
+	if resp.StatusCode != http.StatusOK || edited.Cache.MaxAge != 120 || edited.Cache.StaleBefore == "" {
+		t.Fatalf("edit of a cached redirect: status %d, cache %+v", resp.StatusCode, edited.Cache)
+	}
+	// The redirect carries the edit time, so caches revalidating see the change
+	resp = srv.do("GET", "/"+code, "", nil, nil)
+	if got := resp.Header.Get("Last-Modified"); got != srv.lastModifiedOf(code) {
+		t.Errorf("Last-Modified after edit %q, want %q", got, srv.lastModifiedOf(code))
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "public, max-age="+strconv.Itoa(120) {
+		t.Errorf("Cache-Control after edit %q", got)
+	}
+
+	code = srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/temporary", "redirect_type": RedirectTemporary})
+	edited.Cache.MaxAge, edited.Cache.StaleBefore = -1, ""
+	srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.com/moved"}, &edited)
+	if edited.Cache.MaxAge != 0 || edited.Cache.StaleBefore != "" {
+		t.Fatalf("edit of an uncached redirect reported cache %+v", edited.Cache)
+	}
+}
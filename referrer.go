@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ============================================================================
+// REFERRER RESTRICTIONS
+// ============================================================================
+//
+// A link with allowed_referrers only redirects when the Referer host is one of the listed
+// hosts or a subdomain of one, so links scraped from a newsletter or site stop working when
+// reposted elsewhere. Many clients strip Referer, so a missing header is allowed unless the
+// link sets deny_missing_referrer. Refused clicks are counted in blocked_clicks.
+
+// normalizeAllowedReferrers lower-cases the host suffixes and strips a leading "*." or "."
+// and any port; entries must be bare hostnames
+func normalizeAllowedReferrers(referrers []string) ([]string, error) {
+	if len(referrers) > MaxAllowedReferrers {
+		return nil, fmt.Errorf("allowed_referrers accepts at most %d hosts", MaxAllowedReferrers)
+	}
+	seen := make(map[string]bool, len(referrers))
+	var normalized []string
+	for _, ref := range referrers {
+		host := strings.ToLower(strings.TrimSpace(ref))
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*."), ".")
+		if strings.ContainsAny(host, "/?#@ ") {
+			return nil, fmt.Errorf("invalid allowed_referrers entry %q: use a hostname such as example.com", ref)
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" || strings.Contains(host, ":") || strings.HasPrefix(host, ".") {
+			return nil, fmt.Errorf("invalid allowed_referrers entry %q: use a hostname such as example.com", ref)
+		}
+		if !seen[host] {
+			seen[host] = true
+			normalized = append(normalized, host)
+		}
+	}
+	return normalized, nil
+}
+
+// referrerHost returns the lowercased host of a Referer header, "" when it has none
+func referrerHost(referer string) string {
+	parsed, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+}
+
+// referrerAllowed reports whether a click with this Referer header may follow link
+func referrerAllowed(referer string, link *URLData) bool {
+	if len(link.AllowedReferrers) == 0 {
+		return true
+	}
+	if referer == "" {
+		return !link.DenyMissingReferrer
+	}
+	host := referrerHost(referer)
+	if host == "" {
+		return false
+	}
+	for _, allowed := range link.AllowedReferrers {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeReferrerBlocked answers a refused click with a localized 403 page that offers the
+// link's referrer fallback URL, when it has one; other clients get plain text
+func writeReferrerBlocked(w http.ResponseWriter, r *http.Request, link *URLData) {
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	if link.ReferrerFallbackURL == "" && !wantsHTML(r) {
+		http.Error(w, "This link can only be opened from the site that shared it", http.StatusForbidden)
+		return
+	}
+	writeLocalizedPage(w, r, http.StatusForbidden, "referrer_blocked", link.ReferrerFallbackURL)
+}
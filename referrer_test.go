@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeAllowedReferrers(t *testing.T) {
+	got, err := normalizeAllowedReferrers([]string{" Example.COM ", "*.news.example.org", ".blog.example.net", "example.com", "cdn.example.com:8443"})
+	want := []string{"example.com", "news.example.org", "blog.example.net", "cdn.example.com"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalizeAllowedReferrers = %q, %v; want %q", got, err, want)
+	}
+	for _, invalid := range []string{"https://example.com", "example.com/path", "user@example.com", "", "*.", "a b.com", "[::1]:80x"} {
+		if _, err := normalizeAllowedReferrers([]string{invalid}); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+	tooMany := make([]string, MaxAllowedReferrers+1)
+	for i := range tooMany {
+		tooMany[i] = string(rune('a'+i%26)) + "x" + string(rune('a'+i/26)) + ".com"
+	}
+	if _, err := normalizeAllowedReferrers(tooMany); err == nil {
+		t.Errorf("%d entries accepted", len(tooMany))
+	}
+}
+
+func TestReferrerAllowed(t *testing.T) {
+	link := &URLData{AllowedReferrers: []string{"example.com", "news.example.org"}}
+	strict := &URLData{AllowedReferrers: []string{"example.com"}, DenyMissingReferrer: true}
+	tests := []struct {
+		name    string
+		referer string
+		link    *URLData
+		want    bool
+	}{
+		{"exact host", "https://example.com/post", link, true},
+		{"subdomain", "https://www.example.com/post", link, true},
+		{"deep subdomain", "https://a.b.example.com/", link, true},
+		{"port", "https://example.com:8443/post", link, true},
+		{"subdomain with port", "http://www.example.com:8080/", link, true},
+		{"upper case", "HTTPS://WWW.EXAMPLE.COM/", link, true},
+		{"trailing dot", "https://example.com./", link, true},
+		{"listed subdomain only", "https://news.example.org/", link, true},
+		{"parent of listed subdomain", "https://example.org/", link, false},
+		{"sibling of listed subdomain", "https://sports.example.org/", link, false},
+		{"suffix without dot", "https://evilexample.com/", link, false},
+		{"allowed host as subdomain elsewhere", "https://example.com.evil.net/", link, false},
+		{"allowed host in path", "https://evil.net/example.com", link, false},
+		{"allowed host as userinfo", "https://example.com@evil.net/", link, false},
+		{"unparseable", "::not a url", link, false},
+		{"no host", "/relative/path", link, false},
+		{"missing, allowed", "", link, true},
+		{"missing, denied", "", strict, false},
+		{"no restriction", "https://anywhere.net/", &URLData{}, true},
+	}
+	for _, tt := range tests {
+		if got := referrerAllowed(tt.referer, tt.link); got != tt.want {
+			t.Errorf("%s: referrerAllowed(%q) = %v, want %v", tt.name, tt.referer, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectEnforcesReferrers(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{
+		"long-url":              "https://example.com/members",
+		"allowed_referrers":     []string{"newsletter.example"},
+		"deny_missing_referrer": true,
+	})
+
+	click := func(referer string) int {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		return srv.send(req, nil).StatusCode
+	}
+	if status := click("https://mail.newsletter.example:443/issue/3"); status != http.StatusMovedPermanently {
+		t.Fatalf("allowed referrer: status %d", status)
+	}
+	for _, referer := range []string{"https://scraper.example/", "https://newsletter.example.evil.net/", ""} {
+		if status := click(referer); status != http.StatusForbidden {
+			t.Fatalf("referrer %q: status %d, want 403", referer, status)
+		}
+	}
+	drainClicks(t)
+
+	var detail URLData
+	srv.do("GET", "/url/"+code, token, nil, &detail)
+	if detail.BlockedClicks != 3 || detail.Clicks != 1 {
+		t.Fatalf("clicks %d, blocked_clicks %d; want 1 and 3", detail.Clicks, detail.BlockedClicks)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// REQUEST IDS
+// ============================================================================
+//
+// Every request carries an ID: a well-formed incoming X-Request-ID, or a generated one. It is
+// echoed in the X-Request-ID response header, written to the access log and stored on every
+// security event the request raises, together with the matched route.
+
+type requestInfoKey struct{}
+
+// requestInfo is the per-request correlation data. Route is filled in once the router has
+// matched, which is after the access logger and request ID middleware have seen the request.
+type requestInfo struct {
+	ID    string
+	Route string
+	// UserID is set by JWTMiddleware; RateLimited when the rate limiter refused the request
+	UserID      string
+	RateLimited bool
+	// Config is the live configuration snapshot the request started with
+	Config *runtimeConfig
+}
+
+// requestIDPattern bounds client-supplied IDs so they cannot inject into log lines
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestInfoFrom returns the correlation data of the request ctx belongs to, or an empty one
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if ctx != nil {
+		if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+			return info
+		}
+	}
+	return &requestInfo{}
+}
+
+// requestIDMiddleware assigns the request ID and pins the live configuration snapshot; it
+// must wrap the access logger
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{ID: id, Config: liveConfig()})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// recordRoute stores the matched route template (or route name) on the request's info
+func recordRoute(r *http.Request) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return
+	}
+	name := route.GetName()
+	if name == "" {
+		name, _ = route.GetPathTemplate()
+	}
+	requestInfoFrom(r.Context()).Route = r.Method + " " + name
+}
+
+// accessLogFormatter writes the Apache combined log format followed by the request ID and route
+func accessLogFormatter(w io.Writer, p handlers.LogFormatterParams) {
+	host := splitHost(p.Request.RemoteAddr)
+	referer, userAgent := p.Request.Referer(), p.Request.UserAgent()
+	if referer == "" {
+		referer = "-"
+	}
+	if userAgent == "" {
+		userAgent = "-"
+	}
+	info := requestInfoFrom(p.Request.Context())
+	route := info.Route
+	if route == "" {
+		route = "-"
+	}
+	fmt.Fprintf(w, "%s - - [%s] %q %d %d %q %q request_id=%s route=%q\n",
+		host, p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		p.Request.Method+" "+redactRequestURI(p.URL.RequestURI())+" "+p.Request.Proto,
+		p.StatusCode, p.Size, referer, userAgent, info.ID, route)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureAccessLog sends the access log of servers built afterwards to a file and returns a
+// function reading it back
+func captureAccessLog(t *testing.T) func() string {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), "access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = file
+	t.Cleanup(func() {
+		os.Stdout = saved
+		file.Close()
+	})
+	return func() string {
+		raw, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+}
+
+func TestRequestIDReachesSecurityEvents(t *testing.T) {
+	accessLog := captureAccessLog(t)
+	srv := newTestServer(t)
+	logs := captureLog(t)
+	token, _ := srv.register()
+
+	const id = "req-2184.correlation_1"
+	req, _ := http.NewRequest("PUT", srv.URL+"/url", jsonBody(t, map[string]interface{}{"long-url": "http://localhost/admin"}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Request-ID", id)
+	resp := srv.send(req, nil)
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Request-ID") != id {
+		t.Fatalf("status %d, X-Request-ID %q", resp.StatusCode, resp.Header.Get("X-Request-ID"))
+	}
+	if !logs.waitFor("Request: " + id + ")") {
+		t.Fatalf("security event lacks the request ID:\n%s", logs.String())
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "SECURITY") && strings.Contains(line, "/admin") && !strings.Contains(line, "Request: "+id+")") {
+			t.Errorf("event of the request without its ID: %s", line)
+		}
+	}
+
+	// The access log line of the same request carries the ID and the matched route
+	time.Sleep(10 * time.Millisecond)
+	if !strings.Contains(accessLog(), `request_id=`+id+` route="PUT /url"`) {
+		t.Fatalf("access log lacks the request:\n%s", accessLog())
+	}
+}
+
+func TestRequestIDRejectsInjection(t *testing.T) {
+	srv := newTestServer(t)
+	logs := captureLog(t)
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	for _, id := range []string{"", "bad id with spaces", "inject\nSECURITY [INFO]", strings.Repeat("a", 65)} {
+		// The handler is called directly; the client refuses to send some of these values
+		req := httptest.NewRequest("GET", "/bad!code", nil)
+		if id != "" {
+			req.Header["X-Request-Id"] = []string{id}
+		}
+		got := srv.serveFrom("127.0.0.1:4000", req).Header().Get("X-Request-ID")
+		if !generated.MatchString(got) {
+			t.Errorf("X-Request-ID %q answered with %q, want a generated ID", id, got)
+			continue
+		}
+		if !logs.waitFor("Request: " + got + ")") {
+			t.Errorf("security event lacks the generated ID %s", got)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// LINK RESOLVE API (CMS INTEGRATIONS)
+// ============================================================================
+//
+// The owner's resolve hands out public_sig and public_sig_exp for link cards on their site.
+// The signature covers the link's ID, code and expiry, so it stops working when it expires
+// or when the code is deleted and taken by another link. Public answers are cached per code
+// for resolveCacheTTL, or until the link expires if that is sooner. Every write that changes
+// what the answer shows (edit, delete, revive, admin disable, released draft) forgets the
+// entry at once. The cache is per instance, so other instances catch up within the TTL.
+
+const (
+	resolveCacheTTL         = 60 * time.Second
+	publicResolveValidity   = 30 * 24 * time.Hour
+	publicResolveRateLimit  = 30 // requests per minute per IP
+	publicResolveRateWindow = time.Minute
+)
+
+type resolveCacheEntry struct {
+	payload   map[string]interface{}
+	linkID    primitive.ObjectID
+	userID    string
+	domain    string // full_short_url depends on the request, so it is added per response
+	expiresAt time.Time
+}
+
+var (
+	resolveCache      = make(map[string]resolveCacheEntry)
+	resolveCacheMutex = sync.RWMutex{}
+)
+
+// forgetResolvedLink drops the cached public answer for code after the link changed
+func forgetResolvedLink(code string) {
+	resolveCacheMutex.Lock()
+	delete(resolveCache, code)
+	resolveCacheMutex.Unlock()
+}
+
+// resolveSigningKey returns the secret used to sign public resolve URLs
+func resolveSigningKey() []byte {
+	if secret := os.Getenv("RESOLVE_SIGNING_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return JWTSecret
+}
+
+// signResolveCode returns the public resolve signature for a link valid until exp
+func signResolveCode(linkID primitive.ObjectID, code string, exp int64) string {
+	mac := hmac.New(sha256.New, resolveSigningKey())
+	mac.Write([]byte("resolve:" + linkID.Hex() + ":" + code + ":" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resolveSignatureExpiry parses the exp query parameter of a public resolve, false when it
+// is missing or past
+func resolveSignatureExpiry(query url.Values, now time.Time) (int64, bool) {
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	return exp, err == nil && now.Unix() < exp
+}
+
+// verifyResolveSignature checks a public resolve signature in constant time
+func verifyResolveSignature(linkID primitive.ObjectID, code string, exp int64, sig string) bool {
+	return hmac.Equal([]byte(signResolveCode(linkID, code, exp)), []byte(sig))
+}
+
+// linkStatus describes whether a link currently resolves
+func linkStatus(urlData *URLData) string {
+	if !urlData.IsActive {
+		return "disabled"
+	}
+	if isExpiredAt(urlData.ExpiresAt, clock.Now()) {
+		return "expired"
+	}
+	return "active"
+}
+
+// resolveLink handles GET /api/v1/resolve?code=abc123
+//
+// Without a sig parameter the caller must be authenticated and own the link.
+// With ?sig= the request is served publicly for link cards on the owner's site.
+// Resolving never counts as a click.
+func resolveLink(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("sig") != "" {
+		resolvePublic(w, r)
+		return
+	}
+	JWTMiddleware(resolveOwner)(w, r)
+}
+
+// resolveOwner returns full link metadata to the authenticated owner
+func resolveOwner(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+
+	code := sanitizeInput(r.URL.Query().Get("code"))
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Missing or invalid code parameter", http.StatusBadRequest)
+		return
+	}
+
+	if !guardCodeProbe(w, r, probeResolveOwner, userID, code) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	urlData, err := linkStore(r).FindLinkByCode(ctx, code)
+	if err == nil && urlData.UserID != userID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			delayCodeMiss()
+		} else {
+			log.Printf("error resolving short URL %s: %v", code, err)
+		}
+		writeStoreError(w, err, "Short URL", "database error")
+		return
+	}
+
+	publicExp := clock.Now().Add(publicResolveValidity).Unix()
+	response := map[string]interface{}{
+		"success":        true,
+		"short_url":      urlData.ShortURL,
+		"full_short_url": fullShortURL(r, urlData.Domain, urlData.ShortURL),
+		"destination":    urlData.LongURL,
+		"domain":         urlData.Domain,
+		"title":          urlData.Title,
+		"description":    urlData.Description,
+		"og":             urlData.OG,
+		"tags":           urlData.Tags,
+		"status":         linkStatus(urlData),
+		"clicks":         urlData.Clicks,
+		"created_at":     urlData.CreatedAt,
+		"expires_at":     urlData.ExpiresAt,
+		"public_sig":     signResolveCode(urlData.ID, urlData.ShortURL, publicExp),
+		"public_sig_exp": publicExp,
+		// Owner-only: resolvePublic must never include the creation context
+		"created_ip":         revealCreatedIP(urlData.CreatedIP),
+		"created_user_agent": urlData.CreatedUserAgent,
+		// Set once the background probe found the destination redirecting elsewhere
+		"resolved_destination":  urlData.ResolvedDestination,
+		"redirect_chain_length": urlData.RedirectChainLength,
+		"public_note":           urlData.PublicNote,
+		"internal":              urlData.Internal,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding resolve response: %v", err)
+	}
+}
+
+// resolvePublic serves signed, cached link-card metadata without authentication
+func resolvePublic(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	policy := requestConfig(r).RateLimit("resolve")
+	if limit := checkRateLimit("resolve:"+rateLimitSubject(clientIP), policy.Limit, policy.Window); limit.Limited {
+		logSecurityEvent(r.Context(), "RESOLVE_RATE_LIMIT_EXCEEDED", "", clientIP, r.UserAgent(),
+			"Public resolve rate limit exceeded", "WARN")
+		writeRateLimited(w, limit)
+		return
+	}
+
+	code := sanitizeInput(r.URL.Query().Get("code"))
+	sig := r.URL.Query().Get("sig")
+	if !guardCodeProbe(w, r, probeResolvePublic, "", code) {
+		return
+	}
+	now := clock.Now()
+	exp, current := resolveSignatureExpiry(r.URL.Query(), now)
+	refuse := func() {
+		logSecurityEvent(r.Context(), "INVALID_RESOLVE_SIGNATURE", "", clientIP, r.UserAgent(),
+			"Invalid public resolve signature for: "+code, "WARN")
+		http.Error(w, "Invalid code or signature", http.StatusForbidden)
+	}
+	if code == "" || !validateCustomURL(code) || !current {
+		refuse()
+		return
+	}
+
+	resolveCacheMutex.RLock()
+	entry, cached := resolveCache[code]
+	resolveCacheMutex.RUnlock()
+
+	cached = cached && now.Before(entry.expiresAt)
+	if !cached {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		urlData, err := linkStore(r).FindLinkByCode(ctx, code)
+		if errors.Is(err, ErrNotFound) {
+			// Without the link there is no ID to check the signature against
+			delayCodeMiss()
+			refuse()
+			return
+		}
+		if err != nil {
+			log.Printf("error resolving short URL %s: %v", code, err)
+			writeStoreError(w, err, "Short URL", "database error")
+			return
+		}
+
+		entry = resolveCacheEntry{
+			payload: map[string]interface{}{
+				"short_url":   urlData.ShortURL,
+				"destination": urlData.LongURL,
+				"title":       urlData.Title,
+				"description": urlData.Description,
+				"og":          urlData.OG,
+				"status":      linkStatus(urlData),
+			},
+			linkID:    urlData.ID,
+			userID:    urlData.UserID,
+			domain:    urlData.Domain,
+			expiresAt: now.Add(resolveCacheTTL),
+		}
+		// The status must not outlive the link's own expiry
+		if urlData.ExpiresAt != nil && urlData.IsActive && urlData.ExpiresAt.After(now) && urlData.ExpiresAt.Before(entry.expiresAt) {
+			entry.expiresAt = *urlData.ExpiresAt
+		}
+		// Only internal links publish their note, see link_notes.go
+		if urlData.Internal && urlData.PublicNote != "" {
+			entry.payload["public_note"] = urlData.PublicNote
+		}
+	}
+	if !verifyResolveSignature(entry.linkID, code, exp, sig) {
+		refuse()
+		return
+	}
+	// Only answers to valid signatures are kept, so unsigned probes cannot fill the cache
+	if !cached {
+		resolveCacheMutex.Lock()
+		for cachedCode, old := range resolveCache {
+			if !now.Before(old.expiresAt) {
+				delete(resolveCache, cachedCode)
+			}
+		}
+		resolveCache[code] = entry
+		resolveCacheMutex.Unlock()
+	}
+	if suspendedOwners.Has(entry.userID) {
+		http.NotFound(w, r)
+		return
+	}
+	payload := make(map[string]interface{}, len(entry.payload)+1)
+	for k, v := range entry.payload {
+		payload[k] = v
+	}
+	payload["full_short_url"] = fullShortURL(r, entry.domain, code)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("error encoding public resolve response: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// publicResolvePath resolves code as its owner and returns the signed public resolve path
+func (s *testServer) publicResolvePath(token, code string) string {
+	s.t.Helper()
+	var owned struct {
+		Sig string `json:"public_sig"`
+		Exp int64  `json:"public_sig_exp"`
+	}
+	if resp := s.do("GET", "/api/v1/resolve?code="+code, token, nil, &owned); resp.StatusCode != http.StatusOK || owned.Sig == "" {
+		s.t.Fatalf("owner resolve of %s: status %d, %+v", code, resp.StatusCode, owned)
+	}
+	return "/api/v1/resolve?" + url.Values{"code": {code}, "sig": {owned.Sig}, "exp": {strconv.FormatInt(owned.Exp, 10)}}.Encode()
+}
+
+func TestResolve(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/card", "public_note": "Owned by HR", "internal": true})
+	neighbour := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/neighbour"})
+
+	var owned map[string]interface{}
+	if resp := srv.do("GET", "/api/v1/resolve?code="+code, token, nil, &owned); resp.StatusCode != http.StatusOK ||
+		owned["destination"] != "https://example.com/card" || owned["public_note"] != "Owned by HR" {
+		t.Fatalf("owner resolve: status %d, %v", resp.StatusCode, owned)
+	}
+	for _, tt := range []struct {
+		code, token string
+		status      int
+	}{
+		{code, other, http.StatusNotFound},
+		{"missing", token, http.StatusNotFound},
+		{"no_such!", token, http.StatusBadRequest},
+		{code, "", http.StatusUnauthorized},
+	} {
+		if resp := srv.do("GET", "/api/v1/resolve?code="+tt.code, tt.token, nil, nil); resp.StatusCode != tt.status {
+			t.Errorf("owner resolve of %s: status %d, want %d", tt.code, resp.StatusCode, tt.status)
+		}
+	}
+
+	path := srv.publicResolvePath(token, code)
+	public := func(path string) (int, map[string]interface{}) {
+		t.Helper()
+		var answer map[string]interface{}
+		resp := srv.do("GET", path, "", nil, &answer)
+		return resp.StatusCode, answer
+	}
+	if status, answer := public(path); status != http.StatusOK || answer["destination"] != "https://example.com/card" || answer["public_note"] != "Owned by HR" {
+		t.Fatalf("public resolve: status %d, %v", status, answer)
+	}
+
+	// A signature is good for one link, until its expiry only
+	query, _ := url.ParseQuery(path[len("/api/v1/resolve?"):])
+	tampered := func(key, value string) string {
+		changed := url.Values{}
+		for k, v := range query {
+			changed[k] = v
+		}
+		changed.Set(key, value)
+		return "/api/v1/resolve?" + changed.Encode()
+	}
+	exp, _ := strconv.ParseInt(query.Get("exp"), 10, 64)
+	for name, path := range map[string]string{
+		"another code":   tampered("code", neighbour),
+		"a later expiry": tampered("exp", strconv.FormatInt(exp+1, 10)),
+		"no expiry":      tampered("exp", ""),
+		"a missing code": tampered("code", "missing"),
+	} {
+		if status, _ := public(path); status != http.StatusForbidden {
+			t.Errorf("signature with %s: status %d", name, status)
+		}
+	}
+	SetClock(FixedClock(clockTestBase.Add(publicResolveValidity)))
+	if status, _ := public(path); status != http.StatusForbidden {
+		t.Errorf("expired signature: status %d", status)
+	}
+	SetClock(FixedClock(clockTestBase))
+
+	// Edits and deletes reach the cached public answer at once
+	if resp := srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"long-url": "https://example.com/card-v2"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("edit: status %d", resp.StatusCode)
+	}
+	if status, answer := public(path); status != http.StatusOK || answer["destination"] != "https://example.com/card-v2" {
+		t.Errorf("after the edit: status %d, %v", status, answer)
+	}
+	if resp := srv.do("DELETE", "/url", token, map[string]string{"short_url": code}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if status, answer := public(path); status != http.StatusOK || answer["status"] != "disabled" {
+		t.Errorf("after the delete: status %d, %v", status, answer)
+	}
+
+	// Once the code is purged and taken by a new link, the old signature is worthless
+	srv.purge(code)
+	forgetResolvedLink(code)
+	if err := srv.links.InsertLink(context.Background(), &URLData{
+		ID: primitive.NewObjectID(), ShortURL: code, LongURL: "https://example.com/successor", UserID: "someone-else",
+		IsActive: true, CreatedAt: clock.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := public(path); status != http.StatusForbidden {
+		t.Errorf("signature of the purged link: status %d", status)
+	}
+}
+
+func TestResolveCacheEviction(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	first := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/first"})
+	second := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/second"})
+	cached := func(code string) bool {
+		resolveCacheMutex.RLock()
+		defer resolveCacheMutex.RUnlock()
+		_, ok := resolveCache[code]
+		return ok
+	}
+
+	if resp := srv.do("GET", srv.publicResolvePath(token, first), "", nil, nil); resp.StatusCode != http.StatusOK || !cached(first) {
+		t.Fatalf("first resolve: status %d, cached %v", resp.StatusCode, cached(first))
+	}
+	// Expired entries go when the next answer is cached
+	SetClock(FixedClock(clockTestBase.Add(resolveCacheTTL + time.Second)))
+	if resp := srv.do("GET", srv.publicResolvePath(token, second), "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("second resolve: status %d", resp.StatusCode)
+	}
+	if cached(first) || !cached(second) {
+		t.Errorf("after the TTL: first cached %v, second cached %v", cached(first), cached(second))
+	}
+}
+
+// TestResolveCacheFollowsLinkState checks that the cached public answer never outlives the
+// link's expiry or an admin disabling it
+func TestResolveCacheFollowsLinkState(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, _ := srv.register()
+	expiring := srv.shorten(token, map[string]interface{}{
+		"long-url": "https://example.com/flash-sale", "expires": clockTestBase.Add(resolveCacheTTL / 2).Format(time.RFC3339),
+	})
+	disabled := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/offline"})
+	status := func(path string) interface{} {
+		t.Helper()
+		var answer map[string]interface{}
+		if resp := srv.do("GET", path, "", nil, &answer); resp.StatusCode != http.StatusOK {
+			t.Fatalf("public resolve: status %d", resp.StatusCode)
+		}
+		return answer["status"]
+	}
+
+	expiringPath, disabledPath := srv.publicResolvePath(token, expiring), srv.publicResolvePath(token, disabled)
+	if got := status(expiringPath); got != "active" {
+		t.Fatalf("before expiry: status %v", got)
+	}
+	SetClock(FixedClock(clockTestBase.Add(resolveCacheTTL/2 + time.Second)))
+	if got := status(expiringPath); got != "expired" {
+		t.Errorf("after expiry, within the cache TTL: status %v", got)
+	}
+
+	if got := status(disabledPath); got != "active" {
+		t.Fatalf("before the admin disabled it: status %v", got)
+	}
+	if resp := srv.do("POST", "/admin/urls/"+disabled+"/disable", admin, map[string]string{"reason": "phishing"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin disable: status %d", resp.StatusCode)
+	}
+	if got := status(disabledPath); got != "disabled" {
+		t.Errorf("after the admin disabled it: status %v", got)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// LIVE CONFIGURATION
+// ============================================================================
+//
+// The dynamic part of the configuration is read from the JSON file named by CONFIG_FILE and
+// can change without a restart (a restart also generates a new JWT secret when none is set):
+//
+//	{
+//	  "blocked_domains": ["evil.example"],
+//	  "warn_domains": ["tracker.example"],
+//	  "rate_limits": {"global": {"limit": 100, "window": "1m"}},
+//	  "features": {"redirect_probe": {"percentage": 10}},
+//	  "disposable_domains": ["mailinator.example"],
+//	  "retention": {"security_events": {"max_age": "1y"}}
+//	}
+//
+// Shorten and bulk refuse destinations on blocked_domains and accept those on warn_domains
+// with a DESTINATION_WARNED warning; both match the domain and its subdomains.
+// disposable_domains are checked at registration in addition to the disposable email list.
+// retention overrides the maintenance policies of collection_maintenance.go.
+// Rate-limit policies and feature flags (see feature_flags.go) not in the file keep their
+// built-in defaults and environment variables. The file is reloaded when it changes on disk, on SIGHUP and by
+// POST /admin/reload. Each reload builds a complete snapshot and swaps it in at once; a
+// request uses the snapshot that was current when it arrived, so a reload never changes the
+// rules halfway through one. A file that does not parse or validate keeps the current
+// snapshot. Static settings (database, secrets, URLs) are never reloaded: setting one in the
+// file only logs that it needs a restart.
+
+const configWatchInterval = 5 * time.Second
+
+// rateLimitPolicy is a named request budget for checkRateLimit
+type rateLimitPolicy struct {
+	Limit  int           `json:"limit"`
+	Window time.Duration `json:"window"`
+}
+
+// defaultRateLimitPolicies are the budgets used unless CONFIG_FILE overrides them
+var defaultRateLimitPolicies = map[string]rateLimitPolicy{
+	"global":       {Limit: 100, Window: time.Minute},
+	"resolve":      {Limit: publicResolveRateLimit, Window: publicResolveRateWindow},
+	"public_stats": {Limit: publicStatsRateLimit, Window: publicStatsRateWindow},
+	"report":       {Limit: abuseReportRateLimit, Window: abuseReportRateWindow},
+	"bulk_source":  {Limit: bulkSourceRateLimit, Window: bulkSourceRateWindow},
+	"reactivate":   {Limit: 10, Window: time.Hour},
+	"public_share": {Limit: publicShareRateLimit, Window: publicShareRateWindow},
+	"recount":      {Limit: recountRateLimit, Window: recountRateWindow},
+}
+
+// staticConfigKeys are settings only read at startup, with the environment variable behind each
+var staticConfigKeys = map[string]string{
+	"mongodb_uri":       "MONGODB_URI",
+	"mongodb_database":  "MONGODB_DATABASE",
+	"database_dsn":      "DATABASE_DSN",
+	"storage_backend":   "STORAGE_BACKEND",
+	"jwt_secret":        "JWT_SECRET",
+	"encryption_key":    "ENCRYPTION_KEY",
+	"base_url":          "BASE_URL",
+	"short_path_prefix": "SHORT_PATH_PREFIX",
+	"allowed_origins":   "ALLOWED_ORIGINS",
+}
+
+// configFile is the JSON shape of CONFIG_FILE
+type configFile struct {
+	BlockedDomains []string `json:"blocked_domains"`
+	WarnDomains    []string `json:"warn_domains"`
+	RateLimits     map[string]struct {
+		Limit  int    `json:"limit"`
+		Window string `json:"window"`
+	} `json:"rate_limits"`
+	Features          map[string]featureRule       `json:"features"`
+	DisposableDomains []string                     `json:"disposable_domains"`
+	Retention         map[string]retentionOverride `json:"retention"`
+}
+
+// runtimeConfig is one immutable snapshot of the dynamic configuration
+type runtimeConfig struct {
+	blockedDomains    map[string]bool
+	warnDomains       map[string]bool
+	rateLimits        map[string]rateLimitPolicy
+	features          map[string]featureRule
+	disposableDomains []string
+	// retention is nil for the default policies, see collection_maintenance.go
+	retention []retentionPolicy
+
+	source   string
+	loadedAt time.Time
+}
+
+var (
+	liveConfigPointer atomic.Pointer[runtimeConfig]
+	// configReloadMutex serializes reloads so two of them never interleave their side effects
+	configReloadMutex sync.Mutex
+	configFileStamp   string
+)
+
+// liveConfig returns the current snapshot
+func liveConfig() *runtimeConfig {
+	if cfg := liveConfigPointer.Load(); cfg != nil {
+		return cfg
+	}
+	return &runtimeConfig{}
+}
+
+// requestConfig returns the snapshot r started with (pinned by requestIDMiddleware), or the
+// current one
+func requestConfig(r *http.Request) *runtimeConfig {
+	if cfg := requestInfoFrom(r.Context()).Config; cfg != nil {
+		return cfg
+	}
+	return liveConfig()
+}
+
+// normalizeDomainList lowercases domains and checks they are plain host names
+func normalizeDomainList(field string, domains []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.TrimLeft(strings.ToLower(strings.TrimSpace(domain)), "."), ".")
+		if domain == "" || !forwardedHostPattern.MatchString(domain) || strings.Contains(domain, ":") {
+			return nil, fmt.Errorf("%s: %q is not a domain", field, domain)
+		}
+		set[domain] = true
+	}
+	return set, nil
+}
+
+// parseRuntimeConfig validates raw and builds a snapshot from it
+func parseRuntimeConfig(raw []byte, source string) (*runtimeConfig, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %v", err)
+	}
+	dynamic := map[string]bool{"blocked_domains": true, "warn_domains": true, "rate_limits": true,
+		"features": true, "disposable_domains": true, "retention": true}
+	for key := range keys {
+		if env, ok := staticConfigKeys[key]; ok {
+			var value string
+			if err := json.Unmarshal(keys[key], &value); err != nil || value != os.Getenv(env) {
+				log.Printf("⚠️  CONFIG_FILE sets %s, which only takes effect after a restart (through %s)", key, env)
+			}
+		} else if !dynamic[key] {
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	var file configFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, err
+	}
+
+	cfg := &runtimeConfig{
+		rateLimits: make(map[string]rateLimitPolicy, len(defaultRateLimitPolicies)),
+		features:   make(map[string]featureRule, len(file.Features)),
+		source:     source,
+		loadedAt:   clock.Now(),
+	}
+	var err error
+	if cfg.blockedDomains, err = normalizeDomainList("blocked_domains", file.BlockedDomains); err != nil {
+		return nil, err
+	}
+	if cfg.warnDomains, err = normalizeDomainList("warn_domains", file.WarnDomains); err != nil {
+		return nil, err
+	}
+	disposable, err := normalizeDomainList("disposable_domains", file.DisposableDomains)
+	if err != nil {
+		return nil, err
+	}
+	for domain := range disposable {
+		cfg.disposableDomains = append(cfg.disposableDomains, domain)
+	}
+	sort.Strings(cfg.disposableDomains)
+
+	for name, policy := range defaultRateLimitPolicies {
+		cfg.rateLimits[name] = policy
+	}
+	for name, policy := range file.RateLimits {
+		if _, ok := defaultRateLimitPolicies[name]; !ok {
+			return nil, fmt.Errorf("rate_limits: unknown policy %q", name)
+		}
+		window, err := time.ParseDuration(policy.Window)
+		if err != nil || window < time.Second || policy.Limit < 1 {
+			return nil, fmt.Errorf("rate_limits.%s needs a limit of at least 1 and a window of at least 1s", name)
+		}
+		cfg.rateLimits[name] = rateLimitPolicy{Limit: policy.Limit, Window: window}
+	}
+	for name, rule := range file.Features {
+		if _, ok := featureFlagsByName[name]; !ok {
+			return nil, fmt.Errorf("features: unknown flag %q", name)
+		}
+		cfg.features[name] = rule
+	}
+	if file.Retention != nil {
+		if cfg.retention, err = parseRetentionPolicies(file.Retention); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// reloadRuntimeConfig reads CONFIG_FILE again and swaps in the new snapshot, then reloads the
+// disposable email list with it; on error the current snapshot stays
+func reloadRuntimeConfig(trigger string) (*runtimeConfig, error) {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+
+	cfg := &runtimeConfig{rateLimits: defaultRateLimitPolicies, source: "defaults", loadedAt: clock.Now()}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			incMetric("config_reload_failures_total", 1)
+			return nil, fmt.Errorf("CONFIG_FILE: %v", err)
+		}
+		if cfg, err = parseRuntimeConfig(raw, path); err != nil {
+			incMetric("config_reload_failures_total", 1)
+			return nil, fmt.Errorf("CONFIG_FILE %s: %v", path, err)
+		}
+		configFileStamp = fileStamp(path)
+	}
+	liveConfigPointer.Store(cfg)
+	incMetric("config_reloads_total", 1)
+
+	// At startup InitDisposableEmail loads the list afterwards
+	if trigger != "startup" && disposableEmailMode != DisposableEmailOff {
+		if _, err := disposableDomains.Reload(); err != nil {
+			log.Printf("⚠️  Disposable email domains not reloaded: %v", err)
+		}
+	}
+	log.Printf("🔄 Configuration loaded from %s (%s): %d blocked, %d warned domains, %d feature flags",
+		cfg.source, trigger, len(cfg.blockedDomains), len(cfg.warnDomains), len(cfg.features))
+	return cfg, nil
+}
+
+// fileStamp identifies the version of a file on disk by its size and modification time
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// InitRuntimeConfig loads CONFIG_FILE and reloads it on SIGHUP and whenever it changes
+func InitRuntimeConfig() error {
+	if _, err := reloadRuntimeConfig("startup"); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := reloadRuntimeConfig("SIGHUP"); err != nil {
+				log.Printf("⚠️  Configuration not reloaded: %v", err)
+			}
+		}
+	}()
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			configReloadMutex.Lock()
+			changed := fileStamp(path) != configFileStamp
+			configReloadMutex.Unlock()
+			if !changed {
+				continue
+			}
+			if _, err := reloadRuntimeConfig("file changed"); err != nil {
+				log.Printf("⚠️  Configuration not reloaded: %v", err)
+				// Do not retry the same broken version every tick
+				configReloadMutex.Lock()
+				configFileStamp = fileStamp(path)
+				configReloadMutex.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// RateLimit returns the named policy
+func (c *runtimeConfig) RateLimit(name string) rateLimitPolicy {
+	if policy, ok := c.rateLimits[name]; ok {
+		return policy
+	}
+	return defaultRateLimitPolicies[name]
+}
+
+// DestinationListed returns "block" or "warn" when the host of rawURL, or a parent domain of
+// it, is on the block or warn list, and "" otherwise
+func (c *runtimeConfig) DestinationListed(rawURL string) string {
+	if len(c.blockedDomains) == 0 && len(c.warnDomains) == 0 {
+		return ""
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	for host != "" {
+		if c.blockedDomains[host] {
+			return "block"
+		}
+		if c.warnDomains[host] {
+			return "warn"
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			break
+		}
+		host = parent
+	}
+	return ""
+}
+
+// destinationWarnedWarning notes that a new link points at a warn-listed domain
+func destinationWarnedWarning() Warning {
+	return Warning{
+		Code:    WarnDestinationWarned,
+		Message: "The destination is on this service's warn list; the link was created but may be reviewed",
+	}
+}
+
+// adminReloadConfig handles POST /admin/reload
+func adminReloadConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, err := reloadRuntimeConfig("POST /admin/reload")
+	if err != nil {
+		log.Printf("error reloading configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	adminID, _ := r.Context().Value("user_id").(string)
+	logSecurityEvent(r.Context(), "CONFIG_RELOADED", adminID, getClientIP(r), r.UserAgent(),
+		"Configuration reloaded from "+cfg.source, "INFO")
+
+	policies := make(map[string]map[string]interface{}, len(cfg.rateLimits))
+	for name, policy := range cfg.rateLimits {
+		policies[name] = map[string]interface{}{"limit": policy.Limit, "window": policy.Window.String()}
+	}
+	features := make(map[string]featureRule, len(cfg.features))
+	for name, rule := range cfg.features {
+		features[name] = rule
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":            true,
+		"source":             cfg.source,
+		"loaded_at":          cfg.loadedAt,
+		"blocked_domains":    len(cfg.blockedDomains),
+		"warn_domains":       len(cfg.warnDomains),
+		"disposable_domains": len(cfg.disposableDomains),
+		"rate_limits":        policies,
+		"features":           features,
+	}); err != nil {
+		log.Printf("error encoding reload response: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// withConfigFile points CONFIG_FILE at a temporary file and returns a function that writes
+// it; the snapshot in force before the test is restored afterwards
+func withConfigFile(t *testing.T) func(content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("CONFIG_FILE", path)
+	saved := liveConfigPointer.Load()
+	t.Cleanup(func() { liveConfigPointer.Store(saved) })
+	return func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdminReloadConfig(t *testing.T) {
+	write := withConfigFile(t)
+	write(`{}`)
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, _ := srv.register()
+
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://cdn.evil.example/a"}, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("before the reload: status %d", resp.StatusCode)
+	}
+	write(`{
+		"blocked_domains": ["Evil.Example."],
+		"warn_domains": ["tracker.example"],
+		"rate_limits": {"report": {"limit": 2, "window": "1m"}},
+		"jwt_secret": "changed"
+	}`)
+	var reloaded struct {
+		BlockedDomains int `json:"blocked_domains"`
+		RateLimits     map[string]struct {
+			Limit  int    `json:"limit"`
+			Window string `json:"window"`
+		} `json:"rate_limits"`
+	}
+	if resp := srv.do("POST", "/admin/reload", admin, map[string]string{}, &reloaded); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload: status %d", resp.StatusCode)
+	}
+	if reloaded.BlockedDomains != 1 || reloaded.RateLimits["report"].Limit != 2 || reloaded.RateLimits["global"].Limit != 100 {
+		t.Fatalf("reloaded %+v", reloaded)
+	}
+	if !logs.waitFor("jwt_secret, which only takes effect after a restart") {
+		t.Fatal("static setting not reported")
+	}
+
+	// The very next request follows the new lists, subdomains included
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://cdn.evil.example/b"}, &refused)
+	if resp.StatusCode != http.StatusUnprocessableEntity || refused.Error.Code != ErrCodeDestinationBlocked {
+		t.Fatalf("blocked destination: status %d, code %q", resp.StatusCode, refused.Error.Code)
+	}
+	var warned URLData
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://tracker.example/c"}, &warned); resp.StatusCode != http.StatusCreated || !hasWarning(warned.Warnings, WarnDestinationWarned) {
+		t.Fatalf("warned destination: status %d, warnings %v", resp.StatusCode, warningCodes(warned.Warnings))
+	}
+
+	// A file that does not validate keeps the rules in force
+	for _, broken := range []string{
+		`{"blocked_domains": [`,
+		`{"blocked_domain": ["typo.example"]}`,
+		`{"blocked_domains": ["not a domain"]}`,
+		`{"rate_limits": {"global": {"limit": 0, "window": "1m"}}}`,
+		`{"rate_limits": {"nope": {"limit": 5, "window": "1m"}}}`,
+		`{"features": {"nope": {"enabled": true}}}`,
+	} {
+		write(broken)
+		if resp := srv.do("POST", "/admin/reload", admin, map[string]string{}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("reload of %s: status %d", broken, resp.StatusCode)
+		}
+	}
+	if liveConfig().DestinationListed("https://evil.example/") != "block" {
+		t.Fatal("a rejected file replaced the snapshot")
+	}
+	if resp := srv.do("POST", "/admin/reload", token, map[string]string{}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("reload by a user: status %d", resp.StatusCode)
+	}
+}
+
+func TestConfigReloadKeepsInFlightRequests(t *testing.T) {
+	write := withConfigFile(t)
+	write(`{"rate_limits": {"global": {"limit": 50, "window": "1m"}}}`)
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request answers with the global limit it saw when it began and again when it ends
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := requestConfig(r).RateLimit("global").Limit
+		if r.URL.Path == "/held" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(strconv.Itoa(first) + "/" + strconv.Itoa(requestConfig(r).RateLimit("global").Limit)))
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	const inFlight = 5
+	var wg sync.WaitGroup
+	answers := make(chan *httptest.ResponseRecorder, inFlight)
+	for i := 0; i < inFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers <- serve("/held")
+		}()
+	}
+	for i := 0; i < inFlight; i++ {
+		<-started
+	}
+
+	write(`{"rate_limits": {"global": {"limit": 7, "window": "1m"}}}`)
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve("/next").Body.String(); got != "7/7" {
+		t.Fatalf("request after the reload saw %s", got)
+	}
+	close(release)
+	wg.Wait()
+	close(answers)
+	n := 0
+	for rec := range answers {
+		n++
+		if rec.Code != http.StatusOK || rec.Body.String() != "50/50" {
+			t.Errorf("in-flight request: status %d, saw %s", rec.Code, rec.Body.String())
+		}
+	}
+	if n != inFlight {
+		t.Fatalf("%d of %d in-flight requests answered", n, inFlight)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// MINIMAL S3 CLIENT (SIGV4)
+// ============================================================================
+
+// s3Client uploads and downloads objects using AWS Signature Version 4 with
+// credentials from the standard AWS_* environment variables
+type s3Client struct {
+	bucket    string
+	region    string
+	endpoint  string // optional, for S3-compatible stores (path-style addressing)
+	accessKey string
+	secretKey string
+	session   string
+	http      *http.Client
+}
+
+// newS3ClientFromEnv builds a client for bucket from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION and the optional S3_ENDPOINT
+func newS3ClientFromEnv(bucket string) (*s3Client, error) {
+	c := &s3Client{
+		bucket:    bucket,
+		region:    os.Getenv("AWS_REGION"),
+		endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		session:   os.Getenv("AWS_SESSION_TOKEN"),
+		http:      newOutboundClient(outboundOptions{timeout: 30 * time.Minute, maxBytes: -1}),
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for S3 backups")
+	}
+	return c, nil
+}
+
+// objectURL returns the request URL for key
+func (c *s3Client) objectURL(key string) *url.URL {
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+	if c.endpoint != "" {
+		u, _ := url.Parse(c.endpoint + "/" + c.bucket + escaped)
+		return u
+	}
+	u, _ := url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", c.bucket, c.region, escaped))
+	return u
+}
+
+// PutObject uploads size bytes from body; payloadSHA256 is the hex digest of the body
+func (c *s3Client) PutObject(key string, body io.Reader, size int64, payloadSHA256 string) error {
+	req, err := http.NewRequest(http.MethodPut, c.objectURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/gzip")
+	c.sign(req, payloadSHA256)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// GetObject opens key for streaming; the caller must close the returned body
+func (c *s3Client) GetObject(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, "UNSIGNED-PAYLOAD")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 download failed with status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// sign adds SigV4 authentication headers to req
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.session != "" {
+		req.Header.Set("X-Amz-Security-Token", c.session)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if c.session != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := dateStamp + "/" + c.region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// STORED SECURITY EVENTS (ADMIN)
+// ============================================================================
+
+const (
+	securityEventsDefaultLimit = 100
+	securityEventsMaxLimit     = 500
+)
+
+// adminSecurityEvents handles GET /admin/security-events. Events are only stored with
+// SECURITY_LOG_ENABLED=true. Filters: request_id (from X-Request-ID or an access log line),
+// user_id and event; newest first.
+func adminSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := bson.D{}
+	for _, field := range []string{"request_id", "user_id", "event"} {
+		if value := sanitizeInput(query.Get(field)); value != "" {
+			filter = append(filter, bson.E{Key: field, Value: value})
+		}
+	}
+	limit := securityEventsDefaultLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > securityEventsMaxLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(securityEventsMaxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := DB.Database.Collection("security_events").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		log.Printf("error listing security events: %v", err)
+		http.Error(w, "Failed to list security events", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	events := []SecurityEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		log.Printf("error decoding security events: %v", err)
+		http.Error(w, "Failed to list security events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"events":  events,
+		"count":   len(events),
+		"stored":  securityEventStoreEnabled(),
+	}); err != nil {
+		log.Printf("error encoding security events response: %v", err)
+	}
+}
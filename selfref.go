@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ============================================================================
+// SELF-REFERENCE AND REDIRECT LOOP PROTECTION
+// ============================================================================
+
+var (
+	errSelfReference = errors.New("destination points at the shortener itself")
+	errRedirectLoop  = errors.New("destination points back at this short link")
+	errShortLinkHop  = errors.New("destination is another short link; set resolve_chain to store its final destination instead")
+	errChainTooDeep  = errors.New("destination is a chain of short links; only one level can be resolved")
+)
+
+// shortenerHosts returns the lowercased hosts that serve this deployment's short links
+func shortenerHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, raw := range append([]string{baseURL()}, DefaultDomains...) {
+		if parsed, err := url.Parse(raw); err == nil && parsed.Host != "" {
+			hosts[strings.ToLower(parsed.Host)] = true
+		}
+	}
+	return hosts
+}
+
+// shortenerPath returns the path of destination when it is served by this deployment, with
+// the short link prefix removed. With a prefix, other pages of the host belong to the website
+// unless they are API routes.
+func shortenerPath(destination string) (string, bool) {
+	parsed, err := url.Parse(destination)
+	if err != nil || !shortenerHosts()[strings.ToLower(parsed.Host)] {
+		return "", false
+	}
+	if code, ok := codeFromPath(parsed.Path); ok {
+		return strings.Trim(code, "/"), true
+	}
+	path := strings.Trim(parsed.Path, "/")
+	if first, _, _ := strings.Cut(path, "/"); path == "" || isReservedCode(first) {
+		return path, true
+	}
+	return "", false
+}
+
+// checkSelfReference validates a destination that may point at this shortener. Links to the
+// shortener's root, API paths or the link's own code are rejected. A link to another short
+// link is rejected unless resolveChain is set, in which case the other link's destination is
+// returned to be stored instead, as long as that one is not a short link too.
+func checkSelfReference(ctx context.Context, urls URLStore, destination, ownCode string, resolveChain bool) (string, error) {
+	path, ours := shortenerPath(destination)
+	if !ours {
+		return destination, nil
+	}
+	if path == "" || strings.Contains(path, "/") || isReservedCode(path) {
+		return "", errSelfReference
+	}
+	if ownCode != "" && path == ownCode {
+		return "", errRedirectLoop
+	}
+
+	target, err := urls.FindLinkByCode(ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		// Unknown codes on our host would 404 or be claimed later; neither is a valid target
+		return "", errSelfReference
+	} else if err != nil {
+		return "", fmt.Errorf("checking short link target: %w", err)
+	}
+	if !resolveChain {
+		return "", errShortLinkHop
+	}
+	if _, nested := shortenerPath(target.LongURL); nested {
+		return "", errChainTooDeep
+	}
+	return target.LongURL, nil
+}
+
+// isSelfRedirect reports whether destination is the URL of the request being served
+func isSelfRedirect(r *http.Request, destination string) bool {
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, r.Host) &&
+		strings.Trim(parsed.Path, "/") == strings.Trim(r.URL.Path, "/")
+}
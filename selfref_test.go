@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckSelfReference(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	base := baseURL()
+	for _, link := range []*URLData{
+		{ShortURL: "target", LongURL: "https://example.com/final", UserID: "u", IsActive: true},
+		{ShortURL: "hop", LongURL: base + "/target", UserID: "u", IsActive: true},
+	} {
+		if err := store.InsertLink(ctx, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		destination  string
+		ownCode      string
+		resolveChain bool
+		want         string
+		err          error
+	}{
+		{"external", "https://example.com/page", "", false, "https://example.com/page", nil},
+		{"shortener root", base, "", false, "", errSelfReference},
+		{"shortener root with slash", base + "/", "", false, "", errSelfReference},
+		{"api path", base + "/url", "", false, "", errSelfReference},
+		{"nested api path", base + "/auth/login", "", false, "", errSelfReference},
+		{"analytics api", base + "/analytics?page=2", "", false, "", errSelfReference},
+		{"other serving domain", "http://rapidlink.com/analytics", "", false, "", errSelfReference},
+		{"host case", "HTTPS://GO.EXAMPLE.COM/url", "", false, "", errSelfReference},
+		{"unknown code", base + "/nothing", "", false, "", errSelfReference},
+		{"own code", base + "/mine", "mine", false, "", errRedirectLoop},
+		{"own code on another serving domain", "http://rapidlink.com/mine", "mine", true, "", errRedirectLoop},
+		{"short link without consent", base + "/target", "", false, "", errShortLinkHop},
+		{"one-level chain resolved", base + "/target", "", true, "https://example.com/final", nil},
+		{"two-level chain", base + "/hop", "", true, "", errChainTooDeep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkSelfReference(ctx, store, tt.destination, tt.ownCode, tt.resolveChain)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("checkSelfReference(%q) = %q, %v; want %q, %v", tt.destination, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestShortenRefusesLoops(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	base := baseURL()
+	target := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/final"})
+
+	for _, body := range []map[string]interface{}{
+		{"long-url": base + "/auth/register"},
+		{"long-url": base + "/loop", "custom": "loop"},
+		{"long-url": base + "/" + target},
+	} {
+		if resp := srv.do("PUT", "/url", token, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	// With consent, a one-level chain stores the final destination
+	var chained URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": base + "/" + target, "resolve_chain": true}, &chained)
+	if chained.LongURL != "https://example.com/final" {
+		t.Fatalf("chained link stores %q", chained.LongURL)
+	}
+
+	// Editing a link to point at itself or at a short link is refused as on creation
+	for _, destination := range []string{base + "/" + chained.ShortURL, base + "/" + target} {
+		resp := srv.do("PATCH", "/url/"+chained.ShortURL, token, map[string]interface{}{"long-url": destination}, nil)
+		if resp.StatusCode < 400 {
+			t.Errorf("edit to %s: status %d", destination, resp.StatusCode)
+		}
+	}
+}
+
+func TestRedirectNeverPointsAtItself(t *testing.T) {
+	srv := newTestServer(t)
+	// Stored links are validated on creation; this one bypasses that, as data from before the
+	// checks existed would
+	now := time.Now()
+	loop := &URLData{ShortURL: "selfloop", LongURL: srv.URL + "/selfloop/", UserID: "u", IsActive: true, CreatedAt: now, UpdatedAt: &now}
+	if err := srv.links.InsertLink(context.Background(), loop); err != nil {
+		t.Fatal(err)
+	}
+	resp := srv.do("GET", "/selfloop", "", nil, nil)
+	if resp.StatusCode != http.StatusLoopDetected || resp.Header.Get("Location") != "" {
+		t.Fatalf("self redirect: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The handler tests run NewServer against the in-memory store, initialized the way main
+// does for STORAGE_BACKEND=memory but without the background workers.
+// TEST_STORAGE_BACKEND=sqlite with -tags sqlite runs them against SQLite instead.
+func TestMain(m *testing.M) {
+	backend := os.Getenv("TEST_STORAGE_BACKEND")
+	if backend == "" {
+		backend = "memory"
+	}
+	os.Setenv("STORAGE_BACKEND", backend)
+	os.Setenv("BASE_URL", "https://go.example.com")
+	os.Setenv("JWT_SECRET", "handler-tests-secret-0123456789abcdefghijklmnop")
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	for _, init := range []func() error{
+		InitBaseURL, InitShortPathPrefix, InitDeprecations, InitOutboundHTTP, InitEncryption,
+		InitCatalogs, InitLoadShedding, InitClickSink, InitGeoRestrictions, InitCookieAuth,
+		InitRuntimeConfig, InitDisposableEmail, InitClickSpikes,
+	} {
+		if err := init(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	InitStaticAssets()
+	InitCaptcha()
+	InitJWT()
+	os.Exit(m.Run())
+}
+
+// testServer is NewServer running on a fresh store of the backend under test
+type testServer struct {
+	*httptest.Server
+	links URLStore
+	store *memoryStore // nil unless the backend is memory
+	sql   *sqlStore    // nil unless the backend is SQL
+	t     *testing.T
+}
+
+// newTestServer points Users and Links at a new store for the duration of the test
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	var users UserStore
+	var links URLStore
+	var memory *memoryStore
+	var sqlBacked *sqlStore
+	switch storageBackend() {
+	case "memory":
+		memory = newMemoryStore()
+		users, links = memory, memory
+	case "sqlite":
+		t.Setenv("DATABASE_DSN", "file:"+filepath.Join(t.TempDir(), "rapidlink.db"))
+		store, err := openSQLStore("sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.db.Close() })
+		users, links, sqlBacked = store, store, store
+	default:
+		t.Fatalf("unsupported TEST_STORAGE_BACKEND %s", storageBackend())
+	}
+	// Every test server's requests come from 127.0.0.1, so each test starts with no rate limit history
+	rateLimitMutex.Lock()
+	ipRateLimits = make(map[string]*RateLimitInfo)
+	rateLimitMutex.Unlock()
+	// Whatever earlier tests queued is written to their stores before these replace them
+	drainWorkers(t)
+	savedUsers, savedLinks := Users, Links
+	Users, Links = users, links
+	srv := httptest.NewServer(NewServer().Handler)
+	t.Cleanup(func() {
+		srv.Close()
+		drainWorkers(t)
+		Users, Links = savedUsers, savedLinks
+	})
+	return &testServer{Server: srv, links: links, store: memory, sql: sqlBacked, t: t}
+}
+
+// memory returns the memory store for tests that look inside it, skipping on other backends
+func (s *testServer) memory() *memoryStore {
+	s.t.Helper()
+	if s.store == nil {
+		s.t.Skipf("inspects the memory store; backend is %s", storageBackend())
+	}
+	return s.store
+}
+
+// drainClicks waits until the click queue has been written to the store
+func drainClicks(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clicks.Drain(ctx)
+}
+
+// drainWorkers waits until the background workers have written everything queued so far:
+// clicks, API usage and favicons
+func drainWorkers(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clicks.Drain(ctx)
+	apiUsage.Drain(ctx)
+	favicons.Drain(ctx)
+}
+
+var testUserSeq int64
+
+// register creates a new account and returns its access token and user ID
+func (s *testServer) register() (token, userID string) {
+	s.t.Helper()
+	// Usernames are letters only, so the sequence number is spelled with a-j
+	name := "tester-" + strings.Map(func(r rune) rune { return r - '0' + 'a' }, strconv.FormatInt(atomic.AddInt64(&testUserSeq, 1), 10))
+	var auth struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+	}
+	resp := s.do("POST", "/auth/register", "", map[string]string{
+		"username": name, "email": name + "@example.com", "password": "correct-horse-1",
+	}, &auth)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		s.t.Fatalf("register %s: status %d: %s", name, resp.StatusCode, raw)
+	}
+	return auth.Token, auth.User.ID.Hex()
+}
+
+// registerAdmin creates an account with the admin role and returns its access token and user ID
+func (s *testServer) registerAdmin() (token, userID string) {
+	s.t.Helper()
+	token, userID = s.register()
+	s.setRole(userID, RoleAdmin)
+	return token, userID
+}
+
+// setRole gives the account role straight in the store; no endpoint changes roles
+func (s *testServer) setRole(userID, role string) {
+	s.t.Helper()
+	id, _ := primitive.ObjectIDFromHex(userID)
+	if s.store != nil {
+		s.store.mu.Lock()
+		s.store.users[id].Role = role
+		s.store.mu.Unlock()
+		return
+	}
+	if _, err := s.sql.exec(context.Background(), `UPDATE users SET role = ? WHERE id = ?`, role, id.Hex()); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// stored reads code back from the store
+func (s *testServer) stored(code string) *URLData {
+	s.t.Helper()
+	link, err := s.links.FindLinkByCode(context.Background(), code)
+	if err != nil {
+		s.t.Fatalf("stored %s: %v", code, err)
+	}
+	return link
+}
+
+// addClicks records clicks on code straight in the store, without a redirect or the click queue
+func (s *testServer) addClicks(code string, clicks ...ClickHistory) {
+	s.t.Helper()
+	link := s.stored(code)
+	for _, click := range clicks {
+		if err := s.links.RecordClick(context.Background(), link, click); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+// clickEvents returns the click events stored for code in the order they were recorded
+func (s *testServer) clickEvents(code string) []ClickHistory {
+	s.t.Helper()
+	if s.store != nil {
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+		return append([]ClickHistory(nil), s.store.links[code].ClickHistory...)
+	}
+	rows, err := s.sql.query(context.Background(), `SELECT c.clicked_at, c.ip, c.user_agent, c.branch, c.signed, c.referrer_host
+		FROM clicks c JOIN urls u ON u.id = c.url_id WHERE u.short_url = ? ORDER BY c.clicked_at, c.id`, code)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer rows.Close()
+	var events []ClickHistory
+	for rows.Next() {
+		var click ClickHistory
+		var clickedAt int64
+		if err := rows.Scan(&clickedAt, &click.IP, &click.UserAgent, &click.Branch, &click.Signed, &click.ReferrerHost); err != nil {
+			s.t.Fatal(err)
+		}
+		click.Timestamp = time.Unix(0, clickedAt).UTC()
+		events = append(events, click)
+	}
+	if err := rows.Err(); err != nil {
+		s.t.Fatal(err)
+	}
+	return events
+}
+
+// editStored applies edit to code straight in the store, skipping the checks of PATCH
+func (s *testServer) editStored(code string, edit LinkEdit) {
+	s.t.Helper()
+	if _, err := s.links.EditLink(context.Background(), s.stored(code), edit); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// purge deletes code and everything recorded about it, as if it had never been stored
+func (s *testServer) purge(code string) {
+	s.t.Helper()
+	if s.store != nil {
+		s.store.mu.Lock()
+		delete(s.store.links, code)
+		s.store.mu.Unlock()
+		return
+	}
+	id := s.stored(code).ID.Hex()
+	for _, table := range []string{"clicks", "url_tags", "share_events", "daily_clicks", "link_outcomes"} {
+		if _, err := s.sql.exec(context.Background(), `DELETE FROM `+table+` WHERE url_id = ?`, id); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	if _, err := s.sql.exec(context.Background(), `DELETE FROM urls WHERE id = ?`, id); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// serveFrom sends req straight to the server's handler as if it came from remoteAddr
+func (s *testServer) serveFrom(remoteAddr string, req *http.Request) *httptest.ResponseRecorder {
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	s.Config.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// do sends a JSON request with an optional bearer token and decodes the JSON answer into out
+func (s *testServer) do(method, path, token string, body, out interface{}) *http.Response {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		reader = jsonBody(s.t, body)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.send(req, out)
+}
+
+// jsonBody encodes body for a request
+func jsonBody(t *testing.T, body interface{}) io.Reader {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(encoded)
+}
+
+// send performs req without following redirects and decodes a JSON answer into out
+func (s *testServer) send(req *http.Request, out interface{}) *http.Response {
+	s.t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	if out != nil && len(raw) > 0 && json.Valid(raw) {
+		if err := json.Unmarshal(raw, out); err != nil {
+			s.t.Fatalf("%s %s: decoding %s: %v", req.Method, req.URL.Path, raw, err)
+		}
+	}
+	return resp
+}
+
+// shorten creates a short link through PUT /url and returns its code
+func (s *testServer) shorten(token string, body map[string]interface{}) string {
+	s.t.Helper()
+	var link URLData
+	resp := s.do("PUT", "/url", token, body, &link)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		s.t.Fatalf("shorten %v: status %d: %s", body, resp.StatusCode, raw)
+	}
+	return link.ShortURL
+}
+
+// readBody returns the body of a response from send
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// logCapture collects what the standard logger writes during a test
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func captureLog(t *testing.T) *logCapture {
+	c := &logCapture{}
+	saved := log.Writer()
+	log.SetOutput(c)
+	t.Cleanup(func() { log.SetOutput(saved) })
+	return c
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+func (c *logCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// waitFor polls until the log contains s; security events are logged from a goroutine
+func (c *logCapture) waitFor(s string) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if strings.Contains(c.String(), s) {
+			return true
+		}
+	}
+	return false
+}
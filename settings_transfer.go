@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// SETTINGS EXPORT / IMPORT
+// ============================================================================
+//
+// GET /auth/settings/export returns the account's configuration as one versioned JSON
+// document: tag rules, the unclicked-link expiry policy, the time zone and the folder tree
+// (as "Parent/Child" paths, without links). POST /auth/settings/import applies such a
+// document to the signed-in account, for moving between accounts or environments. Import is
+// idempotent: tag rules are matched by host suffix, folders by path (ignoring case), and
+// what is already there is skipped, so each section reports created, updated and skipped
+// counts. Nothing is deleted. The document is validated as a whole before anything is saved.
+// Webhooks, custom domains, branding and notification preferences are not per-account
+// settings in this service; sections with those names are refused and reported as such.
+// The export holds no secrets.
+
+// settingsSchemaVersion is the version of the export document; import refuses newer ones
+const settingsSchemaVersion = 1
+
+// unsupportedSettingsSections are sections other tools may export that have no per-account
+// counterpart here
+var unsupportedSettingsSections = []string{"webhooks", "domains", "branding", "notification_preferences"}
+
+// SettingsExport is the export document
+type SettingsExport struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	TagRules   []TagRule       `json:"tag_rules"`
+	LinkPolicy *settingsPolicy `json:"link_policy,omitempty"`
+	Timezone   *string         `json:"timezone,omitempty"`
+	Folders    []string        `json:"folders"`
+}
+
+// settingsPolicy is the link_policy section
+type settingsPolicy struct {
+	AutoExpireUnclickedAfter string `json:"auto_expire_unclicked_after"`
+}
+
+// SectionResult counts what importing one section did
+type SectionResult struct {
+	Created int    `json:"created"`
+	Updated int    `json:"updated"`
+	Skipped int    `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+// exportSettings handles GET /auth/settings/export
+func exportSettings(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tree, err := loadFolderTree(ctx, linkStore(r), userID)
+	if err != nil {
+		writeFolderError(w, err, "loading folders")
+		return
+	}
+
+	timezone := user.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	export := SettingsExport{
+		Version:    settingsSchemaVersion,
+		ExportedAt: clock.Now().UTC(),
+		TagRules:   user.TagRules,
+		Timezone:   &timezone,
+		Folders:    folderPaths(tree),
+	}
+	if export.TagRules == nil {
+		export.TagRules = []TagRule{}
+	}
+	// The policy only exists with MongoDB; leaving it out keeps imports elsewhere from failing
+	if usesMongo() {
+		export.LinkPolicy = &settingsPolicy{AutoExpireUnclickedAfter: user.AutoExpireUnclickedAfter}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", `attachment; filename="rapidlink-settings.json"`)
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		log.Printf("error encoding settings export: %v", err)
+	}
+}
+
+// folderPaths returns the unescaped "Parent/Child" path of every folder, parents first
+func folderPaths(tree *folderTree) []string {
+	folders := append([]*Folder(nil), tree.list...)
+	sort.SliceStable(folders, func(i, j int) bool { return folders[i].Depth < folders[j].Depth })
+	paths := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		paths = append(paths, html.UnescapeString(tree.fullName(folder)))
+	}
+	return paths
+}
+
+// importSettings handles POST /auth/settings/import with an export document
+func importSettings(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(string)
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// raw tells which sections the document has, doc holds their values
+	var raw map[string]json.RawMessage
+	var doc SettingsExport
+	if err := json.Unmarshal(body, &raw); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		http.Error(w, "invalid settings document: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if doc.Version < 1 || doc.Version > settingsSchemaVersion {
+		writeJSONError(w, http.StatusUnprocessableEntity, ErrCodeSettingsVersion,
+			fmt.Sprintf("Unsupported settings version %d", doc.Version),
+			map[string]interface{}{"supported_version": settingsSchemaVersion})
+		return
+	}
+
+	// Validate every section before saving any of them
+	var problems []string
+	rules, err := normalizeTagRules(doc.TagRules)
+	if err != nil {
+		problems = append(problems, "tag_rules: "+err.Error())
+	}
+	policy := ""
+	if doc.LinkPolicy != nil {
+		policy = strings.ToLower(strings.TrimSpace(doc.LinkPolicy.AutoExpireUnclickedAfter))
+		if policy != "" {
+			if _, err := parseUnclickedExpiryPolicy(policy); err != nil {
+				problems = append(problems, "link_policy: "+err.Error())
+			}
+		}
+	}
+	timezone := ""
+	if doc.Timezone != nil {
+		if timezone, err = normalizeTimezone(*doc.Timezone); err != nil {
+			problems = append(problems, "timezone: "+err.Error())
+		}
+	}
+	folderNames, err := parseFolderPaths(doc.Folders)
+	if err != nil {
+		problems = append(problems, "folders: "+err.Error())
+	}
+	if len(problems) > 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, ErrCodeInvalidSettings, "Invalid settings document",
+			map[string]interface{}{"errors": problems})
+		return
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	results := map[string]*SectionResult{}
+	if _, ok := raw["tag_rules"]; ok {
+		results["tag_rules"] = importTagRules(ctx, id, user.TagRules, rules)
+	}
+	if doc.LinkPolicy != nil {
+		result := &SectionResult{}
+		switch {
+		case !usesMongo():
+			result.Skipped, result.Error = 1, "the link policy requires the MongoDB storage backend"
+		case policy == user.AutoExpireUnclickedAfter:
+			result.Skipped = 1
+		default:
+			if err := saveLinkPolicy(ctx, id, policy); err != nil {
+				log.Printf("error importing link policy for user %s: %v", userID, err)
+				result.Error = "failed to save link policy"
+			} else {
+				result.Updated = 1
+			}
+		}
+		results["link_policy"] = result
+	}
+	if doc.Timezone != nil {
+		result := &SectionResult{}
+		if timezone == user.Timezone {
+			result.Skipped = 1
+		} else if err := Users.SetTimezone(ctx, id, timezone); err != nil {
+			log.Printf("error importing timezone for user %s: %v", userID, err)
+			result.Error = "failed to save timezone"
+		} else {
+			result.Updated = 1
+		}
+		results["timezone"] = result
+	}
+	if _, ok := raw["folders"]; ok {
+		results["folders"] = importFolders(ctx, linkStore(r), userID, folderNames)
+	}
+
+	refused := map[string]string{}
+	for _, section := range unsupportedSettingsSections {
+		if _, ok := raw[section]; ok {
+			refused[section] = "not a per-account setting on this service"
+		}
+	}
+
+	logSecurityEvent(r.Context(), "SETTINGS_IMPORTED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Settings document v%d imported (%d sections, %d refused)", doc.Version, len(results), len(refused)), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"version":  doc.Version,
+		"sections": results,
+		"refused":  refused,
+	}); err != nil {
+		log.Printf("error encoding settings import response: %v", err)
+	}
+}
+
+// importTagRules merges rules into existing by host suffix, keeping rules not in the import
+func importTagRules(ctx context.Context, id primitive.ObjectID, existing, rules []TagRule) *SectionResult {
+	result := &SectionResult{}
+	merged := append([]TagRule(nil), existing...)
+	index := make(map[string]int, len(merged))
+	for i, rule := range merged {
+		index[rule.HostSuffix] = i
+	}
+	for _, rule := range rules {
+		i, ok := index[rule.HostSuffix]
+		switch {
+		case !ok:
+			index[rule.HostSuffix] = len(merged)
+			merged = append(merged, rule)
+			result.Created++
+		case strings.Join(merged[i].Tags, ",") == strings.Join(rule.Tags, ","):
+			result.Skipped++
+		default:
+			merged[i] = rule
+			result.Updated++
+		}
+	}
+	if result.Created+result.Updated == 0 {
+		return result
+	}
+	if len(merged) > maxTagRulesPerUser {
+		return &SectionResult{Skipped: len(rules),
+			Error: fmt.Sprintf("merged with the existing rules there would be more than %d", maxTagRulesPerUser)}
+	}
+	if err := Users.SetTagRules(ctx, id, merged); err != nil {
+		log.Printf("error importing tag rules for user %s: %v", id.Hex(), err)
+		return &SectionResult{Skipped: len(rules), Error: "failed to save tag rules"}
+	}
+	return result
+}
+
+// parseFolderPaths validates "Parent/Child" folder paths into their normalized names
+func parseFolderPaths(paths []string) ([][]string, error) {
+	if len(paths) > maxFoldersPerUser {
+		return nil, fmt.Errorf("at most %d folders are allowed", maxFoldersPerUser)
+	}
+	parsed := make([][]string, 0, len(paths))
+	for i, path := range paths {
+		parts := strings.Split(path, "/")
+		if len(parts) > maxFolderDepth {
+			return nil, fmt.Errorf("folder %d: folders nest at most %d levels", i+1, maxFolderDepth)
+		}
+		names := make([]string, 0, len(parts))
+		for _, part := range parts {
+			name, err := normalizeFolderName(part)
+			if err != nil {
+				return nil, fmt.Errorf("folder %d: %v", i+1, err)
+			}
+			names = append(names, name)
+		}
+		parsed = append(parsed, names)
+	}
+	return parsed, nil
+}
+
+// importFolders creates the folders of paths that are missing, with their parents
+func importFolders(ctx context.Context, store URLStore, userID string, paths [][]string) *SectionResult {
+	result := &SectionResult{}
+	tree, err := loadFolderTree(ctx, store, userID)
+	if err != nil {
+		log.Printf("error loading folders of user %s for import: %v", userID, err)
+		return &SectionResult{Skipped: len(paths), Error: "failed to load folders"}
+	}
+	for i, names := range paths {
+		var parent *Folder
+		created := false
+		for _, name := range names {
+			var found *Folder
+			for _, child := range tree.children(parent) {
+				if child.NameKey == strings.ToLower(name) {
+					found = child
+				}
+			}
+			if found == nil {
+				if len(tree.list) >= maxFoldersPerUser {
+					result.Skipped += len(paths) - i
+					result.Error = fmt.Sprintf("an account can have at most %d folders", maxFoldersPerUser)
+					return result
+				}
+				found = newFolder(userID, name, parent, clock.Now())
+				if err := store.InsertFolder(ctx, found); err != nil {
+					log.Printf("error importing folder for user %s: %v", userID, err)
+					result.Skipped += len(paths) - i
+					result.Error = "failed to create folders"
+					return result
+				}
+				tree = newFolderTree(append(tree.list, found))
+				created = true
+			}
+			parent = found
+		}
+		if created {
+			result.Created++
+		} else {
+			result.Skipped++
+		}
+	}
+	return result
+}
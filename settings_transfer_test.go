@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importAnswer is the JSON of /auth/settings/import
+type importAnswer struct {
+	Sections map[string]SectionResult `json:"sections"`
+	Refused  map[string]string        `json:"refused"`
+	Error    struct {
+		Code string `json:"code"`
+	} `json:"error"`
+}
+
+// exportedSettings downloads the settings document of token's account
+func (s *testServer) exportedSettings(token string) SettingsExport {
+	s.t.Helper()
+	var doc SettingsExport
+	if resp := s.do("GET", "/auth/settings/export", token, nil, &doc); resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("export: status %d", resp.StatusCode)
+	}
+	return doc
+}
+
+func TestSettingsExportImport(t *testing.T) {
+	srv := newTestServer(t)
+	source, _ := srv.register()
+	rules := []TagRule{{HostSuffix: "docs.google.com", Tags: []string{"docs"}}, {HostSuffix: "github.com", Tags: []string{"code", "oss"}}}
+	if resp := srv.do("PUT", "/tag-rules", source, map[string]interface{}{"rules": rules}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("tag rules: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("PUT", "/auth/timezone", source, map[string]string{"timezone": "Europe/Berlin"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("timezone: status %d", resp.StatusCode)
+	}
+	clients := srv.createFolder(source, "Clients", "")
+	acme := srv.createFolder(source, "Acme & Co", clients.ID)
+	srv.createFolder(source, "2031", acme.ID)
+	srv.createFolder(source, "Drafts", "")
+
+	exported := srv.exportedSettings(source)
+	if exported.Version != settingsSchemaVersion || exported.LinkPolicy != nil || *exported.Timezone != "Europe/Berlin" {
+		t.Fatalf("export %+v", exported)
+	}
+	if want := []string{"Clients", "Drafts", "Clients/Acme & Co", "Clients/Acme & Co/2031"}; !reflect.DeepEqual(exported.Folders, want) {
+		t.Fatalf("exported folders %q, want %q", exported.Folders, want)
+	}
+
+	// A fresh account ends up with the same settings
+	target, _ := srv.register()
+	var imported importAnswer
+	if resp := srv.do("POST", "/auth/settings/import", target, exported, &imported); resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: status %d", resp.StatusCode)
+	}
+	for section, want := range map[string]SectionResult{
+		"tag_rules": {Created: 2},
+		"timezone":  {Updated: 1},
+		"folders":   {Created: 4},
+	} {
+		if got := imported.Sections[section]; got != want {
+			t.Errorf("%s: %+v, want %+v", section, got, want)
+		}
+	}
+	copied := srv.exportedSettings(target)
+	copied.ExportedAt = exported.ExportedAt
+	if !reflect.DeepEqual(copied, exported) {
+		t.Fatalf("imported settings differ:\n%+v\n%+v", copied, exported)
+	}
+
+	// Importing again changes nothing
+	imported = importAnswer{}
+	srv.do("POST", "/auth/settings/import", target, exported, &imported)
+	for section, want := range map[string]SectionResult{
+		"tag_rules": {Skipped: 2},
+		"timezone":  {Skipped: 1},
+		"folders":   {Skipped: 4},
+	} {
+		if got := imported.Sections[section]; got != want {
+			t.Errorf("second import, %s: %+v, want %+v", section, got, want)
+		}
+	}
+	if n := len(srv.folders(target)); n != 4 {
+		t.Fatalf("%d folders after importing twice", n)
+	}
+}
+
+func TestSettingsImportMerges(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	srv.do("PUT", "/tag-rules", token, map[string]interface{}{"rules": []TagRule{
+		{HostSuffix: "github.com", Tags: []string{"code"}},
+		{HostSuffix: "example.com", Tags: []string{"mine"}},
+	}}, nil)
+	srv.createFolder(token, "Clients", "")
+
+	// Rules match by host suffix, folders by path ignoring case; other sections are refused
+	var imported importAnswer
+	resp := srv.do("POST", "/auth/settings/import", token, map[string]interface{}{
+		"version": 1,
+		"tag_rules": []TagRule{
+			{HostSuffix: ".GitHub.com", Tags: []string{"oss"}},
+			{HostSuffix: "gitlab.com", Tags: []string{"code"}},
+		},
+		"folders":  []string{"clients/Beta"},
+		"webhooks": []map[string]string{{"url": "https://hooks.example/x", "secret": "s3cret"}},
+		"domains":  []string{"links.example.org"},
+	}, &imported)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: status %d", resp.StatusCode)
+	}
+	if got := imported.Sections["tag_rules"]; got != (SectionResult{Created: 1, Updated: 1}) {
+		t.Errorf("tag rules %+v", got)
+	}
+	if got := imported.Sections["folders"]; got != (SectionResult{Created: 1}) {
+		t.Errorf("folders %+v", got)
+	}
+	if _, ok := imported.Sections["timezone"]; ok {
+		t.Error("absent timezone section imported")
+	}
+	if len(imported.Refused) != 2 || imported.Refused["webhooks"] == "" || imported.Refused["domains"] == "" {
+		t.Errorf("refused %v", imported.Refused)
+	}
+	doc := srv.exportedSettings(token)
+	want := []TagRule{
+		{HostSuffix: "github.com", Tags: []string{"oss"}},
+		{HostSuffix: "example.com", Tags: []string{"mine"}},
+		{HostSuffix: "gitlab.com", Tags: []string{"code"}},
+	}
+	if !reflect.DeepEqual(doc.TagRules, want) {
+		t.Errorf("merged rules %+v", doc.TagRules)
+	}
+	if !reflect.DeepEqual(doc.Folders, []string{"Clients", "Clients/Beta"}) {
+		t.Errorf("folders %q", doc.Folders)
+	}
+
+	// Secrets never reach the export
+	raw, _ := json.Marshal(doc)
+	if strings.Contains(string(raw), "s3cret") || strings.Contains(string(raw), "webhooks") {
+		t.Fatalf("export %s", raw)
+	}
+}
+
+func TestSettingsImportRejects(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	before := srv.exportedSettings(token)
+
+	tests := []struct {
+		name   string
+		doc    interface{}
+		status int
+		code   string
+	}{
+		{"newer version", map[string]interface{}{"version": 2, "tag_rules": []TagRule{}}, http.StatusUnprocessableEntity, ErrCodeSettingsVersion},
+		{"no version", map[string]interface{}{"tag_rules": []TagRule{}}, http.StatusUnprocessableEntity, ErrCodeSettingsVersion},
+		// One bad section keeps the valid ones from being saved
+		{"bad timezone", map[string]interface{}{"version": 1, "tag_rules": []TagRule{{HostSuffix: "a.example", Tags: []string{"a"}}}, "timezone": "Mars/Olympus"}, http.StatusUnprocessableEntity, ErrCodeInvalidSettings},
+		{"bad rule", map[string]interface{}{"version": 1, "folders": []string{"Kept"}, "tag_rules": []TagRule{{HostSuffix: "not a host", Tags: []string{"a"}}}}, http.StatusUnprocessableEntity, ErrCodeInvalidSettings},
+		{"too deep", map[string]interface{}{"version": 1, "folders": []string{strings.Repeat("a/", maxFolderDepth) + "a"}}, http.StatusUnprocessableEntity, ErrCodeInvalidSettings},
+		{"empty folder name", map[string]interface{}{"version": 1, "folders": []string{"Clients//Acme"}}, http.StatusUnprocessableEntity, ErrCodeInvalidSettings},
+		{"bad policy", map[string]interface{}{"version": 1, "link_policy": map[string]string{"auto_expire_unclicked_after": "2d"}}, http.StatusUnprocessableEntity, ErrCodeInvalidSettings},
+		{"not a document", []string{"tag_rules"}, http.StatusBadRequest, ""},
+		{"wrong type", map[string]interface{}{"version": 1, "folders": "Clients"}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		var got importAnswer
+		if resp := srv.do("POST", "/auth/settings/import", token, tt.doc, &got); resp.StatusCode != tt.status || got.Error.Code != tt.code {
+			t.Errorf("%s: status %d, code %q; want %d %q", tt.name, resp.StatusCode, got.Error.Code, tt.status, tt.code)
+		}
+	}
+	after := srv.exportedSettings(token)
+	after.ExportedAt = before.ExportedAt
+	if !reflect.DeepEqual(after, before) {
+		t.Fatalf("rejected imports changed the settings:\n%+v\n%+v", after, before)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// SHARE ATTRIBUTION
+// ============================================================================
+//
+// GET /url/{code}/shares/{id}/attribution answers "how many clicks came in the 48 hours
+// after I posted this": the link's human clicks in the window starting at the share's
+// shared_at, their distinct visitors (by IP hash) and their referrer hosts, next to the same
+// numbers for the equally long window just before the share as a baseline. ?window= sets the
+// length (e.g. 12h or 7d, default 48h, at most 14d). Each share is computed on its own, so a
+// click inside the windows of two shares counts for both; the response lists the overlapping
+// shares. Referrer hosts are only recorded for clicks since this was added, and no visitors
+// are counted with IP_PRIVACY_MODE=none.
+
+const (
+	defaultAttributionWindow = 48 * time.Hour
+	maxAttributionWindow     = 14 * 24 * time.Hour
+	// directReferrer stands for clicks without a Referer
+	directReferrer = "direct"
+)
+
+// attributionCaveat is returned with every attribution
+const attributionCaveat = "Each share's windows are computed independently: a click in the windows of several shares counts for each of them."
+
+// ClickWindow is the click counts of a link in [From, To)
+type ClickWindow struct {
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	Clicks         int64            `json:"clicks"`
+	UniqueVisitors int64            `json:"unique_visitors"`
+	Referrers      map[string]int64 `json:"referrers"`
+}
+
+// newClickWindow returns an empty window over [from, to)
+func newClickWindow(from, to time.Time) *ClickWindow {
+	return &ClickWindow{From: from.UTC(), To: to.UTC(), Referrers: make(map[string]int64)}
+}
+
+// addReferrer counts clicks from host, "" being direct traffic
+func (w *ClickWindow) addReferrer(host string, clicks int64) {
+	if host == "" {
+		host = directReferrer
+	}
+	w.Referrers[host] += clicks
+}
+
+// parseAttributionWindow reads ?window=, a Go duration such as 36h or a number of days such as 7d
+func parseAttributionWindow(raw string) (time.Duration, error) {
+	if raw == "" {
+		return defaultAttributionWindow, nil
+	}
+	var window time.Duration
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("window must be a duration such as 48h or 7d")
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if window, err = time.ParseDuration(raw); err != nil {
+			return 0, fmt.Errorf("window must be a duration such as 48h or 7d")
+		}
+	}
+	if window < time.Hour || window > maxAttributionWindow {
+		return 0, fmt.Errorf("window must be between 1h and 14d")
+	}
+	return window, nil
+}
+
+// shareAttribution handles GET /url/{code}/shares/{id}/attribution (owner only)
+func shareAttribution(w http.ResponseWriter, r *http.Request) {
+	window, err := parseAttributionWindow(r.URL.Query().Get("window"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	link, ok := findOwnedLinkForShares(ctx, w, r)
+	if !ok {
+		return
+	}
+	if link.AnalyticsDisabled {
+		writeAnalyticsOff(w, link)
+		return
+	}
+	store := linkStore(r)
+	shares, err := store.ListShareEvents(ctx, link, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("error listing share events of %s: %v", link.ShortURL, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	var share *ShareEvent
+	for i := range shares {
+		if shares[i].ID.Hex() == mux.Vars(r)["id"] {
+			share = &shares[i]
+		}
+	}
+	if share == nil {
+		http.Error(w, "Share event not found", http.StatusNotFound)
+		return
+	}
+
+	start := share.SharedAt
+	after, err := store.CountClickWindow(ctx, link, start, start.Add(window))
+	if err != nil {
+		log.Printf("error counting clicks after share %s of %s: %v", share.ID.Hex(), link.ShortURL, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	baseline, err := store.CountClickWindow(ctx, link, start.Add(-window), start)
+	if err != nil {
+		log.Printf("error counting clicks before share %s of %s: %v", share.ID.Hex(), link.ShortURL, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	writeShareAttribution(w, link, share, shares, window, after, baseline)
+}
+
+// writeShareAttribution answers the attribution of share with the windows after and before it
+func writeShareAttribution(w http.ResponseWriter, link *URLData, share *ShareEvent, shares []ShareEvent, window time.Duration, after, baseline *ClickWindow) {
+	// Shares whose own window after them intersects this share's
+	overlapping := []string{}
+	for _, other := range shares {
+		if other.ID != share.ID && other.SharedAt.Before(after.To) && other.SharedAt.Add(window).After(after.From) {
+			overlapping = append(overlapping, other.ID.Hex())
+		}
+	}
+
+	var lift interface{}
+	if baseline.Clicks > 0 {
+		lift = float64(after.Clicks) / float64(baseline.Clicks)
+	}
+	response := map[string]interface{}{
+		"success":            true,
+		"short_url":          link.ShortURL,
+		"share":              share,
+		"window_hours":       window.Hours(),
+		"after":              after,
+		"baseline":           baseline,
+		"click_change":       after.Clicks - baseline.Clicks,
+		"lift":               lift, // after / baseline clicks; null without baseline clicks
+		"complete":           !after.To.After(clock.Now()),
+		"overlapping_shares": overlapping,
+		"caveat":             attributionCaveat,
+		"counts_visitors":    ipPrivacyMode() != "none",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error encoding share attribution response: %v", err)
+	}
+}
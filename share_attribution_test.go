@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// attributionAnswer is the body of GET /url/{code}/shares/{id}/attribution
+type attributionAnswer struct {
+	WindowHours       float64     `json:"window_hours"`
+	After             ClickWindow `json:"after"`
+	Baseline          ClickWindow `json:"baseline"`
+	ClickChange       int64       `json:"click_change"`
+	Lift              *float64    `json:"lift"`
+	Complete          bool        `json:"complete"`
+	OverlappingShares []string    `json:"overlapping_shares"`
+	Caveat            string      `json:"caveat"`
+	CountsVisitors    bool        `json:"counts_visitors"`
+}
+
+func TestParseAttributionWindow(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		"":    48 * time.Hour,
+		"1h":  time.Hour,
+		"36h": 36 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+		"14d": maxAttributionWindow,
+	} {
+		if got, err := parseAttributionWindow(raw); err != nil || got != want {
+			t.Errorf("parseAttributionWindow(%q) = %v, %v; want %v", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"59m", "15d", "337h", "-2d", "d", "2 days", "forever"} {
+		if _, err := parseAttributionWindow(raw); err == nil {
+			t.Errorf("parseAttributionWindow(%q) accepted", raw)
+		}
+	}
+}
+
+func TestShareAttribution(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/attributed"})
+
+	// Two shares a day apart, whose 48h windows overlap, and one still in progress
+	shared := map[string]string{"linkedin": "2031-02-20T09:00:00Z", "newsletter": "2031-02-21T09:00:00Z", "mastodon": "2031-02-28T00:00:00Z"}
+	ids := make(map[string]string)
+	for channel, at := range shared {
+		var created struct {
+			Share ShareEvent `json:"share"`
+		}
+		if resp := srv.do("POST", "/url/"+code+"/shares", token, map[string]string{"channel": channel, "shared_at": at}, &created); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("share on %s: status %d", channel, resp.StatusCode)
+		}
+		ids[channel] = created.Share.ID.Hex()
+	}
+
+	linkedin := mustParseTime(t, shared["linkedin"])
+	browser := "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)"
+	srv.addClicks(code,
+		ClickHistory{Timestamp: linkedin.Add(-time.Nanosecond), IP: "198.51.100.4", UserAgent: browser},
+		ClickHistory{Timestamp: linkedin, IP: "198.51.100.1", UserAgent: browser},
+		ClickHistory{Timestamp: linkedin.Add(time.Hour), IP: "198.51.100.9", UserAgent: "Googlebot/2.1", ReferrerHost: "linkedin.com"},
+		ClickHistory{Timestamp: linkedin.Add(2 * time.Hour), IP: "198.51.100.2", UserAgent: browser, ReferrerHost: "linkedin.com"},
+		ClickHistory{Timestamp: linkedin.Add(2*time.Hour + time.Minute), IP: "198.51.100.2", UserAgent: browser, ReferrerHost: "linkedin.com"},
+		// Exactly when the newsletter went out, inside both windows
+		ClickHistory{Timestamp: linkedin.Add(24 * time.Hour), IP: "198.51.100.3", UserAgent: browser, ReferrerHost: "mail.example.org"},
+		// Exactly 48h after the LinkedIn post: the next window's
+		ClickHistory{Timestamp: linkedin.Add(48 * time.Hour), IP: "198.51.100.5", UserAgent: browser},
+	)
+
+	attribution := func(channel, query string) attributionAnswer {
+		t.Helper()
+		var answer attributionAnswer
+		if resp := srv.do("GET", "/url/"+code+"/shares/"+ids[channel]+"/attribution"+query, token, nil, &answer); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s attribution: status %d", channel, resp.StatusCode)
+		}
+		return answer
+	}
+
+	got := attribution("linkedin", "")
+	if got.WindowHours != 48 || got.After.Clicks != 4 || got.After.UniqueVisitors != 3 || got.Baseline.Clicks != 1 || got.ClickChange != 3 || got.Lift == nil || *got.Lift != 4 || !got.Complete || !got.CountsVisitors {
+		t.Fatalf("LinkedIn attribution %+v", got)
+	}
+	if want := map[string]int64{"direct": 1, "linkedin.com": 2, "mail.example.org": 1}; !reflect.DeepEqual(got.After.Referrers, want) {
+		t.Fatalf("LinkedIn referrers %v", got.After.Referrers)
+	}
+	if !got.After.From.Equal(linkedin) || !got.After.To.Equal(linkedin.Add(48*time.Hour)) || !got.Baseline.From.Equal(linkedin.Add(-48*time.Hour)) {
+		t.Fatalf("LinkedIn windows %s-%s after %s", got.After.From, got.After.To, got.Baseline.From)
+	}
+	if !reflect.DeepEqual(got.OverlappingShares, []string{ids["newsletter"]}) || got.Caveat != attributionCaveat {
+		t.Fatalf("overlap %v, caveat %q", got.OverlappingShares, got.Caveat)
+	}
+
+	// The newsletter counts the shared click again: no de-duplication between shares
+	got = attribution("newsletter", "")
+	if got.After.Clicks != 2 || got.Baseline.Clicks != 4 || got.ClickChange != -2 || *got.Lift != 0.5 || !reflect.DeepEqual(got.OverlappingShares, []string{ids["linkedin"]}) {
+		t.Fatalf("newsletter attribution %+v", got)
+	}
+	// A shorter window no longer overlaps
+	if got := attribution("newsletter", "?window=12h"); got.WindowHours != 12 || got.After.Clicks != 1 || len(got.OverlappingShares) != 0 {
+		t.Fatalf("12h newsletter attribution %+v", got)
+	}
+
+	// A window still open, without a baseline
+	if got := attribution("mastodon", ""); got.Complete || got.After.Clicks != 0 || got.Lift != nil || got.OverlappingShares == nil {
+		t.Fatalf("open attribution %+v", got)
+	}
+
+	for path, status := range map[string]int{
+		"/url/" + code + "/shares/" + ids["linkedin"] + "/attribution?window=15d": http.StatusBadRequest,
+		"/url/" + code + "/shares/" + ids["linkedin"] + "/attribution?window=30m": http.StatusBadRequest,
+		"/url/" + code + "/shares/0123456789abcdef01234567/attribution":           http.StatusNotFound,
+	} {
+		if resp := srv.do("GET", path, token, nil, nil); resp.StatusCode != status {
+			t.Errorf("%s: status %d, want %d", path, resp.StatusCode, status)
+		}
+	}
+	if resp := srv.do("GET", "/url/"+code+"/shares/"+ids["linkedin"]+"/attribution", other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("another user's share: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// SHARE EVENTS
+// ============================================================================
+//
+// Owners record where a link was shared ("posted to r/golang") with POST /url/{code}/shares
+// and list the records with GET /url/{code}/shares, newest first. A link keeps at most
+// maxShareEventsPerLink of them. GET /url/{code}/clicks?include_shares=true returns the
+// share events of the same time range next to the clicks, for markers on a click chart.
+// On MongoDB they live in the share_events collection, indexed on (url_id, shared_at).
+
+const (
+	maxShareEventsPerLink = 200
+	maxShareChannelLength = 50
+	maxShareNoteLength    = 500
+)
+
+// ShareEvent records one place a link was shared
+type ShareEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URLID     primitive.ObjectID `bson:"url_id" json:"-"`
+	Channel   string             `bson:"channel" json:"channel"`
+	Note      string             `bson:"note,omitempty" json:"note,omitempty"`
+	PostURL   string             `bson:"post_url,omitempty" json:"post_url,omitempty"`
+	SharedAt  time.Time          `bson:"shared_at" json:"shared_at"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// shareEventRequest is the body of POST /url/{code}/shares
+type shareEventRequest struct {
+	Channel  string `json:"channel"`
+	Note     string `json:"note"`
+	PostURL  string `json:"post_url"`
+	SharedAt string `json:"shared_at"` // RFC 3339 or YYYY-MM-DD; defaults to now
+}
+
+// newShareEvent validates req into a share event for link
+func newShareEvent(req shareEventRequest, link *URLData, now time.Time) (*ShareEvent, error) {
+	channel := sanitizeInput(strings.TrimSpace(req.Channel))
+	if channel == "" || utf8.RuneCountInString(channel) > maxShareChannelLength {
+		return nil, fmt.Errorf("channel is required and must be at most %d characters", maxShareChannelLength)
+	}
+	note := sanitizeInput(strings.TrimSpace(req.Note))
+	if utf8.RuneCountInString(note) > maxShareNoteLength {
+		return nil, fmt.Errorf("note must be at most %d characters", maxShareNoteLength)
+	}
+	postURL := strings.TrimSpace(req.PostURL)
+	if postURL != "" && !validateURL(postURL) {
+		return nil, fmt.Errorf("post_url must be a valid http or https URL")
+	}
+	sharedAt := now
+	if req.SharedAt != "" {
+		parsed, err := parseClickTime(req.SharedAt)
+		if err != nil {
+			return nil, fmt.Errorf("shared_at must be an RFC 3339 timestamp or YYYY-MM-DD date")
+		}
+		if parsed.After(now) {
+			return nil, fmt.Errorf("shared_at cannot be in the future")
+		}
+		sharedAt = parsed
+	}
+	return &ShareEvent{
+		ID:        primitive.NewObjectID(),
+		URLID:     link.ID,
+		Channel:   channel,
+		Note:      note,
+		PostURL:   postURL,
+		SharedAt:  sharedAt.UTC(),
+		CreatedAt: now.UTC(),
+	}, nil
+}
+
+// findOwnedLinkForShares loads the caller's link for the share endpoints, answering the
+// request itself when there is none
+func findOwnedLinkForShares(ctx context.Context, w http.ResponseWriter, r *http.Request) (*URLData, bool) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return nil, false
+	}
+	code := sanitizeInput(mux.Vars(r)["code"])
+	if code == "" || !validateCustomURL(code) {
+		http.Error(w, "Invalid short code", http.StatusBadRequest)
+		return nil, false
+	}
+	link, err := linkStore(r).FindLinkByCode(ctx, code)
+	if errors.Is(err, ErrNotFound) || (err == nil && (link.UserID != userID || link.DeactivatedReason == DeactivatedDraft)) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("error loading link %s for share events: %v", code, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return link, true
+}
+
+// createShareEvent handles POST /url/{code}/shares (owner only)
+func createShareEvent(w http.ResponseWriter, r *http.Request) {
+	var req shareEventRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, ok := findOwnedLinkForShares(ctx, w, r)
+	if !ok {
+		return
+	}
+	event, err := newShareEvent(req, link, clock.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err = linkStore(r).InsertShareEvent(ctx, link, event, maxShareEventsPerLink)
+	if errors.Is(err, ErrLimitReached) {
+		writeJSONError(w, http.StatusForbidden, ErrCodeQuotaExceeded,
+			fmt.Sprintf("A link can have at most %d share events", maxShareEventsPerLink),
+			map[string]interface{}{"quota": maxShareEventsPerLink})
+		return
+	}
+	if err != nil {
+		log.Printf("error saving share event for %s: %v", link.ShortURL, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"share":   event,
+	}); err != nil {
+		log.Printf("error encoding share event response: %v", err)
+	}
+}
+
+// listShareEvents handles GET /url/{code}/shares (owner only)
+func listShareEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link, ok := findOwnedLinkForShares(ctx, w, r)
+	if !ok {
+		return
+	}
+	shares, err := linkStore(r).ListShareEvents(ctx, link, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("error listing share events of %s: %v", link.ShortURL, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"short_url": link.ShortURL,
+		"shares":    shares,
+		"count":     len(shares),
+		"limit":     maxShareEventsPerLink,
+	}); err != nil {
+		log.Printf("error encoding share events response: %v", err)
+	}
+}
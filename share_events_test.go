@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewShareEvent(t *testing.T) {
+	link := &URLData{ShortURL: "shared"}
+	event, err := newShareEvent(shareEventRequest{Channel: "  reddit ", Note: "r/golang", PostURL: "https://reddit.com/r/golang/1"}, link, clockTestBase)
+	if err != nil || event.Channel != "reddit" || !event.SharedAt.Equal(clockTestBase) || event.ID.IsZero() {
+		t.Fatalf("newShareEvent = %+v, %v", event, err)
+	}
+	if event, err := newShareEvent(shareEventRequest{Channel: "newsletter", SharedAt: "2031-02-01"}, link, clockTestBase); err != nil || !event.SharedAt.Equal(time.Date(2031, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("dated share event = %+v, %v", event, err)
+	}
+
+	tests := []struct {
+		name string
+		req  shareEventRequest
+	}{
+		{"no channel", shareEventRequest{Note: "somewhere"}},
+		{"blank channel", shareEventRequest{Channel: "   "}},
+		{"long channel", shareEventRequest{Channel: strings.Repeat("c", maxShareChannelLength+1)}},
+		{"long note", shareEventRequest{Channel: "x", Note: strings.Repeat("n", maxShareNoteLength+1)}},
+		{"script post URL", shareEventRequest{Channel: "x", PostURL: "javascript:alert(1)"}},
+		{"relative post URL", shareEventRequest{Channel: "x", PostURL: "/r/golang"}},
+		{"future", shareEventRequest{Channel: "x", SharedAt: clockTestBase.Add(time.Minute).Format(time.RFC3339)}},
+		{"bad date", shareEventRequest{Channel: "x", SharedAt: "last tuesday"}},
+	}
+	for _, tt := range tests {
+		if event, err := newShareEvent(tt.req, link, clockTestBase); err == nil {
+			t.Errorf("%s: accepted as %+v", tt.name, event)
+		}
+	}
+}
+
+// shareList is the body of GET /url/{code}/shares
+type shareList struct {
+	Shares []ShareEvent `json:"shares"`
+	Count  int          `json:"count"`
+	Limit  int          `json:"limit"`
+}
+
+func TestShareEventsAPI(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/launch"})
+
+	for _, share := range []map[string]interface{}{
+		{"channel": "reddit", "note": "posted to r/golang", "post_url": "https://reddit.com/r/golang/1", "shared_at": "2031-02-20T09:00:00Z"},
+		{"channel": "newsletter", "shared_at": "2031-02-25"},
+		{"channel": "twitter"},
+	} {
+		if resp := srv.do("POST", "/url/"+code+"/shares", token, share, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %v: status %d", share, resp.StatusCode)
+		}
+	}
+	if resp := srv.do("POST", "/url/"+code+"/shares", token, map[string]interface{}{"channel": ""}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid share event: status %d", resp.StatusCode)
+	}
+
+	var list shareList
+	srv.do("GET", "/url/"+code+"/shares", token, nil, &list)
+	if list.Count != 3 || list.Limit != maxShareEventsPerLink {
+		t.Fatalf("listed %d share events, limit %d", list.Count, list.Limit)
+	}
+	for i, want := range []string{"twitter", "newsletter", "reddit"} {
+		if list.Shares[i].Channel != want {
+			t.Fatalf("share event %d is %s, want %s (newest first)", i, list.Shares[i].Channel, want)
+		}
+	}
+
+	// Owner-scoped
+	if resp := srv.do("GET", "/url/"+code+"/shares", other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("list by another user: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("POST", "/url/"+code+"/shares", other, map[string]interface{}{"channel": "spam"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("create by another user: status %d", resp.StatusCode)
+	}
+
+	// The click listing overlays the share events of its range
+	var page struct {
+		Shares []ShareEvent `json:"shares"`
+	}
+	srv.do("GET", "/url/"+code+"/clicks?include_shares=true&from=2031-02-21&to=2031-03-01", token, nil, &page)
+	if len(page.Shares) != 1 || page.Shares[0].Channel != "newsletter" {
+		t.Fatalf("include_shares in range: %+v", page.Shares)
+	}
+	page.Shares = nil
+	srv.do("GET", "/url/"+code+"/clicks", token, nil, &page)
+	if page.Shares != nil {
+		t.Fatal("share events listed without include_shares")
+	}
+}
+
+func TestShareEventsCapped(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/everywhere"})
+	link, err := srv.links.FindLinkByCode(context.Background(), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxShareEventsPerLink-1; i++ {
+		event, _ := newShareEvent(shareEventRequest{Channel: "seeded"}, link, clockTestBase)
+		if err := srv.links.InsertShareEvent(context.Background(), link, event, maxShareEventsPerLink); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if resp := srv.do("POST", "/url/"+code+"/shares", token, map[string]interface{}{"channel": "last"}, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("share event %d: status %d", maxShareEventsPerLink, resp.StatusCode)
+	}
+	var refused struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if resp := srv.do("POST", "/url/"+code+"/shares", token, map[string]interface{}{"channel": "one more"}, &refused); resp.StatusCode != http.StatusForbidden || refused.Error.Code != ErrCodeQuotaExceeded {
+		t.Fatalf("share event over the cap: status %d, code %s", resp.StatusCode, refused.Error.Code)
+	}
+	var list shareList
+	srv.do("GET", "/url/"+code+"/shares", token, nil, &list)
+	if list.Count != maxShareEventsPerLink {
+		t.Fatalf("%d share events stored, cap is %d", list.Count, maxShareEventsPerLink)
+	}
+}
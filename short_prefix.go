@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ============================================================================
+// SHORT LINK PATH PREFIX
+// ============================================================================
+//
+// By default short links live at the root (/{code}) and the redirect route catches every path
+// no other route claims. With SHORT_PATH_PREFIX=/r they live under /r/{code} instead, so a
+// website can be served at / on the same domain by a proxy in front of the API. Full short
+// URLs, QR codes, link cards, previews and the demo endpoints all build links through
+// fullShortURL, which adds the prefix. The prefix may not start with a route of the API.
+// Reserved codes stay reserved either way, so existing links keep working when the prefix is
+// added or removed later. With a prefix, GET / redirects to ROOT_REDIRECT_URL or serves the
+// HTML file at ROOT_PAGE_PATH; with neither set it answers 404 like any unknown path.
+
+// shortPathPrefix is the path short links are served under, e.g. "/r"; "" serves them at the root
+var shortPathPrefix string
+
+// rootRedirectURL and rootPage are what GET / answers when short links have a prefix
+var (
+	rootRedirectURL string
+	rootPage        *staticAsset
+)
+
+// shortPathSegment is one segment of SHORT_PATH_PREFIX
+var shortPathSegment = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// InitShortPathPrefix loads SHORT_PATH_PREFIX and the landing page options of the root path
+func InitShortPathPrefix() error {
+	raw := strings.Trim(os.Getenv("SHORT_PATH_PREFIX"), "/")
+	if raw == "" {
+		return nil
+	}
+	segments := strings.Split(raw, "/")
+	for _, segment := range segments {
+		if !shortPathSegment.MatchString(segment) {
+			return fmt.Errorf("SHORT_PATH_PREFIX %q must be path segments of letters, digits, '-' and '_'", raw)
+		}
+	}
+	if isReservedCode(segments[0]) {
+		return fmt.Errorf("SHORT_PATH_PREFIX %q collides with the API route /%s", raw, segments[0])
+	}
+	shortPathPrefix = "/" + raw
+
+	if target := os.Getenv("ROOT_REDIRECT_URL"); target != "" {
+		if !validateURL(target) {
+			return fmt.Errorf("ROOT_REDIRECT_URL must be a valid HTTP or HTTPS URL")
+		}
+		rootRedirectURL = target
+	} else if path := os.Getenv("ROOT_PAGE_PATH"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read ROOT_PAGE_PATH %s: %v", path, err)
+		}
+		rootPage = newStaticAsset("index.html", data)
+	}
+	log.Printf("✅ Short links served under %s/{code}", shortPathPrefix)
+	return nil
+}
+
+// shortCodePath returns the path a short code is served at
+func shortCodePath(code string) string {
+	return shortPathPrefix + "/" + code
+}
+
+// codeFromPath returns the part of a path under the short link prefix and whether the path
+// is under it at all
+func codeFromPath(path string) (string, bool) {
+	if shortPathPrefix == "" {
+		return strings.TrimPrefix(path, "/"), true
+	}
+	return strings.CutPrefix(path, shortPathPrefix+"/")
+}
+
+// rootLanding handles GET / when short links have a prefix
+func rootLanding(w http.ResponseWriter, r *http.Request) {
+	if rootRedirectURL != "" {
+		http.Redirect(w, r, rootRedirectURL, http.StatusFound)
+		return
+	}
+	if rootPage != nil {
+		serveAsset(w, r, rootPage, staticRevalidateCache)
+		return
+	}
+	notFoundHandler().ServeHTTP(w, r)
+}
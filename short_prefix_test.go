@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withShortPathPrefix loads SHORT_PATH_PREFIX and the root landing options from env for
+// one test; servers started afterwards mount their routes accordingly
+func withShortPathPrefix(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for _, key := range []string{"SHORT_PATH_PREFIX", "ROOT_REDIRECT_URL", "ROOT_PAGE_PATH"} {
+		t.Setenv(key, env[key])
+	}
+	t.Cleanup(func() { shortPathPrefix, rootRedirectURL, rootPage = "", "", nil })
+	return InitShortPathPrefix()
+}
+
+func TestInitShortPathPrefix(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(page, []byte("<h1>Welcome</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env     map[string]string
+		want    string
+		invalid bool
+	}{
+		{map[string]string{}, "", false},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r"}, "/r", false},
+		{map[string]string{"SHORT_PATH_PREFIX": "r/"}, "/r", false},
+		{map[string]string{"SHORT_PATH_PREFIX": "/go/links/"}, "/go/links", false},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r", "ROOT_PAGE_PATH": page}, "/r", false},
+		{map[string]string{"SHORT_PATH_PREFIX": "/analytics"}, "", true},
+		{map[string]string{"SHORT_PATH_PREFIX": "/auth/r"}, "", true},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r/../admin"}, "", true},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r x"}, "", true},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r", "ROOT_REDIRECT_URL": "javascript:alert(1)"}, "", true},
+		{map[string]string{"SHORT_PATH_PREFIX": "/r", "ROOT_PAGE_PATH": page + ".missing"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env["SHORT_PATH_PREFIX"], func(t *testing.T) {
+			err := withShortPathPrefix(t, tt.env)
+			if (err != nil) != tt.invalid || (!tt.invalid && shortPathPrefix != tt.want) {
+				t.Errorf("%v: prefix %q, error %v", tt.env, shortPathPrefix, err)
+			}
+		})
+	}
+}
+
+func TestShortPathPrefixRoutes(t *testing.T) {
+	if err := withShortPathPrefix(t, map[string]string{"SHORT_PATH_PREFIX": "/r", "ROOT_REDIRECT_URL": "https://www.example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	var link URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/prefixed"}, &link)
+	if !strings.HasSuffix(link.FullShortURL, "/r/"+link.ShortURL) || strings.Contains(link.ShortURL, "/") {
+		t.Fatalf("short_url %q, full_short_url %q", link.ShortURL, link.FullShortURL)
+	}
+	if resp := srv.do("GET", "/r/"+link.ShortURL, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/prefixed" {
+		t.Fatalf("GET /r/%s: status %d, Location %q", link.ShortURL, resp.StatusCode, resp.Header.Get("Location"))
+	}
+	// The root paths belong to the website now
+	if resp := srv.do("GET", "/"+link.ShortURL, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /%s without the prefix: status %d", link.ShortURL, resp.StatusCode)
+	}
+	if resp := srv.do("GET", "/", "", nil, nil); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://www.example.com/" {
+		t.Fatalf("GET /: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	// robots.txt is built at startup, after the prefix is loaded
+	if got := defaultRobotsTxt(); got != "User-agent: *\nDisallow: /r/\n" {
+		t.Fatalf("robots.txt:\n%s", got)
+	}
+	// The API is where it was
+	if resp := srv.do("GET", "/analytics", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /analytics: status %d", resp.StatusCode)
+	}
+
+	// Website pages on the host are ordinary destinations; prefixed and API paths are not
+	base := baseURL()
+	ctx := context.Background()
+	if got, err := checkSelfReference(ctx, srv.links, base+"/pricing", "", false); err != nil || got != base+"/pricing" {
+		t.Fatalf("website page: %q, %v", got, err)
+	}
+	for _, destination := range []string{base + "/r/" + link.ShortURL, base + "/r/missing", base + "/analytics", base + "/"} {
+		if _, err := checkSelfReference(ctx, srv.links, destination, "", false); !errors.Is(err, errSelfReference) && !errors.Is(err, errShortLinkHop) {
+			t.Errorf("%s: %v", destination, err)
+		}
+	}
+}
+
+func TestShortPathPrefixRootPage(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(page, []byte("<h1>Welcome</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := withShortPathPrefix(t, map[string]string{"SHORT_PATH_PREFIX": "/go", "ROOT_PAGE_PATH": page}); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	resp := srv.do("GET", "/", "", nil, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "<h1>Welcome</h1>" || resp.Header.Get("ETag") == "" {
+		t.Fatalf("GET /: status %d, ETag %q: %s", resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+}
+
+func TestShortPathPrefixUnset(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	var link URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/rooted"}, &link)
+	if !strings.HasSuffix(link.FullShortURL, "/"+link.ShortURL) || strings.Contains(link.FullShortURL, "/r/") {
+		t.Fatalf("full_short_url %q", link.FullShortURL)
+	}
+	if resp := srv.do("GET", "/"+link.ShortURL, "", nil, nil); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("GET /%s: status %d", link.ShortURL, resp.StatusCode)
+	}
+	if body := readBody(t, srv.do("GET", "/robots.txt", "", nil, nil)); !strings.Contains(body, "Disallow: /\n") {
+		t.Fatalf("robots.txt:\n%s", body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// SHORT URL CONSTRUCTION
+// ============================================================================
+
+// baseURL returns the public base URL of this deployment
+func baseURL() string {
+	if base := strings.TrimRight(os.Getenv("BASE_URL"), "/"); base != "" {
+		return base
+	}
+	return DefaultBaseURL
+}
+
+// isServingDomain reports whether domain is known to route to this deployment. Other
+// user-supplied domains are not trusted to serve the link.
+func isServingDomain(domain string) bool {
+	domain = strings.TrimRight(domain, "/")
+	if domain == "" {
+		return false
+	}
+	if domain == baseURL() {
+		return true
+	}
+	for _, d := range DefaultDomains {
+		if domain == strings.TrimRight(d, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fullShortURL joins a code with the link's domain when that is another domain serving this
+// deployment, otherwise with the base URL of the request (see requestBaseURL), under
+// SHORT_PATH_PREFIX. The stored short_url stays the bare code.
+func fullShortURL(r *http.Request, domain, code string) string {
+	domain = strings.TrimRight(domain, "/")
+	if domain != baseURL() && isServingDomain(domain) {
+		return domain + shortCodePath(code)
+	}
+	return requestBaseURL(r) + shortCodePath(code)
+}
+
+// linkResourcePath returns the API path of an owned link, used as the Location of
+// creation responses
+func linkResourcePath(code string) string {
+	return "/url/" + url.PathEscape(code)
+}
+
+// addFullShortURLs sets full_short_url on aggregation results that project short_url and domain
+func addFullShortURLs(r *http.Request, docs []map[string]interface{}) {
+	for _, doc := range docs {
+		code, ok := doc["short_url"].(string)
+		if !ok {
+			continue
+		}
+		domain, _ := doc["domain"].(string)
+		doc["full_short_url"] = fullShortURL(r, domain, code)
+	}
+}
+
+// statsWithFullShortURLs returns dashboard statistics with full_short_url set on top_links.
+// The statistics may be shared through the stats cache, so they are copied, not modified.
+func statsWithFullShortURLs(r *http.Request, stats map[string]interface{}) map[string]interface{} {
+	topLinks, ok := stats["top_links"].([]map[string]interface{})
+	if !ok {
+		return stats
+	}
+	copied := make(map[string]interface{}, len(stats))
+	for k, v := range stats {
+		copied[k] = v
+	}
+	links := make([]map[string]interface{}, len(topLinks))
+	for i, doc := range topLinks {
+		links[i] = make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			links[i][k] = v
+		}
+	}
+	addFullShortURLs(r, links)
+	copied["top_links"] = links
+	return copied
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFullShortURL(t *testing.T) {
+	base := baseURL()
+	tests := []struct {
+		name, domain, want string
+	}{
+		{"no domain", "", base + "/abc"},
+		{"base url", base, base + "/abc"},
+		{"base url with slash", base + "/", base + "/abc"},
+		{"serving custom domain", "http://rapidlink.com", "http://rapidlink.com/abc"},
+		{"serving custom domain with slash", "http://rapidlink.com/", "http://rapidlink.com/abc"},
+		{"unverified domain", "https://not-ours.example", base + "/abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fullShortURL(nil, tt.domain, "abc"); got != tt.want {
+				t.Errorf("fullShortURL(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponsesCarryFullShortURL(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	tests := []struct {
+		name, domain, origin string
+	}{
+		{"default domain", "", baseURL()},
+		{"custom domain", "http://rapidlink.com", "http://rapidlink.com"},
+		{"unverified domain", "https://not-ours.example", baseURL()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"long-url": "https://example.com/full/" + tt.name}
+			if tt.domain != "" {
+				body["domain"] = tt.domain
+			}
+			var created URLData
+			if resp := srv.do("PUT", "/url", token, body, &created); resp.StatusCode != http.StatusCreated {
+				t.Fatalf("shorten: status %d", resp.StatusCode)
+			}
+			want := tt.origin + "/" + created.ShortURL
+			if created.FullShortURL != want {
+				t.Errorf("shorten full_short_url %q, want %q", created.FullShortURL, want)
+			}
+
+			var detail URLData
+			srv.do("GET", "/url/"+created.ShortURL, token, nil, &detail)
+			if detail.FullShortURL != want {
+				t.Errorf("detail full_short_url %q, want %q", detail.FullShortURL, want)
+			}
+			var edited URLData
+			srv.do("PATCH", "/url/"+created.ShortURL, token, map[string]interface{}{"tags": []string{"full"}}, &edited)
+			if edited.FullShortURL != want {
+				t.Errorf("edit full_short_url %q, want %q", edited.FullShortURL, want)
+			}
+
+			var listing struct {
+				URLs []struct {
+					ShortURL     string `json:"short_url"`
+					FullShortURL string `json:"full_short_url"`
+				} `json:"urls"`
+			}
+			srv.do("GET", "/analytics?pageSize=100", token, nil, &listing)
+			listed := false
+			for _, link := range listing.URLs {
+				if link.ShortURL == created.ShortURL {
+					listed = link.FullShortURL == want
+				}
+			}
+			if !listed {
+				t.Errorf("analytics listing lacks %s as %q", created.ShortURL, want)
+			}
+
+			// The stored code stays bare
+			stored := srv.stored(created.ShortURL)
+			if stored.ShortURL != created.ShortURL || stored.FullShortURL != "" {
+				t.Errorf("stored link %+v", stored)
+			}
+		})
+	}
+}
+
+func TestCreationStatusAndLocation(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	body := map[string]interface{}{"long-url": "https://example.com/located"}
+
+	var created URLData
+	resp := srv.do("PUT", "/url", token, body, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("new link: status %d, want 201", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location != "/url/"+created.ShortURL {
+		t.Fatalf("new link: Location %q", location)
+	}
+
+	var reused URLData
+	resp = srv.do("PUT", "/url", token, body, &reused)
+	if resp.StatusCode != http.StatusOK || reused.ShortURL != created.ShortURL {
+		t.Fatalf("reused link: status %d, code %q, want 200 and %q", resp.StatusCode, reused.ShortURL, created.ShortURL)
+	}
+	if got := resp.Header.Get("Location"); got != location {
+		t.Fatalf("reused link: Location %q, want %q", got, location)
+	}
+
+	// The Location is the owner's view of the link
+	var detail URLData
+	if resp := srv.do("GET", location, token, nil, &detail); resp.StatusCode != http.StatusOK || detail.ShortURL != created.ShortURL {
+		t.Fatalf("GET %s: status %d, code %q", location, resp.StatusCode, detail.ShortURL)
+	}
+
+	// Failures carry no Location
+	resp = srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "not a url"}, nil)
+	if resp.StatusCode < 400 || resp.Header.Get("Location") != "" {
+		t.Fatalf("invalid link: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
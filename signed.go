@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// SIGNED (PRIVATE) LINKS
+// ============================================================================
+//
+// Links created with "signed": true only redirect when the request carries
+// ?sig=<HMAC(link ID, code, exp)>&exp=<unix seconds> issued by POST /url/{code}/sign. A
+// signature may be reused until exp, for that link only: once the code is deleted and taken
+// by another link, its old signatures no longer open it. Signed redirects are always sent no-store so a CDN never
+// serves one visitor's authorized redirect to another.
+
+const (
+	defaultSignedLinkValidity = 24 * time.Hour
+	maxSignedLinkValidity     = 30 * 24 * time.Hour
+)
+
+// linkSigningKey returns the secret used to sign private link access
+func linkSigningKey() []byte {
+	if secret := os.Getenv("LINK_SIGNING_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return JWTSecret
+}
+
+// signLinkAccess returns the access signature for the link with linkID and code valid until exp
+func signLinkAccess(linkID primitive.ObjectID, code string, exp int64) string {
+	mac := hmac.New(sha256.New, linkSigningKey())
+	mac.Write([]byte("link:" + linkID.Hex() + ":" + code + ":" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLinkAccess checks the sig and exp query parameters of a signed link request
+func verifyLinkAccess(link *URLData, query url.Values, now time.Time) bool {
+	sig := query.Get("sig")
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if sig == "" || err != nil || now.Unix() >= exp {
+		return false
+	}
+	return hmac.Equal([]byte(signLinkAccess(link.ID, link.ShortURL, exp)), []byte(sig))
+}
+
+// parseSignedValidity accepts Go durations (90m, 24h) or day/week units (7d, 2w)
+func parseSignedValidity(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultSignedLinkValidity, nil
+	}
+	validity, err := time.ParseDuration(s)
+	if err != nil {
+		d, derr := parseLinkDuration(s)
+		if derr != nil || d.Months != 0 || d.Years != 0 {
+			return 0, fmt.Errorf("invalid valid_for %q (use e.g. 90m, 24h, 7d)", s)
+		}
+		validity = time.Duration(d.Days) * 24 * time.Hour
+	}
+	if validity <= 0 || validity > maxSignedLinkValidity {
+		return 0, fmt.Errorf("valid_for must be between 1s and %s", maxSignedLinkValidity)
+	}
+	return validity, nil
+}
+
+// signURL handles POST /url/{code}/sign
+func signURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	code := mux.Vars(r)["code"]
+
+	var req struct {
+		ValidFor string `json:"valid_for"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+	}
+	validity, err := parseSignedValidity(strings.TrimSpace(req.ValidFor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var urlData URLData
+	err = tenantURLs(r).FindOne(ctx, bson.D{
+		{Key: "short_url", Value: code},
+		{Key: "user_id", Value: userID},
+		{Key: "is_active", Value: true},
+	}).Decode(&urlData)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, "Short URL not found or not owned by user", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("error loading link for signing: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !urlData.Signed {
+		http.Error(w, "Short URL was not created as a signed link", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := clock.Now().Add(validity).Truncate(time.Second)
+	sig := signLinkAccess(urlData.ID, code, expiresAt.Unix())
+	query := url.Values{"sig": {sig}, "exp": {strconv.FormatInt(expiresAt.Unix(), 10)}}
+
+	logSecurityEvent(r.Context(), "SIGNED_LINK_ISSUED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Signed access issued for %s until %s", code, expiresAt.Format(time.RFC3339)), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"short_url":  code,
+		"url":        fullShortURL(r, urlData.Domain, code) + "?" + query.Encode(),
+		"sig":        sig,
+		"exp":        expiresAt.Unix(),
+		"expires_at": expiresAt,
+	})
+}
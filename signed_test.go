@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSignedLinkAccess(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/handbook", "signed": true})
+	link := srv.stored(code)
+	exp := clockTestBase.Add(time.Hour).Unix()
+	redirect := func(query url.Values) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code+"?"+query.Encode(), nil)
+		return srv.send(req, nil).StatusCode
+	}
+	signed := func(linkID primitive.ObjectID, exp int64) url.Values {
+		return url.Values{"sig": {signLinkAccess(linkID, code, exp)}, "exp": {strconv.FormatInt(exp, 10)}}
+	}
+
+	if status := redirect(url.Values{}); status != http.StatusForbidden {
+		t.Errorf("without a signature: status %d", status)
+	}
+	if status := redirect(signed(link.ID, exp)); status != http.StatusFound && status != http.StatusMovedPermanently {
+		t.Fatalf("with a signature: status %d", status)
+	}
+	tampered := signed(link.ID, exp)
+	tampered.Set("exp", strconv.FormatInt(exp+3600, 10))
+	if status := redirect(tampered); status != http.StatusForbidden {
+		t.Errorf("with a later expiry: status %d", status)
+	}
+	if status := redirect(signed(primitive.NewObjectID(), exp)); status != http.StatusForbidden {
+		t.Errorf("signed for another link: status %d", status)
+	}
+
+	// A signature outlives neither its expiry nor the link it was issued for
+	query := signed(link.ID, exp)
+	SetClock(FixedClock(clockTestBase.Add(time.Hour)))
+	if status := redirect(query); status != http.StatusForbidden {
+		t.Errorf("after the expiry: status %d", status)
+	}
+	SetClock(FixedClock(clockTestBase))
+	srv.purge(code)
+	if err := srv.links.InsertLink(context.Background(), &URLData{
+		ShortURL: code, LongURL: "https://example.com/successor", UserID: userID, Signed: true,
+		IsActive: true, CreatedAt: clock.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status := redirect(query); status != http.StatusForbidden {
+		t.Errorf("the code's next link: status %d", status)
+	}
+}
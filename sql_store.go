@@ -0,0 +1,2137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// SQL STORE (SQLITE / POSTGRES)
+// ============================================================================
+//
+// sqlStore implements UserStore and URLStore on database/sql for STORAGE_BACKEND=sqlite or
+// postgres, with the connection string in DATABASE_DSN. Drivers are linked with build tags
+// (-tags sqlite or -tags postgres); SQL_DRIVER overrides the registered driver name.
+// Timestamps are stored as UTC Unix nanoseconds so the schema is identical on both.
+
+// sqlDrivers maps STORAGE_BACKEND to the driver name registered by the tagged driver files
+var sqlDrivers = map[string]string{
+	"sqlite":   "sqlite",
+	"postgres": "pgx",
+}
+
+// sqlMigrations is the SQL schema in version order. Append only - never renumber.
+var sqlMigrations = []struct {
+	Version    int
+	Statements []string
+}{
+	{Version: 1, Statements: []string{
+		`CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL UNIQUE,
+			password TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT '',
+			created_at BIGINT NOT NULL,
+			is_active BOOLEAN NOT NULL
+		)`,
+		`CREATE TABLE sessions (
+			user_id TEXT PRIMARY KEY REFERENCES users(id),
+			token_hash TEXT NOT NULL UNIQUE,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE urls (
+			id TEXT PRIMARY KEY,
+			short_url TEXT NOT NULL UNIQUE,
+			long_url TEXT NOT NULL,
+			domain TEXT NOT NULL DEFAULT '',
+			user_id TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT,
+			expires_at BIGINT,
+			clicks INTEGER NOT NULL DEFAULT 0,
+			is_active BOOLEAN NOT NULL,
+			last_clicked BIGINT,
+			title TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			og TEXT,
+			deep_link TEXT,
+			redirect_type TEXT NOT NULL DEFAULT '',
+			cache_max_age INTEGER,
+			signed BOOLEAN NOT NULL DEFAULT FALSE,
+			deactivated_reason TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX urls_user_active_created_idx ON urls (user_id, is_active, created_at)`,
+		`CREATE INDEX urls_user_long_url_idx ON urls (user_id, long_url)`,
+		`CREATE INDEX urls_expires_at_idx ON urls (expires_at)`,
+		`CREATE TABLE url_tags (
+			url_id TEXT NOT NULL REFERENCES urls(id),
+			tag TEXT NOT NULL,
+			PRIMARY KEY (url_id, tag)
+		)`,
+		`CREATE INDEX url_tags_tag_idx ON url_tags (tag)`,
+		`CREATE TABLE clicks (
+			id TEXT PRIMARY KEY,
+			url_id TEXT NOT NULL REFERENCES urls(id),
+			clicked_at BIGINT NOT NULL,
+			day TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			branch TEXT NOT NULL DEFAULT '',
+			signed BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE INDEX clicks_url_day_idx ON clicks (url_id, day)`,
+	}},
+	{Version: 2, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN allowed_referrers TEXT`,
+		`ALTER TABLE urls ADD COLUMN deny_missing_referrer BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE urls ADD COLUMN referrer_fallback_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN blocked_clicks INTEGER NOT NULL DEFAULT 0`,
+	}},
+	{Version: 3, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN favicon_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN favicon_data TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN accent_color TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN favicon_fetched_at BIGINT`,
+		`CREATE INDEX urls_favicon_fetched_at_idx ON urls (favicon_fetched_at)`,
+	}},
+	{Version: 4, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN created_ip TEXT`,
+		`ALTER TABLE urls ADD COLUMN created_user_agent TEXT`,
+	}},
+	{Version: 5, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN resolved_destination TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN redirect_chain_length INTEGER NOT NULL DEFAULT 0`,
+	}},
+	{Version: 6, Statements: []string{
+		`CREATE INDEX clicks_url_clicked_at_idx ON clicks (url_id, clicked_at DESC, id DESC)`,
+	}},
+	{Version: 7, Statements: []string{
+		`ALTER TABLE users ADD COLUMN tag_rules TEXT`,
+	}},
+	{Version: 8, Statements: []string{
+		`CREATE TABLE share_events (
+			id TEXT PRIMARY KEY,
+			url_id TEXT NOT NULL REFERENCES urls(id),
+			channel TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			post_url TEXT NOT NULL DEFAULT '',
+			shared_at BIGINT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX share_events_url_shared_at_idx ON share_events (url_id, shared_at DESC)`,
+	}},
+	{Version: 9, Statements: []string{
+		`CREATE INDEX clicks_clicked_at_idx ON clicks (clicked_at, id)`,
+	}},
+	{Version: 10, Statements: []string{
+		`CREATE TABLE api_usage (
+			user_id TEXT NOT NULL,
+			day TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			requests BIGINT NOT NULL DEFAULT 0,
+			rate_limited BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, day, endpoint)
+		)`,
+		`CREATE INDEX api_usage_day_idx ON api_usage (day)`,
+	}},
+	{Version: 11, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN on_expire TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN expire_fallback_url TEXT NOT NULL DEFAULT ''`,
+	}},
+	{Version: 12, Statements: []string{
+		`ALTER TABLE users ADD COLUMN restricted BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+	}},
+	{Version: 13, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN abuse_flagged BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE abuse_reports (
+			id TEXT PRIMARY KEY,
+			url_id TEXT NOT NULL,
+			short_url TEXT NOT NULL,
+			owner_id TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT '',
+			ip_hash TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			resolved_at BIGINT
+		)`,
+		`CREATE UNIQUE INDEX abuse_reports_open_ip_idx ON abuse_reports (url_id, ip_hash) WHERE status = 'open'`,
+		`CREATE INDEX abuse_reports_status_created_idx ON abuse_reports (status, created_at)`,
+		`CREATE INDEX abuse_reports_short_url_idx ON abuse_reports (short_url)`,
+	}},
+	{Version: 14, Statements: []string{
+		// The logo is base64 text so the column type is the same on SQLite and Postgres
+		`CREATE TABLE domain_branding (
+			host TEXT PRIMARY KEY,
+			logo_url TEXT NOT NULL DEFAULT '',
+			logo_data TEXT NOT NULL DEFAULT '',
+			logo_type TEXT NOT NULL DEFAULT '',
+			primary_color TEXT NOT NULL DEFAULT '',
+			support_email TEXT NOT NULL DEFAULT '',
+			footer_text TEXT NOT NULL DEFAULT '',
+			updated_at BIGINT NOT NULL
+		)`,
+	}},
+	{Version: 15, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN daily_click_limit INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE urls ADD COLUMN daily_click_timezone TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN budget_fallback_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN paused_until BIGINT`,
+		`CREATE INDEX urls_paused_until_idx ON urls (paused_until)`,
+		`CREATE TABLE daily_clicks (
+			url_id TEXT NOT NULL,
+			day TEXT NOT NULL,
+			clicks INTEGER NOT NULL DEFAULT 0,
+			expires_at BIGINT NOT NULL,
+			PRIMARY KEY (url_id, day)
+		)`,
+		`CREATE INDEX daily_clicks_expires_at_idx ON daily_clicks (expires_at)`,
+	}},
+	{Version: 16, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN folder_id TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX urls_user_folder_idx ON urls (user_id, folder_id)`,
+		`CREATE TABLE folders (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			name_key TEXT NOT NULL,
+			parent_id TEXT NOT NULL DEFAULT '',
+			path TEXT NOT NULL,
+			depth INTEGER NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX folders_user_parent_name_idx ON folders (user_id, parent_id, name_key)`,
+		`CREATE INDEX folders_user_path_idx ON folders (user_id, path)`,
+	}},
+	{Version: 17, Statements: []string{
+		`ALTER TABLE users ADD COLUMN deactivated_at BIGINT`,
+	}},
+	{Version: 18, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE INDEX urls_user_pinned_created_idx ON urls (user_id, pinned, created_at)`,
+	}},
+	{Version: 19, Statements: []string{
+		`ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`,
+	}},
+	{Version: 20, Statements: []string{
+		// Attribution windows read clicks by (url_id, clicked_at), served by the index of migration 6
+		`ALTER TABLE clicks ADD COLUMN referrer_host TEXT NOT NULL DEFAULT ''`,
+	}},
+	{Version: 21, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN analytics_disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	}},
+	{Version: 22, Statements: []string{
+		`CREATE TABLE analytics_shares (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scope TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			label TEXT NOT NULL,
+			passcode_hash TEXT NOT NULL DEFAULT '',
+			expires_at BIGINT NOT NULL,
+			created_at BIGINT NOT NULL,
+			revoked_at BIGINT
+		)`,
+		`CREATE INDEX analytics_shares_user_created_at_idx ON analytics_shares (user_id, created_at DESC)`,
+	}},
+	{Version: 23, Statements: []string{
+		`CREATE TABLE link_outcomes (
+			url_id TEXT NOT NULL,
+			day TEXT NOT NULL,
+			outcome TEXT NOT NULL,
+			count BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (url_id, day, outcome)
+		)`,
+		`CREATE INDEX link_outcomes_day_idx ON link_outcomes (day)`,
+	}},
+	{Version: 24, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN allowed_countries TEXT`,
+		`ALTER TABLE urls ADD COLUMN blocked_countries TEXT`,
+		`ALTER TABLE urls ADD COLUMN geo_fallback_url TEXT NOT NULL DEFAULT ''`,
+	}},
+	{Version: 25, Statements: []string{
+		`ALTER TABLE urls ADD COLUMN public_note TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE urls ADD COLUMN internal BOOLEAN NOT NULL DEFAULT FALSE`,
+	}},
+	{Version: 26, Statements: []string{
+		// Tags are listed in the order they were given, as on MongoDB
+		`ALTER TABLE url_tags ADD COLUMN position INTEGER NOT NULL DEFAULT 0`,
+	}},
+}
+
+type sqlStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// openSQLStore connects DATABASE_DSN with the driver for backend and applies pending migrations
+func openSQLStore(backend string) (*sqlStore, error) {
+	driver := os.Getenv("SQL_DRIVER")
+	if driver == "" {
+		driver = sqlDrivers[backend]
+	}
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		return nil, fmt.Errorf("DATABASE_DSN is required for STORAGE_BACKEND=%s", backend)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s database (build with -tags %s to link the driver): %v", backend, backend, err)
+	}
+	if backend == "sqlite" {
+		// SQLite allows a single writer; one connection avoids "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to %s database: %v", backend, err)
+	}
+	store := &sqlStore{db: db, postgres: backend == "postgres"}
+	if err := store.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%w: %v", ErrMigrationFailed, err)
+	}
+	return store, nil
+}
+
+// migrate applies every sqlMigrations entry newer than the recorded schema version
+func (s *sqlStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for _, m := range sqlMigrations {
+		if m.Version <= current {
+			continue
+		}
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range m.Statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("sql migration %d: %v", m.Version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), m.Version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("✅ Applied SQL migration %d", m.Version)
+	}
+	return nil
+}
+
+// rebind rewrites ? placeholders to $1, $2... for Postgres
+func (s *sqlStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(query), args...)
+}
+
+// isUniqueViolation recognises duplicate-key errors from the SQLite and Postgres drivers
+func isUniqueViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "SQLSTATE 23505") ||
+		strings.Contains(msg, "duplicate key value")
+}
+
+// ----------------------------------------------------------------------------
+// Users
+// ----------------------------------------------------------------------------
+
+const sqlUserColumns = `u.id, u.username, u.email, u.password, u.role, u.created_at, u.is_active,
+	COALESCE(s.token_hash, ''), COALESCE(s.expires_at, 0), COALESCE(u.tag_rules, ''), u.restricted, u.email_verified,
+	COALESCE(u.deactivated_at, 0), u.timezone`
+
+const sqlUserFrom = ` FROM users u LEFT JOIN sessions s ON s.user_id = u.id `
+
+func (s *sqlStore) CreateUser(ctx context.Context, user *User) error {
+	user.ID = primitive.NewObjectID()
+	_, err := s.exec(ctx, `INSERT INTO users (id, username, email, password, role, created_at, is_active, restricted, email_verified) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID.Hex(), user.Username, user.Email, user.Password, user.Role, user.CreatedAt.UnixNano(), user.IsActive,
+		user.Restricted, user.EmailVerified)
+	if err != nil && isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *sqlStore) FindUserByLogin(ctx context.Context, usernameOrEmail string) (*User, error) {
+	return s.findUser(ctx, `WHERE (u.username = ? OR u.email = ?) AND u.is_active = ?`, usernameOrEmail, usernameOrEmail, true)
+}
+
+func (s *sqlStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	return s.findUser(ctx, `WHERE u.id = ? AND u.is_active = ?`, id.Hex(), true)
+}
+
+func (s *sqlStore) FindUserByRefreshToken(ctx context.Context, hashed string) (*User, error) {
+	return s.findUser(ctx, `WHERE s.token_hash = ?`, hashed)
+}
+
+func (s *sqlStore) SetTagRules(ctx context.Context, id primitive.ObjectID, rules []TagRule) error {
+	encoded, err := jsonOrNil(rules, len(rules) > 0)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `UPDATE users SET tag_rules = ? WHERE id = ?`, encoded, id.Hex())
+	return err
+}
+
+func (s *sqlStore) SetTimezone(ctx context.Context, id primitive.ObjectID, timezone string) error {
+	_, err := s.exec(ctx, `UPDATE users SET timezone = ? WHERE id = ?`, timezone, id.Hex())
+	return err
+}
+
+func (s *sqlStore) SetUserActive(ctx context.Context, id primitive.ObjectID, active bool) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE users SET is_active = ?, deactivated_at = NULL WHERE id = ?`, active, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) DeactivateUser(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.rebind(`UPDATE users SET is_active = ?, deactivated_at = ? WHERE id = ? AND is_active = ?`),
+		false, at.UnixNano(), id.Hex(), true)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE user_id = ?`), id.Hex()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) FindDeactivatedUser(ctx context.Context, usernameOrEmail string) (*User, error) {
+	return s.findUser(ctx, `WHERE (u.username = ? OR u.email = ?) AND u.is_active = ? AND u.deactivated_at IS NOT NULL`,
+		usernameOrEmail, usernameOrEmail, false)
+}
+
+func (s *sqlStore) ReactivateUser(ctx context.Context, id primitive.ObjectID, deactivatedAt time.Time) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE users SET is_active = ?, deactivated_at = NULL WHERE id = ? AND is_active = ? AND deactivated_at = ?`,
+		true, id.Hex(), false, deactivatedAt.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) InactiveUserIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.query(ctx, `SELECT id FROM users WHERE is_active = ?`, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) AddUsage(ctx context.Context, counts []UsageCount) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, count := range counts {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO api_usage (user_id, day, endpoint, requests, rate_limited) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, day, endpoint) DO UPDATE SET requests = api_usage.requests + excluded.requests,
+			rate_limited = api_usage.rate_limited + excluded.rate_limited`),
+			count.UserID, count.Day.Format(usageDayLayout), count.Endpoint, count.Requests, count.RateLimited); err != nil {
+			return err
+		}
+	}
+	// There is no TTL index here, so expired days go as new ones are written
+	cutoff := usageDay(clock.Now()).AddDate(0, 0, -usageRetentionDays)
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM api_usage WHERE day < ?`), cutoff.Format(usageDayLayout)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ListUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageCount, error) {
+	rows, err := s.query(ctx, `SELECT day, endpoint, requests, rate_limited FROM api_usage WHERE user_id = ? AND day >= ? AND day < ?`,
+		userID, from.Format(usageDayLayout), to.Format(usageDayLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []UsageCount
+	for rows.Next() {
+		var day string
+		count := UsageCount{UserID: userID}
+		if err := rows.Scan(&day, &count.Endpoint, &count.Requests, &count.RateLimited); err != nil {
+			return nil, err
+		}
+		if count.Day, err = time.Parse(usageDayLayout, day); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqlStore) RestrictedUserIDs(ctx context.Context, youngerThan time.Time) ([]string, error) {
+	rows, err := s.query(ctx, `SELECT id FROM users WHERE restricted = ? AND is_active = ? AND (email_verified = ? OR created_at > ?)`,
+		true, true, false, youngerThan.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) SetEmailVerified(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE users SET email_verified = ? WHERE id = ?`, true, id.Hex())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) SetRefreshToken(ctx context.Context, id primitive.ObjectID, hashed string, expiry time.Time) error {
+	if hashed == "" {
+		_, err := s.exec(ctx, `DELETE FROM sessions WHERE user_id = ?`, id.Hex())
+		return err
+	}
+	// One session per user, as on the other backends
+	_, err := s.exec(ctx, `INSERT INTO sessions (user_id, token_hash, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET token_hash = excluded.token_hash, expires_at = excluded.expires_at`,
+		id.Hex(), hashed, expiry.UnixNano())
+	return err
+}
+
+func (s *sqlStore) findUser(ctx context.Context, where string, args ...interface{}) (*User, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+sqlUserColumns+sqlUserFrom+where), args...)
+	var (
+		user                User
+		id                  string
+		created, tokenUntil int64
+		deactivated         int64
+		tagRules            string
+	)
+	err := row.Scan(&id, &user.Username, &user.Email, &user.Password, &user.Role, &created, &user.IsActive,
+		&user.RefreshToken, &tokenUntil, &tagRules, &user.Restricted, &user.EmailVerified, &deactivated, &user.Timezone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	user.CreatedAt = time.Unix(0, created).UTC()
+	if tagRules != "" {
+		if err := json.Unmarshal([]byte(tagRules), &user.TagRules); err != nil {
+			return nil, err
+		}
+	}
+	if tokenUntil != 0 {
+		user.RefreshTokenExpiry = time.Unix(0, tokenUntil).UTC()
+	}
+	if deactivated != 0 {
+		user.DeactivatedAt = time.Unix(0, deactivated).UTC()
+	}
+	return &user, nil
+}
+
+// ----------------------------------------------------------------------------
+// Links
+// ----------------------------------------------------------------------------
+
+const sqlURLColumns = `id, short_url, long_url, domain, user_id, created_at, updated_at, expires_at, clicks,
+	is_active, last_clicked, title, description, og, deep_link, redirect_type, cache_max_age, signed, deactivated_reason,
+	allowed_referrers, deny_missing_referrer, referrer_fallback_url, blocked_clicks,
+	favicon_url, favicon_data, accent_color, favicon_fetched_at, created_ip, created_user_agent,
+	resolved_destination, redirect_chain_length, on_expire, expire_fallback_url, abuse_flagged,
+	daily_click_limit, daily_click_timezone, budget_fallback_url, paused_until, folder_id, pinned,
+	analytics_disabled, allowed_countries, blocked_countries, geo_fallback_url, public_note, internal`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLURL(row rowScanner) (*URLData, error) {
+	var (
+		link                          URLData
+		id                            string
+		created                       int64
+		updated, expires, lastClicked sql.NullInt64
+		faviconFetched, pausedUntil   sql.NullInt64
+		createdIP, createdUserAgent   sql.NullString
+		og, deepLink, referrers       sql.NullString
+		allowedCountries              sql.NullString
+		blockedCountries              sql.NullString
+		cacheMaxAge                   sql.NullInt64
+	)
+	err := row.Scan(&id, &link.ShortURL, &link.LongURL, &link.Domain, &link.UserID, &created, &updated, &expires,
+		&link.Clicks, &link.IsActive, &lastClicked, &link.Title, &link.Description, &og, &deepLink,
+		&link.RedirectType, &cacheMaxAge, &link.Signed, &link.DeactivatedReason,
+		&referrers, &link.DenyMissingReferrer, &link.ReferrerFallbackURL, &link.BlockedClicks,
+		&link.FaviconURL, &link.FaviconData, &link.AccentColor, &faviconFetched,
+		&createdIP, &createdUserAgent, &link.ResolvedDestination, &link.RedirectChainLength,
+		&link.OnExpire, &link.ExpireFallbackURL, &link.AbuseFlagged,
+		&link.DailyClickLimit, &link.DailyClickTimezone, &link.BudgetFallbackURL, &pausedUntil, &link.FolderID, &link.Pinned,
+		&link.AnalyticsDisabled, &allowedCountries, &blockedCountries, &link.GeoFallbackURL, &link.PublicNote, &link.Internal)
+	if err != nil {
+		return nil, err
+	}
+	if link.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	link.CreatedAt = time.Unix(0, created).UTC()
+	link.UpdatedAt = nullTime(updated)
+	link.ExpiresAt = nullTime(expires)
+	link.LastClicked = nullTime(lastClicked)
+	link.FaviconFetchedAt = nullTime(faviconFetched)
+	link.PausedUntil = nullTime(pausedUntil)
+	if createdIP.Valid {
+		link.CreatedIP = &createdIP.String
+	}
+	if createdUserAgent.Valid {
+		link.CreatedUserAgent = &createdUserAgent.String
+	}
+	if cacheMaxAge.Valid {
+		age := int(cacheMaxAge.Int64)
+		link.CacheMaxAge = &age
+	}
+	if og.Valid {
+		if err := json.Unmarshal([]byte(og.String), &link.OG); err != nil {
+			return nil, err
+		}
+	}
+	if deepLink.Valid {
+		if err := json.Unmarshal([]byte(deepLink.String), &link.DeepLink); err != nil {
+			return nil, err
+		}
+	}
+	if referrers.Valid {
+		if err := json.Unmarshal([]byte(referrers.String), &link.AllowedReferrers); err != nil {
+			return nil, err
+		}
+	}
+	if allowedCountries.Valid {
+		if err := json.Unmarshal([]byte(allowedCountries.String), &link.AllowedCountries); err != nil {
+			return nil, err
+		}
+	}
+	if blockedCountries.Valid {
+		if err := json.Unmarshal([]byte(blockedCountries.String), &link.BlockedCountries); err != nil {
+			return nil, err
+		}
+	}
+	link.ClickHistory = []ClickHistory{}
+	return &link, nil
+}
+
+func nullTime(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(0, n.Int64).UTC()
+	return &t
+}
+
+func nanosOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+func jsonOrNil(v interface{}, present bool) (interface{}, error) {
+	if !present {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *sqlStore) InsertLink(ctx context.Context, link *URLData) error {
+	og, err := jsonOrNil(link.OG, link.OG != nil)
+	if err != nil {
+		return err
+	}
+	deepLink, err := jsonOrNil(link.DeepLink, link.DeepLink != nil)
+	if err != nil {
+		return err
+	}
+	referrers, err := jsonOrNil(link.AllowedReferrers, len(link.AllowedReferrers) > 0)
+	if err != nil {
+		return err
+	}
+	allowedCountries, err := jsonOrNil(link.AllowedCountries, len(link.AllowedCountries) > 0)
+	if err != nil {
+		return err
+	}
+	blockedCountries, err := jsonOrNil(link.BlockedCountries, len(link.BlockedCountries) > 0)
+	if err != nil {
+		return err
+	}
+	var cacheMaxAge interface{}
+	if link.CacheMaxAge != nil {
+		cacheMaxAge = *link.CacheMaxAge
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := primitive.NewObjectID()
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO urls (`+sqlURLColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		id.Hex(), link.ShortURL, link.LongURL, link.Domain, link.UserID, link.CreatedAt.UnixNano(),
+		nanosOrNil(link.UpdatedAt), nanosOrNil(link.ExpiresAt), link.Clicks, link.IsActive, nanosOrNil(link.LastClicked),
+		link.Title, link.Description, og, deepLink, link.RedirectType, cacheMaxAge, link.Signed, link.DeactivatedReason,
+		referrers, link.DenyMissingReferrer, link.ReferrerFallbackURL, link.BlockedClicks,
+		link.FaviconURL, link.FaviconData, link.AccentColor, nanosOrNil(link.FaviconFetchedAt),
+		link.CreatedIP, link.CreatedUserAgent, link.ResolvedDestination, link.RedirectChainLength,
+		link.OnExpire, link.ExpireFallbackURL, link.AbuseFlagged,
+		link.DailyClickLimit, link.DailyClickTimezone, link.BudgetFallbackURL, nanosOrNil(link.PausedUntil), link.FolderID, link.Pinned,
+		link.AnalyticsDisabled, allowedCountries, blockedCountries, link.GeoFallbackURL, link.PublicNote, link.Internal)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicate
+		}
+		return err
+	}
+	for i, tag := range link.Tags {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO url_tags (url_id, tag, position) VALUES (?, ?, ?)`), id.Hex(), tag, i); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	link.ID = id
+	return nil
+}
+
+func (s *sqlStore) FindLinkByCode(ctx context.Context, code string) (*URLData, error) {
+	return s.findLink(ctx, `WHERE short_url = ?`, code)
+}
+
+func (s *sqlStore) FindRedirectTarget(ctx context.Context, code string) (*URLData, error) {
+	return s.findLink(ctx, `WHERE short_url = ? AND is_active = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		code, true, clock.Now().UnixNano())
+}
+
+func (s *sqlStore) FindActiveLink(ctx context.Context, userID, longURL, domain string) (*URLData, error) {
+	return s.findLink(ctx, `WHERE user_id = ? AND long_url = ? AND domain = ? AND is_active = ?`,
+		userID, longURL, domain, true)
+}
+
+func (s *sqlStore) FindExpiredDuplicate(ctx context.Context, userID, longURL, domain string) (*URLData, error) {
+	return s.findLink(ctx, `WHERE user_id = ? AND long_url = ? AND domain = ? AND is_active = ? AND deactivated_reason = ?
+		ORDER BY expires_at DESC LIMIT 1`, userID, longURL, domain, false, DeactivatedExpired)
+}
+
+func (s *sqlStore) ReviveLink(ctx context.Context, link *URLData, expiresAt time.Time) (bool, error) {
+	// There is no unique index on active destinations here, so the update itself refuses to
+	// make a second active link to the same destination
+	res, err := s.exec(ctx, `UPDATE urls SET is_active = ?, deactivated_reason = ?, expires_at = ?, updated_at = ?
+		WHERE id = ? AND is_active = ? AND deactivated_reason = ?
+		AND NOT EXISTS (SELECT 1 FROM urls active WHERE active.user_id = ? AND active.long_url = ?
+			AND active.domain = ? AND active.is_active = ?)`,
+		true, "", expiresAt.UTC().UnixNano(), clock.Now().UnixNano(),
+		link.ID.Hex(), false, DeactivatedExpired,
+		link.UserID, link.LongURL, link.Domain, true)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return n > 0, err
+	}
+	if _, err := s.FindActiveLink(ctx, link.UserID, link.LongURL, link.Domain); err == nil {
+		return false, ErrDuplicate
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *sqlStore) findLink(ctx context.Context, where string, args ...interface{}) (*URLData, error) {
+	link, err := scanSQLURL(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+sqlURLColumns+` FROM urls `+where), args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.loadTags(ctx, []*URLData{link}); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (s *sqlStore) RecordClick(ctx context.Context, link *URLData, click ClickHistory) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	at := click.Timestamp.UTC()
+	if _, err := tx.ExecContext(ctx, s.rebind(`UPDATE urls SET clicks = clicks + 1, last_clicked = ? WHERE id = ?`),
+		at.UnixNano(), link.ID.Hex()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO clicks (id, url_id, clicked_at, day, ip, user_agent, branch, signed, referrer_host) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		primitive.NewObjectID().Hex(), link.ID.Hex(), at.UnixNano(), at.Format("2006-01-02"),
+		click.IP, click.UserAgent, click.Branch, click.Signed, click.ReferrerHost); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) RecordBlockedClick(ctx context.Context, link *URLData) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`UPDATE urls SET blocked_clicks = blocked_clicks + 1 WHERE id = ?`), link.ID.Hex())
+	return err
+}
+
+func (s *sqlStore) AddLinkOutcomes(ctx context.Context, counts []LinkOutcomeCount) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, count := range counts {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO link_outcomes (url_id, day, outcome, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (url_id, day, outcome) DO UPDATE SET count = link_outcomes.count + excluded.count`),
+			count.URLID.Hex(), count.Day.Format(usageDayLayout), count.Outcome, count.Count); err != nil {
+			return err
+		}
+	}
+	// Like api_usage, expired days go as new ones are written
+	cutoff := usageDay(clock.Now()).AddDate(0, 0, -outcomeRetentionDays)
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM link_outcomes WHERE day < ?`), cutoff.Format(usageDayLayout)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ListLinkOutcomes(ctx context.Context, link *URLData, from, to time.Time) ([]LinkOutcomeCount, error) {
+	rows, err := s.query(ctx, `SELECT day, outcome, count FROM link_outcomes WHERE url_id = ? AND day >= ? AND day < ?`,
+		link.ID.Hex(), from.Format(usageDayLayout), to.Format(usageDayLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []LinkOutcomeCount
+	for rows.Next() {
+		var day string
+		count := LinkOutcomeCount{URLID: link.ID}
+		if err := rows.Scan(&day, &count.Outcome, &count.Count); err != nil {
+			return nil, err
+		}
+		if count.Day, err = time.Parse(usageDayLayout, day); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqlStore) CountDailyClick(ctx context.Context, link *URLData, day string, keepUntil time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO daily_clicks (url_id, day, clicks, expires_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT (url_id, day) DO UPDATE SET clicks = daily_clicks.clicks + 1`),
+		link.ID.Hex(), day, keepUntil.UnixNano()); err != nil {
+		return 0, err
+	}
+	var clicks int
+	if err := tx.QueryRowContext(ctx, s.rebind(`SELECT clicks FROM daily_clicks WHERE url_id = ? AND day = ?`),
+		link.ID.Hex(), day).Scan(&clicks); err != nil {
+		return 0, err
+	}
+	return clicks, tx.Commit()
+}
+
+func (s *sqlStore) PauseLink(ctx context.Context, link *URLData, until time.Time) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE urls SET paused_until = ? WHERE id = ? AND (paused_until IS NULL OR paused_until < ?)`,
+		until.UnixNano(), link.ID.Hex(), until.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) ResumePausedLinks(ctx context.Context, now time.Time, limit int) ([]*URLData, error) {
+	if _, err := s.exec(ctx, `DELETE FROM daily_clicks WHERE expires_at <= ?`, now.UnixNano()); err != nil {
+		return nil, err
+	}
+	paused, err := s.listLinks(ctx, `WHERE paused_until <= ? ORDER BY paused_until LIMIT ?`, now.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	resumed := []*URLData{}
+	for _, link := range paused {
+		// Only the run that clears this pause reports it
+		res, err := s.exec(ctx, `UPDATE urls SET paused_until = NULL WHERE id = ? AND paused_until = ?`,
+			link.ID.Hex(), link.PausedUntil.UnixNano())
+		if err != nil {
+			return resumed, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			resumed = append(resumed, link)
+		}
+	}
+	return resumed, nil
+}
+
+func (s *sqlStore) CountActiveLinks(ctx context.Context, userID string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM urls WHERE user_id = ? AND is_active = ?`), userID, true).Scan(&n)
+	return n, err
+}
+
+// ListLinks returns the same page and statistics as the MongoDB $facet aggregation, using
+// GROUP BY queries for the distributions
+func (s *sqlStore) ListLinks(ctx context.Context, userID string, filter LinkFilter, skip, limit int, withStats bool, _ []string) ([]map[string]interface{}, int64, map[string]interface{}, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	if skip < 0 {
+		skip = 0
+	}
+
+	where, args := sqlLinkFilter(userID, filter, clock.Now())
+	var total int64
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM urls `+where), args...).Scan(&total); err != nil {
+		return nil, 0, nil, err
+	}
+	links, err := s.listLinks(ctx, where+` ORDER BY pinned DESC, created_at DESC, short_url LIMIT ? OFFSET ?`, append(args, limit, skip)...)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := s.loadDeepLinkClicks(ctx, links); err != nil {
+		return nil, 0, nil, err
+	}
+
+	page := []map[string]interface{}{}
+	for _, link := range links {
+		doc := linkSummary(link)
+		if link.DeepLink != nil {
+			doc["deep_link"] = link.DeepLink
+		}
+		if len(link.DeepLinkClicks) > 0 {
+			doc["deep_link_clicks"] = link.DeepLinkClicks
+		}
+		page = append(page, doc)
+	}
+
+	if !withStats {
+		return page, total, nil, nil
+	}
+	stats, err := s.linkStats(ctx, userID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return page, total, stats, nil
+}
+
+// sqlLinkFilter returns the WHERE clause and arguments selecting the user's links passing
+// filter at now
+func sqlLinkFilter(userID string, filter LinkFilter, now time.Time) (string, []interface{}) {
+	where := `WHERE user_id = ?`
+	args := []interface{}{userID}
+	switch filter.Status {
+	case linkStatusAll:
+		where += ` AND deactivated_reason NOT IN (?, ?)`
+		args = append(args, DeactivatedDraft, DeactivatedDeleted)
+	case statusExpired:
+		where += ` AND ((is_active = ? AND expires_at <= ?) OR deactivated_reason = ?)`
+		args = append(args, true, now.UnixNano(), DeactivatedExpired)
+	default:
+		where += ` AND is_active = ? AND (expires_at IS NULL OR expires_at > ?)`
+		args = append(args, true, now.UnixNano())
+	}
+	if filter.FolderIDs != nil && len(filter.FolderIDs) == 0 {
+		where += ` AND 1 = 0`
+	} else if filter.FolderIDs != nil {
+		where += ` AND folder_id IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(filter.FolderIDs)), ", ") + `)`
+		for _, id := range filter.FolderIDs {
+			args = append(args, id)
+		}
+	}
+	if filter.Pinned != nil {
+		where += ` AND pinned = ?`
+		args = append(args, *filter.Pinned)
+	}
+	if len(filter.Tags) > 0 {
+		where += ` AND id IN (SELECT url_id FROM url_tags WHERE tag IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(filter.Tags)), ", ") + `))`
+		for _, tag := range filter.Tags {
+			args = append(args, tag)
+		}
+	}
+	if filter.Domain != "" {
+		where += ` AND domain = ?`
+		args = append(args, filter.Domain)
+	}
+	return where, args
+}
+
+func (s *sqlStore) listLinks(ctx context.Context, where string, args ...interface{}) ([]*URLData, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlURLColumns+` FROM urls `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []*URLData
+	for rows.Next() {
+		link, err := scanSQLURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return links, s.loadTags(ctx, links)
+}
+
+// sqlQuerier is *sql.DB, or *sql.Tx for reads that must see the transaction's snapshot
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadTags fills Tags for links with one query
+func (s *sqlStore) loadTags(ctx context.Context, links []*URLData) error {
+	return s.loadTagsWith(ctx, s.db, links)
+}
+
+// loadTagsWith is loadTags through q
+func (s *sqlStore) loadTagsWith(ctx context.Context, q sqlQuerier, links []*URLData) error {
+	if len(links) == 0 {
+		return nil
+	}
+	byID, placeholders, args := linkIDArgs(links)
+	rows, err := q.QueryContext(ctx, s.rebind(`SELECT url_id, tag FROM url_tags WHERE url_id IN (`+placeholders+`) ORDER BY url_id, position, tag`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		byID[id].Tags = append(byID[id].Tags, tag)
+	}
+	return rows.Err()
+}
+
+// loadDeepLinkClicks fills DeepLinkClicks for links from the clicks table
+func (s *sqlStore) loadDeepLinkClicks(ctx context.Context, links []*URLData) error {
+	if len(links) == 0 {
+		return nil
+	}
+	byID, placeholders, args := linkIDArgs(links)
+	rows, err := s.query(ctx, `SELECT url_id, branch, COUNT(*) FROM clicks WHERE url_id IN (`+placeholders+`) AND branch <> '' GROUP BY url_id, branch`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, branch string
+			n          int
+		)
+		if err := rows.Scan(&id, &branch, &n); err != nil {
+			return err
+		}
+		link := byID[id]
+		if link.DeepLinkClicks == nil {
+			link.DeepLinkClicks = make(map[string]int)
+		}
+		link.DeepLinkClicks[branch] = n
+	}
+	return rows.Err()
+}
+
+func linkIDArgs(links []*URLData) (map[string]*URLData, string, []interface{}) {
+	byID := make(map[string]*URLData, len(links))
+	args := make([]interface{}, 0, len(links))
+	for _, link := range links {
+		byID[link.ID.Hex()] = link
+		args = append(args, link.ID.Hex())
+	}
+	return byID, strings.TrimSuffix(strings.Repeat("?, ", len(links)), ", "), args
+}
+
+// linkStats builds the analytics statistics for one user's active links
+func (s *sqlStore) linkStats(ctx context.Context, userID string) (map[string]interface{}, error) {
+	stats := map[string]interface{}{
+		"total_urls":         0,
+		"total_clicks":       0,
+		"avg_clicks_per_url": 0,
+	}
+	var (
+		urls   int64
+		clicks int64
+	)
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*), COALESCE(SUM(clicks), 0) FROM urls WHERE user_id = ? AND is_active = ?`),
+		userID, true).Scan(&urls, &clicks); err != nil {
+		return nil, err
+	}
+	if urls > 0 {
+		stats["total_urls"] = urls
+		stats["total_clicks"] = clicks
+		stats["avg_clicks_per_url"] = math.Round(float64(clicks)/float64(urls)*100) / 100
+	}
+
+	since := time.Now().AddDate(0, 0, -30).UnixNano()
+	clicksOverTime, err := s.countRows(ctx, "date", `SELECT c.day, COUNT(*) FROM clicks c JOIN urls u ON u.id = c.url_id
+		WHERE u.user_id = ? AND u.is_active = ? AND u.created_at >= ? AND c.clicked_at >= ?
+		GROUP BY c.day ORDER BY c.day`, userID, true, since, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range clicksOverTime {
+		row["clicks"] = row["count"]
+		delete(row, "count")
+	}
+	stats["clicks_over_time"] = clicksOverTime
+
+	if stats["tag_distribution"], err = s.countRows(ctx, "tag", `SELECT t.tag, COUNT(*) AS n FROM url_tags t JOIN urls u ON u.id = t.url_id
+		WHERE u.user_id = ? AND u.is_active = ? GROUP BY t.tag ORDER BY n DESC, t.tag LIMIT 10`, userID, true); err != nil {
+		return nil, err
+	}
+	if stats["domain_distribution"], err = s.countRows(ctx, "domain", `SELECT domain, COUNT(*) AS n FROM urls
+		WHERE user_id = ? AND is_active = ? GROUP BY domain ORDER BY n DESC, domain`, userID, true); err != nil {
+		return nil, err
+	}
+
+	top, err := s.listLinks(ctx, `WHERE user_id = ? AND is_active = ? AND clicks > 0 ORDER BY clicks DESC, short_url LIMIT 10`, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	topLinks := []map[string]interface{}{}
+	for _, link := range top {
+		topLinks = append(topLinks, linkSummary(link))
+	}
+	stats["top_links"] = topLinks
+
+	if stats["status_counts"], err = s.statusCounts(ctx, userID, clock.Now()); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// statusCounts counts all of a user's links by status, as statusCategory classifies them
+func (s *sqlStore) statusCounts(ctx context.Context, userID string, now time.Time) (map[string]interface{}, error) {
+	var active, expired, disabled, draft, expiring7d, expiring30d int64
+	live := `is_active = ? AND (expires_at IS NULL OR expires_at > ?)`
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT
+		COALESCE(SUM(CASE WHEN deactivated_reason = ? THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN deactivated_reason <> ? AND `+live+` THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN deactivated_reason <> ? AND NOT (`+live+`) AND (is_active = ? OR deactivated_reason = ?) THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN deactivated_reason <> ? AND is_active = ? AND expires_at > ? AND expires_at <= ? THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN deactivated_reason <> ? AND is_active = ? AND expires_at > ? AND expires_at <= ? THEN 1 ELSE 0 END), 0),
+		COUNT(*)
+		FROM urls WHERE user_id = ?`),
+		DeactivatedDraft,
+		DeactivatedDraft, true, now.UnixNano(),
+		DeactivatedDraft, true, now.UnixNano(), true, DeactivatedExpired,
+		DeactivatedDraft, true, now.UnixNano(), now.AddDate(0, 0, 7).UnixNano(),
+		DeactivatedDraft, true, now.UnixNano(), now.AddDate(0, 0, 30).UnixNano(),
+		userID).Scan(&draft, &active, &expired, &expiring7d, &expiring30d, &disabled); err != nil {
+		return nil, err
+	}
+	counts := newStatusCounts()
+	counts[statusActive] = active
+	counts[statusExpired] = expired
+	// Every link not counted elsewhere is disabled
+	counts[statusDisabled] = disabled - active - expired - draft
+	counts[statusDraft] = draft
+	counts["expiring_7d"] = expiring7d
+	counts["expiring_30d"] = expiring30d
+	return counts, nil
+}
+
+// countRows runs a (label, count) GROUP BY query into {label, count} rows
+func (s *sqlStore) countRows(ctx context.Context, label, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			key string
+			n   int64
+		)
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		result = append(result, map[string]interface{}{label: key, "count": n})
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) PinLink(ctx context.Context, userID, code string, pinned bool, limit int) (*URLData, error) {
+	if pinned {
+		// Concurrent pins can overshoot the limit by a few; it only keeps the top of listings short
+		var count int
+		if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM urls WHERE user_id = ? AND pinned = ? AND is_active = ? AND short_url <> ?`),
+			userID, true, true, code).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count >= limit {
+			return nil, ErrLimitReached
+		}
+	}
+	res, err := s.exec(ctx, `UPDATE urls SET pinned = ?, updated_at = ? WHERE short_url = ? AND user_id = ? AND is_active = ?`,
+		pinned, clock.Now().UnixNano(), code, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.findLink(ctx, `WHERE short_url = ?`, code)
+}
+
+func (s *sqlStore) SetLinkAnalytics(ctx context.Context, userID, code string, disabled, purge bool) (*URLData, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE urls SET analytics_disabled = ?, updated_at = ?`
+	if purge {
+		query += `, clicks = 0, last_clicked = NULL`
+	}
+	res, err := tx.ExecContext(ctx, s.rebind(query+` WHERE short_url = ? AND user_id = ? AND is_active = ?`),
+		disabled, clock.Now().UnixNano(), code, userID, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, 0, err
+	} else if n == 0 {
+		return nil, 0, ErrNotFound
+	}
+	var purged int64
+	if purge {
+		res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM clicks WHERE url_id = (SELECT id FROM urls WHERE short_url = ?)`), code)
+		if err != nil {
+			return nil, 0, err
+		}
+		if purged, err = res.RowsAffected(); err != nil {
+			return nil, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM link_outcomes WHERE url_id = (SELECT id FROM urls WHERE short_url = ?)`), code); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	link, err := s.findLink(ctx, `WHERE short_url = ?`, code)
+	return link, purged, err
+}
+
+func (s *sqlStore) EditLink(ctx context.Context, link *URLData, edit LinkEdit) (bool, error) {
+	longURL := link.LongURL
+	if edit.LongURL != nil {
+		longURL = *edit.LongURL
+	}
+	active := link.IsActive
+	if edit.Active != nil {
+		active = *edit.Active
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if edit.Pinned != nil && *edit.Pinned {
+		// Concurrent pins can overshoot the limit by a few, as with PinLink
+		var count int
+		if err := tx.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM urls WHERE user_id = ? AND pinned = ? AND is_active = ? AND id <> ?`),
+			link.UserID, true, true, link.ID.Hex()).Scan(&count); err != nil {
+			return false, err
+		}
+		if count >= edit.PinLimit {
+			return false, ErrLimitReached
+		}
+	}
+
+	query := `UPDATE urls SET updated_at = ?`
+	args := []interface{}{clock.Now().UnixNano()}
+	if edit.LongURL != nil {
+		query += `, long_url = ?, resolved_destination = ?, redirect_chain_length = ?, favicon_url = ?, favicon_data = ?, accent_color = ?, favicon_fetched_at = NULL`
+		args = append(args, longURL, "", 0, "", "", "")
+	}
+	if edit.ExpiresAt != nil {
+		query += `, expires_at = ?`
+		args = append(args, edit.ExpiresAt.UTC().UnixNano())
+	}
+	if edit.Active != nil {
+		reason := ""
+		if !active {
+			reason = DeactivatedByOwner
+		}
+		query += `, is_active = ?, deactivated_reason = ?`
+		args = append(args, active, reason)
+	}
+	if edit.PublicNote != nil {
+		query += `, public_note = ?`
+		args = append(args, *edit.PublicNote)
+	}
+	if edit.Internal != nil {
+		query += `, internal = ?`
+		args = append(args, *edit.Internal)
+	}
+	if edit.Pinned != nil {
+		query += `, pinned = ?`
+		args = append(args, *edit.Pinned)
+	}
+	query += ` WHERE id = ? AND user_id = ?`
+	args = append(args, link.ID.Hex(), link.UserID)
+	if link.UpdatedAt != nil {
+		query += ` AND updated_at = ?`
+		args = append(args, link.UpdatedAt.UnixNano())
+	} else {
+		query += ` AND updated_at IS NULL`
+	}
+	if active {
+		// There is no unique index on active destinations here, so the update itself refuses
+		// to make a second active link to the same destination
+		query += ` AND NOT EXISTS (SELECT 1 FROM urls active WHERE active.user_id = ? AND active.long_url = ?
+			AND active.domain = ? AND active.is_active = ? AND active.id <> ?)`
+		args = append(args, link.UserID, longURL, link.Domain, true, link.ID.Hex())
+	}
+	res, err := tx.ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		tx.Rollback()
+		if !active {
+			return false, nil
+		}
+		if other, err := s.FindActiveLink(ctx, link.UserID, longURL, link.Domain); err == nil && other.ID != link.ID {
+			return false, ErrDuplicate
+		} else if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		return false, nil
+	}
+	if edit.Tags != nil {
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM url_tags WHERE url_id = ?`), link.ID.Hex()); err != nil {
+			return false, err
+		}
+		for i, tag := range *edit.Tags {
+			if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO url_tags (url_id, tag, position) VALUES (?, ?, ?)`), link.ID.Hex(), tag, i); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) DeactivateLink(ctx context.Context, userID, code, reason string) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE urls SET is_active = ?, deactivated_reason = ?, updated_at = ? WHERE short_url = ? AND user_id = ?`,
+		false, reason, clock.Now().UnixNano(), code, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) CodeHolder(ctx context.Context, code string) (*CodeReservation, error) {
+	return linkCodeHolder(ctx, s, code)
+}
+
+func (s *sqlStore) ReleaseDraft(ctx context.Context, code string) (bool, error) {
+	// Placeholders are inserted without tags or clicks, so no child rows reference them
+	res, err := s.exec(ctx, `DELETE FROM urls WHERE short_url = ? AND deactivated_reason = ?`, code, DeactivatedDraft)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) SetFavicon(ctx context.Context, link *URLData, favicon LinkFavicon) error {
+	_, err := s.exec(ctx, `UPDATE urls SET favicon_url = ?, favicon_data = ?, accent_color = ?,
+		favicon_fetched_at = COALESCE(?, favicon_fetched_at) WHERE id = ?`,
+		favicon.URL, favicon.Data, favicon.AccentColor, nanosOrNil(favicon.FetchedAt), link.ID.Hex())
+	return err
+}
+
+func (s *sqlStore) StaleFavicons(ctx context.Context, before time.Time, limit int) ([]*URLData, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlURLColumns+` FROM urls WHERE is_active = ?
+		AND (favicon_fetched_at IS NULL OR favicon_fetched_at < ?) LIMIT ?`, true, before.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []*URLData{}
+	for rows.Next() {
+		link, err := scanSQLURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *sqlStore) SetRedirectProbe(ctx context.Context, link *URLData, resolved string, hops int) error {
+	_, err := s.exec(ctx, `UPDATE urls SET resolved_destination = ?, redirect_chain_length = ? WHERE id = ?`,
+		resolved, hops, link.ID.Hex())
+	return err
+}
+
+// ApplyTagRule matches hosts in Go, as SQLite has no portable way to parse URLs. Links and
+// tags are read in the transaction that adds the missing tags, and each link is written only
+// if its updated_at is still the one read, so a concurrent edit is not overwritten; that
+// link is left for the next run.
+func (s *sqlStore) ApplyTagRule(ctx context.Context, userID string, rule TagRule) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, s.rebind(`SELECT id, long_url, updated_at FROM urls WHERE user_id = ? AND is_active = ?`), userID, true)
+	if err != nil {
+		return 0, err
+	}
+	var links []*URLData
+	for rows.Next() {
+		var id, longURL string
+		var updated sql.NullInt64
+		if err := rows.Scan(&id, &longURL, &updated); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if host := destinationHost(longURL); host == "" || !rule.matches(host) {
+			continue
+		}
+		link := &URLData{LongURL: longURL, UpdatedAt: nullTime(updated)}
+		if link.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := s.loadTagsWith(ctx, tx, links); err != nil {
+		return 0, err
+	}
+
+	now := clock.Now().UnixNano()
+	var modified int64
+	for _, link := range links {
+		tags, _ := applyTagRules([]TagRule{rule}, link.LongURL, link.Tags)
+		if len(tags) == len(link.Tags) {
+			continue
+		}
+		query := `UPDATE urls SET updated_at = ? WHERE id = ? AND updated_at IS NULL`
+		args := []interface{}{now, link.ID.Hex()}
+		if link.UpdatedAt != nil {
+			query = `UPDATE urls SET updated_at = ? WHERE id = ? AND updated_at = ?`
+			args = append(args, link.UpdatedAt.UnixNano())
+		}
+		res, err := tx.ExecContext(ctx, s.rebind(query), args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		for i, tag := range tags[len(link.Tags):] {
+			if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO url_tags (url_id, tag, position) VALUES (?, ?, ?)`), link.ID.Hex(), tag, len(link.Tags)+i); err != nil {
+				return 0, err
+			}
+		}
+		modified++
+	}
+	return modified, tx.Commit()
+}
+
+// ListClicks pages on (clicked_at, id). Device and bot are derived from the stored user agent,
+// so those filters are applied while reading rows in page order rather than in SQL.
+// ClickHeatmap buckets the clicks in Go: bots are told apart by user agent, and neither
+// driver can convert to a time zone portably
+func (s *sqlStore) ClickHeatmap(ctx context.Context, userID string, link *URLData, since time.Time, loc *time.Location) (ClickHeatmap, error) {
+	statement := `SELECT c.clicked_at, c.user_agent FROM clicks c JOIN urls u ON u.id = c.url_id WHERE u.user_id = ? AND c.clicked_at >= ?`
+	args := []interface{}{userID, since.UnixNano()}
+	if link != nil {
+		statement = `SELECT clicked_at, user_agent FROM clicks WHERE url_id = ? AND clicked_at >= ?`
+		args = []interface{}{link.ID.Hex(), since.UnixNano()}
+	}
+	rows, err := s.query(ctx, statement, args...)
+	if err != nil {
+		return ClickHeatmap{}, err
+	}
+	defer rows.Close()
+
+	var heatmap ClickHeatmap
+	for rows.Next() {
+		var clickedAt int64
+		var userAgent string
+		if err := rows.Scan(&clickedAt, &userAgent); err != nil {
+			return ClickHeatmap{}, err
+		}
+		if !isBotUserAgent(userAgent) {
+			heatmap.add(time.Unix(0, clickedAt), loc)
+		}
+	}
+	return heatmap, rows.Err()
+}
+
+// CountClickWindow reads the window's clicks and counts them in Go, since bots are only
+// told apart by user agent here
+func (s *sqlStore) CountClickWindow(ctx context.Context, link *URLData, from, to time.Time) (*ClickWindow, error) {
+	rows, err := s.query(ctx, `SELECT ip, user_agent, referrer_host FROM clicks WHERE url_id = ? AND clicked_at >= ? AND clicked_at < ?`,
+		link.ID.Hex(), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	window := newClickWindow(from, to)
+	visitors := make(map[string]bool)
+	for rows.Next() {
+		var ip, userAgent, host string
+		if err := rows.Scan(&ip, &userAgent, &host); err != nil {
+			return nil, err
+		}
+		if isBotUserAgent(userAgent) {
+			continue
+		}
+		window.Clicks++
+		window.addReferrer(host, 1)
+		if hash := clickIPHash(ip); hash != "" {
+			visitors[hash] = true
+		}
+	}
+	window.UniqueVisitors = int64(len(visitors))
+	return window, rows.Err()
+}
+
+// CountLinkClicks reads the link's clicks and counts them in Go, like CountClickWindow
+func (s *sqlStore) CountLinkClicks(ctx context.Context, link *URLData) (*ClickCounters, error) {
+	rows, err := s.query(ctx, `SELECT clicked_at, ip, user_agent FROM clicks WHERE url_id = ?`, link.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := &ClickCounters{}
+	visitors := make(map[string]bool)
+	for rows.Next() {
+		var clickedAt int64
+		var ip, userAgent string
+		if err := rows.Scan(&clickedAt, &ip, &userAgent); err != nil {
+			return nil, err
+		}
+		counters.add(time.Unix(0, clickedAt).UTC())
+		if isBotUserAgent(userAgent) {
+			counters.BotClicks++
+		} else if hash := clickIPHash(ip); hash != "" {
+			visitors[hash] = true
+		}
+	}
+	counters.UniqueClicks = int64(len(visitors))
+	return counters, rows.Err()
+}
+
+func (s *sqlStore) SetClickCounters(ctx context.Context, link *URLData, counters ClickCounters) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE urls SET clicks = ?, last_clicked = ? WHERE id = ? AND clicks = ?`,
+		counters.Clicks, nanosOrNil(counters.LastClicked), link.ID.Hex(), link.Clicks)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) ListUserLinks(ctx context.Context, userID string, limit int) ([]*URLData, error) {
+	return s.listLinks(ctx, `WHERE user_id = ? AND deactivated_reason <> ? ORDER BY short_url LIMIT ?`,
+		userID, DeactivatedDraft, limit)
+}
+
+// SampleLinks orders by RANDOM(), which SQLite and PostgreSQL both have; it scans the table,
+// fine for a daily sample
+func (s *sqlStore) SampleLinks(ctx context.Context, size int) ([]*URLData, error) {
+	return s.listLinks(ctx, `WHERE deactivated_reason <> ? ORDER BY RANDOM() LIMIT ?`, DeactivatedDraft, size)
+}
+
+func (s *sqlStore) ListClicks(ctx context.Context, link *URLData, query ClickQuery) ([]ClickRecord, error) {
+	where := `url_id = ?`
+	args := []interface{}{link.ID.Hex()}
+	if !query.From.IsZero() {
+		where += ` AND clicked_at >= ?`
+		args = append(args, query.From.UnixNano())
+	}
+	if !query.To.IsZero() {
+		where += ` AND clicked_at < ?`
+		args = append(args, query.To.UnixNano())
+	}
+	if query.After != nil {
+		where += ` AND (clicked_at < ? OR (clicked_at = ? AND id < ?))`
+		after := query.After.Timestamp.UnixNano()
+		args = append(args, after, after, query.After.ID)
+	}
+	statement := `SELECT id, clicked_at, user_agent, branch, signed FROM clicks WHERE ` + where +
+		` ORDER BY clicked_at DESC, id DESC`
+	if query.Device == "" && query.Bot == nil {
+		statement += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+	rows, err := s.query(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []ClickRecord{}
+	for len(records) < query.Limit && rows.Next() {
+		var id string
+		var clickedAt int64
+		var click ClickHistory
+		if err := rows.Scan(&id, &clickedAt, &click.UserAgent, &click.Branch, &click.Signed); err != nil {
+			return nil, err
+		}
+		click.Timestamp = time.Unix(0, clickedAt)
+		if rec := clickRecordFor(id, click); query.admits(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) ExportClicks(ctx context.Context, query ClickExportQuery, fn func(ClickExportRow) error) error {
+	where := `u.user_id = ? AND c.clicked_at >= ? AND c.clicked_at < ?`
+	args := []interface{}{query.UserID, query.From.UnixNano(), query.To.UnixNano()}
+	if query.Link != nil {
+		where += ` AND c.url_id = ?`
+		args = append(args, query.Link.ID.Hex())
+	}
+	if query.After != nil {
+		where += ` AND (c.clicked_at > ? OR (c.clicked_at = ? AND c.id > ?))`
+		after := query.After.Timestamp.UnixNano()
+		args = append(args, after, after, query.After.ID)
+	}
+	args = append(args, query.Limit, query.Skip)
+	rows, err := s.query(ctx, `SELECT c.id, c.clicked_at, u.short_url, c.ip, c.user_agent, c.branch, c.signed
+		FROM clicks c JOIN urls u ON u.id = c.url_id WHERE `+where+` ORDER BY c.clicked_at, c.id LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, shortURL string
+		var clickedAt int64
+		var click ClickHistory
+		if err := rows.Scan(&id, &clickedAt, &shortURL, &click.IP, &click.UserAgent, &click.Branch, &click.Signed); err != nil {
+			return err
+		}
+		click.Timestamp = time.Unix(0, clickedAt)
+		rec := clickRecordFor(id, click)
+		if err := fn(ClickExportRow{
+			EventID:   id,
+			Timestamp: rec.Timestamp,
+			ShortURL:  shortURL,
+			Device:    rec.Device,
+			Bot:       rec.Bot,
+			Branch:    rec.Branch,
+			Signed:    rec.Signed,
+			IPHash:    clickIPHash(click.IP),
+		}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const sqlFolderColumns = `id, user_id, name, name_key, parent_id, path, depth, created_at, updated_at`
+
+func scanSQLFolder(row rowScanner) (*Folder, error) {
+	var (
+		folder           Folder
+		id               string
+		created, updated int64
+	)
+	if err := row.Scan(&id, &folder.UserID, &folder.Name, &folder.NameKey, &folder.ParentID, &folder.Path,
+		&folder.Depth, &created, &updated); err != nil {
+		return nil, err
+	}
+	var err error
+	if folder.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	folder.CreatedAt = time.Unix(0, created).UTC()
+	folder.UpdatedAt = time.Unix(0, updated).UTC()
+	return &folder, nil
+}
+
+func (s *sqlStore) InsertFolder(ctx context.Context, folder *Folder) error {
+	_, err := s.exec(ctx, `INSERT INTO folders (`+sqlFolderColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		folder.ID.Hex(), folder.UserID, folder.Name, folder.NameKey, folder.ParentID, folder.Path, folder.Depth,
+		folder.CreatedAt.UnixNano(), folder.UpdatedAt.UnixNano())
+	if err != nil && isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *sqlStore) FindFolder(ctx context.Context, userID string, id primitive.ObjectID) (*Folder, error) {
+	folder, err := scanSQLFolder(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+sqlFolderColumns+` FROM folders WHERE id = ? AND user_id = ?`),
+		id.Hex(), userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return folder, err
+}
+
+func (s *sqlStore) ListFolders(ctx context.Context, userID, pathPrefix string) ([]*Folder, error) {
+	// Paths are hex IDs and slashes, so the prefix holds no LIKE wildcards
+	rows, err := s.query(ctx, `SELECT `+sqlFolderColumns+` FROM folders WHERE user_id = ? AND path LIKE ? ORDER BY path`,
+		userID, pathPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	folders := []*Folder{}
+	for rows.Next() {
+		folder, err := scanSQLFolder(rows)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+func (s *sqlStore) UpdateFolders(ctx context.Context, folders []*Folder) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, folder := range folders {
+		if _, err := tx.ExecContext(ctx, s.rebind(`UPDATE folders SET name = ?, name_key = ?, parent_id = ?, path = ?, depth = ?, updated_at = ?
+			WHERE id = ? AND user_id = ?`),
+			folder.Name, folder.NameKey, folder.ParentID, folder.Path, folder.Depth, folder.UpdatedAt.UnixNano(),
+			folder.ID.Hex(), folder.UserID); err != nil {
+			if isUniqueViolation(err) {
+				return ErrDuplicate
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteFolder(ctx context.Context, folder *Folder) error {
+	_, err := s.exec(ctx, `DELETE FROM folders WHERE id = ? AND user_id = ?`, folder.ID.Hex(), folder.UserID)
+	return err
+}
+
+func (s *sqlStore) MoveLinksToFolder(ctx context.Context, userID string, codes []string, folderID string) (int64, error) {
+	if len(codes) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{folderID, clock.Now().UnixNano(), userID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+	res, err := s.exec(ctx, `UPDATE urls SET folder_id = ?, updated_at = ? WHERE user_id = ? AND short_url IN (`+
+		strings.TrimSuffix(strings.Repeat("?, ", len(codes)), ", ")+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) RefileFolderLinks(ctx context.Context, userID, from, to string) (int64, error) {
+	res, err := s.exec(ctx, `UPDATE urls SET folder_id = ?, updated_at = ? WHERE user_id = ? AND folder_id = ?`,
+		to, clock.Now().UnixNano(), userID, from)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) FolderLinkCounts(ctx context.Context, userID string) (map[string]FolderCounts, error) {
+	rows, err := s.query(ctx, `SELECT folder_id, COUNT(*), COALESCE(SUM(clicks), 0) FROM urls WHERE user_id = ? AND is_active = ? GROUP BY folder_id`,
+		userID, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]FolderCounts)
+	for rows.Next() {
+		var (
+			folderID string
+			c        FolderCounts
+		)
+		if err := rows.Scan(&folderID, &c.Links, &c.Clicks); err != nil {
+			return nil, err
+		}
+		counts[folderID] = c
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqlStore) InsertShareEvent(ctx context.Context, link *URLData, event *ShareEvent, limit int) error {
+	var count int
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM share_events WHERE url_id = ?`),
+		link.ID.Hex()).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrLimitReached
+	}
+	_, err := s.exec(ctx, `INSERT INTO share_events (id, url_id, channel, note, post_url, shared_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.ID.Hex(), link.ID.Hex(), event.Channel, event.Note, event.PostURL, event.SharedAt.UnixNano(), event.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *sqlStore) ListShareEvents(ctx context.Context, link *URLData, from, to time.Time) ([]ShareEvent, error) {
+	where := `url_id = ?`
+	args := []interface{}{link.ID.Hex()}
+	if !from.IsZero() {
+		where += ` AND shared_at >= ?`
+		args = append(args, from.UnixNano())
+	}
+	if !to.IsZero() {
+		where += ` AND shared_at < ?`
+		args = append(args, to.UnixNano())
+	}
+	rows, err := s.query(ctx, `SELECT id, channel, note, post_url, shared_at, created_at FROM share_events WHERE `+where+
+		` ORDER BY shared_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []ShareEvent{}
+	for rows.Next() {
+		var id string
+		var sharedAt, createdAt int64
+		event := ShareEvent{URLID: link.ID}
+		if err := rows.Scan(&id, &event.Channel, &event.Note, &event.PostURL, &sharedAt, &createdAt); err != nil {
+			return nil, err
+		}
+		if event.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		event.SharedAt = time.Unix(0, sharedAt).UTC()
+		event.CreatedAt = time.Unix(0, createdAt).UTC()
+		shares = append(shares, event)
+	}
+	return shares, rows.Err()
+}
+
+const sqlAnalyticsShareColumns = `id, user_id, token_hash, scope, resource_id, label, passcode_hash, expires_at, created_at, revoked_at`
+
+// scanSQLAnalyticsShare reads a row of sqlAnalyticsShareColumns
+func scanSQLAnalyticsShare(row rowScanner) (*AnalyticsShare, error) {
+	var id string
+	var expiresAt, createdAt int64
+	var revokedAt sql.NullInt64
+	share := &AnalyticsShare{}
+	if err := row.Scan(&id, &share.UserID, &share.TokenHash, &share.Scope, &share.ResourceID, &share.Label,
+		&share.PasscodeHash, &expiresAt, &createdAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if share.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	share.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	share.CreatedAt = time.Unix(0, createdAt).UTC()
+	if revokedAt.Valid {
+		t := time.Unix(0, revokedAt.Int64).UTC()
+		share.RevokedAt = &t
+	}
+	return share, nil
+}
+
+func (s *sqlStore) InsertAnalyticsShare(ctx context.Context, share *AnalyticsShare, limit int, now time.Time) error {
+	var count int
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM analytics_shares WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?`),
+		share.UserID, now.UnixNano()).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrLimitReached
+	}
+	_, err := s.exec(ctx, `INSERT INTO analytics_shares (`+sqlAnalyticsShareColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL)`,
+		share.ID.Hex(), share.UserID, share.TokenHash, share.Scope, share.ResourceID, share.Label, share.PasscodeHash,
+		share.ExpiresAt.UnixNano(), share.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *sqlStore) FindAnalyticsShare(ctx context.Context, tokenHash string) (*AnalyticsShare, error) {
+	share, err := scanSQLAnalyticsShare(s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+sqlAnalyticsShareColumns+` FROM analytics_shares WHERE token_hash = ?`), tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return share, err
+}
+
+func (s *sqlStore) ListAnalyticsShares(ctx context.Context, userID string) ([]AnalyticsShare, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlAnalyticsShareColumns+` FROM analytics_shares WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []AnalyticsShare{}
+	for rows.Next() {
+		share, err := scanSQLAnalyticsShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, *share)
+	}
+	return shares, rows.Err()
+}
+
+func (s *sqlStore) RevokeAnalyticsShare(ctx context.Context, userID string, id primitive.ObjectID, now time.Time) error {
+	res, err := s.exec(ctx, `UPDATE analytics_shares SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		now.UnixNano(), id.Hex(), userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GlobalCounts(ctx context.Context, since time.Time) (links, clicks, recent int64, err error) {
+	err = s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*), COALESCE(SUM(clicks), 0),
+		COALESCE(SUM(CASE WHEN created_at >= ? THEN 1 ELSE 0 END), 0) FROM urls`), since.UnixNano()).
+		Scan(&links, &clicks, &recent)
+	return links, clicks, recent, err
+}
+
+func (s *sqlStore) InsertAbuseReport(ctx context.Context, report *AbuseReport) error {
+	_, err := s.exec(ctx, `INSERT INTO abuse_reports (id, url_id, short_url, owner_id, reason, details, ip_hash, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		report.ID.Hex(), report.URLID.Hex(), report.ShortURL, report.OwnerID, report.Reason, report.Details,
+		report.IPHash, report.Status, report.CreatedAt.UnixNano())
+	if err != nil && isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *sqlStore) CountAbuseReporters(ctx context.Context, linkID primitive.ObjectID, since time.Time) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM abuse_reports WHERE url_id = ? AND status = ? AND created_at >= ?`),
+		linkID.Hex(), AbuseReportOpen, since.UnixNano()).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) ListAbuseReports(ctx context.Context, limit int) ([]AbuseReport, error) {
+	rows, err := s.query(ctx, `SELECT id, url_id, short_url, owner_id, reason, details, status, created_at
+		FROM abuse_reports WHERE status = ? ORDER BY created_at, id LIMIT ?`, AbuseReportOpen, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := []AbuseReport{}
+	for rows.Next() {
+		var id, urlID string
+		var created int64
+		var report AbuseReport
+		if err := rows.Scan(&id, &urlID, &report.ShortURL, &report.OwnerID, &report.Reason, &report.Details,
+			&report.Status, &created); err != nil {
+			return nil, err
+		}
+		if report.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		if report.URLID, err = primitive.ObjectIDFromHex(urlID); err != nil {
+			return nil, err
+		}
+		report.CreatedAt = time.Unix(0, created).UTC()
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *sqlStore) ResolveAbuseReports(ctx context.Context, code, resolution string) (int64, error) {
+	res, err := s.exec(ctx, `UPDATE abuse_reports SET status = ?, resolved_at = ? WHERE short_url = ? AND status = ?`,
+		resolution, clock.Now().UnixNano(), code, AbuseReportOpen)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) SetAbuseFlag(ctx context.Context, code string, flagged bool) (bool, error) {
+	res, err := s.exec(ctx, `UPDATE urls SET abuse_flagged = ? WHERE short_url = ?`, flagged, code)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) GetDomainBranding(ctx context.Context, host string) (*DomainBranding, error) {
+	var branding DomainBranding
+	var logo string
+	var updated int64
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT host, logo_url, logo_data, logo_type, primary_color, support_email, footer_text, updated_at
+		FROM domain_branding WHERE host = ?`), host).
+		Scan(&branding.Host, &branding.LogoURL, &logo, &branding.LogoType, &branding.PrimaryColor,
+			&branding.SupportEmail, &branding.FooterText, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if logo != "" {
+		if branding.LogoData, err = base64.StdEncoding.DecodeString(logo); err != nil {
+			return nil, err
+		}
+	}
+	branding.UpdatedAt = time.Unix(0, updated).UTC()
+	return &branding, nil
+}
+
+func (s *sqlStore) SaveDomainBranding(ctx context.Context, branding *DomainBranding) error {
+	_, err := s.exec(ctx, `INSERT INTO domain_branding (host, logo_url, logo_data, logo_type, primary_color, support_email, footer_text, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (host) DO UPDATE SET logo_url = excluded.logo_url, logo_data = excluded.logo_data,
+			logo_type = excluded.logo_type, primary_color = excluded.primary_color,
+			support_email = excluded.support_email, footer_text = excluded.footer_text, updated_at = excluded.updated_at`,
+		branding.Host, branding.LogoURL, base64.StdEncoding.EncodeToString(branding.LogoData), branding.LogoType,
+		branding.PrimaryColor, branding.SupportEmail, branding.FooterText, branding.UpdatedAt.UnixNano())
+	return err
+}
+
+func (s *sqlStore) DeleteDomainBranding(ctx context.Context, host string) (bool, error) {
+	res, err := s.exec(ctx, `DELETE FROM domain_branding WHERE host = ?`, host)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) DeactivateExpired(ctx context.Context) (int64, error) {
+	now := clock.Now().UnixNano()
+	res, err := s.exec(ctx, `UPDATE urls SET is_active = ?, deactivated_reason = ?, updated_at = ? WHERE is_active = ? AND expires_at IS NOT NULL AND expires_at <= ?`,
+		false, DeactivatedExpired, now, true, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,6 @@
+//go:build postgres
+
+package main
+
+// Links the pgx driver for STORAGE_BACKEND=postgres
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// Links the pure-Go SQLite driver for STORAGE_BACKEND=sqlite
+import _ "modernc.org/sqlite"
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============================================================================
+// STATIC ASSETS
+// ============================================================================
+//
+// Everything under static/ is embedded and served from /static/. At startup each file is
+// hashed and given a fingerprinted name (page.css → page.3fa2c1d8e4b7.css) that pages link
+// through staticURL; those URLs never change content, so they are cached as immutable. The
+// plain names stay reachable but revalidate on every use. Compressible files are gzipped
+// once at startup and sent pre-compressed, which the compression middleware passes through.
+// /favicon.ico and /robots.txt are served by the same code with a one-day lifetime.
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticHashLength is the number of hex digits of the content hash in fingerprinted names
+const staticHashLength = 12
+
+// Cache-Control values of fingerprinted, plain and well-known asset URLs
+const (
+	staticImmutableCache  = "public, max-age=31536000, immutable"
+	staticRevalidateCache = "public, no-cache"
+	staticWellKnownCache  = "public, max-age=86400"
+)
+
+// defaultRobotsTxt disallows crawling of short codes: everything when they live at the root,
+// only their prefix otherwise
+func defaultRobotsTxt() string {
+	return "User-agent: *\nDisallow: " + shortPathPrefix + "/\n"
+}
+
+// quietPaths are browser/crawler housekeeping requests that must not generate
+// security events or count against the rate limit
+var quietPaths = map[string]bool{
+	"/favicon.ico": true,
+	"/robots.txt":  true,
+}
+
+// isQuietPath reports whether a request path is exempt from security logging and rate limiting
+func isQuietPath(path string) bool {
+	return quietPaths[path] || strings.HasPrefix(path, "/static/")
+}
+
+// staticAsset is one servable file with its validators and optional gzip variant
+type staticAsset struct {
+	name        string
+	hashedName  string
+	contentType string
+	etag        string
+	body        []byte
+	gzipped     []byte
+}
+
+var (
+	// staticAssets maps both plain and fingerprinted names to their asset
+	staticAssets  = make(map[string]*staticAsset)
+	faviconAsset  *staticAsset
+	robotsAsset   *staticAsset
+	staticModTime = time.Now()
+)
+
+// newStaticAsset hashes body and, when it is compressible and gzip makes it smaller,
+// precomputes its gzip variant
+func newStaticAsset(name string, body []byte) *staticAsset {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])[:staticHashLength]
+	ext := path.Ext(name)
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	asset := &staticAsset{
+		name:        name,
+		hashedName:  strings.TrimSuffix(name, ext) + "." + hash + ext,
+		contentType: contentType,
+		etag:        `"` + hash + `"`,
+		body:        body,
+	}
+	if isCompressibleType(contentType) {
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gz.Write(body)
+		gz.Close()
+		if buf.Len() < len(body) {
+			asset.gzipped = buf.Bytes()
+		}
+	}
+	return asset
+}
+
+// registerStaticAsset adds (or replaces) the asset served at /static/<name>
+func registerStaticAsset(name string, body []byte) *staticAsset {
+	if old, ok := staticAssets[name]; ok {
+		delete(staticAssets, old.hashedName)
+	}
+	asset := newStaticAsset(name, body)
+	staticAssets[asset.name] = asset
+	staticAssets[asset.hashedName] = asset
+	return asset
+}
+
+// staticURL returns the fingerprinted path of an embedded asset, e.g. "/static/page.3fa2c1d8e4b7.css"
+func staticURL(name string) string {
+	if asset, ok := staticAssets[name]; ok {
+		return "/static/" + asset.hashedName
+	}
+	return "/static/" + name
+}
+
+// InitStaticAssets fingerprints the embedded assets and loads optional favicon/robots.txt
+// overrides from FAVICON_PATH and ROBOTS_TXT_PATH
+func InitStaticAssets() {
+	err := fs.WalkDir(staticFiles, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := staticFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		registerStaticAsset(strings.TrimPrefix(p, "static/"), body)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to load embedded static assets: %v", err)
+	}
+
+	if path := os.Getenv("FAVICON_PATH"); path != "" {
+		if data, err := os.ReadFile(path); err != nil {
+			log.Printf("⚠️  Could not read FAVICON_PATH %s, using embedded favicon: %v", path, err)
+		} else {
+			registerStaticAsset("favicon.ico", data)
+		}
+	}
+	faviconAsset = staticAssets["favicon.ico"]
+
+	robotsTxt := []byte(defaultRobotsTxt())
+	if path := os.Getenv("ROBOTS_TXT_PATH"); path != "" {
+		if data, err := os.ReadFile(path); err != nil {
+			log.Printf("⚠️  Could not read ROBOTS_TXT_PATH %s, using default robots.txt: %v", path, err)
+		} else {
+			robotsTxt = data
+		}
+	}
+	robotsAsset = newStaticAsset("robots.txt", robotsTxt)
+	robotsAsset.contentType = "text/plain; charset=utf-8"
+}
+
+// serveAsset writes asset with the given Cache-Control, answering If-None-Match with 304
+// and sending the gzip variant to clients that accept it
+func serveAsset(w http.ResponseWriter, r *http.Request, asset *staticAsset, cacheControl string) {
+	header := w.Header()
+	header.Set("Content-Type", asset.contentType)
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", asset.etag)
+	body := asset.body
+	if asset.gzipped != nil {
+		if encoder := negotiateEncoder(r.Header.Get("Accept-Encoding")); encoder != nil && encoder.name == "gzip" {
+			// The variant gets its own strong validator; If-None-Match accepts either
+			header.Set("ETag", strings.TrimSuffix(asset.etag, `"`)+`-gz"`)
+			header.Set("Content-Encoding", "gzip")
+			body = asset.gzipped
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagListMatches(inm, asset.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	http.ServeContent(w, r, "", staticModTime, bytes.NewReader(body))
+}
+
+// etagListMatches reports whether an If-None-Match header names etag or its gzip variant
+func etagListMatches(header, etag string) bool {
+	gzipETag := strings.TrimSuffix(etag, `"`) + `-gz"`
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag || candidate == gzipETag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStatic handles GET /static/{name}
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	asset, ok := staticAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cacheControl := staticRevalidateCache
+	if name == asset.hashedName {
+		cacheControl = staticImmutableCache
+	}
+	serveAsset(w, r, asset, cacheControl)
+}
+
+// favicon handles GET /favicon.ico
+func favicon(w http.ResponseWriter, r *http.Request) {
+	serveAsset(w, r, faviconAsset, staticWellKnownCache)
+}
+
+// robotsTxt handles GET /robots.txt
+func robotsTxt(w http.ResponseWriter, r *http.Request) {
+	serveAsset(w, r, robotsAsset, staticWellKnownCache)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestQuietPathsLogNoSecurityEvents(t *testing.T) {
+	srv := newTestServer(t)
+	logs := captureLog(t)
+	// More than the global rate limit of one client, which quiet paths do not count against
+	policy := liveConfig().RateLimit("global")
+	for i := 0; i <= policy.Limit; i++ {
+		for _, path := range []string{"/favicon.ico", "/robots.txt"} {
+			for _, method := range []string{"GET", "HEAD"} {
+				req := httptest.NewRequest(method, path, nil)
+				req.Header.Set("User-Agent", "Googlebot/2.1")
+				if rec := srv.serveFrom("198.51.100.57:40000", req); rec.Code != http.StatusOK {
+					t.Fatalf("%s %s #%d: status %d", method, path, i+1, rec.Code)
+				}
+			}
+		}
+	}
+
+	// An invalid short code does log, so the log is known to be captured
+	srv.serveFrom("198.51.100.57:40000", httptest.NewRequest("GET", "/bad!code", nil))
+	if !logs.waitFor("INVALID_SHORT_URL_ACCESS") {
+		t.Fatal("security event of the invalid code was not logged")
+	}
+	if n := strings.Count(logs.String(), "SECURITY"); n != 1 {
+		t.Fatalf("%d security events logged, want only the invalid code's:\n%s", n, logs.String())
+	}
+}
+
+func TestRobotsTxtDisallowsShortCodes(t *testing.T) {
+	srv := newTestServer(t)
+	resp := srv.do("GET", "/robots.txt", "", nil, nil)
+	body := readBody(t, resp)
+	if !strings.Contains(body, "Disallow: /") || resp.Header.Get("Cache-Control") != staticWellKnownCache {
+		t.Fatalf("robots.txt: Cache-Control %q, body %q", resp.Header.Get("Cache-Control"), body)
+	}
+}
+
+// notFoundPage returns the HTML 404 page a browser gets for an unknown short code
+func notFoundPage(t *testing.T, srv *testServer) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+"/no-such-code", nil)
+	req.Header.Set("Accept", "text/html")
+	return readBody(t, srv.send(req, nil))
+}
+
+func TestStaticAssetFingerprints(t *testing.T) {
+	srv := newTestServer(t)
+	hashed := staticURL("page.css")
+	if !regexp.MustCompile(`^/static/page\.[0-9a-f]{12}\.css$`).MatchString(hashed) {
+		t.Fatalf("staticURL(page.css) = %s", hashed)
+	}
+	original, _ := staticFiles.ReadFile("static/page.css")
+
+	resp := srv.do("GET", hashed, "", nil, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != string(original) {
+		t.Fatalf("%s: status %d, %d bytes", hashed, resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Cache-Control") != staticImmutableCache || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") {
+		t.Fatalf("Cache-Control %q, Content-Type %q", resp.Header.Get("Cache-Control"), resp.Header.Get("Content-Type"))
+	}
+	if resp := srv.do("GET", "/static/page.css", "", nil, nil); resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != staticRevalidateCache {
+		t.Fatalf("plain name: status %d, Cache-Control %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	// The pre-compressed variant, with its own validator
+	req, _ := http.NewRequest("GET", srv.URL+hashed, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || !strings.HasSuffix(resp.Header.Get("ETag"), `-gz"`) {
+		t.Fatalf("gzip: Content-Encoding %q, ETag %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("ETag"))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != string(original) {
+		t.Fatal("gzip variant differs from the asset")
+	}
+
+	// Pages link the fingerprinted URL; the prefix cannot be taken by a short code
+	if page := notFoundPage(t, srv); !strings.Contains(page, hashed) {
+		t.Fatalf("404 page does not link %s", hashed)
+	}
+	token, _ := srv.register()
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/", "custom": "static"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("custom code static: status %d", resp.StatusCode)
+	}
+}
+
+func TestStaticAssetNotModified(t *testing.T) {
+	srv := newTestServer(t)
+	hashed := staticURL("page.css")
+	etag := staticAssets["page.css"].etag
+	gzipETag := strings.TrimSuffix(etag, `"`) + `-gz"`
+
+	conditional := func(path, ifNoneMatch string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		return srv.send(req, nil)
+	}
+	for _, inm := range []string{etag, gzipETag, "W/" + etag, `"stale", ` + etag, "*"} {
+		for _, path := range []string{hashed, "/static/page.css"} {
+			resp := conditional(path, inm)
+			if resp.StatusCode != http.StatusNotModified || readBody(t, resp) != "" || resp.Header.Get("ETag") == "" {
+				t.Errorf("%s If-None-Match %s: status %d", path, inm, resp.StatusCode)
+			}
+		}
+	}
+	for _, inm := range []string{`"stale"`, strings.Trim(etag, `"`), `"` + strings.Repeat("0", staticHashLength) + `"`} {
+		if resp := conditional(hashed, inm); resp.StatusCode != http.StatusOK {
+			t.Errorf("If-None-Match %s: status %d", inm, resp.StatusCode)
+		}
+	}
+	resp := conditional("/favicon.ico", srv.do("GET", "/favicon.ico", "", nil, nil).Header.Get("ETag"))
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("Cache-Control") != staticWellKnownCache {
+		t.Fatalf("favicon revalidation: status %d, Cache-Control %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestStaticAssetChangeGetsNewURL(t *testing.T) {
+	srv := newTestServer(t)
+	original, _ := staticFiles.ReadFile("static/page.css")
+	t.Cleanup(func() { registerStaticAsset("page.css", original) })
+	before, etag := staticURL("page.css"), staticAssets["page.css"].etag
+
+	changed := append(append([]byte{}, original...), "\n.changed { color: red; }\n"...)
+	registerStaticAsset("page.css", changed)
+	after := staticURL("page.css")
+	if after == before {
+		t.Fatalf("changed asset kept URL %s", before)
+	}
+	resp := srv.do("GET", after, "", nil, nil)
+	if body := readBody(t, resp); body != string(changed) || strings.HasPrefix(resp.Header.Get("ETag"), strings.TrimSuffix(etag, `"`)) {
+		t.Fatalf("new URL %s: ETag %q", after, resp.Header.Get("ETag"))
+	}
+	// The old fingerprint is gone rather than serving new content under an immutable URL
+	if resp := srv.do("GET", before, "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("old URL %s: status %d", before, resp.StatusCode)
+	}
+	// A client holding the old version revalidates the plain name and gets the new one
+	req, _ := http.NewRequest("GET", srv.URL+"/static/page.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	if resp := srv.send(req, nil); resp.StatusCode != http.StatusOK || readBody(t, resp) != string(changed) {
+		t.Fatalf("plain name with the old ETag: status %d", resp.StatusCode)
+	}
+	if page := notFoundPage(t, srv); !strings.Contains(page, after) || strings.Contains(page, before) {
+		t.Fatal("pages still link the old fingerprint")
+	}
+}
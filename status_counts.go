@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ============================================================================
+// LINK COUNTS BY STATUS
+// ============================================================================
+//
+// The statistics block only covers active links; status_counts breaks down all of a user's
+// links. A link is a draft (preview reservation), active, expired (deactivated by expiry or
+// past expires_at but not yet swept) or disabled (deactivated for any other reason).
+// expiring_7d and expiring_30d count active links expiring within that window, so the 30-day
+// figure includes the 7-day one. There is no link scheduling yet, so scheduled is always 0.
+
+const (
+	statusActive    = "active"
+	statusExpired   = "expired"
+	statusDisabled  = "disabled"
+	statusScheduled = "scheduled"
+	statusDraft     = "draft"
+)
+
+// newStatusCounts returns the status_counts block with every counter at zero
+func newStatusCounts() map[string]interface{} {
+	return map[string]interface{}{
+		statusActive:    int64(0),
+		statusExpired:   int64(0),
+		statusDisabled:  int64(0),
+		statusScheduled: int64(0),
+		statusDraft:     int64(0),
+		"expiring_7d":   int64(0),
+		"expiring_30d":  int64(0),
+	}
+}
+
+// statusCategory classifies link for status_counts. Unlike linkStatus (resolve), a link
+// deactivated by expiry counts as expired and drafts are told apart.
+func statusCategory(link *URLData, now time.Time) string {
+	switch {
+	case link.DeactivatedReason == DeactivatedDraft:
+		return statusDraft
+	case link.IsActive && !isExpiredAt(link.ExpiresAt, now):
+		return statusActive
+	case link.IsActive || link.DeactivatedReason == DeactivatedExpired:
+		return statusExpired
+	default:
+		return statusDisabled
+	}
+}
+
+// statusCountsOf builds status_counts for links in memory
+func statusCountsOf(links []*URLData, now time.Time) map[string]interface{} {
+	counts := newStatusCounts()
+	for _, link := range links {
+		status := statusCategory(link, now)
+		counts[status] = counts[status].(int64) + 1
+		if status != statusActive || link.ExpiresAt == nil {
+			continue
+		}
+		if !link.ExpiresAt.After(now.AddDate(0, 0, 7)) {
+			counts["expiring_7d"] = counts["expiring_7d"].(int64) + 1
+		}
+		if !link.ExpiresAt.After(now.AddDate(0, 0, 30)) {
+			counts["expiring_30d"] = counts["expiring_30d"].(int64) + 1
+		}
+	}
+	return counts
+}
+
+// getStatusBreakdown counts a user's links by status with one conditional-sum $group
+func getStatusBreakdown(ctx context.Context, urls *mongo.Collection, userID string, now time.Time) (map[string]interface{}, error) {
+	expiresAt := bson.D{{Key: "$ifNull", Value: bson.A{"$expires_at", nil}}}
+	countIf := func(cond interface{}) bson.D {
+		return bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{cond, 1, 0}}}}}
+	}
+	isStatus := func(status string) bson.D {
+		return bson.D{{Key: "$eq", Value: bson.A{"$status", status}}}
+	}
+	expiringWithin := func(days int) bson.D {
+		return bson.D{{Key: "$and", Value: bson.A{
+			isStatus(statusActive),
+			bson.D{{Key: "$ne", Value: bson.A{expiresAt, nil}}},
+			bson.D{{Key: "$lte", Value: bson.A{"$expires_at", now.AddDate(0, 0, days)}}},
+		}}}
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "user_id", Value: userID}}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "expires_at", Value: 1},
+			{Key: "status", Value: bson.D{{Key: "$switch", Value: bson.D{
+				{Key: "branches", Value: bson.A{
+					bson.D{
+						{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$deactivated_reason", DeactivatedDraft}}}},
+						{Key: "then", Value: statusDraft},
+					},
+					bson.D{
+						{Key: "case", Value: bson.D{{Key: "$and", Value: bson.A{
+							"$is_active",
+							bson.D{{Key: "$or", Value: bson.A{
+								bson.D{{Key: "$eq", Value: bson.A{expiresAt, nil}}},
+								bson.D{{Key: "$gt", Value: bson.A{"$expires_at", now}}},
+							}}},
+						}}}},
+						{Key: "then", Value: statusActive},
+					},
+					bson.D{
+						{Key: "case", Value: bson.D{{Key: "$or", Value: bson.A{
+							"$is_active",
+							bson.D{{Key: "$eq", Value: bson.A{"$deactivated_reason", DeactivatedExpired}}},
+						}}}},
+						{Key: "then", Value: statusExpired},
+					},
+				}},
+				{Key: "default", Value: statusDisabled},
+			}}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: statusActive, Value: countIf(isStatus(statusActive))},
+			{Key: statusExpired, Value: countIf(isStatus(statusExpired))},
+			{Key: statusDisabled, Value: countIf(isStatus(statusDisabled))},
+			{Key: statusDraft, Value: countIf(isStatus(statusDraft))},
+			{Key: "expiring_7d", Value: countIf(expiringWithin(7))},
+			{Key: "expiring_30d", Value: countIf(expiringWithin(30))},
+		}}},
+	}
+
+	cursor, err := urls.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var results []struct {
+		Active      int64 `bson:"active"`
+		Expired     int64 `bson:"expired"`
+		Disabled    int64 `bson:"disabled"`
+		Draft       int64 `bson:"draft"`
+		Expiring7d  int64 `bson:"expiring_7d"`
+		Expiring30d int64 `bson:"expiring_30d"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	counts := newStatusCounts()
+	if len(results) > 0 {
+		r := results[0]
+		counts[statusActive] = r.Active
+		counts[statusExpired] = r.Expired
+		counts[statusDisabled] = r.Disabled
+		counts[statusDraft] = r.Draft
+		counts["expiring_7d"] = r.Expiring7d
+		counts["expiring_30d"] = r.Expiring30d
+	}
+	return counts, nil
+}
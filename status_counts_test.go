@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// statusMix returns links of userID in every state status_counts tells apart, as of now,
+// with the counts they add up to
+func statusMix(userID string, now time.Time) ([]*URLData, map[string]int64) {
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	day := 24 * time.Hour
+	tests := []struct {
+		active    bool
+		reason    string
+		expiresAt *time.Time
+	}{
+		{true, "", nil},
+		{true, "", nil},
+		{true, "", at(3 * day)},
+		{true, "", at(7 * day)},
+		{true, "", at(7*day + time.Minute)},
+		{true, "", at(30 * day)},
+		{true, "", at(60 * day)},
+		// Past its expiry but not yet swept by the cleanup worker
+		{true, "", at(-time.Hour)},
+		{false, DeactivatedExpired, at(-10 * day)},
+		{false, DeactivatedExpired, nil},
+		{false, DeactivatedDeleted, nil},
+		{false, DeactivatedByOwner, at(5 * day)},
+		{false, DeactivatedDisabled, nil},
+		{false, DeactivatedDraft, at(time.Hour)},
+	}
+	links := make([]*URLData, 0, len(tests))
+	for i, tt := range tests {
+		links = append(links, &URLData{
+			ID:                primitive.NewObjectID(),
+			ShortURL:          fmt.Sprintf("mix-%s-%d", userID, i),
+			LongURL:           fmt.Sprintf("https://example.com/mix/%d", i),
+			UserID:            userID,
+			CreatedAt:         now.Add(-time.Duration(i) * time.Hour),
+			IsActive:          tt.active,
+			DeactivatedReason: tt.reason,
+			ExpiresAt:         tt.expiresAt,
+		})
+	}
+	return links, map[string]int64{
+		statusActive: 7, statusExpired: 3, statusDisabled: 3, statusScheduled: 0, statusDraft: 1,
+		"expiring_7d": 2, "expiring_30d": 4,
+	}
+}
+
+// sameStatusCounts reports whether status_counts, as decoded from JSON or built in Go,
+// holds exactly want
+func sameStatusCounts(got map[string]interface{}, want map[string]int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for key, count := range want {
+		if fmt.Sprint(got[key]) != fmt.Sprint(count) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStatusCountsOf(t *testing.T) {
+	now := clockTestBase
+	links, want := statusMix("counts", now)
+	if got := statusCountsOf(links, now); !sameStatusCounts(got, want) {
+		t.Errorf("status counts %v, want %v", got, want)
+	}
+	if got := statusCountsOf(nil, now); !sameStatusCounts(got, map[string]int64{
+		statusActive: 0, statusExpired: 0, statusDisabled: 0, statusScheduled: 0, statusDraft: 0, "expiring_7d": 0, "expiring_30d": 0,
+	}) {
+		t.Errorf("no links: %v", got)
+	}
+	// Four days later the link expiring in 3 days has expired and the windows moved on
+	later := statusCountsOf(links, now.Add(4*24*time.Hour))
+	if later[statusActive] != int64(6) || later[statusExpired] != int64(4) || later["expiring_7d"] != int64(2) || later["expiring_30d"] != int64(3) {
+		t.Errorf("four days later: %v", later)
+	}
+}
+
+func TestStatusCountsInStatistics(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+	other, otherID := srv.register()
+	ctx := context.Background()
+	links, want := statusMix(userID, time.Now())
+	others, _ := statusMix(otherID, time.Now())
+	for _, link := range append(links, others[:3]...) {
+		if err := srv.links.InsertLink(ctx, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var analytics struct {
+		Statistics struct {
+			TotalURLs    int                    `json:"total_urls"`
+			StatusCounts map[string]interface{} `json:"status_counts"`
+		} `json:"statistics"`
+	}
+	if resp := srv.do("GET", "/analytics", token, nil, &analytics); resp.StatusCode != http.StatusOK {
+		t.Fatalf("analytics: status %d", resp.StatusCode)
+	}
+	// total_urls keeps counting the active links only
+	if analytics.Statistics.TotalURLs != 8 || !sameStatusCounts(analytics.Statistics.StatusCounts, want) {
+		t.Errorf("analytics statistics: %d links, status counts %v, want %v", analytics.Statistics.TotalURLs, analytics.Statistics.StatusCounts, want)
+	}
+
+	var profile struct {
+		Data struct {
+			Statistics struct {
+				StatusCounts map[string]interface{} `json:"status_counts"`
+			} `json:"statistics"`
+		} `json:"data"`
+	}
+	if resp := srv.do("GET", "/auth/profile?include=stats", other, nil, &profile); resp.StatusCode != http.StatusOK {
+		t.Fatalf("profile: status %d", resp.StatusCode)
+	}
+	if !sameStatusCounts(profile.Data.Statistics.StatusCounts, map[string]int64{
+		statusActive: 3, statusExpired: 0, statusDisabled: 0, statusScheduled: 0, statusDraft: 0, "expiring_7d": 1, "expiring_30d": 1,
+	}) {
+		t.Errorf("profile status counts %v", profile.Data.Statistics.StatusCounts)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// STORAGE INTERFACES
+// ============================================================================
+//
+// The core user and link paths (register, login, refresh, profile, shorten, redirect,
+// analytics, delete, expiry cleanup) go through UserStore and URLStore so they can run on
+// a backend other than MongoDB. STORAGE_BACKEND selects it: "mongo" (default), "memory",
+// "sqlite" or "postgres". Features built directly on MongoDB (bulk, resolve, extend, sign,
+// demo, backups) are wrapped in requireMongo and answer 503 on other backends.
+
+// Storage errors shared by every backend. Data-access functions return them, wrapped with %w
+// when they add context, and handlers map them to responses with writeStoreError; nothing
+// inspects error text.
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrDuplicate         = errors.New("already exists")
+	ErrLimitReached      = errors.New("limit reached")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrUnauthorizedOwner = errors.New("not the owner")
+	errStoreUnavailable  = errors.New("database not connected")
+)
+
+// ValidationError rejects an input of a data-access function
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// UserStore persists user accounts
+type UserStore interface {
+	// CreateUser inserts user and sets its ID; ErrDuplicate when the username or email is taken
+	CreateUser(ctx context.Context, user *User) error
+	// FindUserByLogin returns the active user with this username or email
+	FindUserByLogin(ctx context.Context, usernameOrEmail string) (*User, error)
+	// GetUserByID returns the active user with this ID
+	GetUserByID(ctx context.Context, id primitive.ObjectID) (*User, error)
+	// FindUserByRefreshToken returns the user holding this hashed refresh token
+	FindUserByRefreshToken(ctx context.Context, hashed string) (*User, error)
+	// SetRefreshToken stores a hashed refresh token; an empty hash clears it
+	SetRefreshToken(ctx context.Context, id primitive.ObjectID, hashed string, expiry time.Time) error
+	// SetTagRules replaces the user's auto-tagging rules
+	SetTagRules(ctx context.Context, id primitive.ObjectID, rules []TagRule) error
+	// SetTimezone stores the user's IANA time zone; "" clears it
+	SetTimezone(ctx context.Context, id primitive.ObjectID, timezone string) error
+	// SetUserActive suspends or restores an account and forgets any self-deactivation; false
+	// when there is no such user
+	SetUserActive(ctx context.Context, id primitive.ObjectID, active bool) (bool, error)
+	// DeactivateUser pauses an active account at the owner's request and ends its session;
+	// false when there is no such active user
+	DeactivateUser(ctx context.Context, id primitive.ObjectID, at time.Time) (bool, error)
+	// FindDeactivatedUser returns the self-deactivated user with this username or email
+	FindDeactivatedUser(ctx context.Context, usernameOrEmail string) (*User, error)
+	// ReactivateUser restores an account deactivated by its owner at deactivatedAt; false when
+	// it is active again, suspended by an admin or was deactivated at another time
+	ReactivateUser(ctx context.Context, id primitive.ObjectID, deactivatedAt time.Time) (bool, error)
+	// InactiveUserIDs returns the hex IDs of all suspended accounts
+	InactiveUserIDs(ctx context.Context) ([]string, error)
+	// RestrictedUserIDs returns the hex IDs of active restricted accounts whose email is not
+	// verified or that were created after youngerThan
+	RestrictedUserIDs(ctx context.Context, youngerThan time.Time) ([]string, error)
+	// SetEmailVerified marks the user's email verified; false when there is no such user
+	SetEmailVerified(ctx context.Context, id primitive.ObjectID) (bool, error)
+	// AddUsage adds the counts to the users' daily API usage counters, creating missing ones
+	AddUsage(ctx context.Context, counts []UsageCount) error
+	// ListUsage returns the user's usage counters for the days in [from, to)
+	ListUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageCount, error)
+}
+
+// URLStore persists short links and their click counters
+type URLStore interface {
+	// InsertLink stores link and sets its ID; ErrDuplicate when the short code is taken
+	InsertLink(ctx context.Context, link *URLData) error
+	// FindLinkByCode returns the link with this code in any state
+	FindLinkByCode(ctx context.Context, code string) (*URLData, error)
+	// CodeHolder returns who holds code, be it a link, a draft, a demo link or a reserved
+	// word; ErrNotFound when the code is free
+	CodeHolder(ctx context.Context, code string) (*CodeReservation, error)
+	// FindRedirectTarget returns the active, unexpired link with this code
+	FindRedirectTarget(ctx context.Context, code string) (*URLData, error)
+	// FindActiveLink returns the owner's active link to longURL on domain
+	FindActiveLink(ctx context.Context, userID, longURL, domain string) (*URLData, error)
+	// FindExpiredDuplicate returns the owner's link to longURL on domain that was switched
+	// off by expiry most recently
+	FindExpiredDuplicate(ctx context.Context, userID, longURL, domain string) (*URLData, error)
+	// ReviveLink reactivates link, keeping its code and clicks, until expiresAt. It returns
+	// false when the link is no longer switched off by expiry, and ErrDuplicate when the
+	// owner has an active link to the same destination again.
+	ReviveLink(ctx context.Context, link *URLData, expiresAt time.Time) (bool, error)
+	// RecordClick counts a click on link
+	RecordClick(ctx context.Context, link *URLData, click ClickHistory) error
+	// RecordBlockedClick counts a click refused by the link's referrer restriction
+	RecordBlockedClick(ctx context.Context, link *URLData) error
+	// AddLinkOutcomes adds the counts to the links' daily redirect outcome counters, creating
+	// missing ones
+	AddLinkOutcomes(ctx context.Context, counts []LinkOutcomeCount) error
+	// ListLinkOutcomes returns link's redirect outcome counters for the days in [from, to)
+	ListLinkOutcomes(ctx context.Context, link *URLData, from, to time.Time) ([]LinkOutcomeCount, error)
+	// CountDailyClick adds a click to link's counter for day, a date in its budget timezone,
+	// and returns the day's count; the counter may be dropped after keepUntil
+	CountDailyClick(ctx context.Context, link *URLData, day string, keepUntil time.Time) (int, error)
+	// PauseLink sets link's paused_until to until; false when it was already paused as long
+	PauseLink(ctx context.Context, link *URLData, until time.Time) (bool, error)
+	// ResumePausedLinks clears paused_until on up to limit links whose pause ended by now and
+	// returns them with the paused_until they had
+	ResumePausedLinks(ctx context.Context, now time.Time, limit int) ([]*URLData, error)
+	// CountActiveLinks returns how many active links the owner has
+	CountActiveLinks(ctx context.Context, userID string) (int64, error)
+	// ListLinks returns a page of the owner's links passing filter, pinned ones first and newest
+	// first within each group, with the total count and, when withStats is set, the dashboard
+	// statistics. The filter limits the page and total; the statistics always cover every
+	// active link. A non-nil fields lets the store skip reading other link fields; callers
+	// still trim with selectLinkFields.
+	ListLinks(ctx context.Context, userID string, filter LinkFilter, skip, limit int, withStats bool, fields []string) ([]map[string]interface{}, int64, map[string]interface{}, error)
+	// PinLink sets the pinned flag of the owner's active link with code and returns the link;
+	// ErrNotFound when there is none, ErrLimitReached when the owner already has limit other
+	// pinned links
+	PinLink(ctx context.Context, userID, code string, pinned bool, limit int) (*URLData, error)
+	// SetLinkAnalytics turns click tracking of the owner's active link with code off or on and
+	// returns the link. With purge the link's click events are deleted and its counters reset;
+	// purged is how many events went. ErrNotFound when there is no such link.
+	SetLinkAnalytics(ctx context.Context, userID, code string, disabled, purge bool) (link *URLData, purged int64, err error)
+	// EditLink applies edit to link as it was read, clearing what the redirect probe and
+	// favicon fetcher found when the destination changes. It returns false when the link
+	// changed since (its updated_at differs), ErrDuplicate when the owner has another
+	// active link to the resulting destination, and ErrLimitReached when edit pins the link
+	// past its PinLimit. On error nothing is changed.
+	EditLink(ctx context.Context, link *URLData, edit LinkEdit) (bool, error)
+	// DeactivateLink switches off the owner's link; false when there is no such link
+	DeactivateLink(ctx context.Context, userID, code, reason string) (bool, error)
+	// ReleaseDraft deletes the reservation placeholder holding code; false when there is none
+	ReleaseDraft(ctx context.Context, code string) (bool, error)
+	// SetFavicon stores the favicon metadata of link
+	SetFavicon(ctx context.Context, link *URLData, favicon LinkFavicon) error
+	// StaleFavicons returns up to limit active links whose favicon was never fetched or
+	// fetched before before
+	StaleFavicons(ctx context.Context, before time.Time, limit int) ([]*URLData, error)
+	// SetRedirectProbe stores where link's destination redirects to and after how many hops
+	SetRedirectProbe(ctx context.Context, link *URLData, resolved string, hops int) error
+	// ApplyTagRule adds rule's tags to the owner's active links matching it, up to
+	// MaxTagsPerLink, and returns how many links changed
+	ApplyTagRule(ctx context.Context, userID string, rule TagRule) (int64, error)
+	// ListClicks returns up to query.Limit of link's clicks, newest first
+	ListClicks(ctx context.Context, link *URLData, query ClickQuery) ([]ClickRecord, error)
+	// ClickHeatmap counts the human clicks since since per weekday and hour in loc, of link
+	// or, when link is nil, of every link of userID
+	ClickHeatmap(ctx context.Context, userID string, link *URLData, since time.Time, loc *time.Location) (ClickHeatmap, error)
+	// ExportClicks passes the clicks selected by query to fn, oldest first, stopping at the
+	// first error fn returns
+	ExportClicks(ctx context.Context, query ClickExportQuery, fn func(ClickExportRow) error) error
+	// InsertFolder stores folder; ErrDuplicate when its parent has a folder of that name
+	InsertFolder(ctx context.Context, folder *Folder) error
+	// FindFolder returns the owner's folder with id; ErrNotFound when there is none
+	FindFolder(ctx context.Context, userID string, id primitive.ObjectID) (*Folder, error)
+	// ListFolders returns the owner's folders whose path starts with pathPrefix, all of them
+	// for ""
+	ListFolders(ctx context.Context, userID, pathPrefix string) ([]*Folder, error)
+	// UpdateFolders saves the name, parent, path and depth of folders; ErrDuplicate when a
+	// name is taken in the new parent
+	UpdateFolders(ctx context.Context, folders []*Folder) error
+	// DeleteFolder removes folder
+	DeleteFolder(ctx context.Context, folder *Folder) error
+	// MoveLinksToFolder puts the owner's links with codes in folderID ("" takes them out of
+	// any folder) and returns how many links it matched
+	MoveLinksToFolder(ctx context.Context, userID string, codes []string, folderID string) (int64, error)
+	// RefileFolderLinks moves every link of the owner in folder from, active or not, to
+	// folder to and returns how many it moved
+	RefileFolderLinks(ctx context.Context, userID, from, to string) (int64, error)
+	// FolderLinkCounts returns the owner's active links and their clicks per folder ID, ""
+	// for links outside any folder
+	FolderLinkCounts(ctx context.Context, userID string) (map[string]FolderCounts, error)
+	// InsertShareEvent records a share of link; ErrLimitReached when it already has limit
+	InsertShareEvent(ctx context.Context, link *URLData, event *ShareEvent, limit int) error
+	// ListShareEvents returns link's share events shared in [from, to), newest first; zero
+	// bounds are open
+	ListShareEvents(ctx context.Context, link *URLData, from, to time.Time) ([]ShareEvent, error)
+	// CountClickWindow counts link's human clicks in [from, to), its distinct IP hashes and
+	// its clicks per referrer host
+	CountClickWindow(ctx context.Context, link *URLData, from, to time.Time) (*ClickWindow, error)
+	// CountLinkClicks counts link's recorded click events: all of them, the distinct IP hashes
+	// of its human clicks and its bot clicks, with the time of the latest
+	CountLinkClicks(ctx context.Context, link *URLData) (*ClickCounters, error)
+	// SetClickCounters sets link's clicks and last_clicked to counters, provided its clicks
+	// are still link.Clicks; false when a click changed them meanwhile
+	SetClickCounters(ctx context.Context, link *URLData, counters ClickCounters) (bool, error)
+	// ListUserLinks returns up to limit of userID's links other than drafts, by code
+	ListUserLinks(ctx context.Context, userID string, limit int) ([]*URLData, error)
+	// SampleLinks returns up to size links other than drafts, picked at random
+	SampleLinks(ctx context.Context, size int) ([]*URLData, error)
+	// InsertAnalyticsShare stores share; ErrLimitReached when its owner already has limit
+	// shares active at now
+	InsertAnalyticsShare(ctx context.Context, share *AnalyticsShare, limit int, now time.Time) error
+	// FindAnalyticsShare returns the share with tokenHash, revoked or expired ones included;
+	// ErrNotFound when there is none
+	FindAnalyticsShare(ctx context.Context, tokenHash string) (*AnalyticsShare, error)
+	// ListAnalyticsShares returns the owner's shares, newest first
+	ListAnalyticsShares(ctx context.Context, userID string) ([]AnalyticsShare, error)
+	// RevokeAnalyticsShare marks the owner's share with id revoked at now; ErrNotFound when
+	// the owner has no unrevoked share with id
+	RevokeAnalyticsShare(ctx context.Context, userID string, id primitive.ObjectID, now time.Time) error
+	// InsertAbuseReport stores report; ErrDuplicate when its IP already has an open report on
+	// the link
+	InsertAbuseReport(ctx context.Context, report *AbuseReport) error
+	// CountAbuseReporters returns how many open reports the link got since since, which is
+	// the number of distinct reporting IPs
+	CountAbuseReporters(ctx context.Context, linkID primitive.ObjectID, since time.Time) (int64, error)
+	// ListAbuseReports returns up to limit open reports, oldest first
+	ListAbuseReports(ctx context.Context, limit int) ([]AbuseReport, error)
+	// ResolveAbuseReports closes the open reports of the link with code as resolution and
+	// returns how many it closed
+	ResolveAbuseReports(ctx context.Context, code, resolution string) (int64, error)
+	// SetAbuseFlag sets or clears the abuse flag of the link with code; false when there is no
+	// such link
+	SetAbuseFlag(ctx context.Context, code string, flagged bool) (bool, error)
+	// GetDomainBranding returns the branding of host; ErrNotFound when it has none
+	GetDomainBranding(ctx context.Context, host string) (*DomainBranding, error)
+	// SaveDomainBranding creates or replaces the branding of branding.Host
+	SaveDomainBranding(ctx context.Context, branding *DomainBranding) error
+	// DeleteDomainBranding removes the branding of host; false when it had none
+	DeleteDomainBranding(ctx context.Context, host string) (bool, error)
+	// DeactivateExpired switches off every active link whose expiry has passed
+	DeactivateExpired(ctx context.Context) (int64, error)
+	// GlobalCounts returns the number of links, total clicks and links created since since,
+	// across all owners
+	GlobalCounts(ctx context.Context, since time.Time) (links, clicks, recent int64, err error)
+}
+
+var (
+	Users UserStore = unavailableStore{}
+	Links URLStore  = unavailableStore{}
+)
+
+// storageBackend returns the configured STORAGE_BACKEND
+func storageBackend() string {
+	if backend := strings.ToLower(os.Getenv("STORAGE_BACKEND")); backend != "" {
+		return backend
+	}
+	return "mongo"
+}
+
+// usesMongo reports whether the MongoDB backend is connected
+func usesMongo() bool {
+	return DB != nil && DB.Database != nil
+}
+
+// linkStore returns the URL store for the request's tenant
+func linkStore(r *http.Request) URLStore {
+	if usesMongo() {
+		return &mongoURLStore{coll: tenantURLs(r)}
+	}
+	return Links
+}
+
+// requireMongo answers 503 for endpoints that only exist on the MongoDB backend
+func requireMongo(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !usesMongo() {
+			http.Error(w, "This endpoint requires the MongoDB storage backend", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// InitStorage connects the backend selected by STORAGE_BACKEND
+func InitStorage() error {
+	switch storageBackend() {
+	case "memory":
+		store := newMemoryStore()
+		Users, Links = store, store
+		startExpiryJanitor(store, time.Minute)
+		log.Println("⚠️  STORAGE_BACKEND=memory: all data is kept in process memory and lost on restart")
+		return nil
+	case "sqlite", "postgres":
+		store, err := openSQLStore(storageBackend())
+		if err != nil {
+			return err
+		}
+		Users, Links = store, store
+		startExpiryJanitor(store, time.Minute)
+		log.Printf("✅ Connected to %s storage backend", storageBackend())
+		return nil
+	case "mongo":
+		if err := InitializeDatabase(); err != nil {
+			return err
+		}
+		if usesMongo() {
+			Users = &mongoUserStore{users: DB.Database.Collection("users")}
+			Links = &mongoURLStore{coll: DB.Collection}
+		}
+		return nil
+	default:
+		return errors.New("unsupported STORAGE_BACKEND " + storageBackend() + " (supported: mongo, memory, sqlite, postgres)")
+	}
+}
+
+// startExpiryJanitor deactivates expired links every interval on backends without the
+// MongoDB cleanup worker
+func startExpiryJanitor(links URLStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			n, err := links.DeactivateExpired(context.Background())
+			if err != nil {
+				log.Printf("⚠️  Expiry cleanup failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Marked %d expired URLs as inactive", n)
+			}
+		}
+	}()
+}
+
+// unavailableStore is used when no backend is connected, e.g. MongoDB unreachable at startup
+type unavailableStore struct{}
+
+func (unavailableStore) CreateUser(context.Context, *User) error { return errStoreUnavailable }
+func (unavailableStore) FindUserByLogin(context.Context, string) (*User, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) GetUserByID(context.Context, primitive.ObjectID) (*User, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) FindUserByRefreshToken(context.Context, string) (*User, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SetRefreshToken(context.Context, primitive.ObjectID, string, time.Time) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) SetTagRules(context.Context, primitive.ObjectID, []TagRule) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) SetTimezone(context.Context, primitive.ObjectID, string) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) SetUserActive(context.Context, primitive.ObjectID, bool) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) DeactivateUser(context.Context, primitive.ObjectID, time.Time) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) FindDeactivatedUser(context.Context, string) (*User, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ReactivateUser(context.Context, primitive.ObjectID, time.Time) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) InactiveUserIDs(context.Context) ([]string, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) RestrictedUserIDs(context.Context, time.Time) ([]string, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SetEmailVerified(context.Context, primitive.ObjectID) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) AddUsage(context.Context, []UsageCount) error { return errStoreUnavailable }
+func (unavailableStore) ListUsage(context.Context, string, time.Time, time.Time) ([]UsageCount, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) InsertLink(context.Context, *URLData) error { return errStoreUnavailable }
+func (unavailableStore) FindLinkByCode(context.Context, string) (*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) CodeHolder(context.Context, string) (*CodeReservation, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) FindRedirectTarget(context.Context, string) (*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) FindActiveLink(context.Context, string, string, string) (*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) FindExpiredDuplicate(context.Context, string, string, string) (*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ReviveLink(context.Context, *URLData, time.Time) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) RecordClick(context.Context, *URLData, ClickHistory) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) RecordBlockedClick(context.Context, *URLData) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) AddLinkOutcomes(context.Context, []LinkOutcomeCount) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) ListLinkOutcomes(context.Context, *URLData, time.Time, time.Time) ([]LinkOutcomeCount, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) CountDailyClick(context.Context, *URLData, string, time.Time) (int, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) PauseLink(context.Context, *URLData, time.Time) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) ResumePausedLinks(context.Context, time.Time, int) ([]*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) CountActiveLinks(context.Context, string) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) ListLinks(context.Context, string, LinkFilter, int, int, bool, []string) ([]map[string]interface{}, int64, map[string]interface{}, error) {
+	return nil, 0, nil, errStoreUnavailable
+}
+func (unavailableStore) PinLink(context.Context, string, string, bool, int) (*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SetLinkAnalytics(context.Context, string, string, bool, bool) (*URLData, int64, error) {
+	return nil, 0, errStoreUnavailable
+}
+func (unavailableStore) EditLink(context.Context, *URLData, LinkEdit) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) DeactivateLink(context.Context, string, string, string) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) ReleaseDraft(context.Context, string) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) SetFavicon(context.Context, *URLData, LinkFavicon) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) StaleFavicons(context.Context, time.Time, int) ([]*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ApplyTagRule(context.Context, string, TagRule) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) ListClicks(context.Context, *URLData, ClickQuery) ([]ClickRecord, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ClickHeatmap(context.Context, string, *URLData, time.Time, *time.Location) (ClickHeatmap, error) {
+	return ClickHeatmap{}, errStoreUnavailable
+}
+func (unavailableStore) ExportClicks(context.Context, ClickExportQuery, func(ClickExportRow) error) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) InsertFolder(context.Context, *Folder) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) FindFolder(context.Context, string, primitive.ObjectID) (*Folder, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ListFolders(context.Context, string, string) ([]*Folder, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) UpdateFolders(context.Context, []*Folder) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) DeleteFolder(context.Context, *Folder) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) MoveLinksToFolder(context.Context, string, []string, string) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) RefileFolderLinks(context.Context, string, string, string) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) FolderLinkCounts(context.Context, string) (map[string]FolderCounts, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) InsertShareEvent(context.Context, *URLData, *ShareEvent, int) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) CountClickWindow(context.Context, *URLData, time.Time, time.Time) (*ClickWindow, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) CountLinkClicks(context.Context, *URLData) (*ClickCounters, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SetClickCounters(context.Context, *URLData, ClickCounters) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) ListUserLinks(context.Context, string, int) ([]*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SampleLinks(context.Context, int) ([]*URLData, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ListShareEvents(context.Context, *URLData, time.Time, time.Time) ([]ShareEvent, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) InsertAnalyticsShare(context.Context, *AnalyticsShare, int, time.Time) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) FindAnalyticsShare(context.Context, string) (*AnalyticsShare, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ListAnalyticsShares(context.Context, string) ([]AnalyticsShare, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) RevokeAnalyticsShare(context.Context, string, primitive.ObjectID, time.Time) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) SetRedirectProbe(context.Context, *URLData, string, int) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) InsertAbuseReport(context.Context, *AbuseReport) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) CountAbuseReporters(context.Context, primitive.ObjectID, time.Time) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) ListAbuseReports(context.Context, int) ([]AbuseReport, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) ResolveAbuseReports(context.Context, string, string) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) SetAbuseFlag(context.Context, string, bool) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) GetDomainBranding(context.Context, string) (*DomainBranding, error) {
+	return nil, errStoreUnavailable
+}
+func (unavailableStore) SaveDomainBranding(context.Context, *DomainBranding) error {
+	return errStoreUnavailable
+}
+func (unavailableStore) DeleteDomainBranding(context.Context, string) (bool, error) {
+	return false, errStoreUnavailable
+}
+func (unavailableStore) DeactivateExpired(context.Context) (int64, error) {
+	return 0, errStoreUnavailable
+}
+func (unavailableStore) GlobalCounts(context.Context, time.Time) (int64, int64, int64, error) {
+	return 0, 0, 0, errStoreUnavailable
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// ACCOUNT SUSPENSION
+// ============================================================================
+//
+// Admins suspend an account with POST /admin/users/{id}/suspend (is_active=false) and
+// restore it with POST /admin/users/{id}/unsuspend. A suspended owner's links answer 410
+// and drop out of public resolve; nothing is written to the links themselves, so they work
+// again as soon as the account is restored. Every instance keeps the suspended user IDs in
+// memory and reloads them every minute; the instance serving the admin call updates its
+// copy at once, the others within a minute. Permanent redirects already cached by browsers
+// or CDNs keep working until their max-age runs out.
+
+const suspendedOwnersRefreshEvery = time.Minute
+
+// userIDSet is an in-memory set of user IDs whose size is published as a gauge
+type userIDSet struct {
+	mu    sync.RWMutex
+	ids   map[string]bool
+	gauge string
+}
+
+func newUserIDSet(gauge string) *userIDSet {
+	return &userIDSet{ids: make(map[string]bool), gauge: gauge}
+}
+
+var suspendedOwners = newUserIDSet("suspended_users")
+
+// Has reports whether userID is in the set
+func (s *userIDSet) Has(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ids[userID]
+}
+
+func (s *userIDSet) set(userID string, member bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if member {
+		s.ids[userID] = true
+	} else {
+		delete(s.ids, userID)
+	}
+	setGauge(s.gauge, int64(len(s.ids)))
+}
+
+func (s *userIDSet) replace(userIDs []string) {
+	ids := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		ids[id] = true
+	}
+	s.mu.Lock()
+	s.ids = ids
+	s.mu.Unlock()
+	setGauge(s.gauge, int64(len(ids)))
+}
+
+// refreshSuspendedOwners reloads the set from the user store
+func refreshSuspendedOwners() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ids, err := Users.InactiveUserIDs(ctx)
+	if err != nil {
+		return err
+	}
+	suspendedOwners.replace(ids)
+	return nil
+}
+
+// StartSuspensionRefresh loads the suspended user IDs and keeps them current. Each instance
+// needs its own copy, so this runs everywhere rather than under runExclusive.
+func StartSuspensionRefresh() {
+	if err := refreshSuspendedOwners(); err != nil {
+		log.Printf("⚠️  Could not load suspended accounts: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(suspendedOwnersRefreshEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := refreshSuspendedOwners(); err != nil {
+				log.Printf("⚠️  Suspended accounts refresh failed: %v", err)
+			}
+		}
+	}()
+}
+
+// writeLinkUnavailable answers a link whose owner is suspended. The message is the same
+// generic one for every reason so it reveals nothing about the account.
+func writeLinkUnavailable(w http.ResponseWriter, r *http.Request) {
+	addSecurityHeaders(w)
+	setNoStoreHeaders(w)
+	if wantsHTML(r) {
+		writeLocalizedPage(w, r, http.StatusGone, "link_unavailable", "")
+		return
+	}
+	http.Error(w, "This link is no longer available", http.StatusGone)
+}
+
+// adminSetUserActive handles POST /admin/users/{id}/suspend and /unsuspend
+func adminSetUserActive(active bool) http.HandlerFunc {
+	event, action := "USER_SUSPENDED", "suspended"
+	if active {
+		event, action = "USER_UNSUSPENDED", "restored"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID := mux.Vars(r)["id"]
+		id, err := primitive.ObjectIDFromHex(targetID)
+		if err != nil {
+			http.Error(w, "invalid user ID", http.StatusBadRequest)
+			return
+		}
+		adminID, _ := r.Context().Value("user_id").(string)
+		if !active && adminID == targetID {
+			http.Error(w, "You cannot suspend your own account", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		found, err := Users.SetUserActive(ctx, id, active)
+		if err != nil {
+			log.Printf("error updating account status of user %s: %v", targetID, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !active {
+			// End the session too; login already refuses inactive accounts
+			if err := Users.SetRefreshToken(ctx, id, "", time.Time{}); err != nil {
+				log.Printf("error revoking refresh token of user %s: %v", targetID, err)
+			}
+		}
+		suspendedOwners.set(targetID, !active)
+
+		logSecurityEvent(r.Context(), event, adminID, getClientIP(r), r.UserAgent(),
+			fmt.Sprintf("Account %s %s by admin", targetID, action), "WARN")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		addSecurityHeaders(w)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"user_id":   targetID,
+			"is_active": active,
+		}); err != nil {
+			log.Printf("error encoding account status response: %v", err)
+		}
+	}
+}
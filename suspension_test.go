@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSuspendBlocksRedirectsUntilRestored(t *testing.T) {
+	srv := newTestServer(t)
+	admin, _ := srv.registerAdmin()
+	token, userID := srv.register()
+	t.Cleanup(func() { suspendedOwners.set(userID, false) })
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/abusive"})
+	bystander, _ := srv.register()
+	unaffected := srv.shorten(bystander, map[string]interface{}{"long-url": "https://example.com/fine"})
+
+	redirect := func(code, accept string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return srv.send(req, nil)
+	}
+	if resp := redirect(code, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("before suspension: status %d", resp.StatusCode)
+	}
+
+	var status struct {
+		IsActive bool `json:"is_active"`
+	}
+	if resp := srv.do("POST", "/admin/users/"+userID+"/suspend", admin, map[string]interface{}{}, &status); resp.StatusCode != http.StatusOK || status.IsActive {
+		t.Fatalf("suspend: status %d, is_active %v", resp.StatusCode, status.IsActive)
+	}
+	resp := redirect(code, "")
+	if body := readBody(t, resp); resp.StatusCode != http.StatusGone || resp.Header.Get("Location") != "" || strings.Contains(body, "suspend") {
+		t.Fatalf("suspended owner's link: status %d, Location %q, body %q", resp.StatusCode, resp.Header.Get("Location"), body)
+	}
+	if resp := redirect(code, "text/html"); resp.StatusCode != http.StatusGone || !strings.Contains(readBody(t, resp), "<h1>") {
+		t.Fatalf("suspended owner's link in a browser: status %d", resp.StatusCode)
+	}
+	if resp := srv.do("GET", "/url/"+code, token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("suspended owner's token: status %d", resp.StatusCode)
+	}
+	if resp := redirect(unaffected, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("another owner's link: status %d", resp.StatusCode)
+	}
+
+	// Other instances learn of the suspension from the user store
+	suspendedOwners.set(userID, false)
+	if err := refreshSuspendedOwners(); err != nil || !suspendedOwners.Has(userID) {
+		t.Fatalf("refresh from the store: %v, suspended %v", err, suspendedOwners.Has(userID))
+	}
+
+	if resp := srv.do("POST", "/admin/users/"+userID+"/unsuspend", admin, map[string]interface{}{}, &status); resp.StatusCode != http.StatusOK || !status.IsActive {
+		t.Fatalf("unsuspend: status %d, is_active %v", resp.StatusCode, status.IsActive)
+	}
+	if resp := redirect(code, ""); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/abusive" {
+		t.Fatalf("after restore: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if err := refreshSuspendedOwners(); err != nil || suspendedOwners.Has(userID) {
+		t.Fatalf("refresh after restore: %v, suspended %v", err, suspendedOwners.Has(userID))
+	}
+}
+
+func TestSuspendRequests(t *testing.T) {
+	srv := newTestServer(t)
+	admin, adminID := srv.registerAdmin()
+	token, userID := srv.register()
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		want  int
+	}{
+		{"not an admin", token, "/admin/users/" + userID + "/suspend", http.StatusForbidden},
+		{"own account", admin, "/admin/users/" + adminID + "/suspend", http.StatusBadRequest},
+		{"invalid ID", admin, "/admin/users/not-an-id/suspend", http.StatusBadRequest},
+		{"unknown user", admin, "/admin/users/000000000000000000000000/suspend", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp := srv.do("POST", tt.path, tt.token, map[string]interface{}{}, nil); resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	if suspendedOwners.Has(userID) {
+		t.Fatal("a refused request suspended the user")
+	}
+}
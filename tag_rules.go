@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ============================================================================
+// AUTO-TAGGING RULES
+// ============================================================================
+//
+// Users keep a list of {host_suffix, tags} rules on their account. When a link is created
+// (shorten or bulk) the tags of every rule matching the destination host are appended to
+// the request's own tags, which come first; the result is deduplicated and cut at
+// MaxTagsPerLink. Rules never touch existing links unless the user calls
+// POST /tag-rules/apply.
+
+const maxTagRulesPerUser = 50
+
+// TagRule tags links to HostSuffix and its subdomains with Tags
+type TagRule struct {
+	HostSuffix string   `bson:"host_suffix" json:"host_suffix"`
+	Tags       []string `bson:"tags" json:"tags"`
+}
+
+// WarnTagsTruncated reports that auto-tag rules would have exceeded MaxTagsPerLink
+const WarnTagsTruncated = "TAGS_TRUNCATED"
+
+var hostSuffixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// normalizeTagRules validates rules, lowercasing host suffixes (without a leading dot) and
+// normalizing their tags like link tags
+func normalizeTagRules(rules []TagRule) ([]TagRule, error) {
+	if len(rules) > maxTagRulesPerUser {
+		return nil, fmt.Errorf("at most %d tag rules are allowed", maxTagRulesPerUser)
+	}
+	normalized := make([]TagRule, 0, len(rules))
+	for i, rule := range rules {
+		suffix := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(rule.HostSuffix)), ".")
+		if len(suffix) > 253 || !hostSuffixPattern.MatchString(suffix) {
+			return nil, fmt.Errorf("rule %d: host_suffix must be a host name such as docs.google.com", i+1)
+		}
+		tags, _, tagErr := normalizeTags(rule.Tags)
+		if tagErr != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, tagErr)
+		}
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("rule %d: at least one tag is required", i+1)
+		}
+		normalized = append(normalized, TagRule{HostSuffix: suffix, Tags: tags})
+	}
+	return normalized, nil
+}
+
+// matches reports whether host is the rule's host or one of its subdomains
+func (rule TagRule) matches(host string) bool {
+	return host == rule.HostSuffix || strings.HasSuffix(host, "."+rule.HostSuffix)
+}
+
+// destinationHost returns the lowercased host name of a destination URL
+func destinationHost(longURL string) string {
+	parsed, err := url.Parse(longURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// applyTagRules appends the tags of the rules matching longURL's host to tags, keeping
+// explicit tags first. A warning is returned when MaxTagsPerLink cut rule tags off.
+func applyTagRules(rules []TagRule, longURL string, tags []string) ([]string, []Warning) {
+	host := destinationHost(longURL)
+	if host == "" || len(rules) == 0 {
+		return tags, nil
+	}
+	merged := append([]string{}, tags...)
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		seen[tag] = true
+	}
+	truncated := false
+	for _, rule := range rules {
+		if !rule.matches(host) {
+			continue
+		}
+		for _, tag := range rule.Tags {
+			if seen[tag] {
+				continue
+			}
+			if len(merged) >= MaxTagsPerLink {
+				truncated = true
+				break
+			}
+			seen[tag] = true
+			merged = append(merged, tag)
+		}
+	}
+	if truncated {
+		return merged, []Warning{{
+			Code:    WarnTagsTruncated,
+			Message: fmt.Sprintf("Auto-tag rules added tags up to the limit of %d per link", MaxTagsPerLink),
+		}}
+	}
+	return merged, nil
+}
+
+// loadTagRules returns the user's tag rules; creation goes on without them on errors
+func loadTagRules(userID string) []TagRule {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	user, err := Users.GetUserByID(ctx, id)
+	if err != nil {
+		log.Printf("Warning: could not load tag rules for user %s: %v", userID, err)
+		return nil
+	}
+	return user.TagRules
+}
+
+// writeTagRules encodes the rules response shared by GET and PUT /tag-rules
+func writeTagRules(w http.ResponseWriter, rules []TagRule) {
+	if rules == nil {
+		rules = []TagRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"rules":   rules,
+	}); err != nil {
+		log.Printf("error encoding tag rules response: %v", err)
+	}
+}
+
+// getTagRules handles GET /tag-rules
+func getTagRules(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+	writeTagRules(w, user.TagRules)
+}
+
+// putTagRules handles PUT /tag-rules, replacing the whole list with {"rules": [...]}
+func putTagRules(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Rules []TagRule `json:"rules"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	rules, err := normalizeTagRules(req.Rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Users.SetTagRules(ctx, id, rules); err != nil {
+		log.Printf("error saving tag rules for user %s: %v", userID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	logSecurityEvent(r.Context(), "TAG_RULES_UPDATED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Tag rules replaced (%d rules)", len(rules)), "INFO")
+	writeTagRules(w, rules)
+}
+
+// applyTagRulesToLinks handles POST /tag-rules/apply: the rules are run over the user's
+// existing active links and the number of links each rule changed is reported
+func applyTagRulesToLinks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		writeStoreError(w, err, "User", "database error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	store := linkStore(r)
+	total := int64(0)
+	perRule := make([]map[string]interface{}, 0, len(user.TagRules))
+	for _, rule := range user.TagRules {
+		modified, err := store.ApplyTagRule(ctx, userID, rule)
+		if err != nil {
+			log.Printf("error applying tag rule %s for user %s: %v", rule.HostSuffix, userID, err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		total += modified
+		perRule = append(perRule, map[string]interface{}{"host_suffix": rule.HostSuffix, "modified": modified})
+	}
+	if total > 0 {
+		invalidateUserStats(userID)
+	}
+	logSecurityEvent(r.Context(), "TAG_RULES_APPLIED", userID, getClientIP(r), r.UserAgent(),
+		fmt.Sprintf("Tag rules applied to existing links (%d updates)", total), "INFO")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"modified": total,
+		"rules":    perRule,
+	}); err != nil {
+		log.Printf("error encoding tag rules apply response: %v", err)
+	}
+}
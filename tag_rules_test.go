@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTagRules(t *testing.T) {
+	got, err := normalizeTagRules([]TagRule{
+		{HostSuffix: " .Docs.Google.COM ", Tags: []string{"Internal", "internal"}},
+		{HostSuffix: "github.com", Tags: []string{"code"}},
+	})
+	want := []TagRule{{HostSuffix: "docs.google.com", Tags: []string{"internal"}}, {HostSuffix: "github.com", Tags: []string{"code"}}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalizeTagRules = %+v, %v; want %+v", got, err, want)
+	}
+	for _, invalid := range [][]TagRule{
+		{{HostSuffix: "https://github.com", Tags: []string{"code"}}},
+		{{HostSuffix: "github.com/org", Tags: []string{"code"}}},
+		{{HostSuffix: "*.github.com", Tags: []string{"code"}}},
+		{{HostSuffix: "", Tags: []string{"code"}}},
+		{{HostSuffix: "github.com"}},
+		{{HostSuffix: "github.com", Tags: []string{" "}}},
+	} {
+		if _, err := normalizeTagRules(invalid); err == nil {
+			t.Errorf("%+v accepted", invalid)
+		}
+	}
+	tooMany := make([]TagRule, maxTagRulesPerUser+1)
+	for i := range tooMany {
+		tooMany[i] = TagRule{HostSuffix: fmt.Sprintf("host%d.example", i), Tags: []string{"t"}}
+	}
+	if _, err := normalizeTagRules(tooMany); err == nil {
+		t.Errorf("%d rules accepted", len(tooMany))
+	}
+}
+
+func TestApplyTagRules(t *testing.T) {
+	rules := []TagRule{
+		{HostSuffix: "google.com", Tags: []string{"google", "external"}},
+		{HostSuffix: "docs.google.com", Tags: []string{"internal", "google"}},
+	}
+	tests := []struct {
+		name    string
+		longURL string
+		tags    []string
+		want    []string
+	}{
+		{"no match", "https://example.com/", []string{"mine"}, []string{"mine"}},
+		{"exact host", "https://google.com/search", nil, []string{"google", "external"}},
+		{"subdomain, rules in order", "https://docs.google.com/d/1", nil, []string{"google", "external", "internal"}},
+		{"explicit tags first", "https://docs.google.com/d/1", []string{"q3", "internal"}, []string{"q3", "internal", "google", "external"}},
+		{"host is case-insensitive", "https://DOCS.Google.COM/d/1", nil, []string{"google", "external", "internal"}},
+		{"suffix without dot", "https://notgoogle.com/", nil, nil},
+		{"suffix elsewhere", "https://google.com.evil.net/", nil, nil},
+		{"host in path", "https://evil.net/docs.google.com", nil, nil},
+		{"unparseable", "::", []string{"mine"}, []string{"mine"}},
+	}
+	for _, tt := range tests {
+		got, warnings := applyTagRules(rules, tt.longURL, tt.tags)
+		if len(got) == 0 && len(tt.want) == 0 {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) || len(warnings) != 0 {
+			t.Errorf("%s: applyTagRules(%s, %q) = %q, %v; want %q", tt.name, tt.longURL, tt.tags, got, warnings, tt.want)
+		}
+	}
+
+	explicit := make([]string, MaxTagsPerLink-1)
+	for i := range explicit {
+		explicit[i] = fmt.Sprintf("tag%d", i)
+	}
+	got, warnings := applyTagRules(rules, "https://google.com/", explicit)
+	if len(got) != MaxTagsPerLink || got[MaxTagsPerLink-1] != "google" || len(warnings) != 1 || warnings[0].Code != WarnTagsTruncated {
+		t.Fatalf("at the tag limit: %q, %v", got, warnings)
+	}
+}
+
+func TestTagRulesAtCreationAndApply(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	other, _ := srv.register()
+	before := srv.shorten(token, map[string]interface{}{"long-url": "https://docs.google.com/before", "tags": []string{"old"}})
+	unrelated := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/unrelated"})
+	othersLink := srv.shorten(other, map[string]interface{}{"long-url": "https://docs.google.com/theirs"})
+
+	var saved struct {
+		Rules []TagRule `json:"rules"`
+	}
+	resp := srv.do("PUT", "/tag-rules", token, map[string]interface{}{"rules": []TagRule{
+		{HostSuffix: "docs.google.com", Tags: []string{"Internal"}},
+		{HostSuffix: "google.com", Tags: []string{"google"}},
+	}}, &saved)
+	if resp.StatusCode != http.StatusOK || len(saved.Rules) != 2 || saved.Rules[0].Tags[0] != "internal" {
+		t.Fatalf("PUT /tag-rules: status %d, rules %+v", resp.StatusCode, saved.Rules)
+	}
+	if resp := srv.do("PUT", "/tag-rules", token, map[string]interface{}{"rules": []TagRule{{HostSuffix: "a/b", Tags: []string{"x"}}}}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid rule: status %d", resp.StatusCode)
+	}
+
+	tagsOf := func(token, code string) []string {
+		var link URLData
+		srv.do("GET", "/url/"+code, token, nil, &link)
+		return link.Tags
+	}
+
+	// Creation applies the rules after the request's tags
+	created := srv.shorten(token, map[string]interface{}{"long-url": "https://docs.google.com/after", "tags": []string{"q3", "google"}})
+	if got := tagsOf(token, created); !reflect.DeepEqual(got, []string{"q3", "google", "internal"}) {
+		t.Fatalf("created with tags %q", got)
+	}
+	// Existing links are left alone until apply
+	if got := tagsOf(token, before); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Fatalf("rules changed an existing link: %q", got)
+	}
+
+	var applied struct {
+		Modified int64 `json:"modified"`
+		Rules    []struct {
+			HostSuffix string `json:"host_suffix"`
+			Modified   int64  `json:"modified"`
+		} `json:"rules"`
+	}
+	if resp := srv.do("POST", "/tag-rules/apply", token, map[string]interface{}{}, &applied); resp.StatusCode != http.StatusOK {
+		t.Fatalf("apply: status %d", resp.StatusCode)
+	}
+	// Both rules add to the older link; the new one already has every tag
+	if applied.Modified != 2 || len(applied.Rules) != 2 || applied.Rules[0].Modified != 1 || applied.Rules[1].Modified != 1 {
+		t.Fatalf("apply reported %+v", applied)
+	}
+	if got := tagsOf(token, before); !reflect.DeepEqual(got, []string{"old", "internal", "google"}) {
+		t.Fatalf("after apply the existing link has %q", got)
+	}
+	if got := tagsOf(token, unrelated); len(got) != 0 {
+		t.Fatalf("apply tagged an unrelated link: %q", got)
+	}
+	if got := tagsOf(other, othersLink); len(got) != 0 {
+		t.Fatalf("apply tagged another user's link: %q", got)
+	}
+
+	applied.Modified = -1
+	srv.do("POST", "/tag-rules/apply", token, map[string]interface{}{}, &applied)
+	if applied.Modified != 0 {
+		t.Fatalf("second apply modified %d links", applied.Modified)
+	}
+}
+
+func TestTagRuleApplyIsAnEdit(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	tagged := srv.shorten(token, map[string]interface{}{"long-url": "https://docs.google.com/versioned"})
+	untouched := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/versioned"})
+	version := func(code string) string {
+		var seen editVersion
+		srv.do("GET", "/url/"+code, token, nil, &seen)
+		if seen.UpdatedAt == nil {
+			t.Fatalf("%s has no version", code)
+		}
+		return seen.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	before, unrelated := version(tagged), version(untouched)
+
+	srv.do("PUT", "/tag-rules", token, map[string]interface{}{"rules": []TagRule{{HostSuffix: "google.com", Tags: []string{"google"}}}}, nil)
+	SetClock(FixedClock(clockTestBase.Add(time.Minute)))
+	if resp := srv.do("POST", "/tag-rules/apply", token, map[string]interface{}{}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("apply: status %d", resp.StatusCode)
+	}
+
+	// An edit made from the version before the rule ran would drop its tag
+	if resp := srv.do("PATCH", "/url/"+tagged, token, map[string]interface{}{"tags": []string{"mine"}, "expected_version": before}, nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("edit from before the apply: status %d", resp.StatusCode)
+	}
+	if after := version(untouched); after != unrelated {
+		t.Errorf("a link the rule skipped moved from version %s to %s", unrelated, after)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// TAG NORMALIZATION
+// ============================================================================
+
+// TagError reports the tags that violate the per-link limits
+type TagError struct {
+	Reason      string
+	InvalidTags []string
+}
+
+func (e *TagError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, strings.Join(e.InvalidTags, ", "))
+}
+
+// normalizeTags lowercases tags, collapses inner whitespace, drops empty entries and
+// duplicates, then enforces MaxTagsPerLink and MaxTagLength. Every write path that accepts
+// tags goes through it so the tag-distribution aggregation sees one spelling per tag.
+// A warning is returned when the stored tags differ from the ones supplied.
+func normalizeTags(tags []string) ([]string, []Warning, *TagError) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	var tooLong []string
+	changed := false
+	for _, raw := range tags {
+		tag := strings.ToLower(strings.Join(strings.Fields(raw), " "))
+		if tag != raw {
+			changed = true
+		}
+		if tag == "" || seen[tag] {
+			changed = true
+			continue
+		}
+		seen[tag] = true
+		// Length is measured in characters before HTML escaping, so "r&d" counts as 3
+		if utf8.RuneCountInString(tag) > MaxTagLength {
+			tooLong = append(tooLong, tag)
+			continue
+		}
+		normalized = append(normalized, sanitizeInput(tag))
+	}
+
+	if len(tooLong) > 0 {
+		return nil, nil, &TagError{
+			Reason:      fmt.Sprintf("tags must be at most %d characters", MaxTagLength),
+			InvalidTags: tooLong,
+		}
+	}
+	if len(normalized) > MaxTagsPerLink {
+		return nil, nil, &TagError{
+			Reason:      fmt.Sprintf("at most %d tags are allowed per link", MaxTagsPerLink),
+			InvalidTags: normalized[MaxTagsPerLink:],
+		}
+	}
+	if changed {
+		return normalized, []Warning{{
+			Code:    WarnTagsNormalized,
+			Message: "Tags were lowercased, whitespace-collapsed and deduplicated",
+		}}, nil
+	}
+	return normalized, nil, nil
+}
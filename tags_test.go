@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		want    []string
+		warning bool
+	}{
+		{"already normal", []string{"go", "docs"}, []string{"go", "docs"}, false},
+		{"case duplicates", []string{"Go", "GO", "go"}, []string{"go"}, true},
+		{"whitespace", []string{"  release   notes ", "release notes"}, []string{"release notes"}, true},
+		{"empty entries", []string{"", "   ", "api"}, []string{"api"}, true},
+		{"unicode lowercased", []string{"Ünïcödé", "ÜNÏCÖDÉ"}, []string{"ünïcödé"}, true},
+		{"greek final sigma", []string{"ΟΔΟΣ"}, []string{"οδοσ"}, true},
+		{"cjk and emoji", []string{"日本語", "🚀 launch"}, []string{"日本語", "🚀 launch"}, false},
+		{"html escaped after counting", []string{"r&d"}, []string{"r&amp;d"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings, err := normalizeTags(tt.in)
+			if err != nil {
+				t.Fatalf("normalizeTags(%q) failed: %s", tt.in, err.Reason)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeTags(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if (len(warnings) > 0) != tt.warning {
+				t.Errorf("normalizeTags(%q) warnings %v, want warning %v", tt.in, warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestNormalizeTagsLimits(t *testing.T) {
+	tags := make([]string, MaxTagsPerLink+1)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+	}
+	if _, _, err := normalizeTags(tags[:MaxTagsPerLink]); err != nil {
+		t.Fatalf("%d tags refused: %s", MaxTagsPerLink, err.Reason)
+	}
+	_, _, err := normalizeTags(tags)
+	if err == nil || !reflect.DeepEqual(err.InvalidTags, []string{tags[MaxTagsPerLink]}) {
+		t.Fatalf("%d tags: %+v, want the 21st reported", len(tags), err)
+	}
+
+	// Duplicates differing only by case count once against the limit
+	if _, _, err := normalizeTags(append(tags[:MaxTagsPerLink:MaxTagsPerLink], "TAG0")); err != nil {
+		t.Fatalf("20 tags plus a case duplicate refused: %s", err.Reason)
+	}
+
+	// Length counts characters, not bytes
+	if _, _, err := normalizeTags([]string{strings.Repeat("é", MaxTagLength)}); err != nil {
+		t.Fatalf("%d two-byte characters refused: %s", MaxTagLength, err.Reason)
+	}
+	if _, _, err := normalizeTags([]string{strings.Repeat("é", MaxTagLength+1)}); err == nil {
+		t.Fatalf("%d characters accepted", MaxTagLength+1)
+	}
+}
+
+func TestShortenRejectsTwentyOneTags(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	tags := make([]string, MaxTagsPerLink+1)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+	}
+	var body struct {
+		Success     bool     `json:"success"`
+		InvalidTags []string `json:"invalid_tags"`
+	}
+	resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/tags", "tags": tags}, &body)
+	if resp.StatusCode != http.StatusUnprocessableEntity || body.Success || !reflect.DeepEqual(body.InvalidTags, []string{"tag20"}) {
+		t.Fatalf("21 tags: status %d, body %+v", resp.StatusCode, body)
+	}
+
+	var link URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/tags", "tags": []string{"Docs", "DOCS", " docs "}}, &link)
+	if !reflect.DeepEqual(link.Tags, []string{"docs"}) {
+		t.Fatalf("stored tags %q, want [docs]", link.Tags)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// PER-USER API USAGE
+// ============================================================================
+//
+// Every authenticated request is counted per user, UTC day and route ("GET /analytics"),
+// together with the requests of that user refused by the rate limiter. The request path only
+// does one non-blocking channel send; a background recorder sums the hits and upserts them
+// every usageFlushInterval, so GET /usage lags by up to that long. Hits are dropped (and
+// counted in usage_dropped_total) when the queue is full. Counters are kept for
+// usageRetentionDays: MongoDB expires them with a TTL index on day, the SQL and memory
+// stores prune them as they write.
+
+const (
+	usageQueueSize      = 10000
+	usageFlushInterval  = 10 * time.Second
+	usageRetentionDays  = 90
+	defaultUsageDays    = 30
+	usageDayLayout      = "2006-01-02"
+	usageEndpointMaxLen = 200
+)
+
+// UsageCount is one user's calls to one endpoint on one UTC day
+type UsageCount struct {
+	UserID      string    `bson:"user_id" json:"-"`
+	Day         time.Time `bson:"day" json:"-"`
+	Endpoint    string    `bson:"endpoint" json:"endpoint"`
+	Requests    int64     `bson:"requests" json:"requests"`
+	RateLimited int64     `bson:"rate_limited" json:"rate_limited"`
+}
+
+// usageKey identifies the counter a hit adds to, and the store it is written to
+type usageKey struct {
+	store    UserStore
+	userID   string
+	day      time.Time
+	endpoint string
+}
+
+// usageHit is one request to count. A hit with done set only marks a point in the queue: it
+// is closed once every hit queued before it has been written.
+type usageHit struct {
+	key     usageKey
+	limited bool
+	done    chan struct{}
+}
+
+// usageRecorder sums hits in memory and writes them to the user store in batches
+type usageRecorder struct {
+	queue chan usageHit
+	once  sync.Once
+}
+
+var apiUsage = &usageRecorder{queue: make(chan usageHit, usageQueueSize)}
+
+// Record queues one request of userID to endpoint, counted in store
+func (u *usageRecorder) Record(store UserStore, userID, endpoint string, at time.Time, limited bool) {
+	u.once.Do(func() { go u.run() })
+	select {
+	case u.queue <- usageHit{key: usageKey{store: store, userID: userID, day: usageDay(at), endpoint: endpoint}, limited: limited}:
+	default:
+		incMetric("usage_dropped_total", 1)
+	}
+}
+
+// Drain waits until every hit queued so far has been written
+func (u *usageRecorder) Drain(ctx context.Context) {
+	u.once.Do(func() { go u.run() })
+	done := make(chan struct{})
+	select {
+	case u.queue <- usageHit{done: done}:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Warning: usage queue drain interrupted: %v", ctx.Err())
+	}
+}
+
+func (u *usageRecorder) run() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	pending := make(map[usageKey]*UsageCount)
+	for {
+		select {
+		case hit := <-u.queue:
+			if hit.done != nil {
+				u.flush(pending)
+				pending = make(map[usageKey]*UsageCount)
+				close(hit.done)
+				continue
+			}
+			count, ok := pending[hit.key]
+			if !ok {
+				count = &UsageCount{UserID: hit.key.userID, Day: hit.key.day, Endpoint: hit.key.endpoint}
+				pending[hit.key] = count
+			}
+			count.Requests++
+			if hit.limited {
+				count.RateLimited++
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				u.flush(pending)
+				pending = make(map[usageKey]*UsageCount)
+			}
+		}
+	}
+}
+
+func (u *usageRecorder) flush(pending map[usageKey]*UsageCount) {
+	if len(pending) == 0 {
+		return
+	}
+	byStore := make(map[UserStore][]UsageCount)
+	for key, count := range pending {
+		byStore[key.store] = append(byStore[key.store], *count)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for store, counts := range byStore {
+		if err := store.AddUsage(ctx, counts); err != nil {
+			incMetric("usage_flush_failed_total", 1)
+			log.Printf("error writing API usage counters: %v", err)
+		}
+	}
+}
+
+// usageDay truncates t to its UTC day
+func usageDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// usageMiddleware counts the request for its user once the handler has run. The user is the
+// one JWTMiddleware authenticated; requests refused by the rate limiter never get there, so
+// their bearer token is checked here instead.
+func usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		info := requestInfoFrom(r.Context())
+		userID := info.UserID
+		if userID == "" && info.RateLimited {
+			userID = bearerUserID(r)
+		}
+		if userID == "" || info.Route == "" {
+			return
+		}
+		endpoint := info.Route
+		if len(endpoint) > usageEndpointMaxLen {
+			endpoint = endpoint[:usageEndpointMaxLen]
+		}
+		apiUsage.Record(Users, userID, endpoint, clock.Now(), info.RateLimited)
+	})
+}
+
+// bearerUserID returns the user of a valid bearer token on r, or ""
+func bearerUserID(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		return ""
+	}
+	return claims.UserID
+}
+
+// getUsage handles GET /usage?from=&to= (YYYY-MM-DD, inclusive; the last 30 days by default)
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(string)
+	if !ok {
+		http.Error(w, "user information not found", http.StatusInternalServerError)
+		return
+	}
+	today := usageDay(clock.Now())
+	to, from := today, today.AddDate(0, 0, 1-defaultUsageDays)
+	var err error
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		if to, err = time.Parse(usageDayLayout, raw); err != nil {
+			http.Error(w, "to must be a YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		from = to.AddDate(0, 0, 1-defaultUsageDays)
+	}
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		if from, err = time.Parse(usageDayLayout, raw); err != nil {
+			http.Error(w, "from must be a YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) >= usageRetentionDays*24*time.Hour {
+		http.Error(w, "the range can span at most 90 days", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts, err := Users.ListUsage(ctx, userID, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		log.Printf("error loading API usage of user %s: %v", userID, err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	type usageDayTotals struct {
+		Date        string       `json:"date"`
+		Requests    int64        `json:"requests"`
+		RateLimited int64        `json:"rate_limited"`
+		Endpoints   []UsageCount `json:"endpoints"`
+	}
+	byDay := make(map[string]*usageDayTotals)
+	var totalRequests, totalLimited int64
+	for _, count := range counts {
+		date := count.Day.UTC().Format(usageDayLayout)
+		day, ok := byDay[date]
+		if !ok {
+			day = &usageDayTotals{Date: date}
+			byDay[date] = day
+		}
+		day.Requests += count.Requests
+		day.RateLimited += count.RateLimited
+		day.Endpoints = append(day.Endpoints, count)
+		totalRequests += count.Requests
+		totalLimited += count.RateLimited
+	}
+	days := make([]*usageDayTotals, 0, len(byDay))
+	for _, day := range byDay {
+		sort.Slice(day.Endpoints, func(i, j int) bool {
+			if day.Endpoints[i].Requests != day.Endpoints[j].Requests {
+				return day.Endpoints[i].Requests > day.Endpoints[j].Requests
+			}
+			return day.Endpoints[i].Endpoint < day.Endpoints[j].Endpoint
+		})
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	addSecurityHeaders(w)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"from":    from.Format(usageDayLayout),
+		"to":      to.Format(usageDayLayout),
+		"totals": map[string]int64{
+			"requests":     totalRequests,
+			"rate_limited": totalLimited,
+		},
+		"days": days,
+	}); err != nil {
+		log.Printf("error encoding usage response: %v", err)
+	}
+}
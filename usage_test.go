@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// usageReport is the body of GET /usage
+type usageReport struct {
+	From   string           `json:"from"`
+	To     string           `json:"to"`
+	Totals map[string]int64 `json:"totals"`
+	Days   []struct {
+		Date        string       `json:"date"`
+		Requests    int64        `json:"requests"`
+		RateLimited int64        `json:"rate_limited"`
+		Endpoints   []UsageCount `json:"endpoints"`
+	} `json:"days"`
+}
+
+// endpointUsage returns the counters of endpoint on the report's only day
+func (u usageReport) endpointUsage(endpoint string) UsageCount {
+	for _, day := range u.Days {
+		for _, count := range day.Endpoints {
+			if count.Endpoint == endpoint {
+				return count
+			}
+		}
+	}
+	return UsageCount{}
+}
+
+func TestUsageCountersUnderConcurrency(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	alice, _ := srv.register()
+	bob, _ := srv.register()
+
+	const clients, perClient = 8, 20
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			// Each client has its own address so the rate limiter stays out of the way
+			peer := fmt.Sprintf("198.51.100.%d:4000", c+1)
+			for i := 0; i < perClient; i++ {
+				token, path := alice, "/analytics"
+				if c%2 == 1 {
+					token = bob
+				}
+				if i%4 == 0 {
+					path = "/auth/profile"
+				}
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				srv.serveFrom(peer, req)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// Requests the rate limiter refuses are counted as such
+	policy := liveConfig().RateLimit("global")
+	for i := 0; i < policy.Limit+5; i++ {
+		req := httptest.NewRequest("GET", "/auth/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+alice)
+		srv.serveFrom("203.0.113.77:4000", req)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	apiUsage.Drain(ctx)
+
+	var report usageReport
+	if resp := srv.do("GET", "/usage", alice, nil, &report); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /usage: status %d", resp.StatusCode)
+	}
+	if len(report.Days) != 1 || report.Days[0].Date != "2031-03-01" || report.To != "2031-03-01" {
+		t.Fatalf("usage days %+v, to %s", report.Days, report.To)
+	}
+	// Four clients each, a quarter of their requests to the profile
+	analytics, profile := report.endpointUsage("GET /analytics"), report.endpointUsage("GET /auth/profile")
+	if analytics.Requests != clients/2*perClient*3/4 || analytics.RateLimited != 0 {
+		t.Errorf("GET /analytics: %+v, want %d requests", analytics, clients/2*perClient*3/4)
+	}
+	wantProfile := int64(clients/2*perClient/4 + policy.Limit + 5)
+	if profile.Requests != wantProfile || profile.RateLimited != 5 {
+		t.Errorf("GET /auth/profile: %+v, want %d requests, 5 rate limited", profile, wantProfile)
+	}
+	if report.Totals["requests"] != analytics.Requests+profile.Requests || report.Totals["rate_limited"] != 5 {
+		t.Errorf("totals %v", report.Totals)
+	}
+
+	// Bob's counters are his own
+	var bobs usageReport
+	srv.do("GET", "/usage", bob, nil, &bobs)
+	if got := bobs.endpointUsage("GET /analytics").Requests; got != clients/2*perClient*3/4 {
+		t.Errorf("bob's GET /analytics requests %d", got)
+	}
+	if bobs.Totals["rate_limited"] != 0 {
+		t.Errorf("bob has %d rate limited requests", bobs.Totals["rate_limited"])
+	}
+}
+
+func TestUsageRange(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	srv := newTestServer(t)
+	token, _ := srv.register()
+
+	var report usageReport
+	srv.do("GET", "/usage", token, nil, &report)
+	if report.From != "2031-01-31" || report.To != "2031-03-01" {
+		t.Fatalf("default range %s to %s", report.From, report.To)
+	}
+	for _, bad := range []string{"from=March", "to=2031-13-01", "from=2031-03-02&to=2031-03-01", "from=2030-01-01&to=2031-03-01"} {
+		if resp := srv.do("GET", "/usage?"+bad, token, nil, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, resp.StatusCode)
+		}
+	}
+}
+
+func TestUsageRecordNeverBlocks(t *testing.T) {
+	recorder := &usageRecorder{queue: make(chan usageHit, 1)}
+	// No recorder goroutine drains the queue
+	recorder.once.Do(func() {})
+	dropped := metricValue("usage_dropped_total")
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			recorder.Record(newMemoryStore(), "user", "GET /analytics", clockTestBase, false)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked on a full queue")
+	}
+	if got := metricValue("usage_dropped_total") - dropped; got != 2 {
+		t.Fatalf("%d hits counted as dropped, want 2", got)
+	}
+}
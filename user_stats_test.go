@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// withStatsPipelines replaces the aggregations of GetUserStatsOptimized for one test
+func withStatsPipelines(t *testing.T, pipelines ...userStatsPipeline) {
+	t.Helper()
+	saved := userStatsPipelines
+	userStatsPipelines = pipelines
+	t.Cleanup(func() { userStatsPipelines = saved })
+}
+
+// valueStats answers value at once
+func valueStats(value interface{}) func(context.Context, string) (interface{}, error) {
+	return func(context.Context, string) (interface{}, error) { return value, nil }
+}
+
+// blockedStats waits for its context and reports on cancelled when it gave up
+func blockedStats(cancelled chan<- error) func(context.Context, string) (interface{}, error) {
+	return func(ctx context.Context, _ string) (interface{}, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+func statsKeys(stats map[string]interface{}) []string {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestUserStatsKeys(t *testing.T) {
+	failure := errors.New("aggregation failed")
+	withStatsPipelines(t,
+		userStatsPipeline{key: "basic", required: true, run: valueStats(map[string]interface{}{"total_urls": 4, "total_clicks": 10, "avg_clicks_per_url": 2.5})},
+		userStatsPipeline{key: "top_links", run: valueStats([]map[string]interface{}{{"short_url": "abc"}})},
+		userStatsPipeline{key: "tag_distribution", run: func(context.Context, string) (interface{}, error) { return nil, failure }},
+	)
+	failed := metricValue("user_stats_tag_distribution_failed_total")
+	runs := metricValue("user_stats_top_links_runs_total")
+
+	stats, err := GetUserStatsOptimized(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"avg_clicks_per_url", "clicks_over_time", "domain_distribution", "status_counts", "tag_distribution", "top_links", "total_clicks", "total_urls"}
+	if got := statsKeys(stats); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+	if stats["total_clicks"] != 10 || len(stats["top_links"].([]map[string]interface{})) != 1 {
+		t.Fatalf("stats %v", stats)
+	}
+	// A failed distribution keeps its empty default
+	if tags, ok := stats["tag_distribution"].([]map[string]interface{}); !ok || len(tags) != 0 {
+		t.Fatalf("tag_distribution after a failure: %v", stats["tag_distribution"])
+	}
+	if metricValue("user_stats_tag_distribution_failed_total") != failed+1 || metricValue("user_stats_top_links_runs_total") != runs+1 {
+		t.Fatal("pipeline metrics not counted")
+	}
+}
+
+func TestUserStatsRequiredFailureCancelsOthers(t *testing.T) {
+	failure := errors.New("basic stats failed")
+	cancelled := make(chan error, 2)
+	withStatsPipelines(t,
+		userStatsPipeline{key: "basic", required: true, run: func(context.Context, string) (interface{}, error) { return nil, failure }},
+		userStatsPipeline{key: "clicks_over_time", run: blockedStats(cancelled)},
+		userStatsPipeline{key: "top_links", run: blockedStats(cancelled)},
+	)
+
+	start := time.Now()
+	_, err := GetUserStatsOptimized(context.Background(), "user-1")
+	if !errors.Is(err, failure) {
+		t.Fatalf("error %v, want the basic stats failure", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %v, the slow pipelines were not cancelled", elapsed)
+	}
+	// Both siblings saw the cancellation before the call returned
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-cancelled:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("sibling stopped with %v", err)
+			}
+		default:
+			t.Fatal("GetUserStatsOptimized returned before its pipelines stopped")
+		}
+	}
+}
+
+func TestUserStatsCallerDeadline(t *testing.T) {
+	cancelled := make(chan error, 2)
+	withStatsPipelines(t,
+		userStatsPipeline{key: "basic", required: true, run: blockedStats(cancelled)},
+		userStatsPipeline{key: "domain_distribution", run: blockedStats(cancelled)},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := GetUserStatsOptimized(ctx, "user-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want the caller's deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %v, past the caller's 50ms deadline", elapsed)
+	}
+	if len(cancelled) != 2 {
+		t.Fatalf("%d of 2 pipelines stopped", len(cancelled))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// validateAnswer is the JSON of /auth/validate, for a valid token or an error
+type validateAnswer struct {
+	Valid            bool      `json:"valid"`
+	UserID           string    `json:"user_id"`
+	TokenType        string    `json:"token_type"`
+	Issuer           string    `json:"issuer"`
+	IssuedAt         time.Time `json:"issued_at"`
+	Expires          time.Time `json:"expires"`
+	SecondsRemaining int64     `json:"seconds_remaining"`
+	Error            struct {
+		Code string `json:"code"`
+	} `json:"error"`
+}
+
+// signedToken signs claims for userID with method and key
+func signedToken(t *testing.T, method jwt.SigningMethod, key interface{}, userID string, issued, expires time.Time) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, &Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(issued),
+			ExpiresAt: jwt.NewNumericDate(expires),
+			Issuer:    "rapidlink-api",
+		},
+	}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateTokenInputs(t *testing.T) {
+	srv := newTestServer(t)
+	token, userID := srv.register()
+
+	check := func(mode string, resp *http.Response, got validateAnswer) {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK || !got.Valid || got.UserID != userID || got.TokenType != "access" || got.Issuer != "rapidlink-api" {
+			t.Fatalf("%s: status %d, %+v", mode, resp.StatusCode, got)
+		}
+		if remaining := time.Duration(got.SecondsRemaining) * time.Second; remaining > TokenDuration || remaining < TokenDuration-time.Minute {
+			t.Errorf("%s: %v remaining of a fresh token", mode, remaining)
+		}
+		if time.Since(got.IssuedAt) > time.Minute || !got.Expires.After(got.IssuedAt) {
+			t.Errorf("%s: issued at %s, expires %s", mode, got.IssuedAt, got.Expires)
+		}
+	}
+
+	var body validateAnswer
+	resp := srv.do("POST", "/auth/validate", "", map[string]string{"token": token}, &body)
+	check("body", resp, body)
+
+	var header validateAnswer
+	resp = srv.do("GET", "/auth/validate", token, nil, &header)
+	check("header", resp, header)
+
+	// A bodyless POST reads the header too
+	req, _ := http.NewRequest("POST", srv.URL+"/auth/validate", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var post validateAnswer
+	resp = srv.send(req, &post)
+	check("bodyless POST", resp, post)
+
+	// The body wins over the header
+	var both validateAnswer
+	resp = srv.do("POST", "/auth/validate", "not-a-token", map[string]string{"token": token}, &both)
+	check("body and header", resp, both)
+
+	for _, body := range []interface{}{map[string]string{"token": ""}, "not an object"} {
+		if resp := srv.do("POST", "/auth/validate", token, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("body %v: status %d", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestValidateTokenFailures(t *testing.T) {
+	srv := newTestServer(t)
+	_, userID := srv.register()
+	now := time.Now()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := signedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, userID, now, now.Add(time.Hour))
+	valid := signedToken(t, jwt.SigningMethodHS256, JWTSecret, userID, now, now.Add(time.Hour))
+
+	tests := []struct {
+		name, token, code string
+	}{
+		{"expired", signedToken(t, jwt.SigningMethodHS256, JWTSecret, userID, now.Add(-2*time.Hour), now.Add(-time.Hour)), ErrCodeTokenExpired},
+		{"malformed", "not.a.jwt", ErrCodeTokenMalformed},
+		{"truncated", valid[:strings.LastIndex(valid, ".")], ErrCodeTokenMalformed},
+		{"foreign secret", signedToken(t, jwt.SigningMethodHS256, []byte("someone else's secret"), userID, now, now.Add(time.Hour)), ErrCodeTokenSignature},
+		{"tampered", valid[:len(valid)-2] + "AA", ErrCodeTokenSignature},
+		{"other algorithm", signedToken(t, jwt.SigningMethodES256, ecKey, userID, now, now.Add(time.Hour)), ErrCodeTokenSignature},
+		{"alg none", unsigned, ErrCodeTokenSignature},
+	}
+	for _, tt := range tests {
+		for _, mode := range []string{"body", "header"} {
+			var got validateAnswer
+			var resp *http.Response
+			if mode == "body" {
+				resp = srv.do("POST", "/auth/validate", "", map[string]string{"token": tt.token}, &got)
+			} else {
+				resp = srv.do("GET", "/auth/validate", tt.token, nil, &got)
+			}
+			if resp.StatusCode != http.StatusUnauthorized || got.Error.Code != tt.code || got.Valid {
+				t.Errorf("%s token in the %s: status %d, code %q; want 401 %s", tt.name, mode, resp.StatusCode, got.Error.Code, tt.code)
+			}
+		}
+	}
+
+	// Neither input, or a header that is not a bearer token
+	for _, tt := range []struct{ authorization, code string }{{"", ErrCodeTokenMissing}, {"Basic dXNlcjpwYXNz", ErrCodeTokenMalformed}} {
+		req, _ := http.NewRequest("GET", srv.URL+"/auth/validate", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		var got validateAnswer
+		if resp := srv.send(req, &got); resp.StatusCode != http.StatusUnauthorized || got.Error.Code != tt.code {
+			t.Errorf("Authorization %q: status %d, code %q; want 401 %s", tt.authorization, resp.StatusCode, got.Error.Code, tt.code)
+		}
+	}
+}
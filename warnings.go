@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// SOFT VALIDATION WARNINGS
+// ============================================================================
+
+// Warning describes an adjustment made to what the client asked for. Creation, edit and
+// bulk-row responses carry them in a warnings array; clients may ignore it.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// ShortURL names another link the warning is about, when there is one
+	ShortURL string `json:"short_url,omitempty"`
+}
+
+// Warning codes
+const (
+	WarnTagsNormalized = "TAGS_NORMALIZED"
+	WarnCodeRenamed    = "CODE_RENAMED"
+	WarnExpiryClamped  = "EXPIRY_CLAMPED"
+	// WarnExpiredDuplicate is a notice rather than an adjustment: the new link's
+	// destination already has an expired link that reuse_expired would have revived
+	WarnExpiredDuplicate = "EXPIRED_DUPLICATE"
+	// WarnDestinationWarned is a notice that the destination is on the warn list of CONFIG_FILE
+	WarnDestinationWarned = "DESTINATION_WARNED"
+)
+
+// clampLinkExpiry caps an expiry at MAX_LINK_TTL from now, returning a warning when it did
+func clampLinkExpiry(expiry, now time.Time) (time.Time, *Warning) {
+	limit := maxLinkExpiry(now)
+	if !expiry.After(limit) {
+		return expiry, nil
+	}
+	return limit, &Warning{
+		Code:    WarnExpiryClamped,
+		Message: fmt.Sprintf("Expiry was capped at the maximum link lifetime: %s", limit.Format(time.RFC3339)),
+	}
+}
+
+// codeRenamedWarning reports that a requested code was taken and a suffix was added
+func codeRenamedWarning(requested, assigned string) Warning {
+	return Warning{
+		Code:    WarnCodeRenamed,
+		Message: fmt.Sprintf("Short code %q was already taken; %q was assigned instead", requested, assigned),
+	}
+}
+
+// expiredDuplicateWarning points out the owner's expired link to the same destination
+func expiredDuplicateWarning(code string) Warning {
+	return Warning{
+		Code:     WarnExpiredDuplicate,
+		Message:  fmt.Sprintf("Your expired short URL %q points to the same destination; send reuse_expired to revive it instead", code),
+		ShortURL: code,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// warningCodes returns the codes of warnings in order
+func warningCodes(warnings []Warning) []string {
+	codes := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		codes = append(codes, w.Code)
+	}
+	return codes
+}
+
+// hasWarning reports whether warnings holds code with a message
+func hasWarning(warnings []Warning, code string) bool {
+	for _, w := range warnings {
+		if w.Code == code && w.Message != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCreationWarnings(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	t.Setenv("MAX_LINK_TTL", "30d")
+	srv := newTestServer(t)
+	owner, _ := srv.register()
+	token, _ := srv.register()
+
+	var clean URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/clean", "tags": []string{"docs"}}, &clean)
+	if len(clean.Warnings) != 0 {
+		t.Fatalf("unadjusted request warned %v", warningCodes(clean.Warnings))
+	}
+	// The default expiry still respects MAX_LINK_TTL, without a warning
+	if clean.ExpiresAt == nil || !clean.ExpiresAt.Equal(clockTestBase.AddDate(0, 0, 30)) {
+		t.Fatalf("default expiry %v, want MAX_LINK_TTL from now", clean.ExpiresAt)
+	}
+
+	srv.shorten(owner, map[string]interface{}{"long-url": "https://example.com/first", "custom": "promo"})
+	var renamed URLData
+	if resp := srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/second", "custom": "promo"}, &renamed); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("taken custom code: status %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(renamed.ShortURL, "promo") || renamed.ShortURL == "promo" || !hasWarning(renamed.Warnings, WarnCodeRenamed) {
+		t.Fatalf("taken custom code: got %q with warnings %v", renamed.ShortURL, warningCodes(renamed.Warnings))
+	}
+
+	var clamped URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{
+		"long-url": "https://example.com/clamped",
+		"expires":  clockTestBase.AddDate(1, 0, 0).Format(time.RFC3339),
+	}, &clamped)
+	if !hasWarning(clamped.Warnings, WarnExpiryClamped) || clamped.ExpiresAt == nil || !clamped.ExpiresAt.Equal(clockTestBase.AddDate(0, 0, 30)) {
+		t.Fatalf("far expiry: expires %v with warnings %v", clamped.ExpiresAt, warningCodes(clamped.Warnings))
+	}
+
+	var normalized URLData
+	srv.do("PUT", "/url", token, map[string]interface{}{"long-url": "https://example.com/tags", "tags": []string{"Docs", "docs"}}, &normalized)
+	if !hasWarning(normalized.Warnings, WarnTagsNormalized) {
+		t.Fatalf("duplicate tags: warnings %v", warningCodes(normalized.Warnings))
+	}
+}
+
+func TestEditWarnings(t *testing.T) {
+	freezeClock(t, clockTestBase)
+	t.Setenv("MAX_LINK_TTL", "30d")
+	srv := newTestServer(t)
+	token, _ := srv.register()
+	code := srv.shorten(token, map[string]interface{}{"long-url": "https://example.com/edited"})
+
+	var edited URLData
+	srv.do("PATCH", "/url/"+code, token, map[string]interface{}{
+		"expires": clockTestBase.AddDate(1, 0, 0).Format(time.RFC3339),
+		"tags":    []string{" Release ", "release"},
+	}, &edited)
+	if !hasWarning(edited.Warnings, WarnExpiryClamped) || !hasWarning(edited.Warnings, WarnTagsNormalized) {
+		t.Fatalf("edit warnings %v", warningCodes(edited.Warnings))
+	}
+
+	edited = URLData{}
+	srv.do("PATCH", "/url/"+code, token, map[string]interface{}{"tags": []string{"release"}}, &edited)
+	if len(edited.Warnings) != 0 {
+		t.Fatalf("unadjusted edit warned %v", warningCodes(edited.Warnings))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ============================================================================
+// COORDINATED BACKGROUND WORKERS
+// ============================================================================
+
+const workerLeaseTTL = 5 * time.Minute
+
+// WorkerRun is the last-run metadata of a background worker, stored in worker_status
+type WorkerRun struct {
+	Name       string           `bson:"_id" json:"name"`
+	InstanceID string           `bson:"instance_id" json:"instance_id"`
+	StartedAt  time.Time        `bson:"started_at" json:"started_at"`
+	DurationMS int64            `bson:"duration_ms" json:"duration_ms"`
+	Counts     map[string]int64 `bson:"counts" json:"counts"`
+	Error      string           `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// runExclusive runs task on at most one instance per interval. The worker lease is renewed
+// while the task runs, so long runs keep it; if the holder dies the lease lapses after
+// workerLeaseTTL and another instance takes over on its next tick. Returns false when
+// another instance holds the lease.
+func runExclusive(name string, interval time.Duration, task func() (map[string]int64, error)) bool {
+	lockName := "worker:" + name
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	acquired, err := acquireLease(ctx, lockName, InstanceID, workerLeaseTTL)
+	cancel()
+	if err != nil {
+		log.Printf("Error acquiring %s lease: %v", name, err)
+		return false
+	}
+	if !acquired {
+		incMetric("worker_"+name+"_skipped_total", 1)
+		return false
+	}
+
+	// Renew the lease while the task is running
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(workerLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewCtx, renewCancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if ok, err := acquireLease(renewCtx, lockName, InstanceID, workerLeaseTTL); err != nil || !ok {
+					log.Printf("Warning: failed to renew %s lease: %v", name, err)
+				}
+				renewCancel()
+			}
+		}
+	}()
+
+	startedAt := time.Now().UTC()
+	counts, taskErr := task()
+	close(done)
+
+	run := WorkerRun{
+		Name:       name,
+		InstanceID: InstanceID,
+		StartedAt:  startedAt,
+		DurationMS: time.Since(startedAt).Milliseconds(),
+		Counts:     counts,
+	}
+	if taskErr != nil {
+		run.Error = taskErr.Error()
+		incMetric("worker_"+name+"_errors_total", 1)
+	}
+	incMetric("worker_"+name+"_runs_total", 1)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := DB.Database.Collection("worker_status").ReplaceOne(ctx, bson.M{"_id": name}, run,
+		options.Replace().SetUpsert(true)); err != nil {
+		log.Printf("Error recording %s run: %v", name, err)
+	}
+
+	// Hold the lease for the rest of the interval so other instances skip this tick
+	if remaining := interval - time.Since(startedAt) - interval/10; remaining > 0 {
+		if _, err := acquireLease(ctx, lockName, InstanceID, remaining); err != nil {
+			log.Printf("Warning: failed to extend %s lease: %v", name, err)
+		}
+	}
+
+	return true
+}
+
+// workerStatuses returns the last-run metadata of every coordinated worker
+func workerStatuses(ctx context.Context) []WorkerRun {
+	runs := []WorkerRun{}
+	if DB == nil || DB.Database == nil {
+		return runs
+	}
+	cursor, err := DB.Database.Collection("worker_status").Find(ctx, bson.D{})
+	if err != nil {
+		return runs
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &runs); err != nil {
+		log.Printf("Error decoding worker status: %v", err)
+	}
+	return runs
+}